@@ -20,6 +20,18 @@
 
 const fs = require('fs');
 
+// The version of the expects.json format. Bump this whenever harnesses need to
+// change to understand the output, e.g. for a new kind of expected result.
+//   1: Prose descriptions only.
+//   2: Adds machine-readable features to each expectation.
+//   3: Adds a clientAuth expectation, for verifying the leaf as a TLS client
+//      certificate.
+//   4: Adds derivedFrom to expectations taken from expectOverrides.json,
+//      whose WEAK-OK results needn't be explained by the features.
+//   5: Adds target to expectations whose test is verified against a hostname
+//      or IP of its own rather than the ones in config.json.
+const SUITE_VERSION = 5;
+
 const PASS = 0,
   WEAK_PASS = 1,
   FAIL = 2;
@@ -27,61 +39,220 @@ const PASS = 0,
 var config = JSON.parse(fs.readFileSync('config.json'));
 var manifest = JSON.parse(fs.readFileSync('certificates/manifest.json'));
 var expects = [];
+
+// Expectations derived from reference verifiers by the harness's derive-expects command, or curated by hand with its
+// expects command, keyed by the test's stable ID, or its ID in older corpora, and name type. Only proposals that have
+// been reviewed, and haven't since been deprecated, are applied.
+var expectOverrides = {};
+var expectOverridesFrom = [];
+var unreviewedOverrides = 0;
+if (fs.existsSync('expectOverrides.json')) {
+  var overridesFile = JSON.parse(fs.readFileSync('expectOverrides.json'));
+  expectOverridesFrom = overridesFile.verifiers;
+  overridesFile.overrides.forEach(function(override) {
+    if (override.deprecated) {
+      return;
+    }
+    if (!override.reviewed) {
+      unreviewedOverrides++;
+      return;
+    }
+    expectOverrides[(override.stableId || override.id) + ' ' + override.type] = override;
+  });
+}
+
+// Returns true if name is one of the configured IPs and it violates the
+// certificate's name constraints.
+function ipViolatesConstraints(certDef, name) {
+  var whitelist = certDef.nameConstraints.whitelist;
+  var blacklist = certDef.nameConstraints.blacklist;
+  return (name == config.ip && whitelist.indexOf(config.invalidIpSubtree) != -1)
+      || (name == config.ip && blacklist.indexOf(config.ipSubtree) != -1)
+      || (name == config.invalidIp && whitelist.indexOf(config.ipSubtree) != -1)
+      || (name == config.invalidIp && whitelist.indexOf(config.invalidIpSubtree) != -1);
+}
+
+// Returns true if name is one of the configured hostnames and it violates the
+// certificate's name constraints. DNS names are compared case-insensitively.
+function dnsViolatesConstraints(certDef, name) {
+  var whitelist = certDef.nameConstraints.whitelist.map(lowerCase);
+  var blacklist = certDef.nameConstraints.blacklist.map(lowerCase);
+  name = lowerCase(name);
+  return (name == config.hostname && whitelist.indexOf(config.invalidHostSubtree) != -1)
+      || (name == config.hostname && blacklist.indexOf(config.hostSubtree) != -1)
+      || (name == config.invalidHostname && whitelist.indexOf(config.hostSubtree) != -1)
+      || (name == config.invalidHostname && whitelist.indexOf(config.invalidHostSubtree) != -1);
+}
+
+function lowerCase(name) {
+  return typeof name == 'string' ? name.toLowerCase() : name;
+}
+
+// Returns the hostname and IP that a test is verified against: its own target, if the generator recorded one, or else
+// the ones in config.json.
+function testTarget(certDef) {
+  var target = certDef.target || {};
+  return {'hostname': target.hostname || config.hostname, 'ip': target.ip || config.ip};
+}
+
+// Returns true if the DNS name in a certificate matches hostname. As in RFC 6125 section 6.4.3, an asterisk may only
+// stand for all or part of the left-most label, and never for more than one label.
+function dnsNameMatches(certName, hostname) {
+  if (typeof certName != 'string') {
+    return false;
+  }
+  certName = certName.toLowerCase();
+  hostname = hostname.toLowerCase();
+  if (certName.indexOf('*') == -1) {
+    return certName == hostname;
+  }
+  var certLabels = certName.split('.');
+  var hostLabels = hostname.split('.');
+  if (certLabels.length != hostLabels.length || certLabels.slice(1).join('.').indexOf('*') != -1) {
+    return false;
+  }
+  if (certLabels.slice(1).join('.') != hostLabels.slice(1).join('.')) {
+    return false;
+  }
+  var pattern = certLabels[0].split('*');
+  var label = hostLabels[0];
+  return pattern.length == 2 && label.length >= pattern[0].length + pattern[1].length
+      && label.indexOf(pattern[0]) == 0 && label.slice(label.length - pattern[1].length) == pattern[1];
+}
+
+// Returns true if any of the SANs in the certificate matches name, which is a DNS name unless isIp is set.
+function sansMatch(certDef, name, isIp) {
+  return certDef.sans.some(function(san) {
+    return isIp ? san == name : dnsNameMatches(san, name);
+  });
+}
+
+// Verifier policy profiles. Unlike the OK/WEAK-OK/ERROR expectations, which
+// allow for variation between implementations, each profile resolves every
+// test to a definite result. New profiles only need a new entry here.
+//   cnFallback: When the common name is matched against the name being
+//               verified: 'never', 'noSan' (only without a SAN extension) or
+//               'always'.
+//   otherNameViolations: Whether a name constraint violation by a name
+//               other than the one being verified causes a rejection.
+//   cnConstraints: Whether name constraints apply to the common name when
+//               there's no SAN extension.
+const PROFILES = {
+  'rfcStrict': {'cnFallback': 'noSan', 'otherNameViolations': true, 'cnConstraints': true},
+  'browser': {'cnFallback': 'never', 'otherNameViolations': true, 'cnConstraints': true},
+  'legacyLenient': {'cnFallback': 'always', 'otherNameViolations': false, 'cnConstraints': false}
+};
+
+// Returns 'OK' or 'ERROR' for verifying name, which is either the test's
+// hostname or, if isIp is set, its IP, under the given profile.
+function profileResult(profile, certDef, name, isIp) {
+  var sanPresent = certDef.sans.length > 0;
+
+  var matched = sansMatch(certDef, name, isIp);
+  // CN fallback is only for DNS names, RFC 2818 requires IPs to be in the SAN extension.
+  if (!matched && certDef.commonName == name) {
+    matched = profile.cnFallback == 'always' || (profile.cnFallback == 'noSan' && !sanPresent && !isIp);
+  }
+  if (!matched) {
+    return 'ERROR';
+  }
+
+  var checked = certDef.sans.slice();
+  if (!sanPresent && profile.cnConstraints && certDef.commonName) {
+    checked.push(certDef.commonName);
+  }
+  if (!profile.otherNameViolations) {
+    checked = checked.filter(function(checkedName) { return isIp ? checkedName == name : dnsNameMatches(checkedName, name); });
+  }
+  // The local root's constraints also apply to the intermediate's names, which are never the one being verified.
+  if (certDef.intermediate) {
+    var intermediateSans = certDef.intermediate.sans || [];
+    checked = checked.concat(intermediateSans);
+    if (intermediateSans.length == 0 && profile.cnConstraints && certDef.intermediate.commonName) {
+      checked.push(certDef.intermediate.commonName);
+    }
+  }
+  var violation = checked.some(function(checkedName) {
+    return ipViolatesConstraints(certDef, checkedName) || dnsViolatesConstraints(certDef, checkedName);
+  });
+  return violation ? 'ERROR' : 'OK';
+}
+
 for (var i=0; i < manifest.certManifest.length; i++) {
   var certDef = manifest.certManifest[i];
+  var target = testTarget(certDef);
 
   var descriptions = [];
 
   var ncIpStatus = PASS;
   var ncDnsStatus = PASS;
+  var ipCnViolation = ipViolatesConstraints(certDef, certDef.commonName);
+  var dnsCnViolation = dnsViolatesConstraints(certDef, certDef.commonName);
+  var ipSanViolation = certDef.sans.some(function(san) { return ipViolatesConstraints(certDef, san); });
+  var dnsSanViolation = certDef.sans.some(function(san) { return dnsViolatesConstraints(certDef, san); });
   if (certDef.sans.length == 0) {
-    if ((certDef.commonName == config.ip && certDef.nameConstraints.whitelist.indexOf(config.invalidIpSubtree) != -1)
-        || (certDef.commonName == config.ip && certDef.nameConstraints.blacklist.indexOf(config.ipSubtree) != -1)
-        || (certDef.commonName == config.invalidIp && certDef.nameConstraints.whitelist.indexOf(config.ipSubtree) != -1)
-        || (certDef.commonName == config.invalidIp && certDef.nameConstraints.whitelist.indexOf(config.invalidIpSubtree) != -1)) {
+    if (ipCnViolation) {
       descriptions.push("The IP in the common name violates a name constraint.");
       ncIpStatus = FAIL;
     }
-    if ((certDef.commonName == config.hostname && certDef.nameConstraints.whitelist.indexOf(config.invalidHostSubtree) != -1)
-        || (certDef.commonName == config.hostname && certDef.nameConstraints.blacklist.indexOf(config.hostSubtree) != -1)
-        || (certDef.commonName == config.invalidHostname && certDef.nameConstraints.whitelist.indexOf(config.hostSubtree) != -1)
-        || (certDef.commonName == config.invalidHostname && certDef.nameConstraints.whitelist.indexOf(config.invalidHostSubtree) != -1)) {
+    if (dnsCnViolation) {
       descriptions.push("The DNS name in the common name violates a name constraint.");
       ncDnsStatus = FAIL;
     }
   } else {
     // If a common name is defined, many implementions ignore it in favor of SAN. So any violation on the common name amounts to a weak pass.
-    if ((certDef.commonName == config.ip && certDef.nameConstraints.whitelist.indexOf(config.invalidIpSubtree) != -1)
-        || (certDef.commonName == config.ip && certDef.nameConstraints.blacklist.indexOf(config.ipSubtree) != -1)
-        || (certDef.commonName == config.invalidIp && certDef.nameConstraints.whitelist.indexOf(config.ipSubtree) != -1)
-        || (certDef.commonName == config.invalidIp && certDef.nameConstraints.whitelist.indexOf(config.invalidIpSubtree) != -1)) {
+    if (ipCnViolation) {
       descriptions.push("The IP in the common name violates a name constraint. Because there is a SAN extension, this might be ignored.");
       ncIpStatus = WEAK_PASS;
     }
-    if ((certDef.commonName == config.hostname && certDef.nameConstraints.whitelist.indexOf(config.invalidHostSubtree) != -1)
-        || (certDef.commonName == config.hostname && certDef.nameConstraints.blacklist.indexOf(config.hostSubtree) != -1)
-        || (certDef.commonName == config.invalidHostname && certDef.nameConstraints.whitelist.indexOf(config.hostSubtree) != -1)
-        || (certDef.commonName == config.invalidHostname && certDef.nameConstraints.whitelist.indexOf(config.invalidHostSubtree) != -1)) {
+    if (dnsCnViolation) {
       descriptions.push("The DNS name in the common name violates a name constraint. Because there is a SAN extension, this might be ignored.");
       ncDnsStatus = WEAK_PASS;
     }
 
     // Hard fail if there is a violation on the SAN values.
-    if ((certDef.sans.indexOf(config.ip) != -1 && certDef.nameConstraints.whitelist.indexOf(config.invalidIpSubtree) != -1)
-        || (certDef.sans.indexOf(config.ip) != -1 && certDef.nameConstraints.blacklist.indexOf(config.ipSubtree) != -1)
-        || (certDef.sans.indexOf(config.invalidIp) != -1 && certDef.nameConstraints.whitelist.indexOf(config.ipSubtree) != -1)
-        || (certDef.sans.indexOf(config.invalidIp) != -1 && certDef.nameConstraints.whitelist.indexOf(config.invalidIpSubtree) != -1)) {
+    if (ipSanViolation) {
       descriptions.push("The IP in the SAN extension violates a name constraint.");
       ncIpStatus = FAIL;
     }
-    if ((certDef.sans.indexOf(config.hostname) != -1 && certDef.nameConstraints.whitelist.indexOf(config.invalidHostSubtree) != -1)
-        || (certDef.sans.indexOf(config.hostname) != -1 && certDef.nameConstraints.blacklist.indexOf(config.hostSubtree) != -1)
-        || (certDef.sans.indexOf(config.invalidHostname) != -1 && certDef.nameConstraints.whitelist.indexOf(config.hostSubtree) != -1)
-        || (certDef.sans.indexOf(config.invalidHostname) != -1 && certDef.nameConstraints.whitelist.indexOf(config.invalidHostSubtree) != -1)) {
+    if (dnsSanViolation) {
       descriptions.push("The DNS name in the SAN extension violates a name constraint.");
       ncDnsStatus = FAIL;
     }
   }
+
+  // Machine-readable equivalent of the descriptions, so that test harnesses
+  // don't have to match on the prose above.
+  var whitelist = certDef.nameConstraints.whitelist;
+  var blacklist = certDef.nameConstraints.blacklist;
+  var constraintType = 'none';
+  if (whitelist.length > 0 && blacklist.length > 0) {
+    constraintType = 'permitted+excluded';
+  } else if (whitelist.length > 0) {
+    constraintType = 'permitted';
+  } else if (blacklist.length > 0) {
+    constraintType = 'excluded';
+  }
+  var features = {
+    'sanPresent': certDef.sans.length > 0,
+    'dnsInCn': certDef.commonName == target.hostname,
+    'ipInCn': certDef.commonName == target.ip,
+    'dnsInSan': sansMatch(certDef, target.hostname, false),
+    'ipInSan': sansMatch(certDef, target.ip, true),
+    'dnsNamePresent': sansMatch(certDef, target.hostname, false) || [target.hostname, config.invalidHostname].some(function(name) {
+      return certDef.commonName == name || certDef.sans.indexOf(name) != -1;
+    }),
+    'ipNamePresent': [target.ip, config.invalidIp].some(function(name) {
+      return certDef.commonName == name || certDef.sans.indexOf(name) != -1;
+    }),
+    'dnsCnViolation': dnsCnViolation,
+    'ipCnViolation': ipCnViolation,
+    'dnsSanViolation': dnsSanViolation,
+    'ipSanViolation': ipSanViolation,
+    'dnsConstraintPresent': whitelist.indexOf(config.hostSubtree) != -1 || whitelist.indexOf(config.invalidHostSubtree) != -1,
+    'ipConstraintPresent': whitelist.indexOf(config.ipSubtree) != -1 || whitelist.indexOf(config.invalidIpSubtree) != -1,
+    'constraintType': constraintType
+  };
     
   var expect = {
     'ip': {
@@ -93,11 +264,22 @@ for (var i=0; i < manifest.certManifest.length; i++) {
       'descriptions': []
     }
   };
-  if (certDef.commonName != config.ip && certDef.sans.indexOf(config.ip) == -1) {
+  // The reasons for which a verifier may reject the certificate, in the terms of the harness's error taxonomy. A
+  // verifier may check name constraints while building the chain, before it matches the name, so a certificate that
+  // also violates a constraint may be rejected for either.
+  var anyViolation = ipCnViolation || dnsCnViolation || ipSanViolation || dnsSanViolation;
+  var mismatchReasons = anyViolation ? ['HOSTNAME_MISMATCH', 'NAME_CONSTRAINT_VIOLATION'] : ['HOSTNAME_MISMATCH'];
+  // A name that's only in the common name is never matched by verifiers that ignore it.
+  var violationReasons = function(name) {
+    return certDef.sans.indexOf(name) == -1 ? ['NAME_CONSTRAINT_VIOLATION', 'HOSTNAME_MISMATCH'] : ['NAME_CONSTRAINT_VIOLATION'];
+  };
+  if (certDef.commonName != target.ip && !sansMatch(certDef, target.ip, true)) {
     expect.ip.descriptions.push("The IP used as an origin is not listed in the CN or SAN extension.");
     expect.ip.expect = 'ERROR';
+    expect.ip.reasons = mismatchReasons;
   } else if (ncIpStatus == FAIL) {
     expect.ip.expect = 'ERROR';
+    expect.ip.reasons = violationReasons(target.ip);
   } else {
     // Expect a pass unless one of the below checks weakens the expectation
     expect.ip.expect = 'OK';
@@ -111,7 +293,7 @@ for (var i=0; i < manifest.certManifest.length; i++) {
     }
 
     // Weak-pass if the IP is in the CN but not in a SAN. Most browsers support this, but strictly it's against the RFC and some TLS stacks reject it.
-    if (certDef.commonName == config.ip && certDef.sans.indexOf(config.ip) == -1) {
+    if (certDef.commonName == target.ip && !sansMatch(certDef, target.ip, true)) {
       expect.ip.expect = 'WEAK-OK';
       expect.ip.descriptions.push("The IP is only contained in the CN of this certificate, which isn't permitted by RFC but which many implementations support.");
     }
@@ -119,20 +301,22 @@ for (var i=0; i < manifest.certManifest.length; i++) {
     // Weak-pass if there is a DNS name constraint and no DNS SAN
     if ((certDef.nameConstraints.whitelist.indexOf(config.hostSubtree) != -1
           || certDef.nameConstraints.whitelist.indexOf(config.invalidHostSubtree) != -1)
-        && certDef.commonName != config.hostname
+        && certDef.commonName != target.hostname
         && certDef.commonName != config.invalidHostname
-        && certDef.sans.indexOf(config.hostname) == -1
+        && !sansMatch(certDef, target.hostname, false)
         && certDef.sans.indexOf(config.invalidHostname) == -1) {
       expect.ip.expect = 'WEAK-OK';
       expect.ip.descriptions.push("There is a DNS name constraint but no DNS name in the certificate. This is allowed by the RFC, but some implementations will fail to validate the certificate.");
     }
   }
     
-  if (certDef.commonName != config.hostname && certDef.sans.indexOf(config.hostname) == -1) {
+  if (certDef.commonName != target.hostname && !sansMatch(certDef, target.hostname, false)) {
     expect.dns.descriptions.push("The DNS hostname used as an origin is not listed in the CN or SAN extension.");
     expect.dns.expect = 'ERROR';
+    expect.dns.reasons = mismatchReasons;
   } else if (ncDnsStatus == FAIL) {
     expect.dns.expect = 'ERROR';
+    expect.dns.reasons = violationReasons(target.hostname);
   } else {
     // Expect a pass unless one of the below checks weakens the expectation
     expect.dns.expect = 'OK';
@@ -145,7 +329,7 @@ for (var i=0; i < manifest.certManifest.length; i++) {
       expect.dns.descriptions.push("Althought the IP address is not the subject name in question, it's name constraint violation may still cause this certificate to be rejected.");
     }
 
-    if (certDef.commonName == config.hostname && certDef.sans.length > 0 && certDef.sans.indexOf(config.hostname) == -1) {
+    if (certDef.commonName == target.hostname && certDef.sans.length > 0 && !sansMatch(certDef, target.hostname, false)) {
       expect.dns.expect = 'WEAK-OK';
       expect.dns.descriptions.push("The DNS name for this certificate exists in the common name but not in the Subject Alternate Names extension even though the extension is specified. Most implementations will fail DNS-hostname validation on this certificate.");
     }
@@ -153,21 +337,471 @@ for (var i=0; i < manifest.certManifest.length; i++) {
     // Weak-pass if there is a IP name constraint and no IP SAN
     if ((certDef.nameConstraints.whitelist.indexOf(config.ipSubtree) != -1
           || certDef.nameConstraints.whitelist.indexOf(config.invalidIpSubtree) != -1)
-        && certDef.commonName != config.ip
+        && certDef.commonName != target.ip
         && certDef.commonName != config.invalidIp
-        && certDef.sans.indexOf(config.ip) == -1
+        && !sansMatch(certDef, target.ip, true)
         && certDef.sans.indexOf(config.invalidIp) == -1) {
       expect.dns.expect = 'WEAK-OK';
       expect.dns.descriptions.push("There is a IP name constraint but no IP in the certificate. This isn't an explicit violation, but some implementations will fail to validate the certificate.");
     }
   }
 
+  // A client certificate isn't matched against a name, so only the name constraints matter. Verifiers that ignore
+  // the common name accept it when only the common name violates them.
+  expect.clientAuth = {
+    'expect': 'OK',
+    'descriptions': []
+  };
+  if (ipSanViolation || dnsSanViolation) {
+    expect.clientAuth.expect = 'ERROR';
+    expect.clientAuth.descriptions.push("A name in the SAN extension violates a name constraint, which applies to client certificates as it does to server certificates.");
+    expect.clientAuth.reasons = ['NAME_CONSTRAINT_VIOLATION'];
+  } else if (ipCnViolation || dnsCnViolation) {
+    expect.clientAuth.expect = 'WEAK-OK';
+    expect.clientAuth.descriptions.push("Only the common name violates a name constraint. Verifiers that apply name constraints to the common name reject this certificate.");
+  }
+
+  // Reviewed expectations from expectOverrides.json override the derived ones, and are overridden by explicit ones.
+  ['ip', 'dns'].forEach(function(name) {
+    var override = expectOverrides[(certDef.stableId || certDef.id) + ' ' + name];
+    if (override) {
+      expect[name].expect = override.expect;
+      expect[name].descriptions = [override.description];
+      delete expect[name].reasons;
+      if (override.reasons && override.reasons.length) {
+        expect[name].reasons = override.reasons;
+      }
+      expect[name].derivedFrom = override.curated ? ['curated'] : expectOverridesFrom;
+    }
+  });
+
+  // Test cases declared with an explicit expectation (see TestCase.java) override the derived one.
+  if (certDef.expect) {
+    ['ip', 'dns'].forEach(function(name) {
+      if (certDef.expect[name]) {
+        expect[name].expect = certDef.expect[name].expect;
+        delete expect[name].derivedFrom;
+        expect[name].descriptions = [certDef.expect[name].description];
+        // The derived reasons don't apply to the declared expectation, so any reason is accepted unless it lists some.
+        delete expect[name].reasons;
+        if (certDef.expect[name].reasons && certDef.expect[name].reasons.length) {
+          expect[name].reasons = certDef.expect[name].reasons;
+        }
+        // Competing interpretations, each with the result it leads to and a reason code.
+        if (certDef.expect[name].interpretations && certDef.expect[name].interpretations.length) {
+          expect[name].interpretations = certDef.expect[name].interpretations;
+        }
+      }
+    });
+
+    // No name is being verified for a client certificate, so a name that violates the constraints can't be set
+    // aside as one that isn't being verified.
+    var anyNameViolates = ['ip', 'dns'].some(function(name) {
+      return certDef.expect[name] && (certDef.expect[name].interpretations || []).some(function(interpretation) {
+        return interpretation.reason == 'ANY_NAME_VIOLATES';
+      });
+    });
+    if (anyNameViolates) {
+      expect.clientAuth.expect = 'ERROR';
+      expect.clientAuth.descriptions = ["One of the names in the certificate violates a name constraint, and client certificates aren't verified against a particular name."];
+      expect.clientAuth.reasons = ['NAME_CONSTRAINT_VIOLATION'];
+    }
+    if (certDef.expect.clientAuth) {
+      expect.clientAuth.expect = certDef.expect.clientAuth.expect;
+      expect.clientAuth.descriptions = [certDef.expect.clientAuth.description];
+      delete expect.clientAuth.reasons;
+    }
+  }
+
+  var profiles = {};
+  Object.keys(PROFILES).forEach(function(profileName) {
+    profiles[profileName] = {
+      'dns': profileResult(PROFILES[profileName], certDef, target.hostname, false),
+      'ip': profileResult(PROFILES[profileName], certDef, target.ip, true)
+    };
+  });
+
   expects.push({
     'id': certDef.id,
+    // The generator's hash of the test's definition, which survives renumbering. It's missing from older corpora.
+    'stableId': certDef.stableId || null,
     'ip': expect.ip,
     'dns': expect.dns,
-    'descriptions': descriptions
+    'clientAuth': expect.clientAuth,
+    'descriptions': descriptions,
+    'features': features,
+    'profiles': profiles,
+    // The generator's dimension vector for the test, which reports pivot on. It's missing from older corpora.
+    'dimensions': certDef.dimensions || null,
+    // The RFC clauses that the test exercises, which the harness's coverage command scores by. It's missing from
+    // older corpora.
+    'clauses': certDef.clauses || null,
+    // The hostname and IP that the test is verified against, if they aren't the ones in config.json.
+    'target': certDef.target || null
   });
 }
 
-fs.writeFileSync('html/expects.json', JSON.stringify({'expects': expects}));
+fs.writeFileSync('html/expects.json', JSON.stringify({'suiteVersion': SUITE_VERSION, 'expects': expects}));
+if (unreviewedOverrides) {
+  console.warn(unreviewedOverrides + ' proposals in expectOverrides.json are not marked as reviewed, so were not applied.');
+}
+
+// The proxy certificate corpus is optional, see ProxyCertificateGenerator.
+if (fs.existsSync('certificates/proxy/manifest.json')) {
+  var proxyManifest = JSON.parse(fs.readFileSync('certificates/proxy/manifest.json'));
+  var proxyExpects = [];
+  for (var i=0; i < proxyManifest.proxyManifest.length; i++) {
+    var proxyDef = proxyManifest.proxyManifest[i];
+    proxyExpects.push({
+      'id': proxyDef.id,
+      // Verifiers without RFC 3820 support should reject every proxy certificate, since they are issued by an
+      // end-entity certificate and carry a critical extension that isn't understood.
+      'mainstream': {
+        'expect': 'ERROR',
+        'descriptions': ["Proxy certificates are issued by end-entity certificates, which isn't permitted outside of RFC 3820."]
+      },
+      'proxyAware': {
+        'expect': proxyDef.validProxy ? 'OK' : 'ERROR',
+        'descriptions': [proxyDef.description]
+      }
+    });
+  }
+  fs.writeFileSync('html/proxyExpects.json', JSON.stringify({'expects': proxyExpects}));
+}
+
+// The path building corpus is optional, see PathBuildingCertificateGenerator.
+if (fs.existsSync('certificates/pathbuilding/manifest.json')) {
+  var pathManifest = JSON.parse(fs.readFileSync('certificates/pathbuilding/manifest.json'));
+  var pathExpects = [];
+  for (var i=0; i < pathManifest.pathManifest.length; i++) {
+    var pathDef = pathManifest.pathManifest[i];
+    pathExpects.push({
+      'id': pathDef.id,
+      // A verifier that builds paths should find the valid path among the candidate intermediates whenever there is one.
+      'expect': pathDef.validPath ? 'OK' : 'ERROR',
+      'descriptions': [pathDef.description]
+    });
+  }
+  fs.writeFileSync('html/pathBuildingExpects.json', JSON.stringify({'expects': pathExpects}));
+}
+
+// The AIA corpus is optional, see AiaCertificateGenerator.
+if (fs.existsSync('certificates/aia/manifest.json')) {
+  var aiaManifest = JSON.parse(fs.readFileSync('certificates/aia/manifest.json'));
+  var aiaExpects = [];
+  for (var i=0; i < aiaManifest.aiaManifest.length; i++) {
+    var aiaDef = aiaManifest.aiaManifest[i];
+    aiaExpects.push({
+      'id': aiaDef.id,
+      // Verifiers that don't fetch missing issuers can't complete any of these chains.
+      'mainstream': {
+        'expect': 'ERROR',
+        'descriptions': ["The chain is incomplete without fetching issuers from the authority information access extension."]
+      },
+      'aiaAware': {
+        'expect': aiaDef.validWithAia ? 'OK' : 'ERROR',
+        'descriptions': [aiaDef.description]
+      }
+    });
+  }
+  fs.writeFileSync('html/aiaExpects.json', JSON.stringify({'expects': aiaExpects}));
+}
+
+// The malformed certificate corpus is optional, see MalformedCertificateGenerator.
+if (fs.existsSync('certificates/malformed/manifest.json')) {
+  var malformedManifest = JSON.parse(fs.readFileSync('certificates/malformed/manifest.json'));
+  var malformedExpects = [];
+  for (var i=0; i < malformedManifest.malformedManifest.length; i++) {
+    var malformedDef = malformedManifest.malformedManifest[i];
+    malformedExpects.push({
+      'id': malformedDef.id,
+      'expect': malformedDef.expect,
+      // The rule that the certificate breaks, if any.
+      'rule': malformedDef.rule || null,
+      'descriptions': [malformedDef.description]
+    });
+  }
+  fs.writeFileSync('html/malformedExpects.json', JSON.stringify({'expects': malformedExpects}));
+}
+
+// The IDN corpus is optional, see IdnCertificateGenerator.
+if (fs.existsSync('certificates/idn/manifest.json')) {
+  var idnManifest = JSON.parse(fs.readFileSync('certificates/idn/manifest.json'));
+  var idnExpects = [];
+  for (var i=0; i < idnManifest.idnManifest.length; i++) {
+    var idnDef = idnManifest.idnManifest[i];
+    idnExpects.push({
+      'id': idnDef.id,
+      // Each test is verified against its own name, in A-label form.
+      'hostname': idnDef.hostname,
+      'tld': idnDef.tld,
+      'expect': idnDef.expect,
+      'descriptions': [idnDef.description]
+    });
+  }
+  fs.writeFileSync('html/idnExpects.json', JSON.stringify({'expects': idnExpects}));
+}
+
+// The stress corpus is optional, see StressCertificateGenerator.
+if (fs.existsSync('certificates/stress/manifest.json')) {
+  var stressManifest = JSON.parse(fs.readFileSync('certificates/stress/manifest.json'));
+  var stressExpects = [];
+  for (var i=0; i < stressManifest.stressManifest.length; i++) {
+    var stressDef = stressManifest.stressManifest[i];
+    stressExpects.push({
+      'id': stressDef.id,
+      'sans': stressDef.sans,
+      'constraints': stressDef.constraints,
+      'expect': stressDef.expect,
+      'descriptions': [stressDef.description]
+    });
+  }
+  fs.writeFileSync('html/stressExpects.json', JSON.stringify({'expects': stressExpects}));
+}
+
+// The IP literal corpus is optional, see IpLiteralCertificateGenerator.
+if (fs.existsSync('certificates/ipliteral/manifest.json')) {
+  var ipLiteralManifest = JSON.parse(fs.readFileSync('certificates/ipliteral/manifest.json'));
+  var ipLiteralExpects = [];
+  for (var i=0; i < ipLiteralManifest.ipLiteralManifest.length; i++) {
+    var ipLiteralDef = ipLiteralManifest.ipLiteralManifest[i];
+    ipLiteralExpects.push({
+      'id': ipLiteralDef.id,
+      // Each test is verified against its own IP literal.
+      'hostname': ipLiteralDef.hostname,
+      'sanIp': ipLiteralDef.sanIp,
+      'form': ipLiteralDef.form,
+      'expect': ipLiteralDef.expect,
+      'descriptions': [ipLiteralDef.description]
+    });
+  }
+  fs.writeFileSync('html/ipLiteralExpects.json', JSON.stringify({'expects': ipLiteralExpects}));
+}
+
+if (fs.existsSync('certificates/ct/manifest.json')) {
+  var ctManifest = JSON.parse(fs.readFileSync('certificates/ct/manifest.json'));
+  var ctExpects = [];
+  for (var i=0; i < ctManifest.ctManifest.length; i++) {
+    var ctDef = ctManifest.ctManifest[i];
+    ctExpects.push({
+      'id': ctDef.id,
+      'delivery': ctDef.delivery,
+      'logs': ctDef.logs,
+      'badSignatureLogs': ctDef.badSignatureLogs,
+      // Clients that enforce CT require SCTs from two trusted logs.
+      'ctEnforcing': {
+        'expect': ctDef.expect,
+        'descriptions': [ctDef.description]
+      },
+      // Clients that don't enforce CT ignore SCTs, so every chain is valid.
+      'nonEnforcing': {
+        'expect': 'OK',
+        'descriptions': ['Clients that don\'t enforce Certificate Transparency ignore SCTs.']
+      }
+    });
+  }
+  fs.writeFileSync('html/ctExpects.json', JSON.stringify({'expects': ctExpects}));
+}
+
+if (fs.existsSync('certificates/policy/manifest.json')) {
+  var policyManifest = JSON.parse(fs.readFileSync('certificates/policy/manifest.json'));
+  var policyExpects = [];
+  for (var i=0; i < policyManifest.policyManifest.length; i++) {
+    var policyDef = policyManifest.policyManifest[i];
+    policyExpects.push({
+      'id': policyDef.id,
+      'name': policyDef.name,
+      'expect': policyDef.expect,
+      'descriptions': [policyDef.description]
+    });
+  }
+  fs.writeFileSync('html/policyExpects.json', JSON.stringify({'expects': policyExpects}));
+}
+
+// The S/MIME corpus is optional, see SmimeCertificateGenerator. Each test is
+// verified against an email address rather than a hostname.
+if (fs.existsSync('certificates/smime/manifest.json')) {
+  var smimeManifest = JSON.parse(fs.readFileSync('certificates/smime/manifest.json'));
+  var smimeExpects = [];
+  for (var i=0; i < smimeManifest.smimeManifest.length; i++) {
+    var smimeDef = smimeManifest.smimeManifest[i];
+    smimeExpects.push({
+      'id': smimeDef.id,
+      'name': smimeDef.name,
+      'email': smimeDef.email,
+      'expect': smimeDef.expect,
+      'descriptions': [smimeDef.description]
+    });
+  }
+  fs.writeFileSync('html/smimeExpects.json', JSON.stringify({'expects': smimeExpects}));
+}
+
+// The chain order corpus is optional, see ChainOrderCertificateGenerator.
+if (fs.existsSync('certificates/chainorder/manifest.json')) {
+  var chainOrderManifest = JSON.parse(fs.readFileSync('certificates/chainorder/manifest.json'));
+  var chainOrderExpects = [];
+  for (var i=0; i < chainOrderManifest.chainOrderManifest.length; i++) {
+    var chainOrderDef = chainOrderManifest.chainOrderManifest[i];
+    chainOrderExpects.push({
+      'id': chainOrderDef.id,
+      'name': chainOrderDef.name,
+      'presented': chainOrderDef.presented,
+      'expect': chainOrderDef.expect,
+      'descriptions': [chainOrderDef.description]
+    });
+  }
+  fs.writeFileSync('html/chainOrderExpects.json', JSON.stringify({'expects': chainOrderExpects}));
+}
+
+// The trust anchor corpus is optional, see TrustAnchorCertificateGenerator.
+if (fs.existsSync('certificates/trustanchor/manifest.json')) {
+  var trustAnchorManifest = JSON.parse(fs.readFileSync('certificates/trustanchor/manifest.json'));
+  var trustAnchorExpects = [];
+  for (var i=0; i < trustAnchorManifest.trustAnchorManifest.length; i++) {
+    var trustAnchorDef = trustAnchorManifest.trustAnchorManifest[i];
+    trustAnchorExpects.push({
+      'id': trustAnchorDef.id,
+      'name': trustAnchorDef.name,
+      'property': trustAnchorDef.property,
+      'rootProperties': trustAnchorDef.rootProperties,
+      'appliedExpect': trustAnchorDef.appliedExpect,
+      'ignoredExpect': trustAnchorDef.ignoredExpect,
+      'descriptions': [trustAnchorDef.description]
+    });
+  }
+  fs.writeFileSync('html/trustAnchorExpects.json', JSON.stringify({'expects': trustAnchorExpects}));
+}
+
+// The cross-sign corpus is optional, see CrossSignCertificateGenerator.
+if (fs.existsSync('certificates/crosssign/manifest.json')) {
+  var crossSignManifest = JSON.parse(fs.readFileSync('certificates/crosssign/manifest.json'));
+  var crossSignExpects = [];
+  for (var i=0; i < crossSignManifest.crossSignManifest.length; i++) {
+    var crossSignDef = crossSignManifest.crossSignManifest[i];
+    crossSignExpects.push({
+      'id': crossSignDef.id,
+      'name': crossSignDef.name,
+      'presented': crossSignDef.presented,
+      'trusted': crossSignDef.trusted,
+      'expect': crossSignDef.expect,
+      'descriptions': [crossSignDef.description]
+    });
+  }
+  fs.writeFileSync('html/crossSignExpects.json', JSON.stringify({'expects': crossSignExpects}));
+}
+
+// The distrust corpus is optional, see DistrustCertificateGenerator.
+if (fs.existsSync('certificates/distrust/manifest.json')) {
+  var distrustManifest = JSON.parse(fs.readFileSync('certificates/distrust/manifest.json'));
+  var distrustExpects = [];
+  for (var i=0; i < distrustManifest.distrustManifest.length; i++) {
+    var distrustDef = distrustManifest.distrustManifest[i];
+    distrustExpects.push({
+      'id': distrustDef.id,
+      'name': distrustDef.name,
+      'distrusted': distrustDef.distrusted,
+      'distrustedHashes': distrustDef.distrustedHashes,
+      'expect': distrustDef.expect,
+      'descriptions': [distrustDef.description]
+    });
+  }
+  fs.writeFileSync('html/distrustExpects.json', JSON.stringify({'expects': distrustExpects}));
+}
+
+// The depth corpus is optional, see DepthCertificateGenerator.
+if (fs.existsSync('certificates/depth/manifest.json')) {
+  var depthManifest = JSON.parse(fs.readFileSync('certificates/depth/manifest.json'));
+  var depthExpects = [];
+  for (var i=0; i < depthManifest.depthManifest.length; i++) {
+    var depthDef = depthManifest.depthManifest[i];
+    depthExpects.push({
+      'id': depthDef.id,
+      'intermediates': depthDef.intermediates,
+      'depth': depthDef.depth,
+      'expect': depthDef.expect,
+      'descriptions': [depthDef.description]
+    });
+  }
+  fs.writeFileSync('html/depthExpects.json', JSON.stringify({'expects': depthExpects}));
+}
+
+// The IDNA probe corpus is optional, see IdnaCertificateGenerator.
+if (fs.existsSync('certificates/idna/manifest.json')) {
+  var idnaManifest = JSON.parse(fs.readFileSync('certificates/idna/manifest.json'));
+  var idnaExpects = [];
+  for (var i=0; i < idnaManifest.idnaManifest.length; i++) {
+    var idnaDef = idnaManifest.idnaManifest[i];
+    idnaExpects.push({
+      'id': idnaDef.id,
+      'probe': idnaDef.probe,
+      'kind': idnaDef.kind,
+      'mapping': idnaDef.mapping,
+      // Hostname probes are verified against the U-label name.
+      'hostname': idnaDef.hostname,
+      'expect': idnaDef.expect,
+      'descriptions': [idnaDef.description]
+    });
+  }
+  fs.writeFileSync('html/idnaExpects.json', JSON.stringify({'expects': idnaExpects}));
+}
+
+// The serial collision corpus is optional, see SerialCollisionCertificateGenerator.
+if (fs.existsSync('certificates/serialcollision/manifest.json')) {
+  var serialCollisionManifest = JSON.parse(fs.readFileSync('certificates/serialcollision/manifest.json'));
+  var serialCollisionExpects = [];
+  for (var i=0; i < serialCollisionManifest.serialCollisionManifest.length; i++) {
+    var serialCollisionDef = serialCollisionManifest.serialCollisionManifest[i];
+    serialCollisionExpects.push({
+      'id': serialCollisionDef.id,
+      'name': serialCollisionDef.name,
+      'presented': serialCollisionDef.presented,
+      'selectable': serialCollisionDef.selectable,
+      'expect': serialCollisionDef.expect,
+      'descriptions': [serialCollisionDef.description]
+    });
+  }
+  fs.writeFileSync('html/serialCollisionExpects.json', JSON.stringify({'expects': serialCollisionExpects}));
+}
+
+// The key usage corpus is optional, see KeyUsageCertificateGenerator.
+if (fs.existsSync('certificates/keyusage/manifest.json')) {
+  var keyUsageManifest = JSON.parse(fs.readFileSync('certificates/keyusage/manifest.json'));
+  var keyUsageExpects = [];
+  for (var i=0; i < keyUsageManifest.keyUsageManifest.length; i++) {
+    var keyUsageDef = keyUsageManifest.keyUsageManifest[i];
+    keyUsageExpects.push({
+      'id': keyUsageDef.id,
+      'name': keyUsageDef.name,
+      'component': keyUsageDef.component,
+      // The intended usage, which test harnesses pass on to the verifier.
+      'keyExchange': keyUsageDef.keyExchange,
+      'crl': keyUsageDef.crl,
+      'issuerKeyUsage': keyUsageDef.issuerKeyUsage,
+      'leafKeyUsage': keyUsageDef.leafKeyUsage,
+      'expect': keyUsageDef.expect,
+      'descriptions': [keyUsageDef.description]
+    });
+  }
+  fs.writeFileSync('html/keyUsageExpects.json', JSON.stringify({'expects': keyUsageExpects}));
+}
+
+// The ALPACA corpus is optional, see AlpacaCertificateGenerator.
+if (fs.existsSync('certificates/alpaca/manifest.json')) {
+  var alpacaManifest = JSON.parse(fs.readFileSync('certificates/alpaca/manifest.json'));
+  var alpacaExpects = [];
+  for (var i=0; i < alpacaManifest.alpacaManifest.length; i++) {
+    var alpacaDef = alpacaManifest.alpacaManifest[i];
+    alpacaExpects.push({
+      'id': alpacaDef.id,
+      'name': alpacaDef.name,
+      // The protocol that the certificate was issued for, or https for
+      // the controls. Every test is verified for HTTPS.
+      'service': alpacaDef.service,
+      'keyPurposes': alpacaDef.keyPurposes,
+      'issuerKeyPurposes': alpacaDef.issuerKeyPurposes,
+      'expect': alpacaDef.expect,
+      'descriptions': [alpacaDef.description]
+    });
+  }
+  fs.writeFileSync('html/alpacaExpects.json', JSON.stringify({'expects': alpacaExpects}));
+}
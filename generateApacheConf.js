@@ -23,8 +23,27 @@ const fs = require('fs');
 var config = JSON.parse(fs.readFileSync('config.json'));
 var manifest = JSON.parse(fs.readFileSync('certificates/manifest.json'));
 var maxId = 1;
+var targetHostnames = {};
 for (var i=0; i < manifest.certManifest.length; i++) {
-  maxId = Math.max(maxId, manifest.certManifest[i].id);
+  var certDef = manifest.certManifest[i];
+  maxId = Math.max(maxId, certDef.id);
+  if (certDef.target && certDef.target.hostname) {
+    targetHostnames[certDef.id] = certDef.target.hostname;
+  }
+}
+
+// Returns the hostname that test id is served on by SNI. As in the generator, the test's hostname, or a target under
+// it, is moved under test-ID.hostname.
+function sniHostname(id) {
+  var name = targetHostnames[id] || config.hostname;
+  var suffix = '.' + config.hostname;
+  if (name == config.hostname) {
+    return 'test-' + id + '.' + config.hostname;
+  }
+  if (name.slice(-suffix.length) == suffix) {
+    return name.slice(0, -config.hostname.length) + 'test-' + id + '.' + config.hostname;
+  }
+  return name;
 }
 
 process.stdout.write("ServerName " + config.hostname + "\n");
@@ -46,3 +65,20 @@ for (var i=1; i<=maxId; i++) {
       + "</VirtualHost>\n");
 }
 
+// Corpora generated with perTestHostnames give each test its own hostname, so
+// their DNS tests can also be served on one port, picking the virtual host by
+// SNI.
+if (config.perTestHostnames) {
+  process.stdout.write("Listen 443\n");
+  for (var i=1; i<=maxId; i++) {
+    process.stdout.write("<VirtualHost *:443>\n"
+        + "  ServerName " + sniHostname(i) + "\n"
+        + "  DocumentRoot /apps/bettertls/test_html\n"
+        + "  Header set Access-Control-Allow-Origin \"*\"\n"
+        + "  SSLEngine on\n"
+        + "  SSLCertificateFile /apps/bettertls/certificates/" + i + ".crt\n"
+        + "  SSLCertificateKeyFile /apps/bettertls/certificates/" + i + ".key\n"
+        + "  SSLCertificateChainFile /apps/bettertls/certificates/" + i + ".chain\n"
+        + "</VirtualHost>\n");
+  }
+}
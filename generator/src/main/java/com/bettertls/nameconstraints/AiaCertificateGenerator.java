@@ -0,0 +1,162 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.asn1.x509.AccessDescription;
+import org.bouncycastle.asn1.x509.AuthorityInformationAccess;
+import org.bouncycastle.asn1.x509.Extension;
+import org.bouncycastle.asn1.x509.GeneralName;
+import org.bouncycastle.asn1.x509.GeneralNames;
+import org.bouncycastle.openssl.jcajce.JcaPEMWriter;
+import org.json.JSONArray;
+import org.json.JSONObject;
+
+import java.io.OutputStream;
+import java.io.OutputStreamWriter;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyStore;
+
+/**
+ * Generates chains that are missing intermediates, where the missing certificates can be fetched from the caIssuers
+ * URL in the authority information access extension (RFC 5280 section 4.2.2.1). The URLs point at a local HTTP server
+ * that test harnesses run while testing, serving the files in the issuers directory. These are only generated when
+ * running this class directly, e.g. with {@code gradle runAiaGenerator}.
+ *
+ * Verifiers that don't fetch issuers should reject every chain as incomplete.
+ */
+public class AiaCertificateGenerator {
+
+    // Where harnesses serve the issuers directory.
+    private static final String AIA_BASE_URL = "http://127.0.0.1:8642/";
+
+    public static void main(String[] args) throws Exception {
+
+        final JSONObject config = new JSONObject(new String(Files.readAllBytes(Paths.get("../config.json")), StandardCharsets.UTF_8));
+        final Path outputDir = Paths.get("../certificates/aia");
+        Files.createDirectories(outputDir.resolve("issuers"));
+
+        new AiaCertificateGenerator(config, outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
+    }
+
+    private final Path outputDir;
+    private final GeneratorOptions options;
+    private final String hostname;
+
+    private final JSONArray aiaManifest = new JSONArray();
+    private int nextCertId = 1;
+
+    private AiaCertificateGenerator(JSONObject config, Path outputDir, GeneratorOptions options) {
+        this.outputDir = outputDir;
+        this.options = options;
+        this.hostname = config.getString("hostname");
+    }
+
+    private void generateCertificates() throws Exception {
+
+        KeyStore rootCa = new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("AIA Test Root CA")
+                .setIsCa(true)
+                .build();
+        CertificateGenerator.writeCertificate(rootCa.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve("root.crt"));
+
+        KeyStore intermediate = makeIntermediate(rootCa, "AIA Test Intermediate CA", null);
+        writeIssuer(intermediate, "1.cer");
+        writeCase("The only intermediate is missing and can be fetched.", true,
+                makeLeaf(intermediate, "1.cer"));
+
+        KeyStore upper = makeIntermediate(rootCa, "AIA Test Upper Intermediate CA", null);
+        writeIssuer(upper, "2.cer");
+        KeyStore lower = makeIntermediate(upper, "AIA Test Lower Intermediate CA", "2.cer");
+        writeIssuer(lower, "3.cer");
+        writeCase("Both intermediates are missing and each can be fetched from the certificate it issued.", true,
+                makeLeaf(lower, "3.cer"));
+
+        writeCase("The lower intermediate is supplied, but the upper one is missing and can be fetched.", true,
+                makeLeaf(lower, "3.cer"), lower);
+
+        writeCase("The only intermediate is missing and the caIssuers URL doesn't serve a certificate.", false,
+                makeLeaf(intermediate, "missing.cer"));
+
+        final JSONObject manifest = new JSONObject();
+        manifest.put("aiaBaseUrl", AIA_BASE_URL);
+        manifest.put("aiaManifest", aiaManifest);
+        Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    private KeyStore makeIntermediate(KeyStore issuer, String commonName, String issuerFile) throws Exception {
+        KeyStoreGenerator generator = new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(issuer))
+                .setCommonName(commonName)
+                .setIsCa(true);
+        if (issuerFile != null) {
+            generator.addExtension(Extension.authorityInfoAccess, false, makeAia(issuerFile));
+        }
+        return generator.build();
+    }
+
+    private KeyStore makeLeaf(KeyStore issuer, String issuerFile) throws Exception {
+        return new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(issuer))
+                .setCommonName(hostname)
+                .setIsCa(false)
+                .setSubjectAlternateNames(new GeneralNames(new GeneralName(GeneralName.dNSName, hostname)))
+                .addExtension(Extension.authorityInfoAccess, false, makeAia(issuerFile))
+                .build();
+    }
+
+    private static AuthorityInformationAccess makeAia(String issuerFile) {
+        return new AuthorityInformationAccess(new AccessDescription(AccessDescription.id_ad_caIssuers,
+                new GeneralName(GeneralName.uniformResourceIdentifier, AIA_BASE_URL + issuerFile)));
+    }
+
+    /**
+     * Writes a certificate to the issuers directory, DER encoded as RFC 5280 requires.
+     */
+    private void writeIssuer(KeyStore issuer, String name) throws Exception {
+        Files.write(outputDir.resolve("issuers").resolve(name), issuer.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS).getEncoded());
+    }
+
+    /**
+     * Writes the leaf to {@code <id>.crt} and the supplied intermediates, which omit at least one of those needed, to
+     * {@code <id>.chain}.
+     */
+    private void writeCase(String description, boolean isValidWithAia, KeyStore leaf, KeyStore... supplied) throws Exception {
+        System.out.println("Generating AIA test " + nextCertId + "...");
+        CertificateGenerator.writeCertificate(leaf.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve(nextCertId + ".crt"));
+
+        try (OutputStream stream = Files.newOutputStream(outputDir.resolve(nextCertId + ".chain"));
+             OutputStreamWriter writer = new OutputStreamWriter(stream);
+             JcaPEMWriter pemWriter = new JcaPEMWriter(writer)) {
+            for (KeyStore intermediate : supplied) {
+                pemWriter.writeObject(intermediate.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS));
+            }
+        }
+
+        aiaManifest.put(new JSONObject()
+                .put("id", nextCertId)
+                .put("validWithAia", isValidWithAia)
+                .put("description", description)
+        );
+
+        nextCertId += 1;
+    }
+}
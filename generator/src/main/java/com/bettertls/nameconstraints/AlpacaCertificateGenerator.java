@@ -0,0 +1,272 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.asn1.ASN1Encodable;
+import org.bouncycastle.asn1.ASN1ObjectIdentifier;
+import org.bouncycastle.asn1.DERIA5String;
+import org.bouncycastle.asn1.DERSequence;
+import org.bouncycastle.asn1.DERTaggedObject;
+import org.bouncycastle.asn1.x509.ExtendedKeyUsage;
+import org.bouncycastle.asn1.x509.Extension;
+import org.bouncycastle.asn1.x509.GeneralName;
+import org.bouncycastle.asn1.x509.GeneralNames;
+import org.bouncycastle.asn1.x509.KeyPurposeId;
+import org.json.JSONArray;
+import org.json.JSONObject;
+
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyStore;
+import java.util.LinkedHashMap;
+import java.util.Map;
+
+/**
+ * Generates certificates for the hostname that were issued for services other than HTTPS, as in the ALPACA
+ * cross-protocol attacks, in which a TLS connection meant for a web server is redirected to a mail or FTP server that
+ * shares its name or its certificate. Leaves have the extended key usages of other protocols in place of serverAuth,
+ * or name the service with only an SRVName (RFC 4985) or a URI SAN, or only a service-specific host, and one case
+ * restricts the intermediate's extended key usage to email. Each is verified for HTTPS to the hostname, so a client
+ * that accepts one would accept that service's certificate from an attacker. These are only generated when running
+ * this class directly, e.g. with {@code gradle runAlpacaGenerator}.
+ */
+public class AlpacaCertificateGenerator {
+
+    /** id-on-dnsSRV, the otherName type of an SRVName (RFC 4985). */
+    private static final ASN1ObjectIdentifier SRV_NAME = new ASN1ObjectIdentifier("1.3.6.1.5.5.7.8.7");
+    /** id-kp-sipDomain (RFC 5924). */
+    private static final KeyPurposeId SIP_DOMAIN = KeyPurposeId.getInstance(new ASN1ObjectIdentifier("1.3.6.1.5.5.7.3.20"));
+    /** id-kp-secureShellServer (RFC 6187). */
+    private static final KeyPurposeId SSH_SERVER = KeyPurposeId.getInstance(new ASN1ObjectIdentifier("1.3.6.1.5.5.7.3.22"));
+
+    /** The names recorded in the manifest for each key purpose, as RFC 5280 and the RFCs above give them. */
+    private static final Map<KeyPurposeId, String> KEY_PURPOSE_NAMES = new LinkedHashMap<>();
+
+    static {
+        KEY_PURPOSE_NAMES.put(KeyPurposeId.id_kp_serverAuth, "serverAuth");
+        KEY_PURPOSE_NAMES.put(KeyPurposeId.id_kp_clientAuth, "clientAuth");
+        KEY_PURPOSE_NAMES.put(KeyPurposeId.id_kp_codeSigning, "codeSigning");
+        KEY_PURPOSE_NAMES.put(KeyPurposeId.id_kp_emailProtection, "emailProtection");
+        KEY_PURPOSE_NAMES.put(KeyPurposeId.id_kp_timeStamping, "timeStamping");
+        KEY_PURPOSE_NAMES.put(KeyPurposeId.id_kp_OCSPSigning, "OCSPSigning");
+        KEY_PURPOSE_NAMES.put(KeyPurposeId.id_kp_ipsecIKE, "ipsecIKE");
+        KEY_PURPOSE_NAMES.put(SIP_DOMAIN, "sipDomain");
+        KEY_PURPOSE_NAMES.put(SSH_SERVER, "secureShellServer");
+        KEY_PURPOSE_NAMES.put(KeyPurposeId.anyExtendedKeyUsage, "anyExtendedKeyUsage");
+    }
+
+    public static void main(String[] args) throws Exception {
+
+        final JSONObject config = new JSONObject(new String(Files.readAllBytes(Paths.get("../config.json")), StandardCharsets.UTF_8));
+        final Path outputDir = Paths.get("../certificates/alpaca");
+        Files.createDirectories(outputDir);
+
+        new AlpacaCertificateGenerator(config, outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
+    }
+
+    private final Path outputDir;
+    private final GeneratorOptions options;
+    private final String hostname;
+
+    private final JSONArray alpacaManifest = new JSONArray();
+    private KeyStore root;
+    private int nextCertId = 1;
+
+    private AlpacaCertificateGenerator(JSONObject config, Path outputDir, GeneratorOptions options) {
+        this.outputDir = outputDir;
+        this.options = options;
+        this.hostname = config.getString("hostname");
+    }
+
+    private void generateCertificates() throws Exception {
+
+        root = new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("ALPACA Test Root CA")
+                .setIsCa(true)
+                .build();
+        CertificateGenerator.writeCertificate(root.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve("root.crt"));
+
+        GeneralName dnsName = new GeneralName(GeneralName.dNSName, hostname);
+
+        // Controls, which are valid for HTTPS.
+        writeCase("serverAuth", "https", "OK",
+                "The leaf's extended key usage is serverAuth.",
+                new Leaf().keyPurposes(KeyPurposeId.id_kp_serverAuth));
+        writeCase("noExtendedKeyUsage", "https", "OK",
+                "The leaf has no extended key usage extension, so it isn't restricted to any purpose.",
+                new Leaf().keyPurposes());
+        writeCase("serverAuthAndEmail", "https", "OK",
+                "The leaf's extended key usage is serverAuth and emailProtection, as for a certificate shared by a web server and a mail server. It's valid for HTTPS, so only the server can defend against it being used for the wrong protocol.",
+                new Leaf().keyPurposes(KeyPurposeId.id_kp_serverAuth, KeyPurposeId.id_kp_emailProtection));
+        writeCase("anyExtendedKeyUsage", "https", "WEAK-OK",
+                "The leaf's extended key usage is anyExtendedKeyUsage, which RFC 5280 allows in place of serverAuth but the CA/Browser Forum's Baseline Requirements forbid in TLS server certificates.",
+                new Leaf().keyPurposes(KeyPurposeId.anyExtendedKeyUsage));
+
+        // Extended key usages of other protocols, without serverAuth.
+        writeCase("emailProtection", "smtp", "ERROR",
+                "The leaf's extended key usage is emailProtection, for S/MIME, without serverAuth (RFC 5280 section 4.2.1.12).",
+                new Leaf().keyPurposes(KeyPurposeId.id_kp_emailProtection));
+        writeCase("clientAuth", "tls-client", "ERROR",
+                "The leaf's extended key usage is clientAuth, for a TLS client, without serverAuth.",
+                new Leaf().keyPurposes(KeyPurposeId.id_kp_clientAuth));
+        writeCase("codeSigning", "code-signing", "ERROR",
+                "The leaf's extended key usage is codeSigning, without serverAuth.",
+                new Leaf().keyPurposes(KeyPurposeId.id_kp_codeSigning));
+        writeCase("timeStamping", "timestamping", "ERROR",
+                "The leaf's extended key usage is timeStamping, for a time stamping authority, without serverAuth.",
+                new Leaf().keyPurposes(KeyPurposeId.id_kp_timeStamping));
+        writeCase("ocspSigning", "ocsp", "ERROR",
+                "The leaf's extended key usage is OCSPSigning, for an OCSP responder, without serverAuth.",
+                new Leaf().keyPurposes(KeyPurposeId.id_kp_OCSPSigning));
+        writeCase("ipsecIke", "ipsec", "ERROR",
+                "The leaf's extended key usage is ipsecIKE, for an IKE peer (RFC 4945), without serverAuth.",
+                new Leaf().keyPurposes(KeyPurposeId.id_kp_ipsecIKE));
+        writeCase("sipDomain", "sip", "ERROR",
+                "The leaf's extended key usage is sipDomain, for a SIP domain (RFC 5924), without serverAuth.",
+                new Leaf().keyPurposes(SIP_DOMAIN));
+        writeCase("secureShellServer", "ssh", "ERROR",
+                "The leaf's extended key usage is secureShellServer, for an SSH server (RFC 6187), without serverAuth.",
+                new Leaf().keyPurposes(SSH_SERVER));
+
+        // Names of other services. The subject's common name is the hostname, but a client that falls back to it
+        // must not do so when the leaf has an SRV-ID or a URI-ID (RFC 6125 section 6.4.4).
+        writeCase("imapSrvNameOnly", "imap", "ERROR",
+                "The leaf's only SAN is the SRVName _imap." + hostname + " (RFC 4985), which names the IMAP service and not the host for HTTPS. The common name is the hostname, which RFC 6125 doesn't allow as a fallback when there's an SRV-ID.",
+                new Leaf().sans(srvName("_imap." + hostname)));
+        writeCase("sipUriOnly", "sip", "ERROR",
+                "The leaf's only SAN is the URI sip:" + hostname + " (RFC 5922), which names the SIP service and not the host for HTTPS. The common name is the hostname, which RFC 6125 doesn't allow as a fallback when there's a URI-ID.",
+                new Leaf().sans(new GeneralName(GeneralName.uniformResourceIdentifier, "sip:" + hostname)));
+        writeCase("serviceHostname", "ftp", "ERROR",
+                "The leaf's only DNS SAN is ftp." + hostname + ", the host of a service alongside the web server, which doesn't match the hostname.",
+                new Leaf().sans(new GeneralName(GeneralName.dNSName, "ftp." + hostname)));
+        writeCase("smtpSrvNameAndDnsName", "smtp", "OK",
+                "The leaf has the SRVName _smtp." + hostname + " alongside a DNS SAN for the hostname, which is valid for HTTPS.",
+                new Leaf().sans(dnsName, srvName("_smtp." + hostname)));
+
+        // Extended key usage of the intermediate.
+        writeCase("intermediateEmailProtection", "smtp", "ERROR",
+                "The intermediate's extended key usage is emailProtection, so the CA may only issue for email, but the leaf's is serverAuth. Verifiers that nest extended key usages, as most TLS clients do, reject it.",
+                new Leaf().keyPurposes(KeyPurposeId.id_kp_serverAuth).issuerKeyPurposes(KeyPurposeId.id_kp_emailProtection));
+        writeCase("intermediateServerAuth", "https", "OK",
+                "The intermediate's extended key usage, like the leaf's, is serverAuth.",
+                new Leaf().keyPurposes(KeyPurposeId.id_kp_serverAuth).issuerKeyPurposes(KeyPurposeId.id_kp_serverAuth));
+
+        final JSONObject manifest = new JSONObject();
+        manifest.put("alpacaManifest", alpacaManifest);
+        Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    /**
+     * Writes the leaf, issued by an intermediate with the leaf's issuer key purposes, to {@code <id>.crt} and
+     * {@code <id>.chain}, along with the leaf's key. {@code service} names the protocol the certificate was issued
+     * for, or "https" for the controls.
+     */
+    private void writeCase(String name, String service, String expect, String description, Leaf leaf) throws Exception {
+        System.out.println("Generating ALPACA test " + nextCertId + "...");
+
+        KeyStoreGenerator intermediateGenerator = new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(root))
+                .setCommonName("ALPACA Test Intermediate CA")
+                .setIsCa(true);
+        if (leaf.issuerKeyPurposes.length > 0) {
+            intermediateGenerator.addExtension(Extension.extendedKeyUsage, false, new ExtendedKeyUsage(leaf.issuerKeyPurposes));
+        }
+        KeyStore intermediate = intermediateGenerator.build();
+
+        CertificateGenerator.writeCertificateSet(leaf.generator(options, hostname)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(intermediate))
+                .build(), outputDir, Integer.toString(nextCertId));
+
+        alpacaManifest.put(new JSONObject()
+                .put("id", nextCertId)
+                .put("name", name)
+                .put("service", service)
+                .put("keyPurposes", keyPurposeNames(leaf.keyPurposes))
+                .put("issuerKeyPurposes", keyPurposeNames(leaf.issuerKeyPurposes))
+                .put("expect", expect)
+                .put("description", description)
+        );
+
+        nextCertId += 1;
+    }
+
+    /**
+     * Returns an SRVName otherName for {@code name}, e.g. "_imap.example.com" (RFC 4985).
+     */
+    private static GeneralName srvName(String name) {
+        return new GeneralName(GeneralName.otherName, new DERSequence(new ASN1Encodable[]{
+                SRV_NAME, new DERTaggedObject(true, 0, new DERIA5String(name))}));
+    }
+
+    /**
+     * Returns the names of {@code keyPurposes}, or null if there's no extension.
+     */
+    private static JSONArray keyPurposeNames(KeyPurposeId[] keyPurposes) {
+        if (keyPurposes.length == 0) {
+            return null;
+        }
+        JSONArray names = new JSONArray();
+        for (KeyPurposeId keyPurpose : keyPurposes) {
+            names.put(KEY_PURPOSE_NAMES.get(keyPurpose));
+        }
+        return names;
+    }
+
+    /**
+     * The names and extended key usage of a leaf, and the extended key usage of its issuer. By default the leaf has a
+     * DNS SAN for the hostname and the serverAuth key purpose, and its issuer has no extended key usage extension.
+     */
+    private static class Leaf {
+        private GeneralName[] sans;
+        private KeyPurposeId[] keyPurposes = {KeyPurposeId.id_kp_serverAuth};
+        private KeyPurposeId[] issuerKeyPurposes = {};
+
+        Leaf sans(GeneralName... sans) {
+            this.sans = sans;
+            return this;
+        }
+
+        /**
+         * Sets the extended key usage. With no key purposes, the leaf has no extended key usage extension.
+         */
+        Leaf keyPurposes(KeyPurposeId... keyPurposes) {
+            this.keyPurposes = keyPurposes;
+            return this;
+        }
+
+        Leaf issuerKeyPurposes(KeyPurposeId... issuerKeyPurposes) {
+            this.issuerKeyPurposes = issuerKeyPurposes;
+            return this;
+        }
+
+        KeyStoreGenerator generator(GeneratorOptions options, String hostname) {
+            KeyStoreGenerator generator = new KeyStoreGenerator(options)
+                    .setIsCa(false)
+                    .setCommonName(hostname)
+                    .setSubjectAlternateNames(new GeneralNames(sans != null ? sans : new GeneralName[]{new GeneralName(GeneralName.dNSName, hostname)}));
+            if (keyPurposes.length > 0) {
+                generator.addExtension(Extension.extendedKeyUsage, false, new ExtendedKeyUsage(keyPurposes));
+            }
+            return generator;
+        }
+    }
+}
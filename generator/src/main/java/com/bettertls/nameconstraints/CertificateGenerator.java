@@ -18,15 +18,21 @@
 
 package com.bettertls.nameconstraints;
 
+import org.bouncycastle.asn1.DEROctetString;
 import org.bouncycastle.asn1.x509.GeneralName;
 import org.bouncycastle.asn1.x509.GeneralNames;
 import org.bouncycastle.asn1.x509.GeneralSubtree;
 import org.bouncycastle.asn1.x509.NameConstraints;
 import org.bouncycastle.openssl.jcajce.JcaPEMWriter;
+import org.bouncycastle.util.encoders.Hex;
 import org.json.JSONArray;
 import org.json.JSONObject;
 
+import java.io.BufferedReader;
+import java.io.ByteArrayOutputStream;
 import java.io.IOException;
+import java.io.InputStream;
+import java.io.InputStreamReader;
 import java.io.OutputStream;
 import java.io.OutputStreamWriter;
 import java.nio.charset.StandardCharsets;
@@ -35,15 +41,27 @@ import java.nio.file.Path;
 import java.nio.file.Paths;
 import java.security.KeyStore;
 import java.security.KeyStoreException;
+import java.security.MessageDigest;
 import java.security.NoSuchAlgorithmException;
 import java.security.UnrecoverableEntryException;
 import java.security.cert.Certificate;
 import java.security.cert.CertificateEncodingException;
+import java.security.cert.CertificateException;
+import java.security.cert.CertificateFactory;
 import java.util.ArrayList;
+import java.util.Collection;
+import java.util.HashSet;
 import java.util.List;
+import java.util.Set;
+import java.util.TreeSet;
 
 public class CertificateGenerator {
 
+    /**
+     * The number of tests that the smoke profile is topped up to.
+     */
+    private static final int SMOKE_PROFILE_SIZE = 100;
+
     public static void main(String[] args) throws Exception {
 
         final Path outputDir = Paths.get("../certificates");
@@ -53,10 +71,11 @@ public class CertificateGenerator {
 
         final JSONObject config = new JSONObject(new String(Files.readAllBytes(Paths.get("../config.json")), StandardCharsets.UTF_8));
 
-        new CertificateGenerator(config, outputDir).generateCertificates();
+        new CertificateGenerator(config, outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
     }
 
     private final Path outputDir;
+    private final GeneratorOptions options;
     private final String hostname;
     private final String ip;
     private final String hostSubtree;
@@ -65,12 +84,17 @@ public class CertificateGenerator {
     private final String invalidIp;
     private final String invalidHostSubtree;
     private final String invalidIpSubtree;
+    private final int corpusVersion;
+    private final boolean perTestHostnames;
+    private final JSONObject config;
 
     private final JSONArray certManifest = new JSONArray();
+    private final Set<String> definitions = new HashSet<>();
     private int nextCertId = 1;
 
-    private CertificateGenerator(JSONObject config, Path outputDir) {
+    private CertificateGenerator(JSONObject config, Path outputDir, GeneratorOptions options) {
         this.outputDir = outputDir;
+        this.options = options;
 
         this.hostname = config.getString("hostname");
         this.ip = config.getString("ip");
@@ -81,11 +105,14 @@ public class CertificateGenerator {
         this.invalidIp = config.getString("invalidIp");
         this.invalidHostSubtree = config.getString("invalidHostSubtree");
         this.invalidIpSubtree = config.getString("invalidIpSubtree");
+        this.corpusVersion = config.getInt("testVersion");
+        this.perTestHostnames = config.optBoolean("perTestHostnames", false);
+        this.config = config;
     }
 
     private void generateCertificates() throws Exception {
 
-        KeyStore rootCa = new KeyStoreGenerator()
+        KeyStore rootCa = new KeyStoreGenerator(options)
                 .setCaKeyEntry(null)
                 .setCommonName("Name Constraints Test Root CA")
                 .setIsCa(true)
@@ -103,110 +130,534 @@ public class CertificateGenerator {
             }
         }
 
+        for (TestCase testCase : TestCases.extraCases(config)) {
+            generateCase(rootCa, testCase);
+        }
+
+        writeDerCorpus();
+
         final JSONObject manifest = new JSONObject();
+        manifest.put("corpusVersion", corpusVersion);
+        manifest.put("generatorCommit", getGeneratorCommit());
+        manifest.put("perTestHostnames", perTestHostnames);
+        manifest.put("count", certManifest.length());
+        manifest.put("files", hashCorpusFiles());
         manifest.put("certManifest", certManifest);
+        manifest.put("profiles", makeProfiles());
         Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
     }
 
     private void generateCertificatesWithNames(KeyStore rootCa, String commonName, String dnsSan, String ipSan) throws Exception {
+        for (String ncIpWhitelist : new String[] { null, ipSubtree, invalidIpSubtree }) {
+            for (String ncDnsWhitelist : new String[] { null, hostSubtree, invalidHostSubtree }) {
+                for (String ncIpBlacklist : new String[] { null, ipSubtree, invalidIpSubtree }) {
+                    for (String ncDnsBlacklist : new String[]{null, hostSubtree, invalidHostSubtree }) {
+                        generateCase(rootCa, TestCase.builder()
+                                .commonName(commonName)
+                                .dnsSans(dnsSan)
+                                .ipSans(ipSan)
+                                .permittedIps(ncIpWhitelist)
+                                .permittedDns(ncDnsWhitelist)
+                                .excludedIps(ncIpBlacklist)
+                                .excludedDns(ncDnsBlacklist)
+                                .build());
+                    }
+                }
+            }
+        }
+    }
+
+    private void generateCase(KeyStore rootCa, TestCase testCase) throws Exception {
 
         GeneralNames sans = null;
-        if (dnsSan != null || ipSan != null) {
+        if (!testCase.dnsSans.isEmpty() || !testCase.ipSans.isEmpty()) {
             List<GeneralName> generalNames = new ArrayList<>();
-            if (dnsSan != null) {
-                generalNames.add(new GeneralName(GeneralName.dNSName, dnsSan));
+            for (String dnsSan : testCase.dnsSans) {
+                generalNames.add(new GeneralName(GeneralName.dNSName, leafHostname(dnsSan)));
             }
-            if (ipSan != null) {
+            for (String ipSan : testCase.ipSans) {
                 generalNames.add(new GeneralName(GeneralName.iPAddress, ipSan));
             }
             sans = new GeneralNames(generalNames.toArray(new GeneralName[generalNames.size()]));
         }
 
-        for (String ncIpWhitelist : new String[] { null, ipSubtree, invalidIpSubtree }) {
-            for (String ncDnsWhitelist : new String[] { null, hostSubtree, invalidHostSubtree }) {
+        List<GeneralSubtree> permittedWhitelist = makeSubtrees(testCase.permittedIps, testCase.permittedDns);
+        List<GeneralSubtree> permittedBlacklist = makeSubtrees(testCase.excludedIps, testCase.excludedDns);
+
+        NameConstraints nameConstraints = null;
+        if (permittedWhitelist.size() != 0 || permittedBlacklist.size() != 0) {
+            nameConstraints = new NameConstraints(
+                    permittedWhitelist.size() == 0 ? null : permittedWhitelist.toArray(new GeneralSubtree[permittedWhitelist.size()]),
+                    permittedBlacklist.size() == 0 ? null : permittedBlacklist.toArray(new GeneralSubtree[permittedBlacklist.size()]));
+        }
 
-                List<GeneralSubtree> permittedWhitelist = new ArrayList<>();
-                if (ncIpWhitelist != null) {
-                    permittedWhitelist.add(new GeneralSubtree(new GeneralName(GeneralName.iPAddress, ncIpWhitelist)));
+        GeneralNames intermediateSans = null;
+        if (!testCase.intermediateDnsSans.isEmpty() || !testCase.intermediateIpSans.isEmpty()) {
+            List<GeneralName> generalNames = new ArrayList<>();
+            for (String dnsSan : testCase.intermediateDnsSans) {
+                generalNames.add(new GeneralName(GeneralName.dNSName, dnsSan));
+            }
+            for (String ipSan : testCase.intermediateIpSans) {
+                generalNames.add(new GeneralName(GeneralName.iPAddress, ipSan));
+            }
+            intermediateSans = new GeneralNames(generalNames.toArray(new GeneralName[generalNames.size()]));
+        }
+
+        System.out.println("Generating certificate " + nextCertId + "...");
+        writeCertificateSet(makeTree(options, nextCertId, rootCa, nameConstraints, testCase.intermediateCommonName, intermediateSans,
+                leafHostname(testCase.commonName), sans), outputDir, Integer.toString(nextCertId));
+
+        // Build a manifest JSON entry for the certificate
+        JSONArray manifestSans = new JSONArray();
+        for (String dnsSan : testCase.dnsSans) {
+            manifestSans.put(dnsSan);
+        }
+        for (String ipSan : testCase.ipSans) {
+            manifestSans.put(ipSan);
+        }
+        JSONObject manifestNcs = new JSONObject();
+        JSONArray manifestNcWhitelist = new JSONArray();
+        for (String subtree : testCase.permittedDns) {
+            manifestNcWhitelist.put(subtree);
+        }
+        for (String subtree : testCase.permittedIps) {
+            manifestNcWhitelist.put(subtree);
+        }
+        JSONArray manifestNcBlacklist = new JSONArray();
+        for (String subtree : testCase.excludedDns) {
+            manifestNcBlacklist.put(subtree);
+        }
+        for (String subtree : testCase.excludedIps) {
+            manifestNcBlacklist.put(subtree);
+        }
+        manifestNcs.put("whitelist", manifestNcWhitelist);
+        manifestNcs.put("blacklist", manifestNcBlacklist);
+
+        JSONObject manifestEntry = new JSONObject()
+                .put("id", nextCertId)
+                .put("commonName", testCase.commonName)
+                .put("sans", manifestSans)
+                .put("nameConstraints", manifestNcs)
+                .put("dimensions", makeDimensions(testCase))
+                .put("clauses", makeClauses(testCase));
+        // Only cases that name the intermediate record it, so that the definitions of the others don't change.
+        if (testCase.intermediateCommonName != null || intermediateSans != null) {
+            JSONArray intermediateManifestSans = new JSONArray();
+            for (String dnsSan : testCase.intermediateDnsSans) {
+                intermediateManifestSans.put(dnsSan);
+            }
+            for (String ipSan : testCase.intermediateIpSans) {
+                intermediateManifestSans.put(ipSan);
+            }
+            manifestEntry.put("intermediate", new JSONObject()
+                    .put("commonName", testCase.intermediateCommonName)
+                    .put("sans", intermediateManifestSans));
+        }
+        if (testCase.dnsExpect != null || testCase.ipExpect != null || testCase.clientAuthExpect != null) {
+            JSONObject manifestExpect = new JSONObject();
+            if (testCase.dnsExpect != null) {
+                manifestExpect.put("dns", new JSONObject()
+                        .put("expect", testCase.dnsExpect.result)
+                        .put("description", testCase.dnsExpect.description)
+                        .put("interpretations", makeInterpretations(testCase.dnsInterpretations))
+                        .put("reasons", new JSONArray(testCase.dnsReasons)));
+            }
+            if (testCase.ipExpect != null) {
+                manifestExpect.put("ip", new JSONObject()
+                        .put("expect", testCase.ipExpect.result)
+                        .put("description", testCase.ipExpect.description)
+                        .put("interpretations", makeInterpretations(testCase.ipInterpretations))
+                        .put("reasons", new JSONArray(testCase.ipReasons)));
+            }
+            if (testCase.clientAuthExpect != null) {
+                manifestExpect.put("clientAuth", new JSONObject()
+                        .put("expect", testCase.clientAuthExpect.result)
+                        .put("description", testCase.clientAuthExpect.description));
+            }
+            manifestEntry.put("expect", manifestExpect);
+        }
+        // Likewise, only cases with a target of their own record it, and the harness verifies the others against the
+        // hostname and IP in config.json.
+        if (testCase.targetHostname != null || testCase.targetIp != null) {
+            manifestEntry.put("target", new JSONObject()
+                    .put("hostname", testCase.targetHostname)
+                    .put("ip", testCase.targetIp));
+        }
+
+        // IDs are matched across corpus versions by the definitions of their tests, so each must be unique.
+        JSONObject definition = new JSONObject(manifestEntry.toString());
+        definition.remove("id");
+        definition.remove("dimensions");
+        definition.remove("clauses");
+        if (!definitions.add(definition.toString())) {
+            throw new IllegalStateException("Test case " + nextCertId + " has the same definition as an earlier one");
+        }
+        manifestEntry.put("stableId", stableId(definition));
+        certManifest.put(manifestEntry);
+
+        nextCertId += 1;
+    }
+
+    /**
+     * Returns the stable ID of a test: the first 16 hex digits of the SHA-256 hash of its definition, as canonical
+     * JSON. Unlike the test's number, it doesn't change when tests are added or removed, so results can be matched
+     * across corpus versions. The Go harness's stable-ids command computes the same IDs from manifest.json.
+     */
+    static String stableId(JSONObject definition) throws NoSuchAlgorithmException {
+        StringBuilder canonical = new StringBuilder();
+        writeCanonicalJson(definition, canonical);
+        MessageDigest digest = MessageDigest.getInstance("SHA-256");
+        return Hex.toHexString(digest.digest(canonical.toString().getBytes(StandardCharsets.UTF_8))).substring(0, 16);
+    }
+
+    /**
+     * Writes value as JSON with sorted keys, escaping strings as Go's encoding/json does, so that the harness hashes
+     * the same bytes.
+     */
+    private static void writeCanonicalJson(Object value, StringBuilder out) {
+        if (value instanceof JSONObject) {
+            JSONObject object = (JSONObject) value;
+            out.append('{');
+            boolean first = true;
+            for (String key : new TreeSet<>(object.keySet())) {
+                if (!first) {
+                    out.append(',');
                 }
-                if (ncDnsWhitelist != null) {
-                    permittedWhitelist.add(new GeneralSubtree(new GeneralName(GeneralName.dNSName, ncDnsWhitelist)));
+                first = false;
+                writeCanonicalString(key, out);
+                out.append(':');
+                writeCanonicalJson(object.get(key), out);
+            }
+            out.append('}');
+        } else if (value instanceof JSONArray) {
+            JSONArray array = (JSONArray) value;
+            out.append('[');
+            for (int i = 0; i < array.length(); i++) {
+                if (i > 0) {
+                    out.append(',');
                 }
+                writeCanonicalJson(array.get(i), out);
+            }
+            out.append(']');
+        } else if (value instanceof String) {
+            writeCanonicalString((String) value, out);
+        } else if (value == null || value == JSONObject.NULL) {
+            out.append("null");
+        } else {
+            out.append(value.toString());
+        }
+    }
 
-                for (String ncIpBlacklist : new String[] { null, ipSubtree, invalidIpSubtree }) {
-                    for (String ncDnsBlacklist : new String[]{null, hostSubtree, invalidHostSubtree }) {
-
-                        List<GeneralSubtree> permittedBlacklist = new ArrayList<>();
-                        if (ncIpBlacklist != null) {
-                            permittedBlacklist.add(new GeneralSubtree(new GeneralName(GeneralName.iPAddress, ncIpBlacklist)));
-                        }
-                        if (ncDnsBlacklist != null) {
-                            permittedBlacklist.add(new GeneralSubtree(new GeneralName(GeneralName.dNSName, ncDnsBlacklist)));
-                        }
-
-                        NameConstraints nameConstraints = null;
-                        if (permittedWhitelist.size() != 0 || permittedBlacklist.size() != 0) {
-                            nameConstraints = new NameConstraints(
-                                    permittedWhitelist.size() == 0 ? null : permittedWhitelist.toArray(new GeneralSubtree[permittedWhitelist.size()]),
-                                    permittedBlacklist.size() == 0 ? null : permittedBlacklist.toArray(new GeneralSubtree[permittedBlacklist.size()]));
-                        }
-
-                        System.out.println("Generating certificate " + nextCertId + "...");
-                        writeCertificateSet(makeTree(nextCertId, rootCa, nameConstraints, commonName, sans), outputDir, Integer.toString(nextCertId));
-
-                        // Build a manifest JSON entry for the certificate
-                        JSONArray manifestSans = new JSONArray();
-                        if (dnsSan != null) {
-                            manifestSans.put(dnsSan);
-                        }
-                        if (ipSan != null) {
-                            manifestSans.put(ipSan);
-                        }
-                        JSONObject manifestNcs = new JSONObject();
-                        JSONArray manifestNcWhitelist = new JSONArray();
-                        if (ncDnsWhitelist != null) {
-                            manifestNcWhitelist.put(ncDnsWhitelist);
-                        }
-                        if (ncIpWhitelist != null) {
-                            manifestNcWhitelist.put(ncIpWhitelist);
-                        }
-                        JSONArray manifestNcBlacklist = new JSONArray();
-                        if (ncDnsBlacklist != null) {
-                            manifestNcBlacklist.put(ncDnsBlacklist);
-                        }
-                        if (ncIpBlacklist != null) {
-                            manifestNcBlacklist.put(ncIpBlacklist);
-                        }
-                        manifestNcs.put("whitelist", manifestNcWhitelist);
-                        manifestNcs.put("blacklist", manifestNcBlacklist);
-
-                        certManifest.put(new JSONObject()
-                                .put("id", nextCertId)
-                                .put("commonName", commonName)
-                                .put("sans", manifestSans)
-                                .put("nameConstraints", manifestNcs)
-                        );
-
-                        nextCertId += 1;
+    private static void writeCanonicalString(String s, StringBuilder out) {
+        out.append('"');
+        for (int i = 0; i < s.length(); i++) {
+            char c = s.charAt(i);
+            switch (c) {
+                case '"':
+                    out.append("\\\"");
+                    break;
+                case '\\':
+                    out.append("\\\\");
+                    break;
+                case '\n':
+                    out.append("\\n");
+                    break;
+                case '\r':
+                    out.append("\\r");
+                    break;
+                case '\t':
+                    out.append("\\t");
+                    break;
+                default:
+                    if (c < 0x20 || c == '<' || c == '>' || c == '&' || c == '\u2028' || c == '\u2029') {
+                        out.append(String.format("\\u%04x", (int) c));
+                    } else {
+                        out.append(c);
                     }
+            }
+        }
+        out.append('"');
+    }
+
+    /**
+     * Returns the name to put in the leaf of the current test in place of name. With perTestHostnames set in
+     * config.json, the hostname is replaced by test-ID.hostname, so that a server can pick each test's certificate by
+     * SNI and serve the whole corpus on one port. Names under the hostname, such as a wildcard or a custom target,
+     * are moved under test-ID.hostname with it, so that they still match. The new names are still within hostSubtree
+     * and outside invalidHostSubtree, so the expected results don't change, and the manifest records the configured
+     * names so that test definitions don't either.
+     */
+    private String leafHostname(String name) {
+        if (perTestHostnames && hostname.equals(name)) {
+            return "test-" + nextCertId + "." + hostname;
+        }
+        if (perTestHostnames && name != null && name.endsWith("." + hostname)) {
+            return name.substring(0, name.length() - hostname.length()) + "test-" + nextCertId + "." + hostname;
+        }
+        return name;
+    }
+
+    /**
+     * Returns the profiles that only have some of the tests, which the harness runs with -profile, mapped to their
+     * IDs. The smoke profile has the first test with each value of each dimension, topped up to SMOKE_PROFILE_SIZE
+     * tests spread evenly over the corpus, so that it's a quick check of every feature. The harness defines the full
+     * and stress profiles, which have every test.
+     */
+    private JSONObject makeProfiles() {
+        Set<String> covered = new HashSet<>();
+        TreeSet<Integer> smoke = new TreeSet<>();
+        for (int i = 0; i < certManifest.length(); i++) {
+            JSONObject entry = certManifest.getJSONObject(i);
+            JSONObject dimensions = entry.getJSONObject("dimensions");
+            for (String dimension : dimensions.keySet()) {
+                if (covered.add(dimension + "=" + dimensions.getString(dimension))) {
+                    smoke.add(entry.getInt("id"));
+                }
+            }
+        }
+        int count = certManifest.length();
+        for (int i = 0; i < SMOKE_PROFILE_SIZE && smoke.size() < Math.min(SMOKE_PROFILE_SIZE, count); i++) {
+            smoke.add(1 + (int) ((long) i * count / SMOKE_PROFILE_SIZE));
+        }
+
+        return new JSONObject().put("smoke", new JSONArray(smoke));
+    }
+
+    /**
+     * Returns the dimension vector of a test case, which reports pivot on to show which kinds of certificate an
+     * implementation gets wrong.
+     */
+    private JSONObject makeDimensions(TestCase testCase) {
+        List<String> sanTypes = new ArrayList<>();
+        if (!testCase.dnsSans.isEmpty()) {
+            sanTypes.add("dns");
+        }
+        if (!testCase.ipSans.isEmpty()) {
+            sanTypes.add("ip");
+        }
+
+        List<String> constraintTypes = new ArrayList<>();
+        if (!testCase.permittedDns.isEmpty()) {
+            constraintTypes.add("permittedDns");
+        }
+        if (!testCase.permittedIps.isEmpty()) {
+            constraintTypes.add("permittedIp");
+        }
+        if (!testCase.excludedDns.isEmpty()) {
+            constraintTypes.add("excludedDns");
+        }
+        if (!testCase.excludedIps.isEmpty()) {
+            constraintTypes.add("excludedIp");
+        }
+
+        String cnUsage = "other";
+        if (testCase.commonName == null) {
+            cnUsage = "none";
+        } else if (testCase.commonName.equals(hostname)) {
+            cnUsage = "hostname";
+        } else if (testCase.commonName.equals(ip)) {
+            cnUsage = "ip";
+        } else if (testCase.commonName.equals(invalidHostname)) {
+            cnUsage = "invalidHostname";
+        } else if (testCase.commonName.equals(invalidIp)) {
+            cnUsage = "invalidIp";
+        }
+
+        // Which of the names under test are the case's own rather than those in config.json.
+        List<String> targetTypes = new ArrayList<>();
+        if (testCase.targetHostname != null) {
+            targetTypes.add("dns");
+        }
+        if (testCase.targetIp != null) {
+            targetTypes.add("ip");
+        }
+
+        // Which of the intermediate's names, beyond its usual description, are subject to the constraints.
+        List<String> intermediateNames = new ArrayList<>();
+        if (testCase.intermediateCommonName != null) {
+            intermediateNames.add("cn");
+        }
+        if (!testCase.intermediateDnsSans.isEmpty() || !testCase.intermediateIpSans.isEmpty()) {
+            intermediateNames.add("san");
+        }
+
+        // Every chain has the shape built by makeTree, with any constraints on the local root.
+        return new JSONObject()
+                .put("sanTypes", sanTypes.isEmpty() ? "none" : String.join("+", sanTypes))
+                .put("constraintTypes", constraintTypes.isEmpty() ? "none" : String.join("+", constraintTypes))
+                .put("cnUsage", cnUsage)
+                .put("customTarget", targetTypes.isEmpty() ? "none" : String.join("+", targetTypes))
+                .put("intermediateNames", intermediateNames.isEmpty() ? "none" : String.join("+", intermediateNames))
+                .put("chainShape", "root>localRoot>intermediate>leaf")
+                .put("constraintPosition", constraintTypes.isEmpty() ? "none" : "localRoot");
+    }
+
+    /**
+     * Returns the clauses of the RFCs that a test case exercises, which the harness's coverage command scores
+     * implementations by. They're cited as in the harness's docs command, so that clauses derived from the features of
+     * older corpora are counted alongside them.
+     */
+    private JSONArray makeClauses(TestCase testCase) {
+        JSONArray clauses = new JSONArray();
+        if (!testCase.dnsSans.isEmpty() || !testCase.ipSans.isEmpty()) {
+            clauses.put("RFC 5280, section 4.2.1.6 (Subject Alternative Name)");
+        }
+        if (!testCase.permittedDns.isEmpty() || !testCase.permittedIps.isEmpty()
+                || !testCase.excludedDns.isEmpty() || !testCase.excludedIps.isEmpty()) {
+            clauses.put("RFC 5280, section 4.2.1.10 (Name Constraints)");
+        }
+        String targetHostname = testCase.targetHostname != null ? testCase.targetHostname : hostname;
+        String targetIp = testCase.targetIp != null ? testCase.targetIp : ip;
+        if (targetHostname.equals(testCase.commonName) || targetIp.equals(testCase.commonName)) {
+            clauses.put("RFC 6125, section 6.4.4 (Checking of Common Names)");
+        }
+        if (testCase.dnsSans.contains(targetHostname) || testCase.dnsSans.contains(invalidHostname)
+                || targetHostname.equals(testCase.commonName) || invalidHostname.equals(testCase.commonName)) {
+            clauses.put("RFC 6125, section 6.4.1 (Checking of Traditional Domain Names)");
+        }
+        boolean wildcard = false;
+        for (String dnsSan : testCase.dnsSans) {
+            wildcard |= dnsSan.contains("*");
+        }
+        if (wildcard) {
+            clauses.put("RFC 6125, section 6.4.3 (Checking of Wildcard Certificates)");
+        }
+        // RFC 6125 leaves IP addresses out of scope, so they're matched as in RFC 2818.
+        if (testCase.ipSans.contains(targetIp) || testCase.ipSans.contains(invalidIp)
+                || targetIp.equals(testCase.commonName) || invalidIp.equals(testCase.commonName)) {
+            clauses.put("RFC 2818, section 3.1 (Server Identity)");
+        }
+        return clauses;
+    }
+
+    private static JSONArray makeInterpretations(List<TestCase.Interpretation> interpretations) {
+        JSONArray ret = new JSONArray();
+        for (TestCase.Interpretation interpretation : interpretations) {
+            ret.put(new JSONObject()
+                    .put("name", interpretation.name)
+                    .put("expect", interpretation.result)
+                    .put("reason", interpretation.reason));
+        }
+        return ret;
+    }
+
+    /**
+     * Returns the subtrees of a name constraints extension. IP subtrees are in CIDR notation, or are the hex encoded
+     * octets of the iPAddress name after a "#", for subtrees that CIDR notation can't express.
+     */
+    private static List<GeneralSubtree> makeSubtrees(List<String> ipSubtrees, List<String> dnsSubtrees) {
+        List<GeneralSubtree> subtrees = new ArrayList<>();
+        for (String subtree : ipSubtrees) {
+            if (subtree.startsWith("#")) {
+                subtrees.add(new GeneralSubtree(new GeneralName(GeneralName.iPAddress, new DEROctetString(Hex.decode(subtree.substring(1))))));
+            } else {
+                subtrees.add(new GeneralSubtree(new GeneralName(GeneralName.iPAddress, subtree)));
+            }
+        }
+        for (String subtree : dnsSubtrees) {
+            subtrees.add(new GeneralSubtree(new GeneralName(GeneralName.dNSName, subtree)));
+        }
+        return subtrees;
+    }
+
+    /**
+     * Returns the SHA-256 hash of each file making up the corpus, keyed by file name, so that test harnesses can
+     * detect stale or partially regenerated corpora.
+     */
+    private JSONObject hashCorpusFiles() throws IOException, NoSuchAlgorithmException {
+        List<String> names = new ArrayList<>();
+        names.add("root.crt");
+        for (int i = 0; i < certManifest.length(); i++) {
+            String id = Integer.toString(certManifest.getJSONObject(i).getInt("id"));
+            names.add(id + ".key");
+            names.add(id + ".crt");
+            names.add(id + ".chain");
+            names.add("der/" + id + ".der");
+        }
+        names.add("der/root.der");
+
+        JSONObject hashes = new JSONObject();
+        for (String name : names) {
+            MessageDigest digest = MessageDigest.getInstance("SHA-256");
+            hashes.put(name, Hex.toHexString(digest.digest(Files.readAllBytes(outputDir.resolve(name)))));
+        }
+        return hashes;
+    }
+
+    /**
+     * Writes the DER form of the corpus to der/, for verifiers that don't read PEM. Each test's leaf and chain are
+     * concatenated in N.der, and der/index.json gives the length of each certificate so that they can be split without
+     * parsing.
+     */
+    private void writeDerCorpus() throws IOException, CertificateException {
+        Path derDir = outputDir.resolve("der");
+        Files.createDirectories(derDir);
+        CertificateFactory factory = CertificateFactory.getInstance("X.509");
+
+        Certificate root = readCertificates(factory, outputDir.resolve("root.crt")).iterator().next();
+        Files.write(derDir.resolve("root.der"), root.getEncoded());
+
+        JSONArray tests = new JSONArray();
+        for (int i = 0; i < certManifest.length(); i++) {
+            int id = certManifest.getJSONObject(i).getInt("id");
+            List<Certificate> certs = new ArrayList<>(readCertificates(factory, outputDir.resolve(id + ".crt")));
+            certs.addAll(readCertificates(factory, outputDir.resolve(id + ".chain")));
+
+            ByteArrayOutputStream contents = new ByteArrayOutputStream();
+            JSONArray lengths = new JSONArray();
+            for (Certificate cert : certs) {
+                byte[] der = cert.getEncoded();
+                contents.write(der);
+                lengths.put(der.length);
+            }
+            Files.write(derDir.resolve(id + ".der"), contents.toByteArray());
+            tests.put(new JSONObject().put("id", id).put("file", id + ".der").put("lengths", lengths));
+        }
+
+        JSONObject index = new JSONObject().put("root", "root.der").put("tests", tests);
+        Files.write(derDir.resolve("index.json"), index.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    private static Collection<? extends Certificate> readCertificates(CertificateFactory factory, Path path) throws IOException, CertificateException {
+        try (InputStream stream = Files.newInputStream(path)) {
+            return factory.generateCertificates(stream);
+        }
+    }
+
+    /**
+     * Returns the git commit of the generator, or "unknown" if it can't be determined.
+     */
+    private static String getGeneratorCommit() {
+        try {
+            Process process = new ProcessBuilder("git", "rev-parse", "HEAD").redirectErrorStream(true).start();
+            try (BufferedReader reader = new BufferedReader(new InputStreamReader(process.getInputStream(), StandardCharsets.UTF_8))) {
+                String commit = reader.readLine();
+                if (process.waitFor() == 0 && commit != null) {
+                    return commit.trim();
                 }
             }
+        } catch (IOException | InterruptedException e) {
+            // Fall through
         }
+        return "unknown";
     }
 
-    private static KeyStore makeTree(int certId, KeyStore rootCa, NameConstraints nameConstraints, String leafCommonName, GeneralNames leafSubjectAlternateNames) throws Exception {
-        KeyStore localRoot = new KeyStoreGenerator()
+    private static KeyStore makeTree(GeneratorOptions options, int certId, KeyStore rootCa, NameConstraints nameConstraints,
+                                     String intermediateCommonName, GeneralNames intermediateSubjectAlternateNames,
+                                     String leafCommonName, GeneralNames leafSubjectAlternateNames) throws Exception {
+        KeyStore localRoot = new KeyStoreGenerator(options)
                 .setCaKeyEntry(getSignerPrivateKey(rootCa))
                 .setCommonName("Local Root for " + certId)
                 .setIsCa(true)
                 .setNameConstraints(nameConstraints)
                 .build();
-        KeyStore localIntermediate = new KeyStoreGenerator()
+        KeyStore localIntermediate = new KeyStoreGenerator(options)
                 .setCaKeyEntry(getSignerPrivateKey(localRoot))
-                .setCommonName("Intermediate CA for " + certId)
+                .setCommonName(intermediateCommonName != null ? intermediateCommonName : "Intermediate CA for " + certId)
                 .setIsCa(true)
+                .setSubjectAlternateNames(intermediateSubjectAlternateNames)
                 .build();
-        KeyStore leafCert = new KeyStoreGenerator()
+        KeyStore leafCert = new KeyStoreGenerator(options)
                 .setCaKeyEntry(getSignerPrivateKey(localIntermediate))
                 .setCommonName(leafCommonName)
                 .setIsCa(false)
@@ -216,7 +667,7 @@ public class CertificateGenerator {
         return leafCert;
     }
 
-    private static void writeCertificate(Certificate certificate, Path path) throws CertificateEncodingException, IOException {
+    static void writeCertificate(Certificate certificate, Path path) throws CertificateEncodingException, IOException {
         try (OutputStream stream = Files.newOutputStream(path);
              OutputStreamWriter writer = new OutputStreamWriter(stream);
              JcaPEMWriter pemWriter = new JcaPEMWriter(writer)) {
@@ -224,7 +675,7 @@ public class CertificateGenerator {
         }
     }
 
-    private static void writeCertificateSet(KeyStore keyStore, Path outputDir, String name) throws IOException, CertificateEncodingException, UnrecoverableEntryException, NoSuchAlgorithmException, KeyStoreException {
+    static void writeCertificateSet(KeyStore keyStore, Path outputDir, String name) throws IOException, CertificateEncodingException, UnrecoverableEntryException, NoSuchAlgorithmException, KeyStoreException {
         KeyStore.PrivateKeyEntry keyEntry = (KeyStore.PrivateKeyEntry) keyStore.getEntry(KeyStoreGenerator.DEFAULT_ALIAS, new KeyStore.PasswordProtection(KeyStoreGenerator.KEYSTORE_PASSWORD.toCharArray()));
 
         try (OutputStream stream = Files.newOutputStream(outputDir.resolve(name + ".key"));
@@ -249,7 +700,7 @@ public class CertificateGenerator {
         }
     }
 
-    private static KeyStore.PrivateKeyEntry getSignerPrivateKey(KeyStore keyStore) throws UnrecoverableEntryException, NoSuchAlgorithmException, KeyStoreException {
+    static KeyStore.PrivateKeyEntry getSignerPrivateKey(KeyStore keyStore) throws UnrecoverableEntryException, NoSuchAlgorithmException, KeyStoreException {
         return (KeyStore.PrivateKeyEntry) keyStore.getEntry(KeyStoreGenerator.DEFAULT_ALIAS, new KeyStore.PasswordProtection(KeyStoreGenerator.KEYSTORE_PASSWORD.toCharArray()));
     }
 }
@@ -0,0 +1,186 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.asn1.x509.GeneralName;
+import org.bouncycastle.asn1.x509.GeneralNames;
+import org.bouncycastle.openssl.jcajce.JcaPEMWriter;
+import org.json.JSONArray;
+import org.json.JSONObject;
+
+import java.io.OutputStream;
+import java.io.OutputStreamWriter;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyStore;
+
+/**
+ * Generates chains that are presented with the root included, out of order, with duplicates or with unrelated
+ * certificates, along with self-signed leaves, to check that verifiers build a valid path from the certificates as a
+ * server would present them rather than relying on them being in order. Each test's {@code .chain} file holds the
+ * certificates after the leaf exactly as presented. These are only generated when running this class directly, e.g.
+ * with {@code gradle runChainOrderGenerator}.
+ */
+public class ChainOrderCertificateGenerator {
+
+    public static void main(String[] args) throws Exception {
+
+        final JSONObject config = new JSONObject(new String(Files.readAllBytes(Paths.get("../config.json")), StandardCharsets.UTF_8));
+        final Path outputDir = Paths.get("../certificates/chainorder");
+        Files.createDirectories(outputDir);
+
+        new ChainOrderCertificateGenerator(config, outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
+    }
+
+    private final Path outputDir;
+    private final GeneratorOptions options;
+    private final String hostname;
+
+    private final JSONArray chainOrderManifest = new JSONArray();
+    private int nextCertId = 1;
+
+    private ChainOrderCertificateGenerator(JSONObject config, Path outputDir, GeneratorOptions options) {
+        this.outputDir = outputDir;
+        this.options = options;
+        this.hostname = config.getString("hostname");
+    }
+
+    private void generateCertificates() throws Exception {
+
+        Presented root = new Presented("root", new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("Chain Order Test Root CA")
+                .setIsCa(true)
+                .build());
+        CertificateGenerator.writeCertificate(root.keyStore.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve("root.crt"));
+
+        Presented first = new Presented("intermediate1", new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(root.keyStore))
+                .setCommonName("Chain Order Test Intermediate CA")
+                .setIsCa(true)
+                .build());
+        Presented second = new Presented("intermediate2", new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(first.keyStore))
+                .setCommonName("Chain Order Test Second Intermediate CA")
+                .setIsCa(true)
+                .build());
+        Presented unrelated = new Presented("unrelated", new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("Chain Order Test Unrelated CA")
+                .setIsCa(true)
+                .build());
+
+        Presented leaf = new Presented("leaf", makeLeaf(second.keyStore));
+        Presented selfSignedLeaf = new Presented("leaf", makeLeaf(null));
+
+        writeCase("inOrder", "OK",
+                "The intermediates are presented in order, from the leaf's issuer to the root's subject.",
+                leaf, second, first);
+        writeCase("rootIncluded", "OK",
+                "The intermediates are presented in order, followed by the root, which verifiers should ignore or find in their trust store.",
+                leaf, second, first, root);
+        writeCase("reversed", "OK",
+                "The intermediates are presented in reverse order, from the root's subject to the leaf's issuer.",
+                leaf, first, second);
+        writeCase("rootFirst", "OK",
+                "The root is presented first, followed by the intermediates in reverse order.",
+                leaf, root, first, second);
+        writeCase("duplicateIntermediate", "OK",
+                "The leaf's issuer is presented twice.",
+                leaf, second, second, first);
+        writeCase("leafRepeated", "OK",
+                "The leaf is presented again ahead of the intermediates.",
+                leaf, leaf, second, first);
+        writeCase("unrelatedCertificate", "OK",
+                "A self-signed CA that isn't part of the path is presented between the intermediates.",
+                leaf, second, unrelated, first);
+        writeCase("missingIntermediate", "ERROR",
+                "Only the leaf's issuer is presented, so there's no path to the root without fetching the missing intermediate.",
+                leaf, second);
+        writeCase("selfSignedLeaf", "ERROR",
+                "The leaf is self-signed and isn't trusted.",
+                selfSignedLeaf);
+        writeCase("selfSignedLeafWithChain", "ERROR",
+                "The leaf is self-signed and isn't trusted, and is presented with intermediates and a root that didn't issue it.",
+                selfSignedLeaf, second, first, root);
+
+        final JSONObject manifest = new JSONObject();
+        manifest.put("chainOrderManifest", chainOrderManifest);
+        Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    private KeyStore makeLeaf(KeyStore issuer) throws Exception {
+        return new KeyStoreGenerator(options)
+                .setCaKeyEntry(issuer == null ? null : CertificateGenerator.getSignerPrivateKey(issuer))
+                .setIsCa(false)
+                .setCommonName(hostname)
+                .setSubjectAlternateNames(new GeneralNames(new GeneralName(GeneralName.dNSName, hostname)))
+                .build();
+    }
+
+    /**
+     * Writes the leaf's key to {@code <id>.key}, the leaf to {@code <id>.crt} and the rest of the presented
+     * certificates, in the given order, to {@code <id>.chain}.
+     */
+    private void writeCase(String name, String expect, String description, Presented leaf, Presented... presented) throws Exception {
+        System.out.println("Generating chain order test " + nextCertId + "...");
+
+        try (OutputStream stream = Files.newOutputStream(outputDir.resolve(nextCertId + ".key"));
+             OutputStreamWriter writer = new OutputStreamWriter(stream);
+             JcaPEMWriter pemWriter = new JcaPEMWriter(writer)) {
+            pemWriter.writeObject(CertificateGenerator.getSignerPrivateKey(leaf.keyStore).getPrivateKey());
+        }
+        CertificateGenerator.writeCertificate(leaf.keyStore.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve(nextCertId + ".crt"));
+
+        JSONArray labels = new JSONArray();
+        try (OutputStream stream = Files.newOutputStream(outputDir.resolve(nextCertId + ".chain"));
+             OutputStreamWriter writer = new OutputStreamWriter(stream);
+             JcaPEMWriter pemWriter = new JcaPEMWriter(writer)) {
+            for (Presented certificate : presented) {
+                pemWriter.writeObject(certificate.keyStore.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS));
+                labels.put(certificate.label);
+            }
+        }
+
+        chainOrderManifest.put(new JSONObject()
+                .put("id", nextCertId)
+                .put("name", name)
+                .put("presented", labels)
+                .put("expect", expect)
+                .put("description", description)
+        );
+
+        nextCertId += 1;
+    }
+
+    /**
+     * A certificate that can be presented, with the label that the manifest gives it.
+     */
+    private static class Presented {
+        private final String label;
+        private final KeyStore keyStore;
+
+        Presented(String label, KeyStore keyStore) {
+            this.label = label;
+            this.keyStore = keyStore;
+        }
+    }
+}
@@ -0,0 +1,227 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.asn1.x500.X500Name;
+import org.bouncycastle.asn1.x509.GeneralName;
+import org.bouncycastle.asn1.x509.GeneralNames;
+import org.bouncycastle.asn1.x509.GeneralSubtree;
+import org.bouncycastle.asn1.x509.NameConstraints;
+import org.bouncycastle.openssl.jcajce.JcaPEMWriter;
+import org.json.JSONArray;
+import org.json.JSONObject;
+
+import java.io.OutputStream;
+import java.io.OutputStreamWriter;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyPair;
+import java.security.KeyStore;
+import java.util.Calendar;
+import java.util.Date;
+
+/**
+ * Generates chains that can lead to either of two roots, an old one and a new one, as when a CA moves to a new root
+ * and cross-signs it with the old one so that clients that only trust the old root still accept its certificates.
+ * Servers present the leaf, its intermediate and the cross-signed new root, and each test gives the verifier its own
+ * trust store, of one or both roots, in {@code <id>.roots}. Tests where one of the roots or the cross-signature has
+ * expired, as the AddTrust root did in 2020, or where the old root is name constrained, check that verifiers find
+ * the valid path rather than giving up on the first path they try. These are only generated when running this class
+ * directly, e.g. with {@code gradle runCrossSignGenerator}.
+ */
+public class CrossSignCertificateGenerator {
+
+    public static void main(String[] args) throws Exception {
+
+        final JSONObject config = new JSONObject(new String(Files.readAllBytes(Paths.get("../config.json")), StandardCharsets.UTF_8));
+        final Path outputDir = Paths.get("../certificates/crosssign");
+        Files.createDirectories(outputDir);
+
+        new CrossSignCertificateGenerator(config, outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
+    }
+
+    private final Path outputDir;
+    private final GeneratorOptions options;
+    private final String hostname;
+    private final String hostSubtree;
+
+    private final JSONArray crossSignManifest = new JSONArray();
+    private int nextCertId = 1;
+
+    private CrossSignCertificateGenerator(JSONObject config, Path outputDir, GeneratorOptions options) {
+        this.outputDir = outputDir;
+        this.options = options;
+        this.hostname = config.getString("hostname");
+        this.hostSubtree = config.getString("hostSubtree");
+    }
+
+    private void generateCertificates() throws Exception {
+
+        Date notBefore = options.getNotBefore();
+        Date notAfter = addDays(notBefore, 365);
+        Date expiredNotBefore = addDays(notBefore, -366);
+        Date expiredNotAfter = addDays(notBefore, -1);
+
+        // Each root has a single name and key, and is issued more than once with different validity periods or
+        // constraints, so that every version of it verifies the same signatures.
+        X500Name oldRootName = new X500Name("O=Netflix Inc, OU=Platform Security (" + options.nextUniqueId() + "), CN=Cross-Sign Test Old Root CA");
+        X500Name newRootName = new X500Name("O=Netflix Inc, OU=Platform Security (" + options.nextUniqueId() + "), CN=Cross-Sign Test New Root CA");
+        KeyPair oldRootKeyPair = options.nextKeyPair();
+        KeyPair newRootKeyPair = options.nextKeyPair();
+
+        Labelled oldRoot = new Labelled("oldRoot", makeCa(null, oldRootName, oldRootKeyPair, notBefore, notAfter, null));
+        Labelled oldRootExpired = new Labelled("oldRootExpired", makeCa(null, oldRootName, oldRootKeyPair, expiredNotBefore, expiredNotAfter, null));
+        Labelled oldRootConstrained = new Labelled("oldRootConstrained", makeCa(null, oldRootName, oldRootKeyPair, notBefore, notAfter,
+                new NameConstraints(null, new GeneralSubtree[]{new GeneralSubtree(new GeneralName(GeneralName.dNSName, hostSubtree))})));
+        Labelled newRoot = new Labelled("newRoot", makeCa(null, newRootName, newRootKeyPair, notBefore, notAfter, null));
+        Labelled newRootExpired = new Labelled("newRootExpired", makeCa(null, newRootName, newRootKeyPair, expiredNotBefore, expiredNotAfter, null));
+
+        Labelled crossSigned = new Labelled("crossSigned", makeCa(oldRoot.keyStore, newRootName, newRootKeyPair, notBefore, notAfter, null));
+        Labelled crossSignedExpired = new Labelled("crossSignedExpired", makeCa(oldRoot.keyStore, newRootName, newRootKeyPair, expiredNotBefore, expiredNotAfter, null));
+
+        Labelled intermediate = new Labelled("intermediate", makeCa(newRoot.keyStore, null, null, notBefore, notAfter, null));
+        KeyStore leaf = new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(intermediate.keyStore))
+                .setIsCa(false)
+                .setCommonName(hostname)
+                .setSubjectAlternateNames(new GeneralNames(new GeneralName(GeneralName.dNSName, hostname)))
+                .setValidity(notBefore, notAfter)
+                .build();
+
+        Labelled[] presented = {intermediate, crossSigned};
+        Labelled[] presentedExpiredCrossSign = {intermediate, crossSignedExpired};
+
+        writeCase("bothRootsTrusted", "OK",
+                "Both roots are trusted, so the chain can end at the new root or, through the cross-signature, at the old root.",
+                leaf, presented, oldRoot, newRoot);
+        writeCase("onlyNewRootTrusted", "OK",
+                "Only the new root is trusted, and the presented cross-signed certificate must be set aside in favour of it.",
+                leaf, presented, newRoot);
+        writeCase("onlyOldRootTrusted", "OK",
+                "Only the old root is trusted, which the chain reaches through the cross-signed new root.",
+                leaf, presented, oldRoot);
+        writeCase("oldRootExpiredNewRootTrusted", "OK",
+                "The old root has expired, but the new root is also trusted and completes a valid path without the cross-signature.",
+                leaf, presented, oldRootExpired, newRoot);
+        writeCase("oldRootExpiredOnly", "ERROR",
+                "Only the old root is trusted, and it has expired.",
+                leaf, presented, oldRootExpired);
+        writeCase("newRootExpiredOldRootTrusted", "OK",
+                "The trusted new root has expired, but the chain reaches the valid old root through the cross-signature.",
+                leaf, presented, oldRoot, newRootExpired);
+        writeCase("crossSignExpiredNewRootTrusted", "OK",
+                "The presented cross-signature has expired, but the new root is trusted and completes a valid path without it.",
+                leaf, presentedExpiredCrossSign, oldRoot, newRoot);
+        writeCase("crossSignExpiredOldRootOnly", "ERROR",
+                "Only the old root is trusted, and the cross-signature that leads to it has expired.",
+                leaf, presentedExpiredCrossSign, oldRoot);
+        writeCase("oldRootConstrainedNewRootTrusted", "OK",
+                "The old root's name constraints exclude " + hostSubtree + ", but the new root is also trusted and completes a path without them.",
+                leaf, presented, oldRootConstrained, newRoot);
+        writeCase("oldRootConstrainedOnly", "WEAK-OK",
+                "Only the old root is trusted, and its name constraints exclude " + hostSubtree + ". Verifiers that apply a trust anchor's constraints reject the chain, and those that don't accept it.",
+                leaf, presented, oldRootConstrained);
+
+        final JSONObject manifest = new JSONObject();
+        manifest.put("crossSignManifest", crossSignManifest);
+        Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    private static Date addDays(Date date, int days) {
+        Calendar cal = Calendar.getInstance();
+        cal.setTime(date);
+        cal.add(Calendar.DATE, days);
+        return cal.getTime();
+    }
+
+    /**
+     * Issues a CA from issuer, or a self-signed one if issuer is null. A null subject name or key pair gets a new one.
+     */
+    private KeyStore makeCa(KeyStore issuer, X500Name subjectName, KeyPair keyPair, Date notBefore, Date notAfter, NameConstraints nameConstraints) throws Exception {
+        return new KeyStoreGenerator(options)
+                .setCaKeyEntry(issuer == null ? null : CertificateGenerator.getSignerPrivateKey(issuer))
+                .setCommonName("Cross-Sign Test Intermediate CA")
+                .setSubjectName(subjectName)
+                .setKeyPair(keyPair)
+                .setIsCa(true)
+                .setValidity(notBefore, notAfter)
+                .setNameConstraints(nameConstraints)
+                .build();
+    }
+
+    /**
+     * Writes the leaf's key to {@code <id>.key}, the leaf to {@code <id>.crt}, the rest of the presented
+     * certificates, in order, to {@code <id>.chain} and the trusted roots to {@code <id>.roots}.
+     */
+    private void writeCase(String name, String expect, String description, KeyStore leaf, Labelled[] presented, Labelled... trusted) throws Exception {
+        System.out.println("Generating cross-sign test " + nextCertId + "...");
+
+        try (OutputStream stream = Files.newOutputStream(outputDir.resolve(nextCertId + ".key"));
+             OutputStreamWriter writer = new OutputStreamWriter(stream);
+             JcaPEMWriter pemWriter = new JcaPEMWriter(writer)) {
+            pemWriter.writeObject(CertificateGenerator.getSignerPrivateKey(leaf).getPrivateKey());
+        }
+        CertificateGenerator.writeCertificate(leaf.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve(nextCertId + ".crt"));
+
+        JSONArray presentedLabels = writeCertificates(outputDir.resolve(nextCertId + ".chain"), presented);
+        JSONArray trustedLabels = writeCertificates(outputDir.resolve(nextCertId + ".roots"), trusted);
+
+        crossSignManifest.put(new JSONObject()
+                .put("id", nextCertId)
+                .put("name", name)
+                .put("presented", presentedLabels)
+                .put("trusted", trustedLabels)
+                .put("expect", expect)
+                .put("description", description)
+        );
+
+        nextCertId += 1;
+    }
+
+    /**
+     * Writes the certificates to path, in order, and returns their labels.
+     */
+    private static JSONArray writeCertificates(Path path, Labelled... certificates) throws Exception {
+        JSONArray labels = new JSONArray();
+        try (OutputStream stream = Files.newOutputStream(path);
+             OutputStreamWriter writer = new OutputStreamWriter(stream);
+             JcaPEMWriter pemWriter = new JcaPEMWriter(writer)) {
+            for (Labelled certificate : certificates) {
+                pemWriter.writeObject(certificate.keyStore.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS));
+                labels.put(certificate.label);
+            }
+        }
+        return labels;
+    }
+
+    /**
+     * A certificate with the label that the manifest gives it.
+     */
+    private static class Labelled {
+        private final String label;
+        private final KeyStore keyStore;
+
+        Labelled(String label, KeyStore keyStore) {
+            this.label = label;
+            this.keyStore = keyStore;
+        }
+    }
+}
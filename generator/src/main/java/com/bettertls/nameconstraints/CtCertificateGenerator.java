@@ -0,0 +1,305 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.asn1.ASN1ObjectIdentifier;
+import org.bouncycastle.asn1.DEROctetString;
+import org.bouncycastle.asn1.x500.X500Name;
+import org.bouncycastle.asn1.x509.Extension;
+import org.bouncycastle.asn1.x509.Extensions;
+import org.bouncycastle.asn1.x509.GeneralName;
+import org.bouncycastle.asn1.x509.GeneralNames;
+import org.bouncycastle.cert.X509CertificateHolder;
+import org.bouncycastle.cert.ocsp.BasicOCSPResp;
+import org.bouncycastle.cert.ocsp.BasicOCSPRespBuilder;
+import org.bouncycastle.cert.ocsp.CertificateID;
+import org.bouncycastle.cert.ocsp.CertificateStatus;
+import org.bouncycastle.cert.ocsp.OCSPRespBuilder;
+import org.bouncycastle.cert.ocsp.RespID;
+import org.bouncycastle.openssl.jcajce.JcaPEMWriter;
+import org.bouncycastle.operator.jcajce.JcaContentSignerBuilder;
+import org.bouncycastle.operator.jcajce.JcaDigestCalculatorProviderBuilder;
+import org.json.JSONArray;
+import org.json.JSONObject;
+
+import java.io.ByteArrayOutputStream;
+import java.io.OutputStream;
+import java.io.OutputStreamWriter;
+import java.math.BigInteger;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyPair;
+import java.security.KeyStore;
+import java.security.MessageDigest;
+import java.security.Signature;
+import java.security.cert.Certificate;
+import java.util.Arrays;
+import java.util.Base64;
+import java.util.Calendar;
+import java.util.Date;
+import java.util.LinkedHashMap;
+import java.util.List;
+import java.util.Map;
+
+/**
+ * Generates certificates with RFC 6962 signed certificate timestamps (SCTs), embedded in the certificate or to be
+ * delivered in the TLS extension or a stapled OCSP response, from trusted logs, from a log that isn't trusted, with
+ * bad signatures or missing entirely, to measure how clients that enforce Certificate Transparency treat them. The
+ * SCTs are signed with the keys of local test logs, which are written alongside the certificates so that the harness
+ * can serve a log list and a log of its own. These are only generated when running this class directly, e.g. with
+ * {@code gradle runCtGenerator}.
+ */
+public class CtCertificateGenerator {
+
+    private static final ASN1ObjectIdentifier EMBEDDED_SCT_LIST = new ASN1ObjectIdentifier("1.3.6.1.4.1.11129.2.4.2");
+    private static final ASN1ObjectIdentifier OCSP_SCT_LIST = new ASN1ObjectIdentifier("1.3.6.1.4.1.11129.2.4.5");
+
+    private static final int X509_ENTRY = 0;
+    private static final int PRECERT_ENTRY = 1;
+
+    public static void main(String[] args) throws Exception {
+
+        final JSONObject config = new JSONObject(new String(Files.readAllBytes(Paths.get("../config.json")), StandardCharsets.UTF_8));
+        final Path outputDir = Paths.get("../certificates/ct");
+        Files.createDirectories(outputDir.resolve("logs"));
+
+        new CtCertificateGenerator(config, outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
+    }
+
+    private final Path outputDir;
+    private final GeneratorOptions options;
+    private final String hostname;
+
+    private final Map<String, KeyPair> logs = new LinkedHashMap<>();
+    private final JSONArray ctManifest = new JSONArray();
+    private int nextCertId = 1;
+
+    private CtCertificateGenerator(JSONObject config, Path outputDir, GeneratorOptions options) {
+        this.outputDir = outputDir;
+        this.options = options;
+        this.hostname = config.getString("hostname");
+    }
+
+    private void generateCertificates() throws Exception {
+
+        KeyStore rootCa = new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("CT Test Root CA")
+                .setIsCa(true)
+                .build();
+        CertificateGenerator.writeCertificate(rootCa.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve("root.crt"));
+
+        JSONArray logList = new JSONArray();
+        logList.put(writeLog("trusted-a", "BetterTLS Test Log A", true));
+        logList.put(writeLog("trusted-b", "BetterTLS Test Log B", true));
+        logList.put(writeLog("unknown", "BetterTLS Unknown Log", false));
+        Files.write(outputDir.resolve("logs.json"), new JSONObject().put("logs", logList).toString().getBytes(StandardCharsets.UTF_8));
+
+        writeCase(rootCa, "embedded", new String[]{"trusted-a", "trusted-b"}, new String[]{}, "OK",
+                "The certificate embeds SCTs from two trusted logs.");
+        writeCase(rootCa, "embedded", new String[]{"trusted-a"}, new String[]{}, "ERROR",
+                "The certificate embeds an SCT from only one trusted log, and CT policies require SCTs from at least two.");
+        writeCase(rootCa, "embedded", new String[]{"trusted-a", "unknown"}, new String[]{}, "ERROR",
+                "The certificate embeds SCTs from a trusted log and from a log that isn't trusted, which doesn't count.");
+        writeCase(rootCa, "embedded", new String[]{"unknown"}, new String[]{}, "ERROR",
+                "The certificate embeds an SCT only from a log that isn't trusted.");
+        writeCase(rootCa, "embedded", new String[]{"trusted-a", "trusted-b"}, new String[]{"trusted-b"}, "ERROR",
+                "The certificate embeds SCTs from two trusted logs, but one of them has a bad signature.");
+        writeCase(rootCa, "none", new String[]{}, new String[]{}, "ERROR",
+                "The certificate has no SCTs, and none are delivered in the TLS extension or a stapled OCSP response.");
+        writeCase(rootCa, "tls", new String[]{"trusted-a", "trusted-b"}, new String[]{}, "OK",
+                "SCTs from two trusted logs are delivered in the TLS extension.");
+        writeCase(rootCa, "tls", new String[]{"trusted-a", "trusted-b"}, new String[]{"trusted-a"}, "ERROR",
+                "SCTs from two trusted logs are delivered in the TLS extension, but one of them has a bad signature.");
+        writeCase(rootCa, "ocsp", new String[]{"trusted-a", "trusted-b"}, new String[]{}, "OK",
+                "SCTs from two trusted logs are delivered in a stapled OCSP response.");
+        writeCase(rootCa, "ocsp", new String[]{"unknown"}, new String[]{}, "ERROR",
+                "An SCT only from a log that isn't trusted is delivered in a stapled OCSP response.");
+
+        final JSONObject manifest = new JSONObject();
+        manifest.put("ctManifest", ctManifest);
+        Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    private JSONObject writeLog(String name, String description, boolean trusted) throws Exception {
+        KeyPair kp = options.nextEcKeyPair();
+        logs.put(name, kp);
+
+        try (OutputStream stream = Files.newOutputStream(outputDir.resolve("logs").resolve(name + ".key"));
+             OutputStreamWriter writer = new OutputStreamWriter(stream);
+             JcaPEMWriter pemWriter = new JcaPEMWriter(writer)) {
+            pemWriter.writeObject(kp.getPrivate());
+        }
+
+        return new JSONObject()
+                .put("name", name)
+                .put("description", description)
+                .put("trusted", trusted)
+                .put("logId", Base64.getEncoder().encodeToString(logId(name)))
+                .put("key", Base64.getEncoder().encodeToString(kp.getPublic().getEncoded()));
+    }
+
+    private void writeCase(KeyStore rootCa, String delivery, String[] sctLogs, String[] badSignatureLogs, String expect, String description) throws Exception {
+        System.out.println("Generating CT certificate " + nextCertId + "...");
+
+        KeyStore intermediate = new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(rootCa))
+                .setCommonName("CT Test Intermediate CA")
+                .setIsCa(true)
+                .build();
+        KeyStore.PrivateKeyEntry issuer = CertificateGenerator.getSignerPrivateKey(intermediate);
+
+        // The certificate is issued twice with the same contents, first as the precertificate that embedded SCTs
+        // are signed over and then with the SCTs added.
+        X500Name subject = new X500Name("C=US, ST=California, L=Los Gatos, O=Netflix Inc, OU=Platform Security (" + options.nextUniqueId() + "), CN=" + hostname);
+        BigInteger serial = options.nextSerial();
+        KeyPair leafKeyPair = options.nextKeyPair();
+        Date notBefore = options.getNotBefore();
+        Calendar notAfter = Calendar.getInstance();
+        notAfter.setTime(notBefore);
+        notAfter.add(Calendar.MONTH, 12);
+
+        KeyStore leaf = leafGenerator(issuer, subject, serial, leafKeyPair, notBefore, notAfter.getTime()).build();
+        if (delivery.equals("embedded")) {
+            X509CertificateHolder precert = new X509CertificateHolder(leaf.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS).getEncoded());
+            byte[] entry = concat(issuerKeyHash(issuer), lengthPrefixed(3, precert.toASN1Structure().getTBSCertificate().getEncoded()));
+            byte[] sctList = makeSctList(PRECERT_ENTRY, entry, sctLogs, badSignatureLogs);
+            leaf = leafGenerator(issuer, subject, serial, leafKeyPair, notBefore, notAfter.getTime())
+                    .addExtension(EMBEDDED_SCT_LIST, false, new DEROctetString(sctList))
+                    .build();
+        }
+
+        CertificateGenerator.writeCertificateSet(leaf, outputDir, Integer.toString(nextCertId));
+
+        Certificate leafCert = leaf.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS);
+        if (delivery.equals("tls")) {
+            byte[] entry = lengthPrefixed(3, leafCert.getEncoded());
+            Files.write(outputDir.resolve(nextCertId + ".sct"), makeSctList(X509_ENTRY, entry, sctLogs, badSignatureLogs));
+        } else if (delivery.equals("ocsp")) {
+            byte[] entry = lengthPrefixed(3, leafCert.getEncoded());
+            byte[] sctList = makeSctList(X509_ENTRY, entry, sctLogs, badSignatureLogs);
+            Files.write(outputDir.resolve(nextCertId + ".ocsp"), makeOcspResponse(issuer, serial, sctList));
+        }
+
+        ctManifest.put(new JSONObject()
+                .put("id", nextCertId)
+                .put("delivery", delivery)
+                .put("logs", new JSONArray(sctLogs))
+                .put("badSignatureLogs", new JSONArray(badSignatureLogs))
+                .put("expect", expect)
+                .put("description", description)
+        );
+
+        nextCertId += 1;
+    }
+
+    private KeyStoreGenerator leafGenerator(KeyStore.PrivateKeyEntry issuer, X500Name subject, BigInteger serial, KeyPair keyPair, Date notBefore, Date notAfter) {
+        return new KeyStoreGenerator(options)
+                .setCaKeyEntry(issuer)
+                .setIsCa(false)
+                .setSubjectName(subject)
+                .setSerial(serial)
+                .setKeyPair(keyPair)
+                .setValidity(notBefore, notAfter)
+                .setSubjectAlternateNames(new GeneralNames(new GeneralName(GeneralName.dNSName, hostname)));
+    }
+
+    /**
+     * Returns a TLS-encoded SignedCertificateTimestampList with an SCT over the given entry from each of the logs,
+     * those in badSignatureLogs being signed over a different timestamp so that their signatures don't verify.
+     */
+    private byte[] makeSctList(int entryType, byte[] entry, String[] sctLogs, String[] badSignatureLogs) throws Exception {
+        List<String> bad = Arrays.asList(badSignatureLogs);
+        long timestamp = options.getNotBefore().getTime();
+
+        ByteArrayOutputStream scts = new ByteArrayOutputStream();
+        for (String log : sctLogs) {
+            long signedTimestamp = bad.contains(log) ? timestamp + 1 : timestamp;
+            byte[] signedData = concat(
+                    new byte[]{0 /* v1 */, 0 /* certificate_timestamp */},
+                    uint(signedTimestamp, 8),
+                    uint(entryType, 2),
+                    entry,
+                    uint(0, 2) /* no extensions */);
+
+            Signature signer = Signature.getInstance("SHA256withECDSA");
+            // ECDSA signatures are randomized, so the seeded source keeps them reproducible.
+            signer.initSign(logs.get(log).getPrivate(), options.getRandom());
+            signer.update(signedData);
+            byte[] signature = signer.sign();
+
+            byte[] sct = concat(
+                    new byte[]{0 /* v1 */},
+                    logId(log),
+                    uint(timestamp, 8),
+                    uint(0, 2) /* no extensions */,
+                    new byte[]{4 /* sha256 */, 3 /* ecdsa */},
+                    lengthPrefixed(2, signature));
+            scts.write(lengthPrefixed(2, sct));
+        }
+        return lengthPrefixed(2, scts.toByteArray());
+    }
+
+    private byte[] makeOcspResponse(KeyStore.PrivateKeyEntry issuer, BigInteger serial, byte[] sctList) throws Exception {
+        X509CertificateHolder issuerHolder = new X509CertificateHolder(issuer.getCertificate().getEncoded());
+        CertificateID certId = new CertificateID(
+                new JcaDigestCalculatorProviderBuilder().build().get(CertificateID.HASH_SHA1), issuerHolder, serial);
+
+        Calendar nextUpdate = Calendar.getInstance();
+        nextUpdate.setTime(options.getNotBefore());
+        nextUpdate.add(Calendar.MONTH, 12);
+
+        BasicOCSPRespBuilder builder = new BasicOCSPRespBuilder(new RespID(issuerHolder.getSubject()));
+        builder.addResponse(certId, CertificateStatus.GOOD, options.getNotBefore(), nextUpdate.getTime(),
+                new Extensions(new Extension(OCSP_SCT_LIST, false, new DEROctetString(new DEROctetString(sctList).getEncoded()))));
+        BasicOCSPResp basic = builder.build(new JcaContentSignerBuilder("SHA256withRSA").build(issuer.getPrivateKey()), null, options.getNotBefore());
+        return new OCSPRespBuilder().build(OCSPRespBuilder.SUCCESSFUL, basic).getEncoded();
+    }
+
+    private byte[] logId(String log) throws Exception {
+        return MessageDigest.getInstance("SHA-256").digest(logs.get(log).getPublic().getEncoded());
+    }
+
+    private static byte[] issuerKeyHash(KeyStore.PrivateKeyEntry issuer) throws Exception {
+        return MessageDigest.getInstance("SHA-256").digest(issuer.getCertificate().getPublicKey().getEncoded());
+    }
+
+    private static byte[] uint(long value, int length) {
+        byte[] bytes = new byte[length];
+        for (int i = length - 1; i >= 0; i--) {
+            bytes[i] = (byte) value;
+            value >>>= 8;
+        }
+        return bytes;
+    }
+
+    private static byte[] lengthPrefixed(int lengthBytes, byte[] data) throws Exception {
+        return concat(uint(data.length, lengthBytes), data);
+    }
+
+    private static byte[] concat(byte[]... parts) throws Exception {
+        ByteArrayOutputStream out = new ByteArrayOutputStream();
+        for (byte[] part : parts) {
+            out.write(part);
+        }
+        return out.toByteArray();
+    }
+}
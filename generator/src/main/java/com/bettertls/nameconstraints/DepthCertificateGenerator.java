@@ -0,0 +1,141 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.asn1.x509.GeneralName;
+import org.bouncycastle.asn1.x509.GeneralNames;
+import org.bouncycastle.openssl.jcajce.JcaPEMWriter;
+import org.json.JSONArray;
+import org.json.JSONObject;
+
+import java.io.OutputStream;
+import java.io.OutputStreamWriter;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyStore;
+import java.util.ArrayList;
+import java.util.List;
+
+/**
+ * Generates otherwise valid chains with many intermediates, to find how deep a chain each verifier will build. RFC
+ * 5280 sets no limit, so every chain but the shallowest is expected to be either accepted or rejected, and results
+ * files record the depth at which the verifier gave up. These are only generated when running this class directly,
+ * e.g. with {@code gradle runDepthGenerator}.
+ */
+public class DepthCertificateGenerator {
+
+    // The numbers of intermediates in each test's chain, shallowest first.
+    private static final int[] INTERMEDIATE_COUNTS = {1, 10, 20, 50};
+
+    public static void main(String[] args) throws Exception {
+
+        final JSONObject config = new JSONObject(new String(Files.readAllBytes(Paths.get("../config.json")), StandardCharsets.UTF_8));
+        final Path outputDir = Paths.get("../certificates/depth");
+        Files.createDirectories(outputDir);
+
+        new DepthCertificateGenerator(config, outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
+    }
+
+    private final Path outputDir;
+    private final GeneratorOptions options;
+    private final String hostname;
+
+    private final JSONArray depthManifest = new JSONArray();
+    private int nextCertId = 1;
+
+    private DepthCertificateGenerator(JSONObject config, Path outputDir, GeneratorOptions options) {
+        this.outputDir = outputDir;
+        this.options = options;
+        this.hostname = config.getString("hostname");
+    }
+
+    private void generateCertificates() throws Exception {
+
+        KeyStore rootCa = new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("Depth Test Root CA")
+                .setIsCa(true)
+                .build();
+        CertificateGenerator.writeCertificate(rootCa.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve("root.crt"));
+
+        for (int intermediateCount : INTERMEDIATE_COUNTS) {
+            // The shallowest chain is a control that every verifier should accept.
+            writeCase(rootCa, intermediateCount, intermediateCount == 1 ? "OK" : "WEAK-OK");
+        }
+
+        final JSONObject manifest = new JSONObject();
+        manifest.put("depthManifest", depthManifest);
+        Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    /**
+     * Writes a chain of intermediateCount intermediates from rootCa: the leaf's key to {@code <id>.key}, the leaf to
+     * {@code <id>.crt} and the intermediates, from the leaf's issuer up, to {@code <id>.chain}.
+     */
+    private void writeCase(KeyStore rootCa, int intermediateCount, String expect) throws Exception {
+        System.out.println("Generating depth test " + nextCertId + "...");
+
+        List<KeyStore> intermediates = new ArrayList<>();
+        KeyStore issuer = rootCa;
+        for (int i = 0; i < intermediateCount; i++) {
+            issuer = new KeyStoreGenerator(options)
+                    .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(issuer))
+                    .setCommonName("Depth Test Intermediate CA " + (i + 1))
+                    .setIsCa(true)
+                    .build();
+            intermediates.add(0, issuer);
+        }
+
+        KeyStore leaf = new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(issuer))
+                .setIsCa(false)
+                .setCommonName(hostname)
+                .setSubjectAlternateNames(new GeneralNames(new GeneralName(GeneralName.dNSName, hostname)))
+                .build();
+
+        try (OutputStream stream = Files.newOutputStream(outputDir.resolve(nextCertId + ".key"));
+             OutputStreamWriter writer = new OutputStreamWriter(stream);
+             JcaPEMWriter pemWriter = new JcaPEMWriter(writer)) {
+            pemWriter.writeObject(CertificateGenerator.getSignerPrivateKey(leaf).getPrivateKey());
+        }
+        CertificateGenerator.writeCertificate(leaf.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve(nextCertId + ".crt"));
+
+        try (OutputStream stream = Files.newOutputStream(outputDir.resolve(nextCertId + ".chain"));
+             OutputStreamWriter writer = new OutputStreamWriter(stream);
+             JcaPEMWriter pemWriter = new JcaPEMWriter(writer)) {
+            for (KeyStore intermediate : intermediates) {
+                pemWriter.writeObject(intermediate.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS));
+            }
+        }
+
+        depthManifest.put(new JSONObject()
+                .put("id", nextCertId)
+                .put("intermediates", intermediateCount)
+                // The depth counts every certificate in the path, including the leaf and the root.
+                .put("depth", intermediateCount + 2)
+                .put("expect", expect)
+                .put("description", "The chain has " + intermediateCount + " intermediate" + (intermediateCount == 1 ? "" : "s")
+                        + ", " + (intermediateCount + 2) + " certificates including the leaf and the root.")
+        );
+
+        nextCertId += 1;
+    }
+}
@@ -0,0 +1,187 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.asn1.x500.X500Name;
+import org.bouncycastle.asn1.x509.GeneralName;
+import org.bouncycastle.asn1.x509.GeneralNames;
+import org.bouncycastle.openssl.jcajce.JcaPEMWriter;
+import org.bouncycastle.util.encoders.Hex;
+import org.json.JSONArray;
+import org.json.JSONObject;
+
+import java.io.OutputStream;
+import java.io.OutputStreamWriter;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyPair;
+import java.security.KeyStore;
+import java.security.MessageDigest;
+
+/**
+ * Generates chains that are valid except that one of their certificates has been explicitly distrusted, as browsers
+ * and operating systems do with blocklists of certificates that are compromised or were misissued. Each test lists the
+ * SHA-256 hashes of the certificates that a verifier should distrust, on top of trusting the root, and a verifier that
+ * honours the list rejects any path through them. These are only generated when running this class directly, e.g.
+ * with {@code gradle runDistrustGenerator}.
+ */
+public class DistrustCertificateGenerator {
+
+    public static void main(String[] args) throws Exception {
+
+        final JSONObject config = new JSONObject(new String(Files.readAllBytes(Paths.get("../config.json")), StandardCharsets.UTF_8));
+        final Path outputDir = Paths.get("../certificates/distrust");
+        Files.createDirectories(outputDir);
+
+        new DistrustCertificateGenerator(config, outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
+    }
+
+    private final Path outputDir;
+    private final GeneratorOptions options;
+    private final String hostname;
+
+    private final JSONArray distrustManifest = new JSONArray();
+    private int nextCertId = 1;
+
+    private DistrustCertificateGenerator(JSONObject config, Path outputDir, GeneratorOptions options) {
+        this.outputDir = outputDir;
+        this.options = options;
+        this.hostname = config.getString("hostname");
+    }
+
+    private void generateCertificates() throws Exception {
+
+        Labelled root = new Labelled("root", new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("Distrust Test Root CA")
+                .setIsCa(true)
+                .build());
+        CertificateGenerator.writeCertificate(root.keyStore.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve("root.crt"));
+
+        // The intermediate is issued twice with the same name and key, so that distrusting one issuance leaves a
+        // path through the other.
+        X500Name intermediateName = new X500Name("O=Netflix Inc, OU=Platform Security (" + options.nextUniqueId() + "), CN=Distrust Test Intermediate CA");
+        KeyPair intermediateKeyPair = options.nextKeyPair();
+        Labelled intermediate = new Labelled("intermediate", makeIntermediate(root.keyStore, intermediateName, intermediateKeyPair));
+        Labelled reissued = new Labelled("reissuedIntermediate", makeIntermediate(root.keyStore, intermediateName, intermediateKeyPair));
+        Labelled unrelated = new Labelled("unrelated", new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("Distrust Test Unrelated CA")
+                .setIsCa(true)
+                .build());
+
+        Labelled leaf = new Labelled("leaf", new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(intermediate.keyStore))
+                .setIsCa(false)
+                .setCommonName(hostname)
+                .setSubjectAlternateNames(new GeneralNames(new GeneralName(GeneralName.dNSName, hostname)))
+                .build());
+
+        Labelled[] presented = {intermediate};
+
+        writeCase("noneDistrusted", "OK",
+                "Nothing is distrusted, so the chain is valid.",
+                leaf, presented);
+        writeCase("intermediateDistrusted", "ERROR",
+                "The leaf's issuer is distrusted.",
+                leaf, presented, intermediate);
+        writeCase("leafDistrusted", "ERROR",
+                "The leaf itself is distrusted.",
+                leaf, presented, leaf);
+        writeCase("rootDistrusted", "ERROR",
+                "The root is distrusted, which overrides it being trusted.",
+                leaf, presented, root);
+        writeCase("unrelatedDistrusted", "OK",
+                "A CA that isn't part of the path is distrusted.",
+                leaf, presented, unrelated);
+        writeCase("reissuedIntermediateAvoidsDistrusted", "OK",
+                "The leaf's issuer is distrusted, but a reissue of it with the same name and key, which isn't, is also presented and completes the path.",
+                leaf, new Labelled[]{intermediate, reissued}, intermediate);
+
+        final JSONObject manifest = new JSONObject();
+        manifest.put("distrustManifest", distrustManifest);
+        Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    private KeyStore makeIntermediate(KeyStore issuer, X500Name subjectName, KeyPair keyPair) throws Exception {
+        return new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(issuer))
+                .setSubjectName(subjectName)
+                .setKeyPair(keyPair)
+                .setIsCa(true)
+                .build();
+    }
+
+    /**
+     * Writes the leaf's key to {@code <id>.key}, the leaf to {@code <id>.crt} and the presented intermediates to
+     * {@code <id>.chain}, and lists the distrusted certificates by label and SHA-256 hash in the manifest.
+     */
+    private void writeCase(String name, String expect, String description, Labelled leaf, Labelled[] presented, Labelled... distrusted) throws Exception {
+        System.out.println("Generating distrust test " + nextCertId + "...");
+
+        try (OutputStream stream = Files.newOutputStream(outputDir.resolve(nextCertId + ".key"));
+             OutputStreamWriter writer = new OutputStreamWriter(stream);
+             JcaPEMWriter pemWriter = new JcaPEMWriter(writer)) {
+            pemWriter.writeObject(CertificateGenerator.getSignerPrivateKey(leaf.keyStore).getPrivateKey());
+        }
+        CertificateGenerator.writeCertificate(leaf.keyStore.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve(nextCertId + ".crt"));
+
+        try (OutputStream stream = Files.newOutputStream(outputDir.resolve(nextCertId + ".chain"));
+             OutputStreamWriter writer = new OutputStreamWriter(stream);
+             JcaPEMWriter pemWriter = new JcaPEMWriter(writer)) {
+            for (Labelled certificate : presented) {
+                pemWriter.writeObject(certificate.keyStore.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS));
+            }
+        }
+
+        JSONArray labels = new JSONArray();
+        JSONArray hashes = new JSONArray();
+        for (Labelled certificate : distrusted) {
+            labels.put(certificate.label);
+            byte[] der = certificate.keyStore.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS).getEncoded();
+            hashes.put(Hex.toHexString(MessageDigest.getInstance("SHA-256").digest(der)));
+        }
+
+        distrustManifest.put(new JSONObject()
+                .put("id", nextCertId)
+                .put("name", name)
+                .put("distrusted", labels)
+                .put("distrustedHashes", hashes)
+                .put("expect", expect)
+                .put("description", description)
+        );
+
+        nextCertId += 1;
+    }
+
+    /**
+     * A certificate with the label that the manifest gives it.
+     */
+    private static class Labelled {
+        private final String label;
+        private final KeyStore keyStore;
+
+        Labelled(String label, KeyStore keyStore) {
+            this.label = label;
+            this.keyStore = keyStore;
+        }
+    }
+}
@@ -0,0 +1,178 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+
+package com.bettertls.nameconstraints;
+
+import java.math.BigInteger;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyFactory;
+import java.security.KeyPair;
+import java.security.KeyPairGenerator;
+import java.security.SecureRandom;
+import java.security.spec.AlgorithmParameterSpec;
+import java.security.spec.ECGenParameterSpec;
+import java.security.spec.PKCS8EncodedKeySpec;
+import java.security.spec.X509EncodedKeySpec;
+import java.text.SimpleDateFormat;
+import java.util.Date;
+import java.util.TimeZone;
+
+/**
+ * Controls the keys, serial numbers and validity periods of generated certificates. By default every run produces new
+ * ones. Given a seed, a start date and a key directory, regenerating the corpus is reproducible bit-for-bit, which
+ * makes corpus changes reviewable.
+ *
+ * Command line arguments:
+ *   --seed N                Derive serial numbers and new keys from the seed N.
+ *   --key-dir DIR           Reuse keys from DIR, in the order they were generated, saving any new keys there.
+ *   --not-before YYYY-MM-DD Start the validity period of every certificate on the given date (UTC).
+ */
+class GeneratorOptions {
+
+    private final SecureRandom random;
+    private final boolean isSeeded;
+    private final Path keyDir;
+    private final Date notBefore;
+
+    private long nextUniqueId = 1;
+    private int nextKeyIndex = 1;
+
+    private GeneratorOptions(Long seed, Path keyDir, Date notBefore) throws Exception {
+        if (seed != null) {
+            // SHA1PRNG is deterministic when seeded before first use.
+            this.random = SecureRandom.getInstance("SHA1PRNG");
+            this.random.setSeed(seed);
+        } else {
+            this.random = new SecureRandom();
+        }
+        this.isSeeded = seed != null;
+        this.keyDir = keyDir;
+        this.notBefore = notBefore;
+
+        if (keyDir != null) {
+            Files.createDirectories(keyDir);
+        }
+    }
+
+    static GeneratorOptions fromArgs(String[] args) throws Exception {
+        Long seed = null;
+        Path keyDir = null;
+        Date notBefore = null;
+
+        for (int i = 0; i < args.length; i++) {
+            if (i + 1 == args.length) {
+                throw new IllegalArgumentException("Missing value for " + args[i]);
+            }
+            switch (args[i]) {
+                case "--seed":
+                    seed = Long.parseLong(args[++i]);
+                    break;
+                case "--key-dir":
+                    keyDir = Paths.get(args[++i]);
+                    break;
+                case "--not-before":
+                    SimpleDateFormat format = new SimpleDateFormat("yyyy-MM-dd");
+                    format.setTimeZone(TimeZone.getTimeZone("UTC"));
+                    notBefore = format.parse(args[++i]);
+                    break;
+                default:
+                    throw new IllegalArgumentException("Unknown argument " + args[i]);
+            }
+        }
+
+        return new GeneratorOptions(seed, keyDir, notBefore);
+    }
+
+    /**
+     * Returns the next RSA key pair, loading it from the key directory if it's there.
+     */
+    KeyPair nextKeyPair() throws Exception {
+        return nextKeyPair("key-", "RSA", null);
+    }
+
+    /**
+     * Returns the next P-256 ECDSA key pair, loading it from the key directory if it's there.
+     */
+    KeyPair nextEcKeyPair() throws Exception {
+        return nextKeyPair("ec-key-", "EC", new ECGenParameterSpec("secp256r1"));
+    }
+
+    private KeyPair nextKeyPair(String prefix, String algorithm, AlgorithmParameterSpec params) throws Exception {
+        int index = nextKeyIndex++;
+
+        Path privatePath = null;
+        Path publicPath = null;
+        if (keyDir != null) {
+            privatePath = keyDir.resolve(prefix + index + ".pk8");
+            publicPath = keyDir.resolve(prefix + index + ".pub");
+            if (Files.exists(privatePath) && Files.exists(publicPath)) {
+                KeyFactory keyFactory = KeyFactory.getInstance(algorithm);
+                return new KeyPair(
+                        keyFactory.generatePublic(new X509EncodedKeySpec(Files.readAllBytes(publicPath))),
+                        keyFactory.generatePrivate(new PKCS8EncodedKeySpec(Files.readAllBytes(privatePath))));
+            }
+        }
+
+        KeyPairGenerator generator = KeyPairGenerator.getInstance(algorithm);
+        if (params != null) {
+            generator.initialize(params, random);
+        } else {
+            generator.initialize(2048, random);
+        }
+        KeyPair kp = generator.generateKeyPair();
+
+        if (keyDir != null) {
+            Files.write(privatePath, kp.getPrivate().getEncoded());
+            Files.write(publicPath, kp.getPublic().getEncoded());
+        }
+
+        return kp;
+    }
+
+    BigInteger nextSerial() {
+        if (!isSeeded) {
+            return BigInteger.valueOf(System.nanoTime());
+        }
+        // A positive serial of at most 63 bits, like System.nanoTime() gives.
+        return new BigInteger(63, random);
+    }
+
+    /**
+     * Returns a number used to make subject names unique.
+     */
+    long nextUniqueId() {
+        if (!isSeeded) {
+            return System.nanoTime();
+        }
+        return nextUniqueId++;
+    }
+
+    /**
+     * Returns the source of randomness for anything else that needs it, such as ECDSA signatures, which is seeded
+     * along with keys and serial numbers.
+     */
+    SecureRandom getRandom() {
+        return random;
+    }
+
+    Date getNotBefore() {
+        return notBefore == null ? new Date() : notBefore;
+    }
+}
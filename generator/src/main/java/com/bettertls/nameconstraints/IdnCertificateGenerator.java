@@ -0,0 +1,133 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.asn1.x509.GeneralName;
+import org.bouncycastle.asn1.x509.GeneralNames;
+import org.bouncycastle.asn1.x509.GeneralSubtree;
+import org.bouncycastle.asn1.x509.NameConstraints;
+import org.json.JSONArray;
+import org.json.JSONObject;
+
+import java.net.IDN;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyStore;
+
+/**
+ * Generates certificates for internationalized domain names under each of the TLDs listed in {@code idnTlds} in
+ * config.json, which may be given as U-labels or A-labels. Some verifiers special-case the TLDs that they know of, so
+ * these can be chosen to resemble production domains. Names are encoded as A-labels, as RFC 5280 section 7.2
+ * requires. These are only generated when running this class directly, e.g. with {@code gradle runIdnGenerator}.
+ */
+public class IdnCertificateGenerator {
+
+    // Internationalized labels placed under each TLD: "bücher" and "例え".
+    private static final String[] LABELS = new String[] { "b\u00fccher", "\u4f8b\u3048" };
+
+    public static void main(String[] args) throws Exception {
+
+        final JSONObject config = new JSONObject(new String(Files.readAllBytes(Paths.get("../config.json")), StandardCharsets.UTF_8));
+        final Path outputDir = Paths.get("../certificates/idn");
+        Files.createDirectories(outputDir);
+
+        new IdnCertificateGenerator(config, outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
+    }
+
+    private final Path outputDir;
+    private final GeneratorOptions options;
+    private final JSONArray tlds;
+
+    private final JSONArray idnManifest = new JSONArray();
+    private int nextCertId = 1;
+
+    private IdnCertificateGenerator(JSONObject config, Path outputDir, GeneratorOptions options) {
+        this.outputDir = outputDir;
+        this.options = options;
+        this.tlds = config.optJSONArray("idnTlds") != null ? config.getJSONArray("idnTlds") : new JSONArray().put("test");
+    }
+
+    private void generateCertificates() throws Exception {
+
+        KeyStore rootCa = new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("IDN Test Root CA")
+                .setIsCa(true)
+                .build();
+        CertificateGenerator.writeCertificate(rootCa.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve("root.crt"));
+
+        for (int i = 0; i < tlds.length(); i++) {
+            String tld = IDN.toASCII(tlds.getString(i));
+            for (String label : LABELS) {
+                String hostname = IDN.toASCII(label) + "." + tld;
+
+                writeCase(hostname, tld, "OK", "The A-label name is unconstrained.",
+                        makeLeaf(rootCa, null, hostname));
+
+                writeCase(hostname, tld, "OK", "The A-label name is within a permitted subtree of its TLD.",
+                        makeLeaf(rootCa, new NameConstraints(new GeneralSubtree[] {
+                                new GeneralSubtree(new GeneralName(GeneralName.dNSName, tld)) }, null), hostname));
+
+                writeCase(hostname, tld, "ERROR", "The A-label name is within an excluded subtree of its TLD.",
+                        makeLeaf(rootCa, new NameConstraints(null, new GeneralSubtree[] {
+                                new GeneralSubtree(new GeneralName(GeneralName.dNSName, tld)) }), hostname));
+
+                writeCase(hostname, tld, "ERROR", "The A-label name is within an excluded subtree that is itself an A-label.",
+                        makeLeaf(rootCa, new NameConstraints(null, new GeneralSubtree[] {
+                                new GeneralSubtree(new GeneralName(GeneralName.dNSName, hostname)) }), hostname));
+            }
+        }
+
+        final JSONObject manifest = new JSONObject();
+        manifest.put("idnManifest", idnManifest);
+        Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    private KeyStore makeLeaf(KeyStore rootCa, NameConstraints nameConstraints, String hostname) throws Exception {
+        KeyStore intermediate = new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(rootCa))
+                .setCommonName("IDN Test Intermediate CA")
+                .setIsCa(true)
+                .setNameConstraints(nameConstraints)
+                .build();
+
+        return new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(intermediate))
+                .setCommonName(hostname)
+                .setIsCa(false)
+                .setSubjectAlternateNames(new GeneralNames(new GeneralName(GeneralName.dNSName, hostname)))
+                .build();
+    }
+
+    private void writeCase(String hostname, String tld, String expect, String description, KeyStore leaf) throws Exception {
+        System.out.println("Generating IDN certificate " + nextCertId + "...");
+        CertificateGenerator.writeCertificateSet(leaf, outputDir, Integer.toString(nextCertId));
+
+        idnManifest.put(new JSONObject()
+                .put("id", nextCertId)
+                .put("hostname", hostname)
+                .put("tld", tld)
+                .put("expect", expect)
+                .put("description", description)
+        );
+
+        nextCertId += 1;
+    }
+}
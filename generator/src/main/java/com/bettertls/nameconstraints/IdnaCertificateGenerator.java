@@ -0,0 +1,148 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.asn1.x509.GeneralName;
+import org.bouncycastle.asn1.x509.GeneralNames;
+import org.bouncycastle.asn1.x509.GeneralSubtree;
+import org.bouncycastle.asn1.x509.NameConstraints;
+import org.json.JSONArray;
+import org.json.JSONObject;
+
+import java.net.IDN;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyStore;
+
+/**
+ * Generates probes for whether a verifier maps internationalized names with the tables of IDNA2003 or IDNA2008, using
+ * labels with characters that the two treat differently: IDNA2003 maps ß and final sigma to "ss" and σ and drops
+ * joiners, where IDNA2008 keeps them. Neither behaviour is wrong for a verifier, so every probe is expected to be
+ * either accepted or rejected, and results files record which mapping each verifier was detected to use. The first TLD
+ * listed in {@code idnTlds} in config.json is used. These are only generated when running this class directly, e.g.
+ * with {@code gradle runIdnaGenerator}.
+ */
+public class IdnaCertificateGenerator {
+
+    // Each probe's name, its U-label and its IDNA2003 and IDNA2008 forms. java.net.IDN only implements IDNA2003, so
+    // the IDNA2008 A-labels are given here, as in the examples of UTS #46 section 4. The U-labels are "faß", "βόλος",
+    // Sinhala "śrī" with a zero width joiner and Persian "nāme-ī" with a zero width non-joiner.
+    private static final String[][] PROBES = new String[][] {
+            { "sharpS", "fa\u00df", "fass", "xn--fa-hia" },
+            { "finalSigma", "\u03b2\u03cc\u03bb\u03bf\u03c2", "xn--nxasmq6b", "xn--nxasmm1c" },
+            { "zeroWidthJoiner", "\u0dc1\u0dca\u200d\u0dbb\u0dd3", "xn--10cl1a0b", "xn--10cl1a0b660p" },
+            { "zeroWidthNonJoiner", "\u0646\u0627\u0645\u0647\u200c\u0627\u06cc", "xn--mgba3gch31f", "xn--mgba3gch31f060k" },
+    };
+
+    public static void main(String[] args) throws Exception {
+
+        final JSONObject config = new JSONObject(new String(Files.readAllBytes(Paths.get("../config.json")), StandardCharsets.UTF_8));
+        final Path outputDir = Paths.get("../certificates/idna");
+        Files.createDirectories(outputDir);
+
+        new IdnaCertificateGenerator(config, outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
+    }
+
+    private final Path outputDir;
+    private final GeneratorOptions options;
+    private final String tld;
+
+    private final JSONArray idnaManifest = new JSONArray();
+    private int nextCertId = 1;
+
+    private IdnaCertificateGenerator(JSONObject config, Path outputDir, GeneratorOptions options) {
+        this.outputDir = outputDir;
+        this.options = options;
+        this.tld = IDN.toASCII(config.optJSONArray("idnTlds") != null ? config.getJSONArray("idnTlds").getString(0) : "test");
+    }
+
+    private void generateCertificates() throws Exception {
+
+        KeyStore rootCa = new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("IDNA Test Root CA")
+                .setIsCa(true)
+                .build();
+        CertificateGenerator.writeCertificate(rootCa.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve("root.crt"));
+
+        for (String[] probe : PROBES) {
+            String uName = probe[1] + "." + tld;
+            String idna2003Name = probe[2] + "." + tld;
+            String idna2008Name = probe[3] + "." + tld;
+
+            // The verifier is given the U-label name, and accepts the certificate whose SAN is the form it maps it to.
+            writeCase(probe[0], "hostname", "IDNA2003", uName,
+                    "The SAN is the IDNA2003 form of the name, which verifiers that map it with IDNA2003 accept.",
+                    makeLeaf(rootCa, null, idna2003Name));
+            writeCase(probe[0], "hostname", "IDNA2008", uName,
+                    "The SAN is the IDNA2008 form of the name, which verifiers that map it with IDNA2008 accept.",
+                    makeLeaf(rootCa, null, idna2008Name));
+
+            // The SAN is the IDNA2008 form and the excluded subtree the IDNA2003 form, so only verifiers that decode
+            // the SAN and map it again with IDNA2003 before checking the constraints reject it.
+            writeCase(probe[0], "constraint", "IDNA2003", idna2008Name,
+                    "The SAN is the IDNA2008 form of the name and the IDNA2003 form is excluded, which verifiers that remap names in certificates with IDNA2003 reject.",
+                    makeLeaf(rootCa, new NameConstraints(null, new GeneralSubtree[] {
+                            new GeneralSubtree(new GeneralName(GeneralName.dNSName, idna2003Name)) }), idna2008Name));
+        }
+
+        final JSONObject manifest = new JSONObject();
+        manifest.put("idnaManifest", idnaManifest);
+        Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    private KeyStore makeLeaf(KeyStore rootCa, NameConstraints nameConstraints, String sanName) throws Exception {
+        KeyStore intermediate = new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(rootCa))
+                .setCommonName("IDNA Test Intermediate CA")
+                .setIsCa(true)
+                .setNameConstraints(nameConstraints)
+                .build();
+
+        return new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(intermediate))
+                .setCommonName(sanName)
+                .setIsCa(false)
+                .setSubjectAlternateNames(new GeneralNames(new GeneralName(GeneralName.dNSName, sanName)))
+                .build();
+    }
+
+    /**
+     * Writes a probe, which detects that the verifier uses mapping if it's accepted or, for a constraint probe,
+     * rejected. Each is expected to be either.
+     */
+    private void writeCase(String probe, String kind, String mapping, String hostname, String description, KeyStore leaf) throws Exception {
+        System.out.println("Generating IDNA probe " + nextCertId + "...");
+        CertificateGenerator.writeCertificateSet(leaf, outputDir, Integer.toString(nextCertId));
+
+        idnaManifest.put(new JSONObject()
+                .put("id", nextCertId)
+                .put("probe", probe)
+                .put("kind", kind)
+                .put("mapping", mapping)
+                .put("hostname", hostname)
+                .put("expect", "WEAK-OK")
+                .put("description", description)
+        );
+
+        nextCertId += 1;
+    }
+}
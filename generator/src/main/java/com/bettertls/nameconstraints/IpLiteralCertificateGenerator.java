@@ -0,0 +1,136 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.asn1.x509.GeneralName;
+import org.bouncycastle.asn1.x509.GeneralNames;
+import org.json.JSONArray;
+import org.json.JSONObject;
+
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyStore;
+
+/**
+ * Generates certificates with iPAddress SANs that are verified against IP literals in different textual forms, such
+ * as with leading zeros, in brackets or with an IPv6 zone ID, to measure how verifiers normalize IP literals before
+ * matching them. Unlike the main corpus, the name under test differs from test to test. These are only generated when
+ * running this class directly, e.g. with {@code gradle runIpLiteralGenerator}.
+ */
+public class IpLiteralCertificateGenerator {
+
+    private static final String IPV6 = "2001:db8::1";
+
+    public static void main(String[] args) throws Exception {
+
+        final JSONObject config = new JSONObject(new String(Files.readAllBytes(Paths.get("../config.json")), StandardCharsets.UTF_8));
+        final Path outputDir = Paths.get("../certificates/ipliteral");
+        Files.createDirectories(outputDir);
+
+        new IpLiteralCertificateGenerator(config, outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
+    }
+
+    private final Path outputDir;
+    private final GeneratorOptions options;
+    private final String ip;
+
+    private final JSONArray ipLiteralManifest = new JSONArray();
+    private int nextCertId = 1;
+
+    private IpLiteralCertificateGenerator(JSONObject config, Path outputDir, GeneratorOptions options) {
+        this.outputDir = outputDir;
+        this.options = options;
+        this.ip = config.getString("ip");
+    }
+
+    private void generateCertificates() throws Exception {
+
+        KeyStore rootCa = new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("IP Literal Test Root CA")
+                .setIsCa(true)
+                .build();
+        CertificateGenerator.writeCertificate(rootCa.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve("root.crt"));
+
+        String[] octets = ip.split("\\.");
+        String zeroPadded = String.format("%03d.%03d.%03d.%03d",
+                Integer.parseInt(octets[0]), Integer.parseInt(octets[1]), Integer.parseInt(octets[2]), Integer.parseInt(octets[3]));
+
+        writeCase(rootCa, ip, ip, "canonical", "OK",
+                "The IPv4 literal is in dotted-decimal form.");
+        writeCase(rootCa, ip, zeroPadded, "leadingZeros", "ERROR",
+                "The IPv4 literal has leading zeros, which some parsers read as octal, giving a different address.");
+        writeCase(rootCa, ip, ip + ".", "trailingDot", "ERROR",
+                "The IPv4 literal has a trailing dot, which makes it a DNS name rather than an IP address.");
+        writeCase(rootCa, ip, "[" + ip + "]", "brackets", "WEAK-OK",
+                "The IPv4 literal is in brackets, which URLs only use for IPv6 literals.");
+        writeCase(rootCa, ip, "::ffff:" + ip, "ipv4MappedLiteral", "WEAK-OK",
+                "The name is the IPv4-mapped IPv6 form of the IPv4 address in the SAN.");
+        writeCase(rootCa, "::ffff:" + ip, ip, "ipv4MappedSan", "WEAK-OK",
+                "The SAN is a 16-byte IPv4-mapped IPv6 address, and the name is the IPv4 address that it maps.");
+
+        writeCase(rootCa, IPV6, IPV6, "canonical", "OK",
+                "The IPv6 literal is in its canonical, compressed form.");
+        writeCase(rootCa, IPV6, "2001:0db8:0000:0000:0000:0000:0000:0001", "expanded", "OK",
+                "The IPv6 literal is written out in full, with leading zeros, which is equivalent.");
+        writeCase(rootCa, IPV6, IPV6.toUpperCase(), "uppercase", "OK",
+                "The IPv6 literal is in upper case, which is equivalent.");
+        writeCase(rootCa, IPV6, "[" + IPV6 + "]", "brackets", "WEAK-OK",
+                "The IPv6 literal is in brackets, as in a URL.");
+        writeCase(rootCa, IPV6, IPV6 + "%eth0", "zoneId", "WEAK-OK",
+                "The IPv6 literal has a zone ID, which identifies an interface and isn't part of the address.");
+        writeCase(rootCa, IPV6, "2001:db8::2", "different", "ERROR",
+                "The IPv6 literal is a different address.");
+
+        final JSONObject manifest = new JSONObject();
+        manifest.put("ipLiteralManifest", ipLiteralManifest);
+        Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    private void writeCase(KeyStore rootCa, String sanIp, String hostname, String form, String expect, String description) throws Exception {
+        System.out.println("Generating IP literal certificate " + nextCertId + "...");
+
+        KeyStore intermediate = new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(rootCa))
+                .setCommonName("IP Literal Test Intermediate CA")
+                .setIsCa(true)
+                .build();
+
+        KeyStore leaf = new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(intermediate))
+                .setIsCa(false)
+                .setSubjectAlternateNames(new GeneralNames(new GeneralName(GeneralName.iPAddress, sanIp)))
+                .build();
+
+        CertificateGenerator.writeCertificateSet(leaf, outputDir, Integer.toString(nextCertId));
+
+        ipLiteralManifest.put(new JSONObject()
+                .put("id", nextCertId)
+                .put("sanIp", sanIp)
+                .put("hostname", hostname)
+                .put("form", form)
+                .put("expect", expect)
+                .put("description", description)
+        );
+
+        nextCertId += 1;
+    }
+}
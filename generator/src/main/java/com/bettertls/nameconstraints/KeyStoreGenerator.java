@@ -18,6 +18,8 @@
 
 package com.bettertls.nameconstraints;
 
+import org.bouncycastle.asn1.ASN1Encodable;
+import org.bouncycastle.asn1.ASN1ObjectIdentifier;
 import org.bouncycastle.asn1.x500.X500Name;
 import org.bouncycastle.asn1.x509.*;
 import org.bouncycastle.cert.X509CertificateHolder;
@@ -27,22 +29,34 @@ import org.bouncycastle.operator.jcajce.JcaContentSignerBuilder;
 import java.io.ByteArrayInputStream;
 import java.math.BigInteger;
 import java.security.KeyPair;
-import java.security.KeyPairGenerator;
 import java.security.KeyStore;
 import java.security.cert.CertificateFactory;
+import java.util.ArrayList;
 import java.util.Calendar;
 import java.util.Date;
+import java.util.List;
 
 class KeyStoreGenerator {
 
     public static final String DEFAULT_ALIAS = "1";
     public static final String KEYSTORE_PASSWORD = "changeit";
 
+    private final GeneratorOptions options;
     private KeyStore.PrivateKeyEntry caKeyEntry;
     private String commonName;
     private boolean isCa;
     private NameConstraints nameConstraints;
     private GeneralNames sans;
+    private X500Name subjectName;
+    private KeyPair keyPair;
+    private Date notBefore;
+    private Date notAfter;
+    private BigInteger serial;
+    private final List<ExtraExtension> extraExtensions = new ArrayList<>();
+
+    public KeyStoreGenerator(GeneratorOptions options) {
+        this.options = options;
+    }
 
     public KeyStoreGenerator setCaKeyEntry(KeyStore.PrivateKeyEntry caKeyEntry) {
         this.caKeyEntry = caKeyEntry;
@@ -69,10 +83,46 @@ class KeyStoreGenerator {
         return this;
     }
 
+    /**
+     * Overrides the subject name, which is otherwise derived from the common name.
+     */
+    public KeyStoreGenerator setSubjectName(X500Name subjectName) {
+        this.subjectName = subjectName;
+        return this;
+    }
+
+    /**
+     * Uses the given key pair instead of a new one, e.g. to issue the same CA from more than one issuer.
+     */
+    public KeyStoreGenerator setKeyPair(KeyPair keyPair) {
+        this.keyPair = keyPair;
+        return this;
+    }
+
+    /**
+     * Overrides the validity period, which otherwise starts at the generator's not-before date and lasts a year.
+     */
+    public KeyStoreGenerator setValidity(Date notBefore, Date notAfter) {
+        this.notBefore = notBefore;
+        this.notAfter = notAfter;
+        return this;
+    }
+
+    /**
+     * Overrides the serial number, e.g. to issue a certificate that matches a precertificate.
+     */
+    public KeyStoreGenerator setSerial(BigInteger serial) {
+        this.serial = serial;
+        return this;
+    }
+
+    public KeyStoreGenerator addExtension(ASN1ObjectIdentifier oid, boolean isCritical, ASN1Encodable value) {
+        this.extraExtensions.add(new ExtraExtension(oid, isCritical, value));
+        return this;
+    }
+
     public KeyStore build() throws Exception {
-        KeyPairGenerator rsa = KeyPairGenerator.getInstance("RSA");
-        rsa.initialize(2048);
-        KeyPair kp = rsa.generateKeyPair();
+        KeyPair kp = keyPair != null ? keyPair : options.nextKeyPair();
 
         X509CertificateHolder caCertHolder;
         if (caKeyEntry != null) {
@@ -81,24 +131,33 @@ class KeyStoreGenerator {
             caCertHolder = null;
         }
 
+        Date notBefore = this.notBefore != null ? this.notBefore : options.getNotBefore();
         Calendar cal = Calendar.getInstance();
-        cal.add(Calendar.MONTH, 12);
-        if (caCertHolder != null && cal.getTime().after(caCertHolder.getNotAfter())) {
-            cal.setTime(caCertHolder.getNotAfter());
+        if (notAfter != null) {
+            cal.setTime(notAfter);
+        } else {
+            cal.setTime(notBefore);
+            cal.add(Calendar.MONTH, 12);
+            if (caCertHolder != null && cal.getTime().after(caCertHolder.getNotAfter())) {
+                cal.setTime(caCertHolder.getNotAfter());
+            }
         }
 
         byte[] pk = kp.getPublic().getEncoded();
         SubjectPublicKeyInfo bcPk = SubjectPublicKeyInfo.getInstance(pk);
 
-        String subjectNameStr = "C=US, ST=California, L=Los Gatos, O=Netflix Inc, OU=Platform Security (" + System.nanoTime() + ")";
-        if (commonName != null) {
-            subjectNameStr += ", CN=" + commonName;
+        X500Name subjectName = this.subjectName;
+        if (subjectName == null) {
+            String subjectNameStr = "C=US, ST=California, L=Los Gatos, O=Netflix Inc, OU=Platform Security (" + options.nextUniqueId() + ")";
+            if (commonName != null) {
+                subjectNameStr += ", CN=" + commonName;
+            }
+            subjectName = new X500Name(subjectNameStr);
         }
-        X500Name subjectName = new X500Name(subjectNameStr);
         X509v3CertificateBuilder certGen = new X509v3CertificateBuilder(
                 caCertHolder == null ? subjectName : caCertHolder.getSubject(),
-                BigInteger.valueOf(System.nanoTime()),
-                new Date(),
+                serial != null ? serial : options.nextSerial(),
+                notBefore,
                 cal.getTime(),
                 subjectName,
                 bcPk
@@ -110,6 +169,9 @@ class KeyStoreGenerator {
         if (sans != null) {
             certGen.addExtension(Extension.subjectAlternativeName, false, sans);
         }
+        for (ExtraExtension extension : extraExtensions) {
+            certGen.addExtension(extension.oid, extension.isCritical, extension.value);
+        }
 
         X509CertificateHolder certHolder = certGen
                 .build(new JcaContentSignerBuilder("SHA256withRSA").build(caKeyEntry == null ? kp.getPrivate() : caKeyEntry.getPrivateKey()));
@@ -133,4 +195,16 @@ class KeyStoreGenerator {
         keyStore.setKeyEntry(DEFAULT_ALIAS, kp.getPrivate(), KEYSTORE_PASSWORD.toCharArray(), certificateChain);
         return keyStore;
     }
+
+    private static class ExtraExtension {
+        private final ASN1ObjectIdentifier oid;
+        private final boolean isCritical;
+        private final ASN1Encodable value;
+
+        private ExtraExtension(ASN1ObjectIdentifier oid, boolean isCritical, ASN1Encodable value) {
+            this.oid = oid;
+            this.isCritical = isCritical;
+            this.value = value;
+        }
+    }
 }
@@ -0,0 +1,226 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.asn1.x509.Extension;
+import org.bouncycastle.asn1.x509.GeneralName;
+import org.bouncycastle.asn1.x509.GeneralNames;
+import org.bouncycastle.asn1.x509.KeyUsage;
+import org.bouncycastle.cert.X509CRLHolder;
+import org.bouncycastle.cert.X509CertificateHolder;
+import org.bouncycastle.cert.X509v2CRLBuilder;
+import org.bouncycastle.openssl.jcajce.JcaPEMWriter;
+import org.bouncycastle.operator.jcajce.JcaContentSignerBuilder;
+import org.json.JSONArray;
+import org.json.JSONObject;
+
+import java.io.OutputStream;
+import java.io.OutputStreamWriter;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyStore;
+import java.util.Calendar;
+import java.util.Date;
+
+/**
+ * Generates chains whose certificates' key usage extensions do or don't permit what the verifier uses their keys for:
+ * intermediates with and without keyCertSign, leaves with and without the digitalSignature or keyEncipherment bit
+ * that the negotiated key exchange needs, and CRLs signed by issuers with and without cRLSign. Each test records its
+ * intended usage, the TLS key exchange and whether its revocation is checked against its {@code .crl}, which test
+ * harnesses pass on to the verifier. These are only generated when running this class directly, e.g. with
+ * {@code gradle runKeyUsageGenerator}.
+ */
+public class KeyUsageCertificateGenerator {
+
+    /** The key exchange in which the server signs its ephemeral parameters, which needs digitalSignature. */
+    private static final String ECDHE_RSA = "ECDHE_RSA";
+    /** The key exchange in which the client encrypts the premaster secret to the server, which needs keyEncipherment. */
+    private static final String RSA = "RSA";
+
+    private static final int CA_USAGE = KeyUsage.keyCertSign | KeyUsage.cRLSign;
+    private static final int SERVER_USAGE = KeyUsage.digitalSignature | KeyUsage.keyEncipherment;
+    /** Leaves the key usage extension out altogether, which leaves the key unrestricted. */
+    private static final int NO_EXTENSION = -1;
+
+    public static void main(String[] args) throws Exception {
+
+        final JSONObject config = new JSONObject(new String(Files.readAllBytes(Paths.get("../config.json")), StandardCharsets.UTF_8));
+        final Path outputDir = Paths.get("../certificates/keyusage");
+        Files.createDirectories(outputDir);
+
+        new KeyUsageCertificateGenerator(config, outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
+    }
+
+    private final Path outputDir;
+    private final GeneratorOptions options;
+    private final String hostname;
+
+    private final JSONArray keyUsageManifest = new JSONArray();
+    private KeyStore root;
+    private int nextCertId = 1;
+
+    private KeyUsageCertificateGenerator(JSONObject config, Path outputDir, GeneratorOptions options) {
+        this.outputDir = outputDir;
+        this.options = options;
+        this.hostname = config.getString("hostname");
+    }
+
+    private void generateCertificates() throws Exception {
+
+        root = new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("Key Usage Test Root CA")
+                .setIsCa(true)
+                .build();
+        CertificateGenerator.writeCertificate(root.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve("root.crt"));
+
+        writeCase("valid", "none", ECDHE_RSA, CA_USAGE, SERVER_USAGE, false, "OK",
+                "Every certificate's key usage permits what its key is used for.");
+
+        writeCase("intermediateNoKeyCertSign", "intermediate", ECDHE_RSA, KeyUsage.digitalSignature | KeyUsage.cRLSign, SERVER_USAGE, false, "ERROR",
+                "The intermediate's key usage doesn't include keyCertSign, so its signature on the leaf can't be used (RFC 5280 section 4.2.1.3).");
+        writeCase("intermediateNoKeyUsage", "intermediate", ECDHE_RSA, NO_EXTENSION, SERVER_USAGE, false, "OK",
+                "The intermediate has no key usage extension, so its key may sign certificates.");
+
+        writeCase("leafDigitalSignatureEcdhe", "leaf", ECDHE_RSA, CA_USAGE, KeyUsage.digitalSignature, false, "OK",
+                "With ECDHE_RSA the server signs its key exchange parameters, which the leaf's digitalSignature permits.");
+        writeCase("leafKeyEnciphermentEcdhe", "leaf", ECDHE_RSA, CA_USAGE, KeyUsage.keyEncipherment, false, "ERROR",
+                "With ECDHE_RSA the server signs its key exchange parameters, which needs digitalSignature, but the leaf only has keyEncipherment (RFC 5246 section 7.4.2).");
+        writeCase("leafKeyEnciphermentRsa", "leaf", RSA, CA_USAGE, KeyUsage.keyEncipherment, false, "OK",
+                "With RSA key exchange the client encrypts the premaster secret to the leaf's key, which the leaf's keyEncipherment permits.");
+        writeCase("leafDigitalSignatureRsa", "leaf", RSA, CA_USAGE, KeyUsage.digitalSignature, false, "ERROR",
+                "With RSA key exchange the client encrypts the premaster secret to the leaf's key, which needs keyEncipherment, but the leaf only has digitalSignature (RFC 5246 section 7.4.2).");
+        writeCase("leafNoKeyUsageEcdhe", "leaf", ECDHE_RSA, CA_USAGE, NO_EXTENSION, false, "OK",
+                "The leaf has no key usage extension, so its key may sign ECDHE_RSA key exchange parameters.");
+        writeCase("leafNoKeyUsageRsa", "leaf", RSA, CA_USAGE, NO_EXTENSION, false, "OK",
+                "The leaf has no key usage extension, so its key may be used for RSA key exchange.");
+        writeCase("leafKeyCertSignOnly", "leaf", ECDHE_RSA, CA_USAGE, KeyUsage.keyCertSign, false, "ERROR",
+                "The leaf's key usage only permits signing certificates, which it can't do anyway, and not the digitalSignature that ECDHE_RSA needs.");
+
+        writeCase("crlSignerCRLSign", "crlSigner", ECDHE_RSA, CA_USAGE, SERVER_USAGE, true, "OK",
+                "The leaf's issuer, whose key usage includes cRLSign, signs a CRL that doesn't list the leaf.");
+        writeCase("crlSignerNoCRLSign", "crlSigner", ECDHE_RSA, KeyUsage.keyCertSign, SERVER_USAGE, true, "ERROR",
+                "The leaf's issuer signs the CRL, but its key usage doesn't include cRLSign, so the CRL can't be used and the leaf's revocation status is unknown (RFC 5280 section 6.3.3).");
+        writeCase("crlSignerNoKeyUsage", "crlSigner", ECDHE_RSA, NO_EXTENSION, SERVER_USAGE, true, "OK",
+                "The leaf's issuer, which has no key usage extension, signs a CRL that doesn't list the leaf.");
+
+        final JSONObject manifest = new JSONObject();
+        manifest.put("keyUsageManifest", keyUsageManifest);
+        Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    /**
+     * Writes a leaf with the given key usage, issued by an intermediate with the given key usage, to {@code <id>.crt}
+     * and {@code <id>.chain}, along with the leaf's key, and, if {@code crl} is set, an empty CRL signed by the
+     * intermediate to {@code <id>.crl}. {@code component} names the certificate whose key usage the case tests.
+     */
+    private void writeCase(String name, String component, String keyExchange, int issuerUsage, int leafUsage, boolean crl, String expect, String description) throws Exception {
+        System.out.println("Generating key usage test " + nextCertId + "...");
+
+        KeyStoreGenerator intermediateGenerator = new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(root))
+                .setCommonName("Key Usage Test Intermediate CA")
+                .setIsCa(true);
+        if (issuerUsage != NO_EXTENSION) {
+            intermediateGenerator.addExtension(Extension.keyUsage, true, new KeyUsage(issuerUsage));
+        }
+        KeyStore intermediate = intermediateGenerator.build();
+
+        KeyStoreGenerator leafGenerator = new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(intermediate))
+                .setIsCa(false)
+                .setCommonName(hostname)
+                .setSubjectAlternateNames(new GeneralNames(new GeneralName(GeneralName.dNSName, hostname)));
+        if (leafUsage != NO_EXTENSION) {
+            leafGenerator.addExtension(Extension.keyUsage, true, new KeyUsage(leafUsage));
+        }
+        KeyStore leaf = leafGenerator.build();
+
+        try (OutputStream stream = Files.newOutputStream(outputDir.resolve(nextCertId + ".key"));
+             OutputStreamWriter writer = new OutputStreamWriter(stream);
+             JcaPEMWriter pemWriter = new JcaPEMWriter(writer)) {
+            pemWriter.writeObject(CertificateGenerator.getSignerPrivateKey(leaf).getPrivateKey());
+        }
+        CertificateGenerator.writeCertificate(leaf.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve(nextCertId + ".crt"));
+        CertificateGenerator.writeCertificate(intermediate.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve(nextCertId + ".chain"));
+
+        if (crl) {
+            try (OutputStream stream = Files.newOutputStream(outputDir.resolve(nextCertId + ".crl"));
+                 OutputStreamWriter writer = new OutputStreamWriter(stream);
+                 JcaPEMWriter pemWriter = new JcaPEMWriter(writer)) {
+                pemWriter.writeObject(makeEmptyCrl(intermediate));
+            }
+        }
+
+        keyUsageManifest.put(new JSONObject()
+                .put("id", nextCertId)
+                .put("name", name)
+                .put("component", component)
+                .put("keyExchange", keyExchange)
+                .put("crl", crl)
+                .put("issuerKeyUsage", usageNames(issuerUsage))
+                .put("leafKeyUsage", usageNames(leafUsage))
+                .put("expect", expect)
+                .put("description", description)
+        );
+
+        nextCertId += 1;
+    }
+
+    /**
+     * Returns a CRL signed by {@code issuer} that revokes nothing, valid for as long as the certificates are.
+     */
+    private X509CRLHolder makeEmptyCrl(KeyStore issuer) throws Exception {
+        X509CertificateHolder issuerHolder = new X509CertificateHolder(issuer.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS).getEncoded());
+
+        Date thisUpdate = options.getNotBefore();
+        Calendar cal = Calendar.getInstance();
+        cal.setTime(thisUpdate);
+        cal.add(Calendar.MONTH, 12);
+
+        X509v2CRLBuilder crlBuilder = new X509v2CRLBuilder(issuerHolder.getSubject(), thisUpdate);
+        crlBuilder.setNextUpdate(cal.getTime());
+        return crlBuilder.build(new JcaContentSignerBuilder("SHA256withRSA").build(CertificateGenerator.getSignerPrivateKey(issuer).getPrivateKey()));
+    }
+
+    /**
+     * Returns the names of the bits set in {@code usage}, as RFC 5280 gives them, or null if there's no extension.
+     */
+    private static JSONArray usageNames(int usage) {
+        if (usage == NO_EXTENSION) {
+            return null;
+        }
+        JSONArray names = new JSONArray();
+        if ((usage & KeyUsage.digitalSignature) != 0) {
+            names.put("digitalSignature");
+        }
+        if ((usage & KeyUsage.keyEncipherment) != 0) {
+            names.put("keyEncipherment");
+        }
+        if ((usage & KeyUsage.keyCertSign) != 0) {
+            names.put("keyCertSign");
+        }
+        if ((usage & KeyUsage.cRLSign) != 0) {
+            names.put("cRLSign");
+        }
+        return names;
+    }
+}
@@ -0,0 +1,341 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.asn1.ASN1Encodable;
+import org.bouncycastle.asn1.ASN1Encoding;
+import org.bouncycastle.asn1.ASN1ObjectIdentifier;
+import org.bouncycastle.asn1.DERNull;
+import org.bouncycastle.asn1.DEROctetString;
+import org.bouncycastle.asn1.pkcs.PKCSObjectIdentifiers;
+import org.bouncycastle.asn1.x509.AlgorithmIdentifier;
+import org.bouncycastle.asn1.x509.BasicConstraints;
+import org.bouncycastle.asn1.x509.Extension;
+import org.bouncycastle.asn1.x509.GeneralName;
+import org.bouncycastle.asn1.x509.GeneralNames;
+import org.bouncycastle.asn1.x509.GeneralSubtree;
+import org.bouncycastle.asn1.x509.NameConstraints;
+import org.bouncycastle.asn1.x509.Time;
+import org.bouncycastle.cert.X509CertificateHolder;
+import org.bouncycastle.openssl.jcajce.JcaPEMWriter;
+import org.bouncycastle.util.io.pem.PemObject;
+import org.json.JSONArray;
+import org.json.JSONObject;
+
+import java.io.ByteArrayOutputStream;
+import java.io.OutputStream;
+import java.io.OutputStreamWriter;
+import java.math.BigInteger;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyPair;
+import java.security.KeyStore;
+import java.security.PrivateKey;
+import java.security.Signature;
+import java.util.Arrays;
+import java.util.Calendar;
+import java.util.Date;
+
+/**
+ * Generates certificates with malformed encodings, such as out of range serial numbers or BER where DER is required,
+ * and with duplicate or unrecognised extensions. The certificates are assembled byte by byte, since BouncyCastle won't
+ * produce most of these, and then signed, so that the malformation is the only thing wrong with them. Each case notes
+ * the rule that it breaks. These are only generated when running this class
+ * directly, e.g. with {@code gradle runMalformedGenerator}.
+ */
+public class MalformedCertificateGenerator {
+
+    // OID 2.5.4.3, id-at-commonName.
+    private static final byte[] COMMON_NAME_OID = new byte[] { 0x06, 0x03, 0x55, 0x04, 0x03 };
+    // OID 2.5.29.17, id-ce-subjectAltName.
+    private static final byte[] SUBJECT_ALT_NAME_OID = new byte[] { 0x06, 0x03, 0x55, 0x1d, 0x11 };
+    // An arbitrary OID, under the UUID arc from X.667, that no verifier will recognise.
+    private static final ASN1ObjectIdentifier UNKNOWN_EXTENSION = new ASN1ObjectIdentifier("2.25.329800735698586629295641978511506172918");
+
+    private static final String RULE_SERIAL = "RFC 5280, section 4.1.2.2: serial numbers are positive and at most 20 octets.";
+    private static final String RULE_DER = "RFC 5280, section 4.1: certificates are DER encoded.";
+    private static final String RULE_DUPLICATE_EXTENSION = "RFC 5280, section 4.2: a certificate must not include more than one instance of an extension.";
+    private static final String RULE_CRITICAL_EXTENSION = "RFC 5280, section 4.2: a certificate with an unrecognised critical extension must be rejected.";
+    private static final String RULE_DNS_NAME_IA5 = "RFC 5280, section 4.2.1.6: a dNSName is an IA5String.";
+    private static final String RULE_DNS_NAME_SYNTAX = "RFC 5280, section 4.2.1.6: a dNSName is in the preferred name syntax of RFC 1034.";
+
+    public static void main(String[] args) throws Exception {
+
+        final JSONObject config = new JSONObject(new String(Files.readAllBytes(Paths.get("../config.json")), StandardCharsets.UTF_8));
+        final Path outputDir = Paths.get("../certificates/malformed");
+        Files.createDirectories(outputDir);
+
+        new MalformedCertificateGenerator(config, outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
+    }
+
+    private final Path outputDir;
+    private final GeneratorOptions options;
+    private final String hostname;
+    private final String invalidHostname;
+    private final String hostSubtree;
+    private final String invalidHostSubtree;
+
+    private final JSONArray malformedManifest = new JSONArray();
+    private int nextCertId = 1;
+
+    private byte[] issuerName;
+    private PrivateKey issuerKey;
+    private KeyPair leafKeyPair;
+
+    private MalformedCertificateGenerator(JSONObject config, Path outputDir, GeneratorOptions options) {
+        this.outputDir = outputDir;
+        this.options = options;
+        this.hostname = config.getString("hostname");
+        this.invalidHostname = config.getString("invalidHostname");
+        this.hostSubtree = config.getString("hostSubtree");
+        this.invalidHostSubtree = config.getString("invalidHostSubtree");
+    }
+
+    private void generateCertificates() throws Exception {
+
+        KeyStore rootCa = new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("Malformed Certificate Test Root CA")
+                .setIsCa(true)
+                .build();
+        CertificateGenerator.writeCertificate(rootCa.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve("root.crt"));
+
+        KeyStore.PrivateKeyEntry rootKeyEntry = CertificateGenerator.getSignerPrivateKey(rootCa);
+        issuerName = new X509CertificateHolder(rootKeyEntry.getCertificate().getEncoded()).getSubject().getEncoded(ASN1Encoding.DER);
+        issuerKey = rootKeyEntry.getPrivateKey();
+        leafKeyPair = options.nextKeyPair();
+
+        byte[] commonName = tlv(0x0c, hostname.getBytes(StandardCharsets.UTF_8));
+        byte[] serial = tlv(0x02, new byte[] { 0x01 });
+
+        writeCase("A well-formed certificate, for comparison.", null, "OK",
+                makeCertificate(serial, commonName), null);
+
+        writeCase("The serial number is negative. RFC 5280 section 4.1.2.2 requires it to be positive, but asks certificate users to handle such certificates gracefully.", RULE_SERIAL, "WEAK-OK",
+                makeCertificate(tlv(0x02, new byte[] { (byte) 0xff }), commonName), null);
+
+        byte[] twentyOctets = new byte[20];
+        Arrays.fill(twentyOctets, (byte) 0x7f);
+        writeCase("The serial number is 20 octets long, the longest that RFC 5280 section 4.1.2.2 requires certificate users to handle.", null, "OK",
+                makeCertificate(tlv(0x02, twentyOctets), commonName), null);
+
+        byte[] twentyOneOctets = new BigInteger(1, new byte[] {
+                0x01, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f,
+                0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f }).toByteArray();
+        writeCase("The serial number is 21 octets long, more than RFC 5280 section 4.1.2.2 permits.", RULE_SERIAL, "WEAK-OK",
+                makeCertificate(tlv(0x02, twentyOneOctets), commonName), null);
+
+        writeCase("The serial number is encoded with a redundant leading zero octet, which DER forbids.", RULE_DER, "ERROR",
+                makeCertificate(tlv(0x02, new byte[] { 0x00, 0x01 }), commonName), null);
+
+        byte[] hostnameBytes = hostname.getBytes(StandardCharsets.UTF_8);
+        int split = hostnameBytes.length / 2;
+        byte[] constructedCommonName = tlv(0x2c,
+                tlv(0x0c, Arrays.copyOfRange(hostnameBytes, 0, split)),
+                tlv(0x0c, Arrays.copyOfRange(hostnameBytes, split, hostnameBytes.length)));
+        writeCase("The subject's common name is a BER constructed string, which DER forbids.", RULE_DER, "ERROR",
+                makeCertificate(serial, constructedCommonName), null);
+
+        writeCase("There is trailing data after the certificate, inside the PEM block.", RULE_DER, "ERROR",
+                makeCertificate(serial, commonName), new byte[] { 0x00, 0x00 });
+
+        byte[] san = extension(Extension.subjectAlternativeName, false, new GeneralNames(new GeneralName(GeneralName.dNSName, hostname)));
+        byte[] invalidSan = extension(Extension.subjectAlternativeName, false, new GeneralNames(new GeneralName(GeneralName.dNSName, invalidHostname)));
+        byte[] subject = makeName(commonName);
+
+        writeCase("The subject alternative name extension appears twice, with the same value.", RULE_DUPLICATE_EXTENSION, "ERROR",
+                sign(issuerName, issuerKey, serial, subject, leafKeyPair, san, san), null);
+
+        writeCase("The subject alternative name extension appears twice, first with a different name and then with the name being verified.", RULE_DUPLICATE_EXTENSION, "ERROR",
+                sign(issuerName, issuerKey, serial, subject, leafKeyPair, invalidSan, san), null);
+
+        byte[] intermediateName = makeName(tlv(0x0c, "Malformed Certificate Test Intermediate CA".getBytes(StandardCharsets.UTF_8)));
+        KeyPair intermediateKeyPair = options.nextKeyPair();
+        byte[] intermediate = sign(issuerName, issuerKey, serial, intermediateName, intermediateKeyPair,
+                extension(Extension.basicConstraints, true, new BasicConstraints(true)),
+                extension(Extension.nameConstraints, true, new NameConstraints(new GeneralSubtree[] {
+                        new GeneralSubtree(new GeneralName(GeneralName.dNSName, hostSubtree)) }, null)),
+                extension(Extension.nameConstraints, true, new NameConstraints(new GeneralSubtree[] {
+                        new GeneralSubtree(new GeneralName(GeneralName.dNSName, invalidHostSubtree)) }, null)));
+        writeCase("The intermediate has two name constraints extensions, one permitting the leaf's name and one not.", RULE_DUPLICATE_EXTENSION, "ERROR",
+                sign(intermediateName, intermediateKeyPair.getPrivate(), serial, subject, leafKeyPair, san), null, intermediate);
+
+        writeCase("The leaf has an unrecognised critical extension.", RULE_CRITICAL_EXTENSION, "ERROR",
+                sign(issuerName, issuerKey, serial, subject, leafKeyPair, san,
+                        extension(UNKNOWN_EXTENSION, true, DERNull.INSTANCE)), null);
+
+        writeCase("The leaf has an unrecognised extension that isn't critical, for comparison.", null, "OK",
+                sign(issuerName, issuerKey, serial, subject, leafKeyPair, san,
+                        extension(UNKNOWN_EXTENSION, false, DERNull.INSTANCE)), null);
+
+        // dNSName SANs with bytes that a strict parser rejects, alongside the name being verified, so that the results
+        // show whether the verifier rejected them while parsing, while verifying or not at all.
+        writeCase("The leaf has a second DNS SAN containing raw UTF-8, which isn't valid in an IA5String.", RULE_DNS_NAME_IA5, "ERROR",
+                sign(issuerName, issuerKey, serial, subject, leafKeyPair,
+                        rawDnsSans(hostnameBytes, ("b\u00fccher." + hostSubtree).getBytes(StandardCharsets.UTF_8))), null);
+        writeCase("The leaf has a second DNS SAN containing a space.", RULE_DNS_NAME_SYNTAX, "WEAK-OK",
+                sign(issuerName, issuerKey, serial, subject, leafKeyPair,
+                        rawDnsSans(hostnameBytes, ("has space." + hostSubtree).getBytes(StandardCharsets.US_ASCII))), null);
+        writeCase("The leaf has a second DNS SAN containing an underscore, which is common in practice.", RULE_DNS_NAME_SYNTAX, "WEAK-OK",
+                sign(issuerName, issuerKey, serial, subject, leafKeyPair,
+                        rawDnsSans(hostnameBytes, ("under_score." + hostSubtree).getBytes(StandardCharsets.US_ASCII))), null);
+        writeCase("The leaf has a second DNS SAN containing a control character, U+0001.", RULE_DNS_NAME_SYNTAX, "WEAK-OK",
+                sign(issuerName, issuerKey, serial, subject, leafKeyPair,
+                        rawDnsSans(hostnameBytes, ("control\u0001." + hostSubtree).getBytes(StandardCharsets.US_ASCII))), null);
+
+        final JSONObject manifest = new JSONObject();
+        manifest.put("malformedManifest", malformedManifest);
+        Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    /**
+     * Returns a DER-encoded leaf certificate, issued by the root, with the given encoded serial number and common name
+     * value.
+     */
+    private byte[] makeCertificate(byte[] serial, byte[] commonNameValue) throws Exception {
+        return sign(issuerName, issuerKey, serial, makeName(commonNameValue), leafKeyPair,
+                extension(Extension.subjectAlternativeName, false, new GeneralNames(new GeneralName(GeneralName.dNSName, hostname))));
+    }
+
+    /**
+     * Returns an encoded name with a single common name, given its encoded value.
+     */
+    private static byte[] makeName(byte[] commonNameValue) {
+        return tlv(0x30, tlv(0x31, tlv(0x30, COMMON_NAME_OID, commonNameValue)));
+    }
+
+    /**
+     * Returns an encoded subject alternative name extension with a dNSName for each of the given names, whose bytes
+     * are included as given.
+     */
+    private static byte[] rawDnsSans(byte[]... names) {
+        byte[][] generalNames = new byte[names.length][];
+        for (int i = 0; i < names.length; i++) {
+            generalNames[i] = tlv(0x82, names[i]);
+        }
+        return tlv(0x30, SUBJECT_ALT_NAME_OID, tlv(0x04, tlv(0x30, generalNames)));
+    }
+
+    private static byte[] extension(ASN1ObjectIdentifier oid, boolean isCritical, ASN1Encodable value) throws Exception {
+        return new Extension(oid, isCritical, new DEROctetString(value)).getEncoded(ASN1Encoding.DER);
+    }
+
+    /**
+     * Returns a DER-encoded certificate with the given encoded names, serial number and extensions, which are included
+     * as given, signed with signerKey.
+     */
+    private byte[] sign(byte[] issuer, PrivateKey signerKey, byte[] serial, byte[] subject, KeyPair subjectKeyPair,
+                        byte[]... extensions) throws Exception {
+        byte[] signatureAlgorithm = new AlgorithmIdentifier(PKCSObjectIdentifiers.sha256WithRSAEncryption, DERNull.INSTANCE)
+                .getEncoded(ASN1Encoding.DER);
+
+        Date notBefore = options.getNotBefore();
+        Calendar cal = Calendar.getInstance();
+        cal.setTime(notBefore);
+        cal.add(Calendar.MONTH, 12);
+        byte[] validity = tlv(0x30,
+                new Time(notBefore).getEncoded(ASN1Encoding.DER),
+                new Time(cal.getTime()).getEncoded(ASN1Encoding.DER));
+
+        byte[] tbsCertificate = tlv(0x30,
+                tlv(0xa0, tlv(0x02, new byte[] { 0x02 })),
+                serial,
+                signatureAlgorithm,
+                issuer,
+                validity,
+                subject,
+                subjectKeyPair.getPublic().getEncoded(),
+                tlv(0xa3, tlv(0x30, extensions)));
+
+        Signature signer = Signature.getInstance("SHA256withRSA");
+        signer.initSign(signerKey);
+        signer.update(tbsCertificate);
+        byte[] signature = signer.sign();
+
+        byte[] bitString = new byte[signature.length + 1];
+        System.arraycopy(signature, 0, bitString, 1, signature.length);
+
+        return tlv(0x30, tbsCertificate, signatureAlgorithm, tlv(0x03, bitString));
+    }
+
+    /**
+     * Returns a definite-length encoding of the given tag and concatenated contents.
+     */
+    private static byte[] tlv(int tag, byte[]... contents) {
+        ByteArrayOutputStream value = new ByteArrayOutputStream();
+        for (byte[] content : contents) {
+            value.write(content, 0, content.length);
+        }
+
+        ByteArrayOutputStream out = new ByteArrayOutputStream();
+        out.write(tag);
+        int length = value.size();
+        if (length < 0x80) {
+            out.write(length);
+        } else if (length < 0x100) {
+            out.write(0x81);
+            out.write(length);
+        } else {
+            out.write(0x82);
+            out.write(length >> 8);
+            out.write(length & 0xff);
+        }
+        out.write(value.toByteArray(), 0, value.size());
+        return out.toByteArray();
+    }
+
+    /**
+     * Writes the certificate, followed by trailer if it isn't null, as a single PEM block in {@code <id>.crt} and any
+     * intermediates to {@code <id>.chain}. rule is the rule that the certificate breaks, if any.
+     */
+    private void writeCase(String description, String rule, String expect, byte[] certificate, byte[] trailer,
+                           byte[]... intermediates) throws Exception {
+        System.out.println("Generating malformed certificate " + nextCertId + "...");
+
+        byte[] der = certificate;
+        if (trailer != null) {
+            der = Arrays.copyOf(certificate, certificate.length + trailer.length);
+            System.arraycopy(trailer, 0, der, certificate.length, trailer.length);
+        }
+
+        try (OutputStream stream = Files.newOutputStream(outputDir.resolve(nextCertId + ".crt"));
+             OutputStreamWriter writer = new OutputStreamWriter(stream);
+             JcaPEMWriter pemWriter = new JcaPEMWriter(writer)) {
+            pemWriter.writeObject(new PemObject("CERTIFICATE", der));
+        }
+
+        try (OutputStream stream = Files.newOutputStream(outputDir.resolve(nextCertId + ".chain"));
+             OutputStreamWriter writer = new OutputStreamWriter(stream);
+             JcaPEMWriter pemWriter = new JcaPEMWriter(writer)) {
+            for (byte[] intermediate : intermediates) {
+                pemWriter.writeObject(new PemObject("CERTIFICATE", intermediate));
+            }
+        }
+
+        malformedManifest.put(new JSONObject()
+                .put("id", nextCertId)
+                .put("expect", expect)
+                .put("rule", rule)
+                .put("description", description)
+        );
+
+        nextCertId += 1;
+    }
+}
@@ -0,0 +1,174 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.asn1.x500.X500Name;
+import org.bouncycastle.asn1.x509.GeneralName;
+import org.bouncycastle.asn1.x509.GeneralNames;
+import org.bouncycastle.asn1.x509.GeneralSubtree;
+import org.bouncycastle.asn1.x509.NameConstraints;
+import org.bouncycastle.openssl.jcajce.JcaPEMWriter;
+import org.json.JSONArray;
+import org.json.JSONObject;
+
+import java.io.OutputStream;
+import java.io.OutputStreamWriter;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyPair;
+import java.security.KeyStore;
+import java.security.cert.Certificate;
+import java.util.Calendar;
+import java.util.Date;
+
+/**
+ * Generates path building test cases, where the intermediates supplied with a leaf offer more than one way to
+ * complete its chain. Every candidate intermediate has the same subject and key, so each of them appears to have
+ * issued the leaf, but only some of them chain to the trusted root and are valid. A correct verifier should find the
+ * valid path when there is one. These are only generated when running this class directly, e.g. with
+ * {@code gradle runPathBuildingGenerator}.
+ */
+public class PathBuildingCertificateGenerator {
+
+    public static void main(String[] args) throws Exception {
+
+        final JSONObject config = new JSONObject(new String(Files.readAllBytes(Paths.get("../config.json")), StandardCharsets.UTF_8));
+        final Path outputDir = Paths.get("../certificates/pathbuilding");
+        Files.createDirectories(outputDir);
+
+        new PathBuildingCertificateGenerator(config, outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
+    }
+
+    private final Path outputDir;
+    private final GeneratorOptions options;
+    private final String hostname;
+    private final String hostSubtree;
+
+    private final JSONArray pathManifest = new JSONArray();
+    private int nextCertId = 1;
+
+    private PathBuildingCertificateGenerator(JSONObject config, Path outputDir, GeneratorOptions options) {
+        this.outputDir = outputDir;
+        this.options = options;
+        this.hostname = config.getString("hostname");
+        this.hostSubtree = config.getString("hostSubtree");
+    }
+
+    private void generateCertificates() throws Exception {
+
+        KeyStore rootCa = new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("Path Building Test Root CA")
+                .setIsCa(true)
+                .build();
+        CertificateGenerator.writeCertificate(rootCa.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve("root.crt"));
+
+        // Not written to root.crt, so nothing issued by it can be trusted.
+        KeyStore untrustedRootCa = new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("Path Building Test Untrusted Root CA")
+                .setIsCa(true)
+                .build();
+
+        // Every candidate intermediate shares this subject and key pair.
+        X500Name intermediateName = new X500Name("O=Netflix Inc, OU=Platform Security (" + options.nextUniqueId()
+                + "), CN=Path Building Test Intermediate CA");
+        KeyPair intermediateKeyPair = options.nextKeyPair();
+
+        KeyStore clean = makeIntermediate(rootCa, intermediateName, intermediateKeyPair).build();
+
+        KeyStore crossSigned = makeIntermediate(untrustedRootCa, intermediateName, intermediateKeyPair).build();
+
+        Calendar cal = Calendar.getInstance();
+        cal.setTime(options.getNotBefore());
+        cal.add(Calendar.DATE, -1);
+        Date expiredNotAfter = cal.getTime();
+        cal.add(Calendar.MONTH, -12);
+        Date expiredNotBefore = cal.getTime();
+        KeyStore expired = makeIntermediate(rootCa, intermediateName, intermediateKeyPair)
+                .setValidity(expiredNotBefore, expiredNotAfter)
+                .build();
+
+        KeyStore constrained = makeIntermediate(rootCa, intermediateName, intermediateKeyPair)
+                .setNameConstraints(new NameConstraints(null, new GeneralSubtree[] {
+                        new GeneralSubtree(new GeneralName(GeneralName.dNSName, hostSubtree))
+                }))
+                .build();
+
+        // The leaf is always issued by the clean intermediate, but since they share a name and key, its signature
+        // verifies with any of them.
+        KeyStore leaf = new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(clean))
+                .setCommonName(hostname)
+                .setIsCa(false)
+                .setSubjectAlternateNames(new GeneralNames(new GeneralName(GeneralName.dNSName, hostname)))
+                .build();
+
+        writeCase("The intermediate is supplied both cross-signed by an untrusted root and issued by the trusted root.", true,
+                leaf, crossSigned, untrustedRootCa, clean);
+        writeCase("The intermediate is only supplied cross-signed by an untrusted root.", false,
+                leaf, crossSigned, untrustedRootCa);
+        writeCase("An expired intermediate is supplied ahead of a valid one.", true,
+                leaf, expired, clean);
+        writeCase("Only an expired intermediate is supplied.", false,
+                leaf, expired);
+        writeCase("An intermediate whose name constraints exclude the leaf's name is supplied ahead of an unconstrained one.", true,
+                leaf, constrained, clean);
+        writeCase("Only an intermediate whose name constraints exclude the leaf's name is supplied.", false,
+                leaf, constrained);
+
+        final JSONObject manifest = new JSONObject();
+        manifest.put("pathManifest", pathManifest);
+        Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    private KeyStoreGenerator makeIntermediate(KeyStore issuer, X500Name subjectName, KeyPair keyPair) throws Exception {
+        return new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(issuer))
+                .setSubjectName(subjectName)
+                .setKeyPair(keyPair)
+                .setIsCa(true);
+    }
+
+    /**
+     * Writes the leaf to {@code <id>.crt} and the candidate intermediates, in the given order, to {@code <id>.chain}.
+     */
+    private void writeCase(String description, boolean hasValidPath, KeyStore leaf, KeyStore... candidates) throws Exception {
+        System.out.println("Generating path building test " + nextCertId + "...");
+        CertificateGenerator.writeCertificate(leaf.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve(nextCertId + ".crt"));
+
+        try (OutputStream stream = Files.newOutputStream(outputDir.resolve(nextCertId + ".chain"));
+             OutputStreamWriter writer = new OutputStreamWriter(stream);
+             JcaPEMWriter pemWriter = new JcaPEMWriter(writer)) {
+            for (KeyStore candidate : candidates) {
+                Certificate certificate = candidate.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS);
+                pemWriter.writeObject(certificate);
+            }
+        }
+
+        pathManifest.put(new JSONObject()
+                .put("id", nextCertId)
+                .put("validPath", hasValidPath)
+                .put("description", description)
+        );
+
+        nextCertId += 1;
+    }
+}
@@ -0,0 +1,228 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.asn1.ASN1Integer;
+import org.bouncycastle.asn1.ASN1ObjectIdentifier;
+import org.bouncycastle.asn1.x509.CertPolicyId;
+import org.bouncycastle.asn1.x509.CertificatePolicies;
+import org.bouncycastle.asn1.x509.Extension;
+import org.bouncycastle.asn1.x509.GeneralName;
+import org.bouncycastle.asn1.x509.GeneralNames;
+import org.bouncycastle.asn1.x509.PolicyConstraints;
+import org.bouncycastle.asn1.x509.PolicyInformation;
+import org.bouncycastle.asn1.x509.PolicyMappings;
+import org.json.JSONArray;
+import org.json.JSONObject;
+
+import java.math.BigInteger;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyStore;
+
+/**
+ * Generates chains of two intermediates and a leaf that exercise RFC 5280 policy processing: certificatePolicies,
+ * policyConstraints (requireExplicitPolicy and inhibitPolicyMapping), policyMappings and inhibitAnyPolicy. Every test
+ * is verified with an initial policy set of anyPolicy and without requiring an explicit policy, so only the
+ * certificates decide whether a policy is required. Verifiers that don't process policies accept every chain. These
+ * are only generated when running this class directly, e.g. with {@code gradle runPolicyGenerator}.
+ */
+public class PolicyCertificateGenerator {
+
+    private static final String ANY_POLICY = "2.5.29.32.0";
+    // Policy OIDs under the example arc, {joint-iso-itu-t(2) example(999)}.
+    private static final String P1 = "2.999.1";
+    private static final String P2 = "2.999.2";
+
+    public static void main(String[] args) throws Exception {
+
+        final JSONObject config = new JSONObject(new String(Files.readAllBytes(Paths.get("../config.json")), StandardCharsets.UTF_8));
+        final Path outputDir = Paths.get("../certificates/policy");
+        Files.createDirectories(outputDir);
+
+        new PolicyCertificateGenerator(config, outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
+    }
+
+    private final Path outputDir;
+    private final GeneratorOptions options;
+    private final String hostname;
+
+    private final JSONArray policyManifest = new JSONArray();
+    private int nextCertId = 1;
+
+    private PolicyCertificateGenerator(JSONObject config, Path outputDir, GeneratorOptions options) {
+        this.outputDir = outputDir;
+        this.options = options;
+        this.hostname = config.getString("hostname");
+    }
+
+    private void generateCertificates() throws Exception {
+
+        KeyStore rootCa = new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("Policy Test Root CA")
+                .setIsCa(true)
+                .build();
+        CertificateGenerator.writeCertificate(rootCa.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve("root.crt"));
+
+        writeCase(rootCa, "explicitPolicyMatches", "OK",
+                "The first intermediate requires an explicit policy, and every certificate asserts it.",
+                new Ca().policies(P1).requireExplicitPolicy(0), new Ca().policies(P1), P1);
+        writeCase(rootCa, "explicitPolicyMissingFromLeaf", "ERROR",
+                "The first intermediate requires an explicit policy, but the leaf has no certificatePolicies extension.",
+                new Ca().policies(P1).requireExplicitPolicy(0), new Ca().policies(P1));
+        writeCase(rootCa, "policyMissingFromLeafNotRequired", "OK",
+                "The leaf has no certificatePolicies extension, but no certificate requires an explicit policy.",
+                new Ca().policies(P1), new Ca().policies(P1));
+        writeCase(rootCa, "explicitPolicyDisjoint", "ERROR",
+                "The first intermediate requires an explicit policy, and the leaf asserts a different policy from the intermediates.",
+                new Ca().policies(P1).requireExplicitPolicy(0), new Ca().policies(P1), P2);
+        writeCase(rootCa, "disjointPolicyNotRequired", "OK",
+                "The leaf asserts a different policy from the intermediates, but no certificate requires an explicit policy.",
+                new Ca().policies(P1), new Ca().policies(P1), P2);
+        writeCase(rootCa, "explicitPolicySkipsTwo", "ERROR",
+                "The first intermediate sets requireExplicitPolicy to 2, which, counting the second intermediate and the leaf, requires an explicit policy by the end of the chain, and the leaf has no policy.",
+                new Ca().policies(P1).requireExplicitPolicy(2), new Ca().policies(P1));
+        writeCase(rootCa, "explicitPolicySkipsThree", "OK",
+                "The first intermediate sets requireExplicitPolicy to 3, which doesn't require an explicit policy within the chain, and the leaf has no policy.",
+                new Ca().policies(P1).requireExplicitPolicy(3), new Ca().policies(P1));
+        writeCase(rootCa, "anyPolicyIntermediates", "OK",
+                "The first intermediate requires an explicit policy, and both intermediates assert anyPolicy, which the leaf's policy matches.",
+                new Ca().policies(ANY_POLICY).requireExplicitPolicy(0), new Ca().policies(ANY_POLICY), P1);
+        writeCase(rootCa, "policyMapped", "OK",
+                "The first intermediate requires an explicit policy, and the second maps the intermediates' policy to the leaf's.",
+                new Ca().policies(P1).requireExplicitPolicy(0), new Ca().policies(P1).mapping(P1, P2), P2);
+        writeCase(rootCa, "policyMappingInhibited", "ERROR",
+                "The first intermediate requires an explicit policy and inhibits policy mapping, so the second intermediate's mapping to the leaf's policy doesn't apply.",
+                new Ca().policies(P1).requireExplicitPolicy(0).inhibitPolicyMapping(0), new Ca().policies(P1).mapping(P1, P2), P2);
+        writeCase(rootCa, "policyMappingInhibitedLater", "OK",
+                "The first intermediate sets inhibitPolicyMapping to 1, which still allows the second intermediate's mapping to the leaf's policy.",
+                new Ca().policies(P1).requireExplicitPolicy(0).inhibitPolicyMapping(1), new Ca().policies(P1).mapping(P1, P2), P2);
+        writeCase(rootCa, "mappingToAnyPolicy", "ERROR",
+                "The second intermediate maps a policy to anyPolicy, which RFC 5280 forbids.",
+                new Ca().policies(P1).requireExplicitPolicy(0), new Ca().policies(P1).mapping(P1, ANY_POLICY), P1);
+        writeCase(rootCa, "anyPolicyInhibited", "ERROR",
+                "The first intermediate requires an explicit policy and inhibits anyPolicy, so the second intermediate's anyPolicy doesn't match the leaf's policy.",
+                new Ca().policies(P1).requireExplicitPolicy(0).inhibitAnyPolicy(0), new Ca().policies(ANY_POLICY), P1);
+
+        final JSONObject manifest = new JSONObject();
+        manifest.put("policyManifest", policyManifest);
+        Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    private void writeCase(KeyStore rootCa, String name, String expect, String description, Ca first, Ca second, String... leafPolicies) throws Exception {
+        System.out.println("Generating policy certificate " + nextCertId + "...");
+
+        KeyStore firstIntermediate = first.generator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(rootCa))
+                .setCommonName("Policy Test Intermediate CA")
+                .build();
+        KeyStore secondIntermediate = second.generator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(firstIntermediate))
+                .setCommonName("Policy Test Second Intermediate CA")
+                .build();
+
+        KeyStoreGenerator leafGenerator = new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(secondIntermediate))
+                .setIsCa(false)
+                .setCommonName(hostname)
+                .setSubjectAlternateNames(new GeneralNames(new GeneralName(GeneralName.dNSName, hostname)));
+        if (leafPolicies.length > 0) {
+            leafGenerator.addExtension(Extension.certificatePolicies, false, certificatePolicies(leafPolicies));
+        }
+
+        CertificateGenerator.writeCertificateSet(leafGenerator.build(), outputDir, Integer.toString(nextCertId));
+
+        policyManifest.put(new JSONObject()
+                .put("id", nextCertId)
+                .put("name", name)
+                .put("expect", expect)
+                .put("description", description)
+        );
+
+        nextCertId += 1;
+    }
+
+    private static CertificatePolicies certificatePolicies(String[] policies) {
+        PolicyInformation[] information = new PolicyInformation[policies.length];
+        for (int i = 0; i < policies.length; i++) {
+            information[i] = new PolicyInformation(new ASN1ObjectIdentifier(policies[i]));
+        }
+        return new CertificatePolicies(information);
+    }
+
+    /**
+     * The policy extensions of an intermediate CA.
+     */
+    private static class Ca {
+        private String[] policies = new String[0];
+        private Integer requireExplicitPolicy;
+        private Integer inhibitPolicyMapping;
+        private Integer inhibitAnyPolicy;
+        private String[] mapping;
+
+        Ca policies(String... policies) {
+            this.policies = policies;
+            return this;
+        }
+
+        Ca requireExplicitPolicy(int skipCerts) {
+            this.requireExplicitPolicy = skipCerts;
+            return this;
+        }
+
+        Ca inhibitPolicyMapping(int skipCerts) {
+            this.inhibitPolicyMapping = skipCerts;
+            return this;
+        }
+
+        Ca inhibitAnyPolicy(int skipCerts) {
+            this.inhibitAnyPolicy = skipCerts;
+            return this;
+        }
+
+        Ca mapping(String issuerDomainPolicy, String subjectDomainPolicy) {
+            this.mapping = new String[]{issuerDomainPolicy, subjectDomainPolicy};
+            return this;
+        }
+
+        KeyStoreGenerator generator(GeneratorOptions options) {
+            KeyStoreGenerator generator = new KeyStoreGenerator(options).setIsCa(true);
+            if (policies.length > 0) {
+                generator.addExtension(Extension.certificatePolicies, false, certificatePolicies(policies));
+            }
+            if (requireExplicitPolicy != null || inhibitPolicyMapping != null) {
+                generator.addExtension(Extension.policyConstraints, true, new PolicyConstraints(
+                        requireExplicitPolicy == null ? null : BigInteger.valueOf(requireExplicitPolicy),
+                        inhibitPolicyMapping == null ? null : BigInteger.valueOf(inhibitPolicyMapping)));
+            }
+            if (mapping != null) {
+                generator.addExtension(Extension.policyMappings, true, new PolicyMappings(
+                        CertPolicyId.getInstance(new ASN1ObjectIdentifier(mapping[0])),
+                        CertPolicyId.getInstance(new ASN1ObjectIdentifier(mapping[1]))));
+            }
+            if (inhibitAnyPolicy != null) {
+                generator.addExtension(Extension.inhibitAnyPolicy, true, new ASN1Integer(inhibitAnyPolicy));
+            }
+            return generator;
+        }
+    }
+}
@@ -0,0 +1,160 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.asn1.ASN1EncodableVector;
+import org.bouncycastle.asn1.ASN1Integer;
+import org.bouncycastle.asn1.ASN1ObjectIdentifier;
+import org.bouncycastle.asn1.DERSequence;
+import org.bouncycastle.asn1.x500.X500Name;
+import org.bouncycastle.asn1.x509.GeneralName;
+import org.bouncycastle.asn1.x509.GeneralNames;
+import org.bouncycastle.cert.X509CertificateHolder;
+import org.json.JSONArray;
+import org.json.JSONObject;
+
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyStore;
+
+/**
+ * Generates RFC 3820 proxy certificates. These aren't part of the name constraints test suite and are only generated
+ * when running this class directly, e.g. with {@code gradle runProxyGenerator}.
+ *
+ * Mainstream verifiers should reject every one of these chains because the leaf is issued by an end-entity
+ * certificate and carries a critical extension they don't understand. Proxy-aware verifiers should accept only the
+ * well-formed ones.
+ */
+public class ProxyCertificateGenerator {
+
+    // id-pe-proxyCertInfo, from RFC 3820 section 3.8.
+    private static final ASN1ObjectIdentifier PROXY_CERT_INFO = new ASN1ObjectIdentifier("1.3.6.1.5.5.7.1.14");
+    // id-ppl-inheritAll, from RFC 3820 section 3.8.
+    private static final ASN1ObjectIdentifier INHERIT_ALL = new ASN1ObjectIdentifier("1.3.6.1.5.5.7.21.1");
+
+    public static void main(String[] args) throws Exception {
+
+        final Path outputDir = Paths.get("../certificates/proxy");
+        Files.createDirectories(outputDir);
+
+        new ProxyCertificateGenerator(outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
+    }
+
+    private final Path outputDir;
+    private final GeneratorOptions options;
+
+    private final JSONArray proxyManifest = new JSONArray();
+    private int nextCertId = 1;
+
+    private ProxyCertificateGenerator(Path outputDir, GeneratorOptions options) {
+        this.outputDir = outputDir;
+        this.options = options;
+    }
+
+    private void generateCertificates() throws Exception {
+
+        KeyStore rootCa = new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("Proxy Certificate Test Root CA")
+                .setIsCa(true)
+                .build();
+        CertificateGenerator.writeCertificate(rootCa.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve("root.crt"));
+
+        KeyStore intermediate = new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(rootCa))
+                .setCommonName("Proxy Certificate Test Intermediate CA")
+                .setIsCa(true)
+                .build();
+        KeyStore endEntity = new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(intermediate))
+                .setCommonName("Proxy Certificate Test End Entity")
+                .setIsCa(false)
+                .build();
+
+        writeProxy("A well-formed proxy certificate issued by an end-entity certificate.", true,
+                makeProxy(endEntity, null, true, null, false, null));
+
+        KeyStore unlimitedProxy = makeProxy(endEntity, null, true, null, false, null);
+        writeProxy("A well-formed proxy certificate issued by another proxy certificate.", true,
+                makeProxy(unlimitedProxy, null, true, null, false, null));
+
+        KeyStore terminalProxy = makeProxy(endEntity, 0, true, null, false, null);
+        writeProxy("The issuing proxy certificate has a path length constraint of zero.", false,
+                makeProxy(terminalProxy, null, true, null, false, null));
+
+        writeProxy("The proxy certificate's subject isn't the issuer's subject with a single CN appended.", false,
+                makeProxy(endEntity, null, true, new X500Name("CN=Unrelated Proxy Subject"), false, null));
+
+        writeProxy("The ProxyCertInfo extension isn't marked critical.", false,
+                makeProxy(endEntity, null, false, null, false, null));
+
+        writeProxy("The proxy certificate asserts that it is a CA.", false,
+                makeProxy(endEntity, null, true, null, true, null));
+
+        writeProxy("The proxy certificate has a subject alternative name extension.", false,
+                makeProxy(endEntity, null, true, null, false,
+                        new GeneralNames(new GeneralName(GeneralName.dNSName, "proxy.example.com"))));
+
+        final JSONObject manifest = new JSONObject();
+        manifest.put("proxyManifest", proxyManifest);
+        Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    private KeyStore makeProxy(KeyStore issuer, Integer pathLenConstraint, boolean isCritical, X500Name subjectName,
+                                      boolean isCa, GeneralNames sans) throws Exception {
+        KeyStore.PrivateKeyEntry issuerKeyEntry = CertificateGenerator.getSignerPrivateKey(issuer);
+
+        if (subjectName == null) {
+            // RFC 3820 section 3.4: the subject is the issuer's subject with a single CN appended.
+            X500Name issuerName = new X509CertificateHolder(issuerKeyEntry.getCertificate().getEncoded()).getSubject();
+            subjectName = new X500Name(issuerName.toString() + ",CN=" + options.nextUniqueId());
+        }
+
+        ASN1EncodableVector proxyPolicy = new ASN1EncodableVector();
+        proxyPolicy.add(INHERIT_ALL);
+        ASN1EncodableVector proxyCertInfo = new ASN1EncodableVector();
+        if (pathLenConstraint != null) {
+            proxyCertInfo.add(new ASN1Integer(pathLenConstraint));
+        }
+        proxyCertInfo.add(new DERSequence(proxyPolicy));
+
+        return new KeyStoreGenerator(options)
+                .setCaKeyEntry(issuerKeyEntry)
+                .setSubjectName(subjectName)
+                .setIsCa(isCa)
+                .setSubjectAlternateNames(sans)
+                .addExtension(PROXY_CERT_INFO, isCritical, new DERSequence(proxyCertInfo))
+                .build();
+    }
+
+    private void writeProxy(String description, boolean isValidProxy, KeyStore proxy) throws Exception {
+        System.out.println("Generating proxy certificate " + nextCertId + "...");
+        CertificateGenerator.writeCertificateSet(proxy, outputDir, Integer.toString(nextCertId));
+
+        proxyManifest.put(new JSONObject()
+                .put("id", nextCertId)
+                .put("validProxy", isValidProxy)
+                .put("description", description)
+        );
+
+        nextCertId += 1;
+    }
+}
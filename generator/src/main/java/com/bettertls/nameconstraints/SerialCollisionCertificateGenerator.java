@@ -0,0 +1,212 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.asn1.x500.X500Name;
+import org.bouncycastle.asn1.x509.GeneralName;
+import org.bouncycastle.asn1.x509.GeneralNames;
+import org.bouncycastle.openssl.jcajce.JcaPEMWriter;
+import org.json.JSONArray;
+import org.json.JSONObject;
+
+import java.io.OutputStream;
+import java.io.OutputStreamWriter;
+import java.math.BigInteger;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyPair;
+import java.security.KeyStore;
+import java.util.Calendar;
+import java.util.Date;
+
+/**
+ * Generates chains in which two distinct certificates share an issuer and serial number, which RFC 5280 forbids but
+ * which verifiers that index certificates by issuer and serial number, as NSS's certificate database does, must cope
+ * with when a server presents both. The leaf's issuer is presented alongside a twin with the same issuer and serial
+ * but a different key, a different name, or the same key but an expired validity, in either order, and the leaf
+ * itself alongside a sibling with its issuer and serial. Each test lists the presented certificates through which a
+ * valid path can be built, and verifiers that build one must select one of them. Each test's {@code .chain} file
+ * holds the certificates after the leaf exactly as presented, and test harnesses verify them in that order. These
+ * are only generated when running this class directly, e.g. with {@code gradle runSerialCollisionGenerator}.
+ */
+public class SerialCollisionCertificateGenerator {
+
+    public static void main(String[] args) throws Exception {
+
+        final JSONObject config = new JSONObject(new String(Files.readAllBytes(Paths.get("../config.json")), StandardCharsets.UTF_8));
+        final Path outputDir = Paths.get("../certificates/serialcollision");
+        Files.createDirectories(outputDir);
+
+        new SerialCollisionCertificateGenerator(config, outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
+    }
+
+    private final Path outputDir;
+    private final GeneratorOptions options;
+    private final String hostname;
+
+    private final JSONArray serialCollisionManifest = new JSONArray();
+    private int nextCertId = 1;
+
+    private SerialCollisionCertificateGenerator(JSONObject config, Path outputDir, GeneratorOptions options) {
+        this.outputDir = outputDir;
+        this.options = options;
+        this.hostname = config.getString("hostname");
+    }
+
+    private void generateCertificates() throws Exception {
+
+        KeyStore rootCa = new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("Serial Collision Test Root CA")
+                .setIsCa(true)
+                .build();
+        CertificateGenerator.writeCertificate(rootCa.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve("root.crt"));
+
+        // Every intermediate is issued by the root with this serial number.
+        BigInteger intermediateSerial = options.nextSerial();
+        X500Name intermediateName = new X500Name("O=Netflix Inc, OU=Platform Security (" + options.nextUniqueId()
+                + "), CN=Serial Collision Test Intermediate CA");
+        KeyPair intermediateKeyPair = options.nextKeyPair();
+
+        Presented issuer = new Presented("issuer", makeIntermediate(rootCa, intermediateSerial, intermediateName, intermediateKeyPair).build());
+        Presented twin = new Presented("twin", makeIntermediate(rootCa, intermediateSerial, intermediateName, options.nextKeyPair()).build());
+        Presented renamedTwin = new Presented("renamedTwin", makeIntermediate(rootCa, intermediateSerial,
+                new X500Name("O=Netflix Inc, OU=Platform Security (" + options.nextUniqueId() + "), CN=Serial Collision Test Other Intermediate CA"),
+                options.nextKeyPair()).build());
+
+        Calendar cal = Calendar.getInstance();
+        cal.setTime(options.getNotBefore());
+        cal.add(Calendar.DATE, -1);
+        Date expiredNotAfter = cal.getTime();
+        cal.add(Calendar.MONTH, -12);
+        Date expiredNotBefore = cal.getTime();
+        Presented expiredTwin = new Presented("expiredTwin", makeIntermediate(rootCa, intermediateSerial, intermediateName, intermediateKeyPair)
+                .setValidity(expiredNotBefore, expiredNotAfter)
+                .build());
+
+        // The leaf and its sibling are both issued by the issuer with this serial number.
+        BigInteger leafSerial = options.nextSerial();
+        Presented leaf = new Presented("leaf", makeLeaf(issuer.keyStore, leafSerial, hostname));
+        Presented siblingLeaf = new Presented("siblingLeaf", makeLeaf(issuer.keyStore, leafSerial, "sibling." + hostname));
+
+        writeCase("noCollision", "OK",
+                "Only the leaf's issuer is presented.",
+                leaf, issuer);
+        writeCase("twinFirst", "WEAK-OK",
+                "A twin of the leaf's issuer, with the same name, issuer and serial number but a different key, is presented before it. A verifier that keeps only the first certificate with each issuer and serial number can't build the path, and RFC 5280 forbids reusing serial numbers, so either result is acceptable.",
+                leaf, twin, issuer);
+        writeCase("twinLast", "WEAK-OK",
+                "A twin of the leaf's issuer, with the same name, issuer and serial number but a different key, is presented after it.",
+                leaf, issuer, twin);
+        writeCase("renamedTwinFirst", "WEAK-OK",
+                "A certificate with a different name and key but the same issuer and serial number as the leaf's issuer is presented before it.",
+                leaf, renamedTwin, issuer);
+        writeCase("expiredTwinFirst", "WEAK-OK",
+                "An expired reissue of the leaf's issuer, with the same name, key, issuer and serial number, is presented before it. The path must go through the unexpired one.",
+                leaf, expiredTwin, issuer);
+        writeCase("siblingLeafFirst", "WEAK-OK",
+                "Another leaf with the same issuer and serial number as the leaf, but a different name and key, is presented before the leaf's issuer. A verifier that indexes by issuer and serial number may confuse it with the leaf.",
+                leaf, siblingLeaf, issuer);
+        writeCase("onlyTwin", "ERROR",
+                "Only the twin of the leaf's issuer is presented, whose key didn't sign the leaf, so there's no path to the root.",
+                leaf, twin);
+        writeCase("onlyExpiredTwin", "ERROR",
+                "Only the expired reissue of the leaf's issuer is presented, so the only path to the root is through an expired certificate.",
+                leaf, expiredTwin);
+
+        final JSONObject manifest = new JSONObject();
+        manifest.put("serialCollisionManifest", serialCollisionManifest);
+        Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    private KeyStoreGenerator makeIntermediate(KeyStore issuer, BigInteger serial, X500Name subjectName, KeyPair keyPair) throws Exception {
+        return new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(issuer))
+                .setSerial(serial)
+                .setSubjectName(subjectName)
+                .setKeyPair(keyPair)
+                .setIsCa(true);
+    }
+
+    private KeyStore makeLeaf(KeyStore issuer, BigInteger serial, String name) throws Exception {
+        return new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(issuer))
+                .setSerial(serial)
+                .setIsCa(false)
+                .setCommonName(name)
+                .setSubjectAlternateNames(new GeneralNames(new GeneralName(GeneralName.dNSName, name)))
+                .build();
+    }
+
+    /**
+     * Writes the leaf's key to {@code <id>.key}, the leaf to {@code <id>.crt} and the rest of the presented
+     * certificates, in the given order, to {@code <id>.chain}. The manifest lists, as {@code selectable}, those of
+     * them through which a valid path can be built: the leaf's issuer, if it's presented.
+     */
+    private void writeCase(String name, String expect, String description, Presented leaf, Presented... presented) throws Exception {
+        System.out.println("Generating serial collision test " + nextCertId + "...");
+
+        try (OutputStream stream = Files.newOutputStream(outputDir.resolve(nextCertId + ".key"));
+             OutputStreamWriter writer = new OutputStreamWriter(stream);
+             JcaPEMWriter pemWriter = new JcaPEMWriter(writer)) {
+            pemWriter.writeObject(CertificateGenerator.getSignerPrivateKey(leaf.keyStore).getPrivateKey());
+        }
+        CertificateGenerator.writeCertificate(leaf.keyStore.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve(nextCertId + ".crt"));
+
+        JSONArray labels = new JSONArray();
+        JSONArray selectable = new JSONArray();
+        try (OutputStream stream = Files.newOutputStream(outputDir.resolve(nextCertId + ".chain"));
+             OutputStreamWriter writer = new OutputStreamWriter(stream);
+             JcaPEMWriter pemWriter = new JcaPEMWriter(writer)) {
+            for (Presented certificate : presented) {
+                pemWriter.writeObject(certificate.keyStore.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS));
+                labels.put(certificate.label);
+                if (certificate.label.equals("issuer")) {
+                    selectable.put(certificate.label);
+                }
+            }
+        }
+
+        serialCollisionManifest.put(new JSONObject()
+                .put("id", nextCertId)
+                .put("name", name)
+                .put("presented", labels)
+                .put("selectable", selectable)
+                .put("expect", expect)
+                .put("description", description)
+        );
+
+        nextCertId += 1;
+    }
+
+    /**
+     * A certificate that can be presented, with the label that the manifest gives it.
+     */
+    private static class Presented {
+        private final String label;
+        private final KeyStore keyStore;
+
+        Presented(String label, KeyStore keyStore) {
+            this.label = label;
+            this.keyStore = keyStore;
+        }
+    }
+}
@@ -0,0 +1,224 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.asn1.x500.X500Name;
+import org.bouncycastle.asn1.x509.ExtendedKeyUsage;
+import org.bouncycastle.asn1.x509.Extension;
+import org.bouncycastle.asn1.x509.GeneralName;
+import org.bouncycastle.asn1.x509.GeneralNames;
+import org.bouncycastle.asn1.x509.GeneralSubtree;
+import org.bouncycastle.asn1.x509.KeyPurposeId;
+import org.bouncycastle.asn1.x509.NameConstraints;
+import org.json.JSONArray;
+import org.json.JSONObject;
+
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyStore;
+
+/**
+ * Generates S/MIME certificates, with rfc822Name SANs and the emailProtection extended key usage, which are verified
+ * against an email address rather than a hostname, along with rfc822Name name constraints on their intermediates.
+ * These are only generated when running this class directly, e.g. with {@code gradle runSmimeGenerator}.
+ */
+public class SmimeCertificateGenerator {
+
+    private static final String LOCAL_PART = "user";
+
+    public static void main(String[] args) throws Exception {
+
+        final JSONObject config = new JSONObject(new String(Files.readAllBytes(Paths.get("../config.json")), StandardCharsets.UTF_8));
+        final Path outputDir = Paths.get("../certificates/smime");
+        Files.createDirectories(outputDir);
+
+        new SmimeCertificateGenerator(config, outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
+    }
+
+    private final Path outputDir;
+    private final GeneratorOptions options;
+    private final String hostname;
+    private final String hostSubtree;
+    private final String invalidHostname;
+    private final String invalidHostSubtree;
+
+    private final JSONArray smimeManifest = new JSONArray();
+    private int nextCertId = 1;
+
+    private SmimeCertificateGenerator(JSONObject config, Path outputDir, GeneratorOptions options) {
+        this.outputDir = outputDir;
+        this.options = options;
+        this.hostname = config.getString("hostname");
+        this.hostSubtree = config.getString("hostSubtree");
+        this.invalidHostname = config.getString("invalidHostname");
+        this.invalidHostSubtree = config.getString("invalidHostSubtree");
+    }
+
+    private void generateCertificates() throws Exception {
+
+        KeyStore rootCa = new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("S/MIME Test Root CA")
+                .setIsCa(true)
+                .build();
+        CertificateGenerator.writeCertificate(rootCa.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve("root.crt"));
+
+        String email = LOCAL_PART + "@" + hostname;
+
+        // Matching the email address.
+        writeCase(rootCa, "emailSan", email, "OK",
+                "The email address is in an rfc822Name SAN.",
+                new Leaf().sanEmails(email), null);
+        writeCase(rootCa, "domainCase", LOCAL_PART + "@" + hostname.toUpperCase(), "OK",
+                "The domain of the email address is in upper case. Domains are compared case-insensitively.",
+                new Leaf().sanEmails(email), null);
+        writeCase(rootCa, "localPartCase", LOCAL_PART.toUpperCase() + "@" + hostname, "WEAK-OK",
+                "The local part of the email address is in upper case. RFC 5280 compares local parts case-sensitively, but most mail systems don't.",
+                new Leaf().sanEmails(email), null);
+        writeCase(rootCa, "differentAddress", "other@" + hostname, "ERROR",
+                "The certificate is for a different email address in the same domain.",
+                new Leaf().sanEmails(email), null);
+        writeCase(rootCa, "subjectEmailOnly", email, "WEAK-OK",
+                "The email address is only in the emailAddress attribute of the subject, which RFC 5280 allows for legacy implementations but which newer ones ignore.",
+                new Leaf().subjectEmail(email), null);
+
+        // Extended key usage.
+        writeCase(rootCa, "serverAuthOnly", email, "ERROR",
+                "The certificate's extended key usage is serverAuth, without emailProtection.",
+                new Leaf().sanEmails(email).keyPurposes(KeyPurposeId.id_kp_serverAuth), null);
+        writeCase(rootCa, "noExtendedKeyUsage", email, "OK",
+                "The certificate has no extended key usage extension, so it isn't restricted to any purpose.",
+                new Leaf().sanEmails(email).keyPurposes(), null);
+        writeCase(rootCa, "anyExtendedKeyUsage", email, "WEAK-OK",
+                "The certificate's extended key usage is anyExtendedKeyUsage, which some verifiers don't accept in place of emailProtection.",
+                new Leaf().sanEmails(email).keyPurposes(KeyPurposeId.anyExtendedKeyUsage), null);
+
+        // rfc822Name name constraints.
+        writeCase(rootCa, "permittedHost", email, "OK",
+                "The intermediate permits email addresses at the domain of the email address.",
+                new Leaf().sanEmails(email), permitted(new GeneralName(GeneralName.rfc822Name, hostname)));
+        writeCase(rootCa, "permittedSubdomains", email, "OK",
+                "The intermediate permits email addresses at subdomains of a domain, which include the domain of the email address.",
+                new Leaf().sanEmails(email), permitted(new GeneralName(GeneralName.rfc822Name, "." + hostSubtree)));
+        writeCase(rootCa, "permittedParentHostOnly", email, "WEAK-OK",
+                "The intermediate permits email addresses at a parent of the domain of the email address. In RFC 5280, an rfc822Name constraint without a leading dot is a single host, but some verifiers match subdomains as they do for DNS constraints.",
+                new Leaf().sanEmails(email), permitted(new GeneralName(GeneralName.rfc822Name, hostSubtree)));
+        writeCase(rootCa, "permittedMailbox", email, "OK",
+                "The intermediate permits only the email address itself.",
+                new Leaf().sanEmails(email), permitted(new GeneralName(GeneralName.rfc822Name, email)));
+        writeCase(rootCa, "permittedOtherMailbox", email, "ERROR",
+                "The intermediate permits only a different email address in the same domain.",
+                new Leaf().sanEmails(email), permitted(new GeneralName(GeneralName.rfc822Name, "other@" + hostname)));
+        writeCase(rootCa, "excludedHost", email, "ERROR",
+                "The intermediate excludes email addresses at the domain of the email address.",
+                new Leaf().sanEmails(email), excluded(new GeneralName(GeneralName.rfc822Name, hostname)));
+        writeCase(rootCa, "dnsConstraintOnly", email, "OK",
+                "The intermediate only constrains DNS names, which don't apply to email addresses.",
+                new Leaf().sanEmails(email), permitted(new GeneralName(GeneralName.dNSName, invalidHostSubtree)));
+        writeCase(rootCa, "secondEmailNotPermitted", email, "ERROR",
+                "The intermediate permits email addresses at the domain of the email address, but the certificate has a second email address at another domain. Name constraints apply to every name in the certificate.",
+                new Leaf().sanEmails(email, LOCAL_PART + "@" + invalidHostname), permitted(new GeneralName(GeneralName.rfc822Name, hostname)));
+
+        final JSONObject manifest = new JSONObject();
+        manifest.put("smimeManifest", smimeManifest);
+        Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    private void writeCase(KeyStore rootCa, String name, String email, String expect, String description, Leaf leaf, NameConstraints nameConstraints) throws Exception {
+        System.out.println("Generating S/MIME certificate " + nextCertId + "...");
+
+        KeyStore intermediate = new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(rootCa))
+                .setCommonName("S/MIME Test Intermediate CA")
+                .setIsCa(true)
+                .setNameConstraints(nameConstraints)
+                .build();
+
+        CertificateGenerator.writeCertificateSet(leaf.generator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(intermediate))
+                .build(), outputDir, Integer.toString(nextCertId));
+
+        smimeManifest.put(new JSONObject()
+                .put("id", nextCertId)
+                .put("name", name)
+                .put("email", email)
+                .put("expect", expect)
+                .put("description", description)
+        );
+
+        nextCertId += 1;
+    }
+
+    private static NameConstraints permitted(GeneralName subtree) {
+        return new NameConstraints(new GeneralSubtree[]{new GeneralSubtree(subtree)}, null);
+    }
+
+    private static NameConstraints excluded(GeneralName subtree) {
+        return new NameConstraints(null, new GeneralSubtree[]{new GeneralSubtree(subtree)});
+    }
+
+    /**
+     * The names and extended key usage of a leaf. By default it has the emailProtection key purpose.
+     */
+    private static class Leaf {
+        private String[] sanEmails = new String[0];
+        private String subjectEmail;
+        private KeyPurposeId[] keyPurposes = {KeyPurposeId.id_kp_emailProtection};
+
+        Leaf sanEmails(String... sanEmails) {
+            this.sanEmails = sanEmails;
+            return this;
+        }
+
+        Leaf subjectEmail(String subjectEmail) {
+            this.subjectEmail = subjectEmail;
+            return this;
+        }
+
+        /**
+         * Sets the extended key usage. With no key purposes, the leaf has no extended key usage extension.
+         */
+        Leaf keyPurposes(KeyPurposeId... keyPurposes) {
+            this.keyPurposes = keyPurposes;
+            return this;
+        }
+
+        KeyStoreGenerator generator(GeneratorOptions options) {
+            KeyStoreGenerator generator = new KeyStoreGenerator(options).setIsCa(false);
+            String subject = "C=US, ST=California, L=Los Gatos, O=Netflix Inc, OU=Platform Security (" + options.nextUniqueId() + "), CN=S/MIME Test User";
+            if (subjectEmail != null) {
+                subject += ", E=" + subjectEmail;
+            }
+            generator.setSubjectName(new X500Name(subject));
+            if (sanEmails.length > 0) {
+                GeneralName[] names = new GeneralName[sanEmails.length];
+                for (int i = 0; i < sanEmails.length; i++) {
+                    names[i] = new GeneralName(GeneralName.rfc822Name, sanEmails[i]);
+                }
+                generator.setSubjectAlternateNames(new GeneralNames(names));
+            }
+            if (keyPurposes.length > 0) {
+                generator.addExtension(Extension.extendedKeyUsage, false, new ExtendedKeyUsage(keyPurposes));
+            }
+            return generator;
+        }
+    }
+}
@@ -0,0 +1,156 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.asn1.x509.GeneralName;
+import org.bouncycastle.asn1.x509.GeneralNames;
+import org.bouncycastle.asn1.x509.GeneralSubtree;
+import org.bouncycastle.asn1.x509.NameConstraints;
+import org.json.JSONArray;
+import org.json.JSONObject;
+
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyStore;
+
+/**
+ * Generates stress certificates with thousands of SANs and thousands of name constraints. Verifiers that compare
+ * every name with every constraint do quadratic work on these, so the harnesses time each test as well as checking its
+ * result. These are only generated when running this class directly, e.g. with {@code gradle runStressGenerator}.
+ */
+public class StressCertificateGenerator {
+
+    // The numbers of SANs and of constraints to generate.
+    private static final int[] SIZES = new int[] { 1024, 4096 };
+
+    public static void main(String[] args) throws Exception {
+
+        final JSONObject config = new JSONObject(new String(Files.readAllBytes(Paths.get("../config.json")), StandardCharsets.UTF_8));
+        final Path outputDir = Paths.get("../certificates/stress");
+        Files.createDirectories(outputDir);
+
+        new StressCertificateGenerator(config, outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
+    }
+
+    private final Path outputDir;
+    private final GeneratorOptions options;
+    private final String hostname;
+    private final String hostSubtree;
+    private final String invalidHostSubtree;
+
+    private final JSONArray stressManifest = new JSONArray();
+    private int nextCertId = 1;
+
+    private StressCertificateGenerator(JSONObject config, Path outputDir, GeneratorOptions options) {
+        this.outputDir = outputDir;
+        this.options = options;
+        this.hostname = config.getString("hostname");
+        this.hostSubtree = config.getString("hostSubtree");
+        this.invalidHostSubtree = config.getString("invalidHostSubtree");
+    }
+
+    private void generateCertificates() throws Exception {
+
+        KeyStore rootCa = new KeyStoreGenerator(options)
+                .setCaKeyEntry(null)
+                .setCommonName("Stress Test Root CA")
+                .setIsCa(true)
+                .build();
+        CertificateGenerator.writeCertificate(rootCa.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve("root.crt"));
+
+        for (int size : SIZES) {
+            writeCase(size, 0, "OK", "The leaf has " + size + " SANs, the last of which is the hostname, and there are no name constraints.",
+                    makeLeaf(rootCa, null, makeSans(size)));
+
+            writeCase(1, size, "OK", "The intermediate has " + size + " permitted DNS subtrees, only the last of which permits the hostname.",
+                    makeLeaf(rootCa, new NameConstraints(makeSubtrees(size, hostSubtree), null), makeSans(1)));
+
+            // Checking every SAN against every constraint takes size * size comparisons, which a verifier may
+            // reasonably refuse to do.
+            writeCase(size, size, "WEAK-OK", "The leaf has " + size + " SANs and the intermediate has " + size + " excluded DNS subtrees, none of which match.",
+                    makeLeaf(rootCa, new NameConstraints(null, makeSubtrees(size, null)), makeSans(size)));
+
+            writeCase(size, size, "ERROR", "The leaf has " + size + " SANs and the intermediate has " + size + " excluded DNS subtrees, only the last of which matches the last SAN.",
+                    makeLeaf(rootCa, new NameConstraints(null, makeSubtrees(size, hostname)), makeSans(size)));
+        }
+
+        final JSONObject manifest = new JSONObject();
+        manifest.put("stressManifest", stressManifest);
+        Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    /**
+     * Returns count DNS SANs within hostSubtree, the last of which is the hostname.
+     */
+    private GeneralNames makeSans(int count) {
+        GeneralName[] names = new GeneralName[count];
+        for (int i = 0; i < count - 1; i++) {
+            names[i] = new GeneralName(GeneralName.dNSName, "san" + i + "." + hostSubtree);
+        }
+        names[count - 1] = new GeneralName(GeneralName.dNSName, hostname);
+        return new GeneralNames(names);
+    }
+
+    /**
+     * Returns count DNS subtrees within invalidHostSubtree, except that the last is last if it isn't null.
+     */
+    private GeneralSubtree[] makeSubtrees(int count, String last) {
+        GeneralSubtree[] subtrees = new GeneralSubtree[count];
+        for (int i = 0; i < count; i++) {
+            String name = "constraint" + i + "." + invalidHostSubtree;
+            if (i == count - 1 && last != null) {
+                name = last;
+            }
+            subtrees[i] = new GeneralSubtree(new GeneralName(GeneralName.dNSName, name));
+        }
+        return subtrees;
+    }
+
+    private KeyStore makeLeaf(KeyStore rootCa, NameConstraints nameConstraints, GeneralNames sans) throws Exception {
+        KeyStore intermediate = new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(rootCa))
+                .setCommonName("Stress Test Intermediate CA")
+                .setIsCa(true)
+                .setNameConstraints(nameConstraints)
+                .build();
+
+        return new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(intermediate))
+                .setIsCa(false)
+                .setSubjectAlternateNames(sans)
+                .build();
+    }
+
+    private void writeCase(int sans, int constraints, String expect, String description, KeyStore leaf) throws Exception {
+        System.out.println("Generating stress certificate " + nextCertId + "...");
+        CertificateGenerator.writeCertificateSet(leaf, outputDir, Integer.toString(nextCertId));
+
+        stressManifest.put(new JSONObject()
+                .put("id", nextCertId)
+                .put("sans", sans)
+                .put("constraints", constraints)
+                .put("expect", expect)
+                .put("description", description)
+        );
+
+        nextCertId += 1;
+    }
+}
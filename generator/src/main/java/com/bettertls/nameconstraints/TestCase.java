@@ -0,0 +1,298 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+
+package com.bettertls.nameconstraints;
+
+import java.util.ArrayList;
+import java.util.Arrays;
+import java.util.Collections;
+import java.util.List;
+
+/**
+ * A declarative description of a single test case: the names in the leaf certificate, the name constraints on its
+ * local root, any names in the intermediate between them and, optionally, the expected results. Each generated
+ * permutation is described by one of these, and cases outside of the permutations can be added to
+ * {@link TestCases#extraCases}, e.g.
+ *
+ * <pre>
+ * TestCase.builder()
+ *         .commonName(hostname)
+ *         .dnsSans(hostname)
+ *         .permittedDns(hostSubtree)
+ *         .expectDns("OK", "The DNS name is within the permitted subtree.")
+ *         .build()
+ * </pre>
+ *
+ * Expectations that aren't given are derived by defineExpects.js. Where verifiers reasonably differ, an explicit
+ * expectation can also list the competing interpretations, each with the result it leads to and a reason code, so that
+ * results can record which interpretation a verifier follows, and an explicit ERROR expectation can list the reasons,
+ * in the terms of the harness's error taxonomy, for which a verifier may reject the certificate.
+ *
+ * Each case is verified against the hostname and IP in config.json unless it sets a target of its own, for names that
+ * can only be tested with a different one, such as wildcards.
+ */
+final class TestCase {
+
+    final String commonName;
+    final List<String> dnsSans;
+    final List<String> ipSans;
+    final List<String> permittedDns;
+    final List<String> permittedIps;
+    final List<String> excludedDns;
+    final List<String> excludedIps;
+    final String intermediateCommonName;
+    final List<String> intermediateDnsSans;
+    final List<String> intermediateIpSans;
+    final Expect dnsExpect;
+    final Expect ipExpect;
+    final Expect clientAuthExpect;
+    final List<Interpretation> dnsInterpretations;
+    final List<Interpretation> ipInterpretations;
+    final List<String> dnsReasons;
+    final List<String> ipReasons;
+    final String targetHostname;
+    final String targetIp;
+
+    private TestCase(Builder builder) {
+        this.commonName = builder.commonName;
+        this.dnsSans = Collections.unmodifiableList(new ArrayList<>(builder.dnsSans));
+        this.ipSans = Collections.unmodifiableList(new ArrayList<>(builder.ipSans));
+        this.permittedDns = Collections.unmodifiableList(new ArrayList<>(builder.permittedDns));
+        this.permittedIps = Collections.unmodifiableList(new ArrayList<>(builder.permittedIps));
+        this.excludedDns = Collections.unmodifiableList(new ArrayList<>(builder.excludedDns));
+        this.excludedIps = Collections.unmodifiableList(new ArrayList<>(builder.excludedIps));
+        this.intermediateCommonName = builder.intermediateCommonName;
+        this.intermediateDnsSans = Collections.unmodifiableList(new ArrayList<>(builder.intermediateDnsSans));
+        this.intermediateIpSans = Collections.unmodifiableList(new ArrayList<>(builder.intermediateIpSans));
+        this.dnsExpect = builder.dnsExpect;
+        this.ipExpect = builder.ipExpect;
+        this.clientAuthExpect = builder.clientAuthExpect;
+        this.dnsInterpretations = Collections.unmodifiableList(new ArrayList<>(builder.dnsInterpretations));
+        this.ipInterpretations = Collections.unmodifiableList(new ArrayList<>(builder.ipInterpretations));
+        this.dnsReasons = Collections.unmodifiableList(new ArrayList<>(builder.dnsReasons));
+        this.ipReasons = Collections.unmodifiableList(new ArrayList<>(builder.ipReasons));
+        this.targetHostname = builder.targetHostname;
+        this.targetIp = builder.targetIp;
+    }
+
+    static Builder builder() {
+        return new Builder();
+    }
+
+    /**
+     * An explicit expected result, one of "OK", "WEAK-OK" or "ERROR", with the reason for it.
+     */
+    static final class Expect {
+        final String result;
+        final String description;
+
+        Expect(String result, String description) {
+            this.result = result;
+            this.description = description;
+        }
+    }
+
+    /**
+     * One reading of the rules under which a verifier could reach a different result from the expected one. The name
+     * identifies the interpretation and the reason is a code for why it leads to its result, e.g.
+     * "ANY_NAME_VIOLATES".
+     */
+    static final class Interpretation {
+        final String name;
+        final String result;
+        final String reason;
+
+        Interpretation(String name, String result, String reason) {
+            this.name = name;
+            this.result = result;
+            this.reason = reason;
+        }
+    }
+
+    static final class Builder {
+        private String commonName;
+        private final List<String> dnsSans = new ArrayList<>();
+        private final List<String> ipSans = new ArrayList<>();
+        private final List<String> permittedDns = new ArrayList<>();
+        private final List<String> permittedIps = new ArrayList<>();
+        private final List<String> excludedDns = new ArrayList<>();
+        private final List<String> excludedIps = new ArrayList<>();
+        private String intermediateCommonName;
+        private final List<String> intermediateDnsSans = new ArrayList<>();
+        private final List<String> intermediateIpSans = new ArrayList<>();
+        private Expect dnsExpect;
+        private Expect ipExpect;
+        private Expect clientAuthExpect;
+        private final List<Interpretation> dnsInterpretations = new ArrayList<>();
+        private final List<Interpretation> ipInterpretations = new ArrayList<>();
+        private final List<String> dnsReasons = new ArrayList<>();
+        private final List<String> ipReasons = new ArrayList<>();
+        private String targetHostname;
+        private String targetIp;
+
+        private Builder() {
+        }
+
+        /**
+         * Sets the leaf's common name. A null name leaves it out.
+         */
+        Builder commonName(String commonName) {
+            this.commonName = commonName;
+            return this;
+        }
+
+        Builder dnsSans(String... names) {
+            addNonNull(dnsSans, names);
+            return this;
+        }
+
+        Builder ipSans(String... ips) {
+            addNonNull(ipSans, ips);
+            return this;
+        }
+
+        Builder permittedDns(String... subtrees) {
+            addNonNull(permittedDns, subtrees);
+            return this;
+        }
+
+        /**
+         * Adds permitted IP subtrees in CIDR notation, or as "#" and the hex encoded octets of the iPAddress name.
+         */
+        Builder permittedIps(String... subtrees) {
+            addNonNull(permittedIps, subtrees);
+            return this;
+        }
+
+        Builder excludedDns(String... subtrees) {
+            addNonNull(excludedDns, subtrees);
+            return this;
+        }
+
+        /**
+         * Adds excluded IP subtrees in CIDR notation, or as "#" and the hex encoded octets of the iPAddress name.
+         */
+        Builder excludedIps(String... subtrees) {
+            addNonNull(excludedIps, subtrees);
+            return this;
+        }
+
+        /**
+         * Sets the intermediate's common name, which is otherwise a description of the CA. Like the intermediate's
+         * SANs, it's subject to the local root's name constraints.
+         */
+        Builder intermediateCommonName(String commonName) {
+            this.intermediateCommonName = commonName;
+            return this;
+        }
+
+        Builder intermediateDnsSans(String... names) {
+            addNonNull(intermediateDnsSans, names);
+            return this;
+        }
+
+        Builder intermediateIpSans(String... ips) {
+            addNonNull(intermediateIpSans, ips);
+            return this;
+        }
+
+        Builder expectDns(String result, String description) {
+            this.dnsExpect = new Expect(result, description);
+            return this;
+        }
+
+        Builder expectIp(String result, String description) {
+            this.ipExpect = new Expect(result, description);
+            return this;
+        }
+
+        /**
+         * Sets the expected result of verifying the leaf as a client certificate, for cases whose names
+         * defineExpects.js can't check against the constraints itself.
+         */
+        Builder expectClientAuth(String result, String description) {
+            this.clientAuthExpect = new Expect(result, description);
+            return this;
+        }
+
+        Builder interpretDns(String name, String result, String reason) {
+            dnsInterpretations.add(new Interpretation(name, result, reason));
+            return this;
+        }
+
+        Builder interpretIp(String name, String result, String reason) {
+            ipInterpretations.add(new Interpretation(name, result, reason));
+            return this;
+        }
+
+        /**
+         * Adds reasons, e.g. "NAME_CONSTRAINT_VIOLATION", for which a verifier may reject the leaf when verifying the
+         * DNS name. Without any, every reason is accepted.
+         */
+        Builder dnsReasons(String... reasons) {
+            addNonNull(dnsReasons, reasons);
+            return this;
+        }
+
+        /**
+         * Adds reasons for which a verifier may reject the leaf when verifying the IP.
+         */
+        Builder ipReasons(String... reasons) {
+            addNonNull(ipReasons, reasons);
+            return this;
+        }
+
+        /**
+         * Sets the DNS name that the leaf is verified against, in place of the hostname in config.json, for cases
+         * that need a name of their own, such as a wildcard's. Like the hostname, it's rewritten under the test's own
+         * hostname when perTestHostnames is set, and it must resolve to the test server for clients to be probed.
+         */
+        Builder targetHostname(String hostname) {
+            this.targetHostname = hostname;
+            return this;
+        }
+
+        /**
+         * Sets the IP that the leaf is verified against, in place of the IP in config.json.
+         */
+        Builder targetIp(String ip) {
+            this.targetIp = ip;
+            return this;
+        }
+
+        TestCase build() {
+            if ((dnsExpect == null && !dnsInterpretations.isEmpty()) || (ipExpect == null && !ipInterpretations.isEmpty())) {
+                throw new IllegalStateException("Interpretations need an explicit expectation");
+            }
+            if ((!dnsReasons.isEmpty() && (dnsExpect == null || !dnsExpect.result.equals("ERROR")))
+                    || (!ipReasons.isEmpty() && (ipExpect == null || !ipExpect.result.equals("ERROR")))) {
+                throw new IllegalStateException("Reasons need an explicit ERROR expectation");
+            }
+            return new TestCase(this);
+        }
+
+        // Null values are skipped so that optional names can be passed straight through from the permutations.
+        private static void addNonNull(List<String> list, String... values) {
+            for (String value : Arrays.asList(values)) {
+                if (value != null) {
+                    list.add(value);
+                }
+            }
+        }
+    }
+}
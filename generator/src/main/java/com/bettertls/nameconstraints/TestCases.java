@@ -0,0 +1,537 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.util.encoders.Hex;
+import org.json.JSONObject;
+
+import java.util.ArrayList;
+import java.util.Arrays;
+import java.util.List;
+import java.util.Locale;
+
+/**
+ * Test cases that are generated in addition to the name constraint permutations. New cases are added by appending
+ * entries here; they're numbered after the permutations. Test IDs must not change within a corpus version, so cases
+ * are only inserted, reordered or removed along with a bump of testVersion in config.json, after which the stability
+ * command of the Go harness maps the old IDs to the new ones.
+ */
+final class TestCases {
+
+    private TestCases() {
+    }
+
+    // RFC 5280 section 4.2.1.10 applies name constraints to every name in the certificate, so a leaf with one name
+    // that violates them is rejected whatever name is being verified. Some verifiers only check the name being
+    // verified.
+    static final String ANY_NAME_VIOLATES = "anyNameViolates";
+    static final String QUERIED_NAME_ONLY = "queriedNameOnly";
+    static final String REASON_ANY_NAME_VIOLATES = "ANY_NAME_VIOLATES";
+    static final String REASON_QUERIED_NAME_PERMITTED = "QUERIED_NAME_PERMITTED";
+
+    // RFC 5280 doesn't say what a leading dot means in a DNS name constraint. In URI and email constraints it means
+    // subdomains only, and some verifiers read DNS constraints the same way, while others ignore the dot.
+    static final String LEADING_DOT_SUBDOMAINS_ONLY = "leadingDotSubdomainsOnly";
+    static final String LEADING_DOT_IGNORED = "leadingDotIgnored";
+    static final String REASON_LEADING_DOT_EXCLUDES_DOMAIN = "LEADING_DOT_EXCLUDES_DOMAIN";
+    static final String REASON_LEADING_DOT_IGNORED = "LEADING_DOT_IGNORED";
+
+    // RFC 5280 section 6.1.3 applies name constraints to every certificate after the one that imposes them, CAs
+    // included, so an intermediate with a name outside them breaks the path. Many verifiers only check the leaf's
+    // names.
+    static final String INTERMEDIATE_NAMES_CHECKED = "intermediateNamesChecked";
+    static final String LEAF_NAMES_ONLY = "leafNamesOnly";
+    static final String REASON_INTERMEDIATE_NAME_VIOLATES = "INTERMEDIATE_NAME_VIOLATES";
+    static final String REASON_LEAF_NAMES_PERMITTED = "LEAF_NAMES_PERMITTED";
+
+    // Whitespace isn't allowed in DNS names, but some verifiers trim it from names and constraints before comparing
+    // them, while others compare them as they are.
+    static final String WHITESPACE_TRIMMED = "whitespaceTrimmed";
+    static final String WHITESPACE_SIGNIFICANT = "whitespaceSignificant";
+    static final String REASON_WHITESPACE_TRIMMED = "WHITESPACE_TRIMMED";
+    static final String REASON_WHITESPACE_SIGNIFICANT = "WHITESPACE_SIGNIFICANT";
+
+    // RFC 6125 section 6.4.3 let clients match a wildcard that's only part of the left-most label, such as "w*", but
+    // RFC 9525, which replaced it, only allows an asterisk that is the whole label.
+    static final String PARTIAL_WILDCARD_REJECTED = "partialWildcardRejected";
+    static final String PARTIAL_WILDCARD_MATCHED = "partialWildcardMatched";
+    static final String REASON_PARTIAL_WILDCARD_REJECTED = "PARTIAL_WILDCARD_REJECTED";
+    static final String REASON_PARTIAL_WILDCARD_MATCHED = "PARTIAL_WILDCARD_MATCHED";
+
+    // IPv6 addresses from the documentation prefix of RFC 3849.
+    private static final String DOCUMENTATION_IPV6 = "2001:db8::1";
+    private static final String DOCUMENTATION_IPV6_SUBTREE = "2001:db8::/32";
+    private static final byte[] IPV4_MAPPED_PREFIX = {0, 0, 0, 0, 0, 0, 0, 0, 0, 0, (byte) 0xff, (byte) 0xff};
+
+    static List<TestCase> extraCases(JSONObject config) {
+        String hostname = config.getString("hostname");
+        String ip = config.getString("ip");
+        String hostSubtree = config.getString("hostSubtree");
+        String ipSubtree = config.getString("ipSubtree");
+        String invalidHostname = config.getString("invalidHostname");
+        String invalidIp = config.getString("invalidIp");
+
+        List<TestCase> cases = new ArrayList<>();
+
+        // Leaves with one SAN that satisfies the constraints and another that violates them.
+        cases.add(mixedSans(TestCase.builder()
+                .dnsSans(hostname, invalidHostname)
+                .ipSans(ip)
+                .permittedDns(hostSubtree), "The leaf has a second DNS SAN outside of the permitted DNS subtree."));
+        cases.add(mixedSans(TestCase.builder()
+                .dnsSans(hostname, invalidHostname)
+                .ipSans(ip)
+                .excludedDns(invalidHostname), "The leaf has a second DNS SAN within an excluded DNS subtree."));
+        cases.add(mixedSans(TestCase.builder()
+                .dnsSans(hostname)
+                .ipSans(ip, invalidIp)
+                .permittedIps(ipSubtree), "The leaf has a second IP SAN outside of the permitted IP subtree."));
+        cases.add(mixedSans(TestCase.builder()
+                .dnsSans(hostname)
+                .ipSans(ip, invalidIp)
+                .excludedIps(invalidIp + "/32"), "The leaf has a second IP SAN within an excluded IP subtree."));
+
+        // Edge cases in the forms of DNS constraints and names, which verifiers disagree on.
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .permittedDns("")
+                .expectDns("OK", "The permitted DNS subtree is empty, and every DNS name is within it.")
+                .expectIp("OK", "The permitted DNS subtree is empty, and every DNS name is within it.")
+                .build());
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .excludedDns("")
+                .expectDns("ERROR", "The excluded DNS subtree is empty, which excludes every DNS name.")
+                .expectIp("ERROR", "The excluded DNS subtree is empty, which excludes the leaf's DNS SAN. Name constraints apply to every name in the certificate.")
+                .dnsReasons("NAME_CONSTRAINT_VIOLATION")
+                .ipReasons("NAME_CONSTRAINT_VIOLATION")
+                .interpretIp(ANY_NAME_VIOLATES, "ERROR", REASON_ANY_NAME_VIOLATES)
+                .interpretIp(QUERIED_NAME_ONLY, "OK", REASON_QUERIED_NAME_PERMITTED)
+                .build());
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .permittedDns(".")
+                .expectDns("WEAK-OK", "The permitted DNS subtree is \".\", which as the root permits every name but isn't a valid hostname, so it may be rejected as malformed.")
+                .expectIp("WEAK-OK", "The permitted DNS subtree is \".\", which as the root permits every name but isn't a valid hostname, so it may be rejected as malformed.")
+                .expectClientAuth("WEAK-OK", "The permitted DNS subtree is \".\", which as the root permits every name but isn't a valid hostname, so it may be rejected as malformed.")
+                .build());
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .permittedDns("." + hostSubtree)
+                .expectDns("OK", "The permitted DNS subtree has a leading dot, and the hostname is a subdomain of it, so it's within the subtree however the dot is read.")
+                .expectIp("OK", "The permitted DNS subtree has a leading dot, and the leaf's DNS SAN is a subdomain of it, so it's within the subtree however the dot is read.")
+                .build());
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .permittedDns("." + hostname)
+                .expectDns("WEAK-OK", "The permitted DNS subtree is the hostname with a leading dot, which permits only its subdomains if the dot is read as in URI and email constraints.")
+                .interpretDns(LEADING_DOT_SUBDOMAINS_ONLY, "ERROR", REASON_LEADING_DOT_EXCLUDES_DOMAIN)
+                .interpretDns(LEADING_DOT_IGNORED, "OK", REASON_LEADING_DOT_IGNORED)
+                .expectIp("WEAK-OK", "The permitted DNS subtree is the leaf's DNS SAN with a leading dot, which permits only its subdomains if the dot is read as in URI and email constraints.")
+                .expectClientAuth("WEAK-OK", "The permitted DNS subtree is the leaf's DNS SAN with a leading dot, which permits only its subdomains if the dot is read as in URI and email constraints.")
+                .build());
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .permittedDns(hostSubtree + ".")
+                .expectDns("WEAK-OK", "The permitted DNS subtree has a trailing dot, as an absolute name. The hostname is within it if names are compared as absolute, but not by a plain suffix match.")
+                .expectIp("WEAK-OK", "The permitted DNS subtree has a trailing dot, as an absolute name. The leaf's DNS SAN is within it if names are compared as absolute, but not by a plain suffix match.")
+                .expectClientAuth("WEAK-OK", "The permitted DNS subtree has a trailing dot, as an absolute name. The leaf's DNS SAN is within it if names are compared as absolute, but not by a plain suffix match.")
+                .build());
+        cases.add(TestCase.builder()
+                .dnsSans(hostname + ".")
+                .ipSans(ip)
+                .permittedDns(hostSubtree)
+                .expectDns("WEAK-OK", "The DNS SAN is the hostname with a trailing dot, as an absolute name. It is the same name and within the permitted subtree if names are compared as absolute, but not by a plain match.")
+                .expectIp("WEAK-OK", "The DNS SAN has a trailing dot, as an absolute name. It is within the permitted subtree if names are compared as absolute, but not by a plain suffix match.")
+                .expectClientAuth("WEAK-OK", "The DNS SAN has a trailing dot, as an absolute name. It is within the permitted subtree if names are compared as absolute, but not by a plain suffix match.")
+                .build());
+        cases.add(mixedSans(TestCase.builder()
+                .dnsSans(hostname, invalidHostname + ".")
+                .ipSans(ip)
+                .excludedDns(invalidHostname), "The leaf has a second DNS SAN that is an excluded name with a trailing dot, which is the same name but evades a plain suffix match."));
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname + "\0." + invalidHostname)
+                .ipSans(ip)
+                .permittedDns(hostSubtree)
+                .expectDns("ERROR", "The DNS SAN is the hostname, a NUL and a name outside of the permitted subtree. Verifiers that read it as a C string see only the hostname.")
+                .expectIp("ERROR", "The DNS SAN is the hostname, a NUL and a name outside of the permitted subtree, so it violates the constraints. Name constraints apply to every name in the certificate.")
+                .dnsReasons("NAME_CONSTRAINT_VIOLATION", "PARSE_ERROR")
+                .ipReasons("NAME_CONSTRAINT_VIOLATION", "PARSE_ERROR")
+                .interpretIp(ANY_NAME_VIOLATES, "ERROR", REASON_ANY_NAME_VIOLATES)
+                .interpretIp(QUERIED_NAME_ONLY, "OK", REASON_QUERIED_NAME_PERMITTED)
+                .build());
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .excludedDns(hostname + "\0." + invalidHostname)
+                .expectDns("WEAK-OK", "The excluded DNS subtree is the hostname, a NUL and another name, which isn't a valid hostname and doesn't match the hostname, unless read as a C string.")
+                .expectIp("WEAK-OK", "The excluded DNS subtree is the leaf's DNS SAN, a NUL and another name, which isn't a valid hostname and doesn't match the SAN, unless read as a C string.")
+                .expectClientAuth("WEAK-OK", "The excluded DNS subtree is the leaf's DNS SAN, a NUL and another name, which isn't a valid hostname and doesn't match the SAN, unless read as a C string.")
+                .build());
+
+        // Edge cases in the encodings of IP constraints.
+        byte[] ipOctets = ipv4Octets(ip);
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .permittedIps(rawIpSubtree(ipOctets, new byte[]{(byte) 0xff, (byte) 0xff}))
+                .expectDns("ERROR", "The permitted IP subtree is 6 bytes long, where an IPv4 subtree is an address and a mask of 8 bytes, so the name constraints extension is malformed.")
+                .expectIp("ERROR", "The permitted IP subtree is 6 bytes long, where an IPv4 subtree is an address and a mask of 8 bytes, so the name constraints extension is malformed.")
+                .expectClientAuth("ERROR", "The permitted IP subtree is 6 bytes long, where an IPv4 subtree is an address and a mask of 8 bytes, so the name constraints extension is malformed.")
+                .dnsReasons("NAME_CONSTRAINT_VIOLATION", "UNSUPPORTED_NAME_CONSTRAINT", "PARSE_ERROR")
+                .ipReasons("NAME_CONSTRAINT_VIOLATION", "UNSUPPORTED_NAME_CONSTRAINT", "PARSE_ERROR")
+                .build());
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .permittedIps(rawIpSubtree(ipOctets))
+                .expectDns("ERROR", "The permitted IP subtree is the IP without a mask, so the name constraints extension is malformed.")
+                .expectIp("ERROR", "The permitted IP subtree is the IP without a mask, so the name constraints extension is malformed.")
+                .expectClientAuth("ERROR", "The permitted IP subtree is the IP without a mask, so the name constraints extension is malformed.")
+                .dnsReasons("NAME_CONSTRAINT_VIOLATION", "UNSUPPORTED_NAME_CONSTRAINT", "PARSE_ERROR")
+                .ipReasons("NAME_CONSTRAINT_VIOLATION", "UNSUPPORTED_NAME_CONSTRAINT", "PARSE_ERROR")
+                .build());
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .excludedIps(rawIpSubtree(ipOctets, new byte[]{(byte) 0xff, (byte) 0xff}))
+                .expectDns("WEAK-OK", "The excluded IP subtree is 6 bytes long, so the name constraints extension is malformed, but verifiers that skip the subtree find no name excluded.")
+                .expectIp("WEAK-OK", "The excluded IP subtree is 6 bytes long, so the name constraints extension is malformed, but verifiers that skip the subtree find no name excluded.")
+                .expectClientAuth("WEAK-OK", "The excluded IP subtree is 6 bytes long, so the name constraints extension is malformed, but verifiers that skip the subtree find no name excluded.")
+                .build());
+        String nonContiguousSubtree = (ipOctets[0] & 0xff) + "." + (ipOctets[1] & 0xff) + ".0." + (ipOctets[3] & 0xff) + "/255.255.0.255";
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .permittedIps(nonContiguousSubtree)
+                .expectDns("WEAK-OK", "The permitted IP subtree has a mask that isn't contiguous. The leaf's IP SAN is within it if the mask is applied bit by bit, but the mask can't be written in CIDR notation, so it may be rejected as malformed.")
+                .expectIp("WEAK-OK", "The permitted IP subtree has a mask that isn't contiguous. The IP is within it if the mask is applied bit by bit, but the mask can't be written in CIDR notation, so it may be rejected as malformed.")
+                .expectClientAuth("WEAK-OK", "The permitted IP subtree has a mask that isn't contiguous. The leaf's IP SAN is within it if the mask is applied bit by bit, but the mask can't be written in CIDR notation, so it may be rejected as malformed.")
+                .build());
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .excludedIps(nonContiguousSubtree)
+                .expectDns("ERROR", "The excluded IP subtree has a mask that isn't contiguous. The leaf's IP SAN is excluded if the mask is applied bit by bit, and otherwise the subtree is malformed.")
+                .expectIp("ERROR", "The excluded IP subtree has a mask that isn't contiguous. The IP is excluded if the mask is applied bit by bit, and otherwise the subtree is malformed.")
+                .expectClientAuth("ERROR", "The excluded IP subtree has a mask that isn't contiguous. The leaf's IP SAN is excluded if the mask is applied bit by bit, and otherwise the subtree is malformed.")
+                .dnsReasons("NAME_CONSTRAINT_VIOLATION", "UNSUPPORTED_NAME_CONSTRAINT", "PARSE_ERROR")
+                .ipReasons("NAME_CONSTRAINT_VIOLATION", "UNSUPPORTED_NAME_CONSTRAINT", "PARSE_ERROR")
+                .build());
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .permittedIps("0.0.0.0/0")
+                .expectDns("OK", "The permitted IP subtree has a mask of length 0, which permits every IPv4 address.")
+                .expectIp("OK", "The permitted IP subtree has a mask of length 0, which permits every IPv4 address.")
+                .build());
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .excludedIps("0.0.0.0/0")
+                .expectDns("ERROR", "The excluded IP subtree has a mask of length 0, which excludes the leaf's IP SAN. Name constraints apply to every name in the certificate.")
+                .interpretDns(ANY_NAME_VIOLATES, "ERROR", REASON_ANY_NAME_VIOLATES)
+                .interpretDns(QUERIED_NAME_ONLY, "OK", REASON_QUERIED_NAME_PERMITTED)
+                .expectIp("ERROR", "The excluded IP subtree has a mask of length 0, which excludes every IPv4 address.")
+                .dnsReasons("NAME_CONSTRAINT_VIOLATION")
+                .ipReasons("NAME_CONSTRAINT_VIOLATION")
+                .build());
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .permittedIps(DOCUMENTATION_IPV6_SUBTREE)
+                .expectDns("ERROR", "The only permitted IP subtree is an IPv6 one, so the leaf's IPv4 SAN isn't within any permitted IP subtree. Name constraints apply to every name in the certificate.")
+                .interpretDns(ANY_NAME_VIOLATES, "ERROR", REASON_ANY_NAME_VIOLATES)
+                .interpretDns(QUERIED_NAME_ONLY, "OK", REASON_QUERIED_NAME_PERMITTED)
+                .expectIp("ERROR", "The only permitted IP subtree is an IPv6 one. IPv4 and IPv6 addresses are the same type of name, so the IP isn't within any permitted subtree of its type.")
+                .dnsReasons("NAME_CONSTRAINT_VIOLATION")
+                .ipReasons("NAME_CONSTRAINT_VIOLATION")
+                .build());
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .permittedIps(rawIpSubtree(IPV4_MAPPED_PREFIX, ipOctets, ones(16)))
+                .expectDns("WEAK-OK", "The only permitted IP subtree is the IPv4-mapped IPv6 form of the leaf's IP SAN. It permits the SAN only if addresses are compared after mapping them to IPv6.")
+                .expectIp("WEAK-OK", "The only permitted IP subtree is the IPv4-mapped IPv6 form of the IP. It permits the IP only if addresses are compared after mapping them to IPv6.")
+                .expectClientAuth("WEAK-OK", "The only permitted IP subtree is the IPv4-mapped IPv6 form of the leaf's IP SAN. It permits the SAN only if addresses are compared after mapping them to IPv6.")
+                .build());
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .excludedIps(rawIpSubtree(new byte[32]))
+                .expectDns("OK", "The excluded IP subtree is every IPv6 address, which doesn't include the leaf's IPv4 SAN.")
+                .expectIp("OK", "The excluded IP subtree is every IPv6 address, which doesn't include the IPv4 address.")
+                .build());
+        cases.add(mixedSans(TestCase.builder()
+                .dnsSans(hostname)
+                .ipSans(ip, DOCUMENTATION_IPV6)
+                .permittedIps(ipSubtree), "The leaf has a second IP SAN, an IPv6 address, which isn't within the permitted IPv4 subtree."));
+
+        // Intermediates whose own names violate the constraints of the local root above them.
+        cases.add(intermediateViolates(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .permittedDns(hostSubtree)
+                .intermediateDnsSans(invalidHostname), "The intermediate has a DNS SAN outside of the permitted DNS subtree."));
+        cases.add(intermediateViolates(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .excludedDns(invalidHostname)
+                .intermediateDnsSans(invalidHostname), "The intermediate has a DNS SAN within an excluded DNS subtree."));
+        cases.add(intermediateViolates(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .permittedIps(ipSubtree)
+                .intermediateIpSans(invalidIp), "The intermediate has an IP SAN outside of the permitted IP subtree."));
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .permittedDns(hostSubtree)
+                .intermediateDnsSans(hostSubtree)
+                .expectDns("OK", "The intermediate has a DNS SAN within the permitted DNS subtree, as does the leaf.")
+                .expectIp("OK", "The intermediate has a DNS SAN within the permitted DNS subtree, as does the leaf.")
+                .build());
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .permittedDns(hostSubtree)
+                .intermediateCommonName(invalidHostname)
+                .expectDns("WEAK-OK", "The intermediate's common name is a DNS name outside of the permitted DNS subtree. DNS name constraints only apply to SANs, but verifiers that apply them to the common names of certificates without a SAN extension reject it.")
+                .expectIp("WEAK-OK", "The intermediate's common name is a DNS name outside of the permitted DNS subtree. DNS name constraints only apply to SANs, but verifiers that apply them to the common names of certificates without a SAN extension reject it.")
+                .expectClientAuth("WEAK-OK", "The intermediate's common name is a DNS name outside of the permitted DNS subtree. DNS name constraints only apply to SANs, but verifiers that apply them to the common names of certificates without a SAN extension reject it.")
+                .build());
+
+        // DNS names and constraints in other than lowercase, which RFC 5280 section 7.2 requires to be compared
+        // case-insensitively.
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname.toUpperCase(Locale.ROOT))
+                .ipSans(ip)
+                .permittedDns(hostSubtree)
+                .expectDns("OK", "The DNS SAN is the hostname in uppercase, which is the same name, and it's within the permitted subtree.")
+                .expectIp("OK", "The DNS SAN is in uppercase, and it's within the permitted subtree.")
+                .build());
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .permittedDns(hostSubtree.toUpperCase(Locale.ROOT))
+                .expectDns("OK", "The permitted DNS subtree is in uppercase, and the hostname is within it.")
+                .expectIp("OK", "The permitted DNS subtree is in uppercase, and the leaf's DNS SAN is within it.")
+                .build());
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .excludedDns(hostSubtree.toUpperCase(Locale.ROOT))
+                .expectDns("ERROR", "The excluded DNS subtree is in uppercase, and the hostname is within it.")
+                .expectIp("ERROR", "The excluded DNS subtree is in uppercase, and the leaf's DNS SAN is within it. Name constraints apply to every name in the certificate.")
+                .dnsReasons("NAME_CONSTRAINT_VIOLATION")
+                .ipReasons("NAME_CONSTRAINT_VIOLATION")
+                .interpretIp(ANY_NAME_VIOLATES, "ERROR", REASON_ANY_NAME_VIOLATES)
+                .interpretIp(QUERIED_NAME_ONLY, "OK", REASON_QUERIED_NAME_PERMITTED)
+                .build());
+        cases.add(mixedSans(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname, mixedCase(invalidHostname))
+                .ipSans(ip)
+                .excludedDns(invalidHostname), "The leaf has a second DNS SAN that is an excluded name in mixed case, which is the same name but evades a case-sensitive match."));
+
+        // DNS names and constraints with leading or trailing whitespace.
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(" " + hostname)
+                .ipSans(ip)
+                .permittedDns(hostSubtree)
+                .expectDns("WEAK-OK", "The DNS SAN is the hostname with a leading space, which isn't a valid DNS name. It only matches the hostname if whitespace is trimmed.")
+                .interpretDns(WHITESPACE_TRIMMED, "OK", REASON_WHITESPACE_TRIMMED)
+                .interpretDns(WHITESPACE_SIGNIFICANT, "ERROR", REASON_WHITESPACE_SIGNIFICANT)
+                .expectIp("WEAK-OK", "The DNS SAN has a leading space, which isn't a valid DNS name, so it may be rejected as malformed.")
+                .expectClientAuth("WEAK-OK", "The DNS SAN has a leading space, which isn't a valid DNS name, so it may be rejected as malformed.")
+                .build());
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .permittedDns(hostSubtree + " ")
+                .expectDns("WEAK-OK", "The permitted DNS subtree has a trailing space, which isn't a valid DNS name. The hostname is only within it if whitespace is trimmed.")
+                .interpretDns(WHITESPACE_TRIMMED, "OK", REASON_WHITESPACE_TRIMMED)
+                .interpretDns(WHITESPACE_SIGNIFICANT, "ERROR", REASON_WHITESPACE_SIGNIFICANT)
+                .expectIp("WEAK-OK", "The permitted DNS subtree has a trailing space, which isn't a valid DNS name. The leaf's DNS SAN is only within it if whitespace is trimmed.")
+                .expectClientAuth("WEAK-OK", "The permitted DNS subtree has a trailing space, which isn't a valid DNS name. The leaf's DNS SAN is only within it if whitespace is trimmed.")
+                .build());
+        cases.add(TestCase.builder()
+                .commonName(hostname)
+                .dnsSans(hostname)
+                .ipSans(ip)
+                .excludedDns(hostSubtree + " ")
+                .expectDns("WEAK-OK", "The excluded DNS subtree has a trailing space, which isn't a valid DNS name. The hostname is only within it if whitespace is trimmed.")
+                .interpretDns(WHITESPACE_TRIMMED, "ERROR", REASON_WHITESPACE_TRIMMED)
+                .interpretDns(WHITESPACE_SIGNIFICANT, "OK", REASON_WHITESPACE_SIGNIFICANT)
+                .expectIp("WEAK-OK", "The excluded DNS subtree has a trailing space, which isn't a valid DNS name. The leaf's DNS SAN is only within it if whitespace is trimmed.")
+                .expectClientAuth("WEAK-OK", "The excluded DNS subtree has a trailing space, which isn't a valid DNS name. The leaf's DNS SAN is only within it if whitespace is trimmed.")
+                .build());
+
+        // Wildcard DNS SANs, which match a single label in the left-most position. Most are verified against a name of
+        // their own under the hostname, so that the wildcard is what matches it.
+        String wildcard = "*." + hostname;
+        cases.add(TestCase.builder()
+                .dnsSans(wildcard)
+                .ipSans(ip)
+                .targetHostname("www." + hostname)
+                .expectDns("OK", "The DNS SAN is a wildcard whose asterisk stands for the left-most label of the name.")
+                .build());
+        cases.add(TestCase.builder()
+                .dnsSans(wildcard)
+                .ipSans(ip)
+                .targetHostname("a.b." + hostname)
+                .expectDns("ERROR", "The DNS SAN is a wildcard, which only stands for a single label, but the name has two in its place.")
+                .dnsReasons("HOSTNAME_MISMATCH")
+                .build());
+        cases.add(TestCase.builder()
+                .dnsSans(wildcard)
+                .ipSans(ip)
+                .expectDns("ERROR", "The DNS SAN is a wildcard, which stands for a label, but the name is the domain under it with no label in its place.")
+                .dnsReasons("HOSTNAME_MISMATCH")
+                .build());
+        cases.add(TestCase.builder()
+                .dnsSans("w*." + hostname)
+                .ipSans(ip)
+                .targetHostname("www." + hostname)
+                .expectDns("ERROR", "The DNS SAN is a wildcard with a prefix in the same label, which RFC 6125 allowed clients to match but RFC 9525 doesn't.")
+                .interpretDns(PARTIAL_WILDCARD_REJECTED, "ERROR", REASON_PARTIAL_WILDCARD_REJECTED)
+                .interpretDns(PARTIAL_WILDCARD_MATCHED, "OK", REASON_PARTIAL_WILDCARD_MATCHED)
+                .dnsReasons("HOSTNAME_MISMATCH")
+                .build());
+        cases.add(TestCase.builder()
+                .dnsSans(wildcard)
+                .ipSans(ip)
+                .permittedDns(hostSubtree)
+                .targetHostname("www." + hostname)
+                .expectDns("OK", "The DNS SAN is a wildcard within the permitted DNS subtree, and the name matches it.")
+                .expectIp("OK", "The leaf's DNS SAN is a wildcard within the permitted DNS subtree.")
+                .build());
+
+        return cases;
+    }
+
+    /**
+     * Returns an IP subtree given as the octets of the iPAddress name, for subtrees that CIDR notation can't express,
+     * such as ones of the wrong length. See CertificateGenerator.makeSubtrees.
+     */
+    private static String rawIpSubtree(byte[]... parts) {
+        StringBuilder hex = new StringBuilder("#");
+        for (byte[] part : parts) {
+            hex.append(Hex.toHexString(part));
+        }
+        return hex.toString();
+    }
+
+    private static byte[] ipv4Octets(String ip) {
+        String[] parts = ip.split("\\.");
+        byte[] octets = new byte[parts.length];
+        for (int i = 0; i < parts.length; i++) {
+            octets[i] = (byte) Integer.parseInt(parts[i]);
+        }
+        return octets;
+    }
+
+    private static byte[] ones(int length) {
+        byte[] bytes = new byte[length];
+        Arrays.fill(bytes, (byte) 0xff);
+        return bytes;
+    }
+
+    /**
+     * Returns name with every other letter in uppercase, e.g. "BaD.eXaMpLe.CoM".
+     */
+    private static String mixedCase(String name) {
+        StringBuilder mixed = new StringBuilder(name.length());
+        boolean upper = true;
+        for (char c : name.toCharArray()) {
+            if (Character.isLetter(c)) {
+                mixed.append(upper ? Character.toUpperCase(c) : c);
+                upper = !upper;
+            } else {
+                mixed.append(c);
+            }
+        }
+        return mixed.toString();
+    }
+
+    /**
+     * Completes a case whose leaf satisfies the constraints but whose intermediate has a name that violates them.
+     */
+    private static TestCase intermediateViolates(TestCase.Builder builder, String description) {
+        return builder
+                .expectDns("ERROR", description + " Name constraints apply to every certificate after the one that imposes them, including CAs.")
+                .interpretDns(INTERMEDIATE_NAMES_CHECKED, "ERROR", REASON_INTERMEDIATE_NAME_VIOLATES)
+                .interpretDns(LEAF_NAMES_ONLY, "OK", REASON_LEAF_NAMES_PERMITTED)
+                .expectIp("ERROR", description + " Name constraints apply to every certificate after the one that imposes them, including CAs.")
+                .interpretIp(INTERMEDIATE_NAMES_CHECKED, "ERROR", REASON_INTERMEDIATE_NAME_VIOLATES)
+                .interpretIp(LEAF_NAMES_ONLY, "OK", REASON_LEAF_NAMES_PERMITTED)
+                .expectClientAuth("ERROR", description + " Name constraints apply to every certificate after the one that imposes them, including CAs.")
+                .dnsReasons("NAME_CONSTRAINT_VIOLATION")
+                .ipReasons("NAME_CONSTRAINT_VIOLATION")
+                .build();
+    }
+
+    /**
+     * Completes a case whose leaf has both the names under test and another name that violates the constraints.
+     */
+    private static TestCase mixedSans(TestCase.Builder builder, String description) {
+        return builder
+                .expectDns("ERROR", description + " Name constraints apply to every name in the certificate.")
+                .interpretDns(ANY_NAME_VIOLATES, "ERROR", REASON_ANY_NAME_VIOLATES)
+                .interpretDns(QUERIED_NAME_ONLY, "OK", REASON_QUERIED_NAME_PERMITTED)
+                .expectIp("ERROR", description + " Name constraints apply to every name in the certificate.")
+                .interpretIp(ANY_NAME_VIOLATES, "ERROR", REASON_ANY_NAME_VIOLATES)
+                .interpretIp(QUERIED_NAME_ONLY, "OK", REASON_QUERIED_NAME_PERMITTED)
+                .build();
+    }
+}
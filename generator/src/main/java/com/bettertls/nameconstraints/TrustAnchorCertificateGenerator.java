@@ -0,0 +1,246 @@
+/**
+ *
+ *  Copyright 2017 Netflix, Inc.
+ *
+ *     Licensed under the Apache License, Version 2.0 (the "License");
+ *     you may not use this file except in compliance with the License.
+ *     You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *     Unless required by applicable law or agreed to in writing, software
+ *     distributed under the License is distributed on an "AS IS" BASIS,
+ *     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *     See the License for the specific language governing permissions and
+ *     limitations under the License.
+ *
+ */
+
+package com.bettertls.nameconstraints;
+
+import org.bouncycastle.asn1.x509.ExtendedKeyUsage;
+import org.bouncycastle.asn1.x509.Extension;
+import org.bouncycastle.asn1.x509.GeneralName;
+import org.bouncycastle.asn1.x509.GeneralNames;
+import org.bouncycastle.asn1.x509.GeneralSubtree;
+import org.bouncycastle.asn1.x509.KeyPurposeId;
+import org.bouncycastle.asn1.x509.NameConstraints;
+import org.bouncycastle.openssl.jcajce.JcaPEMWriter;
+import org.json.JSONArray;
+import org.json.JSONObject;
+
+import java.io.OutputStream;
+import java.io.OutputStreamWriter;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.security.KeyStore;
+import java.util.Calendar;
+import java.util.Date;
+
+/**
+ * Generates chains whose root itself carries name constraints or extended key usages, or is outside its validity
+ * period. RFC 5280 treats the trust anchor as a name and key only, but RFC 5937 describes verifiers that apply the
+ * constraints of a trust anchor certificate to the paths that it anchors, and verifiers differ in which of these
+ * fields they apply. Each test has its own root, in {@code <id>.root}, and the manifest gives the expected result both
+ * for verifiers that apply the root's fields and for those that ignore them. These are only generated when running
+ * this class directly, e.g. with {@code gradle runTrustAnchorGenerator}.
+ */
+public class TrustAnchorCertificateGenerator {
+
+    public static void main(String[] args) throws Exception {
+
+        final JSONObject config = new JSONObject(new String(Files.readAllBytes(Paths.get("../config.json")), StandardCharsets.UTF_8));
+        final Path outputDir = Paths.get("../certificates/trustanchor");
+        Files.createDirectories(outputDir);
+
+        new TrustAnchorCertificateGenerator(config, outputDir, GeneratorOptions.fromArgs(args)).generateCertificates();
+    }
+
+    private final Path outputDir;
+    private final GeneratorOptions options;
+    private final String hostname;
+    private final String hostSubtree;
+    private final String invalidHostSubtree;
+
+    private final JSONArray trustAnchorManifest = new JSONArray();
+    private int nextCertId = 1;
+
+    private TrustAnchorCertificateGenerator(JSONObject config, Path outputDir, GeneratorOptions options) {
+        this.outputDir = outputDir;
+        this.options = options;
+        this.hostname = config.getString("hostname");
+        this.hostSubtree = config.getString("hostSubtree");
+        this.invalidHostSubtree = config.getString("invalidHostSubtree");
+    }
+
+    private void generateCertificates() throws Exception {
+
+        Date notBefore = options.getNotBefore();
+
+        writeCase("plainRoot", "OK", "OK",
+                "The root carries no constraints and is valid.",
+                new Root());
+        writeCase("rootPermitsHost", "OK", "OK",
+                "The root's name constraints permit " + hostSubtree + ", which includes the leaf's name.",
+                new Root().permitted(hostSubtree));
+        writeCase("rootPermitsOtherSubtree", "ERROR", "OK",
+                "The root's name constraints only permit " + invalidHostSubtree + ", which doesn't include the leaf's name.",
+                new Root().permitted(invalidHostSubtree));
+        writeCase("rootExcludesHost", "ERROR", "OK",
+                "The root's name constraints exclude " + hostSubtree + ", which includes the leaf's name.",
+                new Root().excluded(hostSubtree));
+        writeCase("rootServerAuth", "OK", "OK",
+                "The root's extended key usage is serverAuth.",
+                new Root().keyPurposes(KeyPurposeId.id_kp_serverAuth));
+        writeCase("rootClientAuthOnly", "ERROR", "OK",
+                "The root's extended key usage is clientAuth only, which doesn't allow server authentication.",
+                new Root().keyPurposes(KeyPurposeId.id_kp_clientAuth));
+        writeCase("rootExpired", "ERROR", "OK",
+                "The root expired the day before the intermediate and leaf became valid.",
+                new Root().validity(addDays(notBefore, -366), addDays(notBefore, -1)));
+        writeCase("rootNotYetValid", "ERROR", "OK",
+                "The root only becomes valid ten years after the intermediate and leaf do.",
+                new Root().validity(addDays(notBefore, 3650), addDays(notBefore, 4015)));
+
+        final JSONObject manifest = new JSONObject();
+        manifest.put("trustAnchorManifest", trustAnchorManifest);
+        Files.write(outputDir.resolve("manifest.json"), manifest.toString().getBytes(StandardCharsets.UTF_8));
+    }
+
+    private static Date addDays(Date date, int days) {
+        Calendar cal = Calendar.getInstance();
+        cal.setTime(date);
+        cal.add(Calendar.DATE, days);
+        return cal.getTime();
+    }
+
+    /**
+     * Writes the root to {@code <id>.root}, the leaf's key to {@code <id>.key}, the leaf to {@code <id>.crt} and the
+     * intermediate to {@code <id>.chain}. The intermediate and leaf have their own validity period, so that an
+     * expired root doesn't cut theirs short.
+     */
+    private void writeCase(String name, String appliedExpect, String ignoredExpect, String description, Root root) throws Exception {
+        System.out.println("Generating trust anchor test " + nextCertId + "...");
+
+        Date notBefore = options.getNotBefore();
+        Calendar cal = Calendar.getInstance();
+        cal.setTime(notBefore);
+        cal.add(Calendar.MONTH, 12);
+        Date notAfter = cal.getTime();
+
+        KeyStore rootCa = root.build();
+        KeyStore intermediate = new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(rootCa))
+                .setCommonName("Trust Anchor Test Intermediate CA")
+                .setIsCa(true)
+                .setValidity(notBefore, notAfter)
+                .build();
+        KeyStore leaf = new KeyStoreGenerator(options)
+                .setCaKeyEntry(CertificateGenerator.getSignerPrivateKey(intermediate))
+                .setIsCa(false)
+                .setCommonName(hostname)
+                .setSubjectAlternateNames(new GeneralNames(new GeneralName(GeneralName.dNSName, hostname)))
+                .setValidity(notBefore, notAfter)
+                .build();
+
+        CertificateGenerator.writeCertificate(rootCa.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve(nextCertId + ".root"));
+        try (OutputStream stream = Files.newOutputStream(outputDir.resolve(nextCertId + ".key"));
+             OutputStreamWriter writer = new OutputStreamWriter(stream);
+             JcaPEMWriter pemWriter = new JcaPEMWriter(writer)) {
+            pemWriter.writeObject(CertificateGenerator.getSignerPrivateKey(leaf).getPrivateKey());
+        }
+        CertificateGenerator.writeCertificate(leaf.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve(nextCertId + ".crt"));
+        CertificateGenerator.writeCertificate(intermediate.getCertificate(KeyStoreGenerator.DEFAULT_ALIAS), outputDir.resolve(nextCertId + ".chain"));
+
+        trustAnchorManifest.put(new JSONObject()
+                .put("id", nextCertId)
+                .put("name", name)
+                .put("property", root.property())
+                .put("rootProperties", root.properties)
+                .put("appliedExpect", appliedExpect)
+                .put("ignoredExpect", ignoredExpect)
+                .put("description", description)
+        );
+
+        nextCertId += 1;
+    }
+
+    /**
+     * The fields of a test's root. Each one set is also noted in {@code properties}, which the manifest records
+     * alongside the results.
+     */
+    private class Root {
+        private final JSONObject properties = new JSONObject();
+        private GeneralSubtree[] permitted;
+        private GeneralSubtree[] excluded;
+        private KeyPurposeId[] keyPurposes;
+        private Date notBefore;
+        private Date notAfter;
+
+        Root permitted(String dnsSubtree) {
+            this.permitted = new GeneralSubtree[]{new GeneralSubtree(new GeneralName(GeneralName.dNSName, dnsSubtree))};
+            properties.put("permittedDns", dnsSubtree);
+            return this;
+        }
+
+        Root excluded(String dnsSubtree) {
+            this.excluded = new GeneralSubtree[]{new GeneralSubtree(new GeneralName(GeneralName.dNSName, dnsSubtree))};
+            properties.put("excludedDns", dnsSubtree);
+            return this;
+        }
+
+        Root keyPurposes(KeyPurposeId... keyPurposes) {
+            this.keyPurposes = keyPurposes;
+            JSONArray purposes = new JSONArray();
+            for (KeyPurposeId keyPurpose : keyPurposes) {
+                purposes.put(keyPurpose.getId());
+            }
+            properties.put("extendedKeyUsage", purposes);
+            return this;
+        }
+
+        Root validity(Date notBefore, Date notAfter) {
+            this.notBefore = notBefore;
+            this.notAfter = notAfter;
+            properties.put("notBefore", notBefore.toInstant().toString());
+            properties.put("notAfter", notAfter.toInstant().toString());
+            return this;
+        }
+
+        /**
+         * Returns the kind of field that the root carries, by which results are summarized: "nameConstraints",
+         * "extendedKeyUsage", "validity" or, for a plain root, "none".
+         */
+        String property() {
+            if (permitted != null || excluded != null) {
+                return "nameConstraints";
+            }
+            if (keyPurposes != null) {
+                return "extendedKeyUsage";
+            }
+            if (notBefore != null) {
+                return "validity";
+            }
+            return "none";
+        }
+
+        KeyStore build() throws Exception {
+            KeyStoreGenerator generator = new KeyStoreGenerator(options)
+                    .setCaKeyEntry(null)
+                    .setCommonName("Trust Anchor Test Root CA")
+                    .setIsCa(true);
+            if (permitted != null || excluded != null) {
+                generator.setNameConstraints(new NameConstraints(permitted, excluded));
+            }
+            if (keyPurposes != null) {
+                generator.addExtension(Extension.extendedKeyUsage, false, new ExtendedKeyUsage(keyPurposes));
+            }
+            if (notBefore != null) {
+                generator.setValidity(notBefore, notAfter);
+            }
+            return generator.build();
+        }
+    }
+}
@@ -27,8 +27,20 @@ function formatDescriptions(data) {
   return desc;
 }
 
+// Returns the host that a test is verified against for the given type, 'DNS' or 'IP': the test's own target, if it has
+// one, or else the one in config.json.
+function testHost(t, type) {
+  var target = t.target || {};
+  if (type == 'IP') {
+    var ip = target.ip || sessionData.config.ip;
+    // IPv6 addresses are bracketed in URLs.
+    return ip.indexOf(':') != -1 ? '[' + ip + ']' : ip;
+  }
+  return target.hostname || sessionData.config.hostname;
+}
+
 function linkRenderer(data, type, row, meta) {
-  var host = (row.type == 'IP' ? sessionData.config.ip : sessionData.config.hostname);
+  var host = testHost(sessionData.testMap[row.id], row.type);
   return "<a href=\"https://" + host + ":" + (sessionData.config.basePort + row.id) + "/well-known.txt\">" + data + "</a>";
 }
 
@@ -41,7 +53,8 @@ function browserTest() {
     if (t.commonName == config.hostname
         && t.sans.length == 2 && t.sans.indexOf(config.hostname) != -1 && t.sans.indexOf(config.ip) != -1
         && t.nameConstraints.whitelist.length == 0
-        && t.nameConstraints.blacklist.length == 0) {
+        && t.nameConstraints.blacklist.length == 0
+        && t.target == null) {
       testId = sessionData.testMap[id].id;
       break;
     }
@@ -72,7 +85,7 @@ function runBrowserTest() {
 
   renderLiveTestResults(displayDiv, testResults, function(testId, type) {
     var myPromise = $.Deferred();
-    var host = (type == 'DNS' ? sessionData.config.hostname : sessionData.config.ip);
+    var host = testHost(sessionData.testMap[testId], type);
     var targetUrl = 'https://' + host + ':' + (sessionData.config.basePort+testId) + '/well-known.txt';
 
     $.get(targetUrl).then(
@@ -0,0 +1,348 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bettertls runs the main BetterTLS corpus as Go subtests, so that a
+// project's own "go test" checks its certificate verifier against every test,
+// with -run filtering, -v output and its CI's usual reporting.
+//
+// A test function hands its verifier to RunAsSubtests:
+//
+//	func TestBetterTLS(t *testing.T) {
+//		bettertls.RunAsSubtests(t, bettertls.VerifierFunc(myVerify))
+//	}
+//
+// and BETTERTLS_DIR names a checkout of BetterTLS with a generated corpus and
+// expectations. Each test of the corpus is a subtest named by its ID, with a
+// subtest for each of the DNS name and the IP address, so
+// "go test -run 'TestBetterTLS/12/DNS'" verifies a single certificate.
+//
+// SelfTest instead verifies a mini-corpus embedded in the package, so that a
+// verifier's integration can be checked without a checkout or a generated
+// corpus.
+package bettertls
+
+import (
+	"crypto/x509"
+	"embed"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// DirEnv is the environment variable naming the BetterTLS checkout whose
+// corpus RunAsSubtests runs.
+const DirEnv = "BETTERTLS_DIR"
+
+// Verifier is a certificate verifier under test.
+type Verifier interface {
+	// Verify returns nil if leaf chains, through intermediates, to a
+	// certificate in roots and is valid for name, which is either a DNS
+	// name or an IP address.
+	Verify(leaf *x509.Certificate, intermediates []*x509.Certificate, roots *x509.CertPool, name string) error
+}
+
+// VerifierFunc adapts a function to a Verifier.
+type VerifierFunc func(leaf *x509.Certificate, intermediates []*x509.Certificate, roots *x509.CertPool, name string) error
+
+// Verify calls f.
+func (f VerifierFunc) Verify(leaf *x509.Certificate, intermediates []*x509.Certificate, roots *x509.CertPool, name string) error {
+	return f(leaf, intermediates, roots, name)
+}
+
+// CryptoX509 verifies with crypto/x509, as the BetterTLS harness does. It's
+// useful as a baseline, or to wrap.
+var CryptoX509 Verifier = VerifierFunc(func(leaf *x509.Certificate, intermediates []*x509.Certificate, roots *x509.CertPool, name string) error {
+	pool := x509.NewCertPool()
+	for _, intermediate := range intermediates {
+		pool.AddCert(intermediate)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: pool, DNSName: name})
+	return err
+})
+
+// config is the part of config.json that names what the corpus was generated
+// for.
+type config struct {
+	IP               string `json:"ip"`
+	Hostname         string `json:"hostname"`
+	PerTestHostnames bool   `json:"perTestHostnames"`
+}
+
+// testHostname returns the DNS name that test is verified against: its
+// target's, if it has one, or else Hostname. With PerTestHostnames set, the
+// name is moved under test-N.Hostname, as the generator moved it in the leaf.
+func (c *config) testHostname(test *expectation) string {
+	name := c.Hostname
+	if test.Target != nil && len(test.Target.Hostname) > 0 {
+		name = test.Target.Hostname
+	}
+	if !c.PerTestHostnames {
+		return name
+	}
+
+	perTest := "test-" + strconv.Itoa(test.Id) + "." + c.Hostname
+	switch {
+	case name == c.Hostname:
+		return perTest
+	case strings.HasSuffix(name, "."+c.Hostname):
+		return strings.TrimSuffix(name, c.Hostname) + perTest
+	}
+	return name
+}
+
+// testIP returns the IP that test is verified against: its target's, if it
+// has one, or else IP.
+func (c *config) testIP(test *expectation) string {
+	if test.Target != nil && len(test.Target.IP) > 0 {
+		return test.Target.IP
+	}
+	return c.IP
+}
+
+// suiteVersion is the version of the expects.json format that RunAsSubtests
+// understands. Version five added per-test targets, without which the
+// wildcard tests would be verified against the wrong names.
+const suiteVersion = 5
+
+// expectations is the part of html/expects.json, written by defineExpects.js,
+// that RunAsSubtests grades by.
+type expectations struct {
+	SuiteVersion int           `json:"suiteVersion"`
+	Expects      []expectation `json:"expects"`
+}
+
+type expectation struct {
+	Id  int    `json:"id"`
+	IP  result `json:"ip"`
+	DNS result `json:"dns"`
+	// Target is the hostname and IP that the test is verified against, if
+	// they aren't the ones in config.json.
+	Target *verificationTarget `json:"target"`
+}
+
+// verificationTarget is a test's own hostname and IP. Either may be empty,
+// leaving the configured one.
+type verificationTarget struct {
+	Hostname string `json:"hostname"`
+	IP       string `json:"ip"`
+}
+
+type result struct {
+	// Expect is "OK", "ERROR" or "WEAK-OK", which is met by either.
+	Expect       string   `json:"expect"`
+	Descriptions []string `json:"descriptions"`
+}
+
+// corpus is a corpus and its expectations, read from a checkout's layout.
+type corpus struct {
+	fsys    fs.FS
+	cfg     *config
+	expects *expectations
+	roots   *x509.CertPool
+}
+
+// loadCorpus reads config.json, html/expects.json and the root certificate
+// from fsys, which is laid out as a BetterTLS checkout.
+func loadCorpus(fsys fs.FS) (*corpus, error) {
+	c := &corpus{fsys: fsys, cfg: new(config), expects: new(expectations)}
+	if err := readJSON(fsys, "config.json", c.cfg); err != nil {
+		return nil, err
+	}
+	if err := readJSON(fsys, "html/expects.json", c.expects); err != nil {
+		return nil, err
+	}
+	if c.expects.SuiteVersion != suiteVersion {
+		return nil, fmt.Errorf("expects.json is suite version %d but this package only understands version %d; rerun defineExpects.js", c.expects.SuiteVersion, suiteVersion)
+	}
+
+	root, err := readCertificates(fsys, "certificates/root.crt")
+	if err != nil {
+		return nil, err
+	}
+	if len(root) != 1 {
+		return nil, fmt.Errorf("expected a single root in root.crt but found %d", len(root))
+	}
+	c.roots = x509.NewCertPool()
+	c.roots.AddCert(root[0])
+	return c, nil
+}
+
+// chain returns the leaf and the rest of the chain of test id.
+func (c *corpus) chain(id int) (*x509.Certificate, []*x509.Certificate, error) {
+	pathPrefix := "certificates/" + strconv.Itoa(id)
+	leaf, err := readCertificates(c.fsys, pathPrefix+".crt")
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(leaf) != 1 {
+		return nil, nil, fmt.Errorf("expected a single certificate in the .crt file, but found %d", len(leaf))
+	}
+	chain, err := readCertificates(c.fsys, pathPrefix+".chain")
+	if err != nil {
+		return nil, nil, err
+	}
+	return leaf[0], chain, nil
+}
+
+// RunAsSubtests verifies each test of the corpus in the checkout named by
+// BETTERTLS_DIR with verifier, as subtests of t, and fails each subtest whose
+// result doesn't meet its expectation. t is skipped if BETTERTLS_DIR isn't
+// set.
+func RunAsSubtests(t *testing.T, verifier Verifier) {
+	dir := os.Getenv(DirEnv)
+	if len(dir) == 0 {
+		t.Skip(DirEnv + " isn't set to a BetterTLS checkout")
+	}
+
+	c, err := loadCorpus(os.DirFS(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range c.expects.Expects {
+		test := &c.expects.Expects[i]
+		t.Run(strconv.Itoa(test.Id), func(t *testing.T) {
+			leaf, chain, err := c.chain(test.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			t.Run("DNS", func(t *testing.T) {
+				check(t, test.DNS, verifier.Verify(leaf, chain, c.roots, c.cfg.testHostname(test)))
+			})
+			t.Run("IP", func(t *testing.T) {
+				check(t, test.IP, verifier.Verify(leaf, chain, c.roots, c.cfg.testIP(test)))
+			})
+		})
+	}
+}
+
+// selfTestFiles is the mini-corpus that SelfTest runs, laid out as a
+// checkout. The self-test command of the harness regenerates it with
+// "self-test -generate".
+//
+//go:embed testdata/selftest
+var selfTestFiles embed.FS
+
+// SelfTest verifies each test of a mini-corpus of a few dozen name
+// constraints tests, embedded in the package, with verifier, and returns an
+// error listing every result that doesn't meet its expectation. It needs no
+// checkout and takes well under a second, so it checks that a verifier is
+// wired up correctly before committing to a run of the main corpus.
+func SelfTest(verifier Verifier) error {
+	fsys, err := fs.Sub(selfTestFiles, "testdata/selftest")
+	if err != nil {
+		return err
+	}
+	c, err := loadCorpus(fsys)
+	if err != nil {
+		return err
+	}
+
+	var failures []string
+	for i := range c.expects.Expects {
+		test := &c.expects.Expects[i]
+		leaf, chain, err := c.chain(test.Id)
+		if err != nil {
+			return fmt.Errorf("#%d: %s", test.Id, err)
+		}
+
+		if err := grade(test.DNS, verifier.Verify(leaf, chain, c.roots, c.cfg.testHostname(test))); err != nil {
+			failures = append(failures, fmt.Sprintf("#%d (DNS): %s", test.Id, err))
+		}
+		if err := grade(test.IP, verifier.Verify(leaf, chain, c.roots, c.cfg.testIP(test))); err != nil {
+			failures = append(failures, fmt.Sprintf("#%d (IP): %s", test.Id, err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("self-test failed %d of %d verifications:\n%s", len(failures), 2*len(c.expects.Expects), strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// check fails t if err doesn't meet expect.
+func check(t *testing.T, expect result, err error) {
+	t.Helper()
+
+	if expect.Expect == "WEAK-OK" {
+		t.Logf("either result is acceptable; got %v", err)
+		return
+	}
+	if err := grade(expect, err); err != nil {
+		t.Error(err)
+	}
+}
+
+// grade returns an error describing how verifyErr, the result of a
+// verification, doesn't meet expect, or nil if it does.
+func grade(expect result, verifyErr error) error {
+	switch expect.Expect {
+	case "OK":
+		if verifyErr != nil {
+			return fmt.Errorf("rejected, but expected to be accepted: %v", verifyErr)
+		}
+	case "ERROR":
+		if verifyErr == nil {
+			return fmt.Errorf("accepted, but expected to be rejected: %q", expect.Descriptions)
+		}
+	case "WEAK-OK":
+	default:
+		return fmt.Errorf("unknown expected result %q", expect.Expect)
+	}
+	return nil
+}
+
+func readJSON(fsys fs.FS, path string, v interface{}) error {
+	contents, err := fs.ReadFile(fsys, path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(contents, v); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// readCertificates returns the certificates in the PEM file at path in fsys.
+func readCertificates(fsys fs.FS, path string) (certs []*x509.Certificate, err error) {
+	pemBytes, err := fs.ReadFile(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		block, rest := pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		pemBytes = rest
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
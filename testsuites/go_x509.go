@@ -22,6 +22,7 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -29,29 +30,146 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 )
 
 // baseDir is the path to the top of the bettertls repo.
 const baseDir = ".."
 
+// certificatesDir is the directory of the main corpus. The self-test command
+// points it at its own corpus.
+var certificatesDir = filepath.Join(baseDir, "certificates")
+
+// The ways in which intermediates can be delivered to the verifier, which are
+// recorded in results files.
+const (
+	deliveryPool         = "pool"
+	deliveryPreinstalled = "preinstalled"
+	deliveryAIA          = "aia"
+	// deliveryPresented gives the verifier the DER of each test's leaf and
+	// chain in the order that they're in the corpus, as a TLS client
+	// receives them, rather than as a pool.
+	deliveryPresented = "presented"
+)
+
+// limits guard against corpora that are malformed or hostile. They can be
+// changed with flags to the run command.
+var limits = struct {
+	// maxFileSize is the largest corpus file, in bytes, that will be read.
+	maxFileSize int64
+	// maxChainLength is the largest number of certificates that will be
+	// accepted in a test's chain.
+	maxChainLength int
+	// timeout bounds the time spent parsing and verifying a single test.
+	timeout time.Duration
+}{
+	maxFileSize:    1 << 20,
+	maxChainLength: 16,
+	timeout:        10 * time.Second,
+}
+
+// benchIterations is the number of times each verification is repeated. The
+// time recorded for it is the mean.
+var benchIterations = 1
+
+// presentChains is set by -intermediates=presented, to verify each test's
+// chain as presented. See deliveryPresented.
+var presentChains bool
+
 // configFile represents config.json in the top-level of the repo.
 type configFile struct {
-	IP       string `json:"ip"`
-	Hostname string `json:"hostname"`
+	TestVersion int    `json:"testVersion"`
+	IP          string `json:"ip"`
+	Hostname    string `json:"hostname"`
+	// BasePort is the port that the test servers number their ports
+	// from, with test N on BasePort+N.
+	BasePort int `json:"basePort"`
+	// PerTestHostnames is set when the corpus was generated with a
+	// hostname for each test, test-N.Hostname, in place of Hostname.
+	PerTestHostnames bool `json:"perTestHostnames"`
+}
+
+// verificationTarget is the hostname and IP that a test is verified against
+// in place of the ones in config.json, for tests such as wildcard matching
+// that need names of their own. Either may be empty, leaving the configured
+// one.
+type verificationTarget struct {
+	Hostname string `json:"hostname,omitempty"`
+	IP       string `json:"ip,omitempty"`
 }
 
+// testHostname returns the DNS name that test is verified against: its
+// target's, if it has one, or else Hostname. With PerTestHostnames set, the
+// name is moved under test-N.Hostname, as the generator moved it in the leaf.
+func (c *configFile) testHostname(test *expectation) string {
+	name := c.Hostname
+	if test.Target != nil && len(test.Target.Hostname) > 0 {
+		name = test.Target.Hostname
+	}
+	if !c.PerTestHostnames {
+		return name
+	}
+
+	perTest := "test-" + strconv.Itoa(test.Id) + "." + c.Hostname
+	switch {
+	case name == c.Hostname:
+		return perTest
+	case strings.HasSuffix(name, "."+c.Hostname):
+		return strings.TrimSuffix(name, c.Hostname) + perTest
+	}
+	return name
+}
+
+// testIP returns the IP that test is verified against: its target's, if it
+// has one, or else IP.
+func (c *configFile) testIP(test *expectation) string {
+	if test.Target != nil && len(test.Target.IP) > 0 {
+		return test.Target.IP
+	}
+	return c.IP
+}
+
+// suiteVersion is the newest version of the expects.json format that this
+// harness understands. See defineExpects.js for the history.
+const suiteVersion = 5
+
 // expectations represents expects.json, which is generated by
 // defineExpects.js.
 type expectations struct {
-	Expects []expectation
+	// SuiteVersion is missing, and thus zero, in version one.
+	SuiteVersion int `json:"suiteVersion"`
+	Expects      []expectation
 }
 
 type expectation struct {
-	Id           int            `json:"id"`
-	IP           expectedResult `json:"ip"`
-	DNS          expectedResult `json:"dns"`
-	Descriptions []string       `json:"descriptions"`
+	Id int `json:"id"`
+	// StableId is derived from the test's definition, so that it survives
+	// the corpus being regenerated with tests added or removed. It's
+	// missing for corpora generated before stable IDs were added.
+	StableId string         `json:"stableId,omitempty"`
+	IP       expectedResult `json:"ip"`
+	DNS      expectedResult `json:"dns"`
+	// ClientAuth is the expected result of verifying the leaf as a TLS
+	// client certificate. It's missing before suite version three.
+	ClientAuth   *expectedResult `json:"clientAuth,omitempty"`
+	Descriptions []string        `json:"descriptions"`
+	Features     features        `json:"features"`
+	// Profiles maps the name of each verifier policy profile to the
+	// definite results expected under it. It's missing for corpora
+	// generated before profiles were added.
+	Profiles map[string]profileResults `json:"profiles,omitempty"`
+	// Dimensions is the generator's description of the test as a vector
+	// of dimensions, e.g. "sanTypes": "dns+ip", which reports pivot on.
+	// It's missing for corpora generated before dimensions were added.
+	Dimensions map[string]string `json:"dimensions,omitempty"`
+	// Clauses cites the sections of the RFCs that the test exercises, e.g.
+	// "RFC 5280, section 4.2.1.10 (Name Constraints)". It's missing for
+	// corpora generated before clauses were added; see clauses.
+	Clauses []string `json:"clauses,omitempty"`
+	// Target is the hostname and IP that the test is verified against, if
+	// they aren't the ones in config.json. It's missing before suite
+	// version five.
+	Target *verificationTarget `json:"target,omitempty"`
 
 	// testDNS is not part of expects.json but, here, indicates whether the
 	// IP or DNS behaviour should be tested.
@@ -74,14 +192,228 @@ func (e *expectation) descriptions() []string {
 	return ret
 }
 
+// testType returns "DNS" or "IP", for the name that the expectation is being
+// tested against.
+func (e *expectation) testType() string {
+	if e.testDNS {
+		return "DNS"
+	}
+	return "IP"
+}
+
+// profileResults holds the results, "OK" or "ERROR", expected under a
+// verifier policy profile. See defineExpects.js for the profiles.
+type profileResults struct {
+	DNS string `json:"dns"`
+	IP  string `json:"ip"`
+}
+
+// features is the machine-readable description of a test certificate. It
+// carries the same information as the descriptions, but in a form that can be
+// evaluated without matching on prose.
+type features struct {
+	SANPresent           bool   `json:"sanPresent"`
+	DNSInCN              bool   `json:"dnsInCn"`
+	IPInCN               bool   `json:"ipInCn"`
+	DNSInSAN             bool   `json:"dnsInSan"`
+	IPInSAN              bool   `json:"ipInSan"`
+	DNSNamePresent       bool   `json:"dnsNamePresent"`
+	IPNamePresent        bool   `json:"ipNamePresent"`
+	DNSCNViolation       bool   `json:"dnsCnViolation"`
+	IPCNViolation        bool   `json:"ipCnViolation"`
+	DNSSANViolation      bool   `json:"dnsSanViolation"`
+	IPSANViolation       bool   `json:"ipSanViolation"`
+	DNSConstraintPresent bool   `json:"dnsConstraintPresent"`
+	IPConstraintPresent  bool   `json:"ipConstraintPresent"`
+	ConstraintType       string `json:"constraintType"`
+}
+
+// dnsWeakOK evaluates a "WEAK-OK" expectation for DNS verification and returns
+// whether Go should reject the certificate. It returns an error if none of the
+// features explain why the expectation was weakened.
+func (f *features) dnsWeakOK() (shouldFail bool, err error) {
+	// The DNS name only appears in the common name even though there
+	// are SANs. Go never falls back to the common name in that case.
+	cnWithSANs := f.DNSInCN && f.SANPresent && !f.DNSInSAN
+	// A violation in the common name might be ignored because there is
+	// a SAN extension.
+	dnsInCNViolation := f.DNSCNViolation && f.SANPresent
+	// The IP address isn't the name in question, but its violation may
+	// still cause the certificate to be rejected.
+	ipViolation := f.IPCNViolation || f.IPSANViolation
+	// There's an IP name constraint but no IP in the certificate.
+	noIPGiven := f.IPConstraintPresent && !f.IPNamePresent
+
+	if !cnWithSANs && !dnsInCNViolation && !ipViolation && !noIPGiven {
+		return false, errors.New("WEAK-OK without a weakening feature")
+	}
+
+	return cnWithSANs, nil
+}
+
+// ipWeakOK evaluates a "WEAK-OK" expectation for IP verification and returns
+// whether Go should reject the certificate. It returns an error if none of the
+// features explain why the expectation was weakened.
+func (f *features) ipWeakOK() (shouldFail bool, err error) {
+	// The IP address only appears in the common name. Go only matches IP
+	// addresses against IP SANs.
+	ipOnlyInCN := f.IPInCN && !f.IPInSAN
+	// A violation in the common name might be ignored because there is
+	// a SAN extension.
+	ipInCNViolation := f.IPCNViolation && f.SANPresent
+	// The DNS name isn't the name in question, but its violation may
+	// still cause the certificate to be rejected.
+	dnsViolation := f.DNSCNViolation || f.DNSSANViolation
+	// There's a DNS name constraint but no DNS name in the certificate.
+	noDNSGiven := f.DNSConstraintPresent && !f.DNSNamePresent
+
+	if !ipOnlyInCN && !ipInCNViolation && !dnsViolation && !noDNSGiven {
+		return false, errors.New("WEAK-OK without a weakening feature")
+	}
+
+	return ipOnlyInCN, nil
+}
+
 type expectedResult struct {
 	Result       string   `json:"expect"`
 	Descriptions []string `json:"descriptions"`
+	// Interpretations lists the competing readings of the rules for tests
+	// on which verifiers reasonably differ, such as whether a name that
+	// isn't being verified can violate a name constraint.
+	Interpretations []interpretation `json:"interpretations,omitempty"`
+	// Reasons lists the reasons for which a verifier may reject the
+	// certificate when the expected result is "ERROR". Rejecting it for
+	// another reason suggests the verifier would accept the flaw under
+	// test in another context. Any reason is acceptable if it's empty.
+	Reasons []errorReason `json:"reasons,omitempty"`
+	// DerivedFrom, if set, names the reference verifiers that the
+	// expectation was derived from by derive-expects, or is ["curated"] if
+	// it was set by hand with the expects command. A WEAK-OK derived from
+	// them means that they split, rather than that a feature of the test
+	// weakens it. It's missing before suite version four.
+	DerivedFrom []string `json:"derivedFrom,omitempty"`
+}
+
+// reasonAcceptable returns whether rejecting the certificate for reason meets
+// the expectation. Reasons that couldn't be classified are acceptable, since
+// they can't be told apart.
+func (e *expectedResult) reasonAcceptable(reason errorReason) bool {
+	if len(e.Reasons) == 0 || reason == "" || reason == reasonOther {
+		return true
+	}
+	for _, acceptable := range e.Reasons {
+		if reason == acceptable {
+			return true
+		}
+	}
+	return false
+}
+
+// joinReasons formats reasons as an alternation, e.g. "A or B".
+func joinReasons(reasons []errorReason) string {
+	names := make([]string, len(reasons))
+	for i, reason := range reasons {
+		names[i] = string(reason)
+	}
+	return strings.Join(names, " or ")
+}
+
+// interpretation is one reading of the rules and the result, "OK" or "ERROR",
+// that it leads to. Reason is a code for why, e.g. "ANY_NAME_VIOLATES".
+type interpretation struct {
+	Name   string `json:"name"`
+	Result string `json:"expect"`
+	Reason string `json:"reason"`
+}
+
+// interpretationOf returns the first interpretation that a verifier that did,
+// or didn't, accept the certificate follows, or nil if there's none.
+func (e *expectedResult) interpretationOf(accepted bool) *interpretation {
+	want := "ERROR"
+	if accepted {
+		want = "OK"
+	}
+	for i := range e.Interpretations {
+		if e.Interpretations[i].Result == want {
+			return &e.Interpretations[i]
+		}
+	}
+	return nil
 }
 
 // runTests runs all tests and returns nil on success.
-func runTests() error {
-	root, err := loadRoot()
+func runTests(args []string) error {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	resultsPath := flags.String("results", "", "If set, the path to write a results file to")
+	resultsKeyPath := flags.String("results-key", "", resultsKeyUsage)
+	auditLogPath := flags.String("audit-log", "", "If set, the path of an audit log to append a record of this run to")
+	auditKeyPath := flags.String("audit-key", "", "Path to a PEM, PKCS#8 Ed25519 private key used to sign audit log records")
+	hostname := flags.String("hostname", "", "If set, overrides the hostname from config.json")
+	ip := flags.String("ip", "", "If set, overrides the IP address from config.json")
+	flags.Int64Var(&limits.maxFileSize, "max-file-size", limits.maxFileSize, "The largest corpus file, in bytes, that will be read")
+	flags.IntVar(&limits.maxChainLength, "max-chain-length", limits.maxChainLength, "The largest number of certificates accepted in a test's chain")
+	flags.DurationVar(&limits.timeout, "timeout", limits.timeout, "The longest time to spend on a single test")
+	flags.DurationVar(&stressTimeout, "stress-timeout", stressTimeout, "The longest time to spend verifying a single stress test before recording it as TIMEOUT")
+	numWorkers := flags.Int("workers", defaultWorkers, workersUsage)
+	flags.IntVar(&benchIterations, "bench", benchIterations, "Repeat each verification this many times and report timing percentiles and the slowest tests")
+	dryRun := flags.Bool("dry-run", false, "Print the tests that would be run, without running them")
+	dryRunJSON := flags.String("dry-run-json", "", "If set, write the tests that would be run to this path as JSON, without running them")
+	delivery := flags.String("intermediates", deliveryPool, "How intermediates are given to the verifier: \""+deliveryPool+"\", with each test's chain, \""+deliveryPresented+"\", with each test's chain as ordered DER, or \""+deliveryPreinstalled+"\", from a cache of every test's intermediates")
+	implementation := flags.String("implementation", "go", "The verifier to test: \"go\", crypto/x509, \"platform\", the operating system's verifier on Windows and macOS, or \"boringssl\" or \"awslc\", built in with libcrypto.go")
+	capabilitiesFile := flags.String("capabilities", "", "The capabilities file of the verifier, which defaults to the one in the capabilities directory for -implementation")
+	progressInterval := flags.Duration("progress", 10*time.Second, "How often to log progress to stderr, or 0 not to")
+	archivePath := flags.String("corpus-archive", "", corpusArchiveUsage)
+	corpusFormat := flags.String("corpus-format", "pem", corpusFormatUsage)
+	output := flags.String("output", "", outputUsage)
+	dumpFailures := flags.String("dump-failures", "", "If set, a directory to write the certificates, verification options and a reproducing Go program of each failing test to")
+	outputFile := flags.String("output-file", "", "The path to write -output to, which defaults to bettertls-junit.xml or bettertls.tap")
+	profileName := flags.String("profile", "stress", profileUsage)
+	cnPolicyFlag := flags.String("cn-policy", "", cnPolicyUsage)
+	logLevel := flags.String("log-level", "info", logLevelUsage)
+	logFormat := flags.String("log-format", "text", logFormatUsage)
+	flags.Parse(args)
+
+	if err := selectProfile(*profileName); err != nil {
+		return err
+	}
+	if err := selectLogger(*logLevel, *logFormat); err != nil {
+		return err
+	}
+	if err := selectCNPolicy(*cnPolicyFlag); err != nil {
+		return err
+	}
+
+	resultsKey, err := loadResultsKey(*resultsKeyPath)
+	if err != nil {
+		return err
+	}
+	// The audit key is loaded before the run, rather than once it's
+	// finished, so that a bad key doesn't lose the run's record.
+	auditKey, err := loadAuditKey(*auditKeyPath)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := defaultOutputFiles[*output]; len(*output) > 0 && !ok {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+
+	if err := openCorpusArchive(*archivePath); err != nil {
+		return err
+	}
+	reader, err := openCorpusReader(*corpusFormat)
+	if err != nil {
+		return err
+	}
+
+	audit := &auditRecord{
+		Start:    time.Now().UTC(),
+		Args:     args,
+		Verifier: "Go " + runtime.Version(),
+		OS:       runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	root, err := loadRoot(reader)
 	if err != nil {
 		return err
 	}
@@ -96,190 +428,750 @@ func runTests() error {
 		return err
 	}
 
-	var wg sync.WaitGroup
-	numWorkers := runtime.NumCPU() * 2
-	work := make(chan expectation, numWorkers)
-	failures := make(chan expectation, numWorkers)
-	failureCount := make(chan int)
+	manifest, err := loadManifest()
+	if err != nil {
+		return err
+	}
 
-	for i := 0; i < numWorkers; i++ {
-		go worker(failures, work, &wg, config, root)
-		wg.Add(1)
+	if err := manifest.verify(expectations); err != nil {
+		return err
+	}
+	if manifest.PerTestHostnames != config.PerTestHostnames {
+		return fmt.Errorf("perTestHostnames is %v in config.json but the corpus was generated with it %v", config.PerTestHostnames, manifest.PerTestHostnames)
 	}
 
-	go failureCounter(failureCount, failures)
+	if len(*hostname) > 0 {
+		config.Hostname = *hostname
+	}
+	if len(*ip) > 0 {
+		config.IP = *ip
+	}
 
-	for _, expectation := range expectations.Expects {
-		// Each test is run twice, once to test verifying against the
-		// DNS name and again to test verifying against the IP address.
-		// (Although Go doesn't support the latter so they're discarded
-		// later.)
-		expectation.testDNS = false
-		work <- expectation
-		expectation.testDNS = true
-		work <- expectation
+	// The names under test must be the ones that the corpus was generated
+	// for, otherwise every test would be checking a name mismatch.
+	for _, name := range []string{config.Hostname, config.IP} {
+		if !manifest.mentions(name) {
+			return fmt.Errorf("%q doesn't appear in any certificate in the corpus, which was generated for different names", name)
+		}
 	}
 
-	close(work)
-	wg.Wait()
-	close(failures)
+	numFiltered, err := profile.filter(expectations)
+	if err != nil {
+		return err
+	}
 
-	numFailures := <-failureCount
-	if numFailures != 0 {
-		return fmt.Errorf("failed %d of %d tests", numFailures, len(expectations.Expects))
+	// Verifiers that can't be given intermediates with each chain are
+	// measured with the intermediates preinstalled, as platform verifiers
+	// with an intermediate cache would have them.
+	var preinstalled *x509.CertPool
+	switch *delivery {
+	case deliveryPool:
+	case deliveryPresented:
+		presentChains = true
+	case deliveryPreinstalled:
+		if preinstalled, err = loadPreinstalledIntermediates(reader, expectations); err != nil {
+			return err
+		}
+	case deliveryAIA:
+		return fmt.Errorf("the main corpus has no caIssuers URLs, so intermediates can't be delivered by AIA; the AIA corpus is always run that way")
+	default:
+		return fmt.Errorf("unknown intermediate delivery %q", *delivery)
 	}
 
-	return nil
-}
+	switch *implementation {
+	case "go":
+	case "platform", "boringssl", "awslc":
+		// Platform verifiers are given each test's chain, since the
+		// preinstalled intermediates are only kept as a CertPool.
+		if preinstalled != nil {
+			return fmt.Errorf("-intermediates=%s isn't supported with -implementation=%s", deliveryPreinstalled, *implementation)
+		}
+		// The platforms' policies can't be changed, and their errors
+		// can't be relied on to tell a mismatched name from other
+		// failures. BoringSSL and AWS-LC are run with the defaults
+		// that libssl uses, as Chrome and AWS's SDKs do.
+		if cnPolicy != nil {
+			return fmt.Errorf("-cn-policy isn't supported with -implementation=%s", *implementation)
+		}
+		if *implementation != "platform" {
+			name := *implementation
+			loadPlatform = func(root *x509.Certificate) (platformVerifier, error) {
+				return loadLibcryptoVerifier(name, root)
+			}
+		}
+		if platform, err = loadPlatform(root); err != nil {
+			return err
+		}
+		defer platform.close()
+		audit.Verifier = platform.name()
+	default:
+		return fmt.Errorf("unknown implementation %q", *implementation)
+	}
+
+	if len(*capabilitiesFile) == 0 {
+		*capabilitiesFile = capabilitiesPath(*implementation)
+	}
+	if verifierCaps, err = loadCapabilities(*capabilitiesFile); err != nil {
+		return err
+	}
+	// The optional corpora are always verified with crypto/x509.
+	goCaps := verifierCaps
+	if *implementation != "go" {
+		if goCaps, err = loadCapabilities(capabilitiesPath("go")); err != nil {
+			return err
+		}
+	}
+
+	if benchIterations < 1 {
+		return fmt.Errorf("-bench must be at least one")
+	}
+
+	if *dryRun || len(*dryRunJSON) > 0 {
+		plan := makeTestPlan(expectations, config, *numWorkers)
+		if len(*dryRunJSON) > 0 {
+			return plan.writeJSON(*dryRunJSON)
+		}
+		plan.print()
+		return nil
+	}
 
-// worker reads tests from work and writes any failures to failures.
-func worker(failures chan<- expectation, work <-chan expectation, wg *sync.WaitGroup, config *configFile, root *x509.Certificate) {
-	defer wg.Done()
+	corpus := loadCorpus(reader, expectations, *numWorkers)
 
-	// These are the description strings that identify why a result is
-	// marked as "WEAK-OK".
-	const (
-		cnWithSANs                = "The DNS name for this certificate exists in the common name but not in the Subject Alternate Names extension even though the extension is specified. Most implementations will fail DNS-hostname validation on this certificate."
-		dnsInCNViolation          = "The DNS name in the common name violates a name constraint. Because there is a SAN extension, this might be ignored."
-		forbiddenIPAddressPresent = "Althought the IP address is not the subject name in question, it's name constraint violation may still cause this certificate to be rejected."
-		ipInCNViolation           = "The IP in the common name violates a name constraint. Because there is a SAN extension, this might be ignored."
-		ipViolation               = "The IP in the SAN extension violates a name constraint."
-		noIPGiven                 = "There is a IP name constraint but no IP in the certificate. This isn't an explicit violation, but some implementations will fail to validate the certificate."
-	)
+	recorder := newResultRecorder(*delivery)
+	recorder.setSigningKey(resultsKey)
+	profile.recordFiltered(recorder, numFiltered)
+	recorder.capabilities = verifierCaps
+	// crypto/x509 has never matched the Common Name since Go 1.17, which
+	// removed GODEBUG=x509ignoreCN=0.
+	recorder.setCNPolicy(cnPolicyName(cnIgnored))
+	if platform != nil {
+		recorder.userAgent = platform.name()
+		recorder.setImplementation(platform.name(), platform.version())
+		// The operating systems' errors aren't in errorTaxonomy, so
+		// they're classified as OTHER.
+		recorder.taxonomy = platformTaxonomy(platform)
+		recorder.setCNPolicy("")
+	}
+
+	var progress *progressReporter
+	if *progressInterval > 0 {
+		progress = newProgressReporter(2*len(expectations.Expects), *progressInterval)
+	}
 
 	rootPool := x509.NewCertPool()
 	rootPool.AddCert(root)
 
-NextTest:
-	for test := range work {
-		if !test.testDNS {
-			// Go doesn't support verifying against an IP address.
-			continue
+	// Each test is run twice, once to test verifying against the DNS name
+	// and again to test verifying against the IP address. (Although Go
+	// doesn't support the latter so they're discarded later.)
+	summary := new(runSummary)
+	onFailure := failureReporter(summary)
+	var dumper *failureDumper
+	if len(*dumpFailures) > 0 {
+		dumper = &failureDumper{dir: *dumpFailures, config: config, corpus: corpus, root: root, delivery: *delivery, verifier: recorder.userAgent}
+		onFailure = dumper.wrap(onFailure)
+	}
+	numFailures := runPipeline(expectations.Expects, *numWorkers, func(test *expectation) bool {
+		return runCorpusTest(test, config, corpus, rootPool, preinstalled, recorder, progress)
+	}, onFailure)
+	progress.finish()
+	if dumper != nil {
+		fmt.Printf("Wrote %d failing tests to %s\n", dumper.numDumped, *dumpFailures)
+	}
+
+	recorder.printSkips()
+	summary.print(expectations, recorder)
+
+	if len(*output) > 0 {
+		if err := writeCIOutput(*output, *outputFile, expectations, summary.failures, recorder); err != nil {
+			return err
 		}
+	}
 
-		chain, err := readPEMChain(filepath.Join(baseDir, "certificates", strconv.Itoa(test.Id)+".chain"))
-		if err != nil {
-			test.err = err
-			failures <- test
-			continue
+	numAIATests, numAIAFailures, err := runAIATests(config.Hostname, goCaps, recorder)
+	if err != nil {
+		return err
+	}
+
+	numMalformedTests, numMalformedFailures, err := runMalformedTests(config.Hostname, recorder)
+	if err != nil {
+		return err
+	}
+
+	numStressTests, numStressFailures, err := runStressTests(config.Hostname, recorder)
+	if err != nil {
+		return err
+	}
+
+	numIPLiteralTests, numIPLiteralFailures, err := runIPLiteralTests(recorder)
+	if err != nil {
+		return err
+	}
+
+	numCTTests, numCTFailures, err := runCTTests(config.Hostname, goCaps, recorder)
+	if err != nil {
+		return err
+	}
+
+	numPolicyTests, numPolicyFailures, err := runPolicyTests(config.Hostname, recorder)
+	if err != nil {
+		return err
+	}
+
+	numSMIMETests, numSMIMEFailures, err := runSMIMETests(recorder)
+	if err != nil {
+		return err
+	}
+
+	numChainOrderTests, numChainOrderFailures, err := runChainOrderTests(config.Hostname, recorder)
+	if err != nil {
+		return err
+	}
+
+	numTrustAnchorTests, numTrustAnchorFailures, err := runTrustAnchorTests(config.Hostname, recorder)
+	if err != nil {
+		return err
+	}
+
+	numCrossSignTests, numCrossSignFailures, err := runCrossSignTests(config.Hostname, recorder)
+	if err != nil {
+		return err
+	}
+
+	numDistrustTests, numDistrustFailures, err := runDistrustTests(config.Hostname, recorder)
+	if err != nil {
+		return err
+	}
+
+	numDepthTests, numDepthFailures, err := runDepthTests(config.Hostname, recorder)
+	if err != nil {
+		return err
+	}
+
+	numSerialCollisionTests, numSerialCollisionFailures, err := runSerialCollisionTests(config.Hostname, recorder)
+	if err != nil {
+		return err
+	}
+
+	numKeyUsageTests, numKeyUsageFailures, err := runKeyUsageTests(config.Hostname, recorder)
+	if err != nil {
+		return err
+	}
+
+	numALPACATests, numALPACAFailures, err := runALPACATests(config.Hostname, recorder)
+	if err != nil {
+		return err
+	}
+
+	numIDNATests, err := runIDNATests(recorder)
+	if err != nil {
+		return err
+	}
+
+	if benchIterations > 1 {
+		recorder.printTiming(10)
+	}
+
+	if len(*resultsPath) > 0 {
+		if err := recorder.write(*resultsPath, config.TestVersion); err != nil {
+			return err
 		}
+	}
 
-		leaf, err := readPEMChain(filepath.Join(baseDir, "certificates", strconv.Itoa(test.Id)+".crt"))
-		if err != nil {
-			test.err = err
-			failures <- test
-			continue
+	numProxyTests, numProxyFailures, err := runProxyTests()
+	if err != nil {
+		return err
+	}
+
+	numPathTests, numPathFailures, err := runPathBuildingTests(config.Hostname)
+	if err != nil {
+		return err
+	}
+
+	numIDNTests, numIDNFailures, err := runIDNTests()
+	if err != nil {
+		return err
+	}
+
+	if len(*auditLogPath) > 0 {
+		audit.End = time.Now().UTC()
+		audit.Suites = map[string]auditCounts{
+			"nameconstraints": {Tests: len(expectations.Expects), Failures: numFailures},
+			"proxy":           {Tests: numProxyTests, Failures: numProxyFailures},
+			"pathbuilding":    {Tests: numPathTests, Failures: numPathFailures},
+			"aia":             {Tests: numAIATests, Failures: numAIAFailures},
+			"malformed":       {Tests: numMalformedTests, Failures: numMalformedFailures},
+			"idn":             {Tests: numIDNTests, Failures: numIDNFailures},
+			"stress":          {Tests: numStressTests, Failures: numStressFailures},
+			"ipliteral":       {Tests: numIPLiteralTests, Failures: numIPLiteralFailures},
+			"ct":              {Tests: numCTTests, Failures: numCTFailures},
+			"policy":          {Tests: numPolicyTests, Failures: numPolicyFailures},
+			"smime":           {Tests: numSMIMETests, Failures: numSMIMEFailures},
+			"chainorder":      {Tests: numChainOrderTests, Failures: numChainOrderFailures},
+			"trustanchor":     {Tests: numTrustAnchorTests, Failures: numTrustAnchorFailures},
+			"crosssign":       {Tests: numCrossSignTests, Failures: numCrossSignFailures},
+			"distrust":        {Tests: numDistrustTests, Failures: numDistrustFailures},
+			"depth":           {Tests: numDepthTests, Failures: numDepthFailures},
+			"serialcollision": {Tests: numSerialCollisionTests, Failures: numSerialCollisionFailures},
+			"keyusage":        {Tests: numKeyUsageTests, Failures: numKeyUsageFailures},
+			"alpaca":          {Tests: numALPACATests, Failures: numALPACAFailures},
+			"idna":            {Tests: numIDNATests},
+		}
+		if err := appendAuditRecord(*auditLogPath, auditKey, audit); err != nil {
+			return err
 		}
+	}
 
-		if len(leaf) != 1 {
-			test.err = fmt.Errorf("expected a single certificate in the .crt file, but found %d", len(leaf))
-			failures <- test
-			continue
+	if numFailures != 0 {
+		return fmt.Errorf("failed %d of %d tests", numFailures, len(expectations.Expects))
+	}
+	if numProxyFailures != 0 {
+		return fmt.Errorf("failed %d proxy certificate tests", numProxyFailures)
+	}
+	if numPathFailures != 0 {
+		return fmt.Errorf("failed %d path building tests", numPathFailures)
+	}
+	if numAIAFailures != 0 {
+		return fmt.Errorf("failed %d AIA tests", numAIAFailures)
+	}
+	if numMalformedFailures != 0 {
+		return fmt.Errorf("failed %d malformed certificate tests", numMalformedFailures)
+	}
+	if numIDNFailures != 0 {
+		return fmt.Errorf("failed %d IDN tests", numIDNFailures)
+	}
+	if numStressFailures != 0 {
+		return fmt.Errorf("failed %d stress tests", numStressFailures)
+	}
+	if numIPLiteralFailures != 0 {
+		return fmt.Errorf("failed %d IP literal tests", numIPLiteralFailures)
+	}
+	if numCTFailures != 0 {
+		return fmt.Errorf("failed %d CT tests", numCTFailures)
+	}
+	if numPolicyFailures != 0 {
+		return fmt.Errorf("failed %d certificate policy tests", numPolicyFailures)
+	}
+	if numSMIMEFailures != 0 {
+		return fmt.Errorf("failed %d S/MIME tests", numSMIMEFailures)
+	}
+	if numChainOrderFailures != 0 {
+		return fmt.Errorf("failed %d chain order tests", numChainOrderFailures)
+	}
+	if numTrustAnchorFailures != 0 {
+		return fmt.Errorf("failed %d trust anchor tests", numTrustAnchorFailures)
+	}
+	if numCrossSignFailures != 0 {
+		return fmt.Errorf("failed %d cross-sign tests", numCrossSignFailures)
+	}
+	if numDistrustFailures != 0 {
+		return fmt.Errorf("failed %d distrust tests", numDistrustFailures)
+	}
+	if numDepthFailures != 0 {
+		return fmt.Errorf("failed %d chain depth tests", numDepthFailures)
+	}
+	if numSerialCollisionFailures != 0 {
+		return fmt.Errorf("failed %d serial collision tests", numSerialCollisionFailures)
+	}
+	if numKeyUsageFailures != 0 {
+		return fmt.Errorf("failed %d key usage tests", numKeyUsageFailures)
+	}
+	if numALPACAFailures != 0 {
+		return fmt.Errorf("failed %d ALPACA tests", numALPACAFailures)
+	}
+
+	println("PASS")
+	return nil
+}
+
+// skipCategory is a broad reason for skipping tests, used to summarise them.
+type skipCategory string
+
+const (
+	// skipUnsupportedNameType is for tests of a name type that the
+	// verifier can't check.
+	skipUnsupportedNameType skipCategory = "unsupported name type"
+	// skipCapabilityMissing is for tests of a feature that the verifier
+	// lacks.
+	skipCapabilityMissing skipCategory = "capability missing"
+	// skipFilteredOut is for tests excluded by the user.
+	skipFilteredOut skipCategory = "filtered out"
+	// skipCorpusIncomplete is for tests whose files or expectations are
+	// missing.
+	skipCorpusIncomplete skipCategory = "corpus incomplete"
+	// skipNetworkError is for tests against a live server that couldn't
+	// be reached.
+	skipNetworkError skipCategory = "network error"
+)
+
+// skip explains why a test isn't run.
+type skip struct {
+	Category skipCategory `json:"category"`
+	Detail   string       `json:"detail"`
+}
+
+// runCorpusTest runs test, whose certificates are taken from corpus, unless
+// the verifier lacks a capability that it needs, and returns whether it
+// failed. If preinstalled isn't nil, it's used as the intermediates for every
+// test. The result of the verification is recorded with recorder, and the
+// test, whether run or skipped, is counted by progress if it isn't nil.
+func runCorpusTest(test *expectation, config *configFile, corpus *corpusLoader, rootPool, preinstalled *x509.CertPool, recorder *resultRecorder, progress *progressReporter) (failed bool) {
+	defer progress.step()
+
+	if reason := verifierCaps.skipReason(test); reason != nil {
+		traceSkip(test, reason)
+		recorder.recordSkip(reason)
+		return false
+	}
+	return runTestGuarded(test, config, corpus, rootPool, preinstalled, recorder)
+}
+
+// runTestGuarded calls runTest but turns a panic or a test that takes longer
+// than limits.timeout into a failure, so that a hostile corpus can't crash or
+// hang the worker pool. A test that times out is abandoned rather than
+// stopped.
+func runTestGuarded(test *expectation, config *configFile, corpus *corpusLoader, rootPool, preinstalled *x509.CertPool, recorder *resultRecorder) (failed bool) {
+	// The test records into a recorder of its own, which is only merged
+	// into recorder if it finishes in time, since a test that times out
+	// is abandoned rather than stopped and may record later.
+	result := *test
+	scratch := recorder.scratch()
+	done := make(chan bool, 1)
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				result.err = fmt.Errorf("panic while testing %s: %v", testPath(test.Id, ".crt"), r)
+				done <- true
+			}
+		}()
+
+		done <- runTest(&result, config, corpus, rootPool, preinstalled, scratch)
+	}()
+
+	timeout := limits.timeout * time.Duration(benchIterations)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case failed := <-done:
+		*test = result
+		recorder.merge(scratch, test)
+		return failed
+	case <-timer.C:
+		test.err = fmt.Errorf("testing %s timed out after %s", testPath(test.Id, ".crt"), timeout)
+		return true
+	}
+}
+
+// runTest verifies the certificate for test and returns whether the test
+// failed. The test's chain is given to the verifier, as presented if
+// presentChains is set, unless preinstalled isn't nil, in which case that is.
+// The result of the verification is recorded with recorder.
+func runTest(test *expectation, config *configFile, corpus *corpusLoader, rootPool, preinstalled *x509.CertPool, recorder *resultRecorder) (failed bool) {
+	leafDER, chainDER, err := corpus.certificates(test.Id)
+	if err != nil {
+		test.err = err
+		return true
+	}
+
+	if reason := verifierCaps.chainTooDeep(len(chainDER) + 1); reason != nil {
+		recorder.recordSkip(reason)
+		return false
+	}
+
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		test.err = err
+		return true
+	}
+
+	chain := make([]*x509.Certificate, len(chainDER))
+	for i, der := range chainDER {
+		if chain[i], err = x509.ParseCertificate(der); err != nil {
+			test.err = err
+			return true
 		}
+	}
 
-		intermediatePool := x509.NewCertPool()
+	intermediatePool := preinstalled
+	if intermediatePool == nil {
+		intermediatePool = x509.NewCertPool()
 		for _, intermediate := range chain {
 			intermediatePool.AddCert(intermediate)
 		}
+	}
 
-		verifyOpts := x509.VerifyOptions{
+	expect, name := &test.IP, config.testIP(test)
+	if test.testDNS {
+		expect, name = &test.DNS, config.testHostname(test)
+	}
+	shouldFail, err := test.shouldFail()
+	if err != nil {
+		test.err = err
+		return true
+	}
+
+	// verifyFor verifies the chain with crypto/x509 for a DNS name or IP
+	// address, or for no name if it's given "".
+	verifyFor := func(name string) error {
+		_, err := leaf.Verify(x509.VerifyOptions{
 			Roots:         rootPool,
 			Intermediates: intermediatePool,
-			DNSName:       config.Hostname,
+			DNSName:       name,
+		})
+		return err
+	}
+	if presentChains {
+		rawChain := presentedChain(leaf, chain)
+		verifyFor = func(name string) error {
+			return verifyRawChain(rawChain, name, rootPool)
 		}
+	}
 
-		var shouldFail bool
-		switch test.DNS.Result {
-		default:
-			test.err = fmt.Errorf("unknown expected result %q", test.DNS.Result)
-			failures <- test
-			continue
-		case "ERROR":
-			shouldFail = true
-		case "OK":
-			shouldFail = false
-		case "WEAK-OK":
-			descriptions := test.descriptions()
-			if len(descriptions) == 0 {
-				test.err = errors.New("Weak-OK without description")
-				failures <- test
-				continue
-			}
-
-		Descriptions:
-			for _, desc := range descriptions {
-				switch desc {
-				case forbiddenIPAddressPresent, noIPGiven, ipViolation, ipInCNViolation, dnsInCNViolation:
-					shouldFail = false
-
-				case cnWithSANs:
-					// Any description that should be fatal
-					// means that a failure must occur.
-					shouldFail = true
-					break Descriptions
-
-				default:
-					test.err = fmt.Errorf("unknown description for weak-OK: %q", desc)
-					failures <- test
-					continue NextTest
-				}
-			}
+	verify := func() error {
+		return verifyFor(name)
+	}
+	if cnPolicy != nil && cnPolicy.name == cnAllowed {
+		verify = func() error {
+			return verifyWithCNFallback(verifyFor, leaf, chain, name)
+		}
+	}
+	switch {
+	case platform != nil && presentChains:
+		rawChain := presentedChain(leaf, chain)
+		verify = func() error {
+			return platform.verifyRaw(rawChain, name)
+		}
+	case platform != nil:
+		verify = func() error {
+			return platform.verify(leaf, chain, name)
 		}
+	}
 
-		_, err = leaf[0].Verify(verifyOpts)
-		if shouldFail {
-			if err == nil {
-				failures <- test
-			}
-		} else {
-			if err != nil {
-				test.err = err
-				failures <- test
-			}
+	start := time.Now()
+	for i := 0; i < benchIterations; i++ {
+		err = verify()
+	}
+	elapsed := time.Since(start) / time.Duration(benchIterations)
+	traceVerification(test, name, err, elapsed)
+	recorder.record(test, err, elapsed)
+	if cnPolicy != nil {
+		expect, policyErr := cnPolicy.expectation(test, test.testDNS)
+		if policyErr != nil {
+			test.err = policyErr
+			return true
 		}
+		passed, description := gradeResult(expect, err == nil, errorReasonOf(recorder.taxonomy, err))
+		if !passed {
+			test.err = fmt.Errorf("%s under the %s Common Name policy: %v", description, cnPolicy.name, err)
+		}
+		return !passed
+	}
+	if test.acceptsEither() {
+		return false
+	}
+	if shouldFail {
+		if followed := expect.interpretationOf(true); err == nil && followed != nil {
+			test.err = fmt.Errorf("accepted, following the %s interpretation (%s)", followed.Name, followed.Reason)
+		}
+		if reason := errorReasonOf(recorder.taxonomy, err); err != nil && !expect.reasonAcceptable(reason) {
+			test.err = fmt.Errorf("rejected for %s rather than %s: %v", reason, joinReasons(expect.Reasons), err)
+			return true
+		}
+		return err == nil
+	}
+
+	test.err = err
+	return err != nil
+}
+
+// shouldFail returns whether crypto/x509 should reject the test's leaf for
+// the name under test, its DNS name or its IP address. It returns false if
+// acceptsEither, so callers that grade the result must check that first.
+func (e *expectation) shouldFail() (bool, error) {
+	if e.testDNS {
+		return e.shouldFailDNS()
+	}
+	return e.shouldFailIP()
+}
+
+// shouldFailDNS returns whether crypto/x509 should reject the test's leaf for
+// its DNS name. It returns false if acceptsEitherDNS, so callers that grade
+// the result must check that first.
+func (e *expectation) shouldFailDNS() (bool, error) {
+	if e.acceptsEitherDNS() {
+		return false, nil
+	}
+	switch e.DNS.Result {
+	case "ERROR":
+		return true, nil
+	case "OK":
+		return false, nil
+	case "WEAK-OK":
+		return e.Features.dnsWeakOK()
 	}
+	return false, fmt.Errorf("unknown expected result %q", e.DNS.Result)
 }
 
-// failureCounter prints received failures and, once complete, sends the number
-// of failures to count.
-func failureCounter(count chan<- int, failures <-chan expectation) {
-	num := 0
+// acceptsEitherDNS returns whether crypto/x509 passes the test's DNS
+// verification whatever the result, since its expectation is a WEAK-OK derived
+// from reference verifiers that split on it.
+func (e *expectation) acceptsEitherDNS() bool {
+	return e.DNS.Result == "WEAK-OK" && len(e.DNS.DerivedFrom) > 0
+}
 
-	for failure := range failures {
-		num++
+// shouldFailIP is shouldFailDNS for the test's IP address.
+func (e *expectation) shouldFailIP() (bool, error) {
+	if e.acceptsEitherIP() {
+		return false, nil
+	}
+	switch e.IP.Result {
+	case "ERROR":
+		return true, nil
+	case "OK":
+		return false, nil
+	case "WEAK-OK":
+		return e.Features.ipWeakOK()
+	}
+	return false, fmt.Errorf("unknown expected result %q", e.IP.Result)
+}
 
-		testType := "IP"
-		if failure.testDNS {
-			testType = "DNS"
-		}
+// acceptsEitherIP is acceptsEitherDNS for the test's IP address.
+func (e *expectation) acceptsEitherIP() bool {
+	return e.IP.Result == "WEAK-OK" && len(e.IP.DerivedFrom) > 0
+}
 
-		fmt.Printf("#%d: failed for %s:\n  %q\n  %q\n", failure.Id, testType, failure.err, strings.Join(failure.descriptions(), " "))
+// acceptsEither returns whether crypto/x509 passes the verification of the
+// name under test whatever the result.
+func (e *expectation) acceptsEither() bool {
+	if e.testDNS {
+		return e.acceptsEitherDNS()
 	}
+	return e.acceptsEitherIP()
+}
 
-	count <- num
+// testPath returns the path of the file with the given extension for a test.
+func testPath(id int, ext string) string {
+	return filepath.Join(certificatesDir, strconv.Itoa(id)+ext)
 }
 
 func main() {
-	if err := runTests(); err != nil {
+	// The first argument may name a command. Running the tests is the
+	// default.
+	command, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	switch command {
+	case "run":
+		err = runTests(args)
+	case "export-report":
+		err = exportReport(args)
+	case "diff":
+		err = diffResults(args)
+	case "stability":
+		err = checkStability(args)
+	case "stable-ids":
+		err = writeStableIDs(args)
+	case "error-taxonomy":
+		err = printErrorTaxonomy(args)
+	case "docs":
+		err = serveDocs(args)
+	case "coverage":
+		err = printCoverage(args)
+	case "resign":
+		err = resignCorpus(args)
+	case "pack-corpus":
+		err = packCorpus(args)
+	case "fetch-corpus":
+		err = fetchCorpus(args)
+	case "der-corpus":
+		err = writeDERCorpus(args)
+	case "expects":
+		err = editExpectations(args)
+	case "derive-expects":
+		err = deriveExpectations(args)
+	case "diff-verify":
+		err = diffVerify(args)
+	case "hostnames":
+		err = checkHostnames(args)
+	case "fuzz":
+		err = fuzzCorpus(args)
+	case "repro":
+		err = reproduceTest(args)
+	case "self-test":
+		err = selfTest(args)
+	case "serve":
+		err = serveSuite(args)
+	case "toolchain":
+		err = runToolchain(args)
+	case "openssl":
+		err = runOpenSSL(args)
+	case "nss":
+		err = runNSS(args)
+	case "gnutls":
+		err = runGnuTLS(args)
+	case "probe":
+		err = probeClients(args)
+	case "browser":
+		err = runBrowser(args)
+	case "client-auth":
+		err = runClientAuth(args)
+	case "ct":
+		err = runCTServer(args)
+	case "intermediate-cache":
+		err = runIntermediateCache(args)
+	case "alpaca":
+		err = runALPACAServer(args)
+	case "job":
+		err = runJob(args)
+	case "external":
+		err = runExternal(args)
+	case "docker":
+		err = runDocker(args)
+	default:
+		err = fmt.Errorf("unknown command %q", command)
+	}
+
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 		return
 	}
+}
 
-	println("PASS")
+// loadPreinstalledIntermediates returns a pool of the intermediates from
+// every test's chain, read with reader.
+func loadPreinstalledIntermediates(reader corpusReader, expectations *expectations) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, test := range expectations.Expects {
+		_, chain, err := reader.test(test.Id)
+		if err != nil {
+			return nil, err
+		}
+		for _, der := range chain {
+			intermediate, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, err
+			}
+			pool.AddCert(intermediate)
+		}
+	}
+
+	return pool, nil
 }
 
-func loadRoot() (*x509.Certificate, error) {
-	rootChain, err := readPEMChain(filepath.Join(baseDir, "certificates", "root.crt"))
+// loadRoot returns the root of the main corpus, read with reader.
+func loadRoot(reader corpusReader) (*x509.Certificate, error) {
+	der, err := reader.root()
 	if err != nil {
 		return nil, err
 	}
 
-	if len(rootChain) != 1 {
-		return nil, fmt.Errorf("Expected a single root in 'root.pem' but found %d", len(rootChain))
-	}
-
-	return rootChain[0], nil
+	return x509.ParseCertificate(der)
 }
 
 func loadConfig() (*configFile, error) {
@@ -307,11 +1199,65 @@ func loadExpectations() (*expectations, error) {
 		return nil, err
 	}
 
+	if err := ret.checkCompatibility(); err != nil {
+		return nil, err
+	}
+
 	return ret, nil
 }
 
 func readPEMChain(path string) (certs []*x509.Certificate, err error) {
-	pemBytes, err := ioutil.ReadFile(path)
+	blocks, err := readPEMBlocks(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, der := range blocks {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+// verifyHostname verifies the certificate at pathPrefix + ".crt", with the
+// intermediates at pathPrefix + ".chain", for hostname. It's how the optional
+// corpora that are verified for a single hostname are run.
+func verifyHostname(pathPrefix, hostname string, rootPool *x509.CertPool) error {
+	chain, err := readPEMChain(pathPrefix + ".chain")
+	if err != nil {
+		return err
+	}
+
+	leaf, err := readPEMChain(pathPrefix + ".crt")
+	if err != nil {
+		return err
+	}
+
+	if len(leaf) != 1 {
+		return fmt.Errorf("expected a single certificate in the .crt file, but found %d", len(leaf))
+	}
+
+	intermediatePool := x509.NewCertPool()
+	for _, intermediate := range chain {
+		intermediatePool.AddCert(intermediate)
+	}
+
+	_, err = leaf[0].Verify(x509.VerifyOptions{
+		DNSName:       hostname,
+		Roots:         rootPool,
+		Intermediates: intermediatePool,
+	})
+	return err
+}
+
+// readPEMBlocks returns the DER of each certificate in the PEM file at path.
+func readPEMBlocks(path string) (blocks [][]byte, err error) {
+	pemBytes, err := readCorpusFile(path)
 	if err != nil {
 		return nil, err
 	}
@@ -323,17 +1269,10 @@ func readPEMChain(path string) (certs []*x509.Certificate, err error) {
 		}
 		pemBytes = rest
 
-		if block.Type != "CERTIFICATE" {
-			continue
+		if block.Type == "CERTIFICATE" {
+			blocks = append(blocks, block.Bytes)
 		}
-
-		cert, err := x509.ParseCertificate(block.Bytes)
-		if err != nil {
-			return nil, err
-		}
-
-		certs = append(certs, cert)
 	}
 
-	return certs, nil
+	return blocks, nil
 }
@@ -0,0 +1,177 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// aiaOutcomeIncomplete is recorded when a chain is rejected because the
+// verifier didn't fetch the missing issuers.
+const aiaOutcomeIncomplete = "chain incomplete without AIA"
+
+// aiaManifest represents certificates/aia/manifest.json.
+type aiaManifest struct {
+	// AIABaseURL is where the caIssuers URLs in the corpus expect the
+	// issuers directory to be served.
+	AIABaseURL string `json:"aiaBaseUrl"`
+}
+
+// aiaExpectations represents aiaExpects.json, which defineExpects.js
+// generates when the optional AIA corpus is present.
+type aiaExpectations struct {
+	Expects []aiaExpectation
+}
+
+type aiaExpectation struct {
+	Id int `json:"id"`
+	// Mainstream is the expected result for verifiers that don't fetch
+	// missing issuers, such as Go.
+	Mainstream expectedResult `json:"mainstream"`
+	// AIAAware is the expected result for verifiers that do.
+	AIAAware expectedResult `json:"aiaAware"`
+}
+
+// runAIATests runs the AIA tests, verifying each leaf against hostname while
+// serving the missing issuers, and returns the number of tests run and the
+// number of failures. Each test is graded by the expectation that applies to
+// a verifier with caps. The outcome of each test is recorded with recorder. It
+// does nothing if the AIA corpus hasn't been generated.
+func runAIATests(hostname string, caps *verifierCapabilities, recorder *resultRecorder) (numTests, numFailures int, err error) {
+	if !profile.runsOptionalCorpus("aia") {
+		return 0, 0, nil
+	}
+
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(baseDir, "html", "aiaExpects.json"))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	expectations := new(aiaExpectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return 0, 0, err
+	}
+
+	aiaDir := filepath.Join(baseDir, "certificates", "aia")
+	manifestBytes, err := readCorpusFile(filepath.Join(aiaDir, "manifest.json"))
+	if err != nil {
+		return 0, 0, err
+	}
+	manifest := new(aiaManifest)
+	if err := json.Unmarshal(manifestBytes, manifest); err != nil {
+		return 0, 0, err
+	}
+
+	// Serve the issuers so that a verifier that does fetch them could
+	// complete the chains.
+	baseURL, err := url.Parse(manifest.AIABaseURL)
+	if err != nil {
+		return 0, 0, err
+	}
+	listener, err := net.Listen("tcp", baseURL.Host)
+	if err != nil {
+		return 0, 0, fmt.Errorf("serving AIA issuers: %s", err)
+	}
+	server := &http.Server{Handler: http.StripPrefix(baseURL.Path, http.FileServer(http.Dir(filepath.Join(aiaDir, "issuers"))))}
+	go server.Serve(listener)
+	defer server.Close()
+
+	rootChain, err := readPEMChain(filepath.Join(aiaDir, "root.crt"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rootPool := x509.NewCertPool()
+	for _, root := range rootChain {
+		rootPool.AddCert(root)
+	}
+
+	for _, test := range expectations.Expects {
+		accepted, outcome, err := runAIATest(&test, caps.aiaExpectation(&test), aiaDir, hostname, rootPool)
+		recorder.recordAIA(test.Id, accepted, outcome)
+		if err != nil {
+			fmt.Printf("aia #%d: failed:\n  %q\n", test.Id, err)
+			numFailures++
+		}
+	}
+
+	return len(expectations.Expects), numFailures, nil
+}
+
+// runAIATest verifies a single leaf with the intermediates supplied with it
+// and returns whether it was accepted and why. err is non-nil if the result
+// doesn't match expect.
+func runAIATest(test *aiaExpectation, expect expectedResult, aiaDir, hostname string, rootPool *x509.CertPool) (accepted bool, outcome string, err error) {
+	chain, err := readPEMChain(filepath.Join(aiaDir, strconv.Itoa(test.Id)+".chain"))
+	if err != nil {
+		return false, "", err
+	}
+
+	leaf, err := readPEMChain(filepath.Join(aiaDir, strconv.Itoa(test.Id)+".crt"))
+	if err != nil {
+		return false, "", err
+	}
+
+	if len(leaf) != 1 {
+		return false, "", fmt.Errorf("expected a single certificate in the .crt file, but found %d", len(leaf))
+	}
+
+	intermediatePool := x509.NewCertPool()
+	for _, intermediate := range chain {
+		intermediatePool.AddCert(intermediate)
+	}
+
+	_, verifyErr := leaf[0].Verify(x509.VerifyOptions{
+		DNSName:       hostname,
+		Roots:         rootPool,
+		Intermediates: intermediatePool,
+	})
+
+	switch verifyErr.(type) {
+	case nil:
+		accepted, outcome = true, "OK"
+	case x509.UnknownAuthorityError:
+		outcome = aiaOutcomeIncomplete
+	default:
+		outcome = verifyErr.Error()
+	}
+
+	switch expect.Result {
+	case "ERROR":
+		if accepted {
+			return accepted, outcome, fmt.Errorf("the certificate was accepted")
+		}
+	case "OK":
+		if !accepted {
+			return accepted, outcome, verifyErr
+		}
+	default:
+		return accepted, outcome, fmt.Errorf("unknown expected result %q", expect.Result)
+	}
+
+	return accepted, outcome, nil
+}
@@ -0,0 +1,312 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// alpacaExpectations represents alpacaExpects.json, which defineExpects.js
+// generates when the optional ALPACA corpus is present.
+type alpacaExpectations struct {
+	Expects []alpacaExpectation
+}
+
+type alpacaExpectation struct {
+	Id int `json:"id"`
+	// Name identifies the case, e.g. "emailProtection".
+	Name string `json:"name"`
+	// Service is the protocol that the certificate was issued for, e.g.
+	// "smtp", or "https" for the controls. Every test is verified for
+	// HTTPS to the corpus hostname.
+	Service string `json:"service"`
+	// KeyPurposes and IssuerKeyPurposes name the leaf's and the
+	// intermediate's extended key usages, and are nil if it has no
+	// extension.
+	KeyPurposes       []string `json:"keyPurposes"`
+	IssuerKeyPurposes []string `json:"issuerKeyPurposes"`
+	expectedResult
+}
+
+func alpacaDir() string {
+	return filepath.Join(baseDir, "certificates", "alpaca")
+}
+
+// loadALPACAExpectations returns the ALPACA expectations, or nil if the ALPACA
+// corpus hasn't been generated.
+func loadALPACAExpectations() (*alpacaExpectations, error) {
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(baseDir, "html", "alpacaExpects.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	expectations := new(alpacaExpectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return nil, err
+	}
+	return expectations, nil
+}
+
+// runALPACATests runs the ALPACA tests, which verify certificates issued for
+// services other than HTTPS as a TLS client verifies a server's, and returns
+// the number of tests run and the number of failures. A client that accepts
+// one would accept that service's certificate from an attacker who redirects
+// its connection there. It records the outcome of each test with recorder. It
+// does nothing if the ALPACA corpus hasn't been generated.
+func runALPACATests(hostname string, recorder *resultRecorder) (numTests, numFailures int, err error) {
+	if !profile.runsOptionalCorpus("alpaca") {
+		return 0, 0, nil
+	}
+
+	expectations, err := loadALPACAExpectations()
+	if expectations == nil {
+		return 0, 0, err
+	}
+
+	rootChain, err := readPEMChain(filepath.Join(alpacaDir(), "root.crt"))
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(rootChain) != 1 {
+		return 0, 0, fmt.Errorf("expected a single root in alpaca/root.crt but found %d", len(rootChain))
+	}
+
+	rootPool := x509.NewCertPool()
+	rootPool.AddCert(rootChain[0])
+
+	var verifier platformVerifier
+	if platform != nil {
+		if verifier, err = loadPlatform(rootChain[0]); err != nil {
+			return 0, 0, err
+		}
+		defer verifier.close()
+	}
+
+	for _, test := range expectations.Expects {
+		pathPrefix := filepath.Join(alpacaDir(), strconv.Itoa(test.Id))
+		var verifyErr error
+		if verifier != nil {
+			var rawChain [][]byte
+			if rawChain, verifyErr = readPresentedChain(pathPrefix); verifyErr == nil {
+				verifyErr = verifier.verifyRaw(rawChain, hostname)
+			}
+		} else {
+			// crypto/x509 requires serverAuth when no key usages
+			// are given, as crypto/tls does.
+			verifyErr = verifyPresentedFiles(pathPrefix, hostname, rootPool)
+		}
+		recorder.recordALPACA(&test, verifyErr)
+
+		if passed, description := classifyResult(test.Result, verifyErr == nil); !passed {
+			fmt.Printf("alpaca #%d (%s, for %s): %s%s\n", test.Id, test.Name, test.Service, description, errorSuffix(errString(verifyErr)))
+			numFailures++
+		}
+	}
+
+	return len(expectations.Expects), numFailures, nil
+}
+
+// runALPACAServer implements the alpaca command, which serves each ALPACA
+// test on its own port, from the control port plus one, and records which of
+// them a probing client completes HTTPS handshakes with, as the probe command
+// does for the main corpus. This measures the defences of a live client,
+// such as a browser, rather than of its verifier alone.
+func runALPACAServer(args []string) error {
+	flags := flag.NewFlagSet("alpaca", flag.ExitOnError)
+	control := flags.String("control", "", "The address to serve the probe page and controls on, which defaults to basePort+30000 on all interfaces. Tests are served from the port after it")
+	resultsPath := flags.String("results", "alpaca.json", "The path to write the results file to when probing is done")
+	resultsKeyPath := flags.String("results-key", "", resultsKeyUsage)
+	userAgent := flags.String("user-agent", "", "The user agent to record, which defaults to the User-Agent header of the first request made")
+	flags.DurationVar(&limits.timeout, "timeout", limits.timeout, "The longest time to wait for a client to complete a handshake")
+	flags.Parse(args)
+
+	resultsKey, err := loadResultsKey(*resultsKeyPath)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if len(*control) == 0 {
+		*control = ":" + strconv.Itoa(config.BasePort+30000)
+	}
+
+	expectations, err := loadALPACAExpectations()
+	if err != nil {
+		return err
+	}
+	if expectations == nil {
+		return errors.New("html/alpacaExpects.json is missing; run gradle runAlpacaGenerator and then defineExpects.js")
+	}
+
+	controlListener, err := net.Listen("tcp", *control)
+	if err != nil {
+		return err
+	}
+	controlPort := controlListener.Addr().(*net.TCPAddr).Port
+
+	// Every ALPACA test has the corpus hostname, not one of its own.
+	alpacaConfig := *config
+	alpacaConfig.PerTestHostnames = false
+	p := newProber(&alpacaConfig, "", *userAgent)
+	p.resultsKey = resultsKey
+	p.listeners = append(p.listeners, controlListener)
+	defer p.close()
+
+	var urls []string
+	for _, test := range expectations.Expects {
+		cert, err := loadALPACACertificate(test.Id)
+		if err != nil {
+			return fmt.Errorf("alpaca #%d: %s", test.Id, err)
+		}
+
+		port := controlPort + test.Id
+		l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err != nil {
+			return fmt.Errorf("alpaca #%d: %s", test.Id, err)
+		}
+		p.listeners = append(p.listeners, l)
+		go p.serve(test.Id, config.Hostname, l, &tls.Config{Certificates: []tls.Certificate{cert}, GetConfigForClient: p.captureHello, SessionTicketsDisabled: true})
+
+		urls = append(urls, "https://"+net.JoinHostPort(config.Hostname, strconv.Itoa(port))+"/well-known.txt")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := probePageTemplate.Execute(w, urls); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("/urls", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, url := range urls {
+			fmt.Fprintln(w, url)
+		}
+	})
+	mux.HandleFunc("/done", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST to finish probing", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintln(w, "Probing is done; the harness is writing the results")
+		p.doneOnce.Do(func() { close(p.done) })
+	})
+	go http.Serve(controlListener, mux)
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	fmt.Printf("Serving %d ALPACA tests from port %d. Point the client at http://localhost:%d/, or fetch each URL listed at /urls,\n", len(expectations.Expects), controlPort+1, controlPort)
+	fmt.Printf("with a client that trusts certificates/alpaca/root.crt, then POST to /done or interrupt to write the results.\n")
+
+	select {
+	case <-p.done:
+	case <-interrupts:
+	}
+
+	return writeALPACAResults(p, expectations, *resultsPath)
+}
+
+// loadALPACACertificate returns the leaf, key and chain of an ALPACA test.
+func loadALPACACertificate(id int) (tls.Certificate, error) {
+	pathPrefix := filepath.Join(alpacaDir(), strconv.Itoa(id))
+	certPEM, err := readCorpusFile(pathPrefix + ".crt")
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := readCorpusFile(pathPrefix + ".key")
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	chain, err := readPEMChain(pathPrefix + ".chain")
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	for _, intermediate := range chain {
+		cert.Certificate = append(cert.Certificate, intermediate.Raw)
+	}
+	return cert, nil
+}
+
+// writeALPACAResults writes the outcomes of the ALPACA tests to a results
+// file and reports the tests that failed or weren't probed.
+func writeALPACAResults(p *prober, expectations *alpacaExpectations, path string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	recorder := newResultRecorder(deliveryPool)
+	recorder.setSigningKey(p.resultsKey)
+	recorder.userAgent = p.userAgent
+	recorder.setClientHellos(p.hellos.list())
+	p.identify(recorder)
+
+	var numProbed, numFailures int
+	for _, test := range expectations.Expects {
+		outcome, ok := p.outcomes[probeKey{test.Id, true}]
+		if !ok {
+			continue
+		}
+		numProbed++
+
+		var err error
+		if !outcome.accepted {
+			err = outcome.err
+			if err == nil {
+				err = errors.New("handshake failed")
+			}
+		}
+		recorder.recordALPACA(&test, err)
+
+		if passed, description := classifyResult(test.Result, outcome.accepted); !passed {
+			numFailures++
+			fmt.Printf("alpaca #%d (%s, for %s): %s%s\n  %q\n", test.Id, test.Name, test.Service, description, errorSuffix(errString(err)), strings.Join(test.Descriptions, " "))
+		}
+	}
+
+	if err := recorder.write(path, p.config.TestVersion); err != nil {
+		return err
+	}
+
+	fmt.Printf("Probed %d of %d ALPACA tests, of which %d failed; results written to %s\n", numProbed, len(expectations.Expects), numFailures, path)
+	return nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// corpusArchiveUsage is the usage of the -corpus-archive flag of the commands
+// that read the corpus.
+const corpusArchiveUsage = "If set, a zip archive of the certificates directory, as written by pack-corpus, to read the corpus from"
+
+// corpusArchive, if not nil, holds the files of the certificates directory.
+// Files are only decompressed when they're read, so opening an archive of the
+// whole corpus is cheap. Zip is used, rather than a compressed tarball,
+// because its entries can be read in any order.
+var corpusArchive *zipCorpus
+
+type zipCorpus struct {
+	// files maps the slash-separated path of each file, relative to the
+	// certificates directory, to its entry.
+	files map[string]*zip.File
+}
+
+// openCorpusArchive opens the zip archive at archivePath as corpusArchive. It
+// does nothing if archivePath is empty. Entries may be at the top of the
+// archive or under a certificates directory.
+func openCorpusArchive(archivePath string) error {
+	if len(archivePath) == 0 {
+		return nil
+	}
+
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+
+	corpus := &zipCorpus{files: make(map[string]*zip.File)}
+	for _, f := range r.File {
+		name := strings.TrimPrefix(path.Clean(f.Name), "certificates/")
+		corpus.files[name] = f
+	}
+	if _, ok := corpus.files["root.crt"]; !ok {
+		r.Close()
+		return fmt.Errorf("%s has no root.crt", archivePath)
+	}
+
+	corpusArchive = corpus
+	return nil
+}
+
+// openCorpusFile opens the file at filePath, from corpusArchive if it's in the
+// certificates directory and in the archive, and from disk otherwise.
+func openCorpusFile(filePath string) (io.ReadCloser, error) {
+	if corpusArchive != nil {
+		if rel, err := filepath.Rel(certificatesDir, filePath); err == nil {
+			if f, ok := corpusArchive.files[filepath.ToSlash(rel)]; ok {
+				return f.Open()
+			}
+		}
+	}
+	return os.Open(filePath)
+}
+
+// readCorpusFile returns the contents of the file at filePath, opened with
+// openCorpusFile. Files larger than limits.maxFileSize are refused.
+func readCorpusFile(filePath string) ([]byte, error) {
+	r, err := openCorpusFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	contents, err := ioutil.ReadAll(io.LimitReader(r, limits.maxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(contents)) > limits.maxFileSize {
+		return nil, fmt.Errorf("%s is larger than the limit of %d bytes", filePath, limits.maxFileSize)
+	}
+	return contents, nil
+}
+
+// packCorpus implements the pack-corpus command, which writes the certificates
+// directory, including any optional corpora in it, to a zip archive that can
+// be read with -corpus-archive.
+func packCorpus(args []string) error {
+	flags := flag.NewFlagSet("pack-corpus", flag.ExitOnError)
+	output := flags.String("o", "corpus.zip", "The path to write the archive to")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return errors.New("pack-corpus takes no arguments")
+	}
+
+	out, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+
+	w := zip.NewWriter(out)
+	numFiles := 0
+	err = filepath.Walk(certificatesDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(certificatesDir, filePath)
+		if err != nil {
+			return err
+		}
+		contents, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+
+		entry, err := w.Create(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		numFiles++
+		_, err = entry.Write(contents)
+		return err
+	})
+	if err == nil {
+		err = w.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote %d files to %s\n", numFiles, *output)
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Results files can be signed, so that a published comparison of
+// implementations can show which harness produced each set of results. The
+// signature is detached, in the results file's path plus ".sig", and is the
+// raw 64-byte Ed25519 signature of the file's contents, so that it can also
+// be checked with e.g. "openssl pkeyutl -verify -rawin".
+
+// resultsKeyUsage is the usage of the -results-key flag of the commands that
+// write results files.
+const resultsKeyUsage = "Path to a PEM, PKCS#8 Ed25519 private key used to sign the results file, with the signature written to its path plus .sig"
+
+// resultsPublicKeyUsage is the usage of the -public-key flag of the commands
+// that read results files.
+const resultsPublicKeyUsage = "Path to one or more PEM, PKIX Ed25519 public keys, one of which must have signed each results file"
+
+// resultsSignatureSuffix is appended to a results file's path to name its
+// detached signature.
+const resultsSignatureSuffix = ".sig"
+
+// loadResultsKey loads the key that results files are signed with, or returns
+// nil if path is empty.
+func loadResultsKey(path string) (ed25519.PrivateKey, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	return loadEd25519Key(path)
+}
+
+// loadResultsPublicKeys loads the keys that results files must be signed
+// with, or returns nil if path is empty.
+func loadResultsPublicKeys(path string) ([]ed25519.PublicKey, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	return loadEd25519PublicKeys(path)
+}
+
+// verifyResultsFile checks the signature of the results file at path and
+// returns the fingerprint of the key in keys that made it.
+func verifyResultsFile(path string, keys []ed25519.PublicKey) (fingerprint string, err error) {
+	resultsBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	signature, err := ioutil.ReadFile(path + resultsSignatureSuffix)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%s isn't signed: %s%s doesn't exist", path, path, resultsSignatureSuffix)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	fingerprint, err = verifyResultsSignature(resultsBytes, signature, keys)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	return fingerprint, nil
+}
+
+// verifyResultsSignature checks that signature is the signature of
+// resultsBytes by one of keys and returns that key's fingerprint.
+func verifyResultsSignature(resultsBytes, signature []byte, keys []ed25519.PublicKey) (fingerprint string, err error) {
+	for _, key := range keys {
+		if ed25519.Verify(key, resultsBytes, signature) {
+			return keyFingerprint(key), nil
+		}
+	}
+	return "", errors.New("the results aren't signed by any of the trusted keys")
+}
+
+// keyFingerprint identifies a public key by the first 16 hex digits of its
+// SHA-256 hash.
+func keyFingerprint(key ed25519.PublicKey) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:])[:16]
+}
@@ -0,0 +1,277 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// auditRecord is a single line of the audit log. Each record includes the hash
+// of the line before it, so removing or altering earlier records can be
+// detected, and may be signed.
+type auditRecord struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Args are the command-line arguments given to the run command.
+	Args     []string `json:"args"`
+	Verifier string   `json:"verifier"`
+	OS       string   `json:"os"`
+	// CorpusHash is a SHA-256 hash over the certificates directory and
+	// the expectations.
+	CorpusHash string                 `json:"corpusHash"`
+	Suites     map[string]auditCounts `json:"suites"`
+	// PrevHash is the hex SHA-256 hash of the previous line of the log,
+	// or empty for the first record.
+	PrevHash string `json:"prevHash"`
+	// Signature, if present, is a base64 Ed25519 signature over the
+	// record serialised without the signature.
+	Signature []byte `json:"signature,omitempty"`
+}
+
+type auditCounts struct {
+	Tests    int `json:"tests"`
+	Failures int `json:"failures"`
+}
+
+// loadAuditKey loads the key that audit log records are signed with, or
+// returns nil if path is empty.
+func loadAuditKey(path string) (ed25519.PrivateKey, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	return loadEd25519Key(path)
+}
+
+// appendAuditRecord completes record and appends it to the audit log at path.
+// If key isn't nil, the record is signed with it.
+func appendAuditRecord(path string, key ed25519.PrivateKey, record *auditRecord) error {
+	var err error
+	if record.CorpusHash, err = hashCorpus(); err != nil {
+		return err
+	}
+
+	if record.PrevHash, err = lastLineHash(path); err != nil {
+		return err
+	}
+
+	if key != nil {
+		unsigned, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		record.Signature = ed25519.Sign(key, unsigned)
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	log, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := log.Write(append(line, '\n')); err != nil {
+		log.Close()
+		return err
+	}
+	return log.Close()
+}
+
+// lastLineHash returns the hex SHA-256 hash of the last line in the file at
+// path, or an empty string if the file doesn't exist or is empty.
+func lastLineHash(path string) (string, error) {
+	log, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer log.Close()
+
+	var last []byte
+	scanner := bufio.NewScanner(log)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			last = append(last[:0], line...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	if last == nil {
+		return "", nil
+	}
+	digest := sha256.Sum256(last)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// hashCorpus returns the hex SHA-256 hash of every file in the certificates
+// directory, or in corpusArchive if one is open, in name order, followed by
+// the expectations.
+func hashCorpus() (string, error) {
+	var names []string
+	if corpusArchive != nil {
+		for name, f := range corpusArchive.files {
+			if !f.FileInfo().IsDir() {
+				names = append(names, name)
+			}
+		}
+	} else {
+		err := filepath.Walk(certificatesDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(certificatesDir, path)
+			if err != nil {
+				return err
+			}
+			names = append(names, filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	hashFile := func(name, filePath string) error {
+		fmt.Fprintf(h, "%s\x00", name)
+
+		f, err := openCorpusFile(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	}
+	for _, name := range names {
+		if err := hashFile("certificates/"+name, filepath.Join(certificatesDir, filepath.FromSlash(name))); err != nil {
+			return "", err
+		}
+	}
+	if err := hashFile("html/expects.json", filepath.Join(baseDir, "html", "expects.json")); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func loadEd25519Key(path string) (ed25519.PrivateKey, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: expected a PEM PRIVATE KEY block", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	ed25519Key, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New(path + ": not an Ed25519 private key")
+	}
+
+	return ed25519Key, nil
+}
+
+func loadEd25519PublicKey(path string) (ed25519.PublicKey, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s: expected a PEM PUBLIC KEY block", path)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	ed25519Key, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New(path + ": not an Ed25519 public key")
+	}
+
+	return ed25519Key, nil
+}
+
+// loadEd25519PublicKeys loads every PEM, PKIX Ed25519 public key in the file at
+// path, so that a set of trusted keys can be given in one file.
+func loadEd25519PublicKeys(path string) ([]ed25519.PublicKey, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []ed25519.PublicKey
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		ed25519Key, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New(path + ": not an Ed25519 public key")
+		}
+		keys = append(keys, ed25519Key)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: expected a PEM PUBLIC KEY block", path)
+	}
+	return keys, nil
+}
@@ -0,0 +1,262 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// runBrowser implements the browser command, which drives Chrome or Firefox
+// through a WebDriver server, such as chromedriver or geckodriver, to the
+// probe page and records which tests the browser accepts, so that browsers
+// can be measured in CI rather than by hand. The browser must already trust
+// the corpus root.
+func runBrowser(args []string) error {
+	flags := flag.NewFlagSet("browser", flag.ExitOnError)
+	webDriverURL := flags.String("webdriver", "http://localhost:9515", "The URL of the WebDriver server, e.g. chromedriver or geckodriver, to drive the browser with")
+	browser := flags.String("browser", "chrome", "The browser to drive: chrome or firefox")
+	headless := flags.Bool("headless", true, "Whether to run the browser without a window")
+	control := flags.String("control", "127.0.0.1:0", "The address to serve the probe page on, which the browser must be able to reach")
+	sni := flags.String("sni", "", "If set, e.g. to :443, the address to serve every DNS test on by SNI rather than a port per test, as for the probe command")
+	mapHosts := flags.String("map-hosts", "", "If set, the address the browser resolves the test hostnames to, e.g. 127.0.0.1, so that no DNS records are needed")
+	resultsPath := flags.String("results", "browser.json", "The path to write the results file to")
+	resultsKeyPath := flags.String("results-key", "", resultsKeyUsage)
+	deadline := flags.Duration("deadline", 30*time.Minute, "The longest time to wait for the browser to probe every test")
+	flags.DurationVar(&limits.timeout, "timeout", limits.timeout, "The longest time to wait for the browser to complete a handshake")
+	checkpointPath := flags.String("checkpoint", "", checkpointUsage+", once the browser has probed every test")
+	flags.Parse(args)
+
+	resultsKey, err := loadResultsKey(*resultsKeyPath)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	expectations, err := loadExpectations()
+	if err != nil {
+		return err
+	}
+
+	if len(*sni) > 0 && !config.PerTestHostnames {
+		return errors.New("-sni needs a corpus generated with perTestHostnames set in config.json, so that each test has its own hostname")
+	}
+
+	capabilities, err := browserCapabilities(*browser, *headless, config.Hostname, *mapHosts)
+	if err != nil {
+		return err
+	}
+
+	p := newProber(config, *sni, "")
+	p.resultsKey = resultsKey
+	defer p.close()
+
+	controlAddr, err := p.start(expectations, *control)
+	if err != nil {
+		return err
+	}
+
+	session, err := newWebDriverSession(*webDriverURL, capabilities)
+	if err != nil {
+		return err
+	}
+	defer session.close()
+	p.implementation, p.implementationVersion = session.browserName, session.browserVersion
+
+	if err := session.command("POST", "/execute/sync", map[string]interface{}{"script": "return navigator.userAgent", "args": []interface{}{}}, &p.userAgent); err != nil {
+		return err
+	}
+	fmt.Printf("Probing %d tests with %s\n", len(expectations.Expects), p.userAgent)
+
+	// The checkpoint is opened once the browser's user agent is known, and
+	// before it loads the probe page, which lists the tests left to probe.
+	cp, err := openCheckpoint(*checkpointPath, p.userAgent, config.TestVersion)
+	if err != nil {
+		return err
+	}
+	defer cp.close()
+	cp.restoreProbes(p)
+
+	// Navigation returns once the probe page has loaded, while its script
+	// goes on to fetch every test and then finish.
+	if err := session.command("POST", "/url", map[string]string{"url": fmt.Sprintf("http://%s/", controlAddr)}, nil); err != nil {
+		return err
+	}
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	var finished, timedOut bool
+	select {
+	case <-p.done:
+		finished = true
+	case <-interrupts:
+	case <-time.After(*deadline):
+		timedOut = true
+	}
+
+	if err := p.writeResults(expectations, *resultsPath); err != nil {
+		return err
+	}
+	if timedOut {
+		return fmt.Errorf("the browser didn't finish probing within %s; the tests it probed were written to %s", *deadline, *resultsPath)
+	}
+	if finished {
+		return cp.finish()
+	}
+	return nil
+}
+
+// browserCapabilities returns the WebDriver capabilities to start browser
+// with. If mapHosts is set, the browser resolves hostname and the names under
+// it to that address.
+func browserCapabilities(browser string, headless bool, hostname, mapHosts string) (map[string]interface{}, error) {
+	switch browser {
+	case "chrome":
+		args := []string{"--no-first-run", "--disable-background-networking"}
+		if headless {
+			args = append(args, "--headless=new")
+		}
+		if len(mapHosts) > 0 {
+			args = append(args, fmt.Sprintf("--host-resolver-rules=MAP %s %s, MAP *.%s %s", hostname, mapHosts, hostname, mapHosts))
+		}
+		return map[string]interface{}{
+			"browserName":        "chrome",
+			"goog:chromeOptions": map[string]interface{}{"args": args},
+		}, nil
+
+	case "firefox":
+		var args []string
+		if headless {
+			args = append(args, "-headless")
+		}
+		prefs := map[string]interface{}{}
+		if len(mapHosts) > 0 {
+			prefs["network.dns.forceResolve"] = mapHosts
+		}
+		return map[string]interface{}{
+			"browserName":        "firefox",
+			"moz:firefoxOptions": map[string]interface{}{"args": args, "prefs": prefs},
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown browser %q; it must be chrome or firefox", browser)
+}
+
+// webDriverSession is a session with a WebDriver server, spoken to with the
+// W3C WebDriver protocol of JSON over HTTP.
+type webDriverSession struct {
+	url string
+	// browserName and browserVersion are as the server reported them
+	// when the session was created.
+	browserName    string
+	browserVersion string
+}
+
+func newWebDriverSession(webDriverURL string, capabilities map[string]interface{}) (*webDriverSession, error) {
+	var created struct {
+		SessionID    string `json:"sessionId"`
+		Capabilities struct {
+			BrowserName    string `json:"browserName"`
+			BrowserVersion string `json:"browserVersion"`
+		} `json:"capabilities"`
+	}
+	request := map[string]interface{}{
+		"capabilities": map[string]interface{}{"alwaysMatch": capabilities},
+	}
+	url := strings.TrimSuffix(webDriverURL, "/") + "/session"
+	if err := webDriverCommand("POST", url, request, &created); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Started %s %s\n", created.Capabilities.BrowserName, created.Capabilities.BrowserVersion)
+	return &webDriverSession{url: url + "/" + created.SessionID, browserName: created.Capabilities.BrowserName, browserVersion: created.Capabilities.BrowserVersion}, nil
+}
+
+// command sends a command to the session and decodes its value into result,
+// if it isn't nil.
+func (s *webDriverSession) command(method, path string, body, result interface{}) error {
+	return webDriverCommand(method, s.url+path, body, result)
+}
+
+// close ends the session, closing the browser.
+func (s *webDriverSession) close() error {
+	return webDriverCommand("DELETE", s.url, nil, nil)
+}
+
+func webDriverCommand(method, url string, body, result interface{}) error {
+	var requestBody []byte
+	if body != nil {
+		var err error
+		if requestBody, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(requestBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Value struct {
+				Error   string `json:"error"`
+				Message string `json:"message"`
+			} `json:"value"`
+		}
+		if err := json.Unmarshal(responseBody, &failure); err != nil || len(failure.Value.Error) == 0 {
+			return fmt.Errorf("WebDriver %s %s: %s", method, url, resp.Status)
+		}
+		return fmt.Errorf("WebDriver %s %s: %s: %s", method, url, failure.Value.Error, failure.Value.Message)
+	}
+
+	if result == nil {
+		return nil
+	}
+	var response struct {
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(responseBody, &response); err != nil {
+		return fmt.Errorf("WebDriver %s %s: %s", method, url, err)
+	}
+	return json.Unmarshal(response.Value, result)
+}
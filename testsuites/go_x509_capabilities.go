@@ -0,0 +1,118 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+)
+
+// verifierCapabilities represents a capabilities file, which describes what a
+// verifier, as driven by a harness, supports. Tests that need a capability
+// that it lacks are skipped, and tests whose expectation depends on one are
+// graded against the matching expectation. The files for the verifiers built
+// into this harness are in the capabilities directory.
+type verifierCapabilities struct {
+	// Implementation names the verifier, e.g. "Go crypto/x509".
+	Implementation string `json:"implementation"`
+	// SupportsIPSAN is whether the verifier can be asked to verify a
+	// certificate for an IP address. If not, IP tests are skipped.
+	SupportsIPSAN bool `json:"supportsIPSAN"`
+	// DoesAIAFetch is whether the verifier fetches missing issuers from
+	// caIssuers URLs, which decides the expectation of AIA tests.
+	DoesAIAFetch bool `json:"doesAIAFetch"`
+	// EnforcesEKUChain is whether the verifier requires the extended key
+	// usage of intermediates to allow that of the leaf. It's recorded in
+	// results files.
+	EnforcesEKUChain bool `json:"enforcesEKUChain"`
+	// ChecksCT is whether the verifier requires SCTs for chains to the
+	// corpus root, which decides the expectation of CT tests.
+	ChecksCT bool `json:"checksCT"`
+	// MaxChainDepth is the largest number of certificates, including the
+	// leaf and root, that the verifier will build a path of, or zero if
+	// there's no limit. Tests with longer chains are skipped.
+	MaxChainDepth int `json:"maxChainDepth"`
+}
+
+// verifierCaps describes the verifier under test. It's loaded by the commands
+// that run the main corpus.
+var verifierCaps *verifierCapabilities
+
+// capabilitiesPath returns the path of the capabilities file of a built-in
+// verifier, as named by the -implementation flag of the run command.
+func capabilitiesPath(implementation string) string {
+	if implementation == "platform" {
+		implementation += "_" + runtime.GOOS
+	}
+	return filepath.Join("capabilities", implementation+".json")
+}
+
+func loadCapabilities(path string) (*verifierCapabilities, error) {
+	capabilitiesBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := new(verifierCapabilities)
+	if err := json.Unmarshal(capabilitiesBytes, ret); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", path, err)
+	}
+	if ret.MaxChainDepth < 0 {
+		return nil, fmt.Errorf("%s: maxChainDepth must not be negative", path)
+	}
+
+	return ret, nil
+}
+
+// skipReason returns why test isn't run by a verifier with these
+// capabilities, or nil if it is.
+func (c *verifierCapabilities) skipReason(test *expectation) *skip {
+	if !test.testDNS && !c.SupportsIPSAN {
+		return &skip{skipUnsupportedNameType, c.Implementation + " doesn't support verifying against an IP address"}
+	}
+
+	return nil
+}
+
+// chainTooDeep returns a skip if a chain of depth certificates is longer than
+// the verifier will build, or nil otherwise.
+func (c *verifierCapabilities) chainTooDeep(depth int) *skip {
+	if c.MaxChainDepth > 0 && depth > c.MaxChainDepth {
+		return &skip{skipCapabilityMissing, fmt.Sprintf("%s doesn't build chains of more than %d certificates", c.Implementation, c.MaxChainDepth)}
+	}
+
+	return nil
+}
+
+// aiaExpectation returns the expectation of an AIA test that applies to the
+// verifier.
+func (c *verifierCapabilities) aiaExpectation(test *aiaExpectation) expectedResult {
+	if c.DoesAIAFetch {
+		return test.AIAAware
+	}
+	return test.Mainstream
+}
+
+// ctExpectation returns the expectation of a CT test that applies to the
+// verifier.
+func (c *verifierCapabilities) ctExpectation(test *ctExpectation) expectedResult {
+	if c.ChecksCT {
+		return test.CTEnforcing
+	}
+	return test.NonEnforcing
+}
@@ -0,0 +1,171 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// chainOrderExpectations represents chainOrderExpects.json, which
+// defineExpects.js generates when the optional chain order corpus is present.
+type chainOrderExpectations struct {
+	Expects []chainOrderExpectation
+}
+
+type chainOrderExpectation struct {
+	Id int `json:"id"`
+	// Name identifies the case, e.g. "rootFirst".
+	Name string `json:"name"`
+	// Presented labels the certificates presented after the leaf, in
+	// order, e.g. "intermediate1" or "root".
+	Presented []string `json:"presented"`
+	expectedResult
+}
+
+// runChainOrderTests runs the chain order tests, which present chains with
+// the root included, out of order or with duplicates, and returns the number
+// of tests run and the number of failures. The outcome of each test is
+// recorded with recorder. It does nothing if the chain order corpus hasn't
+// been generated.
+func runChainOrderTests(hostname string, recorder *resultRecorder) (numTests, numFailures int, err error) {
+	if !profile.runsOptionalCorpus("chainOrder") {
+		return 0, 0, nil
+	}
+
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(baseDir, "html", "chainOrderExpects.json"))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	expectations := new(chainOrderExpectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return 0, 0, err
+	}
+
+	chainOrderDir := filepath.Join(baseDir, "certificates", "chainorder")
+	rootChain, err := readPEMChain(filepath.Join(chainOrderDir, "root.crt"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rootPool := x509.NewCertPool()
+	for _, root := range rootChain {
+		rootPool.AddCert(root)
+	}
+
+	for _, test := range expectations.Expects {
+		verifyErr := verifyPresentedFiles(filepath.Join(chainOrderDir, strconv.Itoa(test.Id)), hostname, rootPool)
+		recorder.recordChainOrder(&test, verifyErr)
+
+		if passed, description := classifyResult(test.Result, verifyErr == nil); !passed {
+			fmt.Printf("chain order #%d (%s, leaf,%s): %s%s\n", test.Id, test.Name, strings.Join(test.Presented, ","), description, errorSuffix(errString(verifyErr)))
+			numFailures++
+		}
+	}
+
+	return len(expectations.Expects), numFailures, nil
+}
+
+// readPresentedChain returns the DER of the certificate at pathPrefix +
+// ".crt" followed by those at pathPrefix + ".chain", in the order that they're
+// in the file, as a server would present them in its Certificate message.
+func readPresentedChain(pathPrefix string) ([][]byte, error) {
+	leaf, err := readPEMChain(pathPrefix + ".crt")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(leaf) != 1 {
+		return nil, fmt.Errorf("expected a single certificate in the .crt file, but found %d", len(leaf))
+	}
+
+	chain, err := readPEMChain(pathPrefix + ".chain")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(chain) > limits.maxChainLength {
+		return nil, fmt.Errorf("found %d certificates in the .chain file, more than the limit of %d", len(chain), limits.maxChainLength)
+	}
+
+	return presentedChain(leaf[0], chain), nil
+}
+
+// presentedChain returns the DER of leaf followed by that of chain, in order.
+func presentedChain(leaf *x509.Certificate, chain []*x509.Certificate) [][]byte {
+	rawChain := [][]byte{leaf.Raw}
+	for _, cert := range chain {
+		rawChain = append(rawChain, cert.Raw)
+	}
+	return rawChain
+}
+
+// verifyPresentedFiles verifies the chain read by readPresentedChain from
+// pathPrefix against hostname.
+func verifyPresentedFiles(pathPrefix, hostname string, rootPool *x509.CertPool) error {
+	rawChain, err := readPresentedChain(pathPrefix)
+	if err != nil {
+		return err
+	}
+	return verifyRawChain(rawChain, hostname, rootPool)
+}
+
+// verifyRawChain verifies rawChain, the DER of a leaf followed by the rest of
+// a chain exactly as a server presented it, against hostname. As in
+// crypto/tls, every certificate must parse, but the rest of the chain is only
+// a source of intermediates, so its order, any duplicates and any
+// certificates outside of the path don't matter.
+func verifyRawChain(rawChain [][]byte, hostname string, rootPool *x509.CertPool) error {
+	_, err := verifyRawChainPaths(rawChain, hostname, rootPool)
+	return err
+}
+
+// verifyRawChainPaths is verifyRawChain, but also returns the paths that
+// crypto/x509 built.
+func verifyRawChainPaths(rawChain [][]byte, hostname string, rootPool *x509.CertPool) ([][]*x509.Certificate, error) {
+	if len(rawChain) == 0 {
+		return nil, fmt.Errorf("no certificates were presented")
+	}
+
+	certs := make([]*x509.Certificate, len(rawChain))
+	for i, der := range rawChain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse presented certificate %d: %s", i, err)
+		}
+		certs[i] = cert
+	}
+
+	intermediatePool := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediatePool.AddCert(cert)
+	}
+
+	return certs[0].Verify(x509.VerifyOptions{
+		DNSName:       hostname,
+		Roots:         rootPool,
+		Intermediates: intermediatePool,
+	})
+}
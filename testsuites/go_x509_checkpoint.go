@@ -0,0 +1,290 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// checkpointUsage is the usage of the -checkpoint flag of the commands whose
+// runs are slow enough to resume.
+const checkpointUsage = "If set, the path of a file to record each completed test in, from which an interrupted run resumes. It's removed once the results are written"
+
+// A checkpoint file is a line of JSON per record: a checkpointHeader, and then
+// a checkpointEntry per completed test, appended as each completes. A run
+// that's interrupted may leave the last line incomplete, and it's cut off
+// when the checkpoint is resumed, so that the next entry starts a line.
+type checkpointHeader struct {
+	// Verifier is the user agent of the verifier that completed the
+	// tests, since they can't be resumed with another.
+	Verifier    string `json:"verifier"`
+	TestVersion int    `json:"testVersion"`
+}
+
+type checkpointEntry struct {
+	Id      int  `json:"id"`
+	TestDNS bool `json:"testDNS"`
+	// Failed and Error are whether the test failed and why or, for the
+	// probe commands, Accepted and Error are whether the client accepted
+	// the certificate and why the last connection without a request
+	// failed.
+	Failed   bool   `json:"failed,omitempty"`
+	Accepted bool   `json:"accepted,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Result is the test's result as recorded when it completed, of which
+	// the half for its name type is restored.
+	Result *testResult `json:"result,omitempty"`
+}
+
+// checkpoint records the tests that a run has completed, and those that an
+// earlier, interrupted run did. A nil *checkpoint records nothing, and
+// resumes nothing.
+type checkpoint struct {
+	path string
+
+	lock sync.Mutex
+	file *os.File
+	// done holds the entries read from the file when it was opened.
+	done map[probeKey]*checkpointEntry
+	// err is the first error writing to the file, after which nothing
+	// more is written.
+	err error
+}
+
+// openCheckpoint opens the checkpoint at path, creating it if it doesn't
+// exist, for a run of verifier, as named by its user agent, over corpus
+// version testVersion. It returns nil if path is empty.
+func openCheckpoint(path, verifier string, testVersion int) (*checkpoint, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+
+	c := &checkpoint{path: path, done: make(map[probeKey]*checkpointEntry)}
+	header := checkpointHeader{Verifier: verifier, TestVersion: testVersion}
+
+	// end is the length of the complete lines of the file.
+	var end int64
+	file, err := os.Open(path)
+	if err == nil {
+		end, err = c.read(file, header)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if c.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+		return nil, err
+	}
+	if len(c.done) == 0 {
+		// The file is new, or was interrupted before any test
+		// completed, so it's started afresh.
+		if err := c.file.Truncate(0); err != nil {
+			c.file.Close()
+			return nil, err
+		}
+		if err := c.append(header); err != nil {
+			c.file.Close()
+			return nil, err
+		}
+	} else {
+		if err := c.file.Truncate(end); err != nil {
+			c.file.Close()
+			return nil, err
+		}
+		fmt.Printf("Resuming from %s, in which %d tests were completed\n", path, len(c.done))
+	}
+	return c, nil
+}
+
+// read loads the entries of the checkpoint in file, which must have been
+// written with header, and returns the length of its complete lines. A line
+// that isn't valid JSON, which an incomplete line left by an older version
+// could have run into, is skipped.
+func (c *checkpoint) read(file *os.File, header checkpointHeader) (end int64, err error) {
+	reader := bufio.NewReader(file)
+	line, err := reader.ReadBytes('\n')
+	if err == io.EOF {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var got checkpointHeader
+	if err := json.Unmarshal(line, &got); err != nil {
+		return 0, err
+	}
+	if got != header {
+		return 0, fmt.Errorf("the checkpoint is of %q on corpus version %d, not %q on version %d; remove it to start again", got.Verifier, got.TestVersion, header.Verifier, header.TestVersion)
+	}
+	end = int64(len(line))
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// The last line is incomplete, or there's none.
+			return end, nil
+		} else if err != nil {
+			return 0, err
+		}
+		end += int64(len(line))
+
+		entry := new(checkpointEntry)
+		if err := json.Unmarshal(line, entry); err != nil {
+			continue
+		}
+		c.done[probeKey{entry.Id, entry.TestDNS}] = entry
+	}
+}
+
+func (c *checkpoint) append(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = c.file.Write(append(line, '\n'))
+	return err
+}
+
+// restore restores the outcome of test from the checkpoint, if an earlier
+// run completed it, into recorder and test.err. It returns whether the test
+// was restored, and if so whether it failed.
+func (c *checkpoint) restore(test *expectation, recorder *resultRecorder) (failed, ok bool) {
+	if c == nil {
+		return false, false
+	}
+	entry, ok := c.done[probeKey{test.Id, test.testDNS}]
+	if !ok {
+		return false, false
+	}
+
+	if entry.Result != nil {
+		recorder.restore(entry.Result, test.testDNS)
+	}
+	test.err = nil
+	if len(entry.Error) > 0 {
+		test.err = errors.New(entry.Error)
+	}
+	return entry.Failed, true
+}
+
+// complete records that test has completed, with the result recorded for it
+// by recorder.
+func (c *checkpoint) complete(test *expectation, failed bool, recorder *resultRecorder) {
+	if c == nil {
+		return
+	}
+
+	entry := &checkpointEntry{Id: test.Id, TestDNS: test.testDNS, Failed: failed, Result: recorder.resultOf(test.Id)}
+	if test.err != nil {
+		entry.Error = test.err.Error()
+	}
+	c.write(entry)
+}
+
+// write appends entry to the checkpoint, unless writing has already failed.
+func (c *checkpoint) write(entry *checkpointEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err == nil {
+		c.err = c.append(entry)
+	}
+}
+
+// restoreProbes restores the outcomes of the tests that the checkpoint holds
+// into p, for the probe commands, and notes them as resumed so that they
+// aren't probed again.
+func (c *checkpoint) restoreProbes(p *prober) {
+	if c == nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.checkpoint = c
+	p.resumed = make(map[probeKey]bool)
+	for key, entry := range c.done {
+		outcome := &probeOutcome{accepted: entry.Accepted}
+		if len(entry.Error) > 0 {
+			outcome.err = errors.New(entry.Error)
+		}
+		p.outcomes[key] = outcome
+		p.resumed[key] = true
+	}
+}
+
+// completeProbe records the outcome of the connections to test key so far.
+func (c *checkpoint) completeProbe(key probeKey, outcome *probeOutcome) {
+	if c == nil {
+		return
+	}
+
+	entry := &checkpointEntry{Id: key.id, TestDNS: key.testDNS, Accepted: outcome.accepted}
+	if outcome.err != nil {
+		entry.Error = outcome.err.Error()
+	}
+	c.write(entry)
+}
+
+// wrap returns a test function for runPipeline that restores the tests that
+// the checkpoint holds and runs the rest with test, recording them.
+func (c *checkpoint) wrap(recorder *resultRecorder, test func(test *expectation) (failed bool)) func(test *expectation) (failed bool) {
+	if c == nil {
+		return test
+	}
+	return func(t *expectation) bool {
+		if failed, ok := c.restore(t, recorder); ok {
+			return failed
+		}
+		failed := test(t)
+		c.complete(t, failed, recorder)
+		return failed
+	}
+}
+
+// finish removes the checkpoint once the run's results have been written, so
+// that the next run starts afresh. It reports an error if recording a test
+// failed, in which case the checkpoint is kept.
+func (c *checkpoint) finish() error {
+	if c == nil {
+		return nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.file.Close()
+	if c.err != nil {
+		return fmt.Errorf("recording completed tests in %s: %v", c.path, c.err)
+	}
+	return os.Remove(c.path)
+}
+
+// close closes the checkpoint, keeping it, for runs that end early.
+func (c *checkpoint) close() {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.file.Close()
+}
@@ -0,0 +1,224 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// outputUsage is the usage of the -output flag of the run command.
+const outputUsage = "If set, also write the main corpus's results for CI result viewers: \"junit\", as JUnit XML, or \"tap\", in the Test Anything Protocol"
+
+// defaultOutputFiles are the files that -output writes to if -output-file
+// isn't set.
+var defaultOutputFiles = map[string]string{
+	"junit": "bettertls-junit.xml",
+	"tap":   "bettertls.tap",
+}
+
+// ciCase is a single verification of the main corpus, as reported to a CI
+// system.
+type ciCase struct {
+	name string
+	// classname groups tests by the features of the name under test, e.g.
+	// "bettertls.permitted+excluded.dnsInSan".
+	classname string
+	elapsed   time.Duration
+	// failure describes why the test failed, if it did.
+	failure string
+	// details are the test's descriptions.
+	details string
+	skipped bool
+}
+
+// ciCases returns a case for each verification of each test in expectations,
+// as recorded by recorder, of which failures failed.
+func ciCases(expectations *expectations, failures []expectation, recorder *resultRecorder) []ciCase {
+	recorder.Lock()
+	defer recorder.Unlock()
+
+	type key struct {
+		id      int
+		testDNS bool
+	}
+	failed := make(map[key]error)
+	for _, failure := range failures {
+		failed[key{failure.Id, failure.testDNS}] = failure.err
+	}
+
+	var cases []ciCase
+	for i := range expectations.Expects {
+		e := &expectations.Expects[i]
+		for _, testDNS := range []bool{true, false} {
+			c := ciCase{
+				name:      fmt.Sprintf("#%d IP", e.Id),
+				classname: "bettertls." + e.Features.ConstraintType + "." + namePlacement(&e.Features, testDNS),
+				details:   strings.Join(e.descriptions(), " "),
+			}
+			if testDNS {
+				c.name = fmt.Sprintf("#%d DNS", e.Id)
+			}
+
+			ran := false
+			if result, ok := recorder.results[e.Id]; ok {
+				_, ran, _ = result.result(testDNS)
+				c.elapsed = time.Duration(result.DNSNanos)
+				if !testDNS {
+					c.elapsed = time.Duration(result.IPNanos)
+				}
+			}
+
+			if err, ok := failed[key{e.Id, testDNS}]; ok {
+				c.failure = fmt.Sprint(err)
+			} else if !ran {
+				c.skipped = true
+			}
+			cases = append(cases, c)
+		}
+	}
+	return cases
+}
+
+// namePlacement names where the name under test appears in the leaf:
+// "dnsInSan", "dnsInCn", both joined with "+", or "dnsAbsent", and likewise
+// for IP addresses.
+func namePlacement(f *features, testDNS bool) string {
+	prefix, inSAN, inCN := "ip", f.IPInSAN, f.IPInCN
+	if testDNS {
+		prefix, inSAN, inCN = "dns", f.DNSInSAN, f.DNSInCN
+	}
+
+	var places []string
+	if inSAN {
+		places = append(places, prefix+"InSan")
+	}
+	if inCN {
+		places = append(places, prefix+"InCn")
+	}
+	if len(places) == 0 {
+		return prefix + "Absent"
+	}
+	return strings.Join(places, "+")
+}
+
+// writeCIOutput writes the results of the main corpus in format to path. See
+// ciCases for the arguments.
+func writeCIOutput(format, path string, expectations *expectations, failures []expectation, recorder *resultRecorder) error {
+	if len(path) == 0 {
+		path = defaultOutputFiles[format]
+	}
+
+	cases := ciCases(expectations, failures, recorder)
+
+	var output []byte
+	var err error
+	switch format {
+	case "junit":
+		output, err = junitOutput(cases, recorder.userAgent)
+	case "tap":
+		output = tapOutput(cases)
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, output, 0644)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitOutput returns cases as a JUnit XML report with a single test suite,
+// named after the verifier.
+func junitOutput(cases []ciCase, verifier string) ([]byte, error) {
+	suite := junitTestSuite{Name: "BetterTLS name constraints (" + verifier + ")"}
+	var total time.Duration
+	for _, c := range cases {
+		testCase := junitTestCase{Name: c.name, Classname: c.classname, Time: junitSeconds(c.elapsed)}
+		switch {
+		case len(c.failure) > 0:
+			testCase.Failure = &junitFailure{Message: c.failure, Text: c.details}
+			suite.Failures++
+		case c.skipped:
+			testCase.Skipped = &struct{}{}
+			suite.Skipped++
+		}
+		suite.Cases = append(suite.Cases, testCase)
+		total += c.elapsed
+	}
+	suite.Tests = len(cases)
+	suite.Time = junitSeconds(total)
+
+	output, err := xml.MarshalIndent(&junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(output, '\n')...), nil
+}
+
+func junitSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 6, 64)
+}
+
+// tapOutput returns cases as a TAP version 13 report, with the failure and
+// classname of each failed test in a YAML block.
+func tapOutput(cases []ciCase) []byte {
+	var output bytes.Buffer
+	fmt.Fprintf(&output, "TAP version 13\n1..%d\n", len(cases))
+	for i, c := range cases {
+		switch {
+		case len(c.failure) > 0:
+			fmt.Fprintf(&output, "not ok %d - %s\n", i+1, c.name)
+			fmt.Fprintf(&output, "  ---\n  message: %s\n  classname: %s\n  details: %s\n  ...\n", strconv.Quote(c.failure), strconv.Quote(c.classname), strconv.Quote(c.details))
+		case c.skipped:
+			fmt.Fprintf(&output, "ok %d - %s # SKIP not run\n", i+1, c.name)
+		default:
+			fmt.Fprintf(&output, "ok %d - %s\n", i+1, c.name)
+		}
+	}
+	return output.Bytes()
+}
@@ -0,0 +1,338 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runClientAuth implements the client-auth command, which verifies each
+// test's leaf and chain as a TLS client certificate rather than a server
+// certificate. Name constraints apply to client certificates too, but the
+// client auth path is rarely exercised and isn't matched against a name, so
+// verifiers often handle it differently.
+//
+// By default the harness is a TLS server that requires client certificates,
+// verified by crypto/tls, and presents each chain to itself over an
+// in-memory connection. With -target, it instead presents each chain to a
+// server under test that requires client certificates. Attempts that fail
+// because the server couldn't be reached are retried, and tests that only
+// completed on a retry are tagged as flaky in the results file.
+//
+// Each chain is presented under each of the TLS versions given by
+// -tls-versions, TLS 1.2 and 1.3 by default, since some stacks process
+// certificates along different paths for each, and each handshake is graded
+// on its own. The results file records the outcome, cipher suite and ALPN
+// protocol of each.
+func runClientAuth(args []string) error {
+	flags := flag.NewFlagSet("client-auth", flag.ExitOnError)
+	target := flags.String("target", "", "If set, the host:port of a TLS server under test, which requires client certificates issued under certificates/root.crt, to present each chain to")
+	serverName := flags.String("server-name", "", "The name to send in SNI to the -target server, which defaults to its host")
+	versionList := flags.String("tls-versions", "1.2,1.3", "A comma-separated list of the TLS versions to present each chain under")
+	resultsPath := flags.String("results", "", "If set, the path to write a results file to")
+	resultsKeyPath := flags.String("results-key", "", resultsKeyUsage)
+	numWorkers := flags.Int("workers", defaultWorkers, workersUsage)
+	flags.DurationVar(&limits.timeout, "timeout", limits.timeout, "The longest time to wait for each handshake")
+	var retry retryPolicy
+	flags.IntVar(&retry.retries, "retries", 2, "The number of times to retry presenting a chain to the -target server if it can't be reached or times out")
+	flags.DurationVar(&retry.backoff, "retry-backoff", 500*time.Millisecond, "The wait before the first retry, which doubles for each retry after it")
+	archivePath := flags.String("corpus-archive", "", corpusArchiveUsage)
+	flags.Parse(args)
+
+	versions, err := parseTLSVersions(*versionList)
+	if err != nil {
+		return err
+	}
+
+	resultsKey, err := loadResultsKey(*resultsKeyPath)
+	if err != nil {
+		return err
+	}
+
+	if err := openCorpusArchive(*archivePath); err != nil {
+		return err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	expectations, err := loadExpectations()
+	if err != nil {
+		return err
+	}
+	if len(expectations.Expects) > 0 && expectations.Expects[0].ClientAuth == nil {
+		return errors.New("expects.json has no client auth expectations; run defineExpects.js again")
+	}
+
+	recorder := newResultRecorder(deliveryPool)
+	recorder.setSigningKey(resultsKey)
+
+	var present func(cert tls.Certificate, version uint16) (tls.ConnectionState, error)
+	if len(*target) > 0 {
+		if len(*serverName) == 0 {
+			if *serverName, _, err = net.SplitHostPort(*target); err != nil {
+				return err
+			}
+		}
+		present = func(cert tls.Certificate, version uint16) (tls.ConnectionState, error) {
+			return presentClientCertificate(*target, *serverName, cert, version)
+		}
+		recorder.userAgent = "client auth server at " + *target
+		recorder.setImplementation(recorder.userAgent, "")
+		// The server's errors only reach the client as TLS alerts,
+		// which can't be classified.
+		recorder.taxonomy = ""
+	} else {
+		roots, err := readPEMChain(filepath.Join(certificatesDir, "root.crt"))
+		if err != nil {
+			return err
+		}
+		serverConfig, err := clientAuthServerConfig(roots)
+		if err != nil {
+			return err
+		}
+		present = func(cert tls.Certificate, version uint16) (tls.ConnectionState, error) {
+			return verifyClientCertificate(serverConfig, cert, version)
+		}
+		recorder.userAgent = "Go crypto/tls " + runtime.Version()
+		recorder.setImplementation("Go crypto/tls", runtime.Version())
+		recorder.taxonomy = "go"
+	}
+	fmt.Printf("Testing %s\n", recorder.userAgent)
+
+	group := newWorkerGroup(*numWorkers)
+	var lock sync.Mutex
+	var numFailures int
+
+	for _, test := range expectations.Expects {
+		for _, version := range versions {
+			test, version := test, version
+			group.run(func() {
+				versionName := tls.VersionName(version)
+				cert, err := loadTestCertificate(test.Id)
+				if err != nil {
+					test.err = err
+				} else {
+					var state tls.ConnectionState
+					verifyErr, retries := retry.run(func() (err error) {
+						state, err = present(cert, version)
+						return err
+					})
+					switch {
+					case isTransient(verifyErr):
+						// An unreachable server says nothing about
+						// the certificate, so the test is skipped
+						// rather than failed.
+						recorder.recordSkip(&skip{skipNetworkError, "the server couldn't be reached after retrying"})
+						lock.Lock()
+						fmt.Printf("#%d: skipped for client auth over %s after %d retries: %v\n", test.Id, versionName, retries, verifyErr)
+						lock.Unlock()
+						return
+					case isVersionUnsupported(verifyErr):
+						recorder.recordSkip(&skip{skipCapabilityMissing, "the server doesn't support " + versionName})
+						return
+					}
+					recorder.recordClientAuth(&test, versionName, state, verifyErr, retries)
+					if passed, description := gradeResult(test.ClientAuth, verifyErr == nil, errorReasonOf(recorder.taxonomy, verifyErr)); !passed {
+						test.err = fmt.Errorf("%s: %v", description, verifyErr)
+					}
+				}
+				if test.err == nil {
+					return
+				}
+
+				lock.Lock()
+				numFailures++
+				fmt.Printf("#%d: failed for client auth over %s:\n  %q\n  %q\n", test.Id, versionName, test.err, strings.Join(append(append([]string(nil), test.Descriptions...), test.ClientAuth.Descriptions...), " "))
+				lock.Unlock()
+			})
+		}
+	}
+	group.wait()
+
+	recorder.printSkips()
+
+	if len(*resultsPath) > 0 {
+		if err := recorder.write(*resultsPath, config.TestVersion); err != nil {
+			return err
+		}
+	}
+
+	if numFailures != 0 {
+		return fmt.Errorf("failed %d of %d handshakes", numFailures, len(expectations.Expects)*len(versions))
+	}
+
+	return nil
+}
+
+// parseTLSVersions parses a comma-separated list of TLS versions, such as
+// "1.2,1.3".
+func parseTLSVersions(list string) ([]uint16, error) {
+	var versions []uint16
+	for _, name := range strings.Split(list, ",") {
+		switch strings.TrimSpace(name) {
+		case "1.0":
+			versions = append(versions, tls.VersionTLS10)
+		case "1.1":
+			versions = append(versions, tls.VersionTLS11)
+		case "1.2":
+			versions = append(versions, tls.VersionTLS12)
+		case "1.3":
+			versions = append(versions, tls.VersionTLS13)
+		default:
+			return nil, fmt.Errorf("unknown TLS version %q", name)
+		}
+	}
+	return versions, nil
+}
+
+// isVersionUnsupported returns whether err is from a handshake that failed
+// because the other side doesn't support the TLS version offered, which says
+// nothing about the certificate.
+func isVersionUnsupported(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "protocol version")
+}
+
+// clientAuthServerConfig returns the configuration of a TLS server that
+// requires client certificates issued under roots. Its own certificate is a
+// throwaway, since the client doesn't verify it.
+func clientAuthServerConfig(roots []*x509.Certificate) (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "BetterTLS client auth server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	clientCAs := x509.NewCertPool()
+	for _, root := range roots {
+		clientCAs.AddCert(root)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		NextProtos:   []string{"http/1.1"},
+		// Older versions are only offered if asked for with
+		// -tls-versions.
+		MinVersion: tls.VersionTLS10,
+		// Tickets would be written while the client is writing its
+		// certificate, which deadlocks over a net.Pipe.
+		SessionTicketsDisabled: true,
+	}, nil
+}
+
+// verifyClientCertificate presents cert to a crypto/tls server with
+// serverConfig over an in-memory connection, under TLS version, and returns
+// the server's view of the handshake and the error that it rejected cert
+// with, if any.
+func verifyClientCertificate(serverConfig *tls.Config, cert tls.Certificate, version uint16) (tls.ConnectionState, error) {
+	clientConn, serverConn := net.Pipe()
+	deadline := time.Now().Add(limits.timeout)
+	clientConn.SetDeadline(deadline)
+	serverConn.SetDeadline(deadline)
+
+	client := tls.Client(clientConn, clientAuthClientConfig(cert, "", version))
+	go func() {
+		// Reading until the server closes the connection takes any
+		// alert that it sends, so that it doesn't block writing it.
+		if client.Handshake() == nil {
+			io.Copy(ioutil.Discard, client)
+		}
+		clientConn.Close()
+	}()
+
+	server := tls.Server(serverConn, serverConfig)
+	defer server.Close()
+	err := server.Handshake()
+	return server.ConnectionState(), err
+}
+
+// presentClientCertificate connects to the server at addr, presenting cert
+// as its client certificate under TLS version, and returns the client's view
+// of the handshake and an error if the server rejected cert. With TLS 1.3, a
+// server rejects a client certificate after the client's side of the
+// handshake is complete, so the certificate only counts as accepted once the
+// server has answered a request.
+func presentClientCertificate(addr, serverName string, cert tls.Certificate, version uint16) (tls.ConnectionState, error) {
+	conn, err := net.DialTimeout("tcp", addr, limits.timeout)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(limits.timeout))
+
+	client := tls.Client(conn, clientAuthClientConfig(cert, serverName, version))
+	if err := client.Handshake(); err != nil {
+		return client.ConnectionState(), err
+	}
+	state := client.ConnectionState()
+
+	if _, err := fmt.Fprintf(client, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", serverName); err != nil {
+		return state, err
+	}
+	response, err := ioutil.ReadAll(io.LimitReader(client, 1))
+	if len(response) > 0 {
+		return state, nil
+	}
+	if err == nil {
+		err = errors.New("the server closed the connection without answering")
+	}
+	return state, err
+}
+
+// clientAuthClientConfig returns the configuration of a client that presents
+// cert, and offers only TLS version and HTTP/1.1 over ALPN, since it speaks
+// nothing else.
+func clientAuthClientConfig(cert tls.Certificate, serverName string, version uint16) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ServerName:   serverName,
+		MinVersion:   version,
+		MaxVersion:   version,
+		NextProtos:   []string{"http/1.1"},
+		// Only the server's verification of the client is under test.
+		InsecureSkipVerify: true,
+	}
+}
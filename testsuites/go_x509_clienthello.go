@@ -0,0 +1,270 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// clientHello describes the ClientHellos that a live client sent with one
+// fingerprint, so that results can be told apart by the TLS stack that
+// produced them rather than by the user agent that the client reports.
+type clientHello struct {
+	// JA3 is the client's JA3 string and JA3Hash its MD5 hash, the usual
+	// form of a JA3 fingerprint. JA4 is its JA4 fingerprint.
+	JA3     string `json:"ja3"`
+	JA3Hash string `json:"ja3Hash"`
+	JA4     string `json:"ja4"`
+	// Versions and ALPN are the TLS versions and application protocols
+	// offered, in the client's order of preference.
+	Versions []string `json:"versions"`
+	ALPN     []string `json:"alpn,omitempty"`
+	// Connections counts the connections whose ClientHellos had this
+	// fingerprint, and SNIConnections those of them that sent SNI.
+	// JA3 ignores SNI, and JA4 only notes whether it was sent, so the
+	// two are counted together.
+	Connections    int `json:"connections"`
+	SNIConnections int `json:"sniConnections"`
+}
+
+// Extensions that JA4 treats specially.
+const (
+	extensionServerName        = 0x0000
+	extensionALPN              = 0x0010
+	extensionSupportedVersions = 0x002b
+)
+
+// isGREASE returns whether v is one of the GREASE values of RFC 8701, which
+// clients send at random and which fingerprints leave out.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	var ret []uint16
+	for _, v := range values {
+		if !isGREASE(v) {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// fingerprintClientHello returns the description of hello, counting it as
+// one connection.
+func fingerprintClientHello(hello *tls.ClientHelloInfo) *clientHello {
+	versions := withoutGREASE(hello.SupportedVersions)
+	var versionNames []string
+	for _, version := range versions {
+		versionNames = append(versionNames, tls.VersionName(version))
+	}
+
+	ret := &clientHello{
+		JA3:         ja3(hello),
+		JA4:         ja4(hello, versions),
+		Versions:    versionNames,
+		ALPN:        hello.SupportedProtos,
+		Connections: 1,
+	}
+	hash := md5.Sum([]byte(ret.JA3))
+	ret.JA3Hash = hex.EncodeToString(hash[:])
+	if len(hello.ServerName) > 0 {
+		ret.SNIConnections = 1
+	}
+	return ret
+}
+
+// ja3 returns the JA3 string of hello: its version, cipher suites, extensions,
+// curves and point formats, in decimal. crypto/tls doesn't give the
+// ClientHello's legacy version, but a client that sends supported_versions
+// must set it to TLS 1.2, and for one that doesn't, crypto/tls gives the
+// versions up to it.
+func ja3(hello *tls.ClientHelloInfo) string {
+	extensions := withoutGREASE(hello.Extensions)
+	var version uint16 = tls.VersionTLS12
+	if !containsUint16(extensions, extensionSupportedVersions) {
+		version = 0
+		for _, v := range hello.SupportedVersions {
+			if v > version {
+				version = v
+			}
+		}
+	}
+
+	var curves []uint16
+	for _, curve := range hello.SupportedCurves {
+		curves = append(curves, uint16(curve))
+	}
+	var points []uint16
+	for _, point := range hello.SupportedPoints {
+		points = append(points, uint16(point))
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(version)),
+		joinDecimal(withoutGREASE(hello.CipherSuites)),
+		joinDecimal(extensions),
+		joinDecimal(withoutGREASE(curves)),
+		joinDecimal(points),
+	}, ",")
+}
+
+// ja4 returns the JA4 fingerprint of hello, which offered versions, e.g.
+// "t13d1516h2_8daaf6152771_e5627efa2ab1": the transport, the highest version
+// offered, whether SNI was sent, the numbers of cipher suites and extensions
+// and the first ALPN protocol, then truncated SHA-256 hashes of the sorted
+// cipher suites, and of the sorted extensions followed by the signature
+// algorithms.
+func ja4(hello *tls.ClientHelloInfo, versions []uint16) string {
+	var highest uint16
+	for _, v := range versions {
+		if v > highest {
+			highest = v
+		}
+	}
+	version := "00"
+	switch highest {
+	case tls.VersionTLS13:
+		version = "13"
+	case tls.VersionTLS12:
+		version = "12"
+	case tls.VersionTLS11:
+		version = "11"
+	case tls.VersionTLS10:
+		version = "10"
+	case tls.VersionSSL30:
+		version = "s3"
+	}
+
+	sni := "i"
+	if len(hello.ServerName) > 0 {
+		sni = "d"
+	}
+
+	alpn := "00"
+	if len(hello.SupportedProtos) > 0 && len(hello.SupportedProtos[0]) > 0 {
+		first := hello.SupportedProtos[0]
+		if isAlphanumeric(first[0]) && isAlphanumeric(first[len(first)-1]) {
+			alpn = string(first[0]) + string(first[len(first)-1])
+		} else {
+			alpn = hex.EncodeToString([]byte{first[0]})[:1] + hex.EncodeToString([]byte{first[len(first)-1]})[1:]
+		}
+	}
+
+	ciphers := withoutGREASE(hello.CipherSuites)
+	extensions := withoutGREASE(hello.Extensions)
+	var hashedExtensions []uint16
+	for _, extension := range extensions {
+		if extension != extensionServerName && extension != extensionALPN {
+			hashedExtensions = append(hashedExtensions, extension)
+		}
+	}
+	var signatureSchemes []uint16
+	for _, scheme := range hello.SignatureSchemes {
+		signatureSchemes = append(signatureSchemes, uint16(scheme))
+	}
+	signatureSchemes = withoutGREASE(signatureSchemes)
+
+	extensionsPart := joinHex(sortedUint16s(hashedExtensions))
+	if len(signatureSchemes) > 0 {
+		extensionsPart += "_" + joinHex(signatureSchemes)
+	}
+
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s", version, sni, min(len(ciphers), 99), min(len(extensions), 99), alpn,
+		truncatedHash(len(ciphers) > 0, joinHex(sortedUint16s(ciphers))),
+		truncatedHash(len(hashedExtensions) > 0, extensionsPart))
+}
+
+// truncatedHash returns the first 12 hex digits of the SHA-256 hash of s or,
+// if there was nothing to hash, zeros, as JA4 does.
+func truncatedHash(nonEmpty bool, s string) string {
+	if !nonEmpty {
+		return "000000000000"
+	}
+	hash := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(hash[:])[:12]
+}
+
+func isAlphanumeric(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func containsUint16(values []uint16, v uint16) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedUint16s(values []uint16) []uint16 {
+	ret := append([]uint16(nil), values...)
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+func joinDecimal(values []uint16) string {
+	var parts []string
+	for _, v := range values {
+		parts = append(parts, strconv.Itoa(int(v)))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	var parts []string
+	for _, v := range values {
+		parts = append(parts, fmt.Sprintf("%04x", v))
+	}
+	return strings.Join(parts, ",")
+}
+
+// clientHelloLog collects the fingerprints of the ClientHellos that a live
+// client sends. Its methods must be called with the lock of its owner held.
+type clientHelloLog map[string]*clientHello
+
+// add counts hello under its fingerprint.
+func (l clientHelloLog) add(hello *clientHello) {
+	key := hello.JA4 + " " + hello.JA3Hash
+	if seen, ok := l[key]; ok {
+		seen.Connections += hello.Connections
+		seen.SNIConnections += hello.SNIConnections
+		return
+	}
+	l[key] = hello
+}
+
+// list returns the fingerprints, the most common first.
+func (l clientHelloLog) list() []clientHello {
+	var ret []clientHello
+	for _, hello := range l {
+		ret = append(ret, *hello)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Connections != ret[j].Connections {
+			return ret[i].Connections > ret[j].Connections
+		}
+		return ret[i].JA4 < ret[j].JA4
+	})
+	return ret
+}
@@ -0,0 +1,180 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// cnPolicyUsage is the usage of the -cn-policy flag of the commands that run
+// the main corpus.
+const cnPolicyUsage = "The Common Name fallback policy to verify under: \"allowed\", matching the Common Name when the leaf has no subjectAltName extension, or \"ignored\", never matching it. The results are then graded by the rfcStrict or browser profile. By default the verifier's own policy is used and the usual expectations apply"
+
+// Common Name fallback policies, as recorded in results files.
+const (
+	cnAllowed = "allowed"
+	cnIgnored = "ignored"
+)
+
+// cnFallbackPolicy is a policy for matching the name under test against the
+// leaf's Common Name. The corpus varies whether names are in the Common Name,
+// the SANs or both, so the policy decides many of its results.
+type cnFallbackPolicy struct {
+	name string
+	// profile is the policy profile in expects.json whose results are
+	// those expected under the policy.
+	profile string
+}
+
+var cnFallbackPolicies = map[string]*cnFallbackPolicy{
+	cnAllowed: {name: cnAllowed, profile: "rfcStrict"},
+	cnIgnored: {name: cnIgnored, profile: "browser"},
+}
+
+// cnPolicy is the policy set by -cn-policy, or nil if the verifier's own is
+// used.
+var cnPolicy *cnFallbackPolicy
+
+// selectCNPolicy sets cnPolicy to the policy called name, or to nil if name is
+// empty.
+func selectCNPolicy(name string) error {
+	if len(name) == 0 {
+		cnPolicy = nil
+		return nil
+	}
+	p, ok := cnFallbackPolicies[name]
+	if !ok {
+		return fmt.Errorf("unknown Common Name policy %q; the policies are %s and %s", name, cnAllowed, cnIgnored)
+	}
+	cnPolicy = p
+	return nil
+}
+
+// cnPolicyName returns the name of the policy in effect for results files:
+// that of -cn-policy if it was given, or native, the verifier's own.
+func cnPolicyName(native string) string {
+	if cnPolicy != nil {
+		return cnPolicy.name
+	}
+	return native
+}
+
+// expectation returns the expectation that test's verification, of its DNS
+// name if testDNS is set and otherwise of its IP address, is graded against
+// under the policy: the profile's definite result.
+func (p *cnFallbackPolicy) expectation(test *expectation, testDNS bool) (*expectedResult, error) {
+	results, ok := test.Profiles[p.profile]
+	if !ok {
+		return nil, fmt.Errorf("expects.json has no %s profile, which -cn-policy %s is graded by; the corpus was generated by an older defineExpects.js and should be regenerated", p.profile, p.name)
+	}
+	result := results.IP
+	if testDNS {
+		result = results.DNS
+	}
+	return &expectedResult{Result: result, Descriptions: []string{"The result expected under the " + p.profile + " profile."}}, nil
+}
+
+// hasSANExtension returns whether leaf has a subjectAltName extension, with
+// whatever names.
+func hasSANExtension(leaf *x509.Certificate) bool {
+	for _, ext := range leaf.Extensions {
+		if ext.Id.Equal(oidExtensionSubjectAltName) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyWithCNFallback implements the allowed policy for crypto/x509, which
+// never matches the Common Name. verify verifies the chain for a DNS name, or
+// for no name if it's given "". If crypto/x509 rejects the leaf for hostname
+// only because the name isn't in its SANs and it has no subjectAltName
+// extension, the chain is verified without a name and the Common Name is
+// matched instead, and checked against chain's DNS name constraints, which
+// crypto/x509 doesn't apply to it.
+func verifyWithCNFallback(verify func(name string) error, leaf *x509.Certificate, chain []*x509.Certificate, hostname string) error {
+	err := verify(hostname)
+	var hostnameErr x509.HostnameError
+	if err == nil || !errors.As(err, &hostnameErr) || hasSANExtension(leaf) || net.ParseIP(hostname) != nil {
+		return err
+	}
+	if !nssMatchHostname(leaf.Subject.CommonName, hostname) {
+		return err
+	}
+
+	if err := verify(""); err != nil {
+		return err
+	}
+	for _, cert := range chain {
+		if violated, constraint := violatesDNSConstraints(cert, leaf.Subject.CommonName); violated {
+			return x509.CertificateInvalidError{
+				Cert:   leaf,
+				Reason: x509.CANotAuthorizedForThisName,
+				Detail: fmt.Sprintf("DNS name %q in the Common Name is not permitted by %s", leaf.Subject.CommonName, constraint),
+			}
+		}
+	}
+	return nil
+}
+
+// violatesDNSConstraints returns whether name violates cert's DNS name
+// constraints and, if so, which.
+func violatesDNSConstraints(cert *x509.Certificate, name string) (violated bool, constraint string) {
+	for _, excluded := range cert.ExcludedDNSDomains {
+		if matchesDNSConstraint(excluded, name) {
+			return true, fmt.Sprintf("the excluded constraint %q", excluded)
+		}
+	}
+	if len(cert.PermittedDNSDomains) == 0 {
+		return false, ""
+	}
+	for _, permitted := range cert.PermittedDNSDomains {
+		if matchesDNSConstraint(permitted, name) {
+			return false, ""
+		}
+	}
+	return true, "any permitted constraint"
+}
+
+// matchesDNSConstraint returns whether name is within the DNS name constraint,
+// as crypto/x509 matches SANs: a constraint with a leading period covers only
+// subdomains, and one without covers the name itself and its subdomains.
+func matchesDNSConstraint(constraint, name string) bool {
+	constraint, name = strings.ToLower(constraint), strings.ToLower(name)
+	if len(constraint) == 0 {
+		return true
+	}
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(name, constraint)
+	}
+	return name == constraint || strings.HasSuffix(name, "."+constraint)
+}
+
+// nameInSANs implements the ignored policy for verifiers that fall back to the
+// Common Name. It returns an error if the DNS name hostname isn't in leaf's
+// DNS SANs, starting with mismatch, the verifier's identifier for a hostname
+// mismatch, so that it's classified as one.
+func nameInSANs(leaf *x509.Certificate, hostname, mismatch string) error {
+	for _, san := range leaf.DNSNames {
+		if nssMatchHostname(san, hostname) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: %s is only in the Common Name, which -cn-policy %s disregards", mismatch, hostname, cnIgnored)
+}
@@ -0,0 +1,101 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+)
+
+// knownResults are the expected results understood by this harness.
+var knownResults = map[string]bool{
+	"OK":      true,
+	"ERROR":   true,
+	"WEAK-OK": true,
+}
+
+// checkCompatibility returns an error if the expectations are newer than this
+// harness understands. Expectations from older versions are upgraded so the
+// rest of the harness only has to handle the current version.
+func (e *expectations) checkCompatibility() error {
+	version := e.SuiteVersion
+	if version == 0 {
+		version = 1
+	}
+
+	if version > suiteVersion {
+		return fmt.Errorf("expects.json is suite version %d but this harness only understands up to version %d", version, suiteVersion)
+	}
+
+	for i := range e.Expects {
+		test := &e.Expects[i]
+		for _, result := range []string{test.DNS.Result, test.IP.Result} {
+			if !knownResults[result] {
+				return fmt.Errorf("test #%d has an unknown expected result %q", test.Id, result)
+			}
+		}
+		if test.ClientAuth != nil && !knownResults[test.ClientAuth.Result] {
+			return fmt.Errorf("test #%d has an unknown expected client auth result %q", test.Id, test.ClientAuth.Result)
+		}
+
+		if version == 1 {
+			if err := test.featuresFromDescriptions(); err != nil {
+				return err
+			}
+		}
+	}
+
+	e.SuiteVersion = suiteVersion
+	return nil
+}
+
+// featuresFromDescriptions fills in the features for an expectation from
+// version one of expects.json, which only has prose descriptions. Only the
+// features needed to evaluate DNS expectations are set.
+func (e *expectation) featuresFromDescriptions() error {
+	const (
+		cnWithSANs                = "The DNS name for this certificate exists in the common name but not in the Subject Alternate Names extension even though the extension is specified. Most implementations will fail DNS-hostname validation on this certificate."
+		dnsInCNViolation          = "The DNS name in the common name violates a name constraint. Because there is a SAN extension, this might be ignored."
+		forbiddenIPAddressPresent = "Althought the IP address is not the subject name in question, it's name constraint violation may still cause this certificate to be rejected."
+		ipInCNViolation           = "The IP in the common name violates a name constraint. Because there is a SAN extension, this might be ignored."
+		ipViolation               = "The IP in the SAN extension violates a name constraint."
+		noIPGiven                 = "There is a IP name constraint but no IP in the certificate. This isn't an explicit violation, but some implementations will fail to validate the certificate."
+	)
+
+	if e.DNS.Result != "WEAK-OK" {
+		return nil
+	}
+
+	f := &e.Features
+	descriptions := append(append([]string(nil), e.Descriptions...), e.DNS.Descriptions...)
+	for _, desc := range descriptions {
+		switch desc {
+		case cnWithSANs:
+			f.DNSInCN, f.SANPresent = true, true
+		case dnsInCNViolation:
+			f.DNSCNViolation, f.SANPresent = true, true
+		case forbiddenIPAddressPresent, ipViolation:
+			f.IPSANViolation = true
+		case ipInCNViolation:
+			f.IPCNViolation, f.SANPresent = true, true
+		case noIPGiven:
+			f.IPConstraintPresent = true
+		default:
+			// Descriptions that don't weaken the expectation
+			// don't matter here.
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// corpusTest is the DER of a test's leaf and chain, or the error that reading
+// them failed with, which fails the test rather than the run.
+type corpusTest struct {
+	leaf  []byte
+	chain [][]byte
+	err   error
+}
+
+// corpusLoader holds the certificates of every test of the main corpus in
+// memory. Each test is verified twice, for its DNS name and its IP address, so
+// reading and decoding its files once, before the run, rather than in each
+// verification, leaves the workers with little to do but verify.
+type corpusLoader struct {
+	tests map[int]*corpusTest
+}
+
+// loadCorpus reads the leaf and chain of each test in expectations with reader
+// and numWorkers goroutines.
+func loadCorpus(reader corpusReader, expectations *expectations, numWorkers int) *corpusLoader {
+	loader := &corpusLoader{tests: make(map[int]*corpusTest, len(expectations.Expects))}
+	for _, test := range expectations.Expects {
+		loader.tests[test.Id] = new(corpusTest)
+	}
+
+	var wg sync.WaitGroup
+	ids := make(chan int, numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				loader.tests[id].load(reader, id)
+			}
+		}()
+	}
+
+	for _, test := range expectations.Expects {
+		ids <- test.Id
+	}
+	close(ids)
+	wg.Wait()
+
+	return loader
+}
+
+func (t *corpusTest) load(reader corpusReader, id int) {
+	if t.leaf, t.chain, t.err = reader.test(id); t.err != nil {
+		return
+	}
+	if len(t.chain) > limits.maxChainLength {
+		t.err = fmt.Errorf("found %d certificates in the chain, more than the limit of %d", len(t.chain), limits.maxChainLength)
+	}
+}
+
+// certificates returns the DER of the leaf and chain of the test with the
+// given ID.
+func (l *corpusLoader) certificates(id int) (leaf []byte, chain [][]byte, err error) {
+	t, ok := l.tests[id]
+	if !ok {
+		return nil, nil, fmt.Errorf("test %d wasn't loaded", id)
+	}
+	if t.err != nil {
+		return nil, nil, t.err
+	}
+	return t.leaf, t.chain, nil
+}
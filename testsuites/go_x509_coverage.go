@@ -0,0 +1,211 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// coverageReport is written by the coverage command's -o flag.
+type coverageReport struct {
+	// Implementations names each results file, in the order of each
+	// clause's scores.
+	Implementations []string         `json:"implementations,omitempty"`
+	Clauses         []clauseCoverage `json:"clauses"`
+	// NumUncovered counts the verifications that exercise none of the
+	// clauses.
+	NumUncovered int `json:"numUncovered"`
+}
+
+// clauseCoverage summarises the verifications that exercise a clause.
+type clauseCoverage struct {
+	Clause string `json:"clause"`
+	// NumTests counts the verifications, of a test's DNS name or its IP,
+	// that exercise the clause.
+	NumTests int `json:"numTests"`
+	// Scores holds how each results file fared on them.
+	Scores []clauseScore `json:"scores,omitempty"`
+}
+
+// clauseScore counts the verifications of a clause that a results file ran,
+// and how many of them passed.
+type clauseScore struct {
+	Passed int `json:"passed"`
+	Ran    int `json:"ran"`
+}
+
+func (s clauseScore) String() string {
+	if s.Ran == 0 {
+		return "not run"
+	}
+	return fmt.Sprintf("%d/%d (%.1f%%)", s.Passed, s.Ran, 100*float64(s.Passed)/float64(s.Ran))
+}
+
+// clauses returns the sections of the RFCs that the test exercises: those
+// that the generator recorded or, for older corpora, those cited by its
+// features.
+func (e *expectation) clauses() []string {
+	if e.Clauses != nil {
+		return e.Clauses
+	}
+	seen := make(map[string]bool)
+	var ret []string
+	for name, value := range e.Features.values() {
+		citation, ok := featureCitations[name]
+		if !ok || value == "false" || value == "none" || seen[citation] {
+			continue
+		}
+		seen[citation] = true
+		ret = append(ret, citation)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// printCoverage implements the coverage command, which summarises which RFC
+// clauses the corpus exercises and, given results files, how each
+// implementation scored on the tests of each clause.
+func printCoverage(args []string) error {
+	flags := flag.NewFlagSet("coverage", flag.ExitOnError)
+	outputPath := flags.String("o", "", "If set, the path to write the coverage to, as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: coverage [flags] [results.json...]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	expectations, err := loadExpectations()
+	if err != nil {
+		return err
+	}
+
+	var results []*resultsFile
+	for _, path := range flags.Args() {
+		r, err := loadResults(path)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		results = append(results, r)
+	}
+
+	report := buildCoverage(expectations, results)
+	printCoverageReport(report)
+
+	if len(*outputPath) > 0 {
+		output, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(*outputPath, append(output, '\n'), 0644)
+	}
+	return nil
+}
+
+// buildCoverage grades each results file's verifications as export-report
+// does, and totals them by the clauses that each test exercises.
+func buildCoverage(expectations *expectations, results []*resultsFile) *coverageReport {
+	report := new(coverageReport)
+
+	resultMaps := make([]map[int]testResult, len(results))
+	for i, r := range results {
+		resultMaps[i] = make(map[int]testResult)
+		for _, result := range r.Results {
+			resultMaps[i][result.Id] = result
+		}
+		report.Implementations = append(report.Implementations, r.name)
+	}
+
+	byClause := make(map[string]*clauseCoverage)
+	for _, e := range expectations.Expects {
+		clauses := e.clauses()
+		for _, testDNS := range []bool{true, false} {
+			if len(clauses) == 0 {
+				report.NumUncovered++
+				continue
+			}
+
+			expected := &e.IP
+			if testDNS {
+				expected = &e.DNS
+			}
+			for _, clause := range clauses {
+				coverage := byClause[clause]
+				if coverage == nil {
+					coverage = &clauseCoverage{Clause: clause, Scores: make([]clauseScore, len(results))}
+					byClause[clause] = coverage
+				}
+				coverage.NumTests++
+			}
+
+			for i := range results {
+				result, ok := resultMaps[i][e.Id]
+				if !ok {
+					continue
+				}
+				accepted, ran, _ := result.result(testDNS)
+				if !ran {
+					continue
+				}
+				passed, _ := gradeResult(expected, accepted, result.reason(testDNS))
+				for _, clause := range clauses {
+					score := &byClause[clause].Scores[i]
+					score.Ran++
+					if passed {
+						score.Passed++
+					}
+				}
+			}
+		}
+	}
+
+	for _, coverage := range byClause {
+		report.Clauses = append(report.Clauses, *coverage)
+	}
+	sort.Slice(report.Clauses, func(i, j int) bool {
+		return report.Clauses[i].Clause < report.Clauses[j].Clause
+	})
+
+	return report
+}
+
+func printCoverageReport(report *coverageReport) {
+	width := len("Clause")
+	for _, coverage := range report.Clauses {
+		if len(coverage.Clause) > width {
+			width = len(coverage.Clause)
+		}
+	}
+
+	fmt.Printf("%-*s %8s", width, "Clause", "Tests")
+	for _, name := range report.Implementations {
+		fmt.Printf("  %-20s", name)
+	}
+	fmt.Println()
+	for _, coverage := range report.Clauses {
+		fmt.Printf("%-*s %8d", width, coverage.Clause, coverage.NumTests)
+		for _, score := range coverage.Scores {
+			fmt.Printf("  %-20s", score)
+		}
+		fmt.Println()
+	}
+	if report.NumUncovered > 0 {
+		fmt.Printf("%d verifications exercise none of these clauses.\n", report.NumUncovered)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// crossSignExpectations represents crossSignExpects.json, which
+// defineExpects.js generates when the optional cross-sign corpus is present.
+type crossSignExpectations struct {
+	Expects []crossSignExpectation
+}
+
+type crossSignExpectation struct {
+	Id int `json:"id"`
+	// Name identifies the case, e.g. "oldRootExpiredNewRootTrusted".
+	Name string `json:"name"`
+	// Presented labels the certificates presented after the leaf, in
+	// order, e.g. "intermediate" or "crossSigned".
+	Presented []string `json:"presented"`
+	// Trusted labels the roots in the test's trust store, e.g. "oldRoot"
+	// or "newRootExpired".
+	Trusted []string `json:"trusted"`
+	expectedResult
+}
+
+// runCrossSignTests runs the cross-sign tests, each of which verifies a chain
+// that can lead to an old root, through a cross-signature, or to a new one
+// against its own trust store, and returns the number of tests run and the
+// number of failures. The outcome of each test is recorded with recorder. It
+// does nothing if the cross-sign corpus hasn't been generated.
+func runCrossSignTests(hostname string, recorder *resultRecorder) (numTests, numFailures int, err error) {
+	if !profile.runsOptionalCorpus("crossSign") {
+		return 0, 0, nil
+	}
+
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(baseDir, "html", "crossSignExpects.json"))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	expectations := new(crossSignExpectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return 0, 0, err
+	}
+
+	crossSignDir := filepath.Join(baseDir, "certificates", "crosssign")
+	for _, test := range expectations.Expects {
+		pathPrefix := filepath.Join(crossSignDir, strconv.Itoa(test.Id))
+		verifyErr := verifyWithTrustStore(pathPrefix, hostname)
+		recorder.recordCrossSign(&test, verifyErr)
+
+		if passed, description := classifyResult(test.Result, verifyErr == nil); !passed {
+			fmt.Printf("cross-sign #%d (%s, trusting %s): %s%s\n", test.Id, test.Name, strings.Join(test.Trusted, ","), description, errorSuffix(errString(verifyErr)))
+			numFailures++
+		}
+	}
+
+	return len(expectations.Expects), numFailures, nil
+}
+
+// verifyWithTrustStore verifies the chain at pathPrefix, as presented, against
+// the roots at pathPrefix + ".roots" alone.
+func verifyWithTrustStore(pathPrefix, hostname string) error {
+	roots, err := readPEMChain(pathPrefix + ".roots")
+	if err != nil {
+		return err
+	}
+	if len(roots) == 0 {
+		return fmt.Errorf("found no roots in the .roots file")
+	}
+
+	rootPool := x509.NewCertPool()
+	for _, root := range roots {
+		rootPool.AddCert(root)
+	}
+	return verifyPresentedFiles(pathPrefix, hostname, rootPool)
+}
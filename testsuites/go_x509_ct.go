@@ -0,0 +1,504 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ctExpectations represents ctExpects.json, which defineExpects.js generates
+// when the optional Certificate Transparency corpus is present.
+type ctExpectations struct {
+	Expects []ctExpectation
+}
+
+type ctExpectation struct {
+	Id int `json:"id"`
+	// Delivery is how the test's SCTs reach the client: "embedded" in the
+	// certificate, in the "tls" extension, in a stapled "ocsp" response or
+	// "none" at all.
+	Delivery string `json:"delivery"`
+	// Logs names the logs that the SCTs are from, and BadSignatureLogs
+	// those of them whose SCTs have signatures that don't verify.
+	Logs             []string `json:"logs"`
+	BadSignatureLogs []string `json:"badSignatureLogs"`
+	// CTEnforcing is the expected result for clients that enforce CT,
+	// requiring SCTs from two trusted logs, and NonEnforcing that for
+	// clients that ignore SCTs.
+	CTEnforcing  expectedResult `json:"ctEnforcing"`
+	NonEnforcing expectedResult `json:"nonEnforcing"`
+}
+
+// ctLog is a local test log, as listed in certificates/ct/logs.json.
+type ctLog struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Trusted is whether the log is in the log list that the ct command
+	// serves. SCTs from other logs shouldn't count towards CT policy.
+	Trusted bool `json:"trusted"`
+	// LogID and Key are the base64 SHA-256 hash of the log's public key
+	// and the public key itself, as a DER SubjectPublicKeyInfo.
+	LogID string `json:"logId"`
+	Key   string `json:"key"`
+
+	signer crypto.Signer
+}
+
+func ctDir() string {
+	return filepath.Join(baseDir, "certificates", "ct")
+}
+
+// loadCTExpectations returns the CT expectations, or nil if the CT corpus
+// hasn't been generated.
+func loadCTExpectations() (*ctExpectations, error) {
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(baseDir, "html", "ctExpects.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	expectations := new(ctExpectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return nil, err
+	}
+	return expectations, nil
+}
+
+// runCTTests runs the CT tests against crypto/x509, graded by the expectation
+// that applies to a verifier with caps. crypto/x509 doesn't enforce CT, so
+// that the chains verify shows that the SCTs, wherever they are, don't get in
+// the way. It returns the number of tests run and the number of failures, and
+// does nothing if the CT corpus hasn't been generated.
+func runCTTests(hostname string, caps *verifierCapabilities, recorder *resultRecorder) (numTests, numFailures int, err error) {
+	if !profile.runsOptionalCorpus("ct") {
+		return 0, 0, nil
+	}
+
+	expectations, err := loadCTExpectations()
+	if expectations == nil {
+		return 0, 0, err
+	}
+
+	rootChain, err := readPEMChain(filepath.Join(ctDir(), "root.crt"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rootPool := x509.NewCertPool()
+	for _, root := range rootChain {
+		rootPool.AddCert(root)
+	}
+
+	for _, test := range expectations.Expects {
+		verifyErr := verifyHostname(filepath.Join(ctDir(), strconv.Itoa(test.Id)), hostname, rootPool)
+		recorder.recordCT(&test, verifyErr)
+
+		if passed, description := classifyResult(caps.ctExpectation(&test).Result, verifyErr == nil); !passed {
+			fmt.Printf("ct #%d (%s): %s%s\n", test.Id, test.Delivery, description, errorSuffix(errString(verifyErr)))
+			numFailures++
+		}
+	}
+
+	return len(expectations.Expects), numFailures, nil
+}
+
+// runCTServer implements the ct command, which serves each CT test on its
+// own port, from the control port plus one, delivering its SCTs as the test
+// says, and records which tests a probing client completes handshakes with,
+// as the probe command does. The control server also serves a log list of
+// the trusted test logs at /log_list.json, in the format of Chrome's, and
+// each log's RFC 6962 add-chain endpoint under /logs/<name>/, which signs
+// SCTs for servers under test that fetch their own, e.g. for the TLS
+// extension.
+func runCTServer(args []string) error {
+	flags := flag.NewFlagSet("ct", flag.ExitOnError)
+	control := flags.String("control", "", "The address to serve the log list, the test logs and the controls on, which defaults to basePort+10000 on all interfaces. Tests are served from the port after it")
+	enforcing := flags.Bool("enforcing", true, "Whether to grade the client as one that enforces Certificate Transparency, rather than one that ignores SCTs")
+	capabilitiesFile := flags.String("capabilities", "", "If set, the capabilities file of the client, whose checksCT overrides -enforcing")
+	resultsPath := flags.String("results", "ct.json", "The path to write the results file to when probing is done")
+	resultsKeyPath := flags.String("results-key", "", resultsKeyUsage)
+	userAgent := flags.String("user-agent", "", "The user agent to record, which defaults to the User-Agent header of the first request made")
+	flags.DurationVar(&limits.timeout, "timeout", limits.timeout, "The longest time to wait for a client to complete a handshake")
+	flags.Parse(args)
+
+	resultsKey, err := loadResultsKey(*resultsKeyPath)
+	if err != nil {
+		return err
+	}
+
+	if len(*capabilitiesFile) > 0 {
+		caps, err := loadCapabilities(*capabilitiesFile)
+		if err != nil {
+			return err
+		}
+		*enforcing = caps.ChecksCT
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if len(*control) == 0 {
+		*control = ":" + strconv.Itoa(config.BasePort+10000)
+	}
+
+	expectations, err := loadCTExpectations()
+	if err != nil {
+		return err
+	}
+	if expectations == nil {
+		return errors.New("html/ctExpects.json is missing; run gradle runCtGenerator and then defineExpects.js")
+	}
+
+	logs, err := loadCTLogs()
+	if err != nil {
+		return err
+	}
+
+	controlListener, err := net.Listen("tcp", *control)
+	if err != nil {
+		return err
+	}
+	controlPort := controlListener.Addr().(*net.TCPAddr).Port
+
+	// Every CT test has the corpus hostname, not one of its own.
+	ctConfig := *config
+	ctConfig.PerTestHostnames = false
+	p := newProber(&ctConfig, "", *userAgent)
+	p.resultsKey = resultsKey
+	p.listeners = append(p.listeners, controlListener)
+	defer p.close()
+
+	var urls []string
+	for _, test := range expectations.Expects {
+		cert, err := loadCTCertificate(test)
+		if err != nil {
+			return fmt.Errorf("ct #%d: %s", test.Id, err)
+		}
+
+		port := controlPort + test.Id
+		l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err != nil {
+			return fmt.Errorf("ct #%d: %s", test.Id, err)
+		}
+		p.listeners = append(p.listeners, l)
+		go p.serve(test.Id, config.Hostname, l, &tls.Config{Certificates: []tls.Certificate{cert}, GetConfigForClient: p.captureHello, SessionTicketsDisabled: true})
+
+		urls = append(urls, "https://"+net.JoinHostPort(config.Hostname, strconv.Itoa(port))+"/well-known.txt")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/urls", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, url := range urls {
+			fmt.Fprintln(w, url)
+		}
+	})
+	mux.HandleFunc("/done", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST to finish probing", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintln(w, "Probing is done; the harness is writing the results")
+		p.doneOnce.Do(func() { close(p.done) })
+	})
+	mux.HandleFunc("/log_list.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ctLogList(logs, "http://"+r.Host))
+	})
+	for _, log := range logs {
+		mux.Handle("/logs/"+log.Name+"/ct/v1/add-chain", log)
+	}
+	go http.Serve(controlListener, mux)
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	fmt.Printf("Serving %d CT tests from port %d, with the log list at http://localhost:%d/log_list.json.\n", len(expectations.Expects), controlPort+1, controlPort)
+	fmt.Printf("Fetch each URL listed at http://localhost:%d/urls with a client that trusts certificates/ct/root.crt,\n", controlPort)
+	fmt.Printf("then POST to /done or interrupt to write the results.\n")
+
+	select {
+	case <-p.done:
+	case <-interrupts:
+	}
+
+	return writeCTResults(p, expectations, *enforcing, *resultsPath)
+}
+
+// loadCTLogs returns the test logs, with their private keys.
+func loadCTLogs() ([]*ctLog, error) {
+	logsBytes, err := readCorpusFile(filepath.Join(ctDir(), "logs.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var logsFile struct {
+		Logs []*ctLog `json:"logs"`
+	}
+	if err := json.Unmarshal(logsBytes, &logsFile); err != nil {
+		return nil, err
+	}
+
+	for _, log := range logsFile.Logs {
+		if log.signer, err = readPrivateKey(filepath.Join(ctDir(), "logs", log.Name+".key")); err != nil {
+			return nil, err
+		}
+	}
+	return logsFile.Logs, nil
+}
+
+// loadCTCertificate returns the leaf, key and chain of a CT test, with the
+// SCTs or OCSP response that it delivers alongside the certificate.
+func loadCTCertificate(test ctExpectation) (tls.Certificate, error) {
+	pathPrefix := filepath.Join(ctDir(), strconv.Itoa(test.Id))
+	certPEM, err := readCorpusFile(pathPrefix + ".crt")
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := readCorpusFile(pathPrefix + ".key")
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	chain, err := readPEMChain(pathPrefix + ".chain")
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	for _, intermediate := range chain {
+		cert.Certificate = append(cert.Certificate, intermediate.Raw)
+	}
+
+	switch test.Delivery {
+	case "tls":
+		sctList, err := readCorpusFile(pathPrefix + ".sct")
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		if cert.SignedCertificateTimestamps, err = parseSCTList(sctList); err != nil {
+			return tls.Certificate{}, err
+		}
+	case "ocsp":
+		if cert.OCSPStaple, err = readCorpusFile(pathPrefix + ".ocsp"); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	return cert, nil
+}
+
+// parseSCTList splits a TLS-encoded SignedCertificateTimestampList into its
+// SCTs.
+func parseSCTList(list []byte) ([][]byte, error) {
+	if len(list) < 2 || int(binary.BigEndian.Uint16(list)) != len(list)-2 {
+		return nil, errors.New("malformed SCT list")
+	}
+	list = list[2:]
+
+	var scts [][]byte
+	for len(list) > 0 {
+		if len(list) < 2 || int(binary.BigEndian.Uint16(list)) > len(list)-2 {
+			return nil, errors.New("malformed SCT list")
+		}
+		n := int(binary.BigEndian.Uint16(list))
+		scts = append(scts, list[2:2+n])
+		list = list[2+n:]
+	}
+	return scts, nil
+}
+
+// ctLogList returns a log list of the trusted logs in the format of Chrome's
+// log_list.json, with each log served under baseURL.
+func ctLogList(logs []*ctLog, baseURL string) interface{} {
+	type logState struct {
+		Timestamp string `json:"timestamp"`
+	}
+	type listedLog struct {
+		Description string              `json:"description"`
+		LogID       string              `json:"log_id"`
+		Key         string              `json:"key"`
+		URL         string              `json:"url"`
+		MMD         int                 `json:"mmd"`
+		State       map[string]logState `json:"state"`
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	var listed []listedLog
+	for _, log := range logs {
+		if !log.Trusted {
+			continue
+		}
+		listed = append(listed, listedLog{
+			Description: log.Description,
+			LogID:       log.LogID,
+			Key:         log.Key,
+			URL:         baseURL + "/logs/" + log.Name + "/",
+			MMD:         86400,
+			State:       map[string]logState{"usable": {Timestamp: now}},
+		})
+	}
+
+	return map[string]interface{}{
+		"version":            "1.0",
+		"log_list_timestamp": now,
+		"operators": []map[string]interface{}{{
+			"name":  "BetterTLS",
+			"email": []string{},
+			"logs":  listed,
+		}},
+	}
+}
+
+// ServeHTTP implements the log's RFC 6962 add-chain endpoint, returning an
+// SCT for the submitted certificate signed by the log. Nothing is actually
+// logged. Precertificates, submitted with add-pre-chain, aren't supported,
+// since the corpus's embedded SCTs are signed when it's generated.
+func (log *ctLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST a chain to add it", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Chain [][]byte `json:"chain"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&request); err != nil || len(request.Chain) == 0 {
+		http.Error(w, "the request must be JSON with a non-empty chain", http.StatusBadRequest)
+		return
+	}
+
+	logID, err := base64.StdEncoding.DecodeString(log.LogID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	timestamp := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	signature, err := log.sign(timestamp, request.Chain[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sct_version": 0,
+		"id":          logID,
+		"timestamp":   timestamp,
+		"extensions":  "",
+		"signature":   signature,
+	})
+}
+
+// sign returns the TLS-encoded digitally-signed struct of a v1 SCT for the
+// X.509 entry of cert at timestamp.
+func (log *ctLog) sign(timestamp uint64, cert []byte) ([]byte, error) {
+	var signed []byte
+	signed = append(signed, 0 /* v1 */, 0 /* certificate_timestamp */)
+	signed = appendUint(signed, timestamp, 8)
+	signed = appendUint(signed, 0 /* x509_entry */, 2)
+	signed = appendUint(signed, uint64(len(cert)), 3)
+	signed = append(signed, cert...)
+	signed = appendUint(signed, 0 /* no extensions */, 2)
+
+	digest := sha256.Sum256(signed)
+	signature, err := log.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []byte{4 /* sha256 */, 3 /* ecdsa */}
+	out = appendUint(out, uint64(len(signature)), 2)
+	return append(out, signature...), nil
+}
+
+func appendUint(b []byte, v uint64, length int) []byte {
+	for i := length - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(8*uint(i))))
+	}
+	return b
+}
+
+// writeCTResults writes the outcomes of the CT tests to a results file,
+// graded as for a client that enforces CT or one that ignores SCTs, and
+// reports the tests that failed or weren't probed.
+func writeCTResults(p *prober, expectations *ctExpectations, enforcing bool, path string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	recorder := newResultRecorder(deliveryPool)
+	recorder.setSigningKey(p.resultsKey)
+	recorder.userAgent = p.userAgent
+	recorder.setClientHellos(p.hellos.list())
+	p.identify(recorder)
+
+	var numProbed, numFailures int
+	for _, test := range expectations.Expects {
+		outcome, ok := p.outcomes[probeKey{test.Id, true}]
+		if !ok {
+			continue
+		}
+		numProbed++
+
+		var err error
+		if !outcome.accepted {
+			err = outcome.err
+			if err == nil {
+				err = errors.New("handshake failed")
+			}
+		}
+		recorder.recordCT(&test, err)
+
+		expect := test.NonEnforcing
+		if enforcing {
+			expect = test.CTEnforcing
+		}
+		if passed, description := classifyResult(expect.Result, outcome.accepted); !passed {
+			numFailures++
+			fmt.Printf("ct #%d (%s): %s%s\n  %q\n", test.Id, test.Delivery, description, errorSuffix(errString(err)), strings.Join(expect.Descriptions, " "))
+		}
+	}
+
+	if err := recorder.write(path, p.config.TestVersion); err != nil {
+		return err
+	}
+
+	fmt.Printf("Probed %d of %d CT tests, of which %d failed; results written to %s\n", numProbed, len(expectations.Expects), numFailures, path)
+	return nil
+}
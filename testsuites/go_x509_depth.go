@@ -0,0 +1,111 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// depthExpectations represents depthExpects.json, which defineExpects.js
+// generates when the optional chain depth corpus is present.
+type depthExpectations struct {
+	Expects []depthExpectation
+}
+
+type depthExpectation struct {
+	Id int `json:"id"`
+	// Intermediates is the number of intermediates in the chain, and
+	// Depth the number of certificates in the path, including the leaf
+	// and the root.
+	Intermediates int `json:"intermediates"`
+	Depth         int `json:"depth"`
+	expectedResult
+}
+
+// runDepthTests runs the chain depth tests, which verify otherwise valid
+// chains of many intermediates, and returns the number of tests run and the
+// number of failures. RFC 5280 sets no limit on depth, so only the shallowest
+// chain is expected to be accepted. It records the outcome of each test with
+// recorder, along with the depth at which the verifier gave up. It does
+// nothing if the depth corpus hasn't been generated.
+func runDepthTests(hostname string, recorder *resultRecorder) (numTests, numFailures int, err error) {
+	if !profile.runsOptionalCorpus("depth") {
+		return 0, 0, nil
+	}
+
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(baseDir, "html", "depthExpects.json"))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	expectations := new(depthExpectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return 0, 0, err
+	}
+	sort.Slice(expectations.Expects, func(i, j int) bool {
+		return expectations.Expects[i].Depth < expectations.Expects[j].Depth
+	})
+
+	depthDir := filepath.Join(baseDir, "certificates", "depth")
+	rootChain, err := readPEMChain(filepath.Join(depthDir, "root.crt"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rootPool := x509.NewCertPool()
+	for _, root := range rootChain {
+		rootPool.AddCert(root)
+	}
+
+	// maxDepth is the depth of the deepest chain accepted along with every
+	// shallower one.
+	maxDepth, gaveUp := 0, false
+	for _, test := range expectations.Expects {
+		// The chains are deliberately longer than -max-chain-length, so
+		// they're read without it.
+		verifyErr := verifyHostname(filepath.Join(depthDir, strconv.Itoa(test.Id)), hostname, rootPool)
+		recorder.recordDepth(&test, verifyErr)
+
+		if verifyErr != nil {
+			gaveUp = true
+		} else if !gaveUp {
+			maxDepth = test.Depth
+		}
+
+		if passed, description := classifyResult(test.Result, verifyErr == nil); !passed {
+			fmt.Printf("depth #%d (%d intermediates): %s%s\n", test.Id, test.Intermediates, description, errorSuffix(errString(verifyErr)))
+			numFailures++
+		}
+	}
+
+	recorder.setMaxDepth(maxDepth)
+	if gaveUp {
+		fmt.Printf("Chain depth: gave up beyond %d certificates\n", maxDepth)
+	} else {
+		fmt.Printf("Chain depth: accepted every chain, up to %d certificates\n", maxDepth)
+	}
+
+	return len(expectations.Expects), numFailures, nil
+}
@@ -0,0 +1,240 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// corpusFormatUsage is the usage of the -corpus-format flag of the commands
+// that read the main corpus.
+const corpusFormatUsage = "The format to read the main corpus in: \"pem\", the .crt and .chain files, or \"der\", the files indexed by der/index.json"
+
+// corpusReader reads the certificates of the main corpus, as DER, from one of
+// the formats that the corpus is written in.
+type corpusReader interface {
+	// root returns the root that every test's chain leads to.
+	root() ([]byte, error)
+	// test returns the leaf and chain of the test with the given ID.
+	test(id int) (leaf []byte, chain [][]byte, err error)
+}
+
+// openCorpusReader returns the reader for the named format.
+func openCorpusReader(format string) (corpusReader, error) {
+	switch format {
+	case "pem":
+		return pemCorpus{}, nil
+	case "der":
+		return loadDERCorpus()
+	default:
+		return nil, fmt.Errorf("unknown corpus format %q", format)
+	}
+}
+
+// pemCorpus reads the PEM files that the generator writes for each test: the
+// leaf in N.crt and its chain in N.chain.
+type pemCorpus struct{}
+
+func (pemCorpus) root() ([]byte, error) {
+	blocks, err := readPEMBlocks(filepath.Join(certificatesDir, "root.crt"))
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) != 1 {
+		return nil, fmt.Errorf("expected a single root in root.crt but found %d", len(blocks))
+	}
+	return blocks[0], nil
+}
+
+func (pemCorpus) test(id int) (leaf []byte, chain [][]byte, err error) {
+	if chain, err = readPEMBlocks(testPath(id, ".chain")); err != nil {
+		return nil, nil, err
+	}
+
+	leaves, err := readPEMBlocks(testPath(id, ".crt"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(leaves) != 1 {
+		return nil, nil, fmt.Errorf("expected a single certificate in the .crt file, but found %d", len(leaves))
+	}
+	return leaves[0], chain, nil
+}
+
+// derDir returns the directory of the DER form of the main corpus, which is
+// written alongside the PEM files for verifiers that don't read PEM.
+func derDir() string {
+	return filepath.Join(certificatesDir, "der")
+}
+
+// derIndex represents der/index.json, which lists the files of the DER form
+// of the main corpus.
+type derIndex struct {
+	// Root is the name of the file holding the root.
+	Root  string          `json:"root"`
+	Tests []derIndexEntry `json:"tests"`
+}
+
+// derIndexEntry locates the certificates of a single test.
+type derIndexEntry struct {
+	Id int `json:"id"`
+	// File is the name of the file holding the test's leaf followed by
+	// each certificate of its chain, concatenated.
+	File string `json:"file"`
+	// Lengths are the lengths of the certificates in File, in order, so
+	// that they can be split without parsing.
+	Lengths []int `json:"lengths"`
+}
+
+// derCorpus reads the DER form of the main corpus.
+type derCorpus struct {
+	index *derIndex
+	tests map[int]*derIndexEntry
+}
+
+func loadDERCorpus() (*derCorpus, error) {
+	indexBytes, err := readCorpusFile(filepath.Join(derDir(), "index.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	index := new(derIndex)
+	if err := json.Unmarshal(indexBytes, index); err != nil {
+		return nil, err
+	}
+
+	// The index names files in der, and nothing outside it.
+	if index.Root != filepath.Base(index.Root) {
+		return nil, fmt.Errorf("der/index.json names a root outside der: %q", index.Root)
+	}
+
+	corpus := &derCorpus{index: index, tests: make(map[int]*derIndexEntry)}
+	for i := range index.Tests {
+		entry := &index.Tests[i]
+		if entry.File != filepath.Base(entry.File) {
+			return nil, fmt.Errorf("der/index.json names a file outside der for test %d: %q", entry.Id, entry.File)
+		}
+		corpus.tests[entry.Id] = entry
+	}
+	return corpus, nil
+}
+
+func (c *derCorpus) root() ([]byte, error) {
+	return readCorpusFile(filepath.Join(derDir(), c.index.Root))
+}
+
+func (c *derCorpus) test(id int) (leaf []byte, chain [][]byte, err error) {
+	entry, ok := c.tests[id]
+	if !ok {
+		return nil, nil, fmt.Errorf("der/index.json has no entry for test %d", id)
+	}
+	if len(entry.Lengths) == 0 {
+		return nil, nil, fmt.Errorf("der/index.json lists no certificates for test %d", id)
+	}
+
+	contents, err := readCorpusFile(filepath.Join(derDir(), entry.File))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certs := make([][]byte, len(entry.Lengths))
+	for i, length := range entry.Lengths {
+		if length <= 0 || length > len(contents) {
+			return nil, nil, fmt.Errorf("%s is shorter than der/index.json says", entry.File)
+		}
+		certs[i], contents = contents[:length], contents[length:]
+	}
+	if len(contents) != 0 {
+		return nil, nil, fmt.Errorf("%s is longer than der/index.json says", entry.File)
+	}
+
+	return certs[0], certs[1:], nil
+}
+
+// writeDERCorpus implements the der-corpus command, which writes the DER form
+// of the main corpus from its PEM files, for corpora generated without it.
+func writeDERCorpus(args []string) error {
+	flags := flag.NewFlagSet("der-corpus", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return errors.New("der-corpus takes no arguments")
+	}
+
+	manifest, err := loadManifest()
+	if err != nil {
+		return err
+	}
+
+	var ids []int
+	for _, def := range manifest.CertManifest {
+		ids = append(ids, def.Id)
+	}
+	if err := writeDERFiles(derDir(), pemCorpus{}, ids); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote %d tests to %s\n", len(ids), derDir())
+	return nil
+}
+
+// writeDERFiles writes the DER form of the root and of the tests with the
+// given IDs, read with reader, to dir, along with its index.
+func writeDERFiles(dir string, reader corpusReader, ids []int) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	root, err := reader.root()
+	if err != nil {
+		return err
+	}
+	index := &derIndex{Root: "root.der"}
+	if err := ioutil.WriteFile(filepath.Join(dir, index.Root), root, 0644); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		leaf, chain, err := reader.test(id)
+		if err != nil {
+			return err
+		}
+
+		entry := derIndexEntry{Id: id, File: strconv.Itoa(id) + ".der"}
+		var contents bytes.Buffer
+		for _, cert := range append([][]byte{leaf}, chain...) {
+			contents.Write(cert)
+			entry.Lengths = append(entry.Lengths, len(cert))
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, entry.File), contents.Bytes(), 0644); err != nil {
+			return err
+		}
+		index.Tests = append(index.Tests, entry)
+	}
+
+	indexBytes, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "index.json"), indexBytes, 0644)
+}
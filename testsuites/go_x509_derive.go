@@ -0,0 +1,249 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// expectOverrides is expectOverrides.json, in the root of the repository,
+// which defineExpects.js applies over the expectations that it derives, and
+// the file of proposals that derive-expects writes to be reviewed and merged
+// into it.
+type expectOverrides struct {
+	// Verifiers names the reference verifiers that the overrides were
+	// derived from.
+	Verifiers []string         `json:"verifiers"`
+	Overrides []expectOverride `json:"overrides"`
+}
+
+// expectOverride is the expected result of verifying one test's leaf for one
+// type of name, as agreed by the reference verifiers.
+type expectOverride struct {
+	Id int `json:"id"`
+	// StableId identifies the test across regenerations of the corpus,
+	// and is used in preference to Id if it's set.
+	StableId string `json:"stableId,omitempty"`
+	// Type is "dns" or "ip".
+	Type string `json:"type"`
+	// Current is the expected result when the override was proposed, for
+	// the reviewer.
+	Current     string        `json:"current"`
+	Expect      string        `json:"expect"`
+	Description string        `json:"description"`
+	Reasons     []errorReason `json:"reasons,omitempty"`
+	// Results are the reference verifiers' results, for the reviewer.
+	// They're missing from overrides curated by hand.
+	Results []diffResult `json:"results,omitempty"`
+	// Reviewed must be set by whoever reviews the proposal before
+	// defineExpects.js will apply it.
+	Reviewed bool `json:"reviewed"`
+	// Curated is set on overrides set by hand with the expects command,
+	// rather than derived from the verifiers.
+	Curated bool `json:"curated,omitempty"`
+	// Deprecated, if set, explains why the override should no longer be
+	// applied. It's kept, rather than removed, so that the history of the
+	// test's expectation stays in the file.
+	Deprecated string `json:"deprecated,omitempty"`
+}
+
+// sortOverrides sorts overrides by test ID and then type, their canonical
+// order.
+func sortOverrides(overrides []expectOverride) {
+	sort.Slice(overrides, func(i, j int) bool {
+		a, b := &overrides[i], &overrides[j]
+		if a.Id != b.Id {
+			return a.Id < b.Id
+		}
+		return a.Type < b.Type
+	})
+}
+
+// marshalOverrides returns the canonical form of overrides: sorted, indented
+// JSON with a trailing newline.
+func marshalOverrides(overrides *expectOverrides) ([]byte, error) {
+	sortOverrides(overrides.Overrides)
+	output, err := json.MarshalIndent(overrides, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(output, '\n'), nil
+}
+
+// deriveExpectations implements the derive-expects command, which runs the
+// main corpus through several reference verifiers and proposes an expected
+// result for each verification from what they do: OK or ERROR if they agree,
+// and WEAK-OK, where verifiers reasonably differ, if they don't. This replaces
+// curating expects.json by hand when tests are added to the generator. Only
+// proposals that differ from the current expectations are written, unless
+// -all is given, and none is applied until it's been reviewed.
+func deriveExpectations(args []string) error {
+	flags := flag.NewFlagSet("derive-expects", flag.ExitOnError)
+	specs := flags.String("verifiers", "gox509,openssl", "The reference verifiers, separated by commas, each as for diff-verify's -a")
+	minVerifiers := flags.Int("min-verifiers", 2, "The fewest reference verifiers that must be able to verify a type of name for its results to be proposed")
+	all := flags.Bool("all", false, "Propose every verification's expectation, not only those that differ from the current ones")
+	outputPath := flags.String("o", "proposed-expects.json", "The path to write the proposals to")
+	options := newDiffVerifierOptions(flags)
+	numWorkers := flags.Int("workers", defaultWorkers, workersUsage)
+	profileName := flags.String("profile", "stress", profileUsage)
+	flags.Parse(args)
+
+	if err := selectProfile(*profileName); err != nil {
+		return err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	expectations, err := loadExpectations()
+	if err != nil {
+		return err
+	}
+	if _, err := profile.filter(expectations); err != nil {
+		return err
+	}
+
+	options.reader = pemCorpus{}
+	if options.root, err = loadRoot(options.reader); err != nil {
+		return err
+	}
+
+	var verifiers []diffVerifier
+	proposals := &expectOverrides{}
+	for _, spec := range strings.Split(*specs, ",") {
+		v, err := newDiffVerifier(strings.TrimSpace(spec), options)
+		if err != nil {
+			return fmt.Errorf("%s: %v", spec, err)
+		}
+		defer v.close()
+		verifiers = append(verifiers, v)
+		proposals.Verifiers = append(proposals.Verifiers, v.name())
+	}
+	if len(verifiers) < *minVerifiers {
+		return fmt.Errorf("%d reference verifiers were given, but -min-verifiers is %d", len(verifiers), *minVerifiers)
+	}
+	fmt.Printf("Deriving expectations from %s\n", strings.Join(proposals.Verifiers, ", "))
+
+	var mu sync.Mutex
+	var numDerived, numSkipped int
+	numErrors := runPipeline(expectations.Expects, *numWorkers, func(test *expectation) bool {
+		name, nameType, current := config.testIP(test), "ip", &test.IP
+		if test.testDNS {
+			name, nameType, current = config.testHostname(test), "dns", &test.DNS
+		}
+
+		var references []diffVerifier
+		for _, v := range verifiers {
+			if v.supports(test.testDNS) {
+				references = append(references, v)
+			}
+		}
+		if len(references) < *minVerifiers {
+			mu.Lock()
+			numSkipped++
+			mu.Unlock()
+			return false
+		}
+
+		results, err := verifyWithEach(references, test.Id, name)
+		if err != nil {
+			test.err = err
+			return true
+		}
+
+		proposal := proposeExpectation(results)
+		proposal.Id, proposal.StableId, proposal.Type, proposal.Current = test.Id, test.StableId, nameType, current.Result
+
+		mu.Lock()
+		defer mu.Unlock()
+		numDerived++
+		if *all || proposal.Expect != current.Result {
+			proposals.Overrides = append(proposals.Overrides, *proposal)
+		}
+		return false
+	}, func(failure expectation) {
+		fmt.Fprintf(os.Stderr, "#%d: %v\n", failure.Id, failure.err)
+	})
+
+	output, err := marshalOverrides(proposals)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*outputPath, output, 0644); err != nil {
+		return err
+	}
+
+	counts := make(map[string]int)
+	for _, proposal := range proposals.Overrides {
+		counts[proposal.Expect]++
+	}
+	fmt.Printf("Derived %d expectations, skipping %d that fewer than %d reference verifiers can verify. Wrote %d proposals to %s: %d OK, %d ERROR and %d WEAK-OK.\n",
+		numDerived, numSkipped, *minVerifiers, len(proposals.Overrides), *outputPath, counts["OK"], counts["ERROR"], counts["WEAK-OK"])
+	fmt.Println("Review them, set reviewed on those to keep and merge them into expectOverrides.json, then run defineExpects.js.")
+
+	if numErrors > 0 {
+		return fmt.Errorf("%d verifications couldn't be run", numErrors)
+	}
+	return nil
+}
+
+// proposeExpectation returns the expectation that the reference verifiers'
+// results suggest: OK or ERROR if they're unanimous, and WEAK-OK if they're
+// split. The reasons of a unanimous rejection are those that the verifiers
+// gave, unless any of them couldn't be classified.
+func proposeExpectation(results []diffResult) *expectOverride {
+	var accepted, rejected []string
+	reasons := make(map[errorReason]bool)
+	classified := true
+	for _, r := range results {
+		if r.Accepted {
+			accepted = append(accepted, r.Verifier)
+			continue
+		}
+		rejected = append(rejected, r.Verifier)
+		if r.Reason == "" || r.Reason == reasonOther {
+			classified = false
+		}
+		reasons[r.Reason] = true
+	}
+
+	proposal := &expectOverride{Results: results}
+	switch {
+	case len(rejected) == 0:
+		proposal.Expect = "OK"
+		proposal.Description = fmt.Sprintf("Every reference verifier (%s) accepts this certificate.", strings.Join(accepted, ", "))
+	case len(accepted) == 0:
+		proposal.Expect = "ERROR"
+		proposal.Description = fmt.Sprintf("Every reference verifier (%s) rejects this certificate.", strings.Join(rejected, ", "))
+		if classified {
+			for reason := range reasons {
+				proposal.Reasons = append(proposal.Reasons, reason)
+			}
+			sort.Slice(proposal.Reasons, func(i, j int) bool { return proposal.Reasons[i] < proposal.Reasons[j] })
+		}
+	default:
+		proposal.Expect = "WEAK-OK"
+		proposal.Description = fmt.Sprintf("Reference verifiers differ on this certificate: it's accepted by %s and rejected by %s.", strings.Join(accepted, ", "), strings.Join(rejected, ", "))
+	}
+	return proposal
+}
@@ -0,0 +1,154 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// diffResults implements the diff command, which compares two results files,
+// e.g. from two Go releases, and prints the tests whose outcome changed.
+func diffResults(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	idMapPath := flags.String("id-map", "", "If set, an ID map written by the stability command, for comparing old results from an earlier corpus version")
+	publicKeyPath := flags.String("public-key", "", resultsPublicKeyUsage)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: diff [flags] old.json new.json\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("expected two results files")
+	}
+
+	publicKeys, err := loadResultsPublicKeys(*publicKeyPath)
+	if err != nil {
+		return err
+	}
+
+	expectations, err := loadExpectations()
+	if err != nil {
+		return err
+	}
+
+	var results [2]map[int]testResult
+	var deliveries [2]string
+	var versions [2]int
+	for i, path := range flags.Args() {
+		if publicKeys != nil {
+			fingerprint, err := verifyResultsFile(path, publicKeys)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s is signed by key %s.\n", path, fingerprint)
+		}
+
+		r, err := loadResults(path)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		deliveries[i] = r.IntermediateDelivery
+		versions[i] = r.TestVersion
+		results[i] = make(map[int]testResult)
+		for _, result := range r.Results {
+			results[i][result.Id] = result
+		}
+	}
+
+	// Test IDs change between corpus versions, so the old results are
+	// translated to the new IDs first.
+	if len(*idMapPath) > 0 {
+		m, err := loadIDMap(*idMapPath)
+		if err != nil {
+			return err
+		}
+		if versions[0] != m.FromVersion || versions[1] != m.ToVersion {
+			return fmt.Errorf("%s maps corpus version %d to %d, but the results are from versions %d and %d", *idMapPath, m.FromVersion, m.ToVersion, versions[0], versions[1])
+		}
+		results[0] = m.translate(results[0])
+	} else if versions[0] != versions[1] {
+		return fmt.Errorf("the results are from corpus versions %d and %d, whose test IDs differ; pass -id-map with the map from the stability command", versions[0], versions[1])
+	}
+
+	// Results aren't comparable when intermediates were delivered
+	// differently.
+	if deliveries[0] != deliveries[1] {
+		fmt.Printf("Warning: intermediates were delivered by %q in the old results but %q in the new ones.\n\n", deliveryName(deliveries[0]), deliveryName(deliveries[1]))
+	}
+
+	var newlyFailing, newlyPassing, changedErrors []string
+	for _, e := range expectations.Expects {
+		oldResult, oldOK := results[0][e.Id]
+		newResult, newOK := results[1][e.Id]
+		if !oldOK || !newOK {
+			continue
+		}
+
+		for _, testDNS := range []bool{true, false} {
+			testType, expect := "IP", e.IP.Result
+			if testDNS {
+				testType, expect = "DNS", e.DNS.Result
+			}
+
+			oldAccepted, oldRan, oldErr := oldResult.result(testDNS)
+			newAccepted, newRan, newErr := newResult.result(testDNS)
+			if !oldRan || !newRan {
+				continue
+			}
+
+			oldPassed, oldDescription := classifyResult(expect, oldAccepted)
+			newPassed, newDescription := classifyResult(expect, newAccepted)
+			line := fmt.Sprintf("#%d %s: %s -> %s", e.Id, testType, oldDescription, newDescription)
+
+			switch {
+			case oldPassed && !newPassed:
+				newlyFailing = append(newlyFailing, line+errorSuffix(newErr))
+			case !oldPassed && newPassed:
+				newlyPassing = append(newlyPassing, line+errorSuffix(newErr))
+			case oldErr != newErr:
+				changedErrors = append(changedErrors, fmt.Sprintf("#%d %s:\n    %q\n    %q", e.Id, testType, oldErr, newErr))
+			}
+		}
+	}
+
+	printDiffSection("Newly failing", newlyFailing)
+	printDiffSection("Newly passing", newlyPassing)
+	printDiffSection("Changed errors", changedErrors)
+
+	if len(newlyFailing) != 0 {
+		return fmt.Errorf("%d tests newly failing", len(newlyFailing))
+	}
+
+	return nil
+}
+
+func errorSuffix(errString string) string {
+	if len(errString) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%q)", errString)
+}
+
+func printDiffSection(title string, lines []string) {
+	fmt.Printf("%s (%d):\n", title, len(lines))
+	for _, line := range lines {
+		fmt.Printf("  %s\n", line)
+	}
+}
@@ -0,0 +1,529 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// diffVerifierUsage is the usage of diff-verify's -a and -b flags.
+const diffVerifierUsage = "The verifier to compare: \"gox509\", \"platform\", \"boringssl\" or \"awslc\" if libcrypto.go is built in, \"openssl\", \"nss\", \"nss-pkix\" for NSS's libpkix, \"gnutls\", or \"external:COMMAND [ARGS]\" for an external harness"
+
+// diffVerify implements the diff-verify command, which runs every test of the
+// main corpus through two verifiers at once and reports only the tests on
+// which they disagree, whatever the expected result. Disagreements point to
+// bugs in one of the verifiers or to tests whose expectations are missing or
+// wrong, without having to decide first which verifier is right.
+func diffVerify(args []string) error {
+	flags := flag.NewFlagSet("diff-verify", flag.ExitOnError)
+	specA := flags.String("a", "gox509", diffVerifierUsage)
+	specB := flags.String("b", "openssl", diffVerifierUsage)
+	compareReasons := flags.Bool("reasons", false, "Also report tests that both verifiers rejected, but for different reasons")
+	outputPath := flags.String("o", "", "If set, the path to write the disagreements to, as JSON")
+	options := newDiffVerifierOptions(flags)
+	numWorkers := flags.Int("workers", defaultWorkers, workersUsage)
+	profileName := flags.String("profile", "stress", profileUsage)
+	flags.Parse(args)
+
+	if err := selectProfile(*profileName); err != nil {
+		return err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	expectations, err := loadExpectations()
+	if err != nil {
+		return err
+	}
+	if _, err := profile.filter(expectations); err != nil {
+		return err
+	}
+
+	// openssl, vfychain and certtool are given the corpus's files, so it's always
+	// read from disk.
+	options.reader = pemCorpus{}
+	if options.root, err = loadRoot(options.reader); err != nil {
+		return err
+	}
+
+	var verifiers [2]diffVerifier
+	for i, spec := range []string{*specA, *specB} {
+		if verifiers[i], err = newDiffVerifier(spec, options); err != nil {
+			return fmt.Errorf("%s: %v", spec, err)
+		}
+		defer verifiers[i].close()
+	}
+	a, b := verifiers[0], verifiers[1]
+	fmt.Printf("Comparing %s with %s\n", a.name(), b.name())
+
+	var mu sync.Mutex
+	var disagreements []diffDisagreement
+	var numCompared, numSkipped, numErrors int
+	numDisagreements := runPipeline(expectations.Expects, *numWorkers, func(test *expectation) bool {
+		name, nameType := config.testIP(test), "ip"
+		if test.testDNS {
+			name, nameType = config.testHostname(test), "dns"
+		}
+		if !a.supports(test.testDNS) || !b.supports(test.testDNS) {
+			mu.Lock()
+			numSkipped++
+			mu.Unlock()
+			return false
+		}
+
+		results, err := verifyWithEach(verifiers[:], test.Id, name)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "#%d: %v\n", test.Id, err)
+			numErrors++
+			return false
+		}
+		numCompared++
+
+		disagree := results[0].Accepted != results[1].Accepted
+		if *compareReasons && !results[0].Accepted && !results[1].Accepted {
+			disagree = results[0].Reason != results[1].Reason
+		}
+		if !disagree {
+			return false
+		}
+
+		expected := test.IP.Result
+		if test.testDNS {
+			expected = test.DNS.Result
+		}
+		d := diffDisagreement{Id: test.Id, Type: nameType, Name: name, Expected: expected, A: results[0], B: results[1]}
+		disagreements = append(disagreements, d)
+		test.err = errors.New(d.String())
+		return true
+	}, func(failure expectation) {
+		fmt.Println(failure.err)
+	})
+
+	fmt.Printf("Compared %d verifications: %s and %s disagreed on %d.", numCompared, a.name(), b.name(), numDisagreements)
+	if numSkipped > 0 {
+		fmt.Printf(" %d were skipped, since one of the verifiers can't verify their type of name.", numSkipped)
+	}
+	fmt.Println()
+
+	if len(*outputPath) > 0 {
+		output, err := json.MarshalIndent(&diffReport{A: a.name(), B: b.name(), Compared: numCompared, Disagreements: disagreements}, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(*outputPath, append(output, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+
+	if numErrors > 0 {
+		return fmt.Errorf("%d verifications couldn't be run", numErrors)
+	}
+	if numDisagreements > 0 {
+		return fmt.Errorf("%s and %s disagreed on %d of %d verifications", a.name(), b.name(), numDisagreements, numCompared)
+	}
+	return nil
+}
+
+// diffReport is the file written by diff-verify -o.
+type diffReport struct {
+	// A and B name the verifiers compared.
+	A             string             `json:"a"`
+	B             string             `json:"b"`
+	Compared      int                `json:"compared"`
+	Disagreements []diffDisagreement `json:"disagreements"`
+}
+
+// diffDisagreement is a verification on which two verifiers disagreed.
+type diffDisagreement struct {
+	Id int `json:"id"`
+	// Type is "dns" or "ip", and Name the name that the leaf was verified
+	// for.
+	Type string `json:"type"`
+	Name string `json:"name"`
+	// Expected is the test's expected result, for context.
+	Expected string     `json:"expected"`
+	A        diffResult `json:"a"`
+	B        diffResult `json:"b"`
+}
+
+func (d *diffDisagreement) String() string {
+	return fmt.Sprintf("#%d: %s %s, expected %s:\n  %s\n  %s", d.Id, strings.ToUpper(d.Type), d.Name, d.Expected, &d.A, &d.B)
+}
+
+// diffResult is one verifier's result for a verification.
+type diffResult struct {
+	Verifier string      `json:"verifier"`
+	Accepted bool        `json:"accepted"`
+	Error    string      `json:"error,omitempty"`
+	Reason   errorReason `json:"reason,omitempty"`
+}
+
+func newDiffResult(v diffVerifier, verifyErr error) diffResult {
+	r := diffResult{Verifier: v.name(), Accepted: verifyErr == nil}
+	if verifyErr != nil {
+		r.Error = verifyErr.Error()
+		r.Reason = errorReasonOf(v.taxonomy(), verifyErr)
+	}
+	return r
+}
+
+func (r *diffResult) String() string {
+	if r.Accepted {
+		return r.Verifier + " accepted"
+	}
+	return fmt.Sprintf("%s rejected (%s): %s", r.Verifier, r.Reason, r.Error)
+}
+
+// verifyWithEach verifies test id's leaf and chain for name with each of
+// verifiers at once and returns their results, in the same order. err is set
+// if any of them couldn't be run.
+func verifyWithEach(verifiers []diffVerifier, id int, name string) ([]diffResult, error) {
+	results := make([]diffResult, len(verifiers))
+	errs := make([]error, len(verifiers))
+	var wg sync.WaitGroup
+	for i, v := range verifiers {
+		wg.Add(1)
+		go func(i int, v diffVerifier) {
+			defer wg.Done()
+			verifyErr, err := v.verify(id, name)
+			results[i] = newDiffResult(v, verifyErr)
+			errs[i] = err
+		}(i, v)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", verifiers[i].name(), err)
+		}
+	}
+	return results, nil
+}
+
+// diffVerifier is a verifier that diff-verify can compare.
+type diffVerifier interface {
+	// name identifies the verifier in diff-verify's output.
+	name() string
+	// taxonomy names the table in errorTaxonomy that the verifier's
+	// errors are classified with.
+	taxonomy() string
+	// supports returns whether the verifier can verify DNS names, if
+	// testDNS is set, or IP addresses.
+	supports(testDNS bool) bool
+	// verify verifies test id's leaf and chain for name, returning the
+	// verifier's error if it rejected them, or err if it couldn't be run.
+	// It's called concurrently.
+	verify(id int, name string) (verifyErr, err error)
+	close()
+}
+
+// diffVerifierOptions configures the verifiers of diff-verify.
+type diffVerifierOptions struct {
+	reader                                corpusReader
+	root                                  *x509.Certificate
+	openssl, certutil, vfychain, certtool string
+}
+
+// newDiffVerifierOptions returns options for the commands that run diff
+// verifiers, with flags registered in flags for the binaries they run.
+func newDiffVerifierOptions(flags *flag.FlagSet) *diffVerifierOptions {
+	options := &diffVerifierOptions{}
+	flags.StringVar(&options.openssl, "openssl", "openssl", "The openssl binary to run")
+	flags.StringVar(&options.certutil, "certutil", "certutil", "The certutil binary to run")
+	flags.StringVar(&options.vfychain, "vfychain", "vfychain", "The vfychain binary to run")
+	flags.StringVar(&options.certtool, "certtool", "certtool", "The certtool binary to run")
+	return options
+}
+
+// newDiffVerifier returns the verifier described by spec, as in
+// diffVerifierUsage.
+func newDiffVerifier(spec string, options *diffVerifierOptions) (diffVerifier, error) {
+	if strings.HasPrefix(spec, "external:") {
+		return newExternalDiffVerifier(strings.Fields(strings.TrimPrefix(spec, "external:")), options)
+	}
+
+	switch spec {
+	case "gox509", "platform", "boringssl", "awslc":
+		implementation := "go"
+		if spec != "gox509" {
+			implementation = spec
+		}
+		caps, err := loadCapabilities(capabilitiesPath(implementation))
+		if err != nil {
+			return nil, err
+		}
+		v := &goDiffVerifier{reader: options.reader, roots: x509.NewCertPool(), caps: caps}
+		v.roots.AddCert(options.root)
+		switch spec {
+		case "platform":
+			v.platform, err = loadPlatformVerifier(options.root)
+		case "boringssl", "awslc":
+			v.platform, err = loadLibcryptoVerifier(spec, options.root)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return v, nil
+	case "openssl":
+		version, err := exec.Command(options.openssl, "version").Output()
+		if err != nil {
+			return nil, fmt.Errorf("running %s version: %s", options.openssl, err)
+		}
+		// As for the openssl command, the version is e.g. "OpenSSL 3.0.2
+		// 15 Mar 2022", of which the name and version are kept.
+		name := strings.TrimSpace(string(version))
+		if fields := strings.Fields(name); len(fields) >= 2 {
+			name = fields[0] + " " + fields[1]
+		}
+		return &opensslDiffVerifier{binary: options.openssl, version: name, codes: opensslVerifyErrorsFor(name)}, nil
+	case "nss", "nss-pkix":
+		dir, err := createNSSDatabase(options.certutil)
+		if err != nil {
+			return nil, err
+		}
+		return &nssDiffVerifier{vfychain: options.vfychain, dir: dir, args: nssVfychainArgs(dir, spec == "nss-pkix"), spec: spec}, nil
+	case "gnutls":
+		version, err := gnutlsVersion(options.certtool)
+		if err != nil {
+			return nil, err
+		}
+		dir, err := ioutil.TempDir("", "bettertls-gnutls")
+		if err != nil {
+			return nil, err
+		}
+		return &gnutlsDiffVerifier{certtool: options.certtool, dir: dir, version: strings.TrimSpace("GnuTLS " + version)}, nil
+	}
+	return nil, fmt.Errorf("unknown verifier %q", spec)
+}
+
+// goDiffVerifier verifies with crypto/x509 or, if platform is set, the
+// operating system's verifier or libcrypto.go's.
+type goDiffVerifier struct {
+	reader   corpusReader
+	roots    *x509.CertPool
+	caps     *verifierCapabilities
+	platform platformVerifier
+}
+
+func (v *goDiffVerifier) name() string {
+	if v.platform != nil {
+		return v.platform.name()
+	}
+	return "gox509"
+}
+
+func (v *goDiffVerifier) taxonomy() string {
+	if v.platform != nil {
+		return platformTaxonomy(v.platform)
+	}
+	return "go"
+}
+
+func (v *goDiffVerifier) supports(testDNS bool) bool {
+	return testDNS || v.caps.SupportsIPSAN
+}
+
+func (v *goDiffVerifier) verify(id int, name string) (verifyErr, err error) {
+	leafDER, chainDER, err := v.reader.test(id)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		return nil, err
+	}
+	chain := make([]*x509.Certificate, len(chainDER))
+	intermediates := x509.NewCertPool()
+	for i, der := range chainDER {
+		if chain[i], err = x509.ParseCertificate(der); err != nil {
+			return nil, err
+		}
+		intermediates.AddCert(chain[i])
+	}
+
+	if v.platform != nil {
+		return v.platform.verify(leaf, chain, name), nil
+	}
+	_, verifyErr = leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: v.roots, Intermediates: intermediates})
+	return verifyErr, nil
+}
+
+func (v *goDiffVerifier) close() {
+	if v.platform != nil {
+		v.platform.close()
+	}
+}
+
+// opensslDiffVerifier verifies with "openssl verify", as the openssl command
+// does.
+type opensslDiffVerifier struct {
+	binary, version string
+	codes           map[int]string
+}
+
+func (v *opensslDiffVerifier) name() string     { return v.version }
+func (v *opensslDiffVerifier) taxonomy() string { return "openssl" }
+func (v *opensslDiffVerifier) supports(bool) bool {
+	return true
+}
+
+func (v *opensslDiffVerifier) verify(id int, name string) (verifyErr, err error) {
+	nameArgs := []string{"-verify_hostname", name}
+	if net.ParseIP(name) != nil {
+		nameArgs = []string{"-verify_ip", name}
+	}
+	verifyErr, _, err = opensslVerify(v.binary, v.codes, id, nameArgs)
+	return verifyErr, err
+}
+
+func (v *opensslDiffVerifier) close() {}
+
+// nssDiffVerifier verifies with vfychain, as the nss command does.
+type nssDiffVerifier struct {
+	vfychain, dir string
+	args          []string
+	spec          string
+}
+
+func (v *nssDiffVerifier) name() string     { return v.spec }
+func (v *nssDiffVerifier) taxonomy() string { return "nss" }
+func (v *nssDiffVerifier) supports(bool) bool {
+	return true
+}
+
+func (v *nssDiffVerifier) verify(id int, name string) (verifyErr, err error) {
+	verifyErr, _, err = nssVerify(v.vfychain, v.args, v.dir, id, name)
+	return verifyErr, err
+}
+
+func (v *nssDiffVerifier) close() {
+	os.RemoveAll(v.dir)
+}
+
+// gnutlsDiffVerifier verifies with "certtool --verify", as the gnutls command
+// does.
+type gnutlsDiffVerifier struct {
+	certtool, dir, version string
+}
+
+func (v *gnutlsDiffVerifier) name() string     { return v.version }
+func (v *gnutlsDiffVerifier) taxonomy() string { return "gnutls" }
+func (v *gnutlsDiffVerifier) supports(bool) bool {
+	return true
+}
+
+func (v *gnutlsDiffVerifier) verify(id int, name string) (verifyErr, err error) {
+	verifyErr, _, err = gnutlsVerify(v.certtool, v.dir, id, name)
+	return verifyErr, err
+}
+
+func (v *gnutlsDiffVerifier) close() {
+	os.RemoveAll(v.dir)
+}
+
+// externalDiffVerifier verifies with an external harness, as the external
+// command does. The harness handles a test at a time, so mu serializes them.
+type externalDiffVerifier struct {
+	mu           sync.Mutex
+	harness      *externalHarness
+	capabilities *externalCapabilities
+	reader       corpusReader
+	root         string
+}
+
+func newExternalDiffVerifier(command []string, options *diffVerifierOptions) (*externalDiffVerifier, error) {
+	if len(command) == 0 {
+		return nil, errors.New("external: needs a command to run")
+	}
+	harness, err := startExternalHarness(command[0], command[1:])
+	if err != nil {
+		return nil, err
+	}
+	capabilities := new(externalCapabilities)
+	if err := harness.exchange(&externalHello{Protocol: externalProtocolVersion}, capabilities); err != nil {
+		harness.close()
+		return nil, fmt.Errorf("starting %s: %s", command[0], err)
+	}
+	return &externalDiffVerifier{harness: harness, capabilities: capabilities, reader: options.reader, root: pemString(options.root.Raw)}, nil
+}
+
+func (v *externalDiffVerifier) name() string {
+	if len(v.capabilities.Version) > 0 {
+		return v.capabilities.Implementation + " " + v.capabilities.Version
+	}
+	return v.capabilities.Implementation
+}
+
+func (v *externalDiffVerifier) taxonomy() string { return v.capabilities.ErrorTaxonomy }
+
+func (v *externalDiffVerifier) supports(testDNS bool) bool {
+	nameType := "ip"
+	if testDNS {
+		nameType = "dns"
+	}
+	for _, t := range v.capabilities.NameTypes {
+		if t == nameType {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *externalDiffVerifier) verify(id int, name string) (verifyErr, err error) {
+	leaf, chain, err := v.reader.test(id)
+	if err != nil {
+		return nil, err
+	}
+	request := &externalRequest{Id: id, Type: "dns", Name: name, Leaf: pemString(leaf), Root: v.root}
+	if net.ParseIP(name) != nil {
+		request.Type = "ip"
+	}
+	for _, intermediate := range chain {
+		request.Chain = append(request.Chain, pemString(intermediate))
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	response := new(externalResponse)
+	if err := v.harness.exchange(request, response); err != nil {
+		return nil, err
+	}
+	if response.Id != request.Id || response.Type != request.Type {
+		return nil, fmt.Errorf("the harness replied for test %d %s", response.Id, response.Type)
+	}
+	if !response.Accepted {
+		return errors.New(response.Error), nil
+	}
+	return nil, nil
+}
+
+func (v *externalDiffVerifier) close() {
+	v.harness.close()
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// distrustExpectations represents distrustExpects.json, which defineExpects.js
+// generates when the optional distrust corpus is present.
+type distrustExpectations struct {
+	Expects []distrustExpectation
+}
+
+type distrustExpectation struct {
+	Id int `json:"id"`
+	// Name identifies the case, e.g. "intermediateDistrusted".
+	Name string `json:"name"`
+	// Distrusted labels the certificates that the verifier should
+	// distrust, e.g. "intermediate", and DistrustedHashes are their
+	// SHA-256 hashes, in hex, in the same order.
+	Distrusted       []string `json:"distrusted"`
+	DistrustedHashes []string `json:"distrustedHashes"`
+	expectedResult
+}
+
+// Whether the verifier can be given certificates to distrust, recorded in
+// results files.
+const (
+	distrustSupported   = "SUPPORTED"
+	distrustUnsupported = "UNSUPPORTED"
+)
+
+// distrustingVerifier is implemented by platform verifiers that can be told
+// to distrust certificates, e.g. by adding them to the operating system's
+// store of disallowed certificates.
+type distrustingVerifier interface {
+	// verifyDistrusting is like verify, but rejects any path through a
+	// certificate whose SHA-256 hash is in distrusted.
+	verifyDistrusting(leaf *x509.Certificate, intermediates []*x509.Certificate, dnsName string, distrusted [][sha256.Size]byte) error
+}
+
+// runDistrustTests runs the distrust tests, which verify chains that are
+// valid except that they pass through an explicitly distrusted certificate,
+// and returns the number of tests run and the number of failures. crypto/x509
+// has no way to distrust certificates, so the tests are only run with
+// -implementation=platform on a platform whose verifier implements
+// distrustingVerifier; otherwise each is recorded with recorder as
+// UNSUPPORTED, and none fail. It does nothing if the distrust corpus hasn't
+// been generated.
+func runDistrustTests(hostname string, recorder *resultRecorder) (numTests, numFailures int, err error) {
+	if !profile.runsOptionalCorpus("distrust") {
+		return 0, 0, nil
+	}
+
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(baseDir, "html", "distrustExpects.json"))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	expectations := new(distrustExpectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return 0, 0, err
+	}
+
+	distrustDir := filepath.Join(baseDir, "certificates", "distrust")
+
+	var verifier distrustingVerifier
+	if platform != nil {
+		rootChain, err := readPEMChain(filepath.Join(distrustDir, "root.crt"))
+		if err != nil {
+			return 0, 0, err
+		}
+		if len(rootChain) != 1 {
+			return 0, 0, fmt.Errorf("expected a single root in distrust/root.crt but found %d", len(rootChain))
+		}
+
+		distrustPlatform, err := loadPlatform(rootChain[0])
+		if err != nil {
+			return 0, 0, err
+		}
+		defer distrustPlatform.close()
+		verifier, _ = distrustPlatform.(distrustingVerifier)
+	}
+
+	if verifier == nil {
+		recorder.setDistrustSupport(distrustUnsupported)
+		for _, test := range expectations.Expects {
+			recorder.recordDistrust(&test, distrustUnsupported, nil)
+		}
+		fmt.Printf("Distrusted certificates: %s (%d tests not run)\n", distrustUnsupported, len(expectations.Expects))
+		return len(expectations.Expects), 0, nil
+	}
+
+	recorder.setDistrustSupport(distrustSupported)
+	for _, test := range expectations.Expects {
+		verifyErr := verifyDistrusted(verifier, filepath.Join(distrustDir, strconv.Itoa(test.Id)), hostname, &test)
+		recorder.recordDistrust(&test, distrustSupported, verifyErr)
+
+		if passed, description := classifyResult(test.Result, verifyErr == nil); !passed {
+			fmt.Printf("distrust #%d (%s, distrusting %s): %s%s\n", test.Id, test.Name, strings.Join(test.Distrusted, ","), description, errorSuffix(errString(verifyErr)))
+			numFailures++
+		}
+	}
+
+	return len(expectations.Expects), numFailures, nil
+}
+
+// verifyDistrusted verifies the chain at pathPrefix with verifier, distrusting
+// the certificates that test lists.
+func verifyDistrusted(verifier distrustingVerifier, pathPrefix, hostname string, test *distrustExpectation) error {
+	distrusted := make([][sha256.Size]byte, len(test.DistrustedHashes))
+	for i, hash := range test.DistrustedHashes {
+		decoded, err := hex.DecodeString(hash)
+		if err != nil || len(decoded) != sha256.Size {
+			return fmt.Errorf("distrusted hash %q isn't a hex SHA-256 hash", hash)
+		}
+		copy(distrusted[i][:], decoded)
+	}
+
+	leaf, err := readPEMChain(pathPrefix + ".crt")
+	if err != nil {
+		return err
+	}
+	if len(leaf) != 1 {
+		return fmt.Errorf("expected a single certificate in the .crt file, but found %d", len(leaf))
+	}
+
+	chain, err := readPEMChain(pathPrefix + ".chain")
+	if err != nil {
+		return err
+	}
+
+	return verifier.verifyDistrusting(leaf[0], chain, hostname, distrusted)
+}
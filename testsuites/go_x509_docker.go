@@ -0,0 +1,371 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dockerCorpusDir is where the corpus's certificates directory is mounted,
+// read-only, in a driver's container.
+const dockerCorpusDir = "/corpus"
+
+// The modes in which a driver's command is run.
+const (
+	// dockerPerTest runs the command once per verification, in a
+	// container started for the run, and takes its exit status as the
+	// result.
+	dockerPerTest = "per-test"
+	// dockerBatch runs the command once, speaking the external command's
+	// line protocol over its stdin and stdout.
+	dockerBatch = "batch"
+)
+
+// dockerDriver represents a driver file, which declares how to run a verifier
+// inside a Docker image, e.g.
+//
+//	{
+//	  "implementation": "OpenSSL",
+//	  "version": "3.0.2",
+//	  "image": "example/openssl@sha256:...",
+//	  "mode": "per-test",
+//	  "command": ["openssl", "verify", "-CAfile", "{root}", "-untrusted", "{chain}", "-verify_hostname", "{name}", "{leaf}"],
+//	  "nameTypes": ["dns"]
+//	}
+type dockerDriver struct {
+	// Implementation and Version name the verifier for the results file.
+	// In batch mode, the harness names it instead.
+	Implementation string `json:"implementation,omitempty"`
+	Version        string `json:"version,omitempty"`
+	// Image is the image to run, which should be pinned by digest so
+	// that runs are reproducible.
+	Image string `json:"image"`
+	// Mode is dockerPerTest, the default, or dockerBatch.
+	Mode string `json:"mode,omitempty"`
+	// Command is the command to run in the image. In per-test mode, these
+	// placeholders in its arguments are replaced for each verification:
+	//
+	//	{id}     the test's number
+	//	{type}   the type of name, "dns" or "ip"
+	//	{name}   the DNS name or IP address to verify the leaf for
+	//	{leaf}   the path in the container of the leaf, as PEM
+	//	{chain}  the path of the intermediates, as PEM
+	//	{root}   the path of the root, as PEM
+	//
+	// The certificate is accepted if the command exits with status zero,
+	// and otherwise its output is taken as the error. In batch mode it's
+	// run as is.
+	Command []string `json:"command"`
+	// NameTypes lists the types of name that the verifier can check in
+	// per-test mode, "dns" and "ip", both by default. In batch mode, the
+	// harness lists them instead.
+	NameTypes []string `json:"nameTypes,omitempty"`
+	// ErrorTaxonomy names the table in errorTaxonomy that the verifier's
+	// errors are classified with in per-test mode, which the command's
+	// output must then include the identifiers of. In batch mode, the
+	// harness names it instead.
+	ErrorTaxonomy string `json:"errorTaxonomy,omitempty"`
+}
+
+func loadDockerDriver(path string) (*dockerDriver, error) {
+	driverBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := new(dockerDriver)
+	if err := json.Unmarshal(driverBytes, ret); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", path, err)
+	}
+	if len(ret.Image) == 0 {
+		return nil, fmt.Errorf("%s: no image given", path)
+	}
+	if len(ret.Command) == 0 {
+		return nil, fmt.Errorf("%s: no command given", path)
+	}
+	switch ret.Mode {
+	case "":
+		ret.Mode = dockerPerTest
+	case dockerPerTest, dockerBatch:
+	default:
+		return nil, fmt.Errorf("%s: unknown mode %q", path, ret.Mode)
+	}
+	if ret.Mode == dockerPerTest && len(ret.Implementation) == 0 {
+		return nil, fmt.Errorf("%s: no implementation given", path)
+	}
+	if len(ret.NameTypes) == 0 {
+		ret.NameTypes = []string{"dns", "ip"}
+	}
+
+	return ret, nil
+}
+
+// runDocker implements the docker command, which runs the main corpus
+// against a verifier inside the Docker image that a driver file declares,
+// so that pinned versions of verifiers can be measured reproducibly without
+// installing them. The certificates directory is mounted read-only at
+// dockerCorpusDir, and containers have no network.
+func runDocker(args []string) error {
+	flags := flag.NewFlagSet("docker", flag.ExitOnError)
+	binary := flags.String("docker", "docker", "The docker binary to run, or a compatible one such as podman")
+	resultsPath := flags.String("results", "", "If set, the path to write a results file to")
+	resultsKeyPath := flags.String("results-key", "", resultsKeyUsage)
+	numWorkers := flags.Int("workers", defaultWorkers, workersUsage+", in per-test mode")
+	checkpointPath := flags.String("checkpoint", "", checkpointUsage)
+	profileName := flags.String("profile", "stress", profileUsage)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: docker [flags] driver.json\n")
+		flags.PrintDefaults()
+	}
+	logLevel := flags.String("log-level", "info", logLevelUsage)
+	logFormat := flags.String("log-format", "text", logFormatUsage)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("a single driver file must be given")
+	}
+	driver, err := loadDockerDriver(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if err := selectProfile(*profileName); err != nil {
+		return err
+	}
+	if err := selectLogger(*logLevel, *logFormat); err != nil {
+		return err
+	}
+	resultsKey, err := loadResultsKey(*resultsKeyPath)
+	if err != nil {
+		return err
+	}
+
+	corpusDir, err := filepath.Abs(certificatesDir)
+	if err != nil {
+		return err
+	}
+	image, err := resolveDockerImage(*binary, driver.Image)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Running %s\n", image)
+
+	run := &externalRun{
+		resultsPath:    *resultsPath,
+		resultsKey:     resultsKey,
+		checkpointPath: *checkpointPath,
+		annotate: func(recorder *resultRecorder) {
+			recorder.setImage(image)
+		},
+	}
+	mount := corpusDir + ":" + dockerCorpusDir + ":ro"
+
+	if driver.Mode == dockerBatch {
+		if run.reader, err = openCorpusReader("pem"); err != nil {
+			return err
+		}
+		harnessArgs := append([]string{"run", "--rm", "-i", "--network", "none", "-v", mount, image}, driver.Command...)
+		return runExternalHarness(*binary, harnessArgs, run)
+	}
+
+	// The container idles while each verification is run in it with
+	// docker exec, which is much quicker than starting one per test.
+	start := exec.Command(*binary, "run", "--rm", "-d", "--network", "none", "-v", mount, "--entrypoint", "sleep", image, "infinity")
+	start.Stderr = os.Stderr
+	output, err := start.Output()
+	if err != nil {
+		return fmt.Errorf("starting %s: %s", image, err)
+	}
+	container := strings.TrimSpace(string(output))
+	defer exec.Command(*binary, "rm", "-f", container).Run()
+
+	return runDockerPerTest(*binary, container, driver, run, *numWorkers)
+}
+
+// resolveDockerImage returns image pinned by the digest of its repository,
+// pulling it if it isn't present, so that the results file records exactly
+// what was run. Images that were built locally have no such digest, and are
+// returned as they were given.
+func resolveDockerImage(binary, image string) (string, error) {
+	if strings.Contains(image, "@sha256:") {
+		return image, nil
+	}
+
+	inspect := func() ([]byte, error) {
+		return exec.Command(binary, "image", "inspect", "--format", "{{join .RepoDigests \" \"}}", image).Output()
+	}
+	output, err := inspect()
+	if err != nil {
+		pull := exec.Command(binary, "pull", image)
+		pull.Stdout, pull.Stderr = os.Stderr, os.Stderr
+		if err := pull.Run(); err != nil {
+			return "", fmt.Errorf("pulling %s: %s", image, err)
+		}
+		if output, err = inspect(); err != nil {
+			return "", fmt.Errorf("inspecting %s: %s", image, err)
+		}
+	}
+
+	digests := strings.Fields(string(output))
+	if len(digests) == 0 {
+		fmt.Fprintf(os.Stderr, "%s has no repository digest, so the results won't identify it exactly\n", image)
+		return image, nil
+	}
+	return digests[0], nil
+}
+
+// runDockerPerTest runs the main corpus, as filtered by the selected profile,
+// with a docker exec of the driver's command in container for each
+// verification.
+func runDockerPerTest(binary, container string, driver *dockerDriver, run *externalRun, numWorkers int) error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	expectations, err := loadExpectations()
+	if err != nil {
+		return err
+	}
+	numFiltered, err := profile.filter(expectations)
+	if err != nil {
+		return err
+	}
+
+	nameTypes := make(map[string]bool)
+	for _, nameType := range driver.NameTypes {
+		nameTypes[nameType] = true
+	}
+
+	recorder := newResultRecorder(deliveryPool)
+	recorder.setSigningKey(run.resultsKey)
+	profile.recordFiltered(recorder, numFiltered)
+	recorder.userAgent = driver.Implementation
+	recorder.setImplementation(driver.Implementation, driver.Version)
+	if len(driver.Version) > 0 {
+		recorder.userAgent += " " + driver.Version
+	}
+	recorder.taxonomy = driver.ErrorTaxonomy
+	run.annotate(recorder)
+	fmt.Printf("Testing %s\n", recorder.userAgent)
+
+	cp, err := openCheckpoint(run.checkpointPath, recorder.userAgent, config.TestVersion)
+	if err != nil {
+		return err
+	}
+	defer cp.close()
+
+	numTests := 0
+	for _, nameType := range []string{"dns", "ip"} {
+		if nameTypes[nameType] {
+			numTests += len(expectations.Expects)
+		}
+	}
+
+	numFailures := runPipeline(expectations.Expects, numWorkers, cp.wrap(recorder, func(test *expectation) bool {
+		nameType := "ip"
+		if test.testDNS {
+			nameType = "dns"
+		}
+		if !nameTypes[nameType] {
+			reason := &skip{skipUnsupportedNameType, driver.Implementation + " doesn't support verifying " + nameType + " names"}
+			traceSkip(test, reason)
+			recorder.recordSkip(reason)
+			return false
+		}
+		return runDockerTest(binary, container, driver, test, config, recorder)
+	}), failureReporter(nil))
+
+	recorder.printSkips()
+
+	if len(run.resultsPath) > 0 {
+		if err := recorder.write(run.resultsPath, config.TestVersion); err != nil {
+			return err
+		}
+	}
+	if err := cp.finish(); err != nil {
+		return err
+	}
+
+	if numFailures != 0 {
+		return fmt.Errorf("failed %d of %d tests", numFailures, numTests)
+	}
+
+	return nil
+}
+
+// runDockerTest verifies the certificate for test with the driver's command
+// and returns whether the test failed. A WEAK-OK expectation is met whatever
+// the result. The result of the verification is recorded with recorder.
+func runDockerTest(binary, container string, driver *dockerDriver, test *expectation, config *configFile, recorder *resultRecorder) (failed bool) {
+	expect, nameType, name := &test.IP, "ip", config.testIP(test)
+	if test.testDNS {
+		expect, nameType, name = &test.DNS, "dns", config.testHostname(test)
+	}
+
+	id := strconv.Itoa(test.Id)
+	replacer := strings.NewReplacer(
+		"{id}", id,
+		"{type}", nameType,
+		"{name}", name,
+		"{leaf}", dockerCorpusDir+"/"+id+".crt",
+		"{chain}", dockerCorpusDir+"/"+id+".chain",
+		"{root}", dockerCorpusDir+"/root.crt",
+	)
+	args := []string{"exec", container}
+	for _, arg := range driver.Command {
+		args = append(args, replacer.Replace(arg))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), limits.timeout)
+	defer cancel()
+
+	start := time.Now()
+	output, err := exec.CommandContext(ctx, binary, args...).CombinedOutput()
+	elapsed := time.Since(start)
+
+	var verifyErr error
+	if err != nil {
+		// docker exec exits with 126 or 127 if the command couldn't be
+		// run at all, which mustn't be mistaken for a rejection.
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok || ctx.Err() != nil || exitErr.ExitCode() == 126 || exitErr.ExitCode() == 127 {
+			test.err = fmt.Errorf("running %s: %v: %s", driver.Command[0], err, strings.TrimSpace(string(output)))
+			return true
+		}
+		verifyErr = errors.New(strings.TrimSpace(string(output)) + " (" + err.Error() + ")")
+	}
+
+	traceVerification(test, name, verifyErr, elapsed)
+	recorder.record(test, verifyErr, elapsed)
+
+	passed, description := gradeResult(expect, verifyErr == nil, errorReasonOf(recorder.taxonomy, verifyErr))
+	if !passed {
+		test.err = fmt.Errorf("%s: %v", description, verifyErr)
+	}
+	return !passed
+}
@@ -0,0 +1,343 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// featureCitations gives the section of the RFCs that each feature relates
+// to.
+var featureCitations = map[string]string{
+	"sanPresent":           "RFC 5280, section 4.2.1.6 (Subject Alternative Name)",
+	"dnsInCn":              "RFC 6125, section 6.4.4 (Checking of Common Names)",
+	"ipInCn":               "RFC 6125, section 6.4.4 (Checking of Common Names)",
+	"dnsInSan":             "RFC 5280, section 4.2.1.6 (Subject Alternative Name)",
+	"ipInSan":              "RFC 5280, section 4.2.1.6 (Subject Alternative Name)",
+	"dnsNamePresent":       "RFC 6125, section 6.4.1 (Checking of Traditional Domain Names)",
+	"ipNamePresent":        "RFC 2818, section 3.1 (Server Identity)",
+	"dnsCnViolation":       "RFC 5280, section 4.2.1.10 (Name Constraints)",
+	"ipCnViolation":        "RFC 5280, section 4.2.1.10 (Name Constraints)",
+	"dnsSanViolation":      "RFC 5280, section 4.2.1.10 (Name Constraints)",
+	"ipSanViolation":       "RFC 5280, section 4.2.1.10 (Name Constraints)",
+	"dnsConstraintPresent": "RFC 5280, section 4.2.1.10 (Name Constraints)",
+	"ipConstraintPresent":  "RFC 5280, section 4.2.1.10 (Name Constraints)",
+	"constraintType":       "RFC 5280, section 4.2.1.10 (Name Constraints)",
+}
+
+// serveDocs implements the docs command, which serves a browsable view of
+// the corpus: its dimensions, each test and the error reasons.
+func serveDocs(args []string) error {
+	flags := flag.NewFlagSet("docs", flag.ExitOnError)
+	listen := flags.String("listen", "localhost:8080", "Address to serve the documentation on")
+	flags.Parse(args)
+
+	expectations, err := loadExpectations()
+	if err != nil {
+		return err
+	}
+
+	manifest, err := loadManifest()
+	if err != nil {
+		return err
+	}
+
+	docs := &docsServer{
+		expectations: expectations,
+		certDefs:     make(map[int]*certDef),
+	}
+	for i := range manifest.CertManifest {
+		docs.certDefs[manifest.CertManifest[i].Id] = &manifest.CertManifest[i]
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", docs.index)
+	mux.HandleFunc("/test/", docs.test)
+	mux.HandleFunc("/reasons", docs.reasons)
+	mux.Handle("/certificates/", http.StripPrefix("/certificates/", http.FileServer(http.Dir(filepath.Join(baseDir, "certificates")))))
+
+	log.Printf("Serving documentation on http://%s/", *listen)
+	return http.ListenAndServe(*listen, mux)
+}
+
+type docsServer struct {
+	expectations *expectations
+	certDefs     map[int]*certDef
+}
+
+type docsDimension struct {
+	Name     string
+	Citation string
+	Values   []docsDimensionValue
+}
+
+type docsDimensionValue struct {
+	Value string
+	Count int
+}
+
+type docsTestSummary struct {
+	Id           int
+	DNS          string
+	IP           string
+	Descriptions string
+}
+
+// index lists the dimensions of the corpus and the tests that match the
+// query in the q parameter. The query is a list of terms, each either a
+// feature=value pair or text to find in a test's ID or descriptions.
+func (d *docsServer) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	query := r.FormValue("q")
+	terms := strings.Fields(strings.ToLower(query))
+
+	counts := make(map[string]map[string]int)
+	var matches []docsTestSummary
+	for i := range d.expectations.Expects {
+		e := &d.expectations.Expects[i]
+		values := e.Features.values()
+		for name, value := range values {
+			if counts[name] == nil {
+				counts[name] = make(map[string]int)
+			}
+			counts[name][value]++
+		}
+
+		descriptions := strings.Join(append(append(append([]string{}, e.Descriptions...), e.DNS.Descriptions...), e.IP.Descriptions...), " ")
+		if !matchesTerms(terms, e.Id, descriptions, values) {
+			continue
+		}
+		matches = append(matches, docsTestSummary{
+			Id:           e.Id,
+			DNS:          e.DNS.Result,
+			IP:           e.IP.Result,
+			Descriptions: descriptions,
+		})
+	}
+
+	var dimensions []docsDimension
+	for name, values := range counts {
+		dimension := docsDimension{Name: name, Citation: featureCitations[name]}
+		for value, count := range values {
+			dimension.Values = append(dimension.Values, docsDimensionValue{value, count})
+		}
+		sort.Slice(dimension.Values, func(i, j int) bool {
+			return dimension.Values[i].Value < dimension.Values[j].Value
+		})
+		dimensions = append(dimensions, dimension)
+	}
+	sort.Slice(dimensions, func(i, j int) bool {
+		return dimensions[i].Name < dimensions[j].Name
+	})
+
+	d.render(w, "index", struct {
+		Query      string
+		NumTests   int
+		Dimensions []docsDimension
+		Matches    []docsTestSummary
+	}{query, len(d.expectations.Expects), dimensions, matches})
+}
+
+func matchesTerms(terms []string, id int, descriptions string, values map[string]string) bool {
+	descriptions = strings.ToLower(descriptions)
+	for _, term := range terms {
+		if i := strings.Index(term, "="); i > 0 {
+			matched := false
+			for name, value := range values {
+				if strings.ToLower(name) == term[:i] && strings.ToLower(value) == term[i+1:] {
+					matched = true
+				}
+			}
+			if !matched {
+				return false
+			}
+			continue
+		}
+		if term != strconv.Itoa(id) && !strings.Contains(descriptions, term) {
+			return false
+		}
+	}
+	return true
+}
+
+type docsFeature struct {
+	Name     string
+	Value    string
+	Citation string
+}
+
+// test explains a single test: how its certificates were generated, its
+// features and what's expected of a verifier.
+func (d *docsServer) test(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/test/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var e *expectation
+	for i := range d.expectations.Expects {
+		if d.expectations.Expects[i].Id == id {
+			e = &d.expectations.Expects[i]
+			break
+		}
+	}
+	if e == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var features []docsFeature
+	for name, value := range e.Features.values() {
+		features = append(features, docsFeature{name, value, featureCitations[name]})
+	}
+	sort.Slice(features, func(i, j int) bool {
+		return features[i].Name < features[j].Name
+	})
+
+	d.render(w, "test", struct {
+		Expectation *expectation
+		CertDef     *certDef
+		Features    []docsFeature
+	}{e, d.certDefs[id], features})
+}
+
+type docsReason struct {
+	Reason      errorReason
+	Description string
+	// Identifiers maps each implementation to its error identifiers that
+	// are classified as this reason.
+	Identifiers map[string][]string
+}
+
+// reasons lists the error reasons and the identifiers that map to them.
+func (d *docsServer) reasons(w http.ResponseWriter, r *http.Request) {
+	var reasons []docsReason
+	for reason, description := range errorReasonDescriptions {
+		entry := docsReason{reason, description, make(map[string][]string)}
+		for implementation, table := range errorTaxonomy {
+			for identifier, mapped := range table {
+				if mapped == reason {
+					entry.Identifiers[implementation] = append(entry.Identifiers[implementation], identifier)
+				}
+			}
+			sort.Strings(entry.Identifiers[implementation])
+		}
+		reasons = append(reasons, entry)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		return reasons[i].Reason < reasons[j].Reason
+	})
+
+	d.render(w, "reasons", reasons)
+}
+
+func (d *docsServer) render(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := docsTemplates.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("rendering %s: %s", name, err)
+	}
+}
+
+var docsTemplates = template.Must(template.New("docs").Funcs(template.FuncMap{
+	"deref": func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	},
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>BetterTLS Corpus</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; }
+table { border-collapse: collapse; margin-bottom: 12px; }
+th, td { border: 1px solid #ccc; padding: 2px 6px; text-align: left; vertical-align: top; }
+</style>
+</head>
+<body>
+<p><a href="/">Tests</a> | <a href="/reasons">Error reasons</a></p>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "index"}}{{template "header"}}
+<h1>BetterTLS Corpus</h1>
+<form action="/"><input name="q" size="60" value="{{.Query}}" placeholder="e.g. constrainttype=excluded dnssanviolation=true"> <input type="submit" value="Search"></form>
+<h2>Dimensions</h2>
+<table>
+<tr><th>Feature</th><th>Values</th><th>Reference</th></tr>
+{{range .Dimensions}}{{$name := .Name}}<tr><td>{{.Name}}</td><td>{{range .Values}}<a href="/?q={{$name}}={{.Value}}">{{.Value}}</a> ({{.Count}}) {{end}}</td><td>{{.Citation}}</td></tr>
+{{end}}</table>
+<h2>Tests</h2>
+<p>{{len .Matches}} of {{.NumTests}} tests match.</p>
+<table>
+<tr><th>Test</th><th>DNS</th><th>IP</th><th>Descriptions</th></tr>
+{{range .Matches}}<tr><td><a href="/test/{{.Id}}">{{.Id}}</a></td><td>{{.DNS}}</td><td>{{.IP}}</td><td>{{.Descriptions}}</td></tr>
+{{end}}</table>
+{{template "footer"}}{{end}}
+
+{{define "test"}}{{template "header"}}
+{{with .Expectation}}<h1>Test {{.Id}}</h1>
+<p><a href="/certificates/{{.Id}}.crt">Leaf certificate</a> | <a href="/certificates/{{.Id}}.chain">Chain</a></p>
+{{end}}{{with .CertDef}}<h2>Certificates</h2>
+<table>
+<tr><th>Leaf common name</th><td>{{deref .CommonName}}</td></tr>
+<tr><th>Leaf subject alternative names</th><td>{{range .SANs}}{{.}} {{end}}</td></tr>
+<tr><th>Permitted subtrees</th><td>{{range .NameConstraints.Whitelist}}{{.}} {{end}}</td></tr>
+<tr><th>Excluded subtrees</th><td>{{range .NameConstraints.Blacklist}}{{.}} {{end}}</td></tr>
+</table>
+{{end}}<h2>Features</h2>
+<table>
+<tr><th>Feature</th><th>Value</th><th>Reference</th></tr>
+{{range .Features}}<tr><td>{{.Name}}</td><td>{{.Value}}</td><td>{{.Citation}}</td></tr>
+{{end}}</table>
+{{with .Expectation}}<h2>Expectations</h2>
+<table>
+<tr><th></th><th>Expect</th><th>Why</th></tr>
+<tr><th>DNS</th><td>{{.DNS.Result}}</td><td>{{range .Descriptions}}{{.}} {{end}}{{range .DNS.Descriptions}}{{.}} {{end}}</td></tr>
+<tr><th>IP</th><td>{{.IP.Result}}</td><td>{{range .Descriptions}}{{.}} {{end}}{{range .IP.Descriptions}}{{.}} {{end}}</td></tr>
+</table>
+{{if .Profiles}}<h2>Policy profiles</h2>
+<table>
+<tr><th>Profile</th><th>DNS</th><th>IP</th></tr>
+{{range $name, $results := .Profiles}}<tr><td>{{$name}}</td><td>{{$results.DNS}}</td><td>{{$results.IP}}</td></tr>
+{{end}}</table>
+{{end}}{{end}}{{template "footer"}}{{end}}
+
+{{define "reasons"}}{{template "header"}}
+<h1>Error reasons</h1>
+<table>
+<tr><th>Reason</th><th>Description</th><th>Identifiers</th></tr>
+{{range .}}<tr><td>{{.Reason}}</td><td>{{.Description}}</td><td>{{range $implementation, $identifiers := .Identifiers}}{{if $identifiers}}<b>{{$implementation}}</b>: {{range $identifiers}}{{.}} {{end}}<br>{{end}}{{end}}</td></tr>
+{{end}}</table>
+{{template "footer"}}{{end}}
+`))
@@ -0,0 +1,135 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// failureDumper writes what's needed to reproduce each failing test of the run
+// command outside of the harness to a directory named by its ID, for
+// -dump-failures: leaf.pem, chain.pem and root.pem, verify-options.json,
+// describing the x509.VerifyOptions used, and reproduce.go, a program that
+// verifies the certificates with them.
+type failureDumper struct {
+	dir      string
+	config   *configFile
+	corpus   *corpusLoader
+	root     *x509.Certificate
+	delivery string
+	verifier string
+	// numDumped is only used from runPipeline's onFailure, so needs no
+	// lock.
+	numDumped int
+}
+
+// dumpedVerifyOptions describes the x509.VerifyOptions that a test was
+// verified with, with its certificate pools given as the files that hold
+// them. KeyUsages is left empty, for which Verify checks for ServerAuth.
+type dumpedVerifyOptions struct {
+	DNSName       string `json:"dnsName"`
+	Roots         string `json:"roots"`
+	Intermediates string `json:"intermediates"`
+	// IntermediateDelivery is as in results files. With "preinstalled",
+	// the Intermediates pool held every test's intermediates rather than
+	// only those in chain.pem.
+	IntermediateDelivery string `json:"intermediateDelivery"`
+	// CurrentTime is left as zero, for the time of verification, so this
+	// is the time of the run, which matters once the certificates expire.
+	CurrentTime time.Time `json:"currentTime"`
+	// Verifier is the verifier that the test failed with, which is only
+	// given the VerifyOptions if it's crypto/x509.
+	Verifier string `json:"verifier"`
+}
+
+// wrap returns an onFailure function for runPipeline that calls onFailure and
+// then dumps the failure, logging any error in doing so.
+func (d *failureDumper) wrap(onFailure func(failure expectation)) func(failure expectation) {
+	return func(failure expectation) {
+		onFailure(failure)
+		if err := d.dump(&failure); err != nil {
+			fmt.Fprintf(os.Stderr, "Dumping #%d: %v\n", failure.Id, err)
+		}
+	}
+}
+
+// dump writes the failing test's directory. Only DNS tests are run by the run
+// command, so only they are dumped.
+func (d *failureDumper) dump(test *expectation) error {
+	if !test.testDNS {
+		return nil
+	}
+
+	leaf, chain, err := d.corpus.certificates(test.Id)
+	if err != nil {
+		return err
+	}
+	shouldFail, err := test.shouldFailDNS()
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(d.dir, strconv.Itoa(test.Id))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var chainPEM string
+	for _, der := range chain {
+		chainPEM += pemString(der)
+	}
+	files := map[string]string{
+		"leaf.pem":  pemString(leaf),
+		"chain.pem": chainPEM,
+		"root.pem":  pemString(d.root.Raw),
+	}
+
+	dnsName := d.config.testHostname(test)
+	options, err := json.MarshalIndent(&dumpedVerifyOptions{
+		DNSName:              dnsName,
+		Roots:                "root.pem",
+		Intermediates:        "chain.pem",
+		IntermediateDelivery: d.delivery,
+		CurrentTime:          time.Now().UTC().Truncate(time.Second),
+		Verifier:             d.verifier,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	files["verify-options.json"] = string(options) + "\n"
+
+	note := fmt.Sprintf("With %s, the harness failed the test: %v", runtime.Version(), test.err)
+	source, err := newReproducer(test, dnsName, leaf, chain, d.root.Raw, shouldFail, note).source()
+	if err != nil {
+		return err
+	}
+	files["reproduce.go"] = string(source)
+
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			return err
+		}
+	}
+	d.numDumped++
+	return nil
+}
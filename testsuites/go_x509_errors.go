@@ -0,0 +1,283 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// errorReason is an implementation-independent classification of why a
+// certificate was rejected.
+type errorReason string
+
+const (
+	reasonNameConstraintViolation    errorReason = "NAME_CONSTRAINT_VIOLATION"
+	reasonUnsupportedNameConstraint  errorReason = "UNSUPPORTED_NAME_CONSTRAINT"
+	reasonHostnameMismatch           errorReason = "HOSTNAME_MISMATCH"
+	reasonUnknownAuthority           errorReason = "UNKNOWN_AUTHORITY"
+	reasonExpired                    errorReason = "EXPIRED"
+	reasonNotYetValid                errorReason = "NOT_YET_VALID"
+	reasonInvalidCA                  errorReason = "INVALID_CA"
+	reasonPathLengthExceeded         errorReason = "PATH_LENGTH_EXCEEDED"
+	reasonIncompatibleUsage          errorReason = "INCOMPATIBLE_USAGE"
+	reasonUnhandledCriticalExtension errorReason = "UNHANDLED_CRITICAL_EXTENSION"
+	reasonBadSignature               errorReason = "BAD_SIGNATURE"
+	reasonInsecureAlgorithm          errorReason = "INSECURE_ALGORITHM"
+	reasonRevoked                    errorReason = "REVOKED"
+	reasonParseError                 errorReason = "PARSE_ERROR"
+	reasonOther                      errorReason = "OTHER"
+)
+
+// errorReasonDescriptions documents each reason.
+var errorReasonDescriptions = map[errorReason]string{
+	reasonNameConstraintViolation:    "A name in the certificate violates a name constraint.",
+	reasonUnsupportedNameConstraint:  "A name constraint couldn't be evaluated, e.g. because of its type or syntax.",
+	reasonHostnameMismatch:           "The certificate isn't valid for the name being verified.",
+	reasonUnknownAuthority:           "No chain to a trusted root could be built.",
+	reasonExpired:                    "A certificate in the chain has expired.",
+	reasonNotYetValid:                "A certificate in the chain isn't valid yet.",
+	reasonInvalidCA:                  "An issuing certificate isn't permitted to act as a CA.",
+	reasonPathLengthExceeded:         "The chain is longer than a path length constraint or the verifier's limit allows.",
+	reasonIncompatibleUsage:          "A key usage or extended key usage doesn't permit the requested use.",
+	reasonUnhandledCriticalExtension: "A certificate has a critical extension that the verifier doesn't understand.",
+	reasonBadSignature:               "A signature in the chain doesn't verify.",
+	reasonInsecureAlgorithm:          "A certificate is signed with an algorithm that the verifier considers insecure.",
+	reasonRevoked:                    "A certificate in the chain has been revoked.",
+	reasonParseError:                 "A certificate couldn't be parsed.",
+	reasonOther:                      "The error couldn't be classified.",
+}
+
+// errorTaxonomy maps the error identifiers of each implementation to reasons.
+// Identifiers are the names that the implementation uses for its errors: type
+// and reason names for Go, X509_V_ERR codes for OpenSSL and LibreSSL, SEC/SSL
+// error codes for NSS, verification status flags for GnuTLS, error variant
+// names for rustls and webpki, and exception classes, with their reason where
+// there is one, for Java.
+var errorTaxonomy = map[string]map[string]errorReason{
+	"go": {
+		"x509.HostnameError":                                         reasonHostnameMismatch,
+		"x509.UnknownAuthorityError":                                 reasonUnknownAuthority,
+		"x509.UnhandledCriticalExtension":                            reasonUnhandledCriticalExtension,
+		"x509.ConstraintViolationError":                              reasonIncompatibleUsage,
+		"x509.InsecureAlgorithmError":                                reasonInsecureAlgorithm,
+		"x509.SystemRootsError":                                      reasonUnknownAuthority,
+		"x509.CertificateInvalidError:NotAuthorizedToSign":           reasonInvalidCA,
+		"x509.CertificateInvalidError:Expired":                       reasonExpired,
+		"x509.CertificateInvalidError:CANotAuthorizedForThisName":    reasonNameConstraintViolation,
+		"x509.CertificateInvalidError:TooManyIntermediates":          reasonPathLengthExceeded,
+		"x509.CertificateInvalidError:IncompatibleUsage":             reasonIncompatibleUsage,
+		"x509.CertificateInvalidError:NameMismatch":                  reasonUnknownAuthority,
+		"x509.CertificateInvalidError:NameConstraintsWithoutSANs":    reasonNameConstraintViolation,
+		"x509.CertificateInvalidError:UnconstrainedName":             reasonUnsupportedNameConstraint,
+		"x509.CertificateInvalidError:TooManyConstraints":            reasonUnsupportedNameConstraint,
+		"x509.CertificateInvalidError:CANotAuthorizedForExtKeyUsage": reasonIncompatibleUsage,
+		"x509.CertificateInvalidError:NoValidChains":                 reasonUnknownAuthority,
+	},
+	"openssl": {
+		"X509_V_ERR_UNABLE_TO_GET_ISSUER_CERT":         reasonUnknownAuthority,
+		"X509_V_ERR_CERT_SIGNATURE_FAILURE":            reasonBadSignature,
+		"X509_V_ERR_CERT_NOT_YET_VALID":                reasonNotYetValid,
+		"X509_V_ERR_CERT_HAS_EXPIRED":                  reasonExpired,
+		"X509_V_ERR_DEPTH_ZERO_SELF_SIGNED_CERT":       reasonUnknownAuthority,
+		"X509_V_ERR_SELF_SIGNED_CERT_IN_CHAIN":         reasonUnknownAuthority,
+		"X509_V_ERR_UNABLE_TO_GET_ISSUER_CERT_LOCALLY": reasonUnknownAuthority,
+		"X509_V_ERR_UNABLE_TO_VERIFY_LEAF_SIGNATURE":   reasonUnknownAuthority,
+		"X509_V_ERR_CERT_CHAIN_TOO_LONG":               reasonPathLengthExceeded,
+		"X509_V_ERR_CERT_REVOKED":                      reasonRevoked,
+		"X509_V_ERR_INVALID_CA":                        reasonInvalidCA,
+		"X509_V_ERR_PATH_LENGTH_EXCEEDED":              reasonPathLengthExceeded,
+		"X509_V_ERR_INVALID_PURPOSE":                   reasonIncompatibleUsage,
+		"X509_V_ERR_CERT_UNTRUSTED":                    reasonUnknownAuthority,
+		"X509_V_ERR_KEYUSAGE_NO_CERTSIGN":              reasonInvalidCA,
+		"X509_V_ERR_UNHANDLED_CRITICAL_EXTENSION":      reasonUnhandledCriticalExtension,
+		"X509_V_ERR_PERMITTED_VIOLATION":               reasonNameConstraintViolation,
+		"X509_V_ERR_EXCLUDED_VIOLATION":                reasonNameConstraintViolation,
+		"X509_V_ERR_SUBTREE_MINMAX":                    reasonUnsupportedNameConstraint,
+		"X509_V_ERR_UNSUPPORTED_CONSTRAINT_TYPE":       reasonUnsupportedNameConstraint,
+		"X509_V_ERR_UNSUPPORTED_CONSTRAINT_SYNTAX":     reasonUnsupportedNameConstraint,
+		"X509_V_ERR_UNSUPPORTED_NAME_SYNTAX":           reasonUnsupportedNameConstraint,
+		"X509_V_ERR_HOSTNAME_MISMATCH":                 reasonHostnameMismatch,
+		"X509_V_ERR_IP_ADDRESS_MISMATCH":               reasonHostnameMismatch,
+	},
+	"nss": {
+		"SEC_ERROR_UNKNOWN_ISSUER":              reasonUnknownAuthority,
+		"SEC_ERROR_UNTRUSTED_ISSUER":            reasonUnknownAuthority,
+		"SEC_ERROR_EXPIRED_CERTIFICATE":         reasonExpired,
+		"SEC_ERROR_EXPIRED_ISSUER_CERTIFICATE":  reasonExpired,
+		"SEC_ERROR_CERT_NOT_IN_NAME_SPACE":      reasonNameConstraintViolation,
+		"SSL_ERROR_BAD_CERT_DOMAIN":             reasonHostnameMismatch,
+		"SEC_ERROR_CA_CERT_INVALID":             reasonInvalidCA,
+		"SEC_ERROR_PATH_LEN_CONSTRAINT_INVALID": reasonPathLengthExceeded,
+		"SEC_ERROR_INADEQUATE_KEY_USAGE":        reasonIncompatibleUsage,
+		"SEC_ERROR_INADEQUATE_CERT_TYPE":        reasonIncompatibleUsage,
+		"SEC_ERROR_UNKNOWN_CRITICAL_EXTENSION":  reasonUnhandledCriticalExtension,
+		"SEC_ERROR_BAD_SIGNATURE":               reasonBadSignature,
+		"SEC_ERROR_BAD_DER":                     reasonParseError,
+		"SEC_ERROR_REVOKED_CERTIFICATE":         reasonRevoked,
+	},
+	"gnutls": {
+		"GNUTLS_CERT_REVOKED":          reasonRevoked,
+		"GNUTLS_CERT_SIGNER_NOT_FOUND": reasonUnknownAuthority,
+		"GNUTLS_CERT_SIGNER_NOT_CA":    reasonInvalidCA,
+		// GnuTLS also reports path length violations this way, so they
+		// can't be told apart from name constraint violations.
+		"GNUTLS_CERT_SIGNER_CONSTRAINTS_FAILURE": reasonNameConstraintViolation,
+		"GNUTLS_CERT_INSECURE_ALGORITHM":         reasonInsecureAlgorithm,
+		"GNUTLS_CERT_NOT_ACTIVATED":              reasonNotYetValid,
+		"GNUTLS_CERT_EXPIRED":                    reasonExpired,
+		"GNUTLS_CERT_SIGNATURE_FAILURE":          reasonBadSignature,
+		"GNUTLS_CERT_UNEXPECTED_OWNER":           reasonHostnameMismatch,
+		"GNUTLS_CERT_PURPOSE_MISMATCH":           reasonIncompatibleUsage,
+		"GNUTLS_CERT_UNKNOWN_CRIT_EXTENSIONS":    reasonUnhandledCriticalExtension,
+	},
+	// rustls reports webpki's errors as its own where it has an equivalent,
+	// and otherwise wraps them, so both sets of names are listed.
+	"rustls": {
+		"UnknownIssuer":                reasonUnknownAuthority,
+		"Expired":                      reasonExpired,
+		"NotValidYet":                  reasonNotYetValid,
+		"NotValidForName":              reasonHostnameMismatch,
+		"BadSignature":                 reasonBadSignature,
+		"BadEncoding":                  reasonParseError,
+		"Revoked":                      reasonRevoked,
+		"InvalidPurpose":               reasonIncompatibleUsage,
+		"UnhandledCriticalExtension":   reasonUnhandledCriticalExtension,
+		"NameConstraintViolation":      reasonNameConstraintViolation,
+		"MalformedNameConstraint":      reasonUnsupportedNameConstraint,
+		"InvalidNetworkMaskConstraint": reasonUnsupportedNameConstraint,
+		"UnsupportedNameType":          reasonUnsupportedNameConstraint,
+		"CaUsedAsEndEntity":            reasonInvalidCA,
+		"EndEntityUsedAsCa":            reasonInvalidCA,
+		"PathLenConstraintViolated":    reasonPathLengthExceeded,
+		"MaximumPathDepthExceeded":     reasonPathLengthExceeded,
+		"UnsupportedCriticalExtension": reasonUnhandledCriticalExtension,
+		"MalformedDnsIdentifier":       reasonParseError,
+		"MalformedExtensions":          reasonParseError,
+	},
+	"java": {
+		"java.security.cert.CertPathValidatorException:NO_TRUST_ANCHOR":       reasonUnknownAuthority,
+		"java.security.cert.CertPathValidatorException:NAME_CHAINING":         reasonUnknownAuthority,
+		"java.security.cert.CertPathValidatorException:INVALID_NAME":          reasonNameConstraintViolation,
+		"java.security.cert.CertPathValidatorException:INVALID_KEY_USAGE":     reasonIncompatibleUsage,
+		"java.security.cert.CertPathValidatorException:PATH_TOO_LONG":         reasonPathLengthExceeded,
+		"java.security.cert.CertPathValidatorException:NOT_CA_CERT":           reasonInvalidCA,
+		"java.security.cert.CertPathValidatorException:UNRECOGNIZED_CRIT_EXT": reasonUnhandledCriticalExtension,
+		"java.security.cert.CertPathValidatorException:EXPIRED":               reasonExpired,
+		"java.security.cert.CertPathValidatorException:NOT_YET_VALID":         reasonNotYetValid,
+		"java.security.cert.CertPathValidatorException:INVALID_SIGNATURE":     reasonBadSignature,
+		"java.security.cert.CertPathValidatorException:ALGORITHM_CONSTRAINED": reasonInsecureAlgorithm,
+		"java.security.cert.CertPathValidatorException:REVOKED":               reasonRevoked,
+		"sun.security.provider.certpath.SunCertPathBuilderException":          reasonUnknownAuthority,
+		"java.security.cert.CertificateParsingException":                      reasonParseError,
+		"java.security.cert.CertificateException:NO_SUBJECT_ALTERNATIVE_NAME": reasonHostnameMismatch,
+	},
+}
+
+// classifyError maps an implementation's error identifier to a reason,
+// returning reasonOther for identifiers that aren't in the taxonomy.
+func classifyError(implementation, identifier string) errorReason {
+	if reason, ok := errorTaxonomy[implementation][identifier]; ok {
+		return reason
+	}
+	return reasonOther
+}
+
+// errorReasonOf classifies err, from the implementation whose identifiers are
+// in errorTaxonomy under taxonomy. Go's errors are classified by their type;
+// others by the longest identifier that their message contains, since
+// harnesses report errors as text. It returns "" if err is nil.
+func errorReasonOf(taxonomy string, err error) errorReason {
+	if err == nil {
+		return ""
+	}
+	if taxonomy == "go" {
+		return classifyError(taxonomy, goErrorIdentifier(err))
+	}
+
+	message := err.Error()
+	var longest string
+	for identifier := range errorTaxonomy[taxonomy] {
+		if len(identifier) > len(longest) && strings.Contains(message, identifier) {
+			longest = identifier
+		}
+	}
+	return classifyError(taxonomy, longest)
+}
+
+// goErrorIdentifier returns the identifier used in errorTaxonomy for an error
+// from crypto/x509.
+func goErrorIdentifier(err error) string {
+	var hostnameErr x509.HostnameError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	var criticalErr x509.UnhandledCriticalExtension
+	var constraintErr x509.ConstraintViolationError
+	var insecureErr x509.InsecureAlgorithmError
+	var systemRootsErr x509.SystemRootsError
+
+	switch {
+	case errors.As(err, &hostnameErr):
+		return "x509.HostnameError"
+	case errors.As(err, &unknownAuthorityErr):
+		return "x509.UnknownAuthorityError"
+	case errors.As(err, &invalidErr):
+		return "x509.CertificateInvalidError:" + invalidReasonNames[invalidErr.Reason]
+	case errors.As(err, &criticalErr):
+		return "x509.UnhandledCriticalExtension"
+	case errors.As(err, &constraintErr):
+		return "x509.ConstraintViolationError"
+	case errors.As(err, &insecureErr):
+		return "x509.InsecureAlgorithmError"
+	case errors.As(err, &systemRootsErr):
+		return "x509.SystemRootsError"
+	}
+
+	return fmt.Sprintf("%T", err)
+}
+
+// invalidReasonNames names the values of x509.InvalidReason.
+var invalidReasonNames = map[x509.InvalidReason]string{
+	x509.NotAuthorizedToSign:           "NotAuthorizedToSign",
+	x509.Expired:                       "Expired",
+	x509.CANotAuthorizedForThisName:    "CANotAuthorizedForThisName",
+	x509.TooManyIntermediates:          "TooManyIntermediates",
+	x509.IncompatibleUsage:             "IncompatibleUsage",
+	x509.NameMismatch:                  "NameMismatch",
+	x509.NameConstraintsWithoutSANs:    "NameConstraintsWithoutSANs",
+	x509.UnconstrainedName:             "UnconstrainedName",
+	x509.TooManyConstraints:            "TooManyConstraints",
+	x509.CANotAuthorizedForExtKeyUsage: "CANotAuthorizedForExtKeyUsage",
+	x509.NoValidChains:                 "NoValidChains",
+}
+
+// printErrorTaxonomy implements the error-taxonomy command, which writes the
+// reasons and mapping tables as JSON for use by other tools.
+func printErrorTaxonomy(args []string) error {
+	if len(args) != 0 {
+		return errors.New("error-taxonomy takes no arguments")
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Reasons         map[errorReason]string            `json:"reasons"`
+		Implementations map[string]map[string]errorReason `json:"implementations"`
+	}{errorReasonDescriptions, errorTaxonomy})
+}
@@ -0,0 +1,383 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// expectOverridesUsage is the usage of the -f flag of the expects
+// subcommands.
+const expectOverridesUsage = "The expectation overrides file to edit"
+
+// editExpectations implements the expects command, which curates the
+// expectations in expectOverrides.json so that changes to them are reviewable
+// diffs of a canonically formatted file, rather than hand edits of JSON. Its
+// subcommands are set, which adds or modifies a test's override, deprecate,
+// which stops one being applied while keeping it for the record, unset, which
+// removes one, and fmt, which validates the file and rewrites it in its
+// canonical form. defineExpects.js must be run afterwards to apply them.
+func editExpectations(args []string) error {
+	if len(args) == 0 {
+		return errors.New("expects needs a subcommand: set, deprecate, unset or fmt")
+	}
+	switch args[0] {
+	case "set":
+		return setExpectation(args[1:])
+	case "deprecate":
+		return deprecateExpectation(args[1:])
+	case "unset":
+		return unsetExpectation(args[1:])
+	case "fmt":
+		return formatExpectations(args[1:])
+	}
+	return fmt.Errorf("unknown expects subcommand %q; the subcommands are set, deprecate, unset and fmt", args[0])
+}
+
+// setExpectation implements expects set, e.g. "expects set -id 12 -dns ERROR
+// -reason NAME_CONSTRAINT_VIOLATION -description ...".
+func setExpectation(args []string) error {
+	flags := flag.NewFlagSet("expects set", flag.ExitOnError)
+	path := flags.String("f", filepath.Join(baseDir, "expectOverrides.json"), expectOverridesUsage)
+	id := flags.Int("id", 0, "The ID of the test whose expectation to set")
+	dnsResult := flags.String("dns", "", "The expected result of verifying the test's DNS name: OK, ERROR or WEAK-OK")
+	ipResult := flags.String("ip", "", "The expected result of verifying the test's IP address: OK, ERROR or WEAK-OK")
+	reasonList := flags.String("reason", "", "For an ERROR, the reasons for which verifiers may reject the certificate, separated by commas. A unique prefix of a reason is enough")
+	description := flags.String("description", "", "Why the result is expected, for reviewers and reports. It's required for a test without an override")
+	flags.Parse(args)
+
+	results := map[string]string{"dns": *dnsResult, "ip": *ipResult}
+	var types []string
+	for _, nameType := range []string{"dns", "ip"} {
+		switch results[nameType] {
+		case "":
+			continue
+		case "OK", "ERROR", "WEAK-OK":
+			types = append(types, nameType)
+		default:
+			return fmt.Errorf("-%s %s isn't a result; the results are OK, ERROR and WEAK-OK", nameType, results[nameType])
+		}
+	}
+	if len(types) == 0 {
+		return errors.New("at least one of -dns and -ip must be given")
+	}
+
+	reasons, err := parseReasons(*reasonList)
+	if err != nil {
+		return err
+	}
+	if len(reasons) > 0 {
+		for _, nameType := range types {
+			if results[nameType] != "ERROR" {
+				return fmt.Errorf("-reason only applies to ERROR, but -%s is %s", nameType, results[nameType])
+			}
+		}
+	}
+
+	test, err := findExpectation(*id)
+	if err != nil {
+		return err
+	}
+	overrides, err := readExpectOverrides(*path)
+	if err != nil {
+		return err
+	}
+
+	for _, nameType := range types {
+		current := &test.IP
+		if nameType == "dns" {
+			current = &test.DNS
+		}
+		i := overrides.find(test, nameType)
+		if i < 0 {
+			if len(*description) == 0 {
+				return fmt.Errorf("#%d %s has no override, so -description is required", test.Id, nameType)
+			}
+			overrides.Overrides = append(overrides.Overrides, expectOverride{Id: test.Id, StableId: test.StableId, Type: nameType})
+			i = len(overrides.Overrides) - 1
+		}
+		override := &overrides.Overrides[i]
+
+		override.Current = current.Result
+		override.Expect = results[nameType]
+		override.Reasons = reasons
+		if len(*description) > 0 {
+			override.Description = *description
+		}
+		override.Reviewed, override.Curated, override.Deprecated = true, true, ""
+
+		fmt.Printf("#%d %s: %s -> %s%s\n", test.Id, nameType, current.Result, override.Expect, reasonsSuffix(override.Reasons))
+	}
+
+	return writeExpectOverrides(*path, overrides)
+}
+
+// deprecateExpectation implements expects deprecate, which marks a test's
+// overrides as no longer to be applied, with why.
+func deprecateExpectation(args []string) error {
+	flags := flag.NewFlagSet("expects deprecate", flag.ExitOnError)
+	path := flags.String("f", filepath.Join(baseDir, "expectOverrides.json"), expectOverridesUsage)
+	id := flags.Int("id", 0, "The ID of the test whose override to deprecate")
+	nameType := flags.String("type", "", "The type of name, dns or ip, whose override to deprecate. Both are by default")
+	why := flags.String("why", "", "Why the override no longer applies, which is kept in the file")
+	flags.Parse(args)
+
+	if len(*why) == 0 {
+		return errors.New("-why is required, to record why the override no longer applies")
+	}
+
+	return editOverrides(*path, *id, *nameType, func(override *expectOverride) bool {
+		override.Deprecated = *why
+		fmt.Printf("#%d %s: deprecated\n", override.Id, override.Type)
+		return true
+	})
+}
+
+// unsetExpectation implements expects unset, which removes a test's
+// overrides, so that its derived expectations apply again.
+func unsetExpectation(args []string) error {
+	flags := flag.NewFlagSet("expects unset", flag.ExitOnError)
+	path := flags.String("f", filepath.Join(baseDir, "expectOverrides.json"), expectOverridesUsage)
+	id := flags.Int("id", 0, "The ID of the test whose override to remove")
+	nameType := flags.String("type", "", "The type of name, dns or ip, whose override to remove. Both are by default")
+	flags.Parse(args)
+
+	return editOverrides(*path, *id, *nameType, func(override *expectOverride) bool {
+		fmt.Printf("#%d %s: removed\n", override.Id, override.Type)
+		return false
+	})
+}
+
+// editOverrides calls edit with each override for test id and nameType, or
+// either type if it's empty, keeping the override only if edit returns true,
+// and writes the file back.
+func editOverrides(path string, id int, nameType string, edit func(override *expectOverride) bool) error {
+	if nameType != "" && nameType != "dns" && nameType != "ip" {
+		return fmt.Errorf("-type %s isn't a type of name; the types are dns and ip", nameType)
+	}
+	test, err := findExpectation(id)
+	if err != nil {
+		return err
+	}
+	overrides, err := readExpectOverrides(path)
+	if err != nil {
+		return err
+	}
+
+	edited := make(map[int]bool)
+	for _, t := range []string{"dns", "ip"} {
+		if nameType != "" && nameType != t {
+			continue
+		}
+		if i := overrides.find(test, t); i >= 0 {
+			edited[i] = true
+		}
+	}
+	if len(edited) == 0 {
+		return fmt.Errorf("#%d has no override to edit in %s", id, path)
+	}
+
+	kept := overrides.Overrides[:0]
+	for i := range overrides.Overrides {
+		if !edited[i] || edit(&overrides.Overrides[i]) {
+			kept = append(kept, overrides.Overrides[i])
+		}
+	}
+	overrides.Overrides = kept
+
+	return writeExpectOverrides(path, overrides)
+}
+
+// formatExpectations implements expects fmt, which validates the overrides
+// file and rewrites it in its canonical form, or with -check reports whether
+// it's already in it.
+func formatExpectations(args []string) error {
+	flags := flag.NewFlagSet("expects fmt", flag.ExitOnError)
+	path := flags.String("f", filepath.Join(baseDir, "expectOverrides.json"), expectOverridesUsage)
+	check := flags.Bool("check", false, "Don't rewrite the file, but fail if it isn't in its canonical form")
+	flags.Parse(args)
+
+	original, err := ioutil.ReadFile(*path)
+	if err != nil {
+		return err
+	}
+	overrides, err := readExpectOverrides(*path)
+	if err != nil {
+		return err
+	}
+	if err := overrides.validate(); err != nil {
+		return fmt.Errorf("%s: %v", *path, err)
+	}
+
+	output, err := marshalOverrides(overrides)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(original, output) {
+		return nil
+	}
+	if *check {
+		return fmt.Errorf("%s isn't in its canonical form; run expects fmt", *path)
+	}
+	return ioutil.WriteFile(*path, output, 0644)
+}
+
+// find returns the index of the override of test for nameType, matched by
+// stable ID if both have one and otherwise by ID, or -1 if there isn't one.
+func (o *expectOverrides) find(test *expectation, nameType string) int {
+	for i, override := range o.Overrides {
+		if override.Type != nameType {
+			continue
+		}
+		if len(override.StableId) > 0 && len(test.StableId) > 0 {
+			if override.StableId == test.StableId {
+				return i
+			}
+		} else if override.Id == test.Id {
+			return i
+		}
+	}
+	return -1
+}
+
+// validate checks that each override has a known type and result, reasons
+// only for an ERROR, and no duplicate.
+func (o *expectOverrides) validate() error {
+	seen := make(map[string]bool)
+	for _, override := range o.Overrides {
+		if override.Type != "dns" && override.Type != "ip" {
+			return fmt.Errorf("#%d has an override of unknown type %q", override.Id, override.Type)
+		}
+		switch override.Expect {
+		case "OK", "ERROR", "WEAK-OK":
+		default:
+			return fmt.Errorf("#%d %s has an unknown result %q", override.Id, override.Type, override.Expect)
+		}
+		if len(override.Reasons) > 0 && override.Expect != "ERROR" {
+			return fmt.Errorf("#%d %s has reasons, but its result is %s", override.Id, override.Type, override.Expect)
+		}
+		for _, reason := range override.Reasons {
+			if _, ok := errorReasonDescriptions[reason]; !ok {
+				return fmt.Errorf("#%d %s has an unknown reason %q", override.Id, override.Type, reason)
+			}
+		}
+
+		key := fmt.Sprintf("%d %s", override.Id, override.Type)
+		if len(override.StableId) > 0 {
+			key = override.StableId + " " + override.Type
+		}
+		if seen[key] {
+			return fmt.Errorf("#%d %s has more than one override", override.Id, override.Type)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// findExpectation returns the expectation of test id in expects.json.
+func findExpectation(id int) (*expectation, error) {
+	expectations, err := loadExpectations()
+	if err != nil {
+		return nil, err
+	}
+	for i := range expectations.Expects {
+		if expectations.Expects[i].Id == id {
+			return &expectations.Expects[i], nil
+		}
+	}
+	return nil, fmt.Errorf("there's no test #%d in expects.json", id)
+}
+
+// readExpectOverrides reads the overrides file at path, or returns an empty
+// one if it doesn't exist.
+func readExpectOverrides(path string) (*expectOverrides, error) {
+	overrides := &expectOverrides{Verifiers: []string{}, Overrides: []expectOverride{}}
+	overridesBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return overrides, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(overridesBytes, overrides); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return overrides, nil
+}
+
+// writeExpectOverrides writes overrides to path in their canonical form.
+func writeExpectOverrides(path string, overrides *expectOverrides) error {
+	output, err := marshalOverrides(overrides)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, output, 0644)
+}
+
+// parseReasons parses a list of reasons separated by commas, each of which may
+// be a unique prefix of a reason's name.
+func parseReasons(list string) ([]errorReason, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+
+	var known []string
+	for reason := range errorReasonDescriptions {
+		known = append(known, string(reason))
+	}
+	sort.Strings(known)
+
+	var reasons []errorReason
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		var matches []string
+		for _, reason := range known {
+			if reason == name {
+				matches = []string{reason}
+				break
+			}
+			if strings.HasPrefix(reason, name) {
+				matches = append(matches, reason)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			return nil, fmt.Errorf("unknown reason %q; the reasons are %s", name, strings.Join(known, ", "))
+		case 1:
+			reasons = append(reasons, errorReason(matches[0]))
+		default:
+			return nil, fmt.Errorf("reason %q is ambiguous: it could be %s", name, strings.Join(matches, " or "))
+		}
+	}
+	return reasons, nil
+}
+
+// reasonsSuffix returns reasons in parentheses, to follow a result, or "" if
+// there are none.
+func reasonsSuffix(reasons []errorReason) string {
+	if len(reasons) == 0 {
+		return ""
+	}
+	return " (" + joinReasons(reasons) + ")"
+}
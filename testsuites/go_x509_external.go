@@ -0,0 +1,624 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// externalProtocolVersion is the version of the line protocol spoken with
+// external harnesses.
+//
+//	1: Requests are sent one at a time.
+//	2: Adds batch mode, which harnesses opt into with their capabilities.
+//	3: Adds the "proxy" name type, for the proxy certificate corpus.
+const externalProtocolVersion = 3
+
+// The external harness protocol is a line of JSON per message over the
+// harness's stdin and stdout. Its stderr is passed through.
+//
+// The driver starts with an externalHello and the harness replies with an
+// externalCapabilities. The driver then sends an externalRequest per test,
+// and the harness replies to each with an externalResponse before the next is
+// sent. In batch mode, every request is sent without waiting for replies, and
+// the harness may reply to them as it likes, in any order, so that it can
+// verify them concurrently and isn't held up by a round trip per test. Once
+// every test has been sent, the driver closes the harness's stdin and the
+// harness should exit, having replied to each.
+type externalHello struct {
+	Protocol int `json:"protocol"`
+}
+
+type externalCapabilities struct {
+	// Implementation names the verifier and its version, e.g.
+	// "BouncyCastle 1.55". It's the user agent of the results file.
+	Implementation string `json:"implementation"`
+	// Version, if given, is the verifier's version alone, e.g. "1.55",
+	// for the results file's metadata. Implementation is then taken to
+	// be the name alone, too.
+	Version string `json:"version,omitempty"`
+	// NameTypes lists the types of name that the verifier can check:
+	// "dns" and "ip". Tests of other types are skipped. Listing "proxy"
+	// opts into the proxy certificate corpus, if it's been generated.
+	NameTypes []string `json:"nameTypes"`
+	// ProxyAware is whether the verifier implements RFC 3820 proxy
+	// certificates. The proxy corpus is graded against its proxyAware
+	// expectations if so, and its mainstream ones otherwise.
+	ProxyAware bool `json:"proxyAware,omitempty"`
+	// ErrorTaxonomy names the table in errorTaxonomy that the verifier's
+	// errors are classified with, e.g. "java". Errors are classified as
+	// OTHER if it's not given.
+	ErrorTaxonomy string `json:"errorTaxonomy,omitempty"`
+	// Batch is whether the harness supports batch mode.
+	Batch bool `json:"batch,omitempty"`
+}
+
+type externalRequest struct {
+	Id int `json:"id"`
+	// Type is "dns", "ip" or "proxy".
+	Type string `json:"type"`
+	// Name is the DNS name or IP address to verify the leaf for. It's
+	// empty for proxy certificates, which identify a user rather than a
+	// host, and should be verified for any key usage.
+	Name string `json:"name"`
+	// Leaf, Chain and Root are PEM-encoded certificates. Chain holds the
+	// intermediates, which may be given to the verifier in any order.
+	Leaf  string   `json:"leaf"`
+	Chain []string `json:"chain"`
+	Root  string   `json:"root"`
+}
+
+type externalResponse struct {
+	Id       int    `json:"id"`
+	Type     string `json:"type"`
+	Accepted bool   `json:"accepted"`
+	// Error is the verifier's error if the certificate was rejected,
+	// ideally including an identifier listed in errorTaxonomy.
+	Error string `json:"error,omitempty"`
+	// Nanos is how long verification took, if the harness timed it. In
+	// batch mode, the driver can't time verifications itself, so it's
+	// the only timing recorded.
+	Nanos int64 `json:"nanos,omitempty"`
+}
+
+// runExternal implements the external command, which runs the main corpus
+// against an external harness speaking the line protocol above. The corpus,
+// expectations and results files are handled here, so a harness for a new
+// implementation need only be a thin adapter around its verifier.
+func runExternal(args []string) error {
+	flags := flag.NewFlagSet("external", flag.ExitOnError)
+	resultsPath := flags.String("results", "", "If set, the path to write a results file to")
+	resultsKeyPath := flags.String("results-key", "", resultsKeyUsage)
+	checkpointPath := flags.String("checkpoint", "", checkpointUsage)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: external [flags] harness [harness args...]\n")
+		flags.PrintDefaults()
+	}
+	archivePath := flags.String("corpus-archive", "", corpusArchiveUsage)
+	corpusFormat := flags.String("corpus-format", "pem", corpusFormatUsage)
+	profileName := flags.String("profile", "stress", profileUsage)
+	logLevel := flags.String("log-level", "info", logLevelUsage)
+	logFormat := flags.String("log-format", "text", logFormatUsage)
+	flags.Parse(args)
+
+	if err := selectProfile(*profileName); err != nil {
+		return err
+	}
+	if err := selectLogger(*logLevel, *logFormat); err != nil {
+		return err
+	}
+
+	resultsKey, err := loadResultsKey(*resultsKeyPath)
+	if err != nil {
+		return err
+	}
+
+	if err := openCorpusArchive(*archivePath); err != nil {
+		return err
+	}
+	reader, err := openCorpusReader(*corpusFormat)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no harness given")
+	}
+
+	return runExternalHarness(flags.Arg(0), flags.Args()[1:], &externalRun{
+		resultsPath:    *resultsPath,
+		resultsKey:     resultsKey,
+		checkpointPath: *checkpointPath,
+		reader:         reader,
+	})
+}
+
+// externalRun is how runExternalHarness runs the corpus against a harness.
+type externalRun struct {
+	resultsPath    string
+	resultsKey     ed25519.PrivateKey
+	checkpointPath string
+	reader         corpusReader
+	// annotate, if set, is called with the recorder once the harness has
+	// described itself, to add to the results file's metadata.
+	annotate func(recorder *resultRecorder)
+}
+
+// runExternalHarness starts the harness name with args and runs the main
+// corpus, as filtered by the selected profile, against it.
+func runExternalHarness(name string, args []string, run *externalRun) error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	expectations, err := loadExpectations()
+	if err != nil {
+		return err
+	}
+	numFiltered, err := profile.filter(expectations)
+	if err != nil {
+		return err
+	}
+
+	root, err := loadRoot(run.reader)
+	if err != nil {
+		return err
+	}
+
+	harness, err := startExternalHarness(name, args)
+	if err != nil {
+		return err
+	}
+	defer harness.close()
+
+	capabilities := new(externalCapabilities)
+	if err := harness.exchange(&externalHello{Protocol: externalProtocolVersion}, capabilities); err != nil {
+		return fmt.Errorf("starting %s: %s", name, err)
+	}
+	nameTypes := make(map[string]bool)
+	for _, nameType := range capabilities.NameTypes {
+		nameTypes[nameType] = true
+	}
+	fmt.Printf("Testing %s\n", capabilities.Implementation)
+	if capabilities.Batch {
+		fmt.Printf("Sending tests in batch mode\n")
+	}
+
+	recorder := newResultRecorder(deliveryPool)
+	recorder.setSigningKey(run.resultsKey)
+	profile.recordFiltered(recorder, numFiltered)
+	recorder.userAgent = capabilities.Implementation
+	recorder.setImplementation(capabilities.Implementation, capabilities.Version)
+	if len(capabilities.Version) > 0 {
+		recorder.userAgent += " " + capabilities.Version
+	}
+	recorder.taxonomy = capabilities.ErrorTaxonomy
+	if run.annotate != nil {
+		run.annotate(recorder)
+	}
+
+	cp, err := openCheckpoint(run.checkpointPath, recorder.userAgent, config.TestVersion)
+	if err != nil {
+		return err
+	}
+	defer cp.close()
+
+	numTests, numFailures := 0, 0
+	reportFailure := func(test *expectation, failure error) {
+		logger.Warn("test failed", "id", test.Id, "type", test.testType(), "error", errString(failure))
+		numFailures++
+	}
+
+	proxyVerifications, err := loadExternalProxyVerifications(nameTypes["proxy"], capabilities.ProxyAware)
+	if err != nil {
+		return err
+	}
+	numTests += len(proxyVerifications)
+
+	// Each verification that isn't restored from the checkpoint is sent
+	// to the harness.
+	var verifications []*externalVerification
+	for _, test := range expectations.Expects {
+		for _, testDNS := range []bool{true, false} {
+			test.testDNS = testDNS
+			request := &externalRequest{Id: test.Id, Type: "ip", Name: config.testIP(&test), Root: pemString(root.Raw)}
+			if testDNS {
+				request.Type, request.Name = "dns", config.testHostname(&test)
+			}
+
+			if !nameTypes[request.Type] {
+				reason := &skip{skipUnsupportedNameType, capabilities.Implementation + " doesn't support verifying " + request.Type + " names"}
+				traceSkip(&test, reason)
+				recorder.recordSkip(reason)
+				continue
+			}
+			numTests++
+
+			if failed, ok := cp.restore(&test, recorder); ok {
+				if failed {
+					reportFailure(&test, test.err)
+				}
+				continue
+			}
+			verifications = append(verifications, &externalVerification{test: test, request: request})
+		}
+	}
+
+	verifications = append(verifications, proxyVerifications...)
+
+	complete := func(v *externalVerification) {
+		if v.proxyExpect != nil {
+			if v.failure != nil {
+				logger.Warn("proxy test failed", "id", v.request.Id, "error", errString(v.failure))
+				numFailures++
+			}
+			return
+		}
+		v.test.err = v.failure
+		cp.complete(&v.test, v.failure != nil, recorder)
+		if v.failure != nil {
+			reportFailure(&v.test, v.failure)
+		}
+	}
+	if capabilities.Batch {
+		if err := runExternalBatch(harness, run.reader, verifications, recorder, complete); err != nil {
+			return err
+		}
+	} else {
+		for _, v := range verifications {
+			if err := runExternalTest(harness, run.reader, v, recorder); err != nil {
+				return fmt.Errorf("#%d: %s", v.request.Id, err)
+			}
+			complete(v)
+		}
+	}
+
+	recorder.printSkips()
+
+	if len(run.resultsPath) > 0 {
+		if err := recorder.write(run.resultsPath, config.TestVersion); err != nil {
+			return err
+		}
+	}
+	if err := cp.finish(); err != nil {
+		return err
+	}
+
+	if numFailures != 0 {
+		return fmt.Errorf("failed %d of %d tests", numFailures, numTests)
+	}
+
+	return nil
+}
+
+// externalVerification is a verification of a test's leaf for one of its
+// names by an external harness.
+type externalVerification struct {
+	test    expectation
+	request *externalRequest
+	// proxyExpect is set, instead of test, for a verification of a proxy
+	// certificate, which is graded against it but not recorded.
+	proxyExpect *expectedResult
+	// failure is set, once the result is known, if it didn't meet the
+	// expectation.
+	failure error
+}
+
+// loadExternalProxyVerifications returns a verification for each test of the
+// proxy certificate corpus, graded against its proxyAware expectation if
+// proxyAware is set, or nil if run isn't set or the corpus isn't run.
+func loadExternalProxyVerifications(run, proxyAware bool) ([]*externalVerification, error) {
+	if !run {
+		return nil, nil
+	}
+	expectations, err := loadProxyExpectations()
+	if expectations == nil || err != nil {
+		return nil, err
+	}
+
+	root, err := readPEMBlocks(filepath.Join(certificatesDir, "proxy", "root.crt"))
+	if err != nil {
+		return nil, err
+	}
+	if len(root) != 1 {
+		return nil, fmt.Errorf("expected a single proxy corpus root, but found %d", len(root))
+	}
+
+	var verifications []*externalVerification
+	for i := range expectations.Expects {
+		test := &expectations.Expects[i]
+		expect := &test.Mainstream
+		if proxyAware {
+			expect = &test.ProxyAware
+		}
+		verifications = append(verifications, &externalVerification{
+			request:     &externalRequest{Id: test.Id, Type: "proxy", Root: pemString(root[0])},
+			proxyExpect: expect,
+		})
+	}
+	return verifications, nil
+}
+
+// load reads the test's certificates into the request.
+func (v *externalVerification) load(reader corpusReader) error {
+	if v.proxyExpect != nil {
+		return v.loadProxy()
+	}
+
+	leaf, chain, err := reader.test(v.test.Id)
+	if err != nil {
+		return err
+	}
+
+	v.request.Leaf = pemString(leaf)
+	for _, intermediate := range chain {
+		v.request.Chain = append(v.request.Chain, pemString(intermediate))
+	}
+	return nil
+}
+
+// loadProxy reads the proxy certificate's certificates into the request.
+func (v *externalVerification) loadProxy() error {
+	pathPrefix := filepath.Join(certificatesDir, "proxy", strconv.Itoa(v.request.Id))
+	leaf, err := readPEMBlocks(pathPrefix + ".crt")
+	if err != nil {
+		return err
+	}
+	if len(leaf) != 1 {
+		return fmt.Errorf("expected a single certificate in the .crt file, but found %d", len(leaf))
+	}
+	chain, err := readPEMBlocks(pathPrefix + ".chain")
+	if err != nil {
+		return err
+	}
+
+	v.request.Leaf = pemString(leaf[0])
+	for _, intermediate := range chain {
+		v.request.Chain = append(v.request.Chain, pemString(intermediate))
+	}
+	return nil
+}
+
+// grade records the harness's response and sets the failure if it doesn't
+// meet the expectation. A WEAK-OK expectation is met whatever the result.
+func (v *externalVerification) grade(response *externalResponse, elapsed time.Duration, recorder *resultRecorder) {
+	if v.proxyExpect != nil {
+		if passed, description := gradeResult(v.proxyExpect, response.Accepted, errorReasonOf(recorder.taxonomy, errors.New(response.Error))); !passed {
+			v.failure = fmt.Errorf("%s: %s", description, response.Error)
+		}
+		return
+	}
+
+	expect := &v.test.IP
+	if v.test.testDNS {
+		expect = &v.test.DNS
+	}
+
+	var verifyErr error
+	if !response.Accepted {
+		verifyErr = errors.New(response.Error)
+	}
+	traceVerification(&v.test, v.request.Name, verifyErr, elapsed)
+	recorder.record(&v.test, verifyErr, elapsed)
+
+	if passed, description := gradeResult(expect, response.Accepted, errorReasonOf(recorder.taxonomy, verifyErr)); !passed {
+		v.failure = fmt.Errorf("%s: %s", description, response.Error)
+	}
+}
+
+// runExternalTest sends a verification to the harness and grades the reply.
+// It returns an error if the harness couldn't be used, which ends the run.
+func runExternalTest(harness *externalHarness, reader corpusReader, v *externalVerification, recorder *resultRecorder) error {
+	if err := v.load(reader); err != nil {
+		v.failure = err
+		return nil
+	}
+
+	response := new(externalResponse)
+	start := time.Now()
+	if err := harness.exchange(v.request, response); err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+
+	if response.Id != v.request.Id || response.Type != v.request.Type {
+		return fmt.Errorf("the harness replied for test %d %s", response.Id, response.Type)
+	}
+	v.grade(response, elapsed, recorder)
+	return nil
+}
+
+// runExternalBatch sends every verification to a harness in batch mode,
+// without waiting for replies, and grades the replies as they arrive,
+// calling complete with each verification once its result is known. It
+// returns an error if the harness couldn't be used, or went limits.timeout
+// without replying to any of the verifications awaiting a reply, which ends
+// the run.
+func runExternalBatch(harness *externalHarness, reader corpusReader, verifications []*externalVerification, recorder *resultRecorder, complete func(v *externalVerification)) error {
+	// Verifications are sent in the background, each being passed to sent
+	// before it's written, so that its reply can't arrive before it's
+	// awaited. Those whose certificates couldn't be read aren't written,
+	// and are passed with their failure set. Each request's certificates
+	// are dropped once it's written, so that they aren't all held at once.
+	sent := make(chan *externalVerification)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(sent)
+		for _, v := range verifications {
+			if err := v.load(reader); err != nil {
+				v.failure = err
+			}
+			select {
+			case sent <- v:
+			case <-stop:
+				return
+			}
+			if v.failure != nil {
+				continue
+			}
+			if err := harness.encoder.Encode(v.request); err != nil {
+				return
+			}
+			v.request.Leaf, v.request.Chain = "", nil
+		}
+		// The harness may wait for every request before replying.
+		harness.stdin.Close()
+	}()
+
+	awaiting := make(map[string]*externalVerification)
+	timer := time.NewTimer(limits.timeout)
+	defer timer.Stop()
+	for sent != nil || len(awaiting) > 0 {
+		select {
+		case v, ok := <-sent:
+			if !ok {
+				sent = nil
+				break
+			}
+			if v.failure != nil {
+				complete(v)
+				break
+			}
+			awaiting[strconv.Itoa(v.request.Id)+" "+v.request.Type] = v
+		case line, ok := <-harness.responses:
+			if !ok {
+				return fmt.Errorf("the harness exited with %d verifications awaiting a reply", len(awaiting))
+			}
+			response := new(externalResponse)
+			if err := json.Unmarshal(line, response); err != nil {
+				return err
+			}
+			key := strconv.Itoa(response.Id) + " " + response.Type
+			v, ok := awaiting[key]
+			if !ok {
+				return fmt.Errorf("the harness replied for test %d %s, which wasn't awaiting a reply", response.Id, response.Type)
+			}
+			delete(awaiting, key)
+			v.grade(response, time.Duration(response.Nanos), recorder)
+			complete(v)
+		case <-timer.C:
+			harness.cmd.Process.Kill()
+			return fmt.Errorf("the harness didn't reply within %s, with %d verifications awaiting a reply", limits.timeout, len(awaiting))
+		}
+
+		if !timer.Stop() {
+			<-timer.C
+		}
+		timer.Reset(limits.timeout)
+	}
+	return nil
+}
+
+func pemString(der []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// externalHarness is a running external harness.
+type externalHarness struct {
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	encoder   *json.Encoder
+	responses chan []byte
+}
+
+func startExternalHarness(name string, args []string) (*externalHarness, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	h := &externalHarness{
+		cmd:       cmd,
+		stdin:     stdin,
+		encoder:   json.NewEncoder(stdin),
+		responses: make(chan []byte),
+	}
+
+	// Responses are read in the background so that a harness that hangs
+	// can be timed out.
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(nil, int(limits.maxFileSize))
+		for scanner.Scan() {
+			h.responses <- append([]byte(nil), scanner.Bytes()...)
+		}
+		close(h.responses)
+	}()
+
+	return h, nil
+}
+
+// exchange sends request to the harness and decodes its reply into response,
+// waiting at most limits.timeout.
+func (h *externalHarness) exchange(request, response interface{}) error {
+	if err := h.encoder.Encode(request); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(limits.timeout)
+	defer timer.Stop()
+
+	select {
+	case line, ok := <-h.responses:
+		if !ok {
+			return errors.New("the harness exited")
+		}
+		return json.Unmarshal(line, response)
+	case <-timer.C:
+		h.cmd.Process.Kill()
+		return fmt.Errorf("the harness didn't reply within %s", limits.timeout)
+	}
+}
+
+// close tells the harness that there are no more tests and waits for it to
+// exit.
+func (h *externalHarness) close() error {
+	h.stdin.Close()
+	for range h.responses {
+	}
+	return h.cmd.Wait()
+}
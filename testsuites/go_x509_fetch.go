@@ -0,0 +1,107 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// fetchCorpus implements the fetch-corpus command, which downloads a corpus
+// release from GitHub, checks it against its published SHA-256 checksum and
+// Ed25519 signature and extracts it, so that the harness can be run against an
+// exact corpus version without running the generator. A release has three
+// assets: the archive, a .tar.gz of config.json, html/ and certificates/ as
+// the job command takes; the archive's name plus ".sha256", in the format of
+// sha256sum; and the archive's name plus ".sig", the raw 64-byte Ed25519
+// signature of the archive, e.g. from
+// "openssl pkeyutl -sign -rawin -inkey key.pem -in corpus.tar.gz".
+func fetchCorpus(args []string) error {
+	flags := flag.NewFlagSet("fetch-corpus", flag.ExitOnError)
+	release := flags.String("release", "", "The tag of the release to fetch, e.g. corpus-v1")
+	repo := flags.String("repo", "Netflix/bettertls", "The GitHub repository that publishes the release")
+	asset := flags.String("asset", "corpus.tar.gz", "The name of the release's corpus archive")
+	publicKeyPath := flags.String("public-key", "", "Path to the PEM, PKIX Ed25519 public key that the release is signed with")
+	baseURL := flags.String("base-url", "https://github.com", "The server to fetch releases from, for mirrors of GitHub")
+	output := flags.String("o", baseDir, "The directory to extract the corpus into")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return errors.New("fetch-corpus takes no arguments")
+	}
+	if len(*release) == 0 {
+		return errors.New("-release is required")
+	}
+	if len(*publicKeyPath) == 0 {
+		return errors.New("-public-key is required, so that the release's signature can be checked")
+	}
+
+	publicKey, err := loadEd25519PublicKey(*publicKeyPath)
+	if err != nil {
+		return err
+	}
+
+	assetURL := fmt.Sprintf("%s/%s/releases/download/%s/%s", strings.TrimSuffix(*baseURL, "/"), *repo, *release, *asset)
+	fmt.Printf("Fetching %s\n", assetURL)
+	archive, err := fetchURL(assetURL)
+	if err != nil {
+		return err
+	}
+	checksum, err := fetchURL(assetURL + ".sha256")
+	if err != nil {
+		return err
+	}
+	signature, err := fetchURL(assetURL + ".sig")
+	if err != nil {
+		return err
+	}
+
+	if err := verifyCorpusRelease(archive, checksum, signature, publicKey); err != nil {
+		return fmt.Errorf("%s: %v", assetURL, err)
+	}
+
+	if err := extractCorpus(archive, *output); err != nil {
+		return err
+	}
+
+	fmt.Printf("Extracted corpus release %s to %s\n", *release, *output)
+	return nil
+}
+
+// verifyCorpusRelease checks archive against checksum, the contents of a
+// sha256sum file, and signature, its Ed25519 signature by publicKey.
+func verifyCorpusRelease(archive, checksum, signature []byte, publicKey ed25519.PublicKey) error {
+	fields := strings.Fields(string(checksum))
+	if len(fields) == 0 {
+		return errors.New("the checksum file is empty")
+	}
+	expected, err := hex.DecodeString(fields[0])
+	if err != nil || len(expected) != sha256.Size {
+		return fmt.Errorf("the checksum file doesn't start with a hex SHA-256 hash: %q", fields[0])
+	}
+	if actual := sha256.Sum256(archive); !strings.EqualFold(hex.EncodeToString(actual[:]), fields[0]) {
+		return fmt.Errorf("the archive's SHA-256 hash is %x, not %s", actual, fields[0])
+	}
+
+	if !ed25519.Verify(publicKey, archive, signature) {
+		return errors.New("the archive's signature doesn't verify with the public key")
+	}
+	return nil
+}
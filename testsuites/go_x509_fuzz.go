@@ -0,0 +1,579 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fuzzCorpus implements the fuzz command, which applies structured mutations
+// to the extensions of the main corpus's chains, such as flipping their
+// criticality, truncating them or swapping their OIDs, and verifies the
+// results with crypto/x509, watching for panics and verifications that don't
+// finish. Every certificate of a mutated chain is re-signed with one key, so
+// that the mutations reach past the signature checks.
+//
+// Inputs that crash or hang the verifier, or that it rejects with an error
+// that no earlier input did, are written to a directory laid out as go-fuzz's
+// working directory, which libFuzzer can also take as a corpus: corpus/ holds
+// each interesting certificate as DER, named by its SHA-1 hash, and crashers/
+// holds those that crashed or hung, with the whole chain as PEM and what
+// happened in .output.
+func fuzzCorpus(args []string) error {
+	flags := flag.NewFlagSet("fuzz", flag.ExitOnError)
+	iterations := flags.Int("iterations", 10000, "The number of mutated chains to verify")
+	seed := flags.Int64("seed", 0, "The seed of the mutations, which defaults to the time, so that a run can be repeated")
+	outputDir := flags.String("o", "fuzz", "The directory to write interesting inputs to")
+	flags.DurationVar(&limits.timeout, "timeout", limits.timeout, "The longest time to spend verifying a mutated chain before recording it as a hang")
+	archivePath := flags.String("corpus-archive", "", corpusArchiveUsage)
+	corpusFormat := flags.String("corpus-format", "pem", corpusFormatUsage)
+	flags.Parse(args)
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	if err := openCorpusArchive(*archivePath); err != nil {
+		return err
+	}
+	reader, err := openCorpusReader(*corpusFormat)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	expectations, err := loadExpectations()
+	if err != nil {
+		return err
+	}
+	if len(expectations.Expects) == 0 {
+		return errors.New("expects.json has no tests to mutate")
+	}
+	root, err := loadRoot(reader)
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	f := &fuzzer{
+		rand:     mathrand.New(mathrand.NewSource(*seed)),
+		key:      key,
+		dir:      *outputDir,
+		outcomes: make(map[string]int),
+	}
+	for _, dir := range []string{"corpus", "crashers"} {
+		if err := os.MkdirAll(filepath.Join(f.dir, dir), 0755); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Fuzzing %d mutated chains with seed %d\n", *iterations, *seed)
+	for i := 0; i < *iterations; i++ {
+		test := &expectations.Expects[f.rand.Intn(len(expectations.Expects))]
+		leaf, chain, err := reader.test(test.Id)
+		if err != nil {
+			return err
+		}
+		if err := f.fuzz(test.Id, config.testHostname(test), append([][]byte{leaf}, chain...), root.Raw); err != nil {
+			return fmt.Errorf("#%d: %v", test.Id, err)
+		}
+	}
+
+	f.printSummary()
+	if f.numCrashes+f.numHangs > 0 {
+		return fmt.Errorf("%d mutated chains crashed the verifier and %d hung it; see %s", f.numCrashes, f.numHangs, filepath.Join(f.dir, "crashers"))
+	}
+	return nil
+}
+
+// fuzzer mutates chains and records what the verifier does with them.
+type fuzzer struct {
+	rand *mathrand.Rand
+	// key is the key that every certificate of a mutated chain is
+	// re-signed with, and is every certificate's public key.
+	key *ecdsa.PrivateKey
+	dir string
+
+	numRun, numWritten   int
+	numCrashes, numHangs int
+	numSkipped           int
+	// outcomes counts the inputs with each outcome, as given by
+	// fuzzOutcome.
+	outcomes map[string]int
+}
+
+// fuzzMutations are the mutations that the fuzz command applies to one
+// extension of a certificate, by name.
+var fuzzMutations = map[string]func(r *mathrand.Rand, extensions []derExtension, i int) ([]derExtension, error){
+	"flip-criticality": func(r *mathrand.Rand, extensions []derExtension, i int) ([]derExtension, error) {
+		extensions[i].critical = !extensions[i].critical
+		return extensions, nil
+	},
+	"truncate": func(r *mathrand.Rand, extensions []derExtension, i int) ([]derExtension, error) {
+		if len(extensions[i].value) == 0 {
+			return nil, nil
+		}
+		extensions[i].value = extensions[i].value[:r.Intn(len(extensions[i].value))]
+		return extensions, nil
+	},
+	"swap-oid": func(r *mathrand.Rand, extensions []derExtension, i int) ([]derExtension, error) {
+		oid := fuzzExtensionOIDs[r.Intn(len(fuzzExtensionOIDs))]
+		if oid.Equal(extensions[i].oid) {
+			return nil, nil
+		}
+		extensions[i].oid = oid
+		return extensions, nil
+	},
+	"flip-bit": func(r *mathrand.Rand, extensions []derExtension, i int) ([]derExtension, error) {
+		if len(extensions[i].value) == 0 {
+			return nil, nil
+		}
+		value := append([]byte(nil), extensions[i].value...)
+		value[r.Intn(len(value))] ^= 1 << uint(r.Intn(8))
+		extensions[i].value = value
+		return extensions, nil
+	},
+	"duplicate": func(r *mathrand.Rand, extensions []derExtension, i int) ([]derExtension, error) {
+		return append(extensions, extensions[i]), nil
+	},
+	"drop": func(r *mathrand.Rand, extensions []derExtension, i int) ([]derExtension, error) {
+		return append(extensions[:i], extensions[i+1:]...), nil
+	},
+}
+
+// fuzzExtensionOIDs are the extensions that swap-oid gives an extension's value
+// to: those that the verifier interprets, and one that nothing does.
+var fuzzExtensionOIDs = []asn1.ObjectIdentifier{
+	{2, 5, 29, 14},              // subjectKeyIdentifier
+	{2, 5, 29, 15},              // keyUsage
+	{2, 5, 29, 17},              // subjectAltName
+	{2, 5, 29, 19},              // basicConstraints
+	{2, 5, 29, 30},              // nameConstraints
+	{2, 5, 29, 32},              // certificatePolicies
+	{2, 5, 29, 35},              // authorityKeyIdentifier
+	{2, 5, 29, 37},              // extKeyUsage
+	{1, 3, 6, 1, 5, 5, 7, 1, 1}, // authorityInfoAccess
+	{1, 3, 6, 1, 4, 1, 11129, 2, 5, 99},
+}
+
+// fuzz applies a random mutation to one of the certificates in chain, the
+// leaf followed by its intermediates, re-signs them and root, and verifies
+// the result for dnsName, writing it out if it's interesting.
+func (f *fuzzer) fuzz(id int, dnsName string, chain [][]byte, root []byte) error {
+	target := f.rand.Intn(len(chain))
+	names := make([]string, 0, len(fuzzMutations))
+	for name := range fuzzMutations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	mutation := names[f.rand.Intn(len(names))]
+
+	tbs, err := parseTBSCertificate(chain[target])
+	if err != nil {
+		return err
+	}
+	extensions, err := tbs.extensions()
+	if err != nil {
+		return err
+	}
+	if len(extensions) == 0 {
+		f.numSkipped++
+		return nil
+	}
+	if extensions, err = fuzzMutations[mutation](f.rand, extensions, f.rand.Intn(len(extensions))); err != nil {
+		return err
+	}
+	if extensions == nil {
+		// The mutation would have left the certificate as it was.
+		f.numSkipped++
+		return nil
+	}
+	if err := tbs.setExtensions(extensions); err != nil {
+		return err
+	}
+
+	mutated := make([][]byte, len(chain)+1)
+	for i, der := range append(append([][]byte(nil), chain...), root) {
+		t := tbs
+		if i != target {
+			if t, err = parseTBSCertificate(der); err != nil {
+				return err
+			}
+		}
+		if mutated[i], err = t.sign(f.key); err != nil {
+			return err
+		}
+	}
+
+	f.numRun++
+	input := &fuzzInput{id: id, mutation: mutation, target: target, dnsName: dnsName, chain: mutated}
+	outcome, crash := verifyMutatedChain(input)
+	switch {
+	case crash != "" && strings.HasPrefix(outcome, "hang"):
+		f.numHangs++
+	case crash != "":
+		f.numCrashes++
+	}
+	f.outcomes[outcome]++
+	if crash == "" && f.outcomes[outcome] > 1 {
+		return nil
+	}
+	return f.write(input, outcome, crash)
+}
+
+// fuzzInput is a mutated chain.
+type fuzzInput struct {
+	// id is the test whose chain was mutated, mutation the mutation
+	// and target the index in chain of the certificate that it was
+	// applied to.
+	id       int
+	mutation string
+	target   int
+	dnsName  string
+	// chain is the leaf, its intermediates and the root, as DER.
+	chain [][]byte
+}
+
+// fuzzOutcomeNoise matches the parts of an error that vary between inputs
+// that take the same path through the verifier: names, quoted or listed as
+// those that a certificate is valid for, and numbers. Replacing them with
+// fuzzOutcomeNoiseReplacement keeps "valid for".
+var fuzzOutcomeNoise = regexp.MustCompile(`(valid for )[^,]*|"[^"]*"|\b[0-9]+\b`)
+
+const fuzzOutcomeNoiseReplacement = "${1}_"
+
+// verifyMutatedChain verifies input's chain, trusting its root, and returns
+// its outcome: "accepted", or the stage at which it was rejected and the
+// error, with the parts that vary removed so that outcomes that differ show
+// different behaviour. If the verifier panicked or hung, crash describes
+// what happened.
+func verifyMutatedChain(input *fuzzInput) (outcome, crash string) {
+	type result struct{ outcome, crash string }
+	done := make(chan result, 1)
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{"panic", fmt.Sprintf("panic: %v\n\n%s", r, debug.Stack())}
+			}
+		}()
+
+		certs := make([]*x509.Certificate, len(input.chain))
+		for i, der := range input.chain {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				done <- result{stageParse + ": " + fuzzOutcomeNoise.ReplaceAllString(err.Error(), fuzzOutcomeNoiseReplacement), ""}
+				return
+			}
+			certs[i] = cert
+		}
+
+		roots := x509.NewCertPool()
+		roots.AddCert(certs[len(certs)-1])
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1 : len(certs)-1] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{DNSName: input.dnsName, Roots: roots, Intermediates: intermediates})
+		if err != nil {
+			done <- result{stageVerify + ": " + fuzzOutcomeNoise.ReplaceAllString(err.Error(), fuzzOutcomeNoiseReplacement), ""}
+			return
+		}
+		done <- result{"accepted", ""}
+	}()
+
+	timer := time.NewTimer(limits.timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.outcome, r.crash
+	case <-timer.C:
+		return "hang", fmt.Sprintf("verification didn't finish within %s", limits.timeout)
+	}
+}
+
+// write writes input's mutated certificate to the corpus directory and, if it
+// crashed or hung the verifier, the whole chain and what happened to the
+// crashers directory.
+func (f *fuzzer) write(input *fuzzInput, outcome, crash string) error {
+	der := input.chain[input.target]
+	hash := sha1.Sum(der)
+	name := hex.EncodeToString(hash[:])
+
+	if err := ioutil.WriteFile(filepath.Join(f.dir, "corpus", name), der, 0644); err != nil {
+		return err
+	}
+	f.numWritten++
+	if crash == "" {
+		return nil
+	}
+
+	var chainPEM string
+	for _, cert := range input.chain {
+		chainPEM += pemString(cert)
+	}
+	output := fmt.Sprintf("Test #%d, with %s applied to certificate %d of its chain, counting the leaf as 0, verified for %s: %s\n\n%s\n", input.id, input.mutation, input.target, input.dnsName, outcome, crash)
+	crashers := filepath.Join(f.dir, "crashers")
+	if err := ioutil.WriteFile(filepath.Join(crashers, name), der, 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(crashers, name+".pem"), []byte(chainPEM), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s\n", name, strings.SplitN(output, "\n", 2)[0])
+	return ioutil.WriteFile(filepath.Join(crashers, name+".output"), []byte(output), 0644)
+}
+
+func (f *fuzzer) printSummary() {
+	fmt.Printf("Verified %d mutated chains, skipping %d mutations that changed nothing: %d crashed, %d hung, and %d distinct outcomes were seen.\n", f.numRun, f.numSkipped, f.numCrashes, f.numHangs, len(f.outcomes))
+
+	var outcomes []string
+	for outcome := range f.outcomes {
+		outcomes = append(outcomes, outcome)
+	}
+	sort.Slice(outcomes, func(i, j int) bool {
+		return f.outcomes[outcomes[i]] > f.outcomes[outcomes[j]]
+	})
+	for _, outcome := range outcomes {
+		fmt.Printf("  %6d  %s\n", f.outcomes[outcome], outcome)
+	}
+	fmt.Printf("Wrote %d inputs to %s\n", f.numWritten, filepath.Join(f.dir, "corpus"))
+}
+
+// tbsCertificate is a certificate's TBSCertificate, split into its fields so
+// that they can be replaced without parsing them.
+type tbsCertificate struct {
+	fields []asn1.RawValue
+}
+
+// parseTBSCertificate returns the TBSCertificate of the certificate der.
+func parseTBSCertificate(der []byte) (*tbsCertificate, error) {
+	var certificate struct {
+		TBSCertificate     asn1.RawValue
+		SignatureAlgorithm asn1.RawValue
+		Signature          asn1.BitString
+	}
+	if rest, err := asn1.Unmarshal(der, &certificate); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data after the certificate")
+	}
+
+	fields, err := derElements(certificate.TBSCertificate.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &tbsCertificate{fields}, nil
+}
+
+// derElements splits contents, the contents of a DER SEQUENCE, into its
+// elements.
+func derElements(contents []byte) ([]asn1.RawValue, error) {
+	var elements []asn1.RawValue
+	for len(contents) > 0 {
+		var element asn1.RawValue
+		var err error
+		if contents, err = asn1.Unmarshal(contents, &element); err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+	}
+	return elements, nil
+}
+
+// derSequence returns the DER SEQUENCE of elements.
+func derSequence(elements ...asn1.RawValue) ([]byte, error) {
+	var contents []byte
+	for _, element := range elements {
+		contents = append(contents, element.FullBytes...)
+	}
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: contents})
+}
+
+// derRaw returns v, marshaled, as a RawValue.
+func derRaw(v interface{}) (asn1.RawValue, error) {
+	der, err := asn1.Marshal(v)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	var raw asn1.RawValue
+	_, err = asn1.Unmarshal(der, &raw)
+	return raw, err
+}
+
+// Indexes of the fields of a TBSCertificate that has a version, which every
+// certificate with extensions does.
+const (
+	tbsSignatureField = 2
+	tbsPublicKeyField = 6
+)
+
+// derExtension is an Extension, with the value left as DER.
+type derExtension struct {
+	oid      asn1.ObjectIdentifier
+	critical bool
+	value    []byte
+}
+
+// extensionsField returns the index in t.fields of the extensions, or -1 if
+// there are none.
+func (t *tbsCertificate) extensionsField() int {
+	for i, field := range t.fields {
+		if field.Class == asn1.ClassContextSpecific && field.Tag == 3 {
+			return i
+		}
+	}
+	return -1
+}
+
+// extensions returns t's extensions.
+func (t *tbsCertificate) extensions() ([]derExtension, error) {
+	i := t.extensionsField()
+	if i < 0 {
+		return nil, nil
+	}
+	var extensions []struct {
+		Id       asn1.ObjectIdentifier
+		Critical bool `asn1:"optional"`
+		Value    []byte
+	}
+	if _, err := asn1.Unmarshal(t.fields[i].Bytes, &extensions); err != nil {
+		return nil, err
+	}
+	var ret []derExtension
+	for _, e := range extensions {
+		ret = append(ret, derExtension{e.Id, e.Critical, e.Value})
+	}
+	return ret, nil
+}
+
+// setExtensions replaces t's extensions. The criticality of extensions that
+// aren't critical is left out, as DER requires, so that flipping it changes
+// their length.
+func (t *tbsCertificate) setExtensions(extensions []derExtension) error {
+	var encoded []asn1.RawValue
+	for _, e := range extensions {
+		elements := []interface{}{e.oid}
+		if e.critical {
+			elements = append(elements, true)
+		}
+		elements = append(elements, e.value)
+
+		var raws []asn1.RawValue
+		for _, element := range elements {
+			raw, err := derRaw(element)
+			if err != nil {
+				return err
+			}
+			raws = append(raws, raw)
+		}
+		der, err := derSequence(raws...)
+		if err != nil {
+			return err
+		}
+		var raw asn1.RawValue
+		if _, err := asn1.Unmarshal(der, &raw); err != nil {
+			return err
+		}
+		encoded = append(encoded, raw)
+	}
+
+	sequence, err := derSequence(encoded...)
+	if err != nil {
+		return err
+	}
+	field, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: sequence})
+	if err != nil {
+		return err
+	}
+	i := t.extensionsField()
+	if i < 0 {
+		return errors.New("the certificate has no extensions to replace")
+	}
+	_, err = asn1.Unmarshal(field, &t.fields[i])
+	return err
+}
+
+// oidECDSAWithSHA256 is the signature algorithm of re-signed certificates.
+var oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+
+// sign returns the certificate of t, with its public key replaced by key's
+// and signed by key.
+func (t *tbsCertificate) sign(key *ecdsa.PrivateKey) ([]byte, error) {
+	if len(t.fields) <= tbsPublicKeyField || t.fields[0].Class != asn1.ClassContextSpecific {
+		return nil, errors.New("the certificate isn't a v3 certificate")
+	}
+
+	algorithm, err := derRaw(struct{ Algorithm asn1.ObjectIdentifier }{oidECDSAWithSHA256})
+	if err != nil {
+		return nil, err
+	}
+	spki, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	var publicKey asn1.RawValue
+	if _, err := asn1.Unmarshal(spki, &publicKey); err != nil {
+		return nil, err
+	}
+
+	fields := append([]asn1.RawValue(nil), t.fields...)
+	fields[tbsSignatureField] = algorithm
+	fields[tbsPublicKeyField] = publicKey
+	tbs, err := derSequence(fields...)
+	if err != nil {
+		return nil, err
+	}
+	var tbsRaw asn1.RawValue
+	if _, err := asn1.Unmarshal(tbs, &tbsRaw); err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256(tbs)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signatureRaw, err := derRaw(asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)})
+	if err != nil {
+		return nil, err
+	}
+	return derSequence(tbsRaw, algorithm, signatureRaw)
+}
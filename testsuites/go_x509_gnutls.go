@@ -0,0 +1,280 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gnutlsStatusMessages maps a distinctive part of the message with which
+// certtool describes each verification status flag, as worded by
+// gnutls_certificate_verification_status_print, to the flag's name, so that
+// its errors can be classified with errorTaxonomy. GNUTLS_CERT_INVALID
+// accompanies every other flag, so it's left out.
+var gnutlsStatusMessages = []struct{ message, flag string }{
+	{"chain is revoked", "GNUTLS_CERT_REVOKED"},
+	{"issuer is unknown", "GNUTLS_CERT_SIGNER_NOT_FOUND"},
+	{"issuer is not a CA", "GNUTLS_CERT_SIGNER_NOT_CA"},
+	{"signer's constraints", "GNUTLS_CERT_SIGNER_CONSTRAINTS_FAILURE"},
+	{"insecure algorithm", "GNUTLS_CERT_INSECURE_ALGORITHM"},
+	{"not yet valid certificate", "GNUTLS_CERT_NOT_ACTIVATED"},
+	{"expired certificate", "GNUTLS_CERT_EXPIRED"},
+	{"signature in the certificate is invalid", "GNUTLS_CERT_SIGNATURE_FAILURE"},
+	{"name in the certificate does not match", "GNUTLS_CERT_UNEXPECTED_OWNER"},
+	{"purpose does not match", "GNUTLS_CERT_PURPOSE_MISMATCH"},
+	{"unknown critical extension", "GNUTLS_CERT_UNKNOWN_CRIT_EXTENSIONS"},
+}
+
+// gnutlsChainOutput matches the line in which certtool reports the result of
+// verifying the chain, e.g. "Chain verification output: Not verified. The
+// certificate is NOT trusted. The certificate issuer is unknown."
+var gnutlsChainOutput = regexp.MustCompile(`Chain verification output: ?(.*)`)
+
+// runGnuTLS implements the gnutls command, which runs the main corpus against
+// GnuTLS by executing "certtool --verify" for each test, so that GnuTLS can be
+// measured without a C harness. Both DNS and IP tests are run, with
+// --verify-hostname, which GnuTLS matches against IP SANs when it's given an
+// IP address.
+func runGnuTLS(args []string) error {
+	flags := flag.NewFlagSet("gnutls", flag.ExitOnError)
+	binary := flags.String("certtool", "certtool", "The certtool binary to run")
+	resultsPath := flags.String("results", "", "If set, the path to write a results file to")
+	resultsKeyPath := flags.String("results-key", "", resultsKeyUsage)
+	numWorkers := flags.Int("workers", defaultWorkers, workersUsage)
+	checkpointPath := flags.String("checkpoint", "", checkpointUsage)
+	profileName := flags.String("profile", "stress", profileUsage)
+	cnPolicyFlag := flags.String("cn-policy", "", cnPolicyUsage)
+	logLevel := flags.String("log-level", "info", logLevelUsage)
+	logFormat := flags.String("log-format", "text", logFormatUsage)
+	flags.Parse(args)
+
+	if err := selectProfile(*profileName); err != nil {
+		return err
+	}
+	if err := selectLogger(*logLevel, *logFormat); err != nil {
+		return err
+	}
+	if err := selectCNPolicy(*cnPolicyFlag); err != nil {
+		return err
+	}
+
+	resultsKey, err := loadResultsKey(*resultsKeyPath)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	expectations, err := loadExpectations()
+	if err != nil {
+		return err
+	}
+	numFiltered, err := profile.filter(expectations)
+	if err != nil {
+		return err
+	}
+
+	version, err := gnutlsVersion(*binary)
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "bettertls-gnutls")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	recorder := newResultRecorder(deliveryPool)
+	recorder.setSigningKey(resultsKey)
+	profile.recordFiltered(recorder, numFiltered)
+	recorder.taxonomy = "gnutls"
+	// GnuTLS matches the Common Name if there are no DNS SANs, and
+	// certtool has no way to stop it.
+	recorder.setCNPolicy(cnPolicyName(cnAllowed))
+	recorder.userAgent = "GnuTLS"
+	recorder.setImplementation("GnuTLS", version)
+	if len(version) > 0 {
+		recorder.userAgent += " " + version
+	}
+	fmt.Printf("Testing %s\n", recorder.userAgent)
+
+	cp, err := openCheckpoint(*checkpointPath, recorder.userAgent, config.TestVersion)
+	if err != nil {
+		return err
+	}
+	defer cp.close()
+
+	numFailures := runPipeline(expectations.Expects, *numWorkers, cp.wrap(recorder, func(test *expectation) bool {
+		return runGnuTLSTest(*binary, dir, test, config, recorder)
+	}), failureReporter(nil))
+
+	if len(*resultsPath) > 0 {
+		if err := recorder.write(*resultsPath, config.TestVersion); err != nil {
+			return err
+		}
+	}
+	if err := cp.finish(); err != nil {
+		return err
+	}
+
+	if numFailures != 0 {
+		return fmt.Errorf("failed %d of %d tests", numFailures, 2*len(expectations.Expects))
+	}
+
+	return nil
+}
+
+// gnutlsVersion returns the version of GnuTLS that certtool reports, e.g.
+// "3.7.9" from "certtool 3.7.9", or "" if it reports something else.
+func gnutlsVersion(binary string) (string, error) {
+	output, err := exec.Command(binary, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("running %s --version: %s", binary, err)
+	}
+	lines := strings.SplitN(string(output), "\n", 2)
+	if fields := strings.Fields(lines[0]); len(fields) >= 2 && fields[0] == "certtool" {
+		return fields[1], nil
+	}
+	return "", nil
+}
+
+// runGnuTLSTest verifies the certificate for test with "certtool --verify"
+// and returns whether the test failed. A WEAK-OK expectation is met whatever
+// the result. The result of the verification is recorded with recorder.
+func runGnuTLSTest(binary, dir string, test *expectation, config *configFile, recorder *resultRecorder) (failed bool) {
+	expect, name := &test.IP, config.testIP(test)
+	if test.testDNS {
+		expect, name = &test.DNS, config.testHostname(test)
+	}
+
+	verifyErr, elapsed, err := gnutlsVerify(binary, dir, test.Id, name)
+	if err != nil {
+		test.err = err
+		return true
+	}
+	if verifyErr == nil && test.testDNS && cnPolicy != nil && cnPolicy.name == cnIgnored {
+		leaf, err := readPEMChain(testPath(test.Id, ".crt"))
+		if err != nil {
+			test.err = err
+			return true
+		}
+		verifyErr = nameInSANs(leaf[0], name, "GNUTLS_CERT_UNEXPECTED_OWNER")
+	}
+	if cnPolicy != nil {
+		if expect, err = cnPolicy.expectation(test, test.testDNS); err != nil {
+			test.err = err
+			return true
+		}
+	}
+
+	traceVerification(test, name, verifyErr, elapsed)
+	recorder.record(test, verifyErr, elapsed)
+
+	passed, description := gradeResult(expect, verifyErr == nil, errorReasonOf(recorder.taxonomy, verifyErr))
+	if !passed {
+		test.err = fmt.Errorf("%s: %v", description, verifyErr)
+	}
+	return !passed
+}
+
+// gnutlsVerify verifies the certificate for test id for name with "certtool
+// --verify", and returns the error that it reported, if any, and how long it
+// took. certtool takes the leaf and its intermediates from a single file,
+// which is written to dir for the verification. err is set if certtool
+// couldn't be run or timed out.
+func gnutlsVerify(binary, dir string, id int, name string) (verifyErr error, elapsed time.Duration, err error) {
+	leaf, err := ioutil.ReadFile(testPath(id, ".crt"))
+	if err != nil {
+		return nil, 0, err
+	}
+	chain, err := ioutil.ReadFile(testPath(id, ".chain"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// DNS and IP tests of the same certificate may be run at once, so
+	// each verification has its own file.
+	f, err := ioutil.TempFile(dir, strconv.Itoa(id)+"-*.pem")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(append(append(leaf, '\n'), chain...))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	args := []string{"--verify", "--load-ca-certificate", filepath.Join(certificatesDir, "root.crt"), "--verify-hostname", name, "--infile", f.Name()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), limits.timeout)
+	defer cancel()
+
+	start := time.Now()
+	output, err := exec.CommandContext(ctx, binary, args...).CombinedOutput()
+	elapsed = time.Since(start)
+
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok || ctx.Err() != nil {
+			return nil, elapsed, fmt.Errorf("running %s: %v", binary, err)
+		}
+		return gnutlsError(string(output), err), elapsed, nil
+	}
+	// certtool exits with status zero for some failures, so the
+	// verification's own result is checked as well.
+	if match := gnutlsChainOutput.FindStringSubmatch(string(output)); match != nil && !strings.HasPrefix(match[1], "Verified") {
+		return gnutlsError(string(output), errors.New("not verified")), elapsed, nil
+	}
+	return nil, elapsed, nil
+}
+
+// gnutlsError returns the error that certtool reported in output, prefixed
+// with the names of the status flags that it describes, or with runErr if it
+// didn't report a result.
+func gnutlsError(output string, runErr error) error {
+	match := gnutlsChainOutput.FindStringSubmatch(output)
+	if match == nil {
+		return errors.New(strings.TrimSpace(output) + " (" + runErr.Error() + ")")
+	}
+
+	var flags []string
+	for _, status := range gnutlsStatusMessages {
+		if strings.Contains(match[1], status.message) {
+			flags = append(flags, status.flag)
+		}
+	}
+	message := strings.TrimSpace(match[1])
+	if len(flags) == 0 {
+		return errors.New(message)
+	}
+	return fmt.Errorf("%s: %s", strings.Join(flags, ", "), message)
+}
@@ -0,0 +1,343 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Kinds of hostname candidate, each a way of deriving a name from one of the
+// leaf's own names. hostnameKinds lists them in the order they're reported.
+const (
+	candidateExact        = "exact"
+	candidateCase         = "case-variant"
+	candidateSubdomain    = "subdomain"
+	candidateParent       = "parent"
+	candidateWildcard     = "wildcard"
+	candidateWildcardDeep = "wildcard-two-labels"
+	candidateWildcardBare = "wildcard-base"
+	candidatePartial      = "partial-wildcard"
+	candidateIPLiteral    = "ip-literal"
+	candidateIPInDNSSAN   = "ip-in-dns-san"
+	candidateCommonName   = "common-name"
+)
+
+var hostnameKinds = []string{candidateExact, candidateCase, candidateSubdomain, candidateParent, candidateWildcard, candidateWildcardDeep, candidateWildcardBare, candidatePartial, candidateIPLiteral, candidateIPInDNSSAN, candidateCommonName}
+
+// hostnameCandidate is a name that a leaf is matched against.
+type hostnameCandidate struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// From is the leaf's name that the candidate was derived from.
+	From string `json:"from"`
+	// Match is whether RFC 6125 requires the candidate to match, or nil
+	// if it leaves it to the client.
+	Match *bool `json:"match,omitempty"`
+}
+
+// hostnameCheck is the result of matching a leaf against a candidate.
+type hostnameCheck struct {
+	hostnameCandidate
+	Matched bool `json:"matched"`
+}
+
+// conforms returns whether the check's result is the one that RFC 6125
+// requires, which it is if there's no requirement.
+func (c *hostnameCheck) conforms() bool {
+	return c.Match == nil || *c.Match == c.Matched
+}
+
+// hostnameReport is the file written by hostnames -o.
+type hostnameReport struct {
+	Implementation string               `json:"implementation"`
+	Tests          []hostnameTestResult `json:"tests"`
+}
+
+type hostnameTestResult struct {
+	Id int `json:"id"`
+	// ChainAccepted is whether the leaf's chain verified, without a name,
+	// and ChainError the error if it didn't. The candidates are matched
+	// either way.
+	ChainAccepted bool            `json:"chainAccepted"`
+	ChainError    string          `json:"chainError,omitempty"`
+	Checks        []hostnameCheck `json:"checks"`
+}
+
+// checkHostnames implements the hostnames command, which isolates hostname
+// matching from chain building. Each test's chain is verified once, without a
+// name, and then its leaf is matched with VerifyHostname against a matrix of
+// names derived from its own: each name exactly and in another case, a
+// subdomain and the parent of each DNS name, names that its wildcards should
+// and shouldn't cover, and its IP addresses. The results are graded by what
+// RFC 6125 requires for each kind of candidate, giving a finer-grained picture
+// of conformance than the main corpus's single name per test.
+func checkHostnames(args []string) error {
+	flags := flag.NewFlagSet("hostnames", flag.ExitOnError)
+	outputPath := flags.String("o", "", "If set, the path to write every check to, as JSON")
+	archivePath := flags.String("corpus-archive", "", corpusArchiveUsage)
+	corpusFormat := flags.String("corpus-format", "pem", corpusFormatUsage)
+	profileName := flags.String("profile", "stress", profileUsage)
+	flags.Parse(args)
+
+	if err := selectProfile(*profileName); err != nil {
+		return err
+	}
+	if err := openCorpusArchive(*archivePath); err != nil {
+		return err
+	}
+	reader, err := openCorpusReader(*corpusFormat)
+	if err != nil {
+		return err
+	}
+
+	expectations, err := loadExpectations()
+	if err != nil {
+		return err
+	}
+	if _, err := profile.filter(expectations); err != nil {
+		return err
+	}
+	root, err := loadRoot(reader)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	report := &hostnameReport{Implementation: "Go " + runtime.Version()}
+	var numChainsRejected int
+	for _, test := range expectations.Expects {
+		leafDER, chainDER, err := reader.test(test.Id)
+		if err != nil {
+			return err
+		}
+		leaf, err := x509.ParseCertificate(leafDER)
+		if err != nil {
+			return fmt.Errorf("#%d: %v", test.Id, err)
+		}
+		intermediates := x509.NewCertPool()
+		for _, der := range chainDER {
+			intermediate, err := x509.ParseCertificate(der)
+			if err != nil {
+				return fmt.Errorf("#%d: %v", test.Id, err)
+			}
+			intermediates.AddCert(intermediate)
+		}
+
+		result := hostnameTestResult{Id: test.Id, ChainAccepted: true}
+		if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+			result.ChainAccepted, result.ChainError = false, err.Error()
+			numChainsRejected++
+		}
+		for _, candidate := range hostnameCandidates(leaf) {
+			check := hostnameCheck{hostnameCandidate: candidate, Matched: leaf.VerifyHostname(candidate.Name) == nil}
+			if !check.conforms() {
+				should := "should have matched"
+				if !*check.Match {
+					should = "shouldn't have matched"
+				}
+				fmt.Printf("#%d: %s %q, from %q, %s\n", test.Id, check.Kind, check.Name, check.From, should)
+			}
+			result.Checks = append(result.Checks, check)
+		}
+		report.Tests = append(report.Tests, result)
+	}
+
+	numChecks, numNonconforming := printHostnameSummary(report)
+	fmt.Printf("Verified %d chains without a name, of which %d were rejected; their leaves were matched anyway.\n", len(report.Tests), numChainsRejected)
+
+	if len(*outputPath) > 0 {
+		output, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(*outputPath, append(output, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+
+	if numNonconforming > 0 {
+		return fmt.Errorf("%d of %d hostname checks didn't match as RFC 6125 requires", numNonconforming, numChecks)
+	}
+	return nil
+}
+
+// printHostnameSummary prints, for each kind of candidate, how many matched
+// and how many conformed to RFC 6125, and returns the totals.
+func printHostnameSummary(report *hostnameReport) (numChecks, numNonconforming int) {
+	type counts struct{ checks, matched, nonconforming int }
+	byKind := make(map[string]*counts)
+	for _, kind := range hostnameKinds {
+		byKind[kind] = &counts{}
+	}
+	for _, test := range report.Tests {
+		for _, check := range test.Checks {
+			c := byKind[check.Kind]
+			c.checks++
+			if check.Matched {
+				c.matched++
+			}
+			if !check.conforms() {
+				c.nonconforming++
+			}
+		}
+	}
+
+	fmt.Printf("%-20s %8s %8s %14s\n", "Candidate", "Checks", "Matched", "Nonconforming")
+	for _, kind := range hostnameKinds {
+		c := byKind[kind]
+		if c.checks == 0 {
+			continue
+		}
+		fmt.Printf("%-20s %8d %8d %14d\n", kind, c.checks, c.matched, c.nonconforming)
+		numChecks += c.checks
+		numNonconforming += c.nonconforming
+	}
+	return numChecks, numNonconforming
+}
+
+// hostnameCandidates returns the matrix of names to match leaf against,
+// derived from its names, without duplicates. A candidate derived from one
+// name that needn't match it must still match if another of the leaf's names
+// covers it.
+func hostnameCandidates(leaf *x509.Certificate) []hostnameCandidate {
+	match, noMatch := true, false
+	var candidates []hostnameCandidate
+	seen := make(map[string]bool)
+	add := func(kind, name, from string, expect *bool) {
+		if len(name) == 0 || seen[kind+" "+name] {
+			return
+		}
+		seen[kind+" "+name] = true
+		if coveredBySAN(leaf, name) {
+			expect = &match
+		}
+		candidates = append(candidates, hostnameCandidate{kind, name, from, expect})
+	}
+
+	for _, san := range leaf.DNSNames {
+		switch {
+		case net.ParseIP(san) != nil:
+			// An IP address is only matched against IP SANs, per
+			// section 6.2.1.
+			add(candidateIPInDNSSAN, san, san, &noMatch)
+		case strings.Contains(strings.TrimPrefix(san, "*."), "*"):
+			// Section 6.4.3 lets clients match a wildcard that's
+			// only part of a label, such as w*.example.com, but
+			// RFC 9525 forbids it, so either result conforms.
+			add(candidatePartial, strings.Replace(san, "*", "x", -1), san, nil)
+		case strings.HasPrefix(san, "*."):
+			// A wildcard covers a single, whole, left-most label,
+			// per section 6.4.3.
+			base := san[2:]
+			add(candidateWildcard, "wild."+base, san, &match)
+			add(candidateCase, strings.ToUpper("wild."+base), san, &match)
+			add(candidateWildcardDeep, "two.wild."+base, san, &noMatch)
+			add(candidateWildcardBare, base, san, &noMatch)
+		default:
+			// DNS names are compared case-insensitively, per section
+			// 6.4.1, and only exactly.
+			add(candidateExact, san, san, &match)
+			if upper := strings.ToUpper(san); upper != san {
+				add(candidateCase, upper, san, &match)
+			}
+			add(candidateSubdomain, "sub."+san, san, &noMatch)
+			if i := strings.Index(san, "."); i >= 0 && strings.Contains(san[i+1:], ".") {
+				add(candidateParent, san[i+1:], san, &noMatch)
+			}
+		}
+	}
+	for _, ip := range leaf.IPAddresses {
+		add(candidateIPLiteral, ip.String(), ip.String(), &match)
+	}
+
+	// Section 6.4.4 lets clients fall back to the Common Name only if there
+	// are no DNS SANs, and doesn't require them to, so it must only match
+	// if it's also in the SANs. An IP address in it never matches.
+	if cn := leaf.Subject.CommonName; len(cn) > 0 && !hasSAN(leaf, cn) {
+		switch {
+		case net.ParseIP(cn) != nil:
+			add(candidateCommonName, cn, cn, &noMatch)
+		case len(leaf.DNSNames) == 0:
+			add(candidateCommonName, cn, cn, nil)
+		default:
+			add(candidateCommonName, cn, cn, &noMatch)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return kindIndex(candidates[i].Kind) < kindIndex(candidates[j].Kind)
+	})
+	return candidates
+}
+
+// coveredBySAN returns whether RFC 6125 requires name to match one of leaf's
+// SANs: an IP address one of its IP SANs, or a DNS name one of its DNS SANs
+// exactly or a wildcard SAN in place of its left-most label.
+func coveredBySAN(leaf *x509.Certificate, name string) bool {
+	if ip := net.ParseIP(name); ip != nil {
+		for _, san := range leaf.IPAddresses {
+			if san.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, san := range leaf.DNSNames {
+		if strings.EqualFold(san, name) {
+			return true
+		}
+		if base := strings.TrimPrefix(san, "*."); base != san && !strings.Contains(base, "*") {
+			if i := strings.Index(name, "."); i > 0 && strings.EqualFold(name[i+1:], base) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasSAN returns whether name is one of leaf's DNS or IP SANs.
+func hasSAN(leaf *x509.Certificate, name string) bool {
+	for _, san := range leaf.DNSNames {
+		if strings.EqualFold(san, name) {
+			return true
+		}
+	}
+	ip := net.ParseIP(name)
+	for _, san := range leaf.IPAddresses {
+		if ip != nil && san.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func kindIndex(kind string) int {
+	for i, k := range hostnameKinds {
+		if k == kind {
+			return i
+		}
+	}
+	return len(hostnameKinds)
+}
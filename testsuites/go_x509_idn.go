@@ -0,0 +1,124 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// idnExpectations represents idnExpects.json, which defineExpects.js
+// generates when the optional IDN corpus is present.
+type idnExpectations struct {
+	Expects []idnExpectation
+}
+
+type idnExpectation struct {
+	Id int `json:"id"`
+	// Hostname is the A-label name to verify the certificate against.
+	Hostname string `json:"hostname"`
+	// TLD is the A-label TLD that the name is under.
+	TLD string `json:"tld"`
+	expectedResult
+}
+
+// runIDNTests runs the IDN tests and returns the number of tests run and the
+// number of failures. It does nothing if the IDN corpus hasn't been
+// generated.
+func runIDNTests() (numTests, numFailures int, err error) {
+	if !profile.runsOptionalCorpus("idn") {
+		return 0, 0, nil
+	}
+
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(baseDir, "html", "idnExpects.json"))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	expectations := new(idnExpectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return 0, 0, err
+	}
+
+	idnDir := filepath.Join(baseDir, "certificates", "idn")
+	rootChain, err := readPEMChain(filepath.Join(idnDir, "root.crt"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rootPool := x509.NewCertPool()
+	for _, root := range rootChain {
+		rootPool.AddCert(root)
+	}
+
+	for _, test := range expectations.Expects {
+		if err := runIDNTest(&test, idnDir, rootPool); err != nil {
+			fmt.Printf("idn #%d (%s): failed:\n  %q\n", test.Id, test.Hostname, err)
+			numFailures++
+		}
+	}
+
+	return len(expectations.Expects), numFailures, nil
+}
+
+// runIDNTest verifies a single certificate against its name and returns an
+// error if the result doesn't match the expectation.
+func runIDNTest(test *idnExpectation, idnDir string, rootPool *x509.CertPool) error {
+	chain, err := readPEMChain(filepath.Join(idnDir, strconv.Itoa(test.Id)+".chain"))
+	if err != nil {
+		return err
+	}
+
+	leaf, err := readPEMChain(filepath.Join(idnDir, strconv.Itoa(test.Id)+".crt"))
+	if err != nil {
+		return err
+	}
+
+	if len(leaf) != 1 {
+		return fmt.Errorf("expected a single certificate in the .crt file, but found %d", len(leaf))
+	}
+
+	intermediatePool := x509.NewCertPool()
+	for _, intermediate := range chain {
+		intermediatePool.AddCert(intermediate)
+	}
+
+	_, err = leaf[0].Verify(x509.VerifyOptions{
+		DNSName:       test.Hostname,
+		Roots:         rootPool,
+		Intermediates: intermediatePool,
+	})
+
+	switch test.Result {
+	case "ERROR":
+		if err == nil {
+			return fmt.Errorf("certificate was accepted")
+		}
+	case "OK":
+		return err
+	default:
+		return fmt.Errorf("unknown expected result %q", test.Result)
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// idnaExpectations represents idnaExpects.json, which defineExpects.js
+// generates when the optional IDNA probe corpus is present.
+type idnaExpectations struct {
+	Expects []idnaExpectation
+}
+
+type idnaExpectation struct {
+	Id int `json:"id"`
+	// Probe names the characters that the probe uses, e.g. "sharpS".
+	Probe string `json:"probe"`
+	// Kind is "hostname" for probes that are verified against a U-label
+	// name, which detect Mapping if they're accepted, or "constraint" for
+	// probes of name constraints, which detect it if they're rejected.
+	Kind    string `json:"kind"`
+	Mapping string `json:"mapping"`
+	// Hostname is the name to verify the certificate against.
+	Hostname string `json:"hostname"`
+	expectedResult
+}
+
+// The mappings that a verifier can be detected to use for each kind of probe,
+// recorded in results files. They're informational, since neither IDNA2003 nor
+// IDNA2008 is wrong for a verifier to use.
+const (
+	idnaMappingIDNA2003 = "IDNA2003"
+	idnaMappingIDNA2008 = "IDNA2008"
+	// idnaMappingBoth is for verifiers that accepted both forms of a name.
+	idnaMappingBoth = "BOTH"
+	// idnaMappingNone is for verifiers that didn't map names at all, such
+	// as those that only accept A-labels.
+	idnaMappingNone = "NONE"
+	// idnaMappingMixed is for verifiers that were detected to use
+	// different mappings for different probes.
+	idnaMappingMixed = "MIXED"
+)
+
+// runIDNATests runs the IDNA probes, which detect whether the verifier maps
+// internationalized names with IDNA2003 or IDNA2008, and returns the number of
+// probes run. None of them fail. It records the outcome of each with recorder,
+// along with the mapping detected for each kind of probe. It does nothing if
+// the IDNA probe corpus hasn't been generated.
+func runIDNATests(recorder *resultRecorder) (numTests int, err error) {
+	if !profile.runsOptionalCorpus("idna") {
+		return 0, nil
+	}
+
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(baseDir, "html", "idnaExpects.json"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	expectations := new(idnaExpectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return 0, err
+	}
+
+	idnaDir := filepath.Join(baseDir, "certificates", "idna")
+	rootChain, err := readPEMChain(filepath.Join(idnaDir, "root.crt"))
+	if err != nil {
+		return 0, err
+	}
+
+	rootPool := x509.NewCertPool()
+	for _, root := range rootChain {
+		rootPool.AddCert(root)
+	}
+
+	// detected holds, for each kind of probe and then each probe, the
+	// mappings that the verifier was detected to use.
+	detected := make(map[string]map[string][]string)
+	for _, test := range expectations.Expects {
+		verifyErr := verifyHostname(filepath.Join(idnaDir, strconv.Itoa(test.Id)), test.Hostname, rootPool)
+		recorder.recordIDNA(&test, verifyErr)
+
+		if detected[test.Kind] == nil {
+			detected[test.Kind] = make(map[string][]string)
+		}
+		mappings := detected[test.Kind][test.Probe]
+		if (verifyErr == nil) == (test.Kind == "hostname") {
+			mappings = append(mappings, test.Mapping)
+		}
+		detected[test.Kind][test.Probe] = mappings
+	}
+
+	kinds := make([]string, 0, len(detected))
+	for kind := range detected {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	for _, kind := range kinds {
+		mapping := summariseIDNAMappings(detected[kind])
+		recorder.setIDNAMapping(kind, mapping)
+		fmt.Printf("IDNA mapping (%s probes): %s\n", kind, mapping)
+	}
+
+	return len(expectations.Expects), nil
+}
+
+// summariseIDNAMappings returns the mapping that every probe detected, or
+// idnaMappingMixed if they differ.
+func summariseIDNAMappings(byProbe map[string][]string) string {
+	summary := ""
+	for _, mappings := range byProbe {
+		var mapping string
+		switch len(mappings) {
+		case 0:
+			mapping = idnaMappingNone
+		case 1:
+			mapping = mappings[0]
+		default:
+			mapping = idnaMappingBoth
+		}
+
+		if summary == "" {
+			summary = mapping
+		} else if summary != mapping {
+			return idnaMappingMixed
+		}
+	}
+	return summary
+}
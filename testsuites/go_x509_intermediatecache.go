@@ -0,0 +1,489 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The phases of an intermediate caching scenario, in the order that a client
+// is pointed at them.
+const (
+	// cachePhasePrime is a connection to the primed test that's served
+	// its full chain, as a client's connections to it are until one of
+	// them completes a handshake.
+	cachePhasePrime = "prime"
+	// cachePhaseProbe is a later connection to the primed test, which is
+	// served the leaf alone.
+	cachePhaseProbe = "probe"
+	// cachePhaseControl is a connection to the control test, which is
+	// only ever served the leaf alone.
+	cachePhaseControl = "control"
+)
+
+// The outcomes of an intermediate caching scenario, which summarise the
+// scenarios of a results file too, along with cacheOutcomeMixed.
+const (
+	// cacheOutcomeCached means that the client accepted the primed
+	// test's leaf without its chain, having seen the chain on an earlier
+	// connection, but not the control's.
+	cacheOutcomeCached = "CACHED"
+	// cacheOutcomeNotCached means that the client rejected the primed
+	// test's leaf without its chain.
+	cacheOutcomeNotCached = "NOT_CACHED"
+	// cacheOutcomeInconclusive means that the client rejected the primed
+	// test even with its chain, or accepted the control's leaf without
+	// ever seeing its chain, so that it must find issuers some other way.
+	cacheOutcomeInconclusive = "INCONCLUSIVE"
+	cacheOutcomeMixed        = "MIXED"
+)
+
+// cacheScenario is an intermediate caching scenario: a primed test, whose
+// chain is served on a client's first connection and withheld afterwards, and
+// a control test, whose chain is always withheld.
+type cacheScenario struct {
+	primed, control int
+	// primedHost and controlHost are the DNS names that the tests are
+	// verified against.
+	primedHost, controlHost string
+	// primedPort and controlPort are the ports that the tests are served
+	// on.
+	primedPort, controlPort int
+	// fullChain is the primed test's leaf and chain, and primedLeaf and
+	// controlLeaf the leaves alone.
+	fullChain, primedLeaf, controlLeaf tls.Certificate
+}
+
+type cacheKey struct {
+	id    int
+	phase string
+}
+
+// cacheClient is the state of one client, as identified by its IP address.
+type cacheClient struct {
+	// primed holds the primed tests with which the client has completed
+	// a handshake that served the full chain.
+	primed    map[int]bool
+	outcomes  map[cacheKey]*probeOutcome
+	userAgent string
+}
+
+// cacheProber serves the intermediate caching scenarios and records what each
+// client did with them.
+type cacheProber struct {
+	config    *configFile
+	timeout   time.Duration
+	scenarios []*cacheScenario
+
+	listeners []net.Listener
+	done      chan struct{}
+	doneOnce  sync.Once
+
+	lock    sync.Mutex
+	clients map[string]*cacheClient
+	// clientOrder holds the clients' addresses in the order that they
+	// first made a request. The results are those of the first.
+	clientOrder []string
+	hellos      clientHelloLog
+}
+
+// runIntermediateCache implements the intermediate-cache command, which tests
+// whether a live client caches intermediates between connections, as
+// browsers do and libraries don't. It serves valid tests of the main corpus,
+// each on its own port from the control port plus one. For each scenario, a
+// primed test is served with its full chain until a client completes a
+// handshake, and with its leaf alone to that client afterwards, and a control
+// test is only ever served with its leaf alone. Clients are told apart by
+// their IP address. A client that caches intermediates accepts the primed
+// test without its chain, but not the control.
+func runIntermediateCache(args []string) error {
+	flags := flag.NewFlagSet("intermediate-cache", flag.ExitOnError)
+	control := flags.String("control", "", "The address to serve the probe page and controls on, which defaults to basePort+20000 on all interfaces. Tests are served from the port after it")
+	numScenarios := flags.Int("scenarios", 5, "The number of scenarios, each of a primed test and a control test, to serve")
+	resultsPath := flags.String("results", "intermediate-cache.json", "The path to write the results file to when probing is done")
+	resultsKeyPath := flags.String("results-key", "", resultsKeyUsage)
+	userAgent := flags.String("user-agent", "", "The user agent to record, which defaults to the User-Agent header of the client's first request")
+	flags.DurationVar(&limits.timeout, "timeout", limits.timeout, "The longest time to wait for a client to complete a handshake")
+	flags.Parse(args)
+
+	resultsKey, err := loadResultsKey(*resultsKeyPath)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if len(*control) == 0 {
+		*control = ":" + strconv.Itoa(config.BasePort+20000)
+	}
+
+	expectations, err := loadExpectations()
+	if err != nil {
+		return err
+	}
+
+	controlListener, err := net.Listen("tcp", *control)
+	if err != nil {
+		return err
+	}
+	controlPort := controlListener.Addr().(*net.TCPAddr).Port
+
+	p := &cacheProber{
+		config:    config,
+		timeout:   limits.timeout,
+		listeners: []net.Listener{controlListener},
+		done:      make(chan struct{}),
+		clients:   make(map[string]*cacheClient),
+		hellos:    make(clientHelloLog),
+	}
+	defer p.close()
+
+	if p.scenarios, err = makeCacheScenarios(config, expectations, *numScenarios, controlPort); err != nil {
+		return err
+	}
+	if err := p.start(controlListener); err != nil {
+		return err
+	}
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	fmt.Printf("Serving %d intermediate caching scenarios from port %d. Point the client at http://localhost:%d/, or fetch each URL listed at /urls in order,\n", len(p.scenarios), controlPort+1, controlPort)
+	fmt.Printf("then POST to /done or interrupt to write the results.\n")
+
+	select {
+	case <-p.done:
+	case <-interrupts:
+	}
+
+	return p.writeResults(*userAgent, resultsKey, *resultsPath)
+}
+
+// makeCacheScenarios pairs up the first tests of the main corpus that any
+// verifier should accept for their DNS name into scenarios, served from the
+// port after controlPort. Every test has its own intermediates, so a client
+// can't have seen a control's chain with another test.
+func makeCacheScenarios(config *configFile, expectations *expectations, n, controlPort int) ([]*cacheScenario, error) {
+	var tests []*expectation
+	for i := range expectations.Expects {
+		if e := &expectations.Expects[i]; e.DNS.Result == "OK" && len(tests) < 2*n {
+			tests = append(tests, e)
+		}
+	}
+	if len(tests) < 2*n {
+		return nil, fmt.Errorf("the corpus has %d tests that should be accepted, too few for %d scenarios", len(tests), n)
+	}
+
+	var scenarios []*cacheScenario
+	for i := 0; i < n; i++ {
+		primedTest, controlTest := tests[2*i], tests[2*i+1]
+		s := &cacheScenario{
+			primed:      primedTest.Id,
+			control:     controlTest.Id,
+			primedHost:  config.testHostname(primedTest),
+			controlHost: config.testHostname(controlTest),
+			primedPort:  controlPort + 2*i + 1,
+			controlPort: controlPort + 2*i + 2,
+		}
+
+		var err error
+		if s.fullChain, err = loadTestCertificate(s.primed); err != nil {
+			return nil, fmt.Errorf("#%d: %s", s.primed, err)
+		}
+		control, err := loadTestCertificate(s.control)
+		if err != nil {
+			return nil, fmt.Errorf("#%d: %s", s.control, err)
+		}
+		s.primedLeaf, s.controlLeaf = leafOnly(s.fullChain), leafOnly(control)
+		scenarios = append(scenarios, s)
+	}
+	return scenarios, nil
+}
+
+// leafOnly returns cert without the certificates that follow its leaf.
+func leafOnly(cert tls.Certificate) tls.Certificate {
+	cert.Certificate = cert.Certificate[:1]
+	return cert
+}
+
+// start serves the scenarios and, on controlListener, the probe page and
+// controls.
+func (p *cacheProber) start(controlListener net.Listener) error {
+	for _, s := range p.scenarios {
+		for _, port := range []int{s.primedPort, s.controlPort} {
+			l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+			if err != nil {
+				return err
+			}
+			p.listeners = append(p.listeners, l)
+			go p.serve(s, port == s.primedPort, l)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := probePageTemplate.Execute(w, p.urls()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("/urls", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, url := range p.urls() {
+			fmt.Fprintln(w, url)
+		}
+	})
+	mux.HandleFunc("/done", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST to finish probing", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintln(w, "Probing is done; the harness is writing the results")
+		p.doneOnce.Do(func() { close(p.done) })
+	})
+	go http.Serve(controlListener, mux)
+	return nil
+}
+
+func (p *cacheProber) close() {
+	for _, l := range p.listeners {
+		l.Close()
+	}
+}
+
+// urls returns the URLs to fetch, in order: every primed test, to prime the
+// client, then every primed test again and every control.
+func (p *cacheProber) urls() []string {
+	url := func(host string, port int) string {
+		return "https://" + net.JoinHostPort(host, strconv.Itoa(port)) + "/well-known.txt"
+	}
+
+	var primed, controls []string
+	for _, s := range p.scenarios {
+		primed = append(primed, url(s.primedHost, s.primedPort))
+		controls = append(controls, url(s.controlHost, s.controlPort))
+	}
+	return append(append(append([]string(nil), primed...), primed...), controls...)
+}
+
+func (p *cacheProber) serve(s *cacheScenario, primed bool, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(s, primed, conn)
+	}
+}
+
+// handle serves conn the primed test's full chain or leaf, as the client's
+// state calls for, or the control's leaf, and records whether the client
+// made a request.
+func (p *cacheProber) handle(s *cacheScenario, primed bool, conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(p.timeout))
+
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	id, hostname, phase, cert := s.control, s.controlHost, cachePhaseControl, &s.controlLeaf
+	if primed {
+		id, hostname, phase, cert = s.primed, s.primedHost, cachePhaseProbe, &s.primedLeaf
+		p.lock.Lock()
+		if !p.client(host).primed[s.primed] {
+			phase, cert = cachePhasePrime, &s.fullChain
+		}
+		p.lock.Unlock()
+	}
+
+	// Without session tickets, every connection verifies the certificate
+	// afresh.
+	tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{*cert}, GetConfigForClient: p.captureHello, SessionTicketsDisabled: true})
+	err := tlsConn.Handshake()
+	if serverName := tlsConn.ConnectionState().ServerName; !strings.EqualFold(serverName, hostname) {
+		return
+	}
+	key := cacheKey{id, phase}
+	if err != nil {
+		p.record(host, key, err, "")
+		return
+	}
+	if phase == cachePhasePrime {
+		p.lock.Lock()
+		p.client(host).primed[s.primed] = true
+		p.lock.Unlock()
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(tlsConn))
+	if err != nil {
+		p.record(host, key, fmt.Errorf("the client completed the handshake but made no request: %s", err), "")
+		return
+	}
+	p.record(host, key, nil, req.UserAgent())
+	respondToProbe(tlsConn, req)
+}
+
+// client returns the state of the client at host, creating it if need be.
+// p.lock must be held.
+func (p *cacheProber) client(host string) *cacheClient {
+	client, ok := p.clients[host]
+	if !ok {
+		client = &cacheClient{primed: make(map[int]bool), outcomes: make(map[cacheKey]*probeOutcome)}
+		p.clients[host] = client
+	}
+	return client
+}
+
+// captureHello records the fingerprint of a client's ClientHello, as the
+// prober's does.
+func (p *cacheProber) captureHello(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	fingerprint := fingerprintClientHello(hello)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.hellos.add(fingerprint)
+	return nil, nil
+}
+
+func (p *cacheProber) record(host string, key cacheKey, err error, userAgent string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	client := p.client(host)
+	outcome, ok := client.outcomes[key]
+	if !ok {
+		outcome = new(probeOutcome)
+		client.outcomes[key] = outcome
+	}
+	if err != nil {
+		outcome.err = err
+		return
+	}
+	outcome.accepted = true
+	if len(client.userAgent) == 0 {
+		client.userAgent = userAgent
+		p.clientOrder = append(p.clientOrder, host)
+	}
+}
+
+// outcomeOf returns the outcome of scenario s for client, and false if it
+// wasn't probed in full.
+func (client *cacheClient) outcomeOf(s *cacheScenario) (result intermediateCacheResult, ok bool) {
+	prime, primeOK := client.outcomes[cacheKey{s.primed, cachePhasePrime}]
+	probe, probeOK := client.outcomes[cacheKey{s.primed, cachePhaseProbe}]
+	control, controlOK := client.outcomes[cacheKey{s.control, cachePhaseControl}]
+	if !primeOK || !controlOK || (prime.accepted && !probeOK) {
+		return result, false
+	}
+
+	result = intermediateCacheResult{Id: s.primed, ControlId: s.control, PrimeAccepted: prime.accepted, ControlAccepted: control.accepted}
+	if !prime.accepted {
+		result.PrimeError = errString(prime.err)
+	}
+	if probeOK {
+		result.ProbeAccepted = probe.accepted
+		if !probe.accepted {
+			result.ProbeError = errString(probe.err)
+		}
+	}
+	if !control.accepted {
+		result.ControlError = errString(control.err)
+	}
+
+	switch {
+	case !result.PrimeAccepted || result.ControlAccepted:
+		result.Outcome = cacheOutcomeInconclusive
+	case result.ProbeAccepted:
+		result.Outcome = cacheOutcomeCached
+	default:
+		result.Outcome = cacheOutcomeNotCached
+	}
+	return result, true
+}
+
+// writeResults writes the outcomes of the first client to make a request to a
+// results file, summarised as whether it cached intermediates.
+func (p *cacheProber) writeResults(userAgent string, resultsKey ed25519.PrivateKey, path string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.clientOrder) == 0 {
+		return errors.New("no client made a request, so there are no results to write")
+	}
+	client := p.clients[p.clientOrder[0]]
+	if len(p.clientOrder) > 1 {
+		fmt.Printf("%d clients made requests; only the results of the first, from %s, are written\n", len(p.clientOrder), p.clientOrder[0])
+	}
+	if len(userAgent) == 0 {
+		userAgent = client.userAgent
+	}
+
+	recorder := newResultRecorder(deliveryPool)
+	recorder.setSigningKey(resultsKey)
+	recorder.userAgent = userAgent
+	recorder.setClientHellos(p.hellos.list())
+	recorder.setImplementation(userAgent, "")
+
+	var numProbed int
+	seen := make(map[string]bool)
+	for _, s := range p.scenarios {
+		result, ok := client.outcomeOf(s)
+		if !ok {
+			continue
+		}
+		numProbed++
+		recorder.recordIntermediateCache(result)
+		seen[result.Outcome] = true
+		fmt.Printf("#%d, with control #%d: %s\n", s.primed, s.control, result.Outcome)
+	}
+
+	var summary string
+	switch {
+	case seen[cacheOutcomeCached] && seen[cacheOutcomeNotCached]:
+		summary = cacheOutcomeMixed
+	case seen[cacheOutcomeCached]:
+		summary = cacheOutcomeCached
+	case seen[cacheOutcomeNotCached]:
+		summary = cacheOutcomeNotCached
+	case seen[cacheOutcomeInconclusive]:
+		summary = cacheOutcomeInconclusive
+	}
+	recorder.setIntermediateCaching(summary)
+
+	if err := recorder.write(path, p.config.TestVersion); err != nil {
+		return err
+	}
+
+	fmt.Printf("Probed %d of %d scenarios; intermediate caching: %s; results written to %s\n", numProbed, len(p.scenarios), summary, path)
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ipLiteralExpectations represents ipLiteralExpects.json, which
+// defineExpects.js generates when the optional IP literal corpus is present.
+type ipLiteralExpectations struct {
+	Expects []ipLiteralExpectation
+}
+
+type ipLiteralExpectation struct {
+	Id int `json:"id"`
+	// Hostname is the IP literal, in the form under test, to verify the
+	// certificate against.
+	Hostname string `json:"hostname"`
+	// SANIP is the address in the certificate's iPAddress SAN.
+	SANIP string `json:"sanIp"`
+	// Form names the textual form of Hostname, e.g. "leadingZeros".
+	Form string `json:"form"`
+	expectedResult
+}
+
+// runIPLiteralTests runs the IP literal tests and returns the number of tests
+// run and the number of failures. The outcome of each test is recorded with
+// recorder, so that verifiers' normalization of IP literals can be compared
+// even where the expectation is WEAK-OK. It does nothing if the IP literal
+// corpus hasn't been generated.
+func runIPLiteralTests(recorder *resultRecorder) (numTests, numFailures int, err error) {
+	if !profile.runsOptionalCorpus("ipLiteral") {
+		return 0, 0, nil
+	}
+
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(baseDir, "html", "ipLiteralExpects.json"))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	expectations := new(ipLiteralExpectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return 0, 0, err
+	}
+
+	ipLiteralDir := filepath.Join(baseDir, "certificates", "ipliteral")
+	rootChain, err := readPEMChain(filepath.Join(ipLiteralDir, "root.crt"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rootPool := x509.NewCertPool()
+	for _, root := range rootChain {
+		rootPool.AddCert(root)
+	}
+
+	for _, test := range expectations.Expects {
+		// Go treats a hostname that parses as an IP address as one, so
+		// the IP literal is given as the hostname.
+		verifyErr := verifyHostname(filepath.Join(ipLiteralDir, strconv.Itoa(test.Id)), test.Hostname, rootPool)
+		recorder.recordIPLiteral(&test, verifyErr)
+
+		var failure error
+		switch test.Result {
+		case "OK":
+			failure = verifyErr
+		case "WEAK-OK":
+		case "ERROR":
+			if verifyErr == nil {
+				failure = fmt.Errorf("certificate was accepted")
+			}
+		default:
+			failure = fmt.Errorf("unknown expected result %q", test.Result)
+		}
+
+		if failure != nil {
+			fmt.Printf("ip literal #%d (%s, %q): failed:\n  %q\n", test.Id, test.Form, test.Hostname, failure)
+			numFailures++
+		}
+	}
+
+	return len(expectations.Expects), numFailures, nil
+}
@@ -0,0 +1,249 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// jobVerifiers are the verifiers that a job can run, each of which writes a
+// results file to the given path. They return an error if any test failed,
+// as well as if they couldn't be run.
+var jobVerifiers = map[string]func(resultsPath string, args []string) error{
+	"go": func(resultsPath string, args []string) error {
+		return runTests(append([]string{"-results", resultsPath}, args...))
+	},
+	"openssl": func(resultsPath string, args []string) error {
+		return runOpenSSL(append([]string{"-results", resultsPath}, args...))
+	},
+	"nss": func(resultsPath string, args []string) error {
+		return runNSS(append([]string{"-results", resultsPath}, args...))
+	},
+	"gnutls": func(resultsPath string, args []string) error {
+		return runGnuTLS(append([]string{"-results", resultsPath}, args...))
+	},
+}
+
+// jobSummary is written alongside a job's results, recording how each
+// verifier fared.
+type jobSummary struct {
+	RunID     string                      `json:"runId"`
+	CorpusURL string                      `json:"corpusUrl,omitempty"`
+	Verifiers map[string]jobVerifierState `json:"verifiers"`
+}
+
+type jobVerifierState struct {
+	// Results is the name of the results file, if one was written.
+	Results string `json:"results,omitempty"`
+	// Error is why the verifier failed, e.g. because tests failed.
+	Error string `json:"error,omitempty"`
+}
+
+// runJob implements the job command, which is meant to be run as a
+// Kubernetes Job or other scheduled container. It takes its configuration
+// from the environment:
+//
+//	BETTERTLS_CORPUS_URL   an optional s3://, gs:// or http(s):// URL of a
+//	                       .tar.gz holding config.json, html/expects.json
+//	                       and certificates/, extracted over the repo
+//	BETTERTLS_VERIFIERS    a comma-separated list of verifiers to run, from
+//	                       "go", "openssl", "nss" and "gnutls"; "go" by
+//	                       default
+//	BETTERTLS_ARGS_<NAME>  extra flags for a verifier, e.g. BETTERTLS_ARGS_GO
+//	BETTERTLS_RESULTS_URL  the s3:// or gs:// prefix to write results under
+//
+// Each verifier's results, a report and a summary are written under a
+// prefix named for the time of the run. Failing tests are recorded in the
+// summary rather than failing the job, so that it isn't retried for them.
+func runJob(args []string) error {
+	if len(args) > 0 {
+		return errors.New("the job command is configured by environment variables, not flags")
+	}
+
+	resultsURL, err := url.Parse(os.Getenv("BETTERTLS_RESULTS_URL"))
+	if err != nil {
+		return err
+	}
+	if resultsURL.Scheme != "s3" && resultsURL.Scheme != "gs" {
+		return errors.New("BETTERTLS_RESULTS_URL must be an s3:// or gs:// URL")
+	}
+	store, err := objectStoreFromEnv(resultsURL.Scheme)
+	if err != nil {
+		return err
+	}
+
+	verifiers := strings.Split(os.Getenv("BETTERTLS_VERIFIERS"), ",")
+	if len(os.Getenv("BETTERTLS_VERIFIERS")) == 0 {
+		verifiers = []string{"go"}
+	}
+	for _, name := range verifiers {
+		if _, ok := jobVerifiers[name]; !ok {
+			return fmt.Errorf("unknown verifier %q in BETTERTLS_VERIFIERS", name)
+		}
+	}
+
+	summary := &jobSummary{
+		RunID:     time.Now().UTC().Format("20060102T150405Z"),
+		CorpusURL: os.Getenv("BETTERTLS_CORPUS_URL"),
+		Verifiers: make(map[string]jobVerifierState),
+	}
+
+	if len(summary.CorpusURL) > 0 {
+		fmt.Printf("Fetching the corpus from %s\n", summary.CorpusURL)
+		archive, err := fetchURL(summary.CorpusURL)
+		if err != nil {
+			return err
+		}
+		if err := extractCorpus(archive, baseDir); err != nil {
+			return err
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "bettertls-job")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	var resultsPaths []string
+	for _, name := range verifiers {
+		fmt.Printf("Running the %s verifier\n", name)
+		resultsPath := filepath.Join(dir, name+".json")
+		verifierArgs := strings.Fields(os.Getenv("BETTERTLS_ARGS_" + strings.ToUpper(name)))
+
+		var state jobVerifierState
+		if err := jobVerifiers[name](resultsPath, verifierArgs); err != nil {
+			state.Error = err.Error()
+		}
+		if _, err := os.Stat(resultsPath); err == nil {
+			state.Results = name + ".json"
+			resultsPaths = append(resultsPaths, resultsPath)
+		} else if len(state.Error) == 0 {
+			state.Error = "no results were written"
+		}
+		summary.Verifiers[name] = state
+	}
+
+	uploads := map[string]string{}
+	for _, path := range resultsPaths {
+		uploads[filepath.Base(path)] = "application/json"
+	}
+
+	if len(resultsPaths) > 0 {
+		// The report links to the certificates of the corpus, which
+		// aren't uploaded, so those links only work for readers with a
+		// copy of it.
+		if err := exportReport(append([]string{"-o", filepath.Join(dir, "report.html")}, resultsPaths...)); err != nil {
+			return err
+		}
+		uploads["report.html"] = "text/html; charset=utf-8"
+	}
+
+	summaryBytes, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "summary.json"), summaryBytes, 0644); err != nil {
+		return err
+	}
+	uploads["summary.json"] = "application/json"
+
+	prefix := strings.Trim(resultsURL.Path, "/")
+	if len(prefix) > 0 {
+		prefix += "/"
+	}
+	prefix += summary.RunID + "/"
+
+	for name, contentType := range uploads {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if err := store.putObject(resultsURL.Host, prefix+name, contentType, contents); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s://%s/%s%s\n", resultsURL.Scheme, resultsURL.Host, prefix, name)
+	}
+
+	for _, name := range verifiers {
+		if state := summary.Verifiers[name]; len(state.Results) == 0 {
+			return fmt.Errorf("the %s verifier couldn't be run: %s", name, state.Error)
+		}
+	}
+	return nil
+}
+
+// maxCorpusEntrySize is the largest file that a corpus archive may hold.
+// expects.json and manifest.json are a few megabytes.
+const maxCorpusEntrySize = 64 << 20
+
+// extractCorpus extracts a .tar.gz of corpus files into dir, refusing any
+// entry that would be written outside it.
+func extractCorpus(archive []byte, dir string) error {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("the corpus archive has an entry outside its root, %q", header.Name)
+		}
+		path := filepath.Join(dir, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			contents, err := ioutil.ReadAll(io.LimitReader(tr, maxCorpusEntrySize+1))
+			if err != nil {
+				return err
+			}
+			if len(contents) > maxCorpusEntrySize {
+				return fmt.Errorf("%s in the corpus archive is larger than the limit of %d bytes", header.Name, maxCorpusEntrySize)
+			}
+			if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// keyUsageExpectations represents keyUsageExpects.json, which defineExpects.js
+// generates when the optional key usage corpus is present.
+type keyUsageExpectations struct {
+	Expects []keyUsageExpectation
+}
+
+type keyUsageExpectation struct {
+	Id int `json:"id"`
+	// Name identifies the case, e.g. "intermediateNoKeyCertSign".
+	Name string `json:"name"`
+	// Component is the certificate whose key usage the case tests:
+	// "intermediate", "leaf", "crlSigner" or "none".
+	Component string `json:"component"`
+	// KeyExchange is the TLS key exchange that the leaf's key is used
+	// for, "ECDHE_RSA" or "RSA", and CRL is whether the leaf's revocation
+	// is checked against the CRL in its .crl file. Together they're the
+	// intended usage passed to the verifier.
+	KeyExchange string `json:"keyExchange"`
+	CRL         bool   `json:"crl"`
+	// IssuerKeyUsage and LeafKeyUsage name the bits of the intermediate's
+	// and the leaf's key usage, and are nil if it has no extension.
+	IssuerKeyUsage []string `json:"issuerKeyUsage"`
+	LeafKeyUsage   []string `json:"leafKeyUsage"`
+	expectedResult
+}
+
+// intendedUsage is what a key usage test's keys are used for, which decides
+// which key usage bits they need.
+type intendedUsage struct {
+	// keyExchange is the TLS key exchange: "ECDHE_RSA", for which the leaf
+	// needs digitalSignature, or "RSA", for which it needs
+	// keyEncipherment.
+	keyExchange string
+	// crl, if set, is a CRL issued by the leaf's issuer, which must have
+	// cRLSign, to check the leaf's revocation against.
+	crl *x509.RevocationList
+}
+
+// How a verifier treats a kind of key usage, recorded in results files.
+const (
+	keyUsageEnforced = "enforced"
+	keyUsageIgnored  = "ignored"
+	keyUsageMixed    = "mixed"
+	// keyUsageUnsupported is recorded as each result's status when the
+	// verifier can't be given the intended usage, and the tests weren't
+	// run.
+	keyUsageUnsupported = "UNSUPPORTED"
+)
+
+// keyUsageVerifier is implemented by verifiers that can be told what the
+// keys in a chain will be used for.
+type keyUsageVerifier interface {
+	// verifyForUsage is like platformVerifier's verify, but also checks
+	// that each certificate's key may be used as usage intends.
+	verifyForUsage(leaf *x509.Certificate, intermediates []*x509.Certificate, dnsName string, usage *intendedUsage) error
+}
+
+// goKeyUsageVerifier passes the intended usage to crypto/x509 as a TLS client
+// would. Verify checks intermediates for keyCertSign, and the CRL signer's
+// cRLSign is checked by RevocationList.CheckSignatureFrom, but crypto/tls has
+// no way to check the leaf's key usage against the key exchange, so that part
+// of the usage goes unused.
+type goKeyUsageVerifier struct {
+	roots *x509.CertPool
+}
+
+func (v *goKeyUsageVerifier) verifyForUsage(leaf *x509.Certificate, intermediates []*x509.Certificate, dnsName string, usage *intendedUsage) error {
+	intermediatePool := x509.NewCertPool()
+	for _, intermediate := range intermediates {
+		intermediatePool.AddCert(intermediate)
+	}
+
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       dnsName,
+		Roots:         v.roots,
+		Intermediates: intermediatePool,
+	})
+	if err != nil {
+		return err
+	}
+	if usage.crl == nil {
+		return nil
+	}
+	return checkRevocation(chains[0], usage.crl)
+}
+
+// checkRevocation checks the leaf of chain against crl, which must be issued
+// by the leaf's issuer.
+func checkRevocation(chain []*x509.Certificate, crl *x509.RevocationList) error {
+	if len(chain) < 2 {
+		return errors.New("the leaf has no issuer to check the CRL with")
+	}
+	leaf, issuer := chain[0], chain[1]
+	if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) {
+		return errors.New("the CRL wasn't issued by the leaf's issuer")
+	}
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		return fmt.Errorf("the CRL can't be used: %v", err)
+	}
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+			return errors.New("the leaf has been revoked")
+		}
+	}
+	return nil
+}
+
+// runKeyUsageTests runs the key usage tests, which verify chains whose
+// certificates' key usage may not permit what their keys are used for, passing
+// each test's intended usage to the verifier, and returns the number of tests
+// run and the number of failures. It records the outcome of each test with
+// recorder, along with which kinds of key usage the verifier enforced. With
+// -implementation=platform, the tests are only run on a platform whose
+// verifier implements keyUsageVerifier; otherwise each is recorded as
+// UNSUPPORTED, and none fail. It does nothing if the key usage corpus hasn't
+// been generated.
+func runKeyUsageTests(hostname string, recorder *resultRecorder) (numTests, numFailures int, err error) {
+	if !profile.runsOptionalCorpus("keyUsage") {
+		return 0, 0, nil
+	}
+
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(baseDir, "html", "keyUsageExpects.json"))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	expectations := new(keyUsageExpectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return 0, 0, err
+	}
+
+	keyUsageDir := filepath.Join(baseDir, "certificates", "keyusage")
+	rootChain, err := readPEMChain(filepath.Join(keyUsageDir, "root.crt"))
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(rootChain) != 1 {
+		return 0, 0, fmt.Errorf("expected a single root in keyusage/root.crt but found %d", len(rootChain))
+	}
+
+	var verifier keyUsageVerifier
+	if platform != nil {
+		keyUsagePlatform, err := loadPlatform(rootChain[0])
+		if err != nil {
+			return 0, 0, err
+		}
+		defer keyUsagePlatform.close()
+		verifier, _ = keyUsagePlatform.(keyUsageVerifier)
+	} else {
+		roots := x509.NewCertPool()
+		roots.AddCert(rootChain[0])
+		verifier = &goKeyUsageVerifier{roots: roots}
+	}
+
+	if verifier == nil {
+		for _, test := range expectations.Expects {
+			recorder.recordKeyUsage(&test, keyUsageUnsupported, nil)
+		}
+		fmt.Printf("Key usage: %s (%d tests not run)\n", keyUsageUnsupported, len(expectations.Expects))
+		return len(expectations.Expects), 0, nil
+	}
+
+	// enforcement holds, for each component, whether each test that it
+	// should have rejected was rejected.
+	enforcement := make(map[string]map[string]bool)
+	for _, test := range expectations.Expects {
+		verifyErr := verifyKeyUsage(verifier, filepath.Join(keyUsageDir, strconv.Itoa(test.Id)), hostname, &test)
+		accepted := verifyErr == nil
+		recorder.recordKeyUsage(&test, "", verifyErr)
+
+		if test.Result == "ERROR" {
+			if enforcement[test.Component] == nil {
+				enforcement[test.Component] = make(map[string]bool)
+			}
+			if accepted {
+				enforcement[test.Component][keyUsageIgnored] = true
+			} else {
+				enforcement[test.Component][keyUsageEnforced] = true
+			}
+		}
+
+		if passed, description := classifyResult(test.Result, accepted); !passed {
+			fmt.Printf("key usage #%d (%s, %s%s): %s%s\n", test.Id, test.Name, test.KeyExchange, crlSuffix(test.CRL), description, errorSuffix(errString(verifyErr)))
+			numFailures++
+		}
+	}
+
+	var components []string
+	for component := range enforcement {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+
+	for _, component := range components {
+		behaviour := keyUsageMixed
+		switch {
+		case !enforcement[component][keyUsageIgnored]:
+			behaviour = keyUsageEnforced
+		case !enforcement[component][keyUsageEnforced]:
+			behaviour = keyUsageIgnored
+		}
+		recorder.setKeyUsageEnforcement(component, behaviour)
+		fmt.Printf("Key usage of %s: %s\n", component, behaviour)
+	}
+
+	return len(expectations.Expects), numFailures, nil
+}
+
+func crlSuffix(crl bool) string {
+	if crl {
+		return ", checking the CRL"
+	}
+	return ""
+}
+
+// verifyKeyUsage verifies the chain at pathPrefix with verifier, for the
+// intended usage that test gives.
+func verifyKeyUsage(verifier keyUsageVerifier, pathPrefix, hostname string, test *keyUsageExpectation) error {
+	leaf, err := readPEMChain(pathPrefix + ".crt")
+	if err != nil {
+		return err
+	}
+	if len(leaf) != 1 {
+		return fmt.Errorf("expected a single certificate in the .crt file, but found %d", len(leaf))
+	}
+
+	chain, err := readPEMChain(pathPrefix + ".chain")
+	if err != nil {
+		return err
+	}
+
+	usage := &intendedUsage{keyExchange: test.KeyExchange}
+	if test.CRL {
+		if usage.crl, err = readPEMCRL(pathPrefix + ".crl"); err != nil {
+			return err
+		}
+	}
+
+	return verifier.verifyForUsage(leaf[0], chain, hostname, usage)
+}
+
+// readPEMCRL reads the single PEM CRL at path.
+func readPEMCRL(path string) (*x509.RevocationList, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "X509 CRL" {
+		return nil, fmt.Errorf("%s doesn't hold a PEM CRL", path)
+	}
+	return x509.ParseRevocationList(block.Bytes)
+}
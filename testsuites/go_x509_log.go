@@ -0,0 +1,76 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// logLevelUsage and logFormatUsage are the usages of the -log-level and
+// -log-format flags of the commands that run the main corpus.
+const (
+	logLevelUsage  = "The lowest level of message to log: \"debug\", which traces every verification, \"info\", \"warn\", which includes each failed test, or \"error\""
+	logFormatUsage = "The format to log in: \"text\", as key=value pairs, or \"json\", as a JSON object per line"
+)
+
+// logger logs the outcome of each test as the workers run them: failures at
+// warn level and, at debug level, every verification and skip. It writes to
+// stdout, where the run's summary is printed, and is set up by selectLogger.
+var logger = newLogger(os.Stdout, slog.LevelInfo, "text")
+
+// selectLogger sets logger to log messages of at least the named level in
+// the named format.
+func selectLogger(level, format string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	logger = newLogger(os.Stdout, l, format)
+	return nil
+}
+
+func newLogger(f *os.File, level slog.Level, format string) *slog.Logger {
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(f, &slog.HandlerOptions{Level: level}))
+	}
+	// Times are left out of text logs, which are read by people as the
+	// run goes, so that the logs of two runs can be diffed.
+	return slog.New(slog.NewTextHandler(f, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+}
+
+// traceVerification logs, at debug level, the outcome of verifying test's
+// chain for name.
+func traceVerification(test *expectation, name string, err error, elapsed time.Duration) {
+	logger.Debug("test verified", "id", test.Id, "type", test.testType(), "name", name, "accepted", err == nil, "error", errString(err), "elapsed", elapsed)
+}
+
+// traceSkip logs, at debug level, that test was skipped and why.
+func traceSkip(test *expectation, reason *skip) {
+	logger.Debug("test skipped", "id", test.Id, "type", test.testType(), "category", string(reason.Category), "detail", reason.Detail)
+}
@@ -0,0 +1,146 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// The stages at which a certificate can be rejected, which are recorded in
+// results files.
+const (
+	stageParse  = "parse"
+	stageVerify = "verify"
+)
+
+// malformedExpectations represents malformedExpects.json, which
+// defineExpects.js generates when the optional malformed certificate corpus
+// is present.
+type malformedExpectations struct {
+	Expects []malformedExpectation
+}
+
+type malformedExpectation struct {
+	Id int `json:"id"`
+	// Rule is the rule that the certificate breaks, or empty for the
+	// well-formed certificates included for comparison.
+	Rule string `json:"rule"`
+	expectedResult
+}
+
+// runMalformedTests runs the malformed certificate tests, verifying each
+// against hostname, and returns the number of tests run and the number of
+// failures. The outcome of each test is recorded with recorder. It does
+// nothing if the malformed corpus hasn't been generated.
+func runMalformedTests(hostname string, recorder *resultRecorder) (numTests, numFailures int, err error) {
+	if !profile.runsOptionalCorpus("malformed") {
+		return 0, 0, nil
+	}
+
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(baseDir, "html", "malformedExpects.json"))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	expectations := new(malformedExpectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return 0, 0, err
+	}
+
+	malformedDir := filepath.Join(baseDir, "certificates", "malformed")
+	rootChain, err := readPEMChain(filepath.Join(malformedDir, "root.crt"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rootPool := x509.NewCertPool()
+	for _, root := range rootChain {
+		rootPool.AddCert(root)
+	}
+
+	// stages counts the tests by the stage at which they were rejected,
+	// with "" for those that were accepted.
+	stages := make(map[string]int)
+	for _, test := range expectations.Expects {
+		stage, verifyErr := verifyMalformed(filepath.Join(malformedDir, strconv.Itoa(test.Id)), hostname, rootPool)
+		recorder.recordMalformed(&test, stage, verifyErr)
+		stages[stage]++
+
+		var failure error
+		switch test.Result {
+		case "OK":
+			failure = verifyErr
+		case "WEAK-OK":
+		case "ERROR":
+			if verifyErr == nil {
+				failure = fmt.Errorf("malformed certificate was accepted")
+			}
+		default:
+			failure = fmt.Errorf("unknown expected result %q", test.Result)
+		}
+
+		if failure != nil {
+			fmt.Printf("malformed #%d: failed:\n  %q\n", test.Id, failure)
+			numFailures++
+		}
+	}
+
+	fmt.Printf("Malformed certificates: %d rejected while parsing, %d while verifying, %d accepted\n", stages[stageParse], stages[stageVerify], stages[""])
+
+	return len(expectations.Expects), numFailures, nil
+}
+
+// verifyMalformed parses and verifies the certificate at pathPrefix + ".crt",
+// with the intermediates at pathPrefix + ".chain". If it's rejected, stage
+// says whether that was while parsing or verifying.
+func verifyMalformed(pathPrefix, hostname string, rootPool *x509.CertPool) (stage string, err error) {
+	chain, err := readPEMChain(pathPrefix + ".chain")
+	if err != nil {
+		return stageParse, err
+	}
+
+	leaf, err := readPEMChain(pathPrefix + ".crt")
+	if err != nil {
+		return stageParse, err
+	}
+
+	if len(leaf) != 1 {
+		return stageParse, fmt.Errorf("expected a single certificate in the .crt file, but found %d", len(leaf))
+	}
+
+	intermediatePool := x509.NewCertPool()
+	for _, intermediate := range chain {
+		intermediatePool.AddCert(intermediate)
+	}
+
+	if _, err := leaf[0].Verify(x509.VerifyOptions{
+		DNSName:       hostname,
+		Roots:         rootPool,
+		Intermediates: intermediatePool,
+	}); err != nil {
+		return stageVerify, err
+	}
+
+	return "", nil
+}
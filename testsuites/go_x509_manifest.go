@@ -0,0 +1,150 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+)
+
+// manifest represents certificates/manifest.json, which is written by the
+// generator.
+type manifest struct {
+	CorpusVersion   int    `json:"corpusVersion"`
+	GeneratorCommit string `json:"generatorCommit"`
+	Count           int    `json:"count"`
+	// PerTestHostnames is set when each leaf has test-N.hostname in place
+	// of the hostname recorded in CertManifest.
+	PerTestHostnames bool `json:"perTestHostnames"`
+	// Files maps the name of each file in the corpus to its hex SHA-256
+	// hash.
+	Files        map[string]string `json:"files"`
+	CertManifest []certDef         `json:"certManifest"`
+	// Profiles maps the name of each profile that only has some of the
+	// tests, such as "smoke", to their IDs. See corpusProfile.
+	Profiles map[string][]int `json:"profiles,omitempty"`
+}
+
+// certDef describes how a single test certificate was generated.
+type certDef struct {
+	Id              int      `json:"id"`
+	CommonName      *string  `json:"commonName"`
+	SANs            []string `json:"sans"`
+	NameConstraints struct {
+		Whitelist []string `json:"whitelist"`
+		Blacklist []string `json:"blacklist"`
+	} `json:"nameConstraints"`
+	// Target is the hostname and IP that the test is verified against, if
+	// it has its own.
+	Target *verificationTarget `json:"target,omitempty"`
+}
+
+func loadManifest() (*manifest, error) {
+	f, err := openCorpusFile(filepath.Join(certificatesDir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	manifestBytes, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := new(manifest)
+	if err := json.Unmarshal(manifestBytes, ret); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// verify checks that the corpus on disk matches the manifest and that the
+// expectations were derived from a corpus of the same size, so that stale or
+// partially regenerated corpora are detected before running any tests.
+func (m *manifest) verify(expectations *expectations) error {
+	if m.Files == nil {
+		return errors.New("manifest.json has no file hashes; the corpus was generated by an older generator and should be regenerated")
+	}
+
+	if m.Count != len(m.CertManifest) {
+		return fmt.Errorf("manifest.json lists %d certificates but has a count of %d", len(m.CertManifest), m.Count)
+	}
+
+	if len(expectations.Expects) != m.Count {
+		return fmt.Errorf("expects.json has %d expectations but the corpus has %d certificates; run defineExpects.js again", len(expectations.Expects), m.Count)
+	}
+
+	// Tests with targets of their own would otherwise be verified against
+	// the configured names by expectations from an older defineExpects.js.
+	targets := make(map[int]verificationTarget)
+	for _, def := range m.CertManifest {
+		if def.Target != nil {
+			targets[def.Id] = *def.Target
+		}
+	}
+	for _, e := range expectations.Expects {
+		var target verificationTarget
+		if e.Target != nil {
+			target = *e.Target
+		}
+		if target != targets[e.Id] {
+			return fmt.Errorf("test #%d has a different target in expects.json than in the corpus; run defineExpects.js again", e.Id)
+		}
+	}
+
+	var names []string
+	for name := range m.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		contents, err := readCorpusFile(filepath.Join(certificatesDir, name))
+		if err != nil {
+			return fmt.Errorf("corpus is incomplete: %s", err)
+		}
+
+		digest := sha256.Sum256(contents)
+		if hex.EncodeToString(digest[:]) != m.Files[name] {
+			return fmt.Errorf("corpus doesn't match manifest.json: %s has changed", name)
+		}
+	}
+
+	return nil
+}
+
+// mentions returns whether name is the common name or a SAN of any
+// certificate in the corpus.
+func (m *manifest) mentions(name string) bool {
+	for _, def := range m.CertManifest {
+		if def.CommonName != nil && *def.CommonName == name {
+			return true
+		}
+		for _, san := range def.SANs {
+			if san == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
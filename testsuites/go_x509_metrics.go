@@ -0,0 +1,120 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// serverMetrics counts what the serve command has done since it started, for
+// GET /metrics, so that a long-lived instance can be monitored with
+// Prometheus.
+type serverMetrics struct {
+	sync.Mutex
+	// testCasesServed counts the test chains served.
+	testCasesServed int
+	// resultsReceived counts the results files saved, by implementation.
+	resultsReceived map[string]int
+	// verifications counts the verifications in the results files saved,
+	// by implementation and whether they met their expectation.
+	verifications map[verificationKey]int
+}
+
+type verificationKey struct {
+	implementation string
+	passed         bool
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{resultsReceived: make(map[string]int), verifications: make(map[verificationKey]int)}
+}
+
+func (m *serverMetrics) testCaseServed() {
+	m.Lock()
+	defer m.Unlock()
+	m.testCasesServed++
+}
+
+// resultsSaved counts a results file saved for implementation, grading each of
+// its verifications against expects, which maps test IDs to expectations.
+func (m *serverMetrics) resultsSaved(implementation string, results *resultsFile, expects map[int]*expectation) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.resultsReceived[implementation]++
+	for i := range results.Results {
+		result := &results.Results[i]
+		e, ok := expects[result.Id]
+		if !ok {
+			continue
+		}
+		for _, testDNS := range []bool{true, false} {
+			accepted, ran, _ := result.result(testDNS)
+			if !ran {
+				continue
+			}
+			expect := &e.IP
+			if testDNS {
+				expect = &e.DNS
+			}
+			passed, _ := gradeResult(expect, accepted, result.reason(testDNS))
+			m.verifications[verificationKey{implementation, passed}]++
+		}
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format. Implementation
+// labels need no escaping, since uploads are limited to validTag.
+func (m *serverMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintf(w, "# HELP bettertls_testcases_served_total Test chains served.\n")
+	fmt.Fprintf(w, "# TYPE bettertls_testcases_served_total counter\n")
+	fmt.Fprintf(w, "bettertls_testcases_served_total %d\n", m.testCasesServed)
+
+	var implementations []string
+	for implementation := range m.resultsReceived {
+		implementations = append(implementations, implementation)
+	}
+	sort.Strings(implementations)
+
+	fmt.Fprintf(w, "# HELP bettertls_results_received_total Results files saved, by implementation.\n")
+	fmt.Fprintf(w, "# TYPE bettertls_results_received_total counter\n")
+	for _, implementation := range implementations {
+		fmt.Fprintf(w, "bettertls_results_received_total{implementation=%q} %d\n", implementation, m.resultsReceived[implementation])
+	}
+
+	fmt.Fprintf(w, "# HELP bettertls_verifications_total Verifications in the results files saved, by implementation and whether they met their expectation.\n")
+	fmt.Fprintf(w, "# TYPE bettertls_verifications_total counter\n")
+	for _, implementation := range implementations {
+		for _, outcome := range []struct {
+			name   string
+			passed bool
+		}{{"pass", true}, {"fail", false}} {
+			fmt.Fprintf(w, "bettertls_verifications_total{implementation=%q,outcome=%q} %d\n", implementation, outcome.name, m.verifications[verificationKey{implementation, outcome.passed}])
+		}
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nssErrorCodes names the SEC error codes that vfychain reports, so that its
+// errors can be classified with errorTaxonomy.
+var nssErrorCodes = map[int]string{
+	-8183: "SEC_ERROR_BAD_DER",
+	-8182: "SEC_ERROR_BAD_SIGNATURE",
+	-8181: "SEC_ERROR_EXPIRED_CERTIFICATE",
+	-8180: "SEC_ERROR_REVOKED_CERTIFICATE",
+	-8179: "SEC_ERROR_UNKNOWN_ISSUER",
+	-8172: "SEC_ERROR_UNTRUSTED_ISSUER",
+	-8171: "SEC_ERROR_UNTRUSTED_CERT",
+	-8162: "SEC_ERROR_EXPIRED_ISSUER_CERTIFICATE",
+	-8157: "SEC_ERROR_EXTENSION_NOT_FOUND",
+	-8156: "SEC_ERROR_CA_CERT_INVALID",
+	-8155: "SEC_ERROR_PATH_LEN_CONSTRAINT_INVALID",
+	-8151: "SEC_ERROR_UNKNOWN_CRITICAL_EXTENSION",
+	-8102: "SEC_ERROR_INADEQUATE_KEY_USAGE",
+	-8101: "SEC_ERROR_INADEQUATE_CERT_TYPE",
+	-8080: "SEC_ERROR_CERT_NOT_IN_NAME_SPACE",
+}
+
+// nssErrorName matches an NSS error name in vfychain's output, which newer
+// versions print along with the code.
+var nssErrorName = regexp.MustCompile(`\b(?:SEC|SSL)_ERROR_[A-Z_]+\b`)
+
+// nssErrorCode matches the lines in which vfychain reports an error code,
+// e.g. "ERROR -8080: The Certifying Authority for this certificate is not
+// permitted to issue a certificate with this name."
+var nssErrorCode = regexp.MustCompile(`ERROR (-\d+): ?(.*)`)
+
+var oidExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// runNSS implements the nss command, which runs the main corpus against NSS
+// by executing vfychain for each test, with the root imported into a
+// temporary NSS database by certutil, so that NSS can be measured without a
+// C harness. Both DNS and IP tests are run.
+func runNSS(args []string) error {
+	flags := flag.NewFlagSet("nss", flag.ExitOnError)
+	certutil := flags.String("certutil", "certutil", "The certutil binary to run")
+	vfychain := flags.String("vfychain", "vfychain", "The vfychain binary to run")
+	nssConfig := flags.String("nss-config", "nss-config", "The nss-config binary to run for the NSS version, which is left out of the results if it fails")
+	pkix := flags.Bool("pkix", false, "Verify with libpkix rather than NSS's classic verifier")
+	resultsPath := flags.String("results", "", "If set, the path to write a results file to")
+	resultsKeyPath := flags.String("results-key", "", resultsKeyUsage)
+	numWorkers := flags.Int("workers", defaultWorkers, workersUsage)
+	checkpointPath := flags.String("checkpoint", "", checkpointUsage)
+	profileName := flags.String("profile", "stress", profileUsage)
+	cnPolicyFlag := flags.String("cn-policy", "", cnPolicyUsage)
+	logLevel := flags.String("log-level", "info", logLevelUsage)
+	logFormat := flags.String("log-format", "text", logFormatUsage)
+	flags.Parse(args)
+
+	if err := selectProfile(*profileName); err != nil {
+		return err
+	}
+	if err := selectLogger(*logLevel, *logFormat); err != nil {
+		return err
+	}
+	if err := selectCNPolicy(*cnPolicyFlag); err != nil {
+		return err
+	}
+
+	resultsKey, err := loadResultsKey(*resultsKeyPath)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	expectations, err := loadExpectations()
+	if err != nil {
+		return err
+	}
+	numFiltered, err := profile.filter(expectations)
+	if err != nil {
+		return err
+	}
+
+	dir, err := createNSSDatabase(*certutil)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	vfychainArgs := nssVfychainArgs(dir, false)
+	recorder := newResultRecorder(deliveryPool)
+	recorder.setSigningKey(resultsKey)
+	profile.recordFiltered(recorder, numFiltered)
+	recorder.taxonomy = "nss"
+	// The names are matched by nssVerifyName, which follows NSS's own
+	// policy unless -cn-policy ignored is given.
+	recorder.setCNPolicy(cnPolicyName(cnAllowed))
+	recorder.userAgent = "NSS (vfychain)"
+	if *pkix {
+		vfychainArgs = nssVfychainArgs(dir, true)
+		recorder.userAgent = "NSS libpkix (vfychain)"
+	}
+	// vfychain can't report its version, so it's taken from nss-config,
+	// which should be from the same installation.
+	nssVersion := ""
+	if output, err := exec.Command(*nssConfig, "--version").Output(); err == nil {
+		nssVersion = strings.TrimSpace(string(output))
+	}
+	recorder.setImplementation(strings.TrimSuffix(recorder.userAgent, " (vfychain)"), nssVersion)
+	fmt.Printf("Testing %s\n", recorder.userAgent)
+
+	cp, err := openCheckpoint(*checkpointPath, recorder.userAgent, config.TestVersion)
+	if err != nil {
+		return err
+	}
+	defer cp.close()
+
+	numFailures := runPipeline(expectations.Expects, *numWorkers, cp.wrap(recorder, func(test *expectation) bool {
+		return runNSSTest(*vfychain, vfychainArgs, dir, test, config, recorder)
+	}), failureReporter(nil))
+
+	if len(*resultsPath) > 0 {
+		if err := recorder.write(*resultsPath, config.TestVersion); err != nil {
+			return err
+		}
+	}
+	if err := cp.finish(); err != nil {
+		return err
+	}
+
+	if numFailures != 0 {
+		return fmt.Errorf("failed %d of %d tests", numFailures, 2*len(expectations.Expects))
+	}
+
+	return nil
+}
+
+// createNSSDatabase creates an NSS database in a new temporary directory,
+// which the caller should remove, trusting only the corpus root.
+func createNSSDatabase(certutil string) (dir string, err error) {
+	if dir, err = ioutil.TempDir("", "bettertls-nss"); err != nil {
+		return "", err
+	}
+
+	db := "sql:" + dir
+	if output, err := exec.Command(certutil, "-N", "-d", db, "--empty-password").CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("creating an NSS database with %s: %s: %s", certutil, err, strings.TrimSpace(string(output)))
+	}
+	if output, err := exec.Command(certutil, "-A", "-d", db, "-n", "bettertls-root", "-t", "C,,", "-a", "-i", filepath.Join(certificatesDir, "root.crt")).CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("importing the root with %s: %s: %s", certutil, err, strings.TrimSpace(string(output)))
+	}
+	return dir, nil
+}
+
+// nssVfychainArgs returns the arguments that make vfychain verify chains for
+// TLS server use with the database in dir, with libpkix if pkix is set.
+func nssVfychainArgs(dir string, pkix bool) []string {
+	// -u 1 is certUsageSSLServer, and -pp selects libpkix.
+	args := []string{"-d", "sql:" + dir, "-u", "1"}
+	if pkix {
+		args = append(args, "-pp")
+	}
+	return args
+}
+
+// runNSSTest verifies the chain for test with vfychain, matches the name
+// under test and returns whether the test failed. A WEAK-OK expectation is
+// met whatever the result. The result of the verification is recorded with
+// recorder.
+func runNSSTest(vfychain string, vfychainArgs []string, dir string, test *expectation, config *configFile, recorder *resultRecorder) (failed bool) {
+	expect, name := &test.IP, config.testIP(test)
+	if test.testDNS {
+		expect, name = &test.DNS, config.testHostname(test)
+	}
+
+	verifyErr, elapsed, err := nssVerify(vfychain, vfychainArgs, dir, test.Id, name)
+	if err != nil {
+		test.err = err
+		return true
+	}
+	if cnPolicy != nil {
+		if expect, err = cnPolicy.expectation(test, test.testDNS); err != nil {
+			test.err = err
+			return true
+		}
+	}
+
+	traceVerification(test, name, verifyErr, elapsed)
+	recorder.record(test, verifyErr, elapsed)
+
+	passed, description := gradeResult(expect, verifyErr == nil, errorReasonOf(recorder.taxonomy, verifyErr))
+	if !passed {
+		test.err = fmt.Errorf("%s: %v", description, verifyErr)
+	}
+	return !passed
+}
+
+// nssVerify verifies the chain for test id with vfychain, run with
+// vfychainArgs in a temporary directory under dir, and matches name, returning
+// the error that it reported, if any, and how long vfychain took. err is set
+// if vfychain couldn't be run or timed out.
+func nssVerify(vfychain string, vfychainArgs []string, dir string, id int, name string) (verifyErr error, elapsed time.Duration, err error) {
+	leaf, err := readPEMChain(testPath(id, ".crt"))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(leaf) != 1 {
+		return nil, 0, fmt.Errorf("expected a single certificate in the .crt file, but found %d", len(leaf))
+	}
+
+	chain, err := readPEMChain(testPath(id, ".chain"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// vfychain reads a single certificate from each file, so the leaf and
+	// each intermediate are written to their own.
+	testDir, err := ioutil.TempDir(dir, "test")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.RemoveAll(testDir)
+
+	args := append([]string{}, vfychainArgs...)
+	for i, cert := range append(leaf, chain...) {
+		path := filepath.Join(testDir, strconv.Itoa(i)+".der")
+		if err := ioutil.WriteFile(path, cert.Raw, 0644); err != nil {
+			return nil, 0, err
+		}
+		args = append(args, path)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), limits.timeout)
+	defer cancel()
+
+	start := time.Now()
+	output, err := exec.CommandContext(ctx, vfychain, args...).CombinedOutput()
+	elapsed = time.Since(start)
+
+	if err != nil {
+		verifyErr = nssError(string(output), err)
+		if _, ok := err.(*exec.ExitError); !ok || ctx.Err() != nil {
+			return nil, elapsed, fmt.Errorf("running %s: %v", vfychain, verifyErr)
+		}
+	} else {
+		verifyErr = nssVerifyName(leaf[0], name)
+	}
+
+	return verifyErr, elapsed, nil
+}
+
+// nssError returns the error that vfychain reported in output, by name if
+// it's known, or runErr if it didn't report one.
+func nssError(output string, runErr error) error {
+	if name := nssErrorName.FindString(output); len(name) > 0 {
+		return errors.New(name)
+	}
+
+	match := nssErrorCode.FindStringSubmatch(output)
+	if match == nil {
+		return errors.New(strings.TrimSpace(output) + " (" + runErr.Error() + ")")
+	}
+
+	code, _ := strconv.Atoi(match[1])
+	name, ok := nssErrorCodes[code]
+	if !ok {
+		name = "SEC_ERROR_" + match[1]
+	}
+	return fmt.Errorf("%s: %s", name, match[2])
+}
+
+// nssVerifyName checks that leaf is valid for name. NSS's tools verify
+// chains but don't match names, so this follows CERT_VerifyCertName: if the
+// certificate has a subjectAltName extension then only its SANs are
+// considered, and otherwise the Common Name is. Under -cn-policy ignored,
+// the Common Name never is.
+func nssVerifyName(leaf *x509.Certificate, name string) error {
+	matched := false
+	switch ip := net.ParseIP(name); {
+	case !hasSANExtension(leaf) && (cnPolicy == nil || cnPolicy.name == cnAllowed):
+		matched = nssMatchHostname(leaf.Subject.CommonName, name)
+	case ip != nil:
+		for _, sanIP := range leaf.IPAddresses {
+			matched = matched || sanIP.Equal(ip)
+		}
+	default:
+		for _, dnsName := range leaf.DNSNames {
+			matched = matched || nssMatchHostname(dnsName, name)
+		}
+	}
+
+	if !matched {
+		return fmt.Errorf("SSL_ERROR_BAD_CERT_DOMAIN: the certificate isn't valid for %s", name)
+	}
+	return nil
+}
+
+// nssMatchHostname returns whether name matches pattern, which may have a
+// wildcard as its first label.
+func nssMatchHostname(pattern, name string) bool {
+	if strings.EqualFold(pattern, name) {
+		return true
+	}
+
+	dot := strings.IndexByte(name, '.')
+	return strings.HasPrefix(pattern, "*.") && dot > 0 && strings.EqualFold(pattern[2:], name[dot+1:])
+}
@@ -0,0 +1,275 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// opensslVerifyErrors names the X509_V_ERR codes that "openssl verify"
+// reports, as numbered since OpenSSL 3.0, so that its errors can be
+// classified with errorTaxonomy.
+var opensslVerifyErrors = map[int]string{
+	2:  "X509_V_ERR_UNABLE_TO_GET_ISSUER_CERT",
+	7:  "X509_V_ERR_CERT_SIGNATURE_FAILURE",
+	9:  "X509_V_ERR_CERT_NOT_YET_VALID",
+	10: "X509_V_ERR_CERT_HAS_EXPIRED",
+	18: "X509_V_ERR_DEPTH_ZERO_SELF_SIGNED_CERT",
+	19: "X509_V_ERR_SELF_SIGNED_CERT_IN_CHAIN",
+	20: "X509_V_ERR_UNABLE_TO_GET_ISSUER_CERT_LOCALLY",
+	21: "X509_V_ERR_UNABLE_TO_VERIFY_LEAF_SIGNATURE",
+	22: "X509_V_ERR_CERT_CHAIN_TOO_LONG",
+	23: "X509_V_ERR_CERT_REVOKED",
+	25: "X509_V_ERR_PATH_LENGTH_EXCEEDED",
+	26: "X509_V_ERR_INVALID_PURPOSE",
+	27: "X509_V_ERR_CERT_UNTRUSTED",
+	32: "X509_V_ERR_KEYUSAGE_NO_CERTSIGN",
+	34: "X509_V_ERR_UNHANDLED_CRITICAL_EXTENSION",
+	47: "X509_V_ERR_PERMITTED_VIOLATION",
+	48: "X509_V_ERR_EXCLUDED_VIOLATION",
+	49: "X509_V_ERR_SUBTREE_MINMAX",
+	51: "X509_V_ERR_UNSUPPORTED_CONSTRAINT_TYPE",
+	52: "X509_V_ERR_UNSUPPORTED_CONSTRAINT_SYNTAX",
+	53: "X509_V_ERR_UNSUPPORTED_NAME_SYNTAX",
+	62: "X509_V_ERR_HOSTNAME_MISMATCH",
+	64: "X509_V_ERR_IP_ADDRESS_MISMATCH",
+	79: "X509_V_ERR_INVALID_CA",
+}
+
+// legacyVerifyErrors names the X509_V_ERR codes that "openssl verify" reports
+// as numbered before OpenSSL 3.0, which LibreSSL, BoringSSL and AWS-LC still
+// use. Of those in opensslVerifyErrors, only X509_V_ERR_INVALID_CA differs:
+// OpenSSL 3.0 moved it from 24, which is now X509_V_ERR_NO_ISSUER_PUBLIC_KEY,
+// to 79.
+var legacyVerifyErrors = func() map[int]string {
+	codes := make(map[int]string)
+	for code, name := range opensslVerifyErrors {
+		if name != "X509_V_ERR_INVALID_CA" {
+			codes[code] = name
+		}
+	}
+	codes[24] = "X509_V_ERR_INVALID_CA"
+	return codes
+}()
+
+// opensslVerifyErrorsFor returns the table naming the X509_V_ERR codes of the
+// openssl binary that reported version, e.g. "OpenSSL 3.0.2 15 Mar 2022" or
+// "LibreSSL 3.3.6".
+func opensslVerifyErrorsFor(version string) map[int]string {
+	fields := strings.Fields(version)
+	if len(fields) < 2 {
+		return opensslVerifyErrors
+	}
+	switch fields[0] {
+	case "LibreSSL":
+		return legacyVerifyErrors
+	case "OpenSSL":
+		if major, err := strconv.Atoi(strings.SplitN(fields[1], ".", 2)[0]); err == nil && major < 3 {
+			return legacyVerifyErrors
+		}
+	}
+	return opensslVerifyErrors
+}
+
+// opensslVerifyError matches the line in which "openssl verify" reports why
+// it rejected a certificate, e.g. "error 47 at 1 depth lookup: permitted
+// subtree violation".
+var opensslVerifyError = regexp.MustCompile(`error (\d+) at (\d+) depth lookup: ?(.*)`)
+
+// runOpenSSL implements the openssl command, which runs the main corpus
+// against OpenSSL by executing "openssl verify" for each test, so that
+// OpenSSL can be measured without a C harness. Both DNS and IP tests are
+// run, with -verify_hostname and -verify_ip. LibreSSL's openssl binary can be
+// run in the same way, and its error codes are named by its own numbering.
+func runOpenSSL(args []string) error {
+	flags := flag.NewFlagSet("openssl", flag.ExitOnError)
+	binary := flags.String("openssl", "openssl", "The openssl binary to run")
+	resultsPath := flags.String("results", "", "If set, the path to write a results file to")
+	resultsKeyPath := flags.String("results-key", "", resultsKeyUsage)
+	numWorkers := flags.Int("workers", defaultWorkers, workersUsage)
+	checkpointPath := flags.String("checkpoint", "", checkpointUsage)
+	profileName := flags.String("profile", "stress", profileUsage)
+	cnPolicyFlag := flags.String("cn-policy", "", cnPolicyUsage)
+	logLevel := flags.String("log-level", "info", logLevelUsage)
+	logFormat := flags.String("log-format", "text", logFormatUsage)
+	flags.Parse(args)
+
+	if err := selectProfile(*profileName); err != nil {
+		return err
+	}
+	if err := selectLogger(*logLevel, *logFormat); err != nil {
+		return err
+	}
+	if err := selectCNPolicy(*cnPolicyFlag); err != nil {
+		return err
+	}
+
+	resultsKey, err := loadResultsKey(*resultsKeyPath)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	expectations, err := loadExpectations()
+	if err != nil {
+		return err
+	}
+	numFiltered, err := profile.filter(expectations)
+	if err != nil {
+		return err
+	}
+
+	version, err := exec.Command(*binary, "version").Output()
+	if err != nil {
+		return fmt.Errorf("running %s version: %s", *binary, err)
+	}
+
+	recorder := newResultRecorder(deliveryPool)
+	recorder.setSigningKey(resultsKey)
+	profile.recordFiltered(recorder, numFiltered)
+	recorder.taxonomy = "openssl"
+	// OpenSSL matches the Common Name if there are no DNS SANs, unless
+	// X509_CHECK_FLAG_NEVER_CHECK_SUBJECT is set, which "openssl verify"
+	// can't do.
+	recorder.setCNPolicy(cnPolicyName(cnAllowed))
+	recorder.userAgent = strings.TrimSpace(string(version))
+	// The version is e.g. "OpenSSL 3.0.2 15 Mar 2022", or "LibreSSL 3.3.6".
+	if fields := strings.Fields(recorder.userAgent); len(fields) >= 2 {
+		recorder.setImplementation(fields[0], fields[1])
+	} else {
+		recorder.setImplementation("OpenSSL", "")
+	}
+	fmt.Printf("Testing %s\n", recorder.userAgent)
+	codes := opensslVerifyErrorsFor(recorder.userAgent)
+
+	cp, err := openCheckpoint(*checkpointPath, recorder.userAgent, config.TestVersion)
+	if err != nil {
+		return err
+	}
+	defer cp.close()
+
+	numFailures := runPipeline(expectations.Expects, *numWorkers, cp.wrap(recorder, func(test *expectation) bool {
+		return runOpenSSLTest(*binary, codes, test, config, recorder)
+	}), failureReporter(nil))
+
+	if len(*resultsPath) > 0 {
+		if err := recorder.write(*resultsPath, config.TestVersion); err != nil {
+			return err
+		}
+	}
+	if err := cp.finish(); err != nil {
+		return err
+	}
+
+	if numFailures != 0 {
+		return fmt.Errorf("failed %d of %d tests", numFailures, 2*len(expectations.Expects))
+	}
+
+	return nil
+}
+
+// runOpenSSLTest verifies the certificate for test with "openssl verify",
+// whose error codes are named by codes, and returns whether the test failed. A WEAK-OK expectation is met whatever the
+// result. The result of the verification is recorded with recorder.
+func runOpenSSLTest(binary string, codes map[int]string, test *expectation, config *configFile, recorder *resultRecorder) (failed bool) {
+	expect, nameArgs := &test.IP, []string{"-verify_ip", config.testIP(test)}
+	if test.testDNS {
+		expect, nameArgs = &test.DNS, []string{"-verify_hostname", config.testHostname(test)}
+	}
+
+	verifyErr, elapsed, err := opensslVerify(binary, codes, test.Id, nameArgs)
+	if err != nil {
+		test.err = err
+		return true
+	}
+	if verifyErr == nil && test.testDNS && cnPolicy != nil && cnPolicy.name == cnIgnored {
+		leaf, err := readPEMChain(testPath(test.Id, ".crt"))
+		if err != nil {
+			test.err = err
+			return true
+		}
+		verifyErr = nameInSANs(leaf[0], config.testHostname(test), "X509_V_ERR_HOSTNAME_MISMATCH")
+	}
+	if cnPolicy != nil {
+		if expect, err = cnPolicy.expectation(test, test.testDNS); err != nil {
+			test.err = err
+			return true
+		}
+	}
+
+	traceVerification(test, nameArgs[1], verifyErr, elapsed)
+	recorder.record(test, verifyErr, elapsed)
+
+	passed, description := gradeResult(expect, verifyErr == nil, errorReasonOf(recorder.taxonomy, verifyErr))
+	if !passed {
+		test.err = fmt.Errorf("%s: %v", description, verifyErr)
+	}
+	return !passed
+}
+
+// opensslVerify verifies the certificate for test id with "openssl verify",
+// with nameArgs selecting the name to verify it for, and returns the error
+// that it reported, if any, named by codes, and how long it took. err is set if openssl
+// couldn't be run or timed out.
+func opensslVerify(binary string, codes map[int]string, id int, nameArgs []string) (verifyErr error, elapsed time.Duration, err error) {
+	args := []string{"verify", "-CAfile", filepath.Join(certificatesDir, "root.crt"), "-untrusted", testPath(id, ".chain")}
+	args = append(args, nameArgs...)
+	args = append(args, testPath(id, ".crt"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), limits.timeout)
+	defer cancel()
+
+	start := time.Now()
+	output, err := exec.CommandContext(ctx, binary, args...).CombinedOutput()
+	elapsed = time.Since(start)
+
+	if err != nil {
+		verifyErr = opensslError(string(output), err, codes)
+		if _, ok := err.(*exec.ExitError); !ok || ctx.Err() != nil {
+			return nil, elapsed, fmt.Errorf("running %s: %v", binary, verifyErr)
+		}
+	}
+	return verifyErr, elapsed, nil
+}
+
+// opensslError returns the error that "openssl verify" reported in output,
+// with its X509_V_ERR name from codes if it's known, or runErr if it didn't
+// report one.
+func opensslError(output string, runErr error, codes map[int]string) error {
+	match := opensslVerifyError.FindStringSubmatch(output)
+	if match == nil {
+		return errors.New(strings.TrimSpace(output) + " (" + runErr.Error() + ")")
+	}
+
+	code, _ := strconv.Atoi(match[1])
+	name, ok := codes[code]
+	if !ok {
+		name = "X509_V_ERR_" + match[1]
+	}
+	return fmt.Errorf("%s at depth %s: %s", name, match[2], match[3])
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// pathBuildingExpectations represents pathBuildingExpects.json, which
+// defineExpects.js generates when the optional path building corpus is
+// present.
+type pathBuildingExpectations struct {
+	Expects []pathBuildingExpectation
+}
+
+type pathBuildingExpectation struct {
+	Id int `json:"id"`
+	expectedResult
+}
+
+// runPathBuildingTests runs the path building tests, verifying each leaf
+// against hostname, and returns the number of tests run and the number of
+// failures. It does nothing if the path building corpus hasn't been
+// generated.
+func runPathBuildingTests(hostname string) (numTests, numFailures int, err error) {
+	if !profile.runsOptionalCorpus("pathBuilding") {
+		return 0, 0, nil
+	}
+
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(baseDir, "html", "pathBuildingExpects.json"))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	expectations := new(pathBuildingExpectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return 0, 0, err
+	}
+
+	pathDir := filepath.Join(baseDir, "certificates", "pathbuilding")
+	rootChain, err := readPEMChain(filepath.Join(pathDir, "root.crt"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rootPool := x509.NewCertPool()
+	for _, root := range rootChain {
+		rootPool.AddCert(root)
+	}
+
+	for _, test := range expectations.Expects {
+		if err := runPathBuildingTest(&test, pathDir, hostname, rootPool); err != nil {
+			fmt.Printf("path building #%d: failed:\n  %q\n", test.Id, err)
+			numFailures++
+		}
+	}
+
+	return len(expectations.Expects), numFailures, nil
+}
+
+// runPathBuildingTest verifies a single leaf with all of its candidate
+// intermediates and returns an error if the result doesn't match the
+// expectation.
+func runPathBuildingTest(test *pathBuildingExpectation, pathDir, hostname string, rootPool *x509.CertPool) error {
+	candidates, err := readPEMChain(filepath.Join(pathDir, strconv.Itoa(test.Id)+".chain"))
+	if err != nil {
+		return err
+	}
+
+	leaf, err := readPEMChain(filepath.Join(pathDir, strconv.Itoa(test.Id)+".crt"))
+	if err != nil {
+		return err
+	}
+
+	if len(leaf) != 1 {
+		return fmt.Errorf("expected a single certificate in the .crt file, but found %d", len(leaf))
+	}
+
+	intermediatePool := x509.NewCertPool()
+	for _, candidate := range candidates {
+		intermediatePool.AddCert(candidate)
+	}
+
+	_, err = leaf[0].Verify(x509.VerifyOptions{
+		DNSName:       hostname,
+		Roots:         rootPool,
+		Intermediates: intermediatePool,
+	})
+
+	switch test.Result {
+	case "ERROR":
+		if err == nil {
+			return fmt.Errorf("no valid path exists, but the certificate was accepted")
+		}
+	case "OK":
+		if err != nil {
+			return fmt.Errorf("a valid path exists, but verification failed: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown expected result %q", test.Result)
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// testPlan describes the tests that a run would perform, for the -dry-run
+// flags.
+type testPlan struct {
+	Hostname       string        `json:"hostname"`
+	IP             string        `json:"ip"`
+	Root           string        `json:"root"`
+	Workers        int           `json:"workers"`
+	MaxFileSize    int64         `json:"maxFileSize"`
+	MaxChainLength int           `json:"maxChainLength"`
+	Timeout        string        `json:"timeout"`
+	Tests          []plannedTest `json:"tests"`
+}
+
+type plannedTest struct {
+	Id     int    `json:"id"`
+	Type   string `json:"type"`
+	Expect string `json:"expect"`
+	// Name is the name that the certificate is verified against.
+	Name  string `json:"name"`
+	Leaf  string `json:"leaf"`
+	Chain string `json:"chain"`
+	// Skip, if not nil, is the reason that the test won't be run.
+	Skip *skip `json:"skip,omitempty"`
+}
+
+func makeTestPlan(expectations *expectations, config *configFile, numWorkers int) *testPlan {
+	plan := &testPlan{
+		Hostname:       config.Hostname,
+		IP:             config.IP,
+		Root:           filepath.Join(baseDir, "certificates", "root.crt"),
+		Workers:        numWorkers,
+		MaxFileSize:    limits.maxFileSize,
+		MaxChainLength: limits.maxChainLength,
+		Timeout:        limits.timeout.String(),
+	}
+
+	for _, test := range expectations.Expects {
+		for _, testDNS := range []bool{true, false} {
+			test.testDNS = testDNS
+			planned := plannedTest{
+				Id:    test.Id,
+				Type:  "IP",
+				Name:  config.testIP(&test),
+				Leaf:  testPath(test.Id, ".crt"),
+				Chain: testPath(test.Id, ".chain"),
+				Skip:  verifierCaps.skipReason(&test),
+			}
+			planned.Expect = test.IP.Result
+			if testDNS {
+				planned.Type = "DNS"
+				planned.Name = config.testHostname(&test)
+				planned.Expect = test.DNS.Result
+			}
+			plan.Tests = append(plan.Tests, planned)
+		}
+	}
+
+	return plan
+}
+
+func (p *testPlan) print() {
+	fmt.Printf("Root: %s\n", p.Root)
+	fmt.Printf("Workers: %d, timeout: %s, max file size: %d, max chain length: %d\n", p.Workers, p.Timeout, p.MaxFileSize, p.MaxChainLength)
+
+	numRun := 0
+	for _, test := range p.Tests {
+		if test.Skip != nil {
+			fmt.Printf("#%d %s: skip, %s (%s)\n", test.Id, test.Type, test.Skip.Category, test.Skip.Detail)
+			continue
+		}
+		numRun++
+		fmt.Printf("#%d %s: verify %s with chain %s against %q, expecting %s\n", test.Id, test.Type, test.Leaf, test.Chain, test.Name, test.Expect)
+	}
+
+	fmt.Printf("%d of %d tests would be run\n", numRun, len(p.Tests))
+}
+
+func (p *testPlan) writeJSON(path string) error {
+	planBytes, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, planBytes, 0644)
+}
@@ -0,0 +1,101 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"runtime"
+)
+
+// platformVerifier verifies certificates with the operating system's trust
+// stack, the one that browsers on that system use, rather than crypto/x509.
+// Implementations are in platform_windows.go and platform_darwin.go, which
+// don't match go_x509*.go since go run ignores the build constraints of the
+// files that it's given; they're added to the command line on their own
+// systems. libcrypto.go implements it with BoringSSL or AWS-LC instead.
+type platformVerifier interface {
+	// name identifies the verifier in results files and audit logs.
+	name() string
+	// version is the version of the operating system that the verifier
+	// is part of, or "" if it isn't known.
+	version() string
+	// verify checks that leaf, with the given intermediates, chains to
+	// the corpus root and is valid for dnsName. It's called concurrently.
+	verify(leaf *x509.Certificate, intermediates []*x509.Certificate, dnsName string) error
+	// verifyRaw is like verify, but is given the DER of the leaf followed
+	// by the rest of the chain exactly as a server presented it, which may
+	// be out of order, have duplicates or include the root. It's used with
+	// -intermediates=presented.
+	verifyRaw(rawChain [][]byte, dnsName string) error
+	close()
+}
+
+// classifiedVerifier is implemented by platform verifiers whose errors can be
+// classified with errorTaxonomy.
+type classifiedVerifier interface {
+	// taxonomy names the table in errorTaxonomy for the verifier's errors.
+	taxonomy() string
+}
+
+// platformTaxonomy returns the table in errorTaxonomy that v's errors are
+// classified with, or "" if they can't be, so that they're classified as
+// OTHER.
+func platformTaxonomy(v platformVerifier) string {
+	if classified, ok := v.(classifiedVerifier); ok {
+		return classified.taxonomy()
+	}
+	return ""
+}
+
+// platform, if not nil, verifies the name constraints corpus in place of
+// crypto/x509. It's set by -implementation=platform, boringssl or awslc.
+var platform platformVerifier
+
+// loadPlatform loads the verifier selected by -implementation for a root. The
+// optional corpora that have roots of their own use it to load another.
+var loadPlatform = loadPlatformVerifier
+
+// newPlatformVerifier returns a platformVerifier that trusts only root. It's
+// set by the init function of the platform_*.go file for this system, if that
+// was built in.
+var newPlatformVerifier func(root *x509.Certificate) (platformVerifier, error)
+
+func loadPlatformVerifier(root *x509.Certificate) (platformVerifier, error) {
+	if newPlatformVerifier == nil {
+		return nil, fmt.Errorf("no platform verifier was built for %s; on Windows run go_x509*.go with platform_windows.go, and on macOS with platform_darwin.go", runtime.GOOS)
+	}
+	return newPlatformVerifier(root)
+}
+
+// newLibcryptoVerifier returns a platformVerifier that verifies with the
+// libcrypto that libcrypto.go was built against, trusting only root, and
+// libcryptoImplementation names that libcrypto as -implementation does,
+// "boringssl" or "awslc". They're set by libcrypto.go's init function, if that
+// was built in.
+var (
+	newLibcryptoVerifier    func(root *x509.Certificate) (platformVerifier, error)
+	libcryptoImplementation string
+)
+
+func loadLibcryptoVerifier(implementation string, root *x509.Certificate) (platformVerifier, error) {
+	if newLibcryptoVerifier == nil {
+		return nil, fmt.Errorf("no libcrypto verifier was built; run go_x509*.go with libcrypto.go and -tags %s, with CGO_CFLAGS and CGO_LDFLAGS pointing at its headers and libcrypto", implementation)
+	}
+	if implementation != libcryptoImplementation {
+		return nil, fmt.Errorf("libcrypto.go was built with -tags %s, not %s", libcryptoImplementation, implementation)
+	}
+	return newLibcryptoVerifier(root)
+}
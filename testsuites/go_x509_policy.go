@@ -0,0 +1,117 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// policyExpectations represents policyExpects.json, which defineExpects.js
+// generates when the optional certificate policy corpus is present.
+type policyExpectations struct {
+	Expects []policyExpectation
+}
+
+type policyExpectation struct {
+	Id int `json:"id"`
+	// Name identifies the case, e.g. "policyMappingInhibited".
+	Name string `json:"name"`
+	expectedResult
+}
+
+// Policy enforcement summaries, recorded in results files. A verifier that
+// doesn't process certificate policies at all accepts every chain.
+const (
+	policiesEnforced    = "enforced"
+	policiesIgnored     = "ignored"
+	policiesPartially   = "partial"
+	policiesMisenforced = "misenforced"
+)
+
+// runPolicyTests runs the certificate policy tests, which are verified with
+// an initial policy set of anyPolicy, and returns the number of tests run and
+// the number of failures. It records the outcome of each test with recorder,
+// along with whether the verifier enforces policies. It does nothing if the
+// policy corpus hasn't been generated.
+func runPolicyTests(hostname string, recorder *resultRecorder) (numTests, numFailures int, err error) {
+	if !profile.runsOptionalCorpus("policy") {
+		return 0, 0, nil
+	}
+
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(baseDir, "html", "policyExpects.json"))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	expectations := new(policyExpectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return 0, 0, err
+	}
+
+	policyDir := filepath.Join(baseDir, "certificates", "policy")
+	rootChain, err := readPEMChain(filepath.Join(policyDir, "root.crt"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rootPool := x509.NewCertPool()
+	for _, root := range rootChain {
+		rootPool.AddCert(root)
+	}
+
+	var numRejected, numWronglyRejected, numErrorTests int
+	for _, test := range expectations.Expects {
+		// An empty set of certificate policies is anyPolicy.
+		verifyErr := verifyHostname(filepath.Join(policyDir, strconv.Itoa(test.Id)), hostname, rootPool)
+		recorder.recordPolicy(&test, verifyErr)
+
+		if test.Result == "ERROR" {
+			numErrorTests++
+			if verifyErr != nil {
+				numRejected++
+			}
+		} else if verifyErr != nil {
+			numWronglyRejected++
+		}
+
+		if passed, description := classifyResult(test.Result, verifyErr == nil); !passed {
+			fmt.Printf("policy #%d (%s): %s%s\n", test.Id, test.Name, description, errorSuffix(errString(verifyErr)))
+			numFailures++
+		}
+	}
+
+	enforcement := policiesPartially
+	switch {
+	case numWronglyRejected > 0:
+		enforcement = policiesMisenforced
+	case numRejected == numErrorTests:
+		enforcement = policiesEnforced
+	case numRejected == 0:
+		enforcement = policiesIgnored
+	}
+	recorder.setPolicyEnforcement(enforcement)
+	fmt.Printf("Certificate policies: %s (%d of %d invalid policy chains rejected)\n", enforcement, numRejected, numErrorTests)
+
+	return len(expectations.Expects), numFailures, nil
+}
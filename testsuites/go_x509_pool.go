@@ -0,0 +1,110 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// workersUsage is the usage of the -workers flag of the commands that run the
+// main corpus.
+const workersUsage = "The number of tests to run at once"
+
+// defaultWorkers is the default of -workers. Verification is mostly CPU-bound,
+// but the openssl and nss commands wait on a process per test.
+var defaultWorkers = runtime.NumCPU() * 2
+
+// workerGroup runs functions on at most a fixed number of goroutines at once.
+// It's errgroup.Group with SetLimit, but without the errors, which none of its
+// callers have, so that the harness needs nothing beyond the standard library.
+type workerGroup struct {
+	wg sync.WaitGroup
+	// slots holds a value for each running function.
+	slots chan struct{}
+}
+
+func newWorkerGroup(limit int) *workerGroup {
+	if limit < 1 {
+		limit = 1
+	}
+	return &workerGroup{slots: make(chan struct{}, limit)}
+}
+
+// run calls f on a new goroutine, first waiting until fewer than the limit
+// are running.
+func (g *workerGroup) run(f func()) {
+	g.slots <- struct{}{}
+	g.wg.Add(1)
+	go func() {
+		defer func() {
+			<-g.slots
+			g.wg.Done()
+		}()
+		f()
+	}()
+}
+
+// wait waits for every function to return.
+func (g *workerGroup) wait() {
+	g.wg.Wait()
+}
+
+// runPipeline calls test for the IP and then the DNS name of every expectation
+// in expects, with at most numWorkers running at once, and returns the number
+// that failed. Each failure is passed to onFailure on the calling goroutine,
+// which is the only receiver of failures, so however slow onFailure is and
+// however many tests fail, the workers are only ever held up and can't
+// deadlock.
+func runPipeline(expects []expectation, numWorkers int, test func(test *expectation) (failed bool), onFailure func(failure expectation)) int {
+	failures := make(chan expectation)
+
+	go func() {
+		group := newWorkerGroup(numWorkers)
+		for _, expectation := range expects {
+			for _, testDNS := range []bool{false, true} {
+				expectation.testDNS = testDNS
+				e := expectation
+				group.run(func() {
+					if test(&e) {
+						failures <- e
+					}
+				})
+			}
+		}
+		group.wait()
+		close(failures)
+	}()
+
+	numFailures := 0
+	for failure := range failures {
+		numFailures++
+		onFailure(failure)
+	}
+	return numFailures
+}
+
+// failureReporter returns an onFailure function for runPipeline that logs
+// each failure and, if summary isn't nil, adds it to summary.
+func failureReporter(summary *runSummary) func(failure expectation) {
+	return func(failure expectation) {
+		if summary != nil {
+			summary.failures = append(summary.failures, failure)
+		}
+
+		logger.Warn("test failed", "id", failure.Id, "type", failure.testType(), "error", errString(failure.err), "descriptions", strings.Join(failure.descriptions(), " "))
+	}
+}
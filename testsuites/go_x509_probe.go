@@ -0,0 +1,551 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probeOutcome is what the probe server saw of a client's connections for
+// one test and name type.
+type probeOutcome struct {
+	// accepted is set once a client has made a request. Clients that
+	// reject the certificate abort the handshake or, like curl, which
+	// checks the name afterwards, close the connection before making
+	// one.
+	accepted bool
+	// err is why the last connection without a request failed.
+	err error
+}
+
+type probeKey struct {
+	id      int
+	testDNS bool
+}
+
+// prober serves each test's certificate and records the handshakes that
+// clients complete.
+type prober struct {
+	config  *configFile
+	timeout time.Duration
+	// sniAddr, if set, is the address that every DNS test is served on,
+	// with the certificate chosen by SNI, and sniTests maps the hostname
+	// of each test to its ID and certificate.
+	sniAddr  string
+	sniTests map[string]sniTest
+
+	listeners []net.Listener
+	// done is closed when the client has finished probing.
+	done     chan struct{}
+	doneOnce sync.Once
+
+	lock      sync.Mutex
+	outcomes  map[probeKey]*probeOutcome
+	userAgent string
+	// implementation and implementationVersion identify the client in
+	// the results file's metadata, if it's known more precisely than by
+	// its user agent, as for browsers driven by the browser command.
+	implementation        string
+	implementationVersion string
+	// resultsKey, if set, signs the results file.
+	resultsKey ed25519.PrivateKey
+	// checkpoint, if set, records each outcome, and resumed holds the
+	// tests whose outcomes it restored from an earlier run, which aren't
+	// listed for probing again.
+	checkpoint *checkpoint
+	resumed    map[probeKey]bool
+	// hellos holds the fingerprints of the ClientHellos of every
+	// connection to a test.
+	hellos clientHelloLog
+}
+
+// probeClients implements the probe command, which serves each test's leaf
+// and chain on its own port, from basePort+1 as in the Apache configuration
+// that generateApacheConf.js writes, and records which of them a probing
+// client, such as a browser or a curl loop, completes handshakes with. A
+// client that rejects a certificate doesn't make a request, so the results
+// are known without the client reporting them. Connections that send the
+// hostname in SNI are DNS tests and connections without SNI, as for IP
+// addresses, are IP tests. With -sni, the DNS tests are instead all served on
+// one port, with each test's certificate picked by its own hostname in SNI.
+func probeClients(args []string) error {
+	flags := flag.NewFlagSet("probe", flag.ExitOnError)
+	control := flags.String("control", "", "The address to serve the probe page and controls on, which defaults to basePort on all interfaces")
+	resultsPath := flags.String("results", "probe.json", "The path to write the results file to when probing is done")
+	resultsKeyPath := flags.String("results-key", "", resultsKeyUsage)
+	userAgent := flags.String("user-agent", "", "The user agent to record, which defaults to the User-Agent header of the first request made")
+	sni := flags.String("sni", "", "If set, e.g. to :443, the address to serve every DNS test on, choosing each test's certificate by its hostname in SNI, rather than a port per test. This needs a corpus generated with perTestHostnames")
+	flags.DurationVar(&limits.timeout, "timeout", limits.timeout, "The longest time to wait for a client to complete a handshake")
+	archivePath := flags.String("corpus-archive", "", corpusArchiveUsage)
+	checkpointPath := flags.String("checkpoint", "", checkpointUsage+", once the client POSTs to /done")
+	flags.Parse(args)
+
+	resultsKey, err := loadResultsKey(*resultsKeyPath)
+	if err != nil {
+		return err
+	}
+
+	if err := openCorpusArchive(*archivePath); err != nil {
+		return err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	expectations, err := loadExpectations()
+	if err != nil {
+		return err
+	}
+
+	if len(*control) == 0 {
+		*control = ":" + strconv.Itoa(config.BasePort)
+	}
+	if len(*sni) > 0 && !config.PerTestHostnames {
+		return errors.New("-sni needs a corpus generated with perTestHostnames set in config.json, so that each test has its own hostname")
+	}
+
+	p := newProber(config, *sni, *userAgent)
+	p.resultsKey = resultsKey
+	defer p.close()
+
+	cp, err := openCheckpoint(*checkpointPath, *userAgent, config.TestVersion)
+	if err != nil {
+		return err
+	}
+	defer cp.close()
+	cp.restoreProbes(p)
+
+	controlAddr, err := p.start(expectations, *control)
+	if err != nil {
+		return err
+	}
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	if len(p.sniAddr) > 0 {
+		fmt.Printf("Serving the DNS names of %d tests on %s by SNI; IP tests need a port per test, so aren't probed.\n", len(expectations.Expects), p.sniAddr)
+		fmt.Printf("Point the client at http://%s/, or fetch each URL listed at /urls,\n", controlAddr)
+	} else {
+		fmt.Printf("Serving %d tests from port %d. Point the client at http://%s/, or fetch each URL listed at /urls,\n", len(expectations.Expects), config.BasePort+1, controlAddr)
+	}
+	fmt.Printf("then POST to /done or interrupt to write the results.\n")
+
+	finished := false
+	select {
+	case <-p.done:
+		finished = true
+	case <-interrupts:
+	}
+
+	if err := p.writeResults(expectations, *resultsPath); err != nil {
+		return err
+	}
+	if finished {
+		return cp.finish()
+	}
+	return nil
+}
+
+func newProber(config *configFile, sniAddr, userAgent string) *prober {
+	return &prober{
+		config:    config,
+		timeout:   limits.timeout,
+		sniAddr:   sniAddr,
+		sniTests:  make(map[string]sniTest),
+		done:      make(chan struct{}),
+		outcomes:  make(map[probeKey]*probeOutcome),
+		userAgent: userAgent,
+		hellos:    make(clientHelloLog),
+	}
+}
+
+// start serves the tests and, on control, the probe page and controls. It
+// returns the address of the control server.
+func (p *prober) start(expectations *expectations, control string) (net.Addr, error) {
+	for i := range expectations.Expects {
+		e := &expectations.Expects[i]
+		cert, err := loadTestCertificate(e.Id)
+		if err != nil {
+			return nil, fmt.Errorf("#%d: %s", e.Id, err)
+		}
+
+		if len(p.sniAddr) > 0 {
+			// A target outside the hostname isn't moved under the
+			// test's own, so it could be shared with another test.
+			host := strings.ToLower(p.config.testHostname(e))
+			if other, ok := p.sniTests[host]; ok {
+				return nil, fmt.Errorf("#%d: %s is also the hostname of #%d, so they can't both be served by SNI", e.Id, host, other.id)
+			}
+			p.sniTests[host] = sniTest{e.Id, &cert}
+			continue
+		}
+
+		l, err := net.Listen("tcp", ":"+strconv.Itoa(p.config.BasePort+e.Id))
+		if err != nil {
+			return nil, fmt.Errorf("#%d: %s; serving every test needs one file descriptor per test, so check ulimit -n", e.Id, err)
+		}
+		p.listeners = append(p.listeners, l)
+
+		// Without session tickets, every connection verifies the
+		// certificate afresh.
+		go p.serve(e.Id, p.config.testHostname(e), l, &tls.Config{Certificates: []tls.Certificate{cert}, GetConfigForClient: p.captureHello, SessionTicketsDisabled: true})
+	}
+
+	if len(p.sniAddr) > 0 {
+		l, err := net.Listen("tcp", p.sniAddr)
+		if err != nil {
+			return nil, err
+		}
+		p.listeners = append(p.listeners, l)
+		go p.serve(0, "", l, &tls.Config{GetCertificate: p.getCertificate, GetConfigForClient: p.captureHello, SessionTicketsDisabled: true})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := probePageTemplate.Execute(w, p.urls(expectations)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("/urls", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, url := range p.urls(expectations) {
+			fmt.Fprintln(w, url)
+		}
+	})
+	mux.HandleFunc("/done", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST to finish probing", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintln(w, "Probing is done; the harness is writing the results")
+		p.doneOnce.Do(func() { close(p.done) })
+	})
+
+	controlListener, err := net.Listen("tcp", control)
+	if err != nil {
+		return nil, err
+	}
+	p.listeners = append(p.listeners, controlListener)
+	go http.Serve(controlListener, mux)
+
+	return controlListener.Addr(), nil
+}
+
+// loadTestCertificate returns the leaf, key and chain of test id, for serving
+// or presenting in a TLS handshake.
+func loadTestCertificate(id int) (tls.Certificate, error) {
+	certPEM, err := readCorpusFile(testPath(id, ".crt"))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := readCorpusFile(testPath(id, ".key"))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	chain, err := readPEMChain(testPath(id, ".chain"))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	for _, intermediate := range chain {
+		cert.Certificate = append(cert.Certificate, intermediate.Raw)
+	}
+	return cert, nil
+}
+
+// close stops serving.
+func (p *prober) close() {
+	for _, l := range p.listeners {
+		l.Close()
+	}
+}
+
+// urls returns the URL of each DNS and IP test that's being served, except
+// those resumed from a checkpoint.
+func (p *prober) urls(expectations *expectations) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var urls []string
+	for _, e := range expectations.Expects {
+		if len(p.sniAddr) > 0 {
+			if p.resumed[probeKey{e.Id, true}] {
+				continue
+			}
+			host := p.config.testHostname(&e)
+			if _, port, err := net.SplitHostPort(p.sniAddr); err == nil && port != "443" {
+				host = net.JoinHostPort(host, port)
+			}
+			urls = append(urls, "https://"+host+"/well-known.txt")
+			continue
+		}
+		port := strconv.Itoa(p.config.BasePort + e.Id)
+		if !p.resumed[probeKey{e.Id, true}] {
+			urls = append(urls, "https://"+net.JoinHostPort(p.config.testHostname(&e), port)+"/well-known.txt")
+		}
+		if !p.resumed[probeKey{e.Id, false}] {
+			urls = append(urls, "https://"+net.JoinHostPort(p.config.testIP(&e), port)+"/well-known.txt")
+		}
+	}
+	return urls
+}
+
+// sniTest is a test served on the SNI-multiplexed port.
+type sniTest struct {
+	id   int
+	cert *tls.Certificate
+}
+
+// getCertificate picks the certificate of the test whose hostname the client
+// sent in SNI.
+func (p *prober) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	test, ok := p.sniTests[strings.ToLower(hello.ServerName)]
+	if !ok {
+		return nil, fmt.Errorf("no test has the hostname %q", hello.ServerName)
+	}
+	return test.cert, nil
+}
+
+// captureHello records the fingerprint of a client's ClientHello. It's a
+// GetConfigForClient callback that leaves the configuration as it is.
+func (p *prober) captureHello(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	fingerprint := fingerprintClientHello(hello)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.hellos.add(fingerprint)
+	return nil, nil
+}
+
+func (p *prober) serve(id int, hostname string, l net.Listener, config *tls.Config) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(id, hostname, tls.Server(conn, config))
+	}
+}
+
+// handle records whether a client made a request over conn, answering it as
+// the Apache configuration would. Test id is verified against hostname; an
+// id of zero means that conn is on the SNI-multiplexed port, so the test is
+// found from its SNI, which is its hostname.
+func (p *prober) handle(id int, hostname string, conn *tls.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(p.timeout))
+
+	err := conn.Handshake()
+	serverName := strings.ToLower(conn.ConnectionState().ServerName)
+	if id == 0 {
+		test, ok := p.sniTests[serverName]
+		if !ok {
+			return
+		}
+		id, hostname = test.id, serverName
+	}
+	if len(serverName) != 0 && !strings.EqualFold(serverName, hostname) {
+		return
+	}
+	key := probeKey{id, len(serverName) != 0}
+	if err != nil {
+		p.record(key, err)
+		return
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		p.record(key, fmt.Errorf("the client completed the handshake but made no request: %s", err))
+		return
+	}
+	p.record(key, nil)
+
+	p.lock.Lock()
+	if len(p.userAgent) == 0 {
+		p.userAgent = req.UserAgent()
+	}
+	p.lock.Unlock()
+
+	respondToProbe(conn, req)
+}
+
+// respondToProbe answers a probing client's request as the Apache
+// configuration would, and asks it to close the connection, so that its next
+// request is made over a new connection with a new handshake.
+func respondToProbe(w io.Writer, req *http.Request) {
+	// test_html is the document root of each test's virtual host.
+	status := http.StatusOK
+	body, err := ioutil.ReadFile(filepath.Join(baseDir, "test_html", filepath.Base(req.URL.Path)))
+	if err != nil {
+		status, body = http.StatusNotFound, []byte("not found\n")
+	}
+
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Access-Control-Allow-Origin": {"*"}, "Content-Type": {"text/plain"}},
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		Close:         true,
+	}
+	resp.Write(w)
+}
+
+func (p *prober) record(key probeKey, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	outcome, ok := p.outcomes[key]
+	if !ok {
+		outcome = new(probeOutcome)
+		p.outcomes[key] = outcome
+	}
+	if err == nil {
+		outcome.accepted = true
+	} else {
+		outcome.err = err
+	}
+	p.checkpoint.completeProbe(key, outcome)
+}
+
+// identify sets the implementation in recorder's metadata to the client, or
+// its user agent if nothing more is known. p.lock must be held.
+func (p *prober) identify(recorder *resultRecorder) {
+	if len(p.implementation) > 0 {
+		recorder.setImplementation(p.implementation, p.implementationVersion)
+	} else {
+		recorder.setImplementation(p.userAgent, "")
+	}
+}
+
+// writeResults writes the outcomes to a results file and reports the tests
+// that failed or weren't probed.
+func (p *prober) writeResults(expectations *expectations, path string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	recorder := newResultRecorder(deliveryPool)
+	recorder.setSigningKey(p.resultsKey)
+	recorder.userAgent = p.userAgent
+	recorder.setClientHellos(p.hellos.list())
+	p.identify(recorder)
+
+	var numProbed, numFailures int
+	for _, e := range expectations.Expects {
+		for _, testDNS := range []bool{true, false} {
+			outcome, ok := p.outcomes[probeKey{e.Id, testDNS}]
+			if !ok {
+				continue
+			}
+			numProbed++
+
+			var err error
+			if !outcome.accepted {
+				err = outcome.err
+				if err == nil {
+					err = errors.New("handshake failed")
+				}
+			}
+			e.testDNS = testDNS
+			recorder.record(&e, err, 0)
+
+			expect, testType := e.IP.Result, "IP"
+			if testDNS {
+				expect, testType = e.DNS.Result, "DNS"
+			}
+			if passed, description := classifyResult(expect, outcome.accepted); !passed {
+				numFailures++
+				fmt.Printf("#%d %s: %s%s\n", e.Id, testType, description, errorSuffix(errString(err)))
+			}
+		}
+	}
+
+	if err := recorder.write(path, p.config.TestVersion); err != nil {
+		return err
+	}
+
+	fmt.Printf("Probed %d of %d tests, of which %d failed; results written to %s\n", numProbed, 2*len(expectations.Expects), numFailures, path)
+	return nil
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// probePageTemplate is a page that makes a browser fetch every test URL in
+// turn and then finish probing, replacing the in-browser runner's own
+// reporting.
+var probePageTemplate = template.Must(template.New("probe").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>BetterTLS probe</title>
+</head>
+<body>
+<p>Install certificates/root.crt as a trusted root before probing.</p>
+<p id="progress">Starting...</p>
+<script>
+var urls = {{.}};
+var progress = document.getElementById("progress");
+(async function() {
+  for (var i = 0; i < urls.length; i++) {
+    progress.textContent = "Probing " + (i + 1) + " of " + urls.length + ": " + urls[i];
+    try {
+      await fetch(urls[i], {mode: "no-cors", cache: "no-store"});
+    } catch (e) {
+      // A rejected certificate fails the fetch; the server has recorded it.
+    }
+  }
+  await fetch("/done", {method: "POST"});
+  progress.textContent = "Done. The results have been written by the harness.";
+})();
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,106 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+)
+
+// profileUsage is the usage of the -profile flag of the commands that run the
+// main corpus.
+const profileUsage = "The corpus profile to run: \"smoke\", a hundred or so tests of the main corpus covering each of its dimensions, \"full\", the main corpus and the optional corpora except stress, or \"stress\", everything"
+
+// corpusProfile is a named part of the corpus, so that projects can run a
+// quick check on every commit and everything nightly.
+type corpusProfile struct {
+	name string
+	// subset is set if the profile only has some of the main corpus, the
+	// tests listed for it in manifest.json's profiles, which the
+	// generator chooses.
+	subset bool
+	// optionalCorpora is whether the optional corpora are run, and
+	// stressCorpus whether the stress corpus, which is the slowest, is
+	// among them.
+	optionalCorpora bool
+	stressCorpus    bool
+}
+
+var corpusProfiles = map[string]*corpusProfile{
+	"smoke":  {name: "smoke", subset: true},
+	"full":   {name: "full", optionalCorpora: true},
+	"stress": {name: "stress", optionalCorpora: true, stressCorpus: true},
+}
+
+// profile is the profile being run, set by -profile. Everything present is run
+// by default.
+var profile = corpusProfiles["stress"]
+
+// selectProfile sets profile to the profile called name.
+func selectProfile(name string) error {
+	p, ok := corpusProfiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q; the profiles are smoke, full and stress", name)
+	}
+	profile = p
+	return nil
+}
+
+// runsOptionalCorpus returns whether the optional corpus called name, e.g.
+// "aia", is part of the profile.
+func (p *corpusProfile) runsOptionalCorpus(name string) bool {
+	if name == "stress" {
+		return p.stressCorpus
+	}
+	return p.optionalCorpora
+}
+
+// filter removes the tests that aren't part of the profile from expectations,
+// and returns how many it removed.
+func (p *corpusProfile) filter(expectations *expectations) (removed int, err error) {
+	if !p.subset {
+		return 0, nil
+	}
+
+	manifest, err := loadManifest()
+	if err != nil {
+		return 0, err
+	}
+	ids, ok := manifest.Profiles[p.name]
+	if !ok {
+		return 0, fmt.Errorf("manifest.json has no %s profile; the corpus was generated by an older generator and should be regenerated", p.name)
+	}
+	included := make(map[int]bool)
+	for _, id := range ids {
+		included[id] = true
+	}
+
+	var kept []expectation
+	for _, e := range expectations.Expects {
+		if included[e.Id] {
+			kept = append(kept, e)
+		}
+	}
+	removed = len(expectations.Expects) - len(kept)
+	expectations.Expects = kept
+	return removed, nil
+}
+
+// recordFiltered records the DNS and IP verifications of the removed tests as
+// skipped, so that results files show that they weren't run.
+func (p *corpusProfile) recordFiltered(recorder *resultRecorder, removed int) {
+	for i := 0; i < 2*removed; i++ {
+		recorder.recordSkip(&skip{skipFilteredOut, "not in the " + p.name + " profile"})
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// progressReporter logs how many of a run's verifications are done, so that a
+// run over the whole corpus isn't silent until it finishes.
+type progressReporter struct {
+	total int
+	start time.Time
+	// done is updated atomically by the workers.
+	done int64
+	stop chan struct{}
+}
+
+// newProgressReporter returns a reporter for total verifications that logs to
+// stderr every interval until stopped.
+func newProgressReporter(total int, interval time.Duration) *progressReporter {
+	p := &progressReporter{total: total, start: time.Now(), stop: make(chan struct{})}
+	go p.run(interval)
+	return p
+}
+
+func (p *progressReporter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.log()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *progressReporter) log() {
+	if p.total == 0 {
+		return
+	}
+	done := int(atomic.LoadInt64(&p.done))
+	elapsed := time.Since(p.start)
+
+	eta := "unknown"
+	if done > 0 {
+		eta = (elapsed * time.Duration(p.total-done) / time.Duration(done)).Round(time.Second).String()
+	}
+	fmt.Fprintf(os.Stderr, "Verified %d of %d (%d%%) in %s, about %s left\n", done, p.total, 100*done/p.total, elapsed.Round(time.Second), eta)
+}
+
+// step notes that a verification is done, or was skipped. It does nothing if p
+// is nil.
+func (p *progressReporter) step() {
+	if p != nil {
+		atomic.AddInt64(&p.done, 1)
+	}
+}
+
+// finish stops logging. It does nothing if p is nil.
+func (p *progressReporter) finish() {
+	if p != nil {
+		close(p.stop)
+	}
+}
+
+// runSummary collects the failures of a run of the main corpus so that they
+// can be summarised once it's done.
+type runSummary struct {
+	failures []expectation
+}
+
+// summaryCount is the number of verifications in a group and how many failed.
+type summaryCount struct {
+	total, failed int
+}
+
+// print prints the verifications that ran and failed by expected result and
+// by feature, the slowest verifications and the reasons for the failures.
+// Only features with failures are listed.
+func (s *runSummary) print(expectations *expectations, recorder *resultRecorder) {
+	recorder.Lock()
+	defer recorder.Unlock()
+
+	type key struct {
+		id      int
+		testDNS bool
+	}
+	failed := make(map[key]bool)
+	byReason := make(map[string]int)
+	for _, failure := range s.failures {
+		failed[key{failure.Id, failure.testDNS}] = true
+
+		reason := "no result"
+		if result, ok := recorder.results[failure.Id]; ok {
+			if accepted, ran, _ := result.result(failure.testDNS); ran && accepted {
+				reason = "accepted"
+			} else if ran {
+				reason = string(result.reason(failure.testDNS))
+			}
+		}
+		if len(reason) == 0 {
+			reason = "unclassified"
+		}
+		byReason[reason]++
+	}
+
+	byExpect := make(map[string]*summaryCount)
+	byFeature := make(map[string]*summaryCount)
+	count := func(counts map[string]*summaryCount, name string, failed bool) {
+		if counts[name] == nil {
+			counts[name] = new(summaryCount)
+		}
+		counts[name].total++
+		if failed {
+			counts[name].failed++
+		}
+	}
+
+	for i := range expectations.Expects {
+		e := &expectations.Expects[i]
+		result, ok := recorder.results[e.Id]
+		if !ok {
+			continue
+		}
+		for _, testDNS := range []bool{true, false} {
+			if _, ran, _ := result.result(testDNS); !ran {
+				continue
+			}
+			expect, kind := e.IP.Result, "IP"
+			if testDNS {
+				expect, kind = e.DNS.Result, "DNS"
+			}
+			isFailed := failed[key{e.Id, testDNS}]
+			count(byExpect, kind+" "+expect, isFailed)
+			for name, value := range e.Features.values() {
+				count(byFeature, name+"="+value, isFailed)
+			}
+		}
+	}
+
+	fmt.Printf("Summary by expected result:\n")
+	printSummaryCounts(byExpect, false)
+
+	fmt.Printf("Failures by feature:\n")
+	printSummaryCounts(byFeature, true)
+
+	if len(byReason) > 0 {
+		var reasons []string
+		for reason := range byReason {
+			reasons = append(reasons, reason)
+		}
+		sort.Slice(reasons, func(i, j int) bool {
+			if byReason[reasons[i]] != byReason[reasons[j]] {
+				return byReason[reasons[i]] > byReason[reasons[j]]
+			}
+			return reasons[i] < reasons[j]
+		})
+		fmt.Printf("Failures by reason:\n")
+		for _, reason := range reasons {
+			fmt.Printf("  %s: %d\n", reason, byReason[reason])
+		}
+	}
+
+	// -bench prints its own list of the slowest tests.
+	if benchIterations > 1 {
+		return
+	}
+	verifications := recorder.verifications()
+	if len(verifications) > 5 {
+		verifications = verifications[:5]
+	}
+	if len(verifications) > 0 {
+		fmt.Printf("Slowest verifications:\n")
+		for _, v := range verifications {
+			kind := "IP"
+			if v.testDNS {
+				kind = "DNS"
+			}
+			fmt.Printf("  #%d (%s): %s\n", v.id, kind, time.Duration(v.nanos))
+		}
+	}
+}
+
+// printSummaryCounts prints counts sorted by name, leaving out those without
+// failures if failedOnly is set.
+func printSummaryCounts(counts map[string]*summaryCount, failedOnly bool) {
+	var names []string
+	for name, c := range counts {
+		if !failedOnly || c.failed > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		fmt.Printf("  none\n")
+		return
+	}
+	for _, name := range names {
+		fmt.Printf("  %s: %d failed of %d\n", name, counts[name].failed, counts[name].total)
+	}
+}
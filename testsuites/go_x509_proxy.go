@@ -0,0 +1,137 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// proxyExpectations represents proxyExpects.json, which defineExpects.js
+// generates when the optional RFC 3820 proxy certificate corpus is present.
+type proxyExpectations struct {
+	Expects []proxyExpectation
+}
+
+type proxyExpectation struct {
+	Id int `json:"id"`
+	// Mainstream is the expected result for verifiers without proxy
+	// certificate support, such as Go.
+	Mainstream expectedResult `json:"mainstream"`
+	// ProxyAware is the expected result for verifiers that implement RFC
+	// 3820, which are run through the external harness.
+	ProxyAware expectedResult `json:"proxyAware"`
+}
+
+// loadProxyExpectations returns the proxy certificate tests, or nil if the
+// proxy corpus hasn't been generated or the selected profile excludes it.
+func loadProxyExpectations() (*proxyExpectations, error) {
+	if !profile.runsOptionalCorpus("proxy") {
+		return nil, nil
+	}
+
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(baseDir, "html", "proxyExpects.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	expectations := new(proxyExpectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return nil, err
+	}
+	return expectations, nil
+}
+
+// runProxyTests runs the proxy certificate tests and returns the number of
+// tests run and the number of failures. It does nothing if the proxy corpus
+// hasn't been generated.
+func runProxyTests() (numTests, numFailures int, err error) {
+	expectations, err := loadProxyExpectations()
+	if expectations == nil || err != nil {
+		return 0, 0, err
+	}
+
+	proxyDir := filepath.Join(certificatesDir, "proxy")
+	rootChain, err := readPEMChain(filepath.Join(proxyDir, "root.crt"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rootPool := x509.NewCertPool()
+	for _, root := range rootChain {
+		rootPool.AddCert(root)
+	}
+
+	for _, test := range expectations.Expects {
+		if err := runProxyTest(&test, proxyDir, rootPool); err != nil {
+			fmt.Printf("proxy #%d: failed:\n  %q\n", test.Id, err)
+			numFailures++
+		}
+	}
+
+	return len(expectations.Expects), numFailures, nil
+}
+
+// runProxyTest verifies a single proxy certificate and returns an error if
+// the result doesn't match the mainstream expectation.
+func runProxyTest(test *proxyExpectation, proxyDir string, rootPool *x509.CertPool) error {
+	chain, err := readPEMChain(filepath.Join(proxyDir, strconv.Itoa(test.Id)+".chain"))
+	if err != nil {
+		return err
+	}
+
+	leaf, err := readPEMChain(filepath.Join(proxyDir, strconv.Itoa(test.Id)+".crt"))
+	if err != nil {
+		return err
+	}
+
+	if len(leaf) != 1 {
+		return fmt.Errorf("expected a single certificate in the .crt file, but found %d", len(leaf))
+	}
+
+	intermediatePool := x509.NewCertPool()
+	for _, intermediate := range chain {
+		intermediatePool.AddCert(intermediate)
+	}
+
+	// Proxy certificates identify a user rather than a host, so there's
+	// no name to verify.
+	_, err = leaf[0].Verify(x509.VerifyOptions{
+		Roots:         rootPool,
+		Intermediates: intermediatePool,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+
+	switch test.Mainstream.Result {
+	case "ERROR":
+		if err == nil {
+			return fmt.Errorf("proxy certificate was accepted")
+		}
+	case "OK":
+		return err
+	default:
+		return fmt.Errorf("unknown expected result %q", test.Mainstream.Result)
+	}
+
+	return nil
+}
@@ -0,0 +1,346 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// exportReport implements the export-report command, which renders one or
+// more results files as a static HTML page.
+func exportReport(args []string) error {
+	flags := flag.NewFlagSet("export-report", flag.ExitOnError)
+	output := flags.String("o", "report.html", "Path to write the report to")
+	certsURL := flags.String("certs", "../certificates", "URL, relative to the report, of the certificates directory")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: export-report [flags] results.json...\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no results files given")
+	}
+
+	expectations, err := loadExpectations()
+	if err != nil {
+		return err
+	}
+
+	var results []*resultsFile
+	for _, path := range flags.Args() {
+		r, err := loadResults(path)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		results = append(results, r)
+	}
+
+	report := buildReport(expectations, results, *certsURL)
+
+	out, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := reportTemplate.Execute(out, report); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+type report struct {
+	Columns  []reportColumn
+	Features []reportFeature
+	Rows     []reportRow
+	// Pivots break the failures down by each dimension of the tests.
+	Pivots []reportPivot
+}
+
+// reportColumn summarises a single results file.
+type reportColumn struct {
+	Name      string
+	UserAgent string
+	NumPassed int
+	NumFailed int
+}
+
+// reportFeature lists the values seen for one of the features, which the
+// report offers as a filter.
+type reportFeature struct {
+	Name   string
+	Values []string
+}
+
+type reportRow struct {
+	Id           int
+	Type         string
+	Expect       string
+	Descriptions string
+	// Features is a JSON object of feature name to value, used by the
+	// filters.
+	Features string
+	Cells    []reportCell
+	// AllPassed is true if the test passed in every results file.
+	AllPassed bool
+	// Disagree is true if some results files accepted the certificate
+	// and others rejected it.
+	Disagree bool
+	CertURL  string
+	ChainURL string
+}
+
+// reportPivot counts the failures of each results file for each value of a
+// dimension, so that failures confined to one kind of test stand out.
+type reportPivot struct {
+	Dimension string
+	Rows      []reportPivotRow
+}
+
+type reportPivotRow struct {
+	Value string
+	// Cells holds a count for each results file.
+	Cells []reportPivotCell
+}
+
+type reportPivotCell struct {
+	Failed int
+	Total  int
+}
+
+type reportCell struct {
+	Result string
+	// Reason classifies the error given if the certificate was rejected.
+	Reason  errorReason
+	Passed  bool
+	Missing bool
+}
+
+func buildReport(expectations *expectations, results []*resultsFile, certsURL string) *report {
+	ret := new(report)
+
+	resultMaps := make([]map[int]testResult, len(results))
+	for i, r := range results {
+		resultMaps[i] = make(map[int]testResult)
+		for _, result := range r.Results {
+			resultMaps[i][result.Id] = result
+		}
+		ret.Columns = append(ret.Columns, reportColumn{Name: r.name, UserAgent: r.UserAgent})
+	}
+
+	featureValues := make(map[string]map[string]bool)
+	// pivotCounts maps each dimension and value to a count for each
+	// results file.
+	pivotCounts := make(map[string]map[string][]reportPivotCell)
+
+	for _, e := range expectations.Expects {
+		values := e.Features.values()
+		for name, value := range values {
+			if featureValues[name] == nil {
+				featureValues[name] = make(map[string]bool)
+			}
+			featureValues[name][value] = true
+		}
+		featuresJSON, _ := json.Marshal(values)
+
+		for _, testDNS := range []bool{true, false} {
+			e.testDNS = testDNS
+			row := reportRow{
+				Id:           e.Id,
+				Type:         "IP",
+				Expect:       e.IP.Result,
+				Descriptions: strings.Join(e.descriptions(), " "),
+				Features:     string(featuresJSON),
+				AllPassed:    true,
+				CertURL:      fmt.Sprintf("%s/%d.crt", certsURL, e.Id),
+				ChainURL:     fmt.Sprintf("%s/%d.chain", certsURL, e.Id),
+			}
+			expected := &e.IP
+			if testDNS {
+				row.Type = "DNS"
+				row.Expect = e.DNS.Result
+				expected = &e.DNS
+			}
+
+			var numAccepted, numRejected int
+			for i := range results {
+				result, ok := resultMaps[i][e.Id]
+				if !ok {
+					row.Cells = append(row.Cells, reportCell{Missing: true})
+					continue
+				}
+
+				accepted, ran, _ := result.result(testDNS)
+				if !ran {
+					row.Cells = append(row.Cells, reportCell{Missing: true})
+					continue
+				}
+				if accepted {
+					numAccepted++
+				} else {
+					numRejected++
+				}
+				passed, description := gradeResult(expected, accepted, result.reason(testDNS))
+				for dimension, value := range e.Dimensions {
+					if pivotCounts[dimension] == nil {
+						pivotCounts[dimension] = make(map[string][]reportPivotCell)
+					}
+					if pivotCounts[dimension][value] == nil {
+						pivotCounts[dimension][value] = make([]reportPivotCell, len(results))
+					}
+					pivotCounts[dimension][value][i].Total++
+					if !passed {
+						pivotCounts[dimension][value][i].Failed++
+					}
+				}
+				row.Cells = append(row.Cells, reportCell{Result: description, Reason: result.reason(testDNS), Passed: passed})
+				if passed {
+					ret.Columns[i].NumPassed++
+				} else {
+					ret.Columns[i].NumFailed++
+					row.AllPassed = false
+				}
+			}
+
+			row.Disagree = numAccepted > 0 && numRejected > 0
+			ret.Rows = append(ret.Rows, row)
+		}
+	}
+
+	for name, values := range featureValues {
+		feature := reportFeature{Name: name}
+		for value := range values {
+			feature.Values = append(feature.Values, value)
+		}
+		sort.Strings(feature.Values)
+		ret.Features = append(ret.Features, feature)
+	}
+	sort.Slice(ret.Features, func(i, j int) bool {
+		return ret.Features[i].Name < ret.Features[j].Name
+	})
+
+	for dimension, values := range pivotCounts {
+		pivot := reportPivot{Dimension: dimension}
+		for value, cells := range values {
+			pivot.Rows = append(pivot.Rows, reportPivotRow{Value: value, Cells: cells})
+		}
+		sort.Slice(pivot.Rows, func(i, j int) bool {
+			return pivot.Rows[i].Value < pivot.Rows[j].Value
+		})
+		ret.Pivots = append(ret.Pivots, pivot)
+	}
+	sort.Slice(ret.Pivots, func(i, j int) bool {
+		return ret.Pivots[i].Dimension < ret.Pivots[j].Dimension
+	})
+
+	return ret
+}
+
+// values returns the features as a map from their name in expects.json to
+// their value formatted as a string.
+func (f *features) values() map[string]string {
+	ret := make(map[string]string)
+
+	v := reflect.ValueOf(f).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		ret[name] = fmt.Sprint(v.Field(i).Interface())
+	}
+
+	return ret
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>BetterTLS Results</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 2px 6px; }
+td.passed { background: #cfc; }
+td.failed { background: #fcc; }
+td.missing { background: #eee; }
+table.pivot { display: inline-table; margin: 0 12px 12px 0; vertical-align: top; }
+.filters label { display: inline-block; margin: 0 12px 6px 0; }
+</style>
+</head>
+<body>
+<h1>BetterTLS Results</h1>
+{{if .Pivots}}<h2>Failures by dimension</h2>
+{{$columns := .Columns}}{{range .Pivots}}<table class="pivot">
+<thead><tr><th>{{.Dimension}}</th>{{range $columns}}<th>{{.Name}}</th>{{end}}</tr></thead>
+<tbody>
+{{range .Rows}}<tr><td>{{.Value}}</td>{{range .Cells}}<td class="{{if .Failed}}failed{{else}}passed{{end}}">{{.Failed}} of {{.Total}}</td>{{end}}</tr>
+{{end}}</tbody>
+</table>
+{{end}}<h2>Tests</h2>
+{{end}}<div class="filters">
+<label><input type="checkbox" id="hidePassing"> Hide tests passed by every implementation</label>
+<label><input type="checkbox" id="onlyDisagreements"> Only show tests where implementations disagree</label><br>
+{{range .Features}}<label>{{.Name}} <select data-feature="{{.Name}}">
+<option value="">any</option>
+{{range .Values}}<option>{{.}}</option>
+{{end}}</select></label>
+{{end}}</div>
+<table id="tests">
+<thead>
+<tr><th>Test</th><th>Type</th><th>Expect</th><th>Certificates</th>{{range .Columns}}<th title="{{.UserAgent}}">{{.Name}}<br>{{.NumPassed}} passed, {{.NumFailed}} failed</th>{{end}}<th>Descriptions</th></tr>
+</thead>
+<tbody>
+{{range .Rows}}<tr data-features="{{.Features}}"{{if .AllPassed}} data-all-passed{{end}}{{if .Disagree}} data-disagree{{end}}><td>{{.Id}}</td><td>{{.Type}}</td><td>{{.Expect}}</td><td><a href="{{.CertURL}}">crt</a> <a href="{{.ChainURL}}">chain</a></td>{{range .Cells}}{{if .Missing}}<td class="missing">-</td>{{else}}<td class="{{if .Passed}}passed{{else}}failed{{end}}">{{.Result}}{{if .Reason}}<br><small>{{.Reason}}</small>{{end}}</td>{{end}}{{end}}<td>{{.Descriptions}}</td></tr>
+{{end}}</tbody>
+</table>
+<script>
+(function() {
+  var rows = document.querySelectorAll('#tests tbody tr[data-features]');
+  var selects = document.querySelectorAll('select[data-feature]');
+  var hidePassing = document.getElementById('hidePassing');
+  var onlyDisagreements = document.getElementById('onlyDisagreements');
+  function applyFilters() {
+    for (var i = 0; i < rows.length; i++) {
+      var row = rows[i];
+      var features = JSON.parse(row.getAttribute('data-features'));
+      var visible = !(hidePassing.checked && row.hasAttribute('data-all-passed')) &&
+          !(onlyDisagreements.checked && !row.hasAttribute('data-disagree'));
+      for (var j = 0; visible && j < selects.length; j++) {
+        var want = selects[j].value;
+        if (want !== '' && features[selects[j].getAttribute('data-feature')] !== want) {
+          visible = false;
+        }
+      }
+      row.style.display = visible ? '' : 'none';
+    }
+  }
+  hidePassing.addEventListener('change', applyFilters);
+  onlyDisagreements.addEventListener('change', applyFilters);
+  for (var i = 0; i < selects.length; i++) {
+    selects[i].addEventListener('change', applyFilters);
+  }
+})();
+</script>
+</body>
+</html>
+`))
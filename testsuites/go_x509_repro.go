@@ -0,0 +1,303 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// reproduceTest implements the repro command, which writes a standalone Go
+// program, or with -test a Go test, that embeds one test's certificates and
+// verifies them with crypto/x509 as the run command does, for pasting into a
+// golang/go issue. The outcome with this Go version is noted in its doc
+// comment.
+func reproduceTest(args []string) error {
+	flags := flag.NewFlagSet("repro", flag.ExitOnError)
+	asTest := flags.Bool("test", false, "Write a Go test rather than a program")
+	output := flags.String("o", "", "The path to write the program to, which defaults to stdout")
+	archivePath := flags.String("corpus-archive", "", corpusArchiveUsage)
+	corpusFormat := flags.String("corpus-format", "pem", corpusFormatUsage)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: repro [flags] id\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected a test ID")
+	}
+	id, err := strconv.Atoi(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid test ID %q", flags.Arg(0))
+	}
+
+	if err := openCorpusArchive(*archivePath); err != nil {
+		return err
+	}
+	reader, err := openCorpusReader(*corpusFormat)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	expectations, err := loadExpectations()
+	if err != nil {
+		return err
+	}
+	var test *expectation
+	for i := range expectations.Expects {
+		if expectations.Expects[i].Id == id {
+			test = &expectations.Expects[i]
+		}
+	}
+	if test == nil {
+		return fmt.Errorf("there's no test %d", id)
+	}
+	test.testDNS = true
+
+	root, err := loadRoot(reader)
+	if err != nil {
+		return err
+	}
+	leafDER, chainDER, err := reader.test(id)
+	if err != nil {
+		return err
+	}
+	shouldFail, err := test.shouldFailDNS()
+	if err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		return err
+	}
+	rootPool := x509.NewCertPool()
+	rootPool.AddCert(root)
+	intermediatePool := x509.NewCertPool()
+	for _, der := range chainDER {
+		intermediate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		intermediatePool.AddCert(intermediate)
+	}
+	dnsName := config.testHostname(test)
+	_, verifyErr := leaf.Verify(x509.VerifyOptions{
+		DNSName:       dnsName,
+		Roots:         rootPool,
+		Intermediates: intermediatePool,
+	})
+
+	diverges := (verifyErr == nil) == shouldFail
+	note := fmt.Sprintf("With %s, Verify returned %v, as expected.", runtime.Version(), verifyErr)
+	if diverges {
+		note = fmt.Sprintf("With %s, Verify returned %v, which disagrees with the expected result.", runtime.Version(), verifyErr)
+	} else {
+		fmt.Fprintf(os.Stderr, "Warning: with %s, crypto/x509 agrees with the expected result of test %d, so the program doesn't show a divergence.\n", runtime.Version(), id)
+	}
+
+	r := newReproducer(test, dnsName, leafDER, chainDER, root.Raw, shouldFail, note)
+	r.Test = *asTest
+	source, err := r.source()
+	if err != nil {
+		return err
+	}
+
+	if len(*output) == 0 {
+		_, err := os.Stdout.Write(source)
+		return err
+	}
+	return ioutil.WriteFile(*output, source, 0644)
+}
+
+// reproducer describes a standalone Go program, or test, that verifies one
+// test's certificates as the harness did, so that a divergence can be
+// reported against crypto/x509 without the harness or the corpus.
+type reproducer struct {
+	Id           int
+	Descriptions []string
+	DNSName      string
+	// Expected is the test's expected result, e.g. "ERROR", and
+	// ExpectRejection is whether crypto/x509 should reject it.
+	Expected        string
+	ExpectRejection bool
+	// Note, if set, is a paragraph of the program's doc comment saying
+	// what the harness saw.
+	Note string
+	// Test is whether to write a Go test rather than a program.
+	Test bool
+	// LeafPEM, IntermediatesPEM and RootPEM are the certificates, as PEM.
+	LeafPEM          string
+	IntermediatesPEM string
+	RootPEM          string
+}
+
+// newReproducer returns a reproducer of test, whose certificates are the DER
+// of leaf, chain and root, verified for dnsName.
+func newReproducer(test *expectation, dnsName string, leaf []byte, chain [][]byte, root []byte, expectRejection bool, note string) *reproducer {
+	r := &reproducer{
+		Id:              test.Id,
+		Descriptions:    test.descriptions(),
+		DNSName:         dnsName,
+		Expected:        test.DNS.Result,
+		ExpectRejection: expectRejection,
+		Note:            note,
+		LeafPEM:         pemString(leaf),
+		RootPEM:         pemString(root),
+	}
+	for _, der := range chain {
+		r.IntermediatesPEM += pemString(der)
+	}
+	return r
+}
+
+// source returns the reproducer's program, formatted with gofmt.
+func (r *reproducer) source() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := reproducerTemplate.Execute(&buf, r); err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
+
+var reproducerTemplate = template.Must(template.New("reproducer").Funcs(template.FuncMap{
+	"comment": func(s string) string {
+		return "// " + strings.Replace(s, "\n", "\n// ", -1)
+	},
+}).Parse(`// This {{if .Test}}test{{else}}program{{end}} reproduces test {{.Id}} of the BetterTLS name constraints
+// corpus (https://github.com/Netflix/bettertls), whose expected result is
+// {{.Expected}}, so crypto/x509 should {{if .ExpectRejection}}reject{{else}}accept{{end}} the leaf for {{.DNSName}}.
+{{- range .Descriptions}}
+//
+{{comment .}}
+{{- end}}
+{{- if .Note}}
+//
+{{comment .Note}}
+{{- end}}
+//
+{{- if .Test}}
+// Save it as x509repro_test.go and run it with "go test x509repro_test.go".
+// It fails if crypto/x509 disagrees with the expected result.
+package x509repro
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+{{- else}}
+// Run it with "go run reproduce.go". It exits with status 1 if crypto/x509
+// disagrees with the expected result.
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+{{- end}}
+
+const leafPEM = ` + "`{{.LeafPEM}}`" + `
+
+// intermediatesPEM holds the intermediates that the verifier is given, in no
+// particular order.
+const intermediatesPEM = ` + "`{{.IntermediatesPEM}}`" + `
+
+const rootPEM = ` + "`{{.RootPEM}}`" + `
+{{if .Test}}
+func TestBetterTLS{{.Id}}(t *testing.T) {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(rootPEM)) {
+		t.Fatal("failed to parse the root")
+	}
+	intermediates := x509.NewCertPool()
+	intermediates.AppendCertsFromPEM([]byte(intermediatesPEM))
+
+	block, _ := pem.Decode([]byte(leafPEM))
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal("failed to parse the leaf:", err)
+	}
+
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       {{printf "%q" .DNSName}},
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+{{- if .ExpectRejection}}
+	if err == nil {
+		t.Error("expected the leaf to be rejected")
+	}
+{{- else}}
+	if err != nil {
+		t.Error("expected the leaf to be accepted:", err)
+	}
+{{- end}}
+}
+{{- else}}
+func main() {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(rootPEM)) {
+		fmt.Println("failed to parse the root")
+		os.Exit(2)
+	}
+	intermediates := x509.NewCertPool()
+	intermediates.AppendCertsFromPEM([]byte(intermediatesPEM))
+
+	block, _ := pem.Decode([]byte(leafPEM))
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		fmt.Println("failed to parse the leaf:", err)
+		os.Exit(2)
+	}
+
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       {{printf "%q" .DNSName}},
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	fmt.Println("Verify returned:", err)
+{{- if .ExpectRejection}}
+	if err == nil {
+		fmt.Println("expected the leaf to be rejected")
+		os.Exit(1)
+	}
+{{- else}}
+	if err != nil {
+		fmt.Println("expected the leaf to be accepted")
+		os.Exit(1)
+	}
+{{- end}}
+}
+{{- end}}
+`))
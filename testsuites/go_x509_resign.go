@@ -0,0 +1,477 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resigner re-issues the certificates of a corpus, preserving everything but
+// their keys, signatures and validity periods.
+type resigner struct {
+	keyType   string
+	newKeys   bool
+	notBefore time.Time
+	notAfter  time.Time
+	// rootKey, if not nil, is the key that the root is re-issued with,
+	// rather than a new one.
+	rootKey crypto.Signer
+
+	// issued maps the raw bytes of each original CA certificate to its
+	// replacement.
+	issued map[string]*resigned
+	// roots are the original roots.
+	roots []*x509.Certificate
+	// tests maps the name of each re-issued test to the DER of its leaf
+	// followed by its chain, for the DER form of the corpus.
+	tests map[string][][]byte
+}
+
+type resigned struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+var (
+	oidSubjectKeyId   = asn1.ObjectIdentifier{2, 5, 29, 14}
+	oidAuthorityKeyId = asn1.ObjectIdentifier{2, 5, 29, 35}
+)
+
+// resignCorpus implements the resign command, which re-issues every
+// certificate in a corpus with a fresh validity period and keys, keeping IDs,
+// names, serial numbers and extensions, so that expects.json remains valid.
+func resignCorpus(args []string) error {
+	flags := flag.NewFlagSet("resign", flag.ExitOnError)
+	corpusDir := flags.String("corpus", filepath.Join(baseDir, "certificates"), "The corpus directory to re-issue")
+	outputDir := flags.String("o", "", "The directory to write the re-issued corpus to, which defaults to the corpus directory")
+	notBefore := flags.String("not-before", "", "The start of the new validity period, as YYYY-MM-DD, which defaults to now")
+	days := flags.Int("days", 365, "The length of the new validity period in days")
+	keyType := flags.String("key-type", "rsa", "The type of new keys: \"rsa\", for 2048-bit RSA, or \"ecdsa\", for P-256")
+	newKeys := flags.Bool("new-keys", false, "Replace the leaf keys too, rather than reusing them. This is implied when changing key type")
+	rootSigner := flags.String("root-signer", "", "If set, the key to re-issue the root with, such as \"file:root.key\" or \"command:kms-signer --key root\", e.g. one held in an HSM or KMS")
+	flags.Parse(args)
+
+	if len(*outputDir) == 0 {
+		*outputDir = *corpusDir
+	}
+
+	r := &resigner{
+		keyType:   *keyType,
+		newKeys:   *newKeys,
+		notBefore: time.Now().UTC().Truncate(time.Second),
+		issued:    make(map[string]*resigned),
+		tests:     make(map[string][][]byte),
+	}
+	if len(*notBefore) > 0 {
+		t, err := time.Parse("2006-01-02", *notBefore)
+		if err != nil {
+			return err
+		}
+		r.notBefore = t
+	}
+	r.notAfter = r.notBefore.AddDate(0, 0, *days)
+
+	if _, err := r.newKey(); err != nil {
+		return err
+	}
+
+	if len(*rootSigner) > 0 {
+		var err error
+		if r.rootKey, err = openSigner(*rootSigner); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(*outputDir, 0755); err != nil {
+		return err
+	}
+
+	// The root is the only certificate that isn't issued by something
+	// else in the corpus.
+	roots, err := readPEMChain(filepath.Join(*corpusDir, "root.crt"))
+	if err != nil {
+		return err
+	}
+	r.roots = roots
+	if r.rootKey != nil && len(roots) != 1 {
+		return fmt.Errorf("root.crt has %d certificates, but -root-signer gives a single key", len(roots))
+	}
+	for _, root := range roots {
+		if _, err := r.resignCA(root, nil); err != nil {
+			return err
+		}
+	}
+	if err := r.writeCerts(filepath.Join(*outputDir, "root.crt"), roots); err != nil {
+		return err
+	}
+
+	leafPaths, err := filepath.Glob(filepath.Join(*corpusDir, "*.crt"))
+	if err != nil {
+		return err
+	}
+	for _, leafPath := range leafPaths {
+		name := strings.TrimSuffix(filepath.Base(leafPath), ".crt")
+		if name == "root" {
+			continue
+		}
+		if err := r.resignTest(*corpusDir, *outputDir, name); err != nil {
+			return fmt.Errorf("%s: %s", leafPath, err)
+		}
+	}
+
+	if err := r.writeDER(*corpusDir, *outputDir); err != nil {
+		return err
+	}
+	if err := updateManifestHashes(*corpusDir, *outputDir); err != nil {
+		return err
+	}
+
+	fmt.Printf("Re-issued %d tests, valid from %s to %s.\n", len(leafPaths)-1, r.notBefore.Format(time.RFC3339), r.notAfter.Format(time.RFC3339))
+	fmt.Printf("If this is the main corpus, copy root.crt to html/root.crt for the in-browser suite.\n")
+	return nil
+}
+
+// resignTest re-issues the leaf and chain of the test with the given name.
+func (r *resigner) resignTest(corpusDir, outputDir, name string) error {
+	chain, err := readPEMChain(filepath.Join(corpusDir, name+".chain"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	leaves, err := readPEMChain(filepath.Join(corpusDir, name+".crt"))
+	if err != nil {
+		return err
+	}
+	if len(leaves) != 1 {
+		return fmt.Errorf("expected a single certificate, but found %d", len(leaves))
+	}
+	leaf := leaves[0]
+
+	// The chain runs from the leaf's issuer to the root, so it's
+	// re-issued from the end.
+	for i := len(chain) - 1; i >= 0; i-- {
+		if _, err := r.resignCA(chain[i], r.findIssuer(chain[i], chain[i+1:])); err != nil {
+			return err
+		}
+	}
+
+	issuer := r.findIssuer(leaf, chain)
+	if issuer == nil {
+		return errors.New("the leaf's issuer isn't in the chain or the root")
+	}
+
+	keyPath := filepath.Join(corpusDir, name+".key")
+	var key crypto.Signer
+	if !r.newKeys {
+		key, err = readPrivateKey(keyPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if key != nil && !r.matchesKeyType(key) {
+			key = nil
+		}
+	}
+	if key == nil {
+		if key, err = r.newKey(); err != nil {
+			return err
+		}
+	}
+
+	newLeaf, err := r.issue(leaf, issuer, key)
+	if err != nil {
+		return err
+	}
+
+	if err := writePrivateKey(filepath.Join(outputDir, name+".key"), key); err != nil {
+		return err
+	}
+	if err := writePEMCerts(filepath.Join(outputDir, name+".crt"), newLeaf); err != nil {
+		return err
+	}
+	if err := r.writeCerts(filepath.Join(outputDir, name+".chain"), chain); err != nil {
+		return err
+	}
+
+	certs := [][]byte{newLeaf.Raw}
+	for _, cert := range chain {
+		certs = append(certs, r.issued[string(cert.Raw)].cert.Raw)
+	}
+	r.tests[name] = certs
+	return nil
+}
+
+// writeDER writes the DER form of the re-issued corpus to outputDir, if
+// corpusDir has one, for the same tests.
+func (r *resigner) writeDER(corpusDir, outputDir string) error {
+	indexBytes, err := ioutil.ReadFile(filepath.Join(corpusDir, "der", "index.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	index := new(derIndex)
+	if err := json.Unmarshal(indexBytes, index); err != nil {
+		return err
+	}
+	var ids []int
+	for _, entry := range index.Tests {
+		ids = append(ids, entry.Id)
+	}
+	return writeDERFiles(filepath.Join(outputDir, "der"), r, ids)
+}
+
+// root and test implement corpusReader over the re-issued certificates.
+func (r *resigner) root() ([]byte, error) {
+	if len(r.roots) != 1 {
+		return nil, fmt.Errorf("expected a single root in root.crt but found %d", len(r.roots))
+	}
+	return r.issued[string(r.roots[0].Raw)].cert.Raw, nil
+}
+
+func (r *resigner) test(id int) (leaf []byte, chain [][]byte, err error) {
+	certs, ok := r.tests[strconv.Itoa(id)]
+	if !ok {
+		return nil, nil, fmt.Errorf("der/index.json lists test %d, which wasn't re-issued", id)
+	}
+	return certs[0], certs[1:], nil
+}
+
+// findIssuer returns the re-issued certificate that issued cert, looking
+// first in candidates, which are original certificates, and then at the
+// roots. It returns nil for a self-signed certificate.
+func (r *resigner) findIssuer(cert *x509.Certificate, candidates []*x509.Certificate) *resigned {
+	for _, certs := range [][]*x509.Certificate{candidates, r.roots} {
+		for _, candidate := range certs {
+			if !candidate.Equal(cert) && cert.CheckSignatureFrom(candidate) == nil {
+				return r.issued[string(candidate.Raw)]
+			}
+		}
+	}
+	return nil
+}
+
+// resignCA re-issues a CA certificate with a new key, unless it has already
+// been re-issued. A nil issuer means that it's self-signed.
+func (r *resigner) resignCA(cert *x509.Certificate, issuer *resigned) (*resigned, error) {
+	if replacement, ok := r.issued[string(cert.Raw)]; ok {
+		return replacement, nil
+	}
+
+	key := r.rootKey
+	if issuer != nil || key == nil {
+		var err error
+		if key, err = r.newKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	newCert, err := r.issue(cert, issuer, key)
+	if err != nil {
+		return nil, err
+	}
+
+	replacement := &resigned{newCert, key}
+	r.issued[string(cert.Raw)] = replacement
+	return replacement, nil
+}
+
+// issue re-issues cert for key, signed by issuer or, if that's nil,
+// self-signed.
+func (r *resigner) issue(cert *x509.Certificate, issuer *resigned, key crypto.Signer) (*x509.Certificate, error) {
+	template := &x509.Certificate{
+		SerialNumber: cert.SerialNumber,
+		RawSubject:   cert.RawSubject,
+		NotBefore:    r.notBefore,
+		NotAfter:     r.notAfter,
+	}
+	// Extensions are carried over verbatim, except for the key
+	// identifiers, which are recomputed for the new keys.
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidSubjectKeyId) || ext.Id.Equal(oidAuthorityKeyId) {
+			continue
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, ext)
+	}
+	// These are only used to decide whether to generate a subject key
+	// identifier, since the extensions themselves are carried over.
+	template.BasicConstraintsValid = cert.BasicConstraintsValid
+	template.IsCA = cert.IsCA
+
+	parent, signer := template, key
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+func (r *resigner) newKey() (crypto.Signer, error) {
+	switch r.keyType {
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	return nil, fmt.Errorf("unknown key type %q", r.keyType)
+}
+
+func (r *resigner) matchesKeyType(key crypto.Signer) bool {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return r.keyType == "rsa"
+	case *ecdsa.PrivateKey:
+		return r.keyType == "ecdsa"
+	}
+	return false
+}
+
+// writeCerts writes the re-issued replacements of certs to path.
+func (r *resigner) writeCerts(path string, certs []*x509.Certificate) error {
+	var replacements []*x509.Certificate
+	for _, cert := range certs {
+		replacement, ok := r.issued[string(cert.Raw)]
+		if !ok {
+			return fmt.Errorf("%s: certificate wasn't re-issued", path)
+		}
+		replacements = append(replacements, replacement.cert)
+	}
+
+	return writePEMCerts(path, replacements...)
+}
+
+func writePEMCerts(path string, certs ...*x509.Certificate) error {
+	var out []byte
+	for _, cert := range certs {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return ioutil.WriteFile(path, out, 0644)
+}
+
+// readPrivateKey reads a PEM-encoded PKCS#1, SEC 1 or PKCS#8 private key.
+func readPrivateKey(path string) (crypto.Signer, error) {
+	pemBytes, err := readCorpusFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM block found in " + path)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported private key type %T", path, key)
+	}
+	return signer, nil
+}
+
+// writePrivateKey writes key in the same form as the generator does.
+func writePrivateKey(path string, key crypto.Signer) error {
+	var block *pem.Block
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	default:
+		return fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	return ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600)
+}
+
+// updateManifestHashes writes corpusDir's manifest.json to outputDir with the
+// hashes of the re-issued files, leaving everything else as it was.
+func updateManifestHashes(corpusDir, outputDir string) error {
+	manifestBytes, err := ioutil.ReadFile(filepath.Join(corpusDir, "manifest.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var manifest map[string]json.RawMessage
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return err
+	}
+
+	// Manifests from before corpus versioning have no hashes.
+	if manifest["files"] != nil {
+		var files map[string]string
+		if err := json.Unmarshal(manifest["files"], &files); err != nil {
+			return err
+		}
+		for name := range files {
+			contents, err := ioutil.ReadFile(filepath.Join(outputDir, name))
+			if err != nil {
+				return err
+			}
+			digest := sha256.Sum256(contents)
+			files[name] = hex.EncodeToString(digest[:])
+		}
+		if manifest["files"], err = json.Marshal(files); err != nil {
+			return err
+		}
+	}
+
+	manifestBytes, err = json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(outputDir, "manifest.json"), manifestBytes, 0644)
+}
@@ -0,0 +1,1220 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resultsFile represents the test results written by the test suites and the
+// in-browser runner. See html/results for examples.
+type resultsFile struct {
+	TestVersion int          `json:"testVersion"`
+	Date        int64        `json:"date"`
+	UserAgent   string       `json:"userAgent"`
+	OSVersion   string       `json:"osVersion"`
+	Results     []testResult `json:"results"`
+	// Skipped counts the verifications that weren't run, by category.
+	Skipped map[skipCategory]int `json:"skipped,omitempty"`
+	// Timing summarises the time taken by each verification, if known.
+	Timing *timingSummary `json:"timing,omitempty"`
+	// IntermediateDelivery is how intermediates were given to the
+	// verifier, if known. See the deliveryPool constants.
+	IntermediateDelivery string `json:"intermediateDelivery,omitempty"`
+	// ClientHellos holds the fingerprints of the ClientHellos that a live
+	// client sent, the most common first, so that results can be grouped
+	// by the client's actual TLS stack.
+	ClientHellos []clientHello `json:"clientHellos,omitempty"`
+	// AIAResults holds the results of the optional AIA tests.
+	AIAResults []aiaResult `json:"aiaResults,omitempty"`
+	// MalformedResults holds the results of the optional malformed
+	// certificate tests.
+	MalformedResults []malformedResult `json:"malformedResults,omitempty"`
+	// StressResults holds the results of the optional stress tests.
+	StressResults []stressResult `json:"stressResults,omitempty"`
+	// IPLiteralResults holds the results of the optional IP literal
+	// tests.
+	IPLiteralResults []ipLiteralResult `json:"ipLiteralResults,omitempty"`
+	// CTResults holds the results of the optional Certificate
+	// Transparency tests.
+	CTResults []ctResult `json:"ctResults,omitempty"`
+	// PolicyResults holds the results of the optional certificate policy
+	// tests, and PolicyEnforcement summarises them as whether the
+	// verifier enforces certificate policies: "enforced", "ignored",
+	// "partial" or, if it rejected valid policy chains, "misenforced".
+	PolicyResults     []policyResult `json:"policyResults,omitempty"`
+	PolicyEnforcement string         `json:"policyEnforcement,omitempty"`
+	// SMIMEResults holds the results of the optional S/MIME tests.
+	SMIMEResults []smimeResult `json:"smimeResults,omitempty"`
+	// ChainOrderResults holds the results of the optional chain order
+	// tests.
+	ChainOrderResults []chainOrderResult `json:"chainOrderResults,omitempty"`
+	// TrustAnchorResults holds the results of the optional trust anchor
+	// tests, and TrustAnchorBehaviour summarises them by the kind of field
+	// that the root carried, e.g. "nameConstraints", as whether the
+	// verifier "applied" the root's fields to the path, "ignored" them or
+	// did each in some tests ("mixed").
+	TrustAnchorResults   []trustAnchorResult `json:"trustAnchorResults,omitempty"`
+	TrustAnchorBehaviour map[string]string   `json:"trustAnchorBehaviour,omitempty"`
+	// CrossSignResults holds the results of the optional cross-sign
+	// tests.
+	CrossSignResults []crossSignResult `json:"crossSignResults,omitempty"`
+	// DistrustResults holds the results of the optional distrust tests,
+	// and DistrustSupport is whether the verifier could be given
+	// certificates to distrust: "SUPPORTED" or "UNSUPPORTED", in which
+	// case the tests weren't run.
+	DistrustResults []distrustResult `json:"distrustResults,omitempty"`
+	DistrustSupport string           `json:"distrustSupport,omitempty"`
+	// DepthResults holds the results of the optional chain depth tests,
+	// and MaxDepth is the depth, in certificates including the leaf and
+	// the root, of the deepest of them that the verifier accepted along
+	// with every shallower one. If it accepted them all, any limit that
+	// it has is deeper still.
+	DepthResults []depthResult `json:"depthResults,omitempty"`
+	MaxDepth     int           `json:"maxDepth,omitempty"`
+	// SerialCollisionResults holds the results of the optional serial
+	// collision tests.
+	SerialCollisionResults []serialCollisionResult `json:"serialCollisionResults,omitempty"`
+	// KeyUsageResults holds the results of the optional key usage tests,
+	// and KeyUsageEnforcement whether the verifier enforced the key usage
+	// of each component, "intermediate", "leaf" or "crlSigner":
+	// "enforced", "ignored" or "mixed".
+	KeyUsageResults     []keyUsageResult  `json:"keyUsageResults,omitempty"`
+	KeyUsageEnforcement map[string]string `json:"keyUsageEnforcement,omitempty"`
+	// ALPACAResults holds the results of the optional ALPACA tests, of
+	// certificates issued for services other than HTTPS.
+	ALPACAResults []alpacaResult `json:"alpacaResults,omitempty"`
+	// IDNAResults holds the results of the optional IDNA probes, and
+	// IDNAMapping summarises them by the kind of probe, "hostname" or
+	// "constraint", as the mapping that the verifier was detected to use:
+	// "IDNA2003", "IDNA2008", "BOTH", "NONE" or, if the probes disagree,
+	// "MIXED". It's informational rather than a grade.
+	IDNAResults []idnaResult      `json:"idnaResults,omitempty"`
+	IDNAMapping map[string]string `json:"idnaMapping,omitempty"`
+	// IntermediateCacheResults holds the outcomes of the scenarios of the
+	// intermediate-cache command, and IntermediateCaching summarises them
+	// as whether the client cached intermediates between connections:
+	// "CACHED", "NOT_CACHED", "MIXED" or, if no scenario could tell,
+	// "INCONCLUSIVE". Like IDNAMapping, it's informational rather than a
+	// grade.
+	IntermediateCacheResults []intermediateCacheResult `json:"intermediateCacheResults,omitempty"`
+	IntermediateCaching      string                    `json:"intermediateCaching,omitempty"`
+	// Capabilities is the capabilities file that the verifier was graded
+	// with, if known.
+	Capabilities *verifierCapabilities `json:"capabilities,omitempty"`
+	// Toolchain describes the Go toolchain used, if the results were
+	// produced by the toolchain command.
+	Toolchain *toolchainInfo `json:"toolchain,omitempty"`
+	// Metadata identifies the verifier and the corpus and system that it
+	// was run with, so that results files needn't be told apart by their
+	// names. It's missing from older results files.
+	Metadata *resultsMetadata `json:"metadata,omitempty"`
+
+	// name is not part of the results file but, here, is a short name
+	// for it derived from the file name.
+	name string
+}
+
+type testResult struct {
+	Id int `json:"id"`
+	// StableId is the test's stable ID, which, unlike Id, doesn't change
+	// when the corpus is renumbered. It's missing for corpora generated
+	// before stable IDs were added.
+	StableId string `json:"stableId,omitempty"`
+	// DNSResult and IPResult are true if the certificate was accepted and
+	// nil if the test wasn't run.
+	DNSResult *bool `json:"dnsResult,omitempty"`
+	IPResult  *bool `json:"ipResult,omitempty"`
+	// DNSError and IPError contain the error given when the certificate was
+	// rejected, if known.
+	DNSError string `json:"dnsError,omitempty"`
+	IPError  string `json:"ipError,omitempty"`
+	// DNSNanos and IPNanos are the wall time, in nanoseconds, taken by the
+	// verification, if known.
+	DNSNanos int64 `json:"dnsNanos,omitempty"`
+	IPNanos  int64 `json:"ipNanos,omitempty"`
+	// DNSInterpretation and IPInterpretation name the interpretation that
+	// the verifier followed, for tests that list interpretations.
+	DNSInterpretation string `json:"dnsInterpretation,omitempty"`
+	IPInterpretation  string `json:"ipInterpretation,omitempty"`
+	// DNSReason and IPReason classify the error given when the certificate
+	// was rejected. See errorReason.
+	DNSReason errorReason `json:"dnsReason,omitempty"`
+	IPReason  errorReason `json:"ipReason,omitempty"`
+	// ClientAuthResult is true if the leaf was accepted as a TLS client
+	// certificate and nil if that wasn't tested, and ClientAuthError is
+	// the error given if it was rejected.
+	ClientAuthResult *bool  `json:"clientAuthResult,omitempty"`
+	ClientAuthError  string `json:"clientAuthError,omitempty"`
+	// ClientAuthReason classifies ClientAuthError.
+	ClientAuthReason errorReason `json:"clientAuthReason,omitempty"`
+	// ClientAuthRetries is the number of times presenting the chain to a
+	// live server was retried after a network error, and ClientAuthFlaky
+	// is set if there were any, since the result may not be repeatable.
+	ClientAuthRetries int  `json:"clientAuthRetries,omitempty"`
+	ClientAuthFlaky   bool `json:"clientAuthFlaky,omitempty"`
+	// ClientAuthHandshakes holds the outcome of presenting the chain under
+	// each TLS version, keyed by its name, e.g. "TLS 1.3", since stacks
+	// can process certificates differently under each. The fields above
+	// combine them: the leaf only counts as accepted if it was accepted
+	// under every version.
+	ClientAuthHandshakes map[string]*clientAuthHandshake `json:"clientAuthHandshakes,omitempty"`
+}
+
+// clientAuthHandshake is the outcome of presenting a test's chain as a client
+// certificate under one TLS version.
+type clientAuthHandshake struct {
+	Accepted bool        `json:"accepted"`
+	Error    string      `json:"error,omitempty"`
+	Reason   errorReason `json:"reason,omitempty"`
+	Retries  int         `json:"retries,omitempty"`
+	// CipherSuite and ALPN are the cipher suite and application protocol
+	// negotiated, as far as the handshake got.
+	CipherSuite string `json:"cipherSuite,omitempty"`
+	ALPN        string `json:"alpn,omitempty"`
+}
+
+// timingSummary gives percentiles, in nanoseconds, of the time taken by the
+// verifications in a results file.
+type timingSummary struct {
+	Verifications int `json:"verifications"`
+	// Iterations is the number of times each verification was repeated.
+	Iterations int   `json:"iterations"`
+	P50Nanos   int64 `json:"p50Nanos"`
+	P90Nanos   int64 `json:"p90Nanos"`
+	P99Nanos   int64 `json:"p99Nanos"`
+	MaxNanos   int64 `json:"maxNanos"`
+}
+
+type aiaResult struct {
+	Id       int  `json:"id"`
+	Accepted bool `json:"accepted"`
+	// Delivery is always deliveryAIA, since the chains are incomplete.
+	Delivery string `json:"delivery"`
+	// Outcome is "OK", aiaOutcomeIncomplete or the error given.
+	Outcome string `json:"outcome"`
+}
+
+type malformedResult struct {
+	Id       int  `json:"id"`
+	Accepted bool `json:"accepted"`
+	// Rule is the rule that the certificate breaks, if any.
+	Rule string `json:"rule,omitempty"`
+	// Stage is stageParse or stageVerify if the certificate was rejected,
+	// and Reason classifies the error. Rejections while parsing are
+	// always reasonParseError.
+	Stage  string      `json:"stage,omitempty"`
+	Reason errorReason `json:"reason,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+type stressResult struct {
+	Id          int `json:"id"`
+	SANs        int `json:"sans"`
+	Constraints int `json:"constraints"`
+	// Outcome is stressOutcomeOK, stressOutcomeError or
+	// stressOutcomeTimeout.
+	Outcome string `json:"outcome"`
+	// Nanos is how long verification took, which is the timeout if it
+	// timed out.
+	Nanos int64  `json:"nanos"`
+	Error string `json:"error,omitempty"`
+}
+
+type ipLiteralResult struct {
+	Id int `json:"id"`
+	// Form and Hostname are the form of the IP literal and the literal
+	// itself.
+	Form     string `json:"form"`
+	Hostname string `json:"hostname"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+type ctResult struct {
+	Id int `json:"id"`
+	// Delivery is how the test's SCTs were delivered.
+	Delivery string `json:"delivery"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+type policyResult struct {
+	Id int `json:"id"`
+	// Name identifies the case.
+	Name     string `json:"name"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+type chainOrderResult struct {
+	Id int `json:"id"`
+	// Name identifies the case.
+	Name     string `json:"name"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+type trustAnchorResult struct {
+	Id int `json:"id"`
+	// Name identifies the case, Property is the kind of field that its
+	// root carried and RootProperties describes the root's fields.
+	Name           string                 `json:"name"`
+	Property       string                 `json:"property"`
+	RootProperties map[string]interface{} `json:"rootProperties,omitempty"`
+	Accepted       bool                   `json:"accepted"`
+	Error          string                 `json:"error,omitempty"`
+}
+
+type crossSignResult struct {
+	Id int `json:"id"`
+	// Name identifies the case, and Trusted labels the roots that the
+	// verifier trusted.
+	Name     string   `json:"name"`
+	Trusted  []string `json:"trusted"`
+	Accepted bool     `json:"accepted"`
+	Error    string   `json:"error,omitempty"`
+}
+
+type distrustResult struct {
+	Id int `json:"id"`
+	// Name identifies the case, and Distrusted labels the certificates
+	// that the verifier was to distrust.
+	Name       string   `json:"name"`
+	Distrusted []string `json:"distrusted"`
+	// Status is "UNSUPPORTED" if the test wasn't run because the verifier
+	// can't distrust certificates, in which case Accepted is meaningless.
+	Status   string `json:"status"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+type serialCollisionResult struct {
+	Id int `json:"id"`
+	// Name identifies the case, and Presented labels the certificates
+	// presented after the leaf, in order.
+	Name      string   `json:"name"`
+	Presented []string `json:"presented"`
+	// Selected labels the presented certificate that issued the leaf in
+	// the path that the verifier built, if it accepted the chain and the
+	// harness could tell.
+	Selected string `json:"selected,omitempty"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+type alpacaResult struct {
+	Id int `json:"id"`
+	// Name identifies the case, and Service is the protocol that the
+	// certificate was issued for.
+	Name     string `json:"name"`
+	Service  string `json:"service"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+type intermediateCacheResult struct {
+	// Id and ControlId are the main corpus tests served as the scenario's
+	// primed and control tests.
+	Id        int `json:"id"`
+	ControlId int `json:"controlId"`
+	// PrimeAccepted is whether the client accepted the primed test with
+	// its full chain, ProbeAccepted whether it then accepted it with the
+	// leaf alone, on a later connection, and ControlAccepted whether it
+	// accepted the control with the leaf alone.
+	PrimeAccepted   bool   `json:"primeAccepted"`
+	PrimeError      string `json:"primeError,omitempty"`
+	ProbeAccepted   bool   `json:"probeAccepted"`
+	ProbeError      string `json:"probeError,omitempty"`
+	ControlAccepted bool   `json:"controlAccepted"`
+	ControlError    string `json:"controlError,omitempty"`
+	// Outcome is cacheOutcomeCached, cacheOutcomeNotCached or
+	// cacheOutcomeInconclusive.
+	Outcome string `json:"outcome"`
+}
+
+type keyUsageResult struct {
+	Id int `json:"id"`
+	// Name identifies the case, Component is the certificate whose key
+	// usage it tests, and KeyExchange and CRL the intended usage that the
+	// verifier was given.
+	Name        string `json:"name"`
+	Component   string `json:"component"`
+	KeyExchange string `json:"keyExchange"`
+	CRL         bool   `json:"crl"`
+	// Status is "UNSUPPORTED" if the test wasn't run because the verifier
+	// can't be given the intended usage, in which case Accepted is
+	// meaningless.
+	Status   string `json:"status,omitempty"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+type depthResult struct {
+	Id int `json:"id"`
+	// Depth is the number of certificates in the path.
+	Depth    int    `json:"depth"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+type idnaResult struct {
+	Id int `json:"id"`
+	// Probe, Kind and Mapping identify the probe and the mapping that it
+	// detects.
+	Probe    string `json:"probe"`
+	Kind     string `json:"kind"`
+	Mapping  string `json:"mapping"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+type smimeResult struct {
+	Id int `json:"id"`
+	// Name identifies the case, and Email is the email address that the
+	// certificate was verified against.
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+// result returns whether the certificate was accepted and the error given if
+// it wasn't. ran is false if the test wasn't run.
+func (r *testResult) result(testDNS bool) (accepted, ran bool, errString string) {
+	if testDNS {
+		if r.DNSResult == nil {
+			return false, false, ""
+		}
+		return *r.DNSResult, true, r.DNSError
+	}
+
+	if r.IPResult == nil {
+		return false, false, ""
+	}
+	return *r.IPResult, true, r.IPError
+}
+
+// reason returns the classification of the error given if the certificate
+// was rejected, or "" if it wasn't or the results file predates reasons.
+func (r *testResult) reason(testDNS bool) errorReason {
+	if testDNS {
+		return r.DNSReason
+	}
+	return r.IPReason
+}
+
+// resultsMetadata is the metadata block of a results file.
+type resultsMetadata struct {
+	// Implementation names the verifier, e.g. "Go crypto/x509" or
+	// "OpenSSL".
+	Implementation string `json:"implementation"`
+	// ImplementationVersion is the verifier's version, as it reports it,
+	// e.g. "go1.22.1" or "3.0.2", if it could be detected.
+	ImplementationVersion string `json:"implementationVersion,omitempty"`
+	CorpusVersion         int    `json:"corpusVersion"`
+	// OS and Arch are those of the harness, as in GOOS and GOARCH.
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+	// CNPolicy is the Common Name fallback policy that the main corpus
+	// was verified under, cnAllowed or cnIgnored, whether the verifier's
+	// own or one set with -cn-policy. It's empty if it isn't known.
+	CNPolicy string `json:"cnPolicy,omitempty"`
+	// Image is the Docker image that the verifier was run in, by digest
+	// if it was pinned by one or could be resolved to one. It's empty
+	// for verifiers run outside Docker.
+	Image string `json:"image,omitempty"`
+}
+
+// resultRecorder collects the result of every verification so that they can
+// be written out as a results file. It's safe for concurrent use.
+type resultRecorder struct {
+	sync.Mutex
+	// userAgent identifies the verifier in the results file.
+	userAgent string
+	// implementation and implementationVersion identify it in the
+	// results file's metadata.
+	implementation        string
+	implementationVersion string
+	// cnPolicy is the Common Name policy in the results file's metadata.
+	cnPolicy string
+	// image is the Docker image in the results file's metadata.
+	image string
+	// clientHellos are the fingerprints of a live client's ClientHellos.
+	clientHellos []clientHello
+	// taxonomy is the key in errorTaxonomy of the table that the
+	// verifier's errors are classified with.
+	taxonomy        string
+	delivery        string
+	results         map[int]*testResult
+	aiaResults      []aiaResult
+	malformed       []malformedResult
+	stress          []stressResult
+	ipLiterals      []ipLiteralResult
+	ct              []ctResult
+	policies        []policyResult
+	smime           []smimeResult
+	chainOrder      []chainOrderResult
+	trustAnchor     []trustAnchorResult
+	crossSign       []crossSignResult
+	distrust        []distrustResult
+	depth           []depthResult
+	keyUsage        []keyUsageResult
+	serialCollision []serialCollisionResult
+	alpaca          []alpacaResult
+	idna            []idnaResult
+	cache           []intermediateCacheResult
+	// capabilities are those that the verifier was graded with.
+	capabilities *verifierCapabilities
+	// policyEnforcement summarises the policy results.
+	policyEnforcement string
+	// trustAnchorBehaviour summarises the trust anchor results.
+	trustAnchorBehaviour map[string]string
+	// distrustSupport summarises the distrust results.
+	distrustSupport string
+	// maxDepth summarises the depth results.
+	maxDepth int
+	// keyUsageEnforcement summarises the key usage results.
+	keyUsageEnforcement map[string]string
+	// idnaMapping summarises the IDNA probe results.
+	idnaMapping map[string]string
+	// intermediateCaching summarises the intermediate caching results.
+	intermediateCaching string
+	// signingKey, if set, signs the results file.
+	signingKey ed25519.PrivateKey
+	skips      map[skip]int
+}
+
+// newResultRecorder returns a recorder for results where intermediates were
+// delivered as described by delivery.
+func newResultRecorder(delivery string) *resultRecorder {
+	return &resultRecorder{userAgent: "Go " + runtime.Version(), implementation: "Go crypto/x509", implementationVersion: runtime.Version(), taxonomy: "go", delivery: delivery, results: make(map[int]*testResult), skips: make(map[skip]int)}
+}
+
+// record notes the error, or lack thereof, from verifying test and the time
+// that the verification took.
+func (r *resultRecorder) record(test *expectation, verifyErr error, elapsed time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	result, ok := r.results[test.Id]
+	if !ok {
+		result = &testResult{Id: test.Id, StableId: test.StableId}
+		r.results[test.Id] = result
+	}
+
+	accepted := verifyErr == nil
+	var errString string
+	if verifyErr != nil {
+		errString = verifyErr.Error()
+	}
+
+	if test.testDNS {
+		result.DNSResult = &accepted
+		result.DNSError = errString
+		result.DNSReason = errorReasonOf(r.taxonomy, verifyErr)
+		result.DNSNanos = int64(elapsed)
+		if followed := test.DNS.interpretationOf(accepted); followed != nil {
+			result.DNSInterpretation = followed.Name
+		}
+	} else {
+		result.IPResult = &accepted
+		result.IPError = errString
+		result.IPReason = errorReasonOf(r.taxonomy, verifyErr)
+		result.IPNanos = int64(elapsed)
+		if followed := test.IP.interpretationOf(accepted); followed != nil {
+			result.IPInterpretation = followed.Name
+		}
+	}
+}
+
+// recordClientAuth notes the error, or lack thereof, from verifying the leaf
+// of test as a client certificate under the TLS version named version, after
+// retries retries, with state describing the handshake.
+func (r *resultRecorder) recordClientAuth(test *expectation, version string, state tls.ConnectionState, verifyErr error, retries int) {
+	r.Lock()
+	defer r.Unlock()
+
+	result, ok := r.results[test.Id]
+	if !ok {
+		result = &testResult{Id: test.Id, StableId: test.StableId}
+		r.results[test.Id] = result
+	}
+	if result.ClientAuthHandshakes == nil {
+		result.ClientAuthHandshakes = make(map[string]*clientAuthHandshake)
+	}
+
+	handshake := &clientAuthHandshake{Accepted: verifyErr == nil, Reason: errorReasonOf(r.taxonomy, verifyErr), Retries: retries, ALPN: state.NegotiatedProtocol}
+	if verifyErr != nil {
+		handshake.Error = verifyErr.Error()
+	}
+	if state.CipherSuite != 0 {
+		handshake.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	}
+	result.ClientAuthHandshakes[version] = handshake
+
+	// The combined result is that of the first version, in order, that
+	// rejected the leaf, if any did.
+	versions := make([]string, 0, len(result.ClientAuthHandshakes))
+	for version := range result.ClientAuthHandshakes {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	accepted := true
+	result.ClientAuthError = ""
+	result.ClientAuthReason = ""
+	result.ClientAuthRetries = 0
+	for _, version := range versions {
+		handshake := result.ClientAuthHandshakes[version]
+		if !handshake.Accepted && accepted {
+			accepted = false
+			result.ClientAuthError = fmt.Sprintf("%s: %s", version, handshake.Error)
+			result.ClientAuthReason = handshake.Reason
+		}
+		result.ClientAuthRetries += handshake.Retries
+	}
+	result.ClientAuthResult = &accepted
+	result.ClientAuthFlaky = result.ClientAuthRetries > 0
+}
+
+// recordSkip notes that a verification wasn't run.
+func (r *resultRecorder) recordSkip(reason *skip) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.skips[*reason]++
+}
+
+// printSkips prints a breakdown of the verifications that weren't run, so
+// that they aren't hidden from view.
+func (r *resultRecorder) printSkips() {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.skips) == 0 {
+		return
+	}
+
+	var reasons []skip
+	total := 0
+	for reason, count := range r.skips {
+		reasons = append(reasons, reason)
+		total += count
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if reasons[i].Category != reasons[j].Category {
+			return reasons[i].Category < reasons[j].Category
+		}
+		return reasons[i].Detail < reasons[j].Detail
+	})
+
+	fmt.Printf("Skipped %d verifications:\n", total)
+	for _, reason := range reasons {
+		fmt.Printf("  %s: %d (%s)\n", reason.Category, r.skips[reason], reason.Detail)
+	}
+}
+
+// recordAIA notes the outcome of an AIA test.
+func (r *resultRecorder) recordAIA(id int, accepted bool, outcome string) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.aiaResults = append(r.aiaResults, aiaResult{Id: id, Accepted: accepted, Delivery: deliveryAIA, Outcome: outcome})
+}
+
+// recordMalformed notes the outcome of a malformed certificate test. stage is
+// where the certificate was rejected, if it was.
+func (r *resultRecorder) recordMalformed(test *malformedExpectation, stage string, verifyErr error) {
+	r.Lock()
+	defer r.Unlock()
+
+	result := malformedResult{Id: test.Id, Accepted: verifyErr == nil, Rule: test.Rule, Stage: stage}
+	if verifyErr != nil {
+		result.Error = verifyErr.Error()
+		result.Reason = errorReasonOf(r.taxonomy, verifyErr)
+		if stage == stageParse {
+			result.Reason = reasonParseError
+		}
+	}
+	r.malformed = append(r.malformed, result)
+}
+
+// recordStress notes the outcome of a stress test.
+func (r *resultRecorder) recordStress(test *stressExpectation, outcome string, elapsed time.Duration, verifyErr error) {
+	r.Lock()
+	defer r.Unlock()
+
+	result := stressResult{Id: test.Id, SANs: test.SANs, Constraints: test.Constraints, Outcome: outcome, Nanos: elapsed.Nanoseconds()}
+	if verifyErr != nil {
+		result.Error = verifyErr.Error()
+	}
+	r.stress = append(r.stress, result)
+}
+
+// recordIPLiteral notes the outcome of an IP literal test.
+func (r *resultRecorder) recordIPLiteral(test *ipLiteralExpectation, verifyErr error) {
+	r.Lock()
+	defer r.Unlock()
+
+	result := ipLiteralResult{Id: test.Id, Form: test.Form, Hostname: test.Hostname, Accepted: verifyErr == nil}
+	if verifyErr != nil {
+		result.Error = verifyErr.Error()
+	}
+	r.ipLiterals = append(r.ipLiterals, result)
+}
+
+// recordCT notes the outcome of a Certificate Transparency test.
+func (r *resultRecorder) recordCT(test *ctExpectation, verifyErr error) {
+	r.Lock()
+	defer r.Unlock()
+
+	result := ctResult{Id: test.Id, Delivery: test.Delivery, Accepted: verifyErr == nil}
+	if verifyErr != nil {
+		result.Error = verifyErr.Error()
+	}
+	r.ct = append(r.ct, result)
+}
+
+// recordPolicy notes the outcome of a certificate policy test.
+func (r *resultRecorder) recordPolicy(test *policyExpectation, verifyErr error) {
+	r.Lock()
+	defer r.Unlock()
+
+	result := policyResult{Id: test.Id, Name: test.Name, Accepted: verifyErr == nil}
+	if verifyErr != nil {
+		result.Error = verifyErr.Error()
+	}
+	r.policies = append(r.policies, result)
+}
+
+// recordSMIME notes the outcome of an S/MIME test.
+func (r *resultRecorder) recordSMIME(test *smimeExpectation, verifyErr error) {
+	r.Lock()
+	defer r.Unlock()
+
+	result := smimeResult{Id: test.Id, Name: test.Name, Email: test.Email, Accepted: verifyErr == nil}
+	if verifyErr != nil {
+		result.Error = verifyErr.Error()
+	}
+	r.smime = append(r.smime, result)
+}
+
+// recordChainOrder notes the outcome of a chain order test.
+func (r *resultRecorder) recordChainOrder(test *chainOrderExpectation, verifyErr error) {
+	r.Lock()
+	defer r.Unlock()
+
+	result := chainOrderResult{Id: test.Id, Name: test.Name, Accepted: verifyErr == nil}
+	if verifyErr != nil {
+		result.Error = verifyErr.Error()
+	}
+	r.chainOrder = append(r.chainOrder, result)
+}
+
+// recordTrustAnchor notes the outcome of a trust anchor test.
+func (r *resultRecorder) recordTrustAnchor(test *trustAnchorExpectation, verifyErr error) {
+	r.Lock()
+	defer r.Unlock()
+
+	result := trustAnchorResult{Id: test.Id, Name: test.Name, Property: test.Property, RootProperties: test.RootProperties, Accepted: verifyErr == nil}
+	if verifyErr != nil {
+		result.Error = verifyErr.Error()
+	}
+	r.trustAnchor = append(r.trustAnchor, result)
+}
+
+// recordCrossSign notes the outcome of a cross-sign test.
+func (r *resultRecorder) recordCrossSign(test *crossSignExpectation, verifyErr error) {
+	r.Lock()
+	defer r.Unlock()
+
+	result := crossSignResult{Id: test.Id, Name: test.Name, Trusted: test.Trusted, Accepted: verifyErr == nil}
+	if verifyErr != nil {
+		result.Error = verifyErr.Error()
+	}
+	r.crossSign = append(r.crossSign, result)
+}
+
+// recordDistrust notes the outcome of a distrust test, which has the given
+// status; verifyErr is ignored if it wasn't run.
+func (r *resultRecorder) recordDistrust(test *distrustExpectation, status string, verifyErr error) {
+	r.Lock()
+	defer r.Unlock()
+
+	result := distrustResult{Id: test.Id, Name: test.Name, Distrusted: test.Distrusted, Status: status}
+	if status != distrustUnsupported {
+		result.Accepted = verifyErr == nil
+		if verifyErr != nil {
+			result.Error = verifyErr.Error()
+		}
+	}
+	r.distrust = append(r.distrust, result)
+}
+
+// recordDepth notes the outcome of a chain depth test.
+func (r *resultRecorder) recordDepth(test *depthExpectation, verifyErr error) {
+	r.Lock()
+	defer r.Unlock()
+
+	result := depthResult{Id: test.Id, Depth: test.Depth, Accepted: verifyErr == nil}
+	if verifyErr != nil {
+		result.Error = verifyErr.Error()
+	}
+	r.depth = append(r.depth, result)
+}
+
+// recordSerialCollision notes the outcome of a serial collision test, whose
+// path went through the presented certificate labelled selected, if known.
+func (r *resultRecorder) recordSerialCollision(test *serialCollisionExpectation, selected string, verifyErr error) {
+	r.Lock()
+	defer r.Unlock()
+
+	result := serialCollisionResult{Id: test.Id, Name: test.Name, Presented: test.Presented, Selected: selected, Accepted: verifyErr == nil}
+	if verifyErr != nil {
+		result.Error = verifyErr.Error()
+	}
+	r.serialCollision = append(r.serialCollision, result)
+}
+
+// recordALPACA notes the outcome of an ALPACA test.
+func (r *resultRecorder) recordALPACA(test *alpacaExpectation, verifyErr error) {
+	r.Lock()
+	defer r.Unlock()
+
+	result := alpacaResult{Id: test.Id, Name: test.Name, Service: test.Service, Accepted: verifyErr == nil}
+	if verifyErr != nil {
+		result.Error = verifyErr.Error()
+	}
+	r.alpaca = append(r.alpaca, result)
+}
+
+// recordKeyUsage notes the outcome of a key usage test, which has the given
+// status; verifyErr is ignored if it wasn't run.
+func (r *resultRecorder) recordKeyUsage(test *keyUsageExpectation, status string, verifyErr error) {
+	r.Lock()
+	defer r.Unlock()
+
+	result := keyUsageResult{Id: test.Id, Name: test.Name, Component: test.Component, KeyExchange: test.KeyExchange, CRL: test.CRL, Status: status}
+	if status != keyUsageUnsupported {
+		result.Accepted = verifyErr == nil
+		if verifyErr != nil {
+			result.Error = verifyErr.Error()
+		}
+	}
+	r.keyUsage = append(r.keyUsage, result)
+}
+
+// recordIDNA notes the outcome of an IDNA probe.
+func (r *resultRecorder) recordIDNA(test *idnaExpectation, verifyErr error) {
+	r.Lock()
+	defer r.Unlock()
+
+	result := idnaResult{Id: test.Id, Probe: test.Probe, Kind: test.Kind, Mapping: test.Mapping, Accepted: verifyErr == nil}
+	if verifyErr != nil {
+		result.Error = verifyErr.Error()
+	}
+	r.idna = append(r.idna, result)
+}
+
+// recordIntermediateCache notes the outcome of an intermediate caching
+// scenario.
+func (r *resultRecorder) recordIntermediateCache(result intermediateCacheResult) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.cache = append(r.cache, result)
+}
+
+// resultOf returns a copy of the result recorded so far for test id, or nil
+// if there isn't one.
+func (r *resultRecorder) resultOf(id int) *testResult {
+	r.Lock()
+	defer r.Unlock()
+	result, ok := r.results[id]
+	if !ok {
+		return nil
+	}
+	copied := *result
+	return &copied
+}
+
+// restore records the DNS or IP half of saved, a result recorded by an earlier
+// run, as if the verification had been repeated.
+func (r *resultRecorder) restore(saved *testResult, testDNS bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	result, ok := r.results[saved.Id]
+	if !ok {
+		result = &testResult{Id: saved.Id, StableId: saved.StableId}
+		r.results[saved.Id] = result
+	}
+
+	if testDNS {
+		result.DNSResult = saved.DNSResult
+		result.DNSError = saved.DNSError
+		result.DNSReason = saved.DNSReason
+		result.DNSNanos = saved.DNSNanos
+		result.DNSInterpretation = saved.DNSInterpretation
+	} else {
+		result.IPResult = saved.IPResult
+		result.IPError = saved.IPError
+		result.IPReason = saved.IPReason
+		result.IPNanos = saved.IPNanos
+		result.IPInterpretation = saved.IPInterpretation
+	}
+}
+
+// scratch returns an empty recorder that classifies errors as r does, for a
+// verification whose results are only wanted in r once it's finished, when
+// they're added with merge.
+func (r *resultRecorder) scratch() *resultRecorder {
+	scratch := newResultRecorder(r.delivery)
+	scratch.taxonomy = r.taxonomy
+	return scratch
+}
+
+// merge records the DNS or IP half of test's result, and the skips, that
+// scratch recorded.
+func (r *resultRecorder) merge(scratch *resultRecorder, test *expectation) {
+	if result := scratch.resultOf(test.Id); result != nil {
+		r.restore(result, test.testDNS)
+	}
+
+	scratch.Lock()
+	defer scratch.Unlock()
+	r.Lock()
+	defer r.Unlock()
+	for reason, n := range scratch.skips {
+		r.skips[reason] += n
+	}
+}
+
+// setImplementation sets the verifier's name and version in the results file's
+// metadata. version is empty if it isn't known.
+func (r *resultRecorder) setImplementation(name, version string) {
+	r.Lock()
+	defer r.Unlock()
+	r.implementation = name
+	r.implementationVersion = version
+}
+
+// setImage sets the Docker image in the results file's metadata.
+func (r *resultRecorder) setImage(image string) {
+	r.Lock()
+	defer r.Unlock()
+	r.image = image
+}
+
+// setCNPolicy sets the Common Name fallback policy in the results file's
+// metadata.
+func (r *resultRecorder) setCNPolicy(policy string) {
+	r.Lock()
+	defer r.Unlock()
+	r.cnPolicy = policy
+}
+
+// setClientHellos sets the fingerprints of the live client's ClientHellos.
+func (r *resultRecorder) setClientHellos(hellos []clientHello) {
+	r.Lock()
+	defer r.Unlock()
+	r.clientHellos = hellos
+}
+
+// setSigningKey makes write sign the results file with key, if it's set.
+func (r *resultRecorder) setSigningKey(key ed25519.PrivateKey) {
+	r.Lock()
+	defer r.Unlock()
+	r.signingKey = key
+}
+
+func (r *resultRecorder) setPolicyEnforcement(enforcement string) {
+	r.Lock()
+	defer r.Unlock()
+	r.policyEnforcement = enforcement
+}
+
+func (r *resultRecorder) setTrustAnchorBehaviour(property, behaviour string) {
+	r.Lock()
+	defer r.Unlock()
+	if r.trustAnchorBehaviour == nil {
+		r.trustAnchorBehaviour = make(map[string]string)
+	}
+	r.trustAnchorBehaviour[property] = behaviour
+}
+
+func (r *resultRecorder) setDistrustSupport(support string) {
+	r.Lock()
+	defer r.Unlock()
+	r.distrustSupport = support
+}
+
+func (r *resultRecorder) setMaxDepth(depth int) {
+	r.Lock()
+	defer r.Unlock()
+	r.maxDepth = depth
+}
+
+func (r *resultRecorder) setKeyUsageEnforcement(component, enforcement string) {
+	r.Lock()
+	defer r.Unlock()
+	if r.keyUsageEnforcement == nil {
+		r.keyUsageEnforcement = make(map[string]string)
+	}
+	r.keyUsageEnforcement[component] = enforcement
+}
+
+func (r *resultRecorder) setIDNAMapping(kind, mapping string) {
+	r.Lock()
+	defer r.Unlock()
+	if r.idnaMapping == nil {
+		r.idnaMapping = make(map[string]string)
+	}
+	r.idnaMapping[kind] = mapping
+}
+
+func (r *resultRecorder) setIntermediateCaching(caching string) {
+	r.Lock()
+	defer r.Unlock()
+	r.intermediateCaching = caching
+}
+
+// timedVerification is the time taken by one verification of a test.
+type timedVerification struct {
+	id      int
+	testDNS bool
+	nanos   int64
+}
+
+// verifications returns every timed verification, slowest first. It must be
+// called with r locked.
+func (r *resultRecorder) verifications() []timedVerification {
+	var ret []timedVerification
+	for _, result := range r.results {
+		if result.DNSNanos > 0 {
+			ret = append(ret, timedVerification{result.Id, true, result.DNSNanos})
+		}
+		if result.IPNanos > 0 {
+			ret = append(ret, timedVerification{result.Id, false, result.IPNanos})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].nanos > ret[j].nanos
+	})
+
+	return ret
+}
+
+// timing summarises the recorded times. It returns nil if nothing was timed
+// and must be called with r locked.
+func (r *resultRecorder) timing() *timingSummary {
+	verifications := r.verifications()
+	if len(verifications) == 0 {
+		return nil
+	}
+
+	// verifications is sorted slowest first.
+	percentile := func(p int) int64 {
+		return verifications[(len(verifications)-1)*(100-p)/100].nanos
+	}
+
+	return &timingSummary{
+		Verifications: len(verifications),
+		Iterations:    benchIterations,
+		P50Nanos:      percentile(50),
+		P90Nanos:      percentile(90),
+		P99Nanos:      percentile(99),
+		MaxNanos:      verifications[0].nanos,
+	}
+}
+
+// printTiming prints the timing percentiles and the n slowest tests, to help
+// find pathological cases.
+func (r *resultRecorder) printTiming(n int) {
+	r.Lock()
+	defer r.Unlock()
+
+	summary := r.timing()
+	if summary == nil {
+		return
+	}
+
+	fmt.Printf("Timing of %d verifications, each repeated %d times: p50 %s, p90 %s, p99 %s, max %s\n",
+		summary.Verifications, summary.Iterations, time.Duration(summary.P50Nanos), time.Duration(summary.P90Nanos),
+		time.Duration(summary.P99Nanos), time.Duration(summary.MaxNanos))
+
+	verifications := r.verifications()
+	if len(verifications) > n {
+		verifications = verifications[:n]
+	}
+	fmt.Printf("Slowest tests:\n")
+	for _, v := range verifications {
+		kind := "IP"
+		if v.testDNS {
+			kind = "DNS"
+		}
+		fmt.Printf("  #%d (%s): %s\n", v.id, kind, time.Duration(v.nanos))
+	}
+}
+
+// skippedByCategory returns the number of skipped verifications in each
+// category, or nil if there were none. It must be called with r locked.
+func (r *resultRecorder) skippedByCategory() map[skipCategory]int {
+	if len(r.skips) == 0 {
+		return nil
+	}
+
+	ret := make(map[skipCategory]int)
+	for reason, count := range r.skips {
+		ret[reason.Category] += count
+	}
+	return ret
+}
+
+// write writes the recorded results to path.
+func (r *resultRecorder) write(path string, testVersion int) error {
+	r.Lock()
+	defer r.Unlock()
+
+	out := resultsFile{
+		TestVersion:              testVersion,
+		Date:                     time.Now().UnixNano() / int64(time.Millisecond),
+		UserAgent:                r.userAgent,
+		OSVersion:                runtime.GOOS + "/" + runtime.GOARCH,
+		Timing:                   r.timing(),
+		Skipped:                  r.skippedByCategory(),
+		ClientHellos:             r.clientHellos,
+		AIAResults:               r.aiaResults,
+		MalformedResults:         r.malformed,
+		StressResults:            r.stress,
+		IPLiteralResults:         r.ipLiterals,
+		CTResults:                r.ct,
+		PolicyResults:            r.policies,
+		PolicyEnforcement:        r.policyEnforcement,
+		SMIMEResults:             r.smime,
+		ChainOrderResults:        r.chainOrder,
+		TrustAnchorResults:       r.trustAnchor,
+		TrustAnchorBehaviour:     r.trustAnchorBehaviour,
+		CrossSignResults:         r.crossSign,
+		DistrustResults:          r.distrust,
+		DistrustSupport:          r.distrustSupport,
+		DepthResults:             r.depth,
+		MaxDepth:                 r.maxDepth,
+		SerialCollisionResults:   r.serialCollision,
+		KeyUsageResults:          r.keyUsage,
+		KeyUsageEnforcement:      r.keyUsageEnforcement,
+		ALPACAResults:            r.alpaca,
+		IDNAResults:              r.idna,
+		IDNAMapping:              r.idnaMapping,
+		IntermediateCacheResults: r.cache,
+		IntermediateCaching:      r.intermediateCaching,
+		IntermediateDelivery:     r.delivery,
+		Capabilities:             r.capabilities,
+		Metadata: &resultsMetadata{
+			Implementation:        r.implementation,
+			ImplementationVersion: r.implementationVersion,
+			CorpusVersion:         testVersion,
+			OS:                    runtime.GOOS,
+			Arch:                  runtime.GOARCH,
+			CNPolicy:              r.cnPolicy,
+			Image:                 r.image,
+		},
+	}
+	for _, result := range r.results {
+		out.Results = append(out.Results, *result)
+	}
+	sort.Slice(out.Results, func(i, j int) bool {
+		return out.Results[i].Id < out.Results[j].Id
+	})
+
+	resultsBytes, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path, resultsBytes, 0644); err != nil {
+		return err
+	}
+	if r.signingKey != nil {
+		return ioutil.WriteFile(path+resultsSignatureSuffix, ed25519.Sign(r.signingKey, resultsBytes), 0644)
+	}
+	return nil
+}
+
+func loadResults(path string) (*resultsFile, error) {
+	resultsBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := new(resultsFile)
+	if err := json.Unmarshal(resultsBytes, ret); err != nil {
+		return nil, err
+	}
+	ret.name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	return ret, nil
+}
+
+// deliveryName returns a results file's IntermediateDelivery, which is missing
+// from results files that predate it and from other harnesses, which give
+// each test's chain.
+func deliveryName(delivery string) string {
+	if delivery == "" {
+		return deliveryPool
+	}
+	return delivery
+}
+
+// classifyResult compares whether a certificate was accepted with the
+// expected result and returns whether that counts as a pass along with a
+// short description. This matches the classification used by the in-browser
+// runner.
+func classifyResult(expect string, accepted bool) (passed bool, description string) {
+	if accepted {
+		if expect == "OK" || expect == "WEAK-OK" {
+			return true, "OK"
+		}
+		return false, "False Negative"
+	}
+
+	switch expect {
+	case "OK":
+		return false, "False Positive"
+	case "WEAK-OK":
+		return true, "False Positive (OK)"
+	}
+	return true, "OK"
+}
+
+// gradeResult is classifyResult for expect, except that a rejection for a
+// reason that expect doesn't allow fails as "Wrong Reason".
+func gradeResult(expect *expectedResult, accepted bool, reason errorReason) (passed bool, description string) {
+	passed, description = classifyResult(expect.Result, accepted)
+	if passed && !accepted && expect.Result == "ERROR" && !expect.reasonAcceptable(reason) {
+		return false, "Wrong Reason"
+	}
+	return passed, description
+}
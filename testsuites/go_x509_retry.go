@@ -0,0 +1,64 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// retryPolicy is how often, and after how long, to repeat an attempt against a
+// live server that failed with a transient network error.
+type retryPolicy struct {
+	// retries is the number of times to repeat an attempt.
+	retries int
+	// backoff is the wait before the first retry, which doubles for each
+	// retry after it.
+	backoff time.Duration
+}
+
+// run calls attempt until it returns nil or an error that isn't transient, or
+// the retries run out, and returns its last error and the number of retries.
+func (p retryPolicy) run(attempt func() error) (err error, retries int) {
+	backoff := p.backoff
+	for {
+		err = attempt()
+		if !isTransient(err) || retries == p.retries {
+			return err, retries
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		retries++
+	}
+}
+
+// isTransient returns whether err suggests the server couldn't be reached
+// rather than that it rejected a certificate: the connection couldn't be made
+// or an operation timed out. A server that closes or resets the connection is
+// taken to have rejected the certificate, since that's how many do.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,349 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The names that the self-test corpus is generated for. They're unrelated to
+// the main corpus's config.json so that the self-test works without a corpus.
+const (
+	selfTestHostname           = "test.selftest.bettertls.com"
+	selfTestHostSubtree        = "selftest.bettertls.com"
+	selfTestInvalidHostname    = "bad.example.com"
+	selfTestInvalidHostSubtree = "example.net"
+	selfTestIP                 = "127.0.0.1"
+)
+
+// selfTestFiles is the mini-corpus that the self-test runs, laid out as a
+// checkout. It's the one that the bettertls package's SelfTest runs, which
+// package main can't import without a module.
+//
+//go:embed bettertls/testdata/selftest
+var selfTestFiles embed.FS
+
+// selfTest implements the self-test command, which runs the whole pipeline,
+// from reading the corpus through the worker pool and the evaluation of
+// expectations to writing and reading back a results file, on the
+// mini-corpus of a few dozen tests embedded in the harness. This checks that
+// the harness works in a given environment in well under a second, before
+// committing to a full run.
+//
+// With -generate, it instead writes a new mini-corpus, to be checked in
+// under bettertls/testdata/selftest.
+func selfTest(args []string) error {
+	flags := flag.NewFlagSet("self-test", flag.ExitOnError)
+	keep := flags.Bool("keep", false, "Keep the extracted mini-corpus and results file, and print where they are")
+	generate := flags.String("generate", "", "Generate a new mini-corpus in this directory, e.g. bettertls/testdata/selftest, rather than running the self-test")
+	flags.Parse(args)
+
+	if len(*generate) > 0 {
+		return writeSelfTestCorpus(*generate)
+	}
+
+	start := time.Now()
+
+	dir, err := ioutil.TempDir("", "bettertls-self-test")
+	if err != nil {
+		return err
+	}
+	if *keep {
+		fmt.Printf("Writing the self-test corpus to %s\n", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+	if err := extractSelfTestCorpus(dir); err != nil {
+		return err
+	}
+
+	configBytes, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return err
+	}
+	config := new(configFile)
+	if err := json.Unmarshal(configBytes, config); err != nil {
+		return err
+	}
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(dir, "html", "expects.json"))
+	if err != nil {
+		return err
+	}
+	expectations := new(expectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return err
+	}
+	if err := expectations.checkCompatibility(); err != nil {
+		return err
+	}
+
+	// The main corpus is only ever found through testPath.
+	savedCertificatesDir := certificatesDir
+	certificatesDir = filepath.Join(dir, "certificates")
+	defer func() { certificatesDir = savedCertificatesDir }()
+
+	root, err := readPEMChain(filepath.Join(certificatesDir, "root.crt"))
+	if err != nil {
+		return err
+	}
+	if len(root) != 1 {
+		return fmt.Errorf("self-test: expected a single root in root.crt but found %d", len(root))
+	}
+
+	if verifierCaps, err = loadCapabilities(capabilitiesPath("go")); err != nil {
+		return err
+	}
+
+	recorder := newResultRecorder(deliveryPool)
+	numWorkers := 4
+
+	rootPool := x509.NewCertPool()
+	rootPool.AddCert(root[0])
+
+	corpus := loadCorpus(pemCorpus{}, expectations, numWorkers)
+	numFailures := runPipeline(expectations.Expects, numWorkers, func(test *expectation) bool {
+		return runCorpusTest(test, config, corpus, rootPool, nil, recorder, nil)
+	}, failureReporter(nil))
+
+	resultsPath := filepath.Join(dir, "results.json")
+	if err := recorder.write(resultsPath, 0); err != nil {
+		return err
+	}
+	results, err := loadResults(resultsPath)
+	if err != nil {
+		return err
+	}
+
+	numTests := len(expectations.Expects)
+	if len(results.Results) != numTests {
+		return fmt.Errorf("self-test: the results file has %d results, but %d tests were run", len(results.Results), numTests)
+	}
+	for category, numSkipped := range results.Skipped {
+		return fmt.Errorf("self-test: the results file records %d verifications skipped as %s, but none should be", numSkipped, category)
+	}
+	if numFailures != 0 {
+		return fmt.Errorf("self-test: failed %d of %d tests", numFailures, numTests)
+	}
+
+	fmt.Printf("Self-test passed %d tests in %s\n", numTests, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// extractSelfTestCorpus writes the embedded mini-corpus to dir, since the
+// harness reads the corpus from disk.
+func extractSelfTestCorpus(dir string) error {
+	const root = "bettertls/testdata/selftest"
+	return fs.WalkDir(selfTestFiles, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(path, root)))
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		contents, err := selfTestFiles.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, contents, 0644)
+	})
+}
+
+// writeSelfTestCorpus writes a mini-corpus to dir, laid out as a checkout
+// with config.json, html/expects.json and certificates. Each test has a leaf
+// with a combination of the valid and invalid hostnames as SANs, issued by an
+// intermediate with a combination of permitted and excluded DNS subtrees.
+func writeSelfTestCorpus(dir string) error {
+	certsDir := filepath.Join(dir, "certificates")
+	htmlDir := filepath.Join(dir, "html")
+	for _, d := range []string{certsDir, htmlDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	root, err := issueSelfTestCert(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Self-Test Root CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, rootKey, rootKey)
+	if err != nil {
+		return err
+	}
+
+	sanSets := [][]string{
+		{selfTestHostname},
+		{selfTestInvalidHostname},
+		{selfTestHostname, selfTestInvalidHostname},
+	}
+	subtrees := []string{"", selfTestHostSubtree, selfTestInvalidHostSubtree}
+
+	var expects []expectation
+	for _, sans := range sanSets {
+		for _, permitted := range subtrees {
+			for _, excluded := range subtrees {
+				id := len(expects) + 1
+
+				intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				if err != nil {
+					return err
+				}
+				template := &x509.Certificate{
+					Subject:               pkix.Name{CommonName: "Self-Test Intermediate CA " + strconv.Itoa(id)},
+					IsCA:                  true,
+					BasicConstraintsValid: true,
+					KeyUsage:              x509.KeyUsageCertSign,
+				}
+				if len(permitted) > 0 {
+					template.PermittedDNSDomains = []string{permitted}
+				}
+				if len(excluded) > 0 {
+					template.ExcludedDNSDomains = []string{excluded}
+				}
+				intermediate, err := issueSelfTestCert(template, root, intermediateKey, rootKey)
+				if err != nil {
+					return err
+				}
+
+				leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				if err != nil {
+					return err
+				}
+				leaf, err := issueSelfTestCert(&x509.Certificate{
+					DNSNames:    sans,
+					KeyUsage:    x509.KeyUsageDigitalSignature,
+					ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+				}, intermediate, leafKey, intermediateKey)
+				if err != nil {
+					return err
+				}
+
+				if err := writePEMCerts(filepath.Join(certsDir, strconv.Itoa(id)+".crt"), leaf); err != nil {
+					return err
+				}
+				if err := writePEMCerts(filepath.Join(certsDir, strconv.Itoa(id)+".chain"), intermediate, root); err != nil {
+					return err
+				}
+
+				descriptions := []string{fmt.Sprintf("SANs %v, permitted subtree %q, excluded subtree %q.", sans, permitted, excluded)}
+				expects = append(expects, expectation{
+					Id:           id,
+					DNS:          expectedResult{Result: selfTestResult(sans, permitted, excluded), Descriptions: descriptions},
+					IP:           expectedResult{Result: "ERROR", Descriptions: []string{"The leaf has no IP SANs."}},
+					Descriptions: descriptions,
+				})
+			}
+		}
+	}
+
+	if err := writePEMCerts(filepath.Join(certsDir, "root.crt"), root); err != nil {
+		return err
+	}
+
+	expectsBytes, err := json.MarshalIndent(&expectations{SuiteVersion: suiteVersion, Expects: expects}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(htmlDir, "expects.json"), expectsBytes, 0644); err != nil {
+		return err
+	}
+	configBytes, err := json.MarshalIndent(&configFile{Hostname: selfTestHostname, IP: selfTestIP}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "config.json"), configBytes, 0644)
+}
+
+// selfTestResult returns the expected result of verifying selfTestHostname
+// against a leaf with the given SANs, issued under the given subtrees, which
+// are empty if there's no constraint.
+func selfTestResult(sans []string, permitted, excluded string) string {
+	found := false
+	for _, san := range sans {
+		if san == selfTestHostname {
+			found = true
+		}
+		// Every SAN must satisfy the constraints, not just the one
+		// that matches.
+		if len(permitted) > 0 && !withinSubtree(san, permitted) {
+			return "ERROR"
+		}
+		if len(excluded) > 0 && withinSubtree(san, excluded) {
+			return "ERROR"
+		}
+	}
+
+	if !found {
+		return "ERROR"
+	}
+	return "OK"
+}
+
+func withinSubtree(name, subtree string) bool {
+	return name == subtree || (len(name) > len(subtree) && name[len(name)-len(subtree)-1:] == "."+subtree)
+}
+
+// issueSelfTestCert issues template for key, signed by parent with
+// parentKey, or self-signed if parent is nil. It's valid from a day before
+// now until the end of 9999, which RFC 5280 reserves for certificates with
+// no well-defined expiration, so that the checked-in mini-corpus never
+// expires.
+func issueSelfTestCert(template, parent *x509.Certificate, key *ecdsa.PrivateKey, parentKey crypto.Signer) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 63))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-24 * time.Hour)
+	template.NotAfter = time.Date(9999, time.December, 31, 23, 59, 59, 0, time.UTC)
+
+	if parent == nil {
+		parent = template
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.New("self-test: can't parse a generated certificate: " + err.Error())
+	}
+	return cert, nil
+}
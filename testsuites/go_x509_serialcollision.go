@@ -0,0 +1,155 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// serialCollisionExpectations represents serialCollisionExpects.json, which
+// defineExpects.js generates when the optional serial collision corpus is
+// present.
+type serialCollisionExpectations struct {
+	Expects []serialCollisionExpectation
+}
+
+type serialCollisionExpectation struct {
+	Id int `json:"id"`
+	// Name identifies the case, e.g. "twinFirst".
+	Name string `json:"name"`
+	// Presented labels the certificates presented after the leaf, in
+	// order, e.g. "issuer" or "twin".
+	Presented []string `json:"presented"`
+	// Selectable labels those of the presented certificates through which
+	// a valid path can be built. A verifier that accepts the chain must
+	// have built its path through one of them.
+	Selectable []string `json:"selectable"`
+	expectedResult
+}
+
+// selectable returns whether the certificate labelled label may be in the
+// path.
+func (e *serialCollisionExpectation) selectable(label string) bool {
+	for _, l := range e.Selectable {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// runSerialCollisionTests runs the serial collision tests, which present
+// chains in which two distinct certificates share an issuer and serial number,
+// and returns the number of tests run and the number of failures. Each chain
+// is verified exactly as presented, as with -intermediates=presented, so that
+// the verifier sees both certificates. With crypto/x509 the harness also
+// records which presented certificate the path went through, and a test fails
+// if it isn't one that the test allows. It records the outcome of each test
+// with recorder. It does nothing if the serial collision corpus hasn't been
+// generated.
+func runSerialCollisionTests(hostname string, recorder *resultRecorder) (numTests, numFailures int, err error) {
+	if !profile.runsOptionalCorpus("serialCollision") {
+		return 0, 0, nil
+	}
+
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(baseDir, "html", "serialCollisionExpects.json"))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	expectations := new(serialCollisionExpectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return 0, 0, err
+	}
+
+	serialCollisionDir := filepath.Join(baseDir, "certificates", "serialcollision")
+	rootChain, err := readPEMChain(filepath.Join(serialCollisionDir, "root.crt"))
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(rootChain) != 1 {
+		return 0, 0, fmt.Errorf("expected a single root in serialcollision/root.crt but found %d", len(rootChain))
+	}
+
+	rootPool := x509.NewCertPool()
+	rootPool.AddCert(rootChain[0])
+
+	var verifier platformVerifier
+	if platform != nil {
+		if verifier, err = loadPlatform(rootChain[0]); err != nil {
+			return 0, 0, err
+		}
+		defer verifier.close()
+	}
+
+	for _, test := range expectations.Expects {
+		selected, verifyErr := verifySerialCollision(verifier, filepath.Join(serialCollisionDir, strconv.Itoa(test.Id)), hostname, rootPool, &test)
+		recorder.recordSerialCollision(&test, selected, verifyErr)
+
+		passed, description := classifyResult(test.Result, verifyErr == nil)
+		if passed && verifyErr == nil && len(selected) > 0 && !test.selectable(selected) {
+			passed, description = false, "Wrong Path (through "+selected+")"
+		}
+		if !passed {
+			fmt.Printf("serial collision #%d (%s, leaf,%s): %s%s\n", test.Id, test.Name, strings.Join(test.Presented, ","), description, errorSuffix(errString(verifyErr)))
+			numFailures++
+		}
+	}
+
+	return len(expectations.Expects), numFailures, nil
+}
+
+// verifySerialCollision verifies the chain at pathPrefix as it was presented,
+// with verifier if it isn't nil and otherwise with crypto/x509, in which case
+// it also returns the label, from test, of the presented certificate that
+// issued the leaf in the path that was built.
+func verifySerialCollision(verifier platformVerifier, pathPrefix, hostname string, rootPool *x509.CertPool, test *serialCollisionExpectation) (selected string, err error) {
+	rawChain, err := readPresentedChain(pathPrefix)
+	if err != nil {
+		return "", err
+	}
+	if len(rawChain)-1 != len(test.Presented) {
+		return "", fmt.Errorf("the manifest labels %d presented certificates, but the .chain file has %d", len(test.Presented), len(rawChain)-1)
+	}
+
+	if verifier != nil {
+		return "", verifier.verifyRaw(rawChain, hostname)
+	}
+
+	paths, err := verifyRawChainPaths(rawChain, hostname, rootPool)
+	if err != nil {
+		return "", err
+	}
+	if len(paths[0]) < 2 {
+		return "", nil
+	}
+	for i, der := range rawChain[1:] {
+		if bytes.Equal(der, paths[0][1].Raw) {
+			return test.Presented[i], nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,443 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxUploadSize is the largest results file, in bytes, that the serve command
+// accepts.
+const maxUploadSize = 16 << 20
+
+// serveSuite implements the serve command, which exposes the corpus and
+// collects results over HTTP, so that harnesses in other languages, on other
+// machines, needn't be given copies of the corpus or send results back by
+// hand:
+//
+//	GET /testcases           The names under test, the root and expects.json, as JSON.
+//	GET /testcase/{id}/chain The test's leaf followed by its chain, as PEM.
+//	POST /results?implementation=I&version=V
+//	                         A results file, saved in the collect directory as I/V.json.
+//	                         I and V default to those in the file's metadata.
+//	                         Its signature, if any, is the X-Results-Signature header,
+//	                         base64-encoded, and is saved beside it as I/V.json.sig.
+//	                         With bucket=client-hello, I defaults instead to the JA4
+//	                         fingerprint of the client's most common ClientHello.
+//	GET /matrix              An export-report page comparing the latest results for
+//	                         every implementation and version.
+//	GET /matrix.csv          The same comparison as CSV.
+//	GET /metrics             Counts of the chains served, results files saved and
+//	                         verifications passed and failed, for Prometheus.
+func serveSuite(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flags.String("listen", "localhost:8643", "Address to serve the API on")
+	collectDir := flags.String("collect", "collected", "The directory to save uploaded results files in")
+	archivePath := flags.String("corpus-archive", "", corpusArchiveUsage)
+	publicKeyPath := flags.String("public-key", "", "If set, "+resultsPublicKeyUsage+"; unsigned results are refused")
+	flags.Parse(args)
+
+	publicKeys, err := loadResultsPublicKeys(*publicKeyPath)
+	if err != nil {
+		return err
+	}
+
+	if err := openCorpusArchive(*archivePath); err != nil {
+		return err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	expectations, err := loadExpectations()
+	if err != nil {
+		return err
+	}
+
+	rootPEM, err := readCorpusFile(filepath.Join(certificatesDir, "root.crt"))
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(*collectDir, 0755); err != nil {
+		return err
+	}
+
+	s := &suiteServer{
+		config:       config,
+		expectations: expectations,
+		rootPEM:      string(rootPEM),
+		collectDir:   *collectDir,
+		publicKeys:   publicKeys,
+		expects:      make(map[int]*expectation),
+		metrics:      newServerMetrics(),
+	}
+	for i := range expectations.Expects {
+		s.expects[expectations.Expects[i].Id] = &expectations.Expects[i]
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/testcases", s.testCases)
+	mux.HandleFunc("/testcase/", s.testCase)
+	mux.HandleFunc("/results", s.results)
+	mux.HandleFunc("/matrix", s.matrix)
+	mux.HandleFunc("/matrix.csv", s.matrixCSV)
+	mux.Handle("/metrics", s.metrics)
+	mux.HandleFunc("/certificates/", s.certificates)
+
+	log.Printf("Serving the test suite on http://%s/, saving results to %s", *listen, *collectDir)
+	return http.ListenAndServe(*listen, mux)
+}
+
+type suiteServer struct {
+	config       *configFile
+	expectations *expectations
+	rootPEM      string
+	collectDir   string
+	// publicKeys, if set, are the keys that uploaded results must be
+	// signed with.
+	publicKeys []ed25519.PublicKey
+	// expects maps test IDs to their expectations, so that requests for
+	// other IDs can be rejected without touching the file system.
+	expects map[int]*expectation
+	metrics *serverMetrics
+
+	// storeLock serialises access to the collect directory.
+	storeLock sync.Mutex
+}
+
+// suiteTestCases is the response to GET /testcases.
+type suiteTestCases struct {
+	TestVersion int    `json:"testVersion"`
+	Hostname    string `json:"hostname"`
+	// PerTestHostnames is set when each test's DNS name is
+	// test-N.hostname rather than hostname.
+	PerTestHostnames bool          `json:"perTestHostnames,omitempty"`
+	IP               string        `json:"ip"`
+	Root             string        `json:"root"`
+	SuiteVersion     int           `json:"suiteVersion"`
+	Expects          []expectation `json:"expects"`
+}
+
+func (s *suiteServer) testCases(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &suiteTestCases{
+		TestVersion:      s.config.TestVersion,
+		Hostname:         s.config.Hostname,
+		PerTestHostnames: s.config.PerTestHostnames,
+		IP:               s.config.IP,
+		Root:             s.rootPEM,
+		SuiteVersion:     s.expectations.SuiteVersion,
+		Expects:          s.expectations.Expects,
+	})
+}
+
+// testCase serves /testcase/{id}/chain.
+func (s *suiteServer) testCase(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/testcase/"), "/")
+	if len(parts) != 2 || parts[1] != "chain" {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.Atoi(parts[0])
+	if _, ok := s.expects[id]; err != nil || !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var chain []byte
+	for _, ext := range []string{".crt", ".chain"} {
+		contents, err := readCorpusFile(testPath(id, ext))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		chain = append(chain, contents...)
+	}
+
+	s.metrics.testCaseServed()
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(chain)
+}
+
+// servedCertificateTypes maps the extensions of the corpus files that are
+// served under /certificates/ to their content types. Keys aren't served.
+var servedCertificateTypes = map[string]string{
+	".crt":   "application/x-pem-file",
+	".chain": "application/x-pem-file",
+	".der":   "application/octet-stream",
+}
+
+// certificates serves /certificates/{path}, a certificate file of the corpus,
+// read from the corpus archive if one is open.
+func (s *suiteServer) certificates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/certificates/")
+	contentType, ok := servedCertificateTypes[path.Ext(name)]
+	if !ok || path.Clean("/"+name) != "/"+name {
+		http.NotFound(w, r)
+		return
+	}
+
+	contents, err := readCorpusFile(filepath.Join(certificatesDir, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(contents)
+}
+
+// validTag matches the implementation and version tags of uploads, which are
+// used as file names.
+var validTag = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+
+// invalidTagRun matches the characters that aren't allowed in tags, which are
+// replaced with '-' when tags are taken from a results file's metadata.
+var invalidTagRun = regexp.MustCompile(`[^A-Za-z0-9._+-]+`)
+
+// results accepts a results file, checks that it's for this corpus and saves
+// it in the collect directory, replacing any earlier results for the same
+// implementation and version.
+func (s *suiteServer) results(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxUploadSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxUploadSize {
+		http.Error(w, fmt.Sprintf("results files are limited to %d bytes", maxUploadSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var signature []byte
+	if header := r.Header.Get("X-Results-Signature"); len(header) > 0 {
+		signature, err = base64.StdEncoding.DecodeString(header)
+		if err != nil {
+			http.Error(w, "invalid X-Results-Signature: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	signer := ""
+	if s.publicKeys != nil {
+		if signature == nil {
+			http.Error(w, "results must be signed, with the signature in the X-Results-Signature header", http.StatusUnauthorized)
+			return
+		}
+		signer, err = verifyResultsSignature(body, signature, s.publicKeys)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	results := new(resultsFile)
+	if err := json.Unmarshal(body, results); err != nil {
+		http.Error(w, "invalid results file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The tags are read from the URL, since the body is the results file,
+	// or else from the results file's metadata.
+	implementation, version := r.URL.Query().Get("implementation"), r.URL.Query().Get("version")
+	if r.URL.Query().Get("bucket") == "client-hello" && len(implementation) == 0 {
+		// Results from a live client are grouped by its TLS stack
+		// rather than by the user agent that it reports.
+		if len(results.ClientHellos) == 0 {
+			http.Error(w, "bucket=client-hello needs results with clientHellos, as written by the probe, browser and ct commands", http.StatusBadRequest)
+			return
+		}
+		implementation = "ja4-" + results.ClientHellos[0].JA4
+	}
+	if results.Metadata != nil {
+		if len(implementation) == 0 {
+			implementation = invalidTagRun.ReplaceAllString(results.Metadata.Implementation, "-")
+		}
+		if len(version) == 0 {
+			version = invalidTagRun.ReplaceAllString(results.Metadata.ImplementationVersion, "-")
+		}
+	}
+	if !validTag.MatchString(implementation) || !validTag.MatchString(version) {
+		http.Error(w, "the implementation and version parameters are required unless the results file's metadata has them, and may only contain letters, digits, '.', '_', '+' and '-'", http.StatusBadRequest)
+		return
+	}
+	if results.TestVersion != s.config.TestVersion {
+		http.Error(w, fmt.Sprintf("results are for corpus version %d, but this is version %d", results.TestVersion, s.config.TestVersion), http.StatusConflict)
+		return
+	}
+	for _, result := range results.Results {
+		if _, ok := s.expects[result.Id]; !ok {
+			http.Error(w, fmt.Sprintf("results include unknown test %d", result.Id), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	dir := filepath.Join(s.collectDir, implementation)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := filepath.Join(implementation, version+".json")
+	if err := ioutil.WriteFile(filepath.Join(s.collectDir, name), body, 0644); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The signature of any earlier results is removed, so that it isn't
+	// taken to be this file's.
+	signaturePath := filepath.Join(s.collectDir, name+resultsSignatureSuffix)
+	if signature != nil {
+		err = ioutil.WriteFile(signaturePath, signature, 0644)
+	} else if err = os.Remove(signaturePath); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.metrics.resultsSaved(implementation, results, s.expects)
+	if len(signer) > 0 {
+		log.Printf("Saved results from %q, signed by key %s, to %s", results.UserAgent, signer, name)
+	} else {
+		log.Printf("Saved results from %q to %s", results.UserAgent, name)
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"name": name})
+}
+
+// collected returns the stored results files, named "implementation
+// version" and sorted by name.
+func (s *suiteServer) collected() ([]*resultsFile, error) {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(s.collectDir, "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var ret []*resultsFile
+	for _, path := range paths {
+		results, err := loadResults(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		results.name = filepath.Base(filepath.Dir(path)) + " " + results.name
+		ret = append(ret, results)
+	}
+
+	return ret, nil
+}
+
+// matrix renders the stored results with the export-report template.
+func (s *suiteServer) matrix(w http.ResponseWriter, r *http.Request) {
+	collected, err := s.collected()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := reportTemplate.Execute(w, buildReport(s.expectations, collected, "/certificates")); err != nil {
+		log.Printf("Rendering the matrix: %s", err)
+	}
+}
+
+// matrixCSV writes the stored results as CSV, with a row for each test and
+// name type and a column for each implementation and version.
+func (s *suiteServer) matrixCSV(w http.ResponseWriter, r *http.Request) {
+	collected, err := s.collected()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	report := buildReport(s.expectations, collected, "")
+
+	w.Header().Set("Content-Type", "text/csv")
+	out := csv.NewWriter(w)
+
+	header := []string{"id", "type", "expect", "disagree"}
+	for _, column := range report.Columns {
+		header = append(header, column.Name)
+	}
+	out.Write(header)
+
+	for _, row := range report.Rows {
+		record := []string{strconv.Itoa(row.Id), row.Type, row.Expect, strconv.FormatBool(row.Disagree)}
+		for _, cell := range row.Cells {
+			record = append(record, cell.Result)
+		}
+		out.Write(record)
+	}
+
+	out.Flush()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,112 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// signerProviders open the crypto.Signers that CA certificates can be signed
+// with, keyed by the scheme of a signer location such as "file:root.key".
+// Keys held in an HSM or KMS can be used by registering a provider for them
+// here, or through the command provider.
+var signerProviders = map[string]func(location string) (crypto.Signer, error){
+	"file":    readPrivateKey,
+	"command": newCommandSigner,
+}
+
+// openSigner returns the crypto.Signer at a location of the form
+// "scheme:location".
+func openSigner(spec string) (crypto.Signer, error) {
+	i := strings.IndexByte(spec, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("signer %q doesn't start with a scheme, such as \"file:\"", spec)
+	}
+
+	provider, ok := signerProviders[spec[:i]]
+	if !ok {
+		return nil, fmt.Errorf("unknown signer scheme %q", spec[:i])
+	}
+
+	return provider(spec[i+1:])
+}
+
+// commandSigner signs by running a command, which can call out to an HSM or
+// KMS. "command public" must write the PEM-encoded public key to stdout, and
+// "command sign HASH", where HASH is the name of a crypto.Hash such as
+// SHA-256, optionally followed by "pss" for RSA-PSS, must read a digest from
+// stdin and write the raw signature to stdout.
+type commandSigner struct {
+	args   []string
+	public crypto.PublicKey
+}
+
+func newCommandSigner(command string) (crypto.Signer, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("no signer command given")
+	}
+
+	s := &commandSigner{args: args}
+	output, err := s.run(nil, "public")
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(output)
+	if block == nil {
+		return nil, fmt.Errorf("%s public: no PEM block found in its output", args[0])
+	}
+	if s.public, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return nil, fmt.Errorf("%s public: %s", args[0], err)
+	}
+
+	return s, nil
+}
+
+func (s *commandSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *commandSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	args := []string{"sign", opts.HashFunc().String()}
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		args = append(args, "pss")
+	}
+
+	return s.run(digest, args...)
+}
+
+func (s *commandSigner) run(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command(s.args[0], append(s.args[1:], args...)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %s: %s", s.args[0], args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// smimeExpectations represents smimeExpects.json, which defineExpects.js
+// generates when the optional S/MIME corpus is present.
+type smimeExpectations struct {
+	Expects []smimeExpectation
+}
+
+type smimeExpectation struct {
+	Id int `json:"id"`
+	// Name identifies the case, e.g. "permittedSubdomains".
+	Name string `json:"name"`
+	// Email is the email address to verify the certificate against.
+	Email string `json:"email"`
+	expectedResult
+}
+
+// runSMIMETests runs the S/MIME tests, which verify each certificate for
+// email protection against an email address, and returns the number of tests
+// run and the number of failures. The outcome of each test is recorded with
+// recorder. It does nothing if the S/MIME corpus hasn't been generated.
+func runSMIMETests(recorder *resultRecorder) (numTests, numFailures int, err error) {
+	if !profile.runsOptionalCorpus("smime") {
+		return 0, 0, nil
+	}
+
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(baseDir, "html", "smimeExpects.json"))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	expectations := new(smimeExpectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return 0, 0, err
+	}
+
+	smimeDir := filepath.Join(baseDir, "certificates", "smime")
+	rootChain, err := readPEMChain(filepath.Join(smimeDir, "root.crt"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rootPool := x509.NewCertPool()
+	for _, root := range rootChain {
+		rootPool.AddCert(root)
+	}
+
+	for _, test := range expectations.Expects {
+		verifyErr := verifySMIME(filepath.Join(smimeDir, strconv.Itoa(test.Id)), test.Email, rootPool)
+		recorder.recordSMIME(&test, verifyErr)
+
+		if passed, description := classifyResult(test.Result, verifyErr == nil); !passed {
+			fmt.Printf("smime #%d (%s, %q): %s%s\n", test.Id, test.Name, test.Email, description, errorSuffix(errString(verifyErr)))
+			numFailures++
+		}
+	}
+
+	return len(expectations.Expects), numFailures, nil
+}
+
+// verifySMIME verifies the certificate at pathPrefix + ".crt", with the
+// intermediates at pathPrefix + ".chain", for email protection, and checks
+// that it's valid for email. Go's verifier enforces rfc822Name constraints but
+// doesn't match email addresses, so that's done here.
+func verifySMIME(pathPrefix, email string, rootPool *x509.CertPool) error {
+	chain, err := readPEMChain(pathPrefix + ".chain")
+	if err != nil {
+		return err
+	}
+
+	leaf, err := readPEMChain(pathPrefix + ".crt")
+	if err != nil {
+		return err
+	}
+
+	if len(leaf) != 1 {
+		return fmt.Errorf("expected a single certificate in the .crt file, but found %d", len(leaf))
+	}
+
+	intermediatePool := x509.NewCertPool()
+	for _, intermediate := range chain {
+		intermediatePool.AddCert(intermediate)
+	}
+
+	if _, err := leaf[0].Verify(x509.VerifyOptions{
+		Roots:         rootPool,
+		Intermediates: intermediatePool,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}); err != nil {
+		return err
+	}
+
+	for _, candidate := range leaf[0].EmailAddresses {
+		if matchEmail(candidate, email) {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate is not valid for %s", email)
+}
+
+// matchEmail returns whether two email addresses are the same. As in RFC 5280
+// section 7.5, the local parts are compared case-sensitively and the domains
+// case-insensitively.
+func matchEmail(a, b string) bool {
+	i, j := strings.LastIndex(a, "@"), strings.LastIndex(b, "@")
+	if i < 0 || j < 0 {
+		return false
+	}
+	return a[:i] == b[:j] && strings.EqualFold(a[i+1:], b[j+1:])
+}
@@ -0,0 +1,323 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// idMap maps the test IDs of one corpus version to those of another, so that
+// results from before a version bump can be compared with results from after
+// it. It's written by the stability command.
+type idMap struct {
+	FromVersion int `json:"fromVersion"`
+	ToVersion   int `json:"toVersion"`
+	// IDs maps each old ID to the new ID of the test with the same
+	// definition.
+	IDs map[int]int `json:"ids"`
+	// Removed lists the old IDs of tests that no longer exist.
+	Removed []int `json:"removed"`
+	// Added lists the new IDs of tests that didn't exist before.
+	Added []int `json:"added"`
+}
+
+func loadIDMap(path string) (*idMap, error) {
+	mapBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := new(idMap)
+	if err := json.Unmarshal(mapBytes, ret); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return ret, nil
+}
+
+// translate returns results from the old corpus version keyed by their new
+// IDs, dropping the results of removed tests.
+func (m *idMap) translate(results map[int]testResult) map[int]testResult {
+	ret := make(map[int]testResult)
+	for id, result := range results {
+		newID, ok := m.IDs[id]
+		if !ok {
+			continue
+		}
+		result.Id = newID
+		ret[newID] = result
+	}
+	return ret
+}
+
+// corpusDefinitions holds the definition of each test in a manifest.json.
+type corpusDefinitions struct {
+	version int
+	files   map[string]string
+	// byID maps each test ID to its definition.
+	byID map[int]string
+	ids  []int
+	// generatorStableIDs maps each test ID to the stable ID that the
+	// generator recorded for it, if any.
+	generatorStableIDs map[int]string
+}
+
+// loadCorpusDefinitions reads a manifest.json and reduces each entry of its
+// certManifest to a definition: the canonical JSON of everything but its ID,
+// its dimensions and its stable ID, which are derived from the rest.
+func loadCorpusDefinitions(path string) (*corpusDefinitions, error) {
+	manifestBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var m struct {
+		CorpusVersion int                      `json:"corpusVersion"`
+		Files         map[string]string        `json:"files"`
+		CertManifest  []map[string]interface{} `json:"certManifest"`
+	}
+	if err := json.Unmarshal(manifestBytes, &m); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	ret := &corpusDefinitions{
+		version: m.CorpusVersion,
+		files:   m.Files,
+		byID:    make(map[int]string),
+
+		generatorStableIDs: make(map[int]string),
+	}
+	for _, entry := range m.CertManifest {
+		idValue, ok := entry["id"].(float64)
+		if !ok {
+			return nil, fmt.Errorf("%s: a certManifest entry has no id", path)
+		}
+		id := int(idValue)
+		if _, ok := ret.byID[id]; ok {
+			return nil, fmt.Errorf("%s: test %d is listed twice", path, id)
+		}
+
+		if stableID, ok := entry["stableId"].(string); ok {
+			ret.generatorStableIDs[id] = stableID
+		}
+
+		delete(entry, "id")
+		delete(entry, "dimensions")
+		delete(entry, "stableId")
+		// Maps are marshaled with sorted keys, so equal definitions
+		// marshal identically.
+		definition, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		ret.byID[id] = string(definition)
+		ret.ids = append(ret.ids, id)
+	}
+	sort.Ints(ret.ids)
+
+	return ret, nil
+}
+
+// checkStability implements the stability command. Given manifests from two
+// generator runs with the same corpus version, it checks that every test kept
+// its ID and definition. Given manifests from different corpus versions, it
+// writes an idMap from the old IDs to the new ones.
+func checkStability(args []string) error {
+	flags := flag.NewFlagSet("stability", flag.ExitOnError)
+	output := flags.String("o", "idmap.json", "Where to write the mapping from old test IDs to new ones, if the corpus versions differ")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: stability [flags] old/manifest.json new/manifest.json\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("expected two manifest files")
+	}
+
+	old, err := loadCorpusDefinitions(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	current, err := loadCorpusDefinitions(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	if old.version == current.version {
+		return compareDefinitions(old, current)
+	}
+
+	m, err := mapIDs(old, current)
+	if err != nil {
+		return err
+	}
+
+	mapBytes, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*output, mapBytes, 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("Mapped %d tests from corpus version %d to %d, with %d removed and %d added, in %s\n", len(m.IDs), m.FromVersion, m.ToVersion, len(m.Removed), len(m.Added), *output)
+	return nil
+}
+
+func compareDefinitions(old, current *corpusDefinitions) error {
+	var changed []string
+	for _, id := range old.ids {
+		newDefinition, ok := current.byID[id]
+		switch {
+		case !ok:
+			changed = append(changed, fmt.Sprintf("#%d was removed", id))
+		case newDefinition != old.byID[id]:
+			changed = append(changed, fmt.Sprintf("#%d changed:\n    %s\n    %s", id, old.byID[id], newDefinition))
+		}
+	}
+	for _, id := range current.ids {
+		if _, ok := old.byID[id]; !ok {
+			changed = append(changed, fmt.Sprintf("#%d was added", id))
+		}
+	}
+
+	// The bytes of the files only match if the same seed, key directory
+	// and start date were used, so differences are reported but allowed.
+	numDifferent := 0
+	for name, hash := range current.files {
+		if old.files[name] != hash {
+			numDifferent++
+		}
+	}
+	if numDifferent != 0 {
+		fmt.Printf("%d of %d files differ; regenerate with the same --seed, --key-dir and --not-before to reproduce them exactly\n", numDifferent, len(current.files))
+	}
+
+	if len(changed) != 0 {
+		printDiffSection("Changed tests", changed)
+		return fmt.Errorf("%d tests changed within corpus version %d; bump testVersion in config.json", len(changed), current.version)
+	}
+
+	fmt.Printf("All %d tests have the same IDs and definitions\n", len(current.ids))
+	return nil
+}
+
+func mapIDs(old, current *corpusDefinitions) (*idMap, error) {
+	newIDs := make(map[string]int)
+	for _, id := range current.ids {
+		definition := current.byID[id]
+		if other, ok := newIDs[definition]; ok {
+			return nil, fmt.Errorf("tests %d and %d of the new corpus have the same definition, so old IDs can't be mapped to them", other, id)
+		}
+		newIDs[definition] = id
+	}
+
+	m := &idMap{
+		FromVersion: old.version,
+		ToVersion:   current.version,
+		IDs:         make(map[int]int),
+		Removed:     []int{},
+		Added:       []int{},
+	}
+	mapped := make(map[int]bool)
+	for _, id := range old.ids {
+		newID, ok := newIDs[old.byID[id]]
+		if !ok {
+			m.Removed = append(m.Removed, id)
+			continue
+		}
+		m.IDs[id] = newID
+		mapped[newID] = true
+	}
+	for _, id := range current.ids {
+		if !mapped[id] {
+			m.Added = append(m.Added, id)
+		}
+	}
+
+	return m, nil
+}
+
+// stableID returns the stable ID of a test with the given definition, as made
+// by loadCorpusDefinitions: the first 16 hex digits of its SHA-256 hash. The
+// generator computes the same ID, and since it only depends on the test's
+// definition, adding or removing tests doesn't change it.
+func stableID(definition string) string {
+	digest := sha256.Sum256([]byte(definition))
+	return hex.EncodeToString(digest[:8])
+}
+
+// stableIDMap maps the integer IDs of a corpus version to stable IDs. It's
+// written by the stable-ids command.
+type stableIDMap struct {
+	CorpusVersion int            `json:"corpusVersion"`
+	StableIDs     map[int]string `json:"stableIds"`
+}
+
+// writeStableIDs implements the stable-ids command, which maps the integer
+// IDs of the corpus described by a manifest.json to stable IDs, so that
+// results from before stable IDs were added, or from any corpus version, can
+// be matched to the same tests in later versions.
+func writeStableIDs(args []string) error {
+	flags := flag.NewFlagSet("stable-ids", flag.ExitOnError)
+	output := flags.String("o", "stableids.json", "Where to write the mapping from test IDs to stable IDs")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: stable-ids [flags] manifest.json\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected a manifest file")
+	}
+
+	definitions, err := loadCorpusDefinitions(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	m := &stableIDMap{CorpusVersion: definitions.version, StableIDs: make(map[int]string)}
+	for _, id := range definitions.ids {
+		m.StableIDs[id] = stableID(definitions.byID[id])
+
+		// A generator that disagrees would give results that can't be
+		// matched to those mapped by this command.
+		if recorded, ok := definitions.generatorStableIDs[id]; ok && recorded != m.StableIDs[id] {
+			return fmt.Errorf("the generator gave test %d the stable ID %s, but its definition hashes to %s", id, recorded, m.StableIDs[id])
+		}
+	}
+
+	mapBytes, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*output, mapBytes, 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("Mapped %d tests of corpus version %d to stable IDs in %s\n", len(m.StableIDs), m.CorpusVersion, *output)
+	return nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// objectStore reads and writes objects in S3 or an S3-compatible store, such
+// as Google Cloud Storage with HMAC keys or MinIO, signing requests with AWS
+// Signature Version 4.
+type objectStore struct {
+	endpoint     string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// objectStoreFromEnv returns an objectStore for the scheme of an object URL,
+// "s3" or "gs", configured from the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and AWS_REGION environment
+// variables, which hold HMAC keys for Google Cloud Storage.
+// BETTERTLS_S3_ENDPOINT overrides the endpoint, for other S3-compatible
+// stores.
+func objectStoreFromEnv(scheme string) (*objectStore, error) {
+	s := &objectStore{
+		region:       os.Getenv("AWS_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		endpoint:     os.Getenv("BETTERTLS_S3_ENDPOINT"),
+	}
+
+	switch scheme {
+	case "s3":
+		if len(s.region) == 0 {
+			s.region = "us-east-1"
+		}
+		if len(s.endpoint) == 0 {
+			s.endpoint = "https://s3." + s.region + ".amazonaws.com"
+		}
+	case "gs":
+		s.region = "auto"
+		if len(s.endpoint) == 0 {
+			s.endpoint = "https://storage.googleapis.com"
+		}
+	default:
+		return nil, fmt.Errorf("unknown object store scheme %q", scheme)
+	}
+
+	if len(s.accessKey) == 0 || len(s.secretKey) == 0 {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to use %s:// URLs", scheme)
+	}
+
+	return s, nil
+}
+
+// fetchURL returns the contents of an s3://, gs://, http:// or https:// URL.
+func fetchURL(rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *http.Response
+	switch u.Scheme {
+	case "http", "https":
+		resp, err = http.Get(rawURL)
+	default:
+		var s *objectStore
+		if s, err = objectStoreFromEnv(u.Scheme); err != nil {
+			return nil, err
+		}
+		resp, err = s.do("GET", u.Host, strings.TrimPrefix(u.Path, "/"), "", nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s: %s", rawURL, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// putObject writes contents to bucket/key.
+func (s *objectStore) putObject(bucket, key, contentType string, contents []byte) error {
+	resp, err := s.do("PUT", bucket, key, contentType, contents)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("writing %s/%s: %s: %s", bucket, key, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// do makes a signed path-style request for bucket/key.
+func (s *objectStore) do(method, bucket, key, contentType string, body []byte) (*http.Response, error) {
+	path := "/" + bucket + "/" + key
+	req, err := http.NewRequest(method, s.endpoint+escapeObjectPath(path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	s.sign(req, path, body, time.Now().UTC())
+	return http.DefaultClient.Do(req)
+}
+
+// sign adds AWS Signature Version 4 headers to req.
+func (s *objectStore) sign(req *http.Request, path string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if len(s.sessionToken) > 0 {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	if len(s.sessionToken) > 0 {
+		signedHeaders = append(signedHeaders, "x-amz-security-token")
+		canonicalHeaders += "x-amz-security-token:" + s.sessionToken + "\n"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		escapeObjectPath(path),
+		"",
+		canonicalHeaders,
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+// escapeObjectPath percent-encodes everything in path but unreserved
+// characters and slashes, as Signature Version 4 requires.
+func escapeObjectPath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// The outcomes of a stress test, which are recorded in results files.
+const (
+	stressOutcomeOK      = "OK"
+	stressOutcomeError   = "ERROR"
+	stressOutcomeTimeout = "TIMEOUT"
+)
+
+// stressTimeout bounds the time spent verifying a single stress test. It's
+// much shorter than limits.timeout, since verifiers that do linear work on
+// the stress corpus finish in milliseconds.
+var stressTimeout = time.Second
+
+// stressExpectations represents stressExpects.json, which defineExpects.js
+// generates when the optional stress corpus is present.
+type stressExpectations struct {
+	Expects []stressExpectation
+}
+
+type stressExpectation struct {
+	Id int `json:"id"`
+	// SANs and Constraints are the numbers of SANs in the leaf and of name
+	// constraints in the intermediate.
+	SANs        int `json:"sans"`
+	Constraints int `json:"constraints"`
+	expectedResult
+}
+
+// runStressTests runs the stress tests, verifying each against hostname
+// within stressTimeout, and returns the number of tests run and the number
+// of failures. The outcome of each test is recorded with recorder. It does
+// nothing if the stress corpus hasn't been generated.
+func runStressTests(hostname string, recorder *resultRecorder) (numTests, numFailures int, err error) {
+	if !profile.runsOptionalCorpus("stress") {
+		return 0, 0, nil
+	}
+
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(baseDir, "html", "stressExpects.json"))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	expectations := new(stressExpectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return 0, 0, err
+	}
+
+	stressDir := filepath.Join(baseDir, "certificates", "stress")
+	rootChain, err := readPEMChain(filepath.Join(stressDir, "root.crt"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rootPool := x509.NewCertPool()
+	for _, root := range rootChain {
+		rootPool.AddCert(root)
+	}
+
+	for _, test := range expectations.Expects {
+		outcome, elapsed, verifyErr := verifyStress(filepath.Join(stressDir, strconv.Itoa(test.Id)), hostname, rootPool)
+		recorder.recordStress(&test, outcome, elapsed, verifyErr)
+
+		var failure error
+		switch {
+		case outcome == stressOutcomeTimeout:
+			failure = fmt.Errorf("verification didn't finish within %s", stressTimeout)
+		case test.Result == "WEAK-OK":
+		case test.Result != outcome:
+			failure = fmt.Errorf("expected %s but got %s: %v", test.Result, outcome, verifyErr)
+		}
+
+		if failure != nil {
+			fmt.Printf("stress #%d (%d SANs, %d constraints): failed:\n  %q\n", test.Id, test.SANs, test.Constraints, failure)
+			numFailures++
+		}
+	}
+
+	return len(expectations.Expects), numFailures, nil
+}
+
+// verifyStress verifies the certificate at pathPrefix + ".crt", with the
+// intermediates at pathPrefix + ".chain", and returns its outcome and how
+// long verification took. A verification that times out is abandoned rather
+// than stopped.
+func verifyStress(pathPrefix, hostname string, rootPool *x509.CertPool) (outcome string, elapsed time.Duration, err error) {
+	chain, err := readPEMChain(pathPrefix + ".chain")
+	if err != nil {
+		return stressOutcomeError, 0, err
+	}
+
+	leaf, err := readPEMChain(pathPrefix + ".crt")
+	if err != nil {
+		return stressOutcomeError, 0, err
+	}
+
+	if len(leaf) != 1 {
+		return stressOutcomeError, 0, fmt.Errorf("expected a single certificate in the .crt file, but found %d", len(leaf))
+	}
+
+	intermediatePool := x509.NewCertPool()
+	for _, intermediate := range chain {
+		intermediatePool.AddCert(intermediate)
+	}
+
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		_, err := leaf[0].Verify(x509.VerifyOptions{
+			DNSName:       hostname,
+			Roots:         rootPool,
+			Intermediates: intermediatePool,
+		})
+		done <- err
+	}()
+
+	timer := time.NewTimer(stressTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		elapsed = time.Since(start)
+		if err != nil {
+			return stressOutcomeError, elapsed, err
+		}
+		return stressOutcomeOK, elapsed, nil
+	case <-timer.C:
+		return stressOutcomeTimeout, stressTimeout, nil
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// toolchainInfo describes the Go toolchain that produced a results file.
+type toolchainInfo struct {
+	// Version is the output of "go version".
+	Version      string `json:"version"`
+	GOROOT       string `json:"goroot"`
+	GOEXPERIMENT string `json:"goexperiment,omitempty"`
+}
+
+// runToolchain implements the toolchain command, which runs the harness with
+// another Go toolchain, such as a checkout of tip with GOEXPERIMENT settings,
+// records the toolchain in the results, and diffs them against the results
+// of a release. This supports the crypto/x509 development workflow: run the
+// corpus against a change before sending it.
+func runToolchain(args []string) error {
+	flags := flag.NewFlagSet("toolchain", flag.ExitOnError)
+	goroot := flags.String("goroot", "", "The Go toolchain checkout to run the harness with")
+	goexperiment := flags.String("goexperiment", "", "GOEXPERIMENT settings to build the harness with")
+	build := flags.Bool("build", false, "Build the toolchain with make.bash first, as a fresh checkout of tip needs")
+	output := flags.String("o", "toolchain.json", "Path to write the toolchain's results file to")
+	baseline := flags.String("baseline", "", "A results file from the latest release to diff against. By default, the harness is run with the go command on the PATH to produce one")
+	idMapPath := flags.String("id-map", "", "If set, an ID map written by the stability command, for a -baseline from an earlier corpus version")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: toolchain -goroot DIR [flags] [-- run flags...]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if len(*goroot) == 0 {
+		flags.Usage()
+		return errors.New("no toolchain given")
+	}
+
+	root, err := filepath.Abs(*goroot)
+	if err != nil {
+		return err
+	}
+
+	if *build {
+		makeCmd := exec.Command("./make.bash")
+		makeCmd.Dir = filepath.Join(root, "src")
+		makeCmd.Stdout, makeCmd.Stderr = os.Stderr, os.Stderr
+		if err := makeCmd.Run(); err != nil {
+			return fmt.Errorf("building the toolchain in %s: %s", root, err)
+		}
+	}
+
+	goBinary := filepath.Join(root, "bin", "go")
+	env := append(os.Environ(), "GOROOT="+root, "GOEXPERIMENT="+*goexperiment)
+	info, err := describeToolchain(goBinary, env)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Running with %s", info.Version)
+	if len(info.GOEXPERIMENT) > 0 {
+		fmt.Printf(" and GOEXPERIMENT=%s", info.GOEXPERIMENT)
+	}
+	fmt.Printf("\n")
+
+	if err := runHarness(goBinary, env, *output, flags.Args()); err != nil {
+		return err
+	}
+
+	results, err := loadResults(*output)
+	if err != nil {
+		return err
+	}
+	results.Toolchain = info
+	resultsBytes, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*output, resultsBytes, 0644); err != nil {
+		return err
+	}
+
+	baselinePath := *baseline
+	if len(baselinePath) == 0 {
+		dir, err := ioutil.TempDir("", "bettertls-toolchain")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		baselinePath = filepath.Join(dir, "baseline.json")
+		releaseEnv := append(os.Environ(), "GOEXPERIMENT=")
+		release, err := describeToolchain("go", releaseEnv)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Running with %s for the baseline\n", release.Version)
+		if err := runHarness("go", releaseEnv, baselinePath, flags.Args()); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("\n")
+	diffArgs := []string{baselinePath, *output}
+	if len(*idMapPath) > 0 {
+		diffArgs = append([]string{"-id-map", *idMapPath}, diffArgs...)
+	}
+	return diffResults(diffArgs)
+}
+
+// describeToolchain returns the version and settings of the go command at
+// goBinary, run with env.
+func describeToolchain(goBinary string, env []string) (*toolchainInfo, error) {
+	cmd := exec.Command(goBinary, "env", "GOROOT", "GOEXPERIMENT")
+	cmd.Env = env
+	envOutput, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s env: %s", goBinary, err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(envOutput))+"\n", "\n")
+
+	cmd = exec.Command(goBinary, "version")
+	cmd.Env = env
+	version, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s version: %s", goBinary, err)
+	}
+
+	return &toolchainInfo{
+		Version:      strings.TrimSpace(string(version)),
+		GOROOT:       lines[0],
+		GOEXPERIMENT: lines[1],
+	}, nil
+}
+
+// runHarness runs the harness's run command, with runArgs, using goBinary and
+// env, and writes the results to resultsPath. Test failures are expected, so
+// the harness exiting unsuccessfully is only an error if it didn't write the
+// results.
+func runHarness(goBinary string, env []string, resultsPath string, runArgs []string) error {
+	sources, err := filepath.Glob("go_x509*.go")
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		return errors.New("the toolchain command must be run from the testsuites directory")
+	}
+
+	absResultsPath, err := filepath.Abs(resultsPath)
+	if err != nil {
+		return err
+	}
+	os.Remove(absResultsPath)
+
+	args := append([]string{"run"}, sources...)
+	args = append(args, "run", "-results", absResultsPath)
+	args = append(args, runArgs...)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(goBinary, args...)
+	cmd.Env = env
+	cmd.Stderr = &stderr
+	runErr := cmd.Run()
+
+	if _, err := os.Stat(absResultsPath); err != nil {
+		return fmt.Errorf("%s run didn't write results (%v): %s", goBinary, runErr, stderr.String())
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// trustAnchorExpectations represents trustAnchorExpects.json, which
+// defineExpects.js generates when the optional trust anchor corpus is present.
+type trustAnchorExpectations struct {
+	Expects []trustAnchorExpectation
+}
+
+type trustAnchorExpectation struct {
+	Id int `json:"id"`
+	// Name identifies the case, e.g. "rootExpired".
+	Name string `json:"name"`
+	// Property is the kind of field that the root carries:
+	// "nameConstraints", "extendedKeyUsage", "validity" or "none".
+	Property string `json:"property"`
+	// RootProperties describes the root's fields, e.g. its permitted DNS
+	// subtree, as the generator recorded them.
+	RootProperties map[string]interface{} `json:"rootProperties"`
+	// AppliedExpect is the expected result for a verifier that applies the
+	// root's fields to the path, as RFC 5937 describes, and IgnoredExpect
+	// that for one that, as RFC 5280 allows, treats the root as just a
+	// name and key.
+	AppliedExpect string   `json:"appliedExpect"`
+	IgnoredExpect string   `json:"ignoredExpect"`
+	Descriptions  []string `json:"descriptions"`
+}
+
+// How a verifier treats a kind of trust anchor field, recorded in results
+// files.
+const (
+	trustAnchorApplied = "applied"
+	trustAnchorIgnored = "ignored"
+	trustAnchorMixed   = "mixed"
+)
+
+// runTrustAnchorTests runs the trust anchor tests, each of which verifies a
+// chain against its own root, and returns the number of tests run and the
+// number of failures. Verifiers may either apply or ignore the root's fields,
+// so a test only fails if its result meets neither expectation. It records
+// the outcome of each test with recorder, along with which of the root's
+// fields the verifier applied. It does nothing if the trust anchor corpus
+// hasn't been generated.
+func runTrustAnchorTests(hostname string, recorder *resultRecorder) (numTests, numFailures int, err error) {
+	if !profile.runsOptionalCorpus("trustAnchor") {
+		return 0, 0, nil
+	}
+
+	expectsBytes, err := ioutil.ReadFile(filepath.Join(baseDir, "html", "trustAnchorExpects.json"))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	expectations := new(trustAnchorExpectations)
+	if err := json.Unmarshal(expectsBytes, expectations); err != nil {
+		return 0, 0, err
+	}
+
+	trustAnchorDir := filepath.Join(baseDir, "certificates", "trustanchor")
+
+	// behaviours holds, for each kind of field, whether each test that
+	// tells the two apart was applied or ignored.
+	behaviours := make(map[string]map[string]bool)
+	for _, test := range expectations.Expects {
+		pathPrefix := filepath.Join(trustAnchorDir, strconv.Itoa(test.Id))
+		verifyErr := verifyTrustAnchor(pathPrefix, hostname)
+		accepted := verifyErr == nil
+		recorder.recordTrustAnchor(&test, verifyErr)
+
+		applied, _ := classifyResult(test.AppliedExpect, accepted)
+		ignored, _ := classifyResult(test.IgnoredExpect, accepted)
+		if applied != ignored {
+			if behaviours[test.Property] == nil {
+				behaviours[test.Property] = make(map[string]bool)
+			}
+			if applied {
+				behaviours[test.Property][trustAnchorApplied] = true
+			} else {
+				behaviours[test.Property][trustAnchorIgnored] = true
+			}
+		}
+
+		if !applied && !ignored {
+			_, description := classifyResult(test.AppliedExpect, accepted)
+			fmt.Printf("trust anchor #%d (%s): %s%s\n", test.Id, test.Name, description, errorSuffix(errString(verifyErr)))
+			numFailures++
+		}
+	}
+
+	var properties []string
+	for property := range behaviours {
+		properties = append(properties, property)
+	}
+	sort.Strings(properties)
+
+	for _, property := range properties {
+		behaviour := trustAnchorMixed
+		switch {
+		case !behaviours[property][trustAnchorIgnored]:
+			behaviour = trustAnchorApplied
+		case !behaviours[property][trustAnchorApplied]:
+			behaviour = trustAnchorIgnored
+		}
+		recorder.setTrustAnchorBehaviour(property, behaviour)
+		fmt.Printf("Trust anchor %s: %s\n", property, behaviour)
+	}
+
+	return len(expectations.Expects), numFailures, nil
+}
+
+// verifyTrustAnchor verifies the chain at pathPrefix, as verifyHostname does,
+// against the root at pathPrefix + ".root" alone.
+func verifyTrustAnchor(pathPrefix, hostname string) error {
+	rootChain, err := readPEMChain(pathPrefix + ".root")
+	if err != nil {
+		return err
+	}
+	if len(rootChain) != 1 {
+		return fmt.Errorf("expected a single root in the .root file, but found %d", len(rootChain))
+	}
+
+	rootPool := x509.NewCertPool()
+	rootPool.AddCert(rootChain[0])
+	return verifyHostname(pathPrefix, hostname, rootPool)
+}
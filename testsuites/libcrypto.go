@@ -0,0 +1,223 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build cgo && (boringssl || awslc)
+
+package main
+
+/*
+#cgo LDFLAGS: -lcrypto
+#cgo boringssl CFLAGS: -DBETTERTLS_BORINGSSL
+#cgo awslc CFLAGS: -DBETTERTLS_AWSLC
+
+#include <stdlib.h>
+#include <string.h>
+#include <openssl/base.h>
+#include <openssl/crypto.h>
+#include <openssl/x509.h>
+#include <openssl/x509v3.h>
+
+// AWS-LC defines OPENSSL_IS_BORINGSSL too, so the two are told apart by
+// OPENSSL_IS_AWSLC.
+#if defined(BETTERTLS_AWSLC)
+#if !defined(OPENSSL_IS_AWSLC)
+#error "-tags awslc needs AWS-LC's headers; set CGO_CFLAGS and CGO_LDFLAGS to its include and lib directories"
+#endif
+#define LIBCRYPTO_TAG "awslc"
+#define LIBCRYPTO_NAME "AWS-LC"
+#define LIBCRYPTO_VERSION AWSLC_VERSION_NUMBER_STRING
+#elif defined(BETTERTLS_BORINGSSL)
+#if !defined(OPENSSL_IS_BORINGSSL) || defined(OPENSSL_IS_AWSLC)
+#error "-tags boringssl needs BoringSSL's headers; set CGO_CFLAGS and CGO_LDFLAGS to its include and build directories"
+#endif
+#define LIBCRYPTO_TAG "boringssl"
+#define LIBCRYPTO_NAME "BoringSSL"
+// BoringSSL isn't released in versions.
+#define LIBCRYPTO_VERSION ""
+#else
+#error "libcrypto.go must be built with -tags boringssl or -tags awslc"
+#endif
+
+static const char *libcryptoTag(void) {
+	return LIBCRYPTO_TAG;
+}
+
+static const char *libcryptoName(void) {
+	return LIBCRYPTO_NAME;
+}
+
+static const char *libcryptoVersion(void) {
+	return LIBCRYPTO_VERSION;
+}
+
+// newStore returns a store that trusts only the root in rootDER, or NULL if it
+// couldn't be parsed.
+static X509_STORE *newStore(const unsigned char *rootDER, long rootLen) {
+	X509 *root = d2i_X509(NULL, &rootDER, rootLen);
+	if (root == NULL) {
+		return NULL;
+	}
+	X509_STORE *store = X509_STORE_new();
+	if (store != NULL && !X509_STORE_add_cert(store, root)) {
+		X509_STORE_free(store);
+		store = NULL;
+	}
+	X509_free(root);
+	return store;
+}
+
+// verify returns X509_V_OK if the n certificates in ders, the leaf followed by
+// the others presented, chain to the root in store and are valid for
+// hostname, checked as a TLS client checks a server's chain. Otherwise it
+// returns the X509_V_ERR code and sets *depth to the depth of the certificate
+// at fault, or returns -1 and sets *depth to the index of a certificate that
+// couldn't be parsed.
+static int verify(X509_STORE *store, const unsigned char *ders, const long *lens, int n, const char *hostname, int *depth) {
+	int ret = -1;
+	X509 *leaf = NULL;
+	STACK_OF(X509) *untrusted = sk_X509_new_null();
+	X509_STORE_CTX *ctx = NULL;
+
+	for (int i = 0; i < n; i++) {
+		const unsigned char *der = ders;
+		X509 *cert = d2i_X509(NULL, &der, lens[i]);
+		ders += lens[i];
+		if (cert == NULL) {
+			*depth = i;
+			goto done;
+		}
+		if (i == 0) {
+			leaf = cert;
+		} else if (!sk_X509_push(untrusted, cert)) {
+			X509_free(cert);
+			*depth = i;
+			goto done;
+		}
+	}
+
+	ctx = X509_STORE_CTX_new();
+	if (ctx == NULL || !X509_STORE_CTX_init(ctx, store, leaf, untrusted)) {
+		*depth = 0;
+		goto done;
+	}
+	// This sets the purpose and trust settings that libssl uses to verify
+	// a server's chain.
+	X509_STORE_CTX_set_default(ctx, "ssl_server");
+	X509_VERIFY_PARAM_set1_host(X509_STORE_CTX_get0_param(ctx), hostname, strlen(hostname));
+
+	if (X509_verify_cert(ctx) == 1) {
+		ret = X509_V_OK;
+	} else {
+		ret = X509_STORE_CTX_get_error(ctx);
+		*depth = X509_STORE_CTX_get_error_depth(ctx);
+	}
+
+done:
+	if (ctx != NULL) X509_STORE_CTX_free(ctx);
+	sk_X509_pop_free(untrusted, X509_free);
+	if (leaf != NULL) X509_free(leaf);
+	return ret;
+}
+*/
+import "C"
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// libcryptoVerifier verifies certificates with X509_verify_cert from the
+// BoringSSL or AWS-LC libcrypto that this file was built against, with a store
+// that trusts only the corpus root. Both number their X509_V_ERR codes as
+// OpenSSL did before 3.0, so errors are named with legacyVerifyErrors and
+// classified with the "openssl" taxonomy.
+type libcryptoVerifier struct {
+	store *C.X509_STORE
+}
+
+func init() {
+	newLibcryptoVerifier = newX509StoreVerifier
+	libcryptoImplementation = C.GoString(C.libcryptoTag())
+}
+
+func newX509StoreVerifier(root *x509.Certificate) (platformVerifier, error) {
+	store := C.newStore((*C.uchar)(&root.Raw[0]), C.long(len(root.Raw)))
+	if store == nil {
+		return nil, errors.New("the root couldn't be added to an X509_STORE")
+	}
+	return &libcryptoVerifier{store: store}, nil
+}
+
+func (v *libcryptoVerifier) name() string {
+	return C.GoString(C.libcryptoName())
+}
+
+// version returns AWS-LC's version, e.g. "1.34.2", or "" for BoringSSL.
+func (v *libcryptoVerifier) version() string {
+	return C.GoString(C.libcryptoVersion())
+}
+
+func (v *libcryptoVerifier) taxonomy() string {
+	return "openssl"
+}
+
+func (v *libcryptoVerifier) close() {
+	C.X509_STORE_free(v.store)
+}
+
+func (v *libcryptoVerifier) verify(leaf *x509.Certificate, intermediates []*x509.Certificate, dnsName string) error {
+	rawChain := [][]byte{leaf.Raw}
+	for _, intermediate := range intermediates {
+		rawChain = append(rawChain, intermediate.Raw)
+	}
+	return v.verifyRaw(rawChain, dnsName)
+}
+
+// verifyRaw gives X509_verify_cert the certificates after the leaf as its
+// untrusted certificates, which it searches for issuers in the order
+// presented.
+func (v *libcryptoVerifier) verifyRaw(rawChain [][]byte, dnsName string) error {
+	if len(rawChain) == 0 {
+		return errors.New("no certificates were presented")
+	}
+
+	// The certificates are concatenated into a single buffer, since cgo
+	// can't pass C an array of Go pointers.
+	var ders []byte
+	var lens []C.long
+	for _, der := range rawChain {
+		ders = append(ders, der...)
+		lens = append(lens, C.long(len(der)))
+	}
+
+	hostname := C.CString(dnsName)
+	defer C.free(unsafe.Pointer(hostname))
+
+	var depth C.int
+	code := int(C.verify(v.store, (*C.uchar)(&ders[0]), &lens[0], C.int(len(lens)), hostname, &depth))
+	switch code {
+	case C.X509_V_OK:
+		return nil
+	case -1:
+		return fmt.Errorf("certificate %d couldn't be parsed or added to the chain", depth)
+	}
+
+	name, ok := legacyVerifyErrors[code]
+	if !ok {
+		name = fmt.Sprintf("X509_V_ERR_%d", code)
+	}
+	return fmt.Errorf("%s at depth %d: %s", name, depth, C.GoString(C.X509_verify_cert_error_string(C.long(code))))
+}
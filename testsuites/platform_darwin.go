@@ -0,0 +1,175 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+/*
+#cgo LDFLAGS: -framework CoreFoundation -framework Security
+
+#include <stdlib.h>
+#include <string.h>
+#include <CoreFoundation/CoreFoundation.h>
+#include <Security/Security.h>
+
+static char *copyErrorDescription(CFErrorRef error) {
+	if (error == NULL) {
+		return strdup("SecTrustEvaluateWithError failed without an error");
+	}
+	CFStringRef description = CFErrorCopyDescription(error);
+	CFIndex size = CFStringGetMaximumSizeForEncoding(CFStringGetLength(description), kCFStringEncodingUTF8) + 1;
+	char *ret = malloc(size);
+	if (!CFStringGetCString(description, ret, size, kCFStringEncodingUTF8)) {
+		ret[0] = 0;
+	}
+	CFRelease(description);
+	return ret;
+}
+
+// evaluate returns one if the n certificates in ders, the leaf followed by the
+// intermediates, chain to the root in rootDER and are valid for hostname.
+// Otherwise it returns zero and sets *errOut to a description, which the
+// caller must free.
+static int evaluate(const unsigned char *ders, const long *lens, int n, const unsigned char *rootDER, long rootLen, const char *hostname, char **errOut) {
+	int trusted = 0;
+	CFMutableArrayRef certs = CFArrayCreateMutable(NULL, n, &kCFTypeArrayCallBacks);
+	SecCertificateRef root = NULL;
+	CFArrayRef anchors = NULL;
+	CFStringRef name = NULL;
+	SecPolicyRef policy = NULL;
+	SecTrustRef trust = NULL;
+	CFErrorRef error = NULL;
+
+	for (int i = 0; i < n; i++) {
+		CFDataRef data = CFDataCreate(NULL, ders, lens[i]);
+		SecCertificateRef cert = SecCertificateCreateWithData(NULL, data);
+		CFRelease(data);
+		ders += lens[i];
+		if (cert == NULL) {
+			*errOut = strdup("SecCertificateCreateWithData failed");
+			goto done;
+		}
+		CFArrayAppendValue(certs, cert);
+		CFRelease(cert);
+	}
+
+	CFDataRef rootData = CFDataCreate(NULL, rootDER, rootLen);
+	root = SecCertificateCreateWithData(NULL, rootData);
+	CFRelease(rootData);
+	if (root == NULL) {
+		*errOut = strdup("SecCertificateCreateWithData failed for the root");
+		goto done;
+	}
+	anchors = CFArrayCreate(NULL, (const void **)&root, 1, &kCFTypeArrayCallBacks);
+
+	name = CFStringCreateWithCString(NULL, hostname, kCFStringEncodingUTF8);
+	policy = SecPolicyCreateSSL(true, name);
+	if (SecTrustCreateWithCertificates(certs, policy, &trust) != errSecSuccess) {
+		*errOut = strdup("SecTrustCreateWithCertificates failed");
+		goto done;
+	}
+	SecTrustSetAnchorCertificates(trust, anchors);
+	SecTrustSetAnchorCertificatesOnly(trust, true);
+	SecTrustSetNetworkFetchAllowed(trust, false);
+
+	if (SecTrustEvaluateWithError(trust, &error)) {
+		trusted = 1;
+	} else {
+		*errOut = copyErrorDescription(error);
+	}
+
+done:
+	if (error != NULL) CFRelease(error);
+	if (trust != NULL) CFRelease(trust);
+	if (policy != NULL) CFRelease(policy);
+	if (name != NULL) CFRelease(name);
+	if (anchors != NULL) CFRelease(anchors);
+	if (root != NULL) CFRelease(root);
+	CFRelease(certs);
+	return trusted;
+}
+*/
+import "C"
+
+import (
+	"crypto/x509"
+	"errors"
+	"os/exec"
+	"strings"
+	"unsafe"
+)
+
+// securityFrameworkVerifier verifies certificates with SecTrust, anchored to
+// only the corpus root and with network fetches disabled.
+type securityFrameworkVerifier struct {
+	root []byte
+}
+
+func init() {
+	newPlatformVerifier = newSecurityFrameworkVerifier
+}
+
+func newSecurityFrameworkVerifier(root *x509.Certificate) (platformVerifier, error) {
+	return &securityFrameworkVerifier{root: root.Raw}, nil
+}
+
+func (v *securityFrameworkVerifier) name() string {
+	return "macOS Security.framework"
+}
+
+// version returns the macOS version, e.g. "14.4.1".
+func (v *securityFrameworkVerifier) version() string {
+	output, err := exec.Command("sw_vers", "-productVersion").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func (v *securityFrameworkVerifier) close() {}
+
+func (v *securityFrameworkVerifier) verify(leaf *x509.Certificate, intermediates []*x509.Certificate, dnsName string) error {
+	rawChain := [][]byte{leaf.Raw}
+	for _, intermediate := range intermediates {
+		rawChain = append(rawChain, intermediate.Raw)
+	}
+	return v.verifyRaw(rawChain, dnsName)
+}
+
+// verifyRaw gives SecTrust the certificates in the order presented, which it
+// searches for issuers in that order.
+func (v *securityFrameworkVerifier) verifyRaw(rawChain [][]byte, dnsName string) error {
+	if len(rawChain) == 0 {
+		return errors.New("no certificates were presented")
+	}
+
+	// The certificates are concatenated into a single buffer, since cgo
+	// can't pass C an array of Go pointers.
+	var ders []byte
+	var lens []C.long
+	for _, der := range rawChain {
+		ders = append(ders, der...)
+		lens = append(lens, C.long(len(der)))
+	}
+
+	hostname := C.CString(dnsName)
+	defer C.free(unsafe.Pointer(hostname))
+
+	var errOut *C.char
+	if C.evaluate((*C.uchar)(&ders[0]), &lens[0], C.int(len(lens)), (*C.uchar)(&v.root[0]), C.long(len(v.root)), hostname, &errOut) == 1 {
+		return nil
+	}
+	defer C.free(unsafe.Pointer(errOut))
+
+	return errors.New(C.GoString(errOut))
+}
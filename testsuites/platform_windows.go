@@ -0,0 +1,256 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	crypt32                              = syscall.NewLazyDLL("crypt32.dll")
+	procCertCreateCertificateChainEngine = crypt32.NewProc("CertCreateCertificateChainEngine")
+	procCertFreeCertificateChainEngine   = crypt32.NewProc("CertFreeCertificateChainEngine")
+
+	ntdll                      = syscall.NewLazyDLL("ntdll.dll")
+	procRtlGetNtVersionNumbers = ntdll.NewProc("RtlGetNtVersionNumbers")
+)
+
+const (
+	// certChainDisableAuthRootAutoUpdate stops the chain engine from
+	// fetching roots from Windows Update.
+	certChainDisableAuthRootAutoUpdate = 0x00000100
+	// certChainCacheOnlyURLRetrieval stops CertGetCertificateChain from
+	// fetching anything over the network.
+	certChainCacheOnlyURLRetrieval = 0x00000004
+	// certTrustIsPartialChain is CERT_TRUST_IS_PARTIAL_CHAIN, which the
+	// syscall package doesn't define.
+	certTrustIsPartialChain = 0x00010000
+)
+
+// certChainEngineConfig is CERT_CHAIN_ENGINE_CONFIG, which the syscall
+// package doesn't define, including the fields added in Windows 7.
+type certChainEngineConfig struct {
+	size                      uint32
+	restrictedRoot            syscall.Handle
+	restrictedTrust           syscall.Handle
+	restrictedOther           syscall.Handle
+	additionalStoreCount      uint32
+	additionalStores          *syscall.Handle
+	flags                     uint32
+	urlRetrievalTimeout       uint32
+	maximumCachedCertificates uint32
+	cycleDetectionModulus     uint32
+	exclusiveRoot             syscall.Handle
+	exclusiveTrustedPeople    syscall.Handle
+	exclusiveFlags            uint32
+}
+
+// trustErrors names the CERT_TRUST_* error status bits.
+var trustErrors = []struct {
+	bit  uint32
+	name string
+}{
+	{syscall.CERT_TRUST_IS_NOT_TIME_VALID, "IS_NOT_TIME_VALID"},
+	{syscall.CERT_TRUST_IS_REVOKED, "IS_REVOKED"},
+	{syscall.CERT_TRUST_IS_NOT_SIGNATURE_VALID, "IS_NOT_SIGNATURE_VALID"},
+	{syscall.CERT_TRUST_IS_NOT_VALID_FOR_USAGE, "IS_NOT_VALID_FOR_USAGE"},
+	{syscall.CERT_TRUST_IS_UNTRUSTED_ROOT, "IS_UNTRUSTED_ROOT"},
+	{syscall.CERT_TRUST_REVOCATION_STATUS_UNKNOWN, "REVOCATION_STATUS_UNKNOWN"},
+	{syscall.CERT_TRUST_IS_CYCLIC, "IS_CYCLIC"},
+	{syscall.CERT_TRUST_INVALID_EXTENSION, "INVALID_EXTENSION"},
+	{syscall.CERT_TRUST_INVALID_POLICY_CONSTRAINTS, "INVALID_POLICY_CONSTRAINTS"},
+	{syscall.CERT_TRUST_INVALID_BASIC_CONSTRAINTS, "INVALID_BASIC_CONSTRAINTS"},
+	{syscall.CERT_TRUST_INVALID_NAME_CONSTRAINTS, "INVALID_NAME_CONSTRAINTS"},
+	{syscall.CERT_TRUST_HAS_NOT_SUPPORTED_NAME_CONSTRAINT, "HAS_NOT_SUPPORTED_NAME_CONSTRAINT"},
+	{syscall.CERT_TRUST_HAS_NOT_DEFINED_NAME_CONSTRAINT, "HAS_NOT_DEFINED_NAME_CONSTRAINT"},
+	{syscall.CERT_TRUST_HAS_NOT_PERMITTED_NAME_CONSTRAINT, "HAS_NOT_PERMITTED_NAME_CONSTRAINT"},
+	{syscall.CERT_TRUST_HAS_EXCLUDED_NAME_CONSTRAINT, "HAS_EXCLUDED_NAME_CONSTRAINT"},
+	{syscall.CERT_TRUST_IS_OFFLINE_REVOCATION, "IS_OFFLINE_REVOCATION"},
+	{syscall.CERT_TRUST_NO_ISSUANCE_CHAIN_POLICY, "NO_ISSUANCE_CHAIN_POLICY"},
+	{syscall.CERT_TRUST_IS_EXPLICIT_DISTRUST, "IS_EXPLICIT_DISTRUST"},
+	{syscall.CERT_TRUST_HAS_NOT_SUPPORTED_CRITICAL_EXT, "HAS_NOT_SUPPORTED_CRITICAL_EXT"},
+	{certTrustIsPartialChain, "IS_PARTIAL_CHAIN"},
+}
+
+// cryptoAPIVerifier verifies certificates with CertGetCertificateChain and
+// the SSL chain policy, using a chain engine that trusts only the corpus
+// root.
+type cryptoAPIVerifier struct {
+	rootStore syscall.Handle
+	engine    syscall.Handle
+}
+
+func init() {
+	newPlatformVerifier = newCryptoAPIVerifier
+}
+
+func newCryptoAPIVerifier(root *x509.Certificate) (platformVerifier, error) {
+	rootStore, err := newMemoryStore(root)
+	if err != nil {
+		return nil, err
+	}
+
+	config := certChainEngineConfig{
+		flags:         certChainDisableAuthRootAutoUpdate,
+		exclusiveRoot: rootStore,
+	}
+	config.size = uint32(unsafe.Sizeof(config))
+
+	var engine syscall.Handle
+	if r, _, err := procCertCreateCertificateChainEngine.Call(uintptr(unsafe.Pointer(&config)), uintptr(unsafe.Pointer(&engine))); r == 0 {
+		syscall.CertCloseStore(rootStore, 0)
+		return nil, fmt.Errorf("CertCreateCertificateChainEngine: %s", err)
+	}
+
+	return &cryptoAPIVerifier{rootStore: rootStore, engine: engine}, nil
+}
+
+func (v *cryptoAPIVerifier) name() string {
+	return "Windows CryptoAPI"
+}
+
+// version returns the Windows version, e.g. "10.0.19045". It's read with
+// RtlGetNtVersionNumbers, since GetVersion reports 6.2 to programs without a
+// manifest.
+func (v *cryptoAPIVerifier) version() string {
+	var major, minor, build uint32
+	procRtlGetNtVersionNumbers.Call(uintptr(unsafe.Pointer(&major)), uintptr(unsafe.Pointer(&minor)), uintptr(unsafe.Pointer(&build)))
+	if major == 0 {
+		return ""
+	}
+	// The high bits of the build number flag checked builds.
+	return fmt.Sprintf("%d.%d.%d", major, minor, build&0xffff)
+}
+
+func (v *cryptoAPIVerifier) close() {
+	procCertFreeCertificateChainEngine.Call(uintptr(v.engine))
+	syscall.CertCloseStore(v.rootStore, 0)
+}
+
+func (v *cryptoAPIVerifier) verify(leaf *x509.Certificate, intermediates []*x509.Certificate, dnsName string) error {
+	intermediateStore, err := newMemoryStore(intermediates...)
+	if err != nil {
+		return err
+	}
+	defer syscall.CertCloseStore(intermediateStore, 0)
+
+	leafContext, err := syscall.CertCreateCertificateContext(syscall.X509_ASN_ENCODING|syscall.PKCS_7_ASN_ENCODING, &leaf.Raw[0], uint32(len(leaf.Raw)))
+	if err != nil {
+		return fmt.Errorf("CertCreateCertificateContext: %s", err)
+	}
+	defer syscall.CertFreeCertificateContext(leafContext)
+
+	serverAuth := &syscall.OID_PKIX_KP_SERVER_AUTH[0]
+	para := syscall.CertChainPara{
+		RequestedUsage: syscall.CertUsageMatch{
+			Type: syscall.USAGE_MATCH_TYPE_AND,
+			Usage: syscall.CertEnhKeyUsage{
+				Length:           1,
+				UsageIdentifiers: &serverAuth,
+			},
+		},
+	}
+	para.Size = uint32(unsafe.Sizeof(para))
+
+	var chainContext *syscall.CertChainContext
+	if err := syscall.CertGetCertificateChain(v.engine, leafContext, nil, intermediateStore, &para, certChainCacheOnlyURLRetrieval, 0, &chainContext); err != nil {
+		return fmt.Errorf("CertGetCertificateChain: %s", err)
+	}
+	defer syscall.CertFreeCertificateChain(chainContext)
+
+	if status := chainContext.TrustStatus.ErrorStatus; status != syscall.CERT_TRUST_NO_ERROR {
+		var names []string
+		for _, e := range trustErrors {
+			if status&e.bit != 0 {
+				names = append(names, e.name)
+			}
+		}
+		return fmt.Errorf("CertGetCertificateChain: trust error status 0x%x (%s)", status, strings.Join(names, ", "))
+	}
+
+	serverName, err := syscall.UTF16PtrFromString(dnsName)
+	if err != nil {
+		return err
+	}
+	sslPara := syscall.SSLExtraCertChainPolicyPara{
+		AuthType:   syscall.AUTHTYPE_SERVER,
+		ServerName: serverName,
+	}
+	sslPara.Size = uint32(unsafe.Sizeof(sslPara))
+
+	policyPara := syscall.CertChainPolicyPara{
+		ExtraPolicyPara: (syscall.Pointer)(unsafe.Pointer(&sslPara)),
+	}
+	policyPara.Size = uint32(unsafe.Sizeof(policyPara))
+
+	status := syscall.CertChainPolicyStatus{}
+	status.Size = uint32(unsafe.Sizeof(status))
+
+	if err := syscall.CertVerifyCertificateChainPolicy(syscall.CERT_CHAIN_POLICY_SSL, chainContext, &policyPara, &status); err != nil {
+		return fmt.Errorf("CertVerifyCertificateChainPolicy: %s", err)
+	}
+	if status.Error != 0 {
+		return fmt.Errorf("CertVerifyCertificateChainPolicy: %s", syscall.Errno(status.Error))
+	}
+
+	return nil
+}
+
+// verifyRaw parses the presented certificates and verifies them with verify.
+// CryptoAPI is given the intermediates as a store, as Schannel is, so their
+// order and any duplicates are lost either way.
+func (v *cryptoAPIVerifier) verifyRaw(rawChain [][]byte, dnsName string) error {
+	if len(rawChain) == 0 {
+		return fmt.Errorf("no certificates were presented")
+	}
+
+	certs := make([]*x509.Certificate, len(rawChain))
+	for i, der := range rawChain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("failed to parse presented certificate %d: %s", i, err)
+		}
+		certs[i] = cert
+	}
+	return v.verify(certs[0], certs[1:], dnsName)
+}
+
+// newMemoryStore returns an in-memory certificate store holding certs.
+func newMemoryStore(certs ...*x509.Certificate) (syscall.Handle, error) {
+	store, err := syscall.CertOpenStore(syscall.CERT_STORE_PROV_MEMORY, 0, 0, syscall.CERT_STORE_DEFER_CLOSE_UNTIL_LAST_FREE_FLAG, 0)
+	if err != nil {
+		return 0, fmt.Errorf("CertOpenStore: %s", err)
+	}
+
+	for _, cert := range certs {
+		context, err := syscall.CertCreateCertificateContext(syscall.X509_ASN_ENCODING|syscall.PKCS_7_ASN_ENCODING, &cert.Raw[0], uint32(len(cert.Raw)))
+		if err != nil {
+			syscall.CertCloseStore(store, 0)
+			return 0, fmt.Errorf("CertCreateCertificateContext: %s", err)
+		}
+		err = syscall.CertAddCertificateContextToStore(store, context, syscall.CERT_STORE_ADD_ALWAYS, nil)
+		syscall.CertFreeCertificateContext(context)
+		if err != nil {
+			syscall.CertCloseStore(store, 0)
+			return 0, fmt.Errorf("CertAddCertificateContextToStore: %s", err)
+		}
+	}
+
+	return store, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file is named so that it isn't matched by go_x509*.go, which
+// "go run" refuses to run with tests among them. Run it with
+// "go test -race pool_test.go go_x509*.go".
+
+package main
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pipelineKey identifies one call of runPipeline's test function.
+type pipelineKey struct {
+	id      int
+	testDNS bool
+}
+
+// TestRunPipelineStress runs many more tests than there are workers through
+// runPipeline, with many of them failing and the failures handled slowly, to
+// check that the workers and the handling of failures can't deadlock however
+// the two are interleaved, that every test runs once, that every failure is
+// handled once, and that no more tests run at once than the limit.
+func TestRunPipelineStress(t *testing.T) {
+	expects := make([]expectation, 2000)
+	for i := range expects {
+		expects[i].Id = i + 1
+	}
+	// Every DNS test of an even ID and every IP test of an ID divisible
+	// by three fails.
+	shouldFail := func(key pipelineKey) bool {
+		if key.testDNS {
+			return key.id%2 == 0
+		}
+		return key.id%3 == 0
+	}
+
+	for _, numWorkers := range []int{1, 4, 64} {
+		var running, maxRunning, handling int32
+		var lock sync.Mutex
+		calls := make(map[pipelineKey]int)
+		handled := make(map[pipelineKey]int)
+
+		done := make(chan int, 1)
+		go func() {
+			done <- runPipeline(expects, numWorkers, func(test *expectation) bool {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					max := atomic.LoadInt32(&maxRunning)
+					if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+						break
+					}
+				}
+				key := pipelineKey{test.Id, test.testDNS}
+				lock.Lock()
+				calls[key]++
+				lock.Unlock()
+				runtime.Gosched()
+				atomic.AddInt32(&running, -1)
+				return shouldFail(key)
+			}, func(failure expectation) {
+				if atomic.AddInt32(&handling, 1) != 1 {
+					t.Errorf("%d workers: failures were handled concurrently", numWorkers)
+				}
+				handled[pipelineKey{failure.Id, failure.testDNS}]++
+				runtime.Gosched()
+				atomic.AddInt32(&handling, -1)
+			})
+		}()
+
+		var numFailures int
+		select {
+		case numFailures = <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%d workers: the pipeline didn't finish within 10s", numWorkers)
+		}
+
+		if int(maxRunning) > numWorkers {
+			t.Errorf("%d workers: the pipeline ran %d tests at once", numWorkers, maxRunning)
+		}
+
+		wantFailures := 0
+		for _, e := range expects {
+			for _, testDNS := range []bool{false, true} {
+				key := pipelineKey{e.Id, testDNS}
+				if calls[key] != 1 {
+					t.Errorf("%d workers: #%d (DNS %t) was run %d times", numWorkers, key.id, key.testDNS, calls[key])
+				}
+				want := 0
+				if shouldFail(key) {
+					want = 1
+					wantFailures++
+				}
+				if handled[key] != want {
+					t.Errorf("%d workers: #%d (DNS %t) failure was handled %d times, but should have been %d", numWorkers, key.id, key.testDNS, handled[key], want)
+				}
+			}
+		}
+		if numFailures != wantFailures {
+			t.Errorf("%d workers: the pipeline counted %d failures, but there were %d", numWorkers, numFailures, wantFailures)
+		}
+	}
+}
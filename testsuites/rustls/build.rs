@@ -0,0 +1,33 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Records the version of rustls that the harness is built against, from
+// Cargo.lock, as RUSTLS_VERSION, since rustls doesn't export it.
+fn main() {
+    println!("cargo:rerun-if-changed=Cargo.lock");
+
+    let lock = std::fs::read_to_string("Cargo.lock").unwrap_or_default();
+    let version = lock
+        .split("[[package]]")
+        .find(|package| package.lines().any(|line| line.trim() == "name = \"rustls\""))
+        .and_then(|package| {
+            package.lines().find_map(|line| {
+                line.trim()
+                    .strip_prefix("version = \"")
+                    .map(|version| version.trim_end_matches('"').to_string())
+            })
+        })
+        .unwrap_or_default();
+    println!("cargo:rustc-env=RUSTLS_VERSION={}", version);
+}
@@ -0,0 +1,166 @@
+// Copyright 2017 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! An external harness for rustls, which verifies certificates as a rustls
+//! client does, with its WebPkiServerVerifier, and so with webpki. It speaks
+//! the line protocol documented in go_x509_external.go:
+//!
+//!     go run go_x509*.go external -results rustls.json rustls/target/release/bettertls-rustls
+//!
+//! Errors are reported as the Debug form of rustls's error, which names
+//! webpki's error where rustls has no equivalent, and are classified with the
+//! "rustls" table of errorTaxonomy.
+
+use std::error::Error;
+use std::io::{self, BufRead, Write};
+use std::sync::Arc;
+use std::time::Instant;
+
+use rustls::client::danger::ServerCertVerifier;
+use rustls::client::WebPkiServerVerifier;
+use rustls::crypto::ring;
+use rustls::pki_types::pem::PemObject;
+use rustls::pki_types::{CertificateDer, ServerName, UnixTime};
+use rustls::RootCertStore;
+use serde::{Deserialize, Serialize};
+
+#[derive(Deserialize)]
+struct Hello {
+    protocol: u32,
+}
+
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct Capabilities {
+    implementation: &'static str,
+    #[serde(skip_serializing_if = "str::is_empty")]
+    version: &'static str,
+    name_types: [&'static str; 2],
+    error_taxonomy: &'static str,
+    batch: bool,
+}
+
+#[derive(Deserialize)]
+struct Request {
+    id: i64,
+    #[serde(rename = "type")]
+    name_type: String,
+    name: String,
+    leaf: String,
+    chain: Vec<String>,
+    root: String,
+}
+
+#[derive(Serialize)]
+struct Response {
+    id: i64,
+    #[serde(rename = "type")]
+    name_type: String,
+    accepted: bool,
+    #[serde(skip_serializing_if = "String::is_empty")]
+    error: String,
+    nanos: u64,
+}
+
+fn main() -> Result<(), Box<dyn Error>> {
+    let stdin = io::stdin();
+    let mut lines = stdin.lock().lines();
+    let mut stdout = io::stdout().lock();
+
+    let hello: Hello = match lines.next() {
+        Some(line) => serde_json::from_str(&line?)?,
+        None => return Ok(()),
+    };
+    // Requests are verified and replied to in order, which suits both
+    // modes, but only protocol 2 drivers know of batch mode.
+    send(
+        &mut stdout,
+        &Capabilities {
+            implementation: "rustls",
+            version: env!("RUSTLS_VERSION"),
+            name_types: ["dns", "ip"],
+            error_taxonomy: "rustls",
+            batch: hello.protocol >= 2,
+        },
+    )?;
+
+    // Every test shares the corpus's root, so the verifier is only
+    // rebuilt if it changes.
+    let mut verifiers: Option<(String, Arc<WebPkiServerVerifier>)> = None;
+    for line in lines {
+        let line = line?;
+        if line.trim().is_empty() {
+            continue;
+        }
+        let request: Request = serde_json::from_str(&line)?;
+
+        let verifier = match &verifiers {
+            Some((root, verifier)) if *root == request.root => verifier.clone(),
+            _ => {
+                let verifier = new_verifier(&request.root)?;
+                verifiers = Some((request.root.clone(), verifier.clone()));
+                verifier
+            }
+        };
+
+        let start = Instant::now();
+        let result = verify(&verifier, &request);
+        let nanos = start.elapsed().as_nanos() as u64;
+
+        send(
+            &mut stdout,
+            &Response {
+                id: request.id,
+                name_type: request.name_type,
+                accepted: result.is_ok(),
+                error: result.err().unwrap_or_default(),
+                nanos,
+            },
+        )?;
+    }
+    Ok(())
+}
+
+fn send<T: Serialize>(stdout: &mut impl Write, message: &T) -> Result<(), Box<dyn Error>> {
+    serde_json::to_writer(&mut *stdout, message)?;
+    stdout.write_all(b"\n")?;
+    stdout.flush()?;
+    Ok(())
+}
+
+/// Returns a verifier that trusts root alone, as a client configured with
+/// only that root would.
+fn new_verifier(root: &str) -> Result<Arc<WebPkiServerVerifier>, Box<dyn Error>> {
+    let mut roots = RootCertStore::empty();
+    roots.add(CertificateDer::from_pem_slice(root.as_bytes())?)?;
+    Ok(WebPkiServerVerifier::builder_with_provider(Arc::new(roots), Arc::new(ring::default_provider())).build()?)
+}
+
+/// Verifies the request's leaf for its name, returning rustls's error if the
+/// leaf is rejected.
+fn verify(verifier: &WebPkiServerVerifier, request: &Request) -> Result<(), String> {
+    let leaf = CertificateDer::from_pem_slice(request.leaf.as_bytes()).map_err(|err| format!("parsing leaf: {:?}", err))?;
+    let intermediates = request
+        .chain
+        .iter()
+        .map(|pem| CertificateDer::from_pem_slice(pem.as_bytes()))
+        .collect::<Result<Vec<_>, _>>()
+        .map_err(|err| format!("parsing chain: {:?}", err))?;
+    let name = ServerName::try_from(request.name.as_str()).map_err(|err| format!("parsing name: {:?}", err))?;
+
+    verifier
+        .verify_server_cert(&leaf, &intermediates, &name, &[], UnixTime::now())
+        .map(|_| ())
+        .map_err(|err| format!("{:?}", err))
+}